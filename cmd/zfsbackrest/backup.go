@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 
+	"github.com/gargakshit/zfsbackrest/encryption"
 	"github.com/gargakshit/zfsbackrest/internal/util"
 	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
 	"github.com/gargakshit/zfsbackrest/repository"
@@ -11,6 +14,9 @@ import (
 )
 
 var backupType string
+var backupIgnoreMaintenance bool
+var backupTags []string
+var backupNote string
 
 var backupGuard *util.CommandGuard
 
@@ -25,6 +31,7 @@ var backupCmd = &cobra.Command{
 		backupGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
 			NeedsRoot:       true,
 			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
 		})
 		if err != nil {
 			slog.Error("Failed to initialize command guard", "error", err)
@@ -42,7 +49,22 @@ var backupCmd = &cobra.Command{
 			return fmt.Errorf("invalid backup type: %w", err)
 		}
 
-		slog.Info("Starting backup", "type", backupType)
+		tags, err := repository.ParseTags(backupTags)
+		if err != nil {
+			return err
+		}
+
+		if !backupIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("backup")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		slog.Info("Starting backup", "type", backupType, "tags", tags, "note", backupNote)
 
 		slog.Debug("Creating runner from existing repository", "config", cfg)
 		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
@@ -50,12 +72,45 @@ var backupCmd = &cobra.Command{
 			return fmt.Errorf("failed to create runner: %w", err)
 		}
 
-		err = runner.BackupAllManaged(cmd.Context(), &cfg.UploadConcurrency, repository.BackupType(backupType))
+		unlock, err := lockRepository(cmd.Context(), runner)
 		if err != nil {
-			return fmt.Errorf("failed to backup: %w", err)
+			return err
 		}
+		defer unlock()
 
-		return nil
+		if !backupIgnoreMaintenance && skipForRepositoryMaintenance("backup", runner.Store) {
+			return nil
+		}
+
+		// Fail before any snapshot is taken if the plugin of the recipient,
+		// or of the recovery recipient, is missing.
+		if err := encryption.CheckPlugin(runner.Store.Encryption.Age.RecipientPublicKey); err != nil {
+			return err
+		}
+		if err := encryption.CheckPlugin(runner.Store.Encryption.Age.RecoveryRecipientPublicKey); err != nil {
+			return err
+		}
+
+		// Clean up the uploads a forced exit aborted, and finish the backups
+		// an earlier run left spooled first, but don't let them hold up this
+		// one.
+		var resumeErr error
+		if err := runner.CleanupPartialUploads(cmd.Context()); err != nil {
+			resumeErr = fmt.Errorf("failed to clean up partial uploads: %w", err)
+		}
+		if err := runner.ResumeSpooled(cmd.Context()); err != nil {
+			resumeErr = errors.Join(resumeErr, fmt.Errorf("failed to resume spooled backups: %w", err))
+		}
+
+		err = runner.BackupAllManaged(cmd.Context(), &cfg.UploadConcurrency, repository.BackupType(backupType), zfsbackrest.BackupLabels{
+			Tags: tags,
+			Note: strings.TrimSpace(backupNote),
+		})
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to backup: %w", err), resumeErr)
+		}
+
+		return resumeErr
 	},
 }
 
@@ -71,4 +126,7 @@ func validateBackupType(backupType string) error {
 func init() {
 	rootCmd.AddCommand(backupCmd)
 	backupCmd.Flags().StringVar(&backupType, "type", "full", "The type of backup to start. Valid values are: full, diff, incr.")
+	backupCmd.Flags().StringArrayVar(&backupTags, "tag", nil, "Tag the backups, as key=value, e.g. reason=pre-upgrade. Can be repeated")
+	backupCmd.Flags().StringVar(&backupNote, "note", "", "Note on the backups, e.g. \"state before PostgreSQL 16 migration\". Edit it later with the note command")
+	backupCmd.Flags().BoolVar(&backupIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+var (
+	changeRateJSON   bool
+	changeRateWindow time.Duration
+	changeRateOutput tableOutput
+)
+
+var changeRateCmd = &cobra.Command{
+	Use:   "change-rate",
+	Short: "Show how fast datasets and the repository grow",
+	Long: `Show how fast datasets and the repository grow.
+
+Backups record the space used by their dataset, and the data written to it
+since the last backup. From the backups in the window, this shows per day how
+much is written to each dataset, how much its used space grows, and how much
+the repository grows, along with the average size of each type of backup. Use
+it to pick full, diff and incr cadences, and to predict repository growth.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := changeRateOutput.resolve(changeRateJSON); err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		rates := runner.Store.Backups.ChangeRates(changeRateWindow, time.Now())
+		if changeRateOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(rates)
+		}
+
+		if len(rates) == 0 && !changeRateOutput.tsv() {
+			fmt.Printf("No backups in the last %s.\n", changeRateWindow)
+			return nil
+		}
+
+		return renderChangeRates(rates, &changeRateOutput)
+	},
+}
+
+func renderChangeRates(rates []*repository.ChangeRate, out *tableOutput) error {
+	out.title("Change rates")
+
+	header := []string{"Dataset", "Backups", "Span", "Written/Day", "Used/Day", "Stored/Day", "Avg Full", "Avg Diff", "Avg Incr"}
+	var rows [][]string
+	var stored int64
+	for _, rate := range rates {
+		stored += rate.StoredPerDay
+		rows = append(rows, []string{
+			rate.Dataset,
+			fmt.Sprintf("%d", rate.Backups),
+			rate.Span.Round(time.Hour).String(),
+			humanize.Bytes(uint64(rate.WrittenPerDay)),
+			signedBytes(rate.UsedPerDay),
+			humanize.Bytes(uint64(rate.StoredPerDay)),
+			averageSize(rate, repository.BackupTypeFull),
+			averageSize(rate, repository.BackupTypeDiff),
+			averageSize(rate, repository.BackupTypeIncr),
+		})
+	}
+
+	if err := out.render(header, rows); err != nil {
+		return err
+	}
+
+	if !out.tsv() {
+		fmt.Printf("\nThe repository grows by about %s a day, %s in 30 days, not counting backups that expire.\n",
+			humanize.Bytes(uint64(stored)),
+			humanize.Bytes(uint64(stored*30)),
+		)
+	}
+
+	return nil
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + humanize.Bytes(uint64(-n))
+	}
+	return humanize.Bytes(uint64(n))
+}
+
+func averageSize(rate *repository.ChangeRate, typ repository.BackupType) string {
+	size, ok := rate.AverageSize[typ]
+	if !ok {
+		return "-"
+	}
+	return humanize.Bytes(uint64(size))
+}
+
+func init() {
+	rootCmd.AddCommand(changeRateCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	changeRateCmd.Flags().BoolVar(&changeRateJSON, "json", !isTerminal, "Output in JSON format")
+	changeRateCmd.Flags().DurationVar(&changeRateWindow, "window", 30*24*time.Hour, "Only use backups created in this window")
+	changeRateOutput.addFlags(changeRateCmd)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkStorageJSON      bool
+	checkStorageWriteTest bool
+)
+
+var checkStorageCmd = &cobra.Command{
+	Use:   "check-storage",
+	Short: "Check the repository's storage is reachable and usable",
+	Long: `Check the repository's storage is reachable and usable.
+
+Checks the storage, the cold storage if tiering is enabled, and every replica:
+that the bucket or container exists, that the credentials can list it and read
+the store, and that a probe object can be written, read back and deleted. It
+needs neither root nor ZFS, so it can validate a config before the first
+backup runs. Exits with an error if any check failed.
+
+Pass --write-test=false to only check reads.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		checks := zfsbackrest.StorageHealth(cmd.Context(), cfg, checkStorageWriteTest)
+		slog.Debug("Storage checks", "checks", checks)
+
+		if checkStorageJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+				return err
+			}
+		} else {
+			renderDoctorChecks(checks)
+		}
+
+		failed := 0
+		for _, check := range checks {
+			if check.Status == zfsbackrest.DoctorFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkStorageCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	checkStorageCmd.Flags().BoolVar(&checkStorageJSON, "json", !isTerminal, "Output in JSON format")
+	checkStorageCmd.Flags().BoolVar(&checkStorageWriteTest, "write-test", true, "Check the storage is writable, by writing, reading back and deleting a small object")
+}
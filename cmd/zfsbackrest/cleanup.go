@@ -12,6 +12,8 @@ import (
 // actions
 var cleanupOrphans bool
 var cleanupExpired bool
+var cleanupNoncurrentVersions bool
+var cleanupTrash bool
 
 // options
 var cleanupDryRun bool
@@ -19,6 +21,7 @@ var cleanupSkipPrerequisitesVerification bool
 var cleanupSkipOrphaning bool
 var cleanupSkipLocalSnapshotRemoval bool
 var cleanupSkipRemoteSnapshotRemoval bool
+var cleanupIgnoreMaintenance bool
 
 var cleanupGuard *util.CommandGuard
 
@@ -31,6 +34,7 @@ var cleanupCmd = &cobra.Command{
 		cleanupGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
 			NeedsRoot:       true,
 			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
 		})
 		if err != nil {
 			slog.Error("Failed to initialize command guard", "error", err)
@@ -50,11 +54,31 @@ var cleanupCmd = &cobra.Command{
 			slog.Info("Dry run enabled, no backups will be deleted. Set --dry-run=false to actually delete backups.")
 		}
 
+		if !cleanupIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("cleanup")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
 		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
 		if err != nil {
 			return fmt.Errorf("failed to create runner: %w", err)
 		}
 
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !cleanupIgnoreMaintenance && skipForRepositoryMaintenance("cleanup", runner.Store) {
+			return nil
+		}
+
 		opts := zfsbackrest.DeleteOpts{
 			SkipPrerequisitesVerification: cleanupSkipPrerequisitesVerification,
 			SkipOrphaning:                 cleanupSkipOrphaning,
@@ -79,7 +103,22 @@ var cleanupCmd = &cobra.Command{
 			}
 		}
 
-		if !cleanupOrphans && !cleanupExpired {
+		if cleanupNoncurrentVersions {
+			slog.Info("Purging noncurrent snapshot versions")
+			if err := runner.PurgeNoncurrentVersions(cmd.Context(), cleanupDryRun); err != nil {
+				return err
+			}
+		}
+
+		if cleanupTrash {
+			slog.Info("Purging the trash", "retention", cfg.Repository.Trash.Retention)
+			err := runner.PurgeDueFromTrash(cmd.Context(), zfsbackrest.PurgeOpts{DryRun: cleanupDryRun})
+			if err != nil {
+				return fmt.Errorf("failed to purge the trash: %w", err)
+			}
+		}
+
+		if !cleanupOrphans && !cleanupExpired && !cleanupNoncurrentVersions && !cleanupTrash {
 			slog.Error("No action specified. Please specify at least one action.")
 			return cmd.Help()
 		}
@@ -98,4 +137,7 @@ func init() {
 	cleanupCmd.Flags().BoolVar(&cleanupSkipLocalSnapshotRemoval, "skip-local-snapshot-removal", false, "Skip local snapshot removal")
 	cleanupCmd.Flags().BoolVar(&cleanupSkipRemoteSnapshotRemoval, "skip-remote-snapshot-removal", false, "Skip remote snapshot removal")
 	cleanupCmd.Flags().BoolVar(&cleanupExpired, "expired", false, "Cleanup expired backups")
+	cleanupCmd.Flags().BoolVar(&cleanupNoncurrentVersions, "noncurrent-versions", false, "Permanently remove noncurrent versions and delete markers of snapshots in versioned buckets")
+	cleanupCmd.Flags().BoolVar(&cleanupTrash, "trash", false, "Permanently remove backups that have been in the trash longer than repository.trash.retention")
+	cleanupCmd.Flags().BoolVar(&cleanupIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
 }
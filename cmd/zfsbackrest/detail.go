@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -11,23 +12,41 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/fatih/color"
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
 	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
 	"github.com/mattn/go-isatty"
+	"github.com/oklog/ulid/v2"
 	"github.com/olekukonko/tablewriter"
 	"github.com/olekukonko/tablewriter/tw"
 	"github.com/spf13/cobra"
 )
 
 var jsonDetail bool
+var detailOutput tableOutput
+var detailTags []string
+
 var detailCmd = &cobra.Command{
-	Use:     "detail",
-	Short:   "Show details about a backup repository",
-	Long:    `Show details about a backup repository.`,
-	Aliases: []string{"info", "status", "details"},
+	Use:   "detail",
+	Short: "Show details about a backup repository",
+	Long: `Show details about a backup repository.
+
+--columns selects the columns of the backups table, and --tag its backups.
+--format tsv prints only the backups table, without a header, for scripts.`,
+	Aliases: []string{"info", "details"},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		slog.Debug("Showing details about backup repository")
 
+		if err := detailOutput.resolve(jsonDetail); err != nil {
+			return err
+		}
+
+		tags, err := repository.ParseTagSelectors(detailTags)
+		if err != nil {
+			return &errclass.ValidationError{Subject: "tag", Err: err}
+		}
+
 		slog.Debug("Creating runner from existing repository", "config", cfg)
 		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
 		if err != nil {
@@ -35,19 +54,28 @@ var detailCmd = &cobra.Command{
 		}
 
 		store := runner.Store
-		if jsonDetail {
-			return json.NewEncoder(os.Stdout).Encode(store)
+		stats := store.Stats()
+		if detailOutput.json() {
+			warnVersionUsage(cmd.Context(), runner)
+			return json.NewEncoder(os.Stdout).Encode(struct {
+				*repository.Store
+				Stats *repository.Stats `json:"stats"`
+			}{store, stats})
+		}
+
+		if detailOutput.tsv() {
+			return renderBackupsTable(store, cfg, tags, &detailOutput)
 		}
 
-		if err := renderStoreInfo(store); err != nil {
+		if err := renderStoreInfo(store, stats); err != nil {
 			return err
 		}
 
-		if err := renderManagedDatasets(store); err != nil {
+		if err := renderManagedDatasets(store, stats); err != nil {
 			return err
 		}
 
-		if err := renderBackupsTable(store, cfg); err != nil {
+		if err := renderBackupsTable(store, cfg, tags, &detailOutput); err != nil {
 			return err
 		}
 
@@ -55,6 +83,15 @@ var detailCmd = &cobra.Command{
 			return err
 		}
 
+		if len(store.Trash) > 0 {
+			if err := renderTrashTable(store, cfg.Repository.Trash.Retention, &tableOutput{}); err != nil {
+				return err
+			}
+		}
+
+		renderRemoteUsage(cmd.Context(), runner)
+		renderVersionUsage(warnVersionUsage(cmd.Context(), runner))
+
 		return nil
 	},
 }
@@ -64,16 +101,13 @@ func init() {
 
 	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
 	detailCmd.Flags().BoolVar(&jsonDetail, "json", !isTerminal, "Output in JSON format")
+	detailCmd.Flags().StringArrayVar(&detailTags, "tag", nil, "Only show the backups with this tag in the backups table, as key=value, or key for any value. Can be repeated")
+	detailOutput.addFlags(detailCmd)
 }
 
-func renderStoreInfo(store *repository.Store) error {
+func renderStoreInfo(store *repository.Store, stats *repository.Stats) error {
 	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Store Info\n")
 
-	totalStorage := int64(0)
-	for _, b := range store.Backups {
-		totalStorage += b.Size
-	}
-
 	table := tablewriter.NewWriter(os.Stdout)
 	table.Header([]string{
 		"Version",
@@ -81,16 +115,33 @@ func renderStoreInfo(store *repository.Store) error {
 		"Backups",
 		"Orphans",
 		"Total Storage Used",
+		"Stored Size",
 		"Age public key",
+		"Maintenance",
 	})
 
+	recipient := store.Encryption.Age.RecipientPublicKey
+	if store.Encryption.Disabled() {
+		recipient = "none (not encrypted)"
+	}
+	if recovery := store.Encryption.Age.RecoveryRecipientPublicKey; recovery != "" {
+		recipient += "\nrecovery: " + recovery
+	}
+
+	maintenance := "off"
+	if store.Maintenance != nil {
+		maintenance = fmt.Sprintf("on since %s (%s)", store.Maintenance.Since.Format(time.RFC1123), store.Maintenance.Reason)
+	}
+
 	table.Append([]string{
 		fmt.Sprintf("%d", store.Version),
 		store.CreatedAt.Format(time.RFC1123),
-		fmt.Sprintf("%d", len(store.Backups)),
-		fmt.Sprintf("%d", len(store.Orphans)),
-		humanize.Bytes(uint64(totalStorage)),
-		store.Encryption.Age.RecipientPublicKey,
+		fmt.Sprintf("%d", stats.Backups),
+		fmt.Sprintf("%d", stats.Orphans),
+		humanize.Bytes(uint64(stats.Size)),
+		storedSize(stats.ObjectSize, stats.UnsizedObjects),
+		recipient,
+		maintenance,
 	})
 
 	table.Render()
@@ -98,44 +149,23 @@ func renderStoreInfo(store *repository.Store) error {
 	return nil
 }
 
-func renderManagedDatasets(store *repository.Store) error {
+func renderManagedDatasets(store *repository.Store, stats *repository.Stats) error {
 	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Managed Datasets\n")
 
-	storageUsedByDataset := make(map[string]int64)
-
-	completedFullBackupsByDataset := make(map[string]int)
-	completedDiffBackupsByDataset := make(map[string]int)
-	completedIncrementalBackupsByDataset := make(map[string]int)
-
-	lastBackupByDataset := make(map[string]time.Time)
-
-	for _, b := range store.Backups {
-		storageUsedByDataset[b.Dataset] += b.Size
-
-		switch b.Type {
-		case repository.BackupTypeFull:
-			completedFullBackupsByDataset[b.Dataset]++
-		case repository.BackupTypeDiff:
-			completedDiffBackupsByDataset[b.Dataset]++
-		case repository.BackupTypeIncr:
-			completedIncrementalBackupsByDataset[b.Dataset]++
-		}
-
-		if b.CreatedAt.After(lastBackupByDataset[b.Dataset]) {
-			lastBackupByDataset[b.Dataset] = b.CreatedAt
-		}
-	}
-
 	table := tablewriter.NewWriter(os.Stdout)
-	table.Header([]string{"Dataset", "Storage Used", "Full Backups", "Diff Backups", "Incr Backups", "Last Backup"})
+	table.Header([]string{"Dataset", "Storage Used", "Full Backups", "Diff Backups", "Incr Backups", "Chain Depth", "Orphans", "Oldest Backup", "Last Backup"})
 	for _, d := range store.ManagedDatasets {
+		ds := stats.Datasets[d]
 		table.Append([]string{
 			d,
-			humanize.Bytes(uint64(storageUsedByDataset[d])),
-			fmt.Sprintf("%d", completedFullBackupsByDataset[d]),
-			fmt.Sprintf("%d", completedDiffBackupsByDataset[d]),
-			fmt.Sprintf("%d", completedIncrementalBackupsByDataset[d]),
-			lastBackupByDataset[d].Format(time.RFC1123),
+			humanize.Bytes(uint64(ds.Size)),
+			fmt.Sprintf("%d", ds.Full),
+			fmt.Sprintf("%d", ds.Diff),
+			fmt.Sprintf("%d", ds.Incr),
+			fmt.Sprintf("%d", ds.ChainDepth),
+			fmt.Sprintf("%d", ds.Orphans),
+			backupTime(ds.Oldest),
+			backupTime(ds.Newest),
 		})
 	}
 
@@ -144,11 +174,31 @@ func renderManagedDatasets(store *repository.Store) error {
 	return nil
 }
 
-func renderBackupsTable(store *repository.Store, cfg *config.Config) error {
+// storedSize formats the size of the stored snapshot objects, noting the
+// backups it wasn't recorded for.
+func storedSize(size int64, unsized int) string {
+	if unsized == 0 {
+		return humanize.Bytes(uint64(size))
+	}
+
+	return fmt.Sprintf("%s (%d unrecorded)", humanize.Bytes(uint64(size)), unsized)
+}
+
+func backupTime(b *repository.Backup) string {
+	if b == nil {
+		return "never"
+	}
+
+	return b.CreatedAt.Format(time.RFC1123)
+}
+
+func renderBackupsTable(store *repository.Store, cfg *config.Config, tags []repository.TagSelector, out *tableOutput) error {
 	// Convert map to slice and sort by Dataset, then ID
 	var backupsSlice []*repository.Backup
-	for _, b := range store.Backups {
-		backupsSlice = append(backupsSlice, b)
+	for _, b := range store.Backups.All() {
+		if b.MatchAllTags(tags) {
+			backupsSlice = append(backupsSlice, b)
+		}
 	}
 
 	sort.Slice(backupsSlice, func(i, j int) bool {
@@ -159,12 +209,35 @@ func renderBackupsTable(store *repository.Store, cfg *config.Config) error {
 		return backupsSlice[i].Dataset < backupsSlice[j].Dataset
 	})
 
-	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Backups\n")
+	out.title("Backups")
 
-	table := tablewriter.NewWriter(os.Stdout).
-		Options(tablewriter.WithTrimSpace(tw.Off))
-	table.Header([]string{"Dataset", "Backup ID", "Backup Type", "Depends On", "Created At", "Size", "Expires In"})
+	var retentions map[ulid.ULID]*repository.Retention
+	var keptByTags map[ulid.ULID]repository.TagSelector
+	if cfg.Repository.Expiry.GFS.Enabled() {
+		var err error
+		retentions, err = gfsRetentions(store, &cfg.Repository.Expiry, "")
+		if err != nil {
+			return fmt.Errorf("failed to evaluate GFS retention: %w", err)
+		}
+	} else {
+		keep, err := repository.KeepTags(&cfg.Repository.Expiry)
+		if err != nil {
+			return err
+		}
+		keptByTags = store.Backups.KeptByTags(keep)
+	}
 
+	var lastChains map[ulid.ULID]bool
+	if cfg.Repository.Expiry.KeepLastChain {
+		var err error
+		lastChains, err = store.Backups.KeptByLastChains(store.ManagedDatasets)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := []string{"Dataset", "Backup ID", "Backup Type", "Depends On", "Created At", "Size", "Expires In", "Verified", "Host", "Tags", "Note"}
+	var rows [][]string
 	for _, b := range backupsSlice {
 		dependsOn := ""
 		if b.DependsOn != nil {
@@ -179,25 +252,59 @@ func renderBackupsTable(store *repository.Store, cfg *config.Config) error {
 			padding = "    "
 		}
 
-		timeTillExpiry, err := store.Backups.TimeTillExpiry(b.ID, &cfg.Repository.Expiry)
-		if err != nil {
-			return fmt.Errorf("failed to calculate time till expiry: %w", err)
+		var expiresIn string
+		if retentions != nil {
+			expiresIn = keptBy(retentions[b.ID], lastChains[b.ID])
+		} else if tag, ok := keptByTags[b.ID]; ok {
+			expiresIn = "kept (tag " + tag.String() + ")"
+		} else {
+			timeTillExpiry, err := store.Backups.TimeTillExpiry(b.ID, &cfg.Repository.Expiry)
+			if err != nil {
+				return fmt.Errorf("failed to calculate time till expiry: %w", err)
+			}
+			expiresIn = humanize.Time(time.Now().Add(timeTillExpiry))
+			if timeTillExpiry <= 0 && lastChains[b.ID] {
+				expiresIn = "kept (last chain)"
+			}
 		}
 
-		table.Append([]string{
+		rows = append(rows, []string{
 			padding + b.Dataset,
 			b.ID.String(),
 			padding + string(b.Type),
 			dependsOn,
 			b.CreatedAt.Format(time.RFC1123),
 			humanize.Bytes(uint64(b.Size)),
-			humanize.Time(time.Now().Add(timeTillExpiry)),
+			expiresIn,
+			verificationStatus(b),
+			originHost(b),
+			repository.FormatTags(b.Tags),
+			b.Note,
 		})
 	}
 
-	table.Render()
+	return out.render(header, rows, tablewriter.WithTrimSpace(tw.Off))
+}
 
-	return nil
+// originHost is the host a backup was taken on, or empty if it wasn't
+// recorded.
+func originHost(b *repository.Backup) string {
+	if b.Origin == nil {
+		return ""
+	}
+
+	return b.Origin.Host
+}
+
+func verificationStatus(b *repository.Backup) string {
+	switch {
+	case b.Damage != nil:
+		return color.HiRedString("DAMAGED %s", humanize.Time(b.Damage.DetectedAt))
+	case b.VerifiedAt != nil:
+		return humanize.Time(*b.VerifiedAt)
+	default:
+		return "never"
+	}
 }
 
 func renderOrphansTable(store *repository.Store) error {
@@ -239,3 +346,119 @@ func renderOrphansTable(store *repository.Store) error {
 
 	return nil
 }
+
+// renderRemoteUsage lists the objects of each storage tier and route, and
+// compares what they actually take up with the sizes recorded in the store.
+func renderRemoteUsage(ctx context.Context, runner *zfsbackrest.Runner) {
+	stores := runner.TierStores()
+
+	recorded := map[string]int64{}
+	runner.Store.View(func() {
+		for _, b := range runner.Store.Backups.All() {
+			if b.Route != "" {
+				recorded["route:"+b.Route] += b.Size
+				continue
+			}
+			recorded[string(b.StorageTier())] += b.Size
+		}
+	})
+
+	names := []string{string(repository.TierHot), string(repository.TierCold)}
+	for _, route := range runner.Routes {
+		names = append(names, route.StorageName())
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Remote Usage\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Storage", "Snapshots", "Manifests", "Store & History", "Other", "Total", "Recorded"})
+	for _, name := range names {
+		s, ok := stores[name]
+		if !ok {
+			continue
+		}
+
+		usage, err := storage.MeasureUsage(ctx, s)
+		if err != nil {
+			slog.Warn("Failed to measure remote usage", "storage", name, "error", err)
+			continue
+		}
+
+		total := usage.Total()
+		table.Append([]string{
+			name,
+			formatObjectUsage(usage.Snapshots),
+			formatObjectUsage(usage.Manifests),
+			formatObjectUsage(usage.Metadata),
+			formatObjectUsage(usage.Other),
+			formatObjectUsage(total),
+			humanize.Bytes(uint64(recorded[name])),
+		})
+	}
+
+	table.Render()
+}
+
+func formatObjectUsage(u storage.ObjectUsage) string {
+	return fmt.Sprintf("%s (%d)", humanize.Bytes(uint64(u.Bytes)), u.Objects)
+}
+
+// warnVersionUsage warns about noncurrent snapshot versions kept by
+// versioned buckets, and returns the usage of the storages that keep any.
+func warnVersionUsage(ctx context.Context, runner *zfsbackrest.Runner) map[string]*storage.VersionUsage {
+	inflated := map[string]*storage.VersionUsage{}
+	for tier, s := range runner.TierStores() {
+		versioned, ok := storage.As[storage.VersionedStore](s)
+		if !ok {
+			continue
+		}
+
+		usage, err := versioned.VersionUsage(ctx)
+		if err != nil {
+			slog.Warn("Failed to check bucket versioning", "tier", tier, "error", err)
+			continue
+		}
+
+		if usage.NoncurrentVersions == 0 && usage.DeleteMarkers == 0 {
+			continue
+		}
+
+		slog.Warn("Bucket versioning keeps deleted snapshots. Set purge_versions, or run cleanup --noncurrent-versions.",
+			"tier", tier,
+			"versioning", usage.Status,
+			"noncurrent_versions", usage.NoncurrentVersions,
+			"noncurrent_bytes", usage.NoncurrentBytes,
+			"delete_markers", usage.DeleteMarkers,
+		)
+		inflated[tier] = usage
+	}
+
+	return inflated
+}
+
+func renderVersionUsage(inflated map[string]*storage.VersionUsage) {
+	if len(inflated) == 0 {
+		return
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Noncurrent Versions\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Tier", "Versioning", "Noncurrent Versions", "Noncurrent Size", "Delete Markers"})
+	for _, tier := range []string{"hot", "cold"} {
+		usage, ok := inflated[tier]
+		if !ok {
+			continue
+		}
+
+		table.Append([]string{
+			tier,
+			usage.Status,
+			fmt.Sprintf("%d", usage.NoncurrentVersions),
+			humanize.Bytes(uint64(usage.NoncurrentBytes)),
+			fmt.Sprintf("%d", usage.DeleteMarkers),
+		})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var docsFormat string
+var docsOutput string
+
+var docsCmd = &cobra.Command{
+	Use:    "docs",
+	Short:  "Generate documentation",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var docsGenCmd = &cobra.Command{
+	Use:   "gen",
+	Short: "Generate man pages or markdown for all commands",
+	Long: `Generate man pages or markdown for all commands.
+
+Meant for packagers. Set SOURCE_DATE_EPOCH for reproducible man pages.`,
+	// Generating docs doesn't need a config file.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := os.MkdirAll(docsOutput, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+
+		root := cmd.Root()
+		root.DisableAutoGenTag = true
+
+		slog.Info("Generating docs", "format", docsFormat, "output", docsOutput)
+		switch docsFormat {
+		case "man":
+			return doc.GenManTree(root, &doc.GenManHeader{Title: "ZFSBACKREST", Section: "8", Source: "zfsbackrest " + version}, docsOutput)
+		case "markdown":
+			return doc.GenMarkdownTree(root, docsOutput)
+		default:
+			return &errclass.ValidationError{
+				Subject: "format",
+				Err:     fmt.Errorf("unknown format %q. Valid values are: man, markdown", docsFormat),
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(docsCmd)
+	docsCmd.AddCommand(docsGenCmd)
+
+	docsGenCmd.Flags().StringVar(&docsFormat, "format", "man", "The format to generate. Valid values are: man, markdown.")
+	docsGenCmd.Flags().StringVarP(&docsOutput, "output", "o", "docs", "The directory to write the docs to")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorJSON      bool
+	doctorWriteTest bool
+	doctorIdentity  identityFlags
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose the environment zfsbackrest runs in",
+	Long: `Diagnose the environment zfsbackrest runs in.
+
+Checks the zfs binary and its version, the health of the pools, whether
+zfsbackrest runs as root or has the ZFS permissions it needs delegated, the
+config, that the repository is reachable and readable, the clock skew to the
+repository, the process lock, and the repository's age recipient. Prints a
+report with a hint for every check that didn't pass, and exits with an error if
+any failed.
+
+Pass an age identity to check it matches the repository's recipient, and
+--write-test to check the repository is writable, by uploading and deleting a
+small object.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := zfsbackrest.DoctorOpts{
+			WriteTest: doctorWriteTest,
+			AgeOpts:   doctorIdentity.ageOpts(),
+		}
+
+		if doctorIdentity.set() {
+			identities, err := doctorIdentity.load()
+			if err != nil {
+				return err
+			}
+			opts.Identities = identities
+		}
+
+		checks := zfsbackrest.Doctor(cmd.Context(), cfg, opts)
+		slog.Debug("Doctor checks", "checks", checks)
+
+		if doctorJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+				return err
+			}
+		} else {
+			renderDoctorChecks(checks)
+		}
+
+		failed := 0
+		for _, check := range checks {
+			if check.Status == zfsbackrest.DoctorFail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+
+		return nil
+	},
+}
+
+func renderDoctorChecks(checks []*zfsbackrest.DoctorCheck) {
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Diagnostics\n")
+
+	statusColors := map[zfsbackrest.DoctorStatus]*color.Color{
+		zfsbackrest.DoctorPass: color.New(color.FgGreen),
+		zfsbackrest.DoctorWarn: color.New(color.FgYellow),
+		zfsbackrest.DoctorFail: color.New(color.FgRed, color.Bold),
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Check", "Status", "Detail", "Hint"})
+	for _, check := range checks {
+		table.Append([]string{
+			check.Name,
+			statusColors[check.Status].Sprint(check.Status),
+			check.Detail,
+			check.Hint,
+		})
+	}
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorIdentity.register(doctorCmd)
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", !isTerminal, "Output in JSON format")
+	doctorCmd.Flags().BoolVar(&doctorWriteTest, "write-test", false, "Check the repository is writable, by uploading and deleting a small object")
+}
@@ -19,6 +19,7 @@ var forceDestroySkipPrerequisitesVerification bool
 var forceDestroySkipOrphaning bool
 var forceDestroySkipLocalSnapshotRemoval bool
 var forceDestroySkipRemoteSnapshotRemoval bool
+var forceDestroySkipTrash bool
 
 var forceDestroyGuard *util.CommandGuard
 
@@ -33,6 +34,7 @@ children. Any options must be used with extreme caution.`,
 		forceDestroyGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
 			NeedsRoot:       true,
 			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
 		})
 		if err != nil {
 			slog.Error("Failed to initialize command guard", "error", err)
@@ -69,13 +71,19 @@ children. Any options must be used with extreme caution.`,
 			return err
 		}
 
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
 		snapshotID, err := ulid.ParseStrict(forceDestroySnapshotID)
 		if err != nil {
 			slog.Error("Failed to parse snapshot ID", "error", err)
 			return err
 		}
 
-		backup, ok := runner.Store.Backups[snapshotID]
+		backup, ok := runner.Store.Backups.Get(snapshotID)
 		if !ok {
 			slog.Error("Backup not found", "id", snapshotID)
 			return fmt.Errorf("backup not found")
@@ -87,10 +95,10 @@ children. Any options must be used with extreme caution.`,
 		}
 
 		children := runner.Store.Backups.GetAllChildren(snapshotID)
-		slog.Debug("Found children", "children", len(children))
+		slog.Debug("Found children", "children", children.Len())
 
 		slog.Warn("Snapshot will be destroyed", "id", snapshotID)
-		for _, child := range children {
+		for _, child := range children.All() {
 			slog.Warn("Snapshot will be destroyed", "id", child.ID)
 		}
 
@@ -104,6 +112,7 @@ children. Any options must be used with extreme caution.`,
 			SkipOrphaning:                 forceDestroySkipOrphaning,
 			SkipLocalSnapshotRemoval:      forceDestroySkipLocalSnapshotRemoval,
 			SkipRemoteSnapshotRemoval:     forceDestroySkipRemoteSnapshotRemoval,
+			SkipTrash:                     forceDestroySkipTrash,
 		})
 		if err != nil {
 			slog.Error("Failed to delete snapshot", "error", err)
@@ -124,4 +133,5 @@ func init() {
 	forceDestroyCmd.Flags().BoolVarP(&forceDestroySkipOrphaning, "skip-orphaning", "o", false, "Skip orphaning.")
 	forceDestroyCmd.Flags().BoolVarP(&forceDestroySkipLocalSnapshotRemoval, "skip-local-snapshot-removal", "l", false, "Skip removing local snapshot")
 	forceDestroyCmd.Flags().BoolVarP(&forceDestroySkipRemoteSnapshotRemoval, "skip-remote-snapshot-removal", "r", false, "Skip removing remote snapshot")
+	forceDestroyCmd.Flags().BoolVar(&forceDestroySkipTrash, "skip-trash", false, "Remove the remote snapshot right away instead of moving it to the trash")
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/mattn/go-isatty"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	historyJSON    bool
+	historyActions []string
+	historyDataset string
+	historyBackup  string
+	historySince   time.Duration
+	historyLimit   int
+	historyOutput  tableOutput
+)
+
+var auditActions = []repository.AuditAction{
+	repository.AuditBackupCreated,
+	repository.AuditBackupDeleted,
+	repository.AuditExpiryRun,
+	repository.AuditDatasetsChanged,
+	repository.AuditStoreRolledBack,
+	repository.AuditNoteChanged,
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the audit log of the operations that changed the repository",
+	Long: `Show the audit log of the operations that changed the repository.
+
+Every operation that changes the repository appends who ran it, on which host,
+when, and what it changed to an audit log in the repository: the backups it
+created and deleted, the expiry runs, the changes to the managed datasets and
+to the notes on backups, and the rollbacks of the store.
+Entries are shown oldest first.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := historyOutput.resolve(historyJSON); err != nil {
+			return err
+		}
+
+		filter := &repository.AuditFilter{Dataset: historyDataset}
+		for _, action := range historyActions {
+			if !slices.Contains(auditActions, repository.AuditAction(action)) {
+				return &errclass.ValidationError{Subject: "action", Err: fmt.Errorf("unknown action %q, expected one of %v", action, auditActions)}
+			}
+			filter.Actions = append(filter.Actions, repository.AuditAction(action))
+		}
+		if historyBackup != "" {
+			id, err := ulid.ParseStrict(historyBackup)
+			if err != nil {
+				return &errclass.ValidationError{Subject: "backup ID", Err: err}
+			}
+			filter.Backup = &id
+		}
+		if historySince > 0 {
+			filter.Since = time.Now().Add(-historySince)
+		}
+
+		strongStore, err := storage.NewStrongStore(cmd.Context(), &cfg.Repository)
+		if err != nil {
+			return fmt.Errorf("failed to create storage: %w", err)
+		}
+
+		entries, err := repository.LoadAudit(cmd.Context(), strongStore, filter)
+		if err != nil {
+			return err
+		}
+		if historyLimit > 0 && len(entries) > historyLimit {
+			entries = entries[len(entries)-historyLimit:]
+		}
+
+		if historyOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(entries)
+		}
+
+		return renderAudit(entries, &historyOutput)
+	},
+}
+
+func renderAudit(entries []repository.AuditEntry, out *tableOutput) error {
+	if len(entries) == 0 && !out.tsv() {
+		fmt.Println("No audit log entries.")
+		return nil
+	}
+
+	out.title("Audit Log")
+
+	header := []string{"Time", "Host", "User", "Operation", "Action", "Dataset", "Backup ID", "Backup Type", "Details"}
+	rows := make([][]string, len(entries))
+	for i, entry := range entries {
+		backup := ""
+		if entry.Backup != nil {
+			backup = entry.Backup.String()
+		}
+
+		rows[i] = []string{
+			entry.Time.Format(time.RFC1123),
+			entry.Host,
+			entry.User,
+			entry.Operation,
+			string(entry.Action),
+			entry.Dataset,
+			backup,
+			string(entry.Type),
+			entry.Details,
+		}
+	}
+
+	return out.render(header, rows)
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	historyCmd.Flags().BoolVar(&historyJSON, "json", !isTerminal, "Output in JSON format")
+	historyCmd.Flags().StringSliceVar(&historyActions, "action", nil, "Only show these actions: backup_created, backup_deleted, expiry_run, datasets_changed, store_rolled_back or note_changed")
+	historyCmd.Flags().StringVar(&historyDataset, "dataset", "", "Only show the entries of this dataset")
+	historyCmd.Flags().StringVar(&historyBackup, "backup", "", "Only show the entries of this backup ID")
+	historyCmd.Flags().DurationVar(&historySince, "since", 0, "Only show the entries of this long ago or later, e.g. 168h")
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 0, "Only show the last entries, 0 shows all")
+	historyOutput.addFlags(historyCmd)
+}
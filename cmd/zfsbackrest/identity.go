@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/manifoldco/promptui"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+// identityEnv holds an age identity for hosts where it shouldn't touch disk.
+const identityEnv = "ZFSBACKREST_AGE_IDENTITY"
+
+// identityFlags are the ways of providing age identities to commands that
+// decrypt. Identities from every --age-identity-file (a file, a directory of
+// files, or - for stdin), --ssh-agent and --vault are combined. The
+// ZFSBACKREST_AGE_IDENTITY environment variable is only used if neither is
+// set. Decryption tries each identity in turn.
+type identityFlags struct {
+	files          []string
+	passphraseFile string
+	sshAgent       bool
+	sshAgentKey    string
+	vault          bool
+	pluginTimeout  time.Duration
+}
+
+func (f *identityFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVarP(&f.files, "age-identity-file", "i", nil, "Path to an age identity file or a directory of them, or - to read it from stdin. Can be repeated")
+	cmd.Flags().StringVar(&f.passphraseFile, "passphrase-file", "", "Path to a file with the passphrase of encrypted age identity files (prompts if not set)")
+	cmd.Flags().BoolVar(&f.sshAgent, "ssh-agent", false, "Derive age identities from the Ed25519 keys in ssh-agent")
+	cmd.Flags().StringVar(&f.sshAgentKey, "ssh-agent-key", "", "SHA256 fingerprint or comment of the ssh-agent key to use (every Ed25519 key is tried if not set)")
+	cmd.Flags().BoolVar(&f.vault, "vault", false, "Fetch the age identity from HashiCorp Vault or OpenBao, as configured in [vault]")
+	cmd.Flags().DurationVar(&f.pluginTimeout, "plugin-timeout", 2*time.Minute, "How long to wait for an age plugin identity, e.g. for a hardware token touch (0 waits forever)")
+}
+
+// ageOpts returns the options for plugin identities. Plugin prompts are only
+// interactive if stdin is a terminal and isn't used for the identity.
+func (f *identityFlags) ageOpts() encryption.AgeOpts {
+	opts := encryption.AgeOpts{PluginTimeout: f.pluginTimeout}
+	if isatty.IsTerminal(os.Stdin.Fd()) && !slices.Contains(f.files, "-") {
+		opts.PluginUI = interactivePluginUI()
+	}
+
+	return opts
+}
+
+func interactivePluginUI() *plugin.ClientUI {
+	return &plugin.ClientUI{
+		DisplayMessage: func(name, message string) error {
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: %s\n", name, message)
+			return nil
+		},
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			p := promptui.Prompt{Label: fmt.Sprintf("age-plugin-%s: %s", name, prompt)}
+			if secret {
+				p.Mask = '*'
+			}
+
+			return p.Run()
+		},
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			items := []string{yes}
+			if no != "" {
+				items = append(items, no)
+			}
+
+			s := promptui.Select{Label: fmt.Sprintf("age-plugin-%s: %s", name, prompt), Items: items}
+			i, _, err := s.Run()
+			if err != nil {
+				return false, err
+			}
+
+			return i == 0, nil
+		},
+		WaitTimer: func(name string) {
+			fmt.Fprintf(os.Stderr, "age-plugin-%s: waiting on the plugin. You may need to touch your hardware token.\n", name)
+		},
+	}
+}
+
+// set reports whether any source of identities is set.
+func (f *identityFlags) set() bool {
+	_, ok := os.LookupEnv(identityEnv)
+	return len(f.files) > 0 || f.sshAgent || f.sshAgentKey != "" || f.vault || ok
+}
+
+// load returns the age identities from every source that is set. The first
+// one is the identity of the current recipient, if there is one.
+func (f *identityFlags) load() ([]string, error) {
+	var identities []string
+	for _, path := range f.files {
+		var read []string
+		var err error
+		if path == "-" {
+			read, err = readIdentityStdin(f.passphraseFile)
+		} else {
+			read, err = readIdentityPath(path, f.passphraseFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, read...)
+	}
+
+	if f.sshAgent || f.sshAgentKey != "" {
+		slog.Debug("Deriving age identities from ssh-agent", "ssh-agent-key", f.sshAgentKey)
+		derived, err := encryption.IdentitiesFromSSHAgent(f.sshAgentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, derived...)
+	}
+
+	if f.vault {
+		slog.Debug("Fetching age identity from vault", "address", cfg.Vault.Address)
+		read, err := encryption.IdentitiesFromVault(context.Background(), &cfg.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch age identity from vault: %w", err)
+		}
+
+		identities = append(identities, read...)
+	}
+
+	if len(identities) > 0 {
+		slog.Debug("Loaded age identities", "count", len(identities))
+		return identities, nil
+	}
+
+	if content, ok := os.LookupEnv(identityEnv); ok {
+		slog.Debug("Reading age identity from the environment", "env", identityEnv)
+		identities, err := encryption.ReadIdentities([]byte(content), identityPassphrase(identityEnv, f.passphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age identity from %s: %w", identityEnv, err)
+		}
+
+		return identities, nil
+	}
+
+	return nil, errIdentityRequired
+}
+
+var errIdentityRequired = fmt.Errorf("age identity is required. Please use --age-identity-file, --ssh-agent, --vault, or set %s", identityEnv)
+
+// loadOptional is like load, but returns no identities if no source is set,
+// as repositories initialized without encryption don't need any.
+func (f *identityFlags) loadOptional() ([]string, error) {
+	if !f.set() {
+		return nil, nil
+	}
+
+	return f.load()
+}
+
+// loadReadingStore is load, or loadOptional unless required, and has the
+// identities also read the store in cmd's context, if it is encrypted.
+func (f *identityFlags) loadReadingStore(cmd *cobra.Command, required bool) ([]string, error) {
+	load := f.loadOptional
+	if required {
+		load = f.load
+	}
+
+	identities, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.SetContext(repository.WithStoreIdentities(cmd.Context(), identities, f.ageOpts()))
+	return identities, nil
+}
+
+// decryption returns the encryption that decrypts the backups of store with
+// identities.
+func (f *identityFlags) decryption(store *repository.Store, identities []string) (encryption.Encryption, error) {
+	if len(identities) == 0 && !store.Encryption.Disabled() {
+		return nil, errIdentityRequired
+	}
+
+	slog.Debug("Creating encryption instance from age identities", "count", len(identities), "disabled", store.Encryption.Disabled())
+	enc, err := encryption.NewDecryption(identities, &store.Encryption, f.ageOpts())
+	if errors.Is(err, encryption.ErrIdentityMismatch) && (f.sshAgent || f.sshAgentKey != "") {
+		if sshErr := encryption.CheckSSHAgentRecipient(store.Encryption.Age.RecipientPublicKey); sshErr != nil {
+			return nil, sshErr
+		}
+	}
+
+	return enc, err
+}
+
+// readIdentityPath reads the age identities in the file at path, or in every
+// file of the directory at path. Hidden files are skipped.
+func readIdentityPath(path string, passphraseFile string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity file: %w", err)
+	}
+
+	if !info.IsDir() {
+		return readIdentityFile(path, passphraseFile)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity directory: %w", err)
+	}
+
+	var identities []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		read, err := readIdentityFile(filepath.Join(path, entry.Name()), passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, read...)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identity files in %s", path)
+	}
+
+	return identities, nil
+}
+
+// readIdentityFile reads the age identities at path. If the file is encrypted
+// with a passphrase, the passphrase is read from passphraseFile, or prompted
+// for if that's empty.
+func readIdentityFile(path string, passphraseFile string) ([]string, error) {
+	slog.Debug("Reading age identity file", "age-identity-file", path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity file: %w", err)
+	}
+
+	identities, err := encryption.ReadIdentities(content, identityPassphrase(path, passphraseFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity file %s: %w", path, err)
+	}
+
+	return identities, nil
+}
+
+// readIdentityStdin reads the age identity from stdin. Stdin is consumed by
+// then, so an encrypted identity needs its passphrase in a file.
+func readIdentityStdin(passphraseFile string) ([]string, error) {
+	slog.Debug("Reading age identity from stdin")
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity from stdin: %w", err)
+	}
+
+	passphrase := func() (string, error) {
+		if passphraseFile == "" {
+			return "", fmt.Errorf("the age identity on stdin is encrypted. Please use --passphrase-file to provide its passphrase")
+		}
+		return identityPassphrase("stdin", passphraseFile)()
+	}
+
+	identities, err := encryption.ReadIdentities(content, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age identity from stdin: %w", err)
+	}
+
+	return identities, nil
+}
+
+// readStoreIdentityFile reads the store identity file. It is read on every
+// run, so it can't be encrypted with a passphrase.
+func readStoreIdentityFile(path string) ([]string, error) {
+	slog.Debug("Reading store identity file", "identity-file", path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store identity file: %w", err)
+	}
+
+	identities, err := encryption.ReadIdentities(content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store identity file %s: %w", path, err)
+	}
+
+	return identities, nil
+}
+
+func identityPassphrase(path string, passphraseFile string) encryption.PassphraseFunc {
+	return func() (string, error) {
+		if passphraseFile != "" {
+			slog.Debug("Reading passphrase file", "passphrase-file", passphraseFile)
+			content, err := os.ReadFile(passphraseFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to read passphrase file: %w", err)
+			}
+
+			return strings.TrimRight(string(content), "\r\n"), nil
+		}
+
+		prompt := promptui.Prompt{
+			Label: fmt.Sprintf("Passphrase for %s", path),
+			Mask:  '*',
+		}
+
+		return prompt.Run()
+	}
+}
+
+var sshAgentRecipientKey string
+
+var sshAgentRecipientCmd = &cobra.Command{
+	Use:   "ssh-agent-recipient",
+	Short: "Print the age recipient derived from an ssh-agent key",
+	Long: `Print the age recipient derived from an Ed25519 key in ssh-agent.
+
+Use it as the age recipient of a new repository, then restore with --ssh-agent.
+The identity is derived by having the agent sign a fixed challenge, so it is
+only available while the key is loaded.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identity, err := encryption.IdentityFromSSHAgent(sshAgentRecipientKey)
+		if err != nil {
+			return err
+		}
+
+		parsed, err := age.ParseX25519Identity(identity)
+		if err != nil {
+			return fmt.Errorf("failed to parse derived identity: %w", err)
+		}
+
+		fmt.Println(parsed.Recipient().String())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshAgentRecipientCmd)
+
+	sshAgentRecipientCmd.Flags().StringVar(&sshAgentRecipientKey, "ssh-agent-key", "", "SHA256 fingerprint or comment of the ssh-agent key (needed if the agent holds several Ed25519 keys)")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var importMatch string
+var importFullEvery int
+var importDryRun bool
+var importJSON bool
+var importTags []string
+var importNote string
+var importIgnoreMaintenance bool
+
+var importGuard *util.CommandGuard
+
+var importCmd = &cobra.Command{
+	Use:   "import <dataset>",
+	Short: "Import existing snapshots of a dataset as backups",
+	Long: `Import existing snapshots of a dataset as backups.
+
+import uploads the snapshots of a managed dataset zfsbackrest didn't take, e.g.
+the ones sanoid or syncoid take, as backups with manifests, oldest first, so
+adopting zfsbackrest doesn't mean discarding their history. The first snapshot
+is imported as a full backup, and the others as diffs of it. With --full-every,
+a new full backup is imported every so many snapshots instead. --match selects
+the snapshots to import by a glob on their name after the @.
+
+Snapshots already backed up are skipped, so import can be run again to import
+newer snapshots. Imported snapshots are neither held nor destroyed by
+zfsbackrest, and backups can't be taken on top of them: take a full backup
+after importing. Retention applies to imported backups like to the others, by
+the time their snapshot was taken.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		importGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return importGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dataset := args[0]
+		slog.Debug("Import command", "dataset", dataset, "match", importMatch, "full-every", importFullEvery, "dry-run", importDryRun)
+
+		tags, err := repository.ParseTags(importTags)
+		if err != nil {
+			return err
+		}
+
+		if importDryRun {
+			slog.Info("Dry run enabled, nothing will be imported. Set --dry-run=false to actually import snapshots.")
+		}
+
+		if !importIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("import")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !importIgnoreMaintenance && skipForRepositoryMaintenance("import", runner.Store) {
+			return nil
+		}
+
+		if !importDryRun {
+			if err := encryption.CheckPlugin(runner.Store.Encryption.Age.RecipientPublicKey); err != nil {
+				return err
+			}
+			if err := encryption.CheckPlugin(runner.Store.Encryption.Age.RecoveryRecipientPublicKey); err != nil {
+				return err
+			}
+		}
+
+		imported, err := runner.Import(cmd.Context(), dataset, zfsbackrest.ImportOpts{
+			Match:     importMatch,
+			FullEvery: importFullEvery,
+			DryRun:    importDryRun,
+			Labels: zfsbackrest.BackupLabels{
+				Tags: tags,
+				Note: strings.TrimSpace(importNote),
+			},
+		})
+		if importJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(imported); err != nil {
+				return err
+			}
+		} else {
+			renderImportedSnapshots(imported)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import snapshots: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func renderImportedSnapshots(imported []*zfsbackrest.ImportedSnapshot) {
+	if len(imported) == 0 {
+		fmt.Println("No snapshots to import.")
+		return
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Snapshots\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Snapshot", "Created", "Type", "Backup ID", "Depends On", "Status"})
+	for _, s := range imported {
+		backup, dependsOn := "-", "-"
+		if s.Backup != nil {
+			backup = s.Backup.String()
+		}
+		if s.DependsOn != nil {
+			dependsOn = s.DependsOn.String()
+		}
+
+		typ := string(s.Type)
+		status := "planned"
+		switch {
+		case s.Skipped != "":
+			typ = "-"
+			status = color.YellowString("skipped: %s", s.Skipped)
+		case s.Imported:
+			status = color.GreenString("imported")
+		}
+
+		table.Append([]string{
+			s.Dataset + "@" + s.Snapshot,
+			s.Created.Format(time.RFC1123),
+			typ,
+			backup,
+			dependsOn,
+			status,
+		})
+	}
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	importCmd.Flags().StringVar(&importMatch, "match", "", "Only import the snapshots whose name after the @ matches this glob, e.g. autosnap_*_daily")
+	importCmd.Flags().IntVar(&importFullEvery, "full-every", 0, "Import a full backup every this many snapshots, and diffs of it in between. 0 imports only the first snapshot as a full backup")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", true, "Dry run")
+	importCmd.Flags().BoolVar(&importJSON, "json", !isTerminal, "Output in JSON format")
+	importCmd.Flags().StringArrayVar(&importTags, "tag", nil, "Tag the imported backups, as key=value, e.g. source=sanoid. Can be repeated")
+	importCmd.Flags().StringVar(&importNote, "note", "", "Note on the imported backups")
+	importCmd.Flags().BoolVar(&importIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
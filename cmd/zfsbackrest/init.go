@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 
@@ -13,18 +14,35 @@ import (
 )
 
 var ageRecipientPublicKey string
+var initRecoveryRecipient string
+var initNoEncryption bool
+var initAdopt bool
+var initForce bool
 
 var initGuard *util.CommandGuard
 
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize a new backup repository",
-	Long:  `Initialize a new backup repository.`,
+	Long: `Initialize a new backup repository.
+
+If the storage already has a repository, init refuses to overwrite it. Pass
+--adopt to use it as is, e.g. on a reinstalled host, or --force to overwrite it.
+Overwriting loses track of every backup in it.
+
+Pass --no-encryption instead of a recipient to store snapshots as zfs send
+writes them, e.g. on trusted on-premises storage. The store records the mode,
+and it can't be changed afterwards.
+
+Pass --recovery-recipient-public-key to also encrypt every backup to a
+recovery recipient, whose identity is kept offline. It can be changed later
+with keys recovery.`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		var err error
 		initGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
 			NeedsRoot:       true,
 			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
 		})
 		if err != nil {
 			slog.Error("Failed to initialize command guard", "error", err)
@@ -38,29 +56,57 @@ var initCmd = &cobra.Command{
 		return initGuard.OnExit()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if ageRecipientPublicKey == "" {
-			return fmt.Errorf("age recipient public key is required")
+		if ageRecipientPublicKey == "" && !initNoEncryption && !initAdopt {
+			return fmt.Errorf("age recipient public key is required. Pass --no-encryption to initialize the repository without encryption")
 		}
 
 		slog.Info("Initializing ZFS backup repository...")
 
-		err := encryption.ValidateRecipientPublicKey(ageRecipientPublicKey)
-		if err != nil {
-			return fmt.Errorf("invalid age recipient public key: %w", err)
+		if ageRecipientPublicKey != "" {
+			// SSH public keys are recorded without their comment.
+			ageRecipientPublicKey = encryption.NormalizeRecipient(ageRecipientPublicKey)
+			err := encryption.ValidateRecipientPublicKey(ageRecipientPublicKey)
+			if err != nil {
+				return fmt.Errorf("invalid age recipient public key: %w", err)
+			}
+		}
+
+		if initRecoveryRecipient != "" {
+			initRecoveryRecipient = encryption.NormalizeRecipient(initRecoveryRecipient)
+			if err := encryption.ValidateRecipientPublicKey(initRecoveryRecipient); err != nil {
+				return fmt.Errorf("invalid recovery recipient public key: %w", err)
+			}
+			if initRecoveryRecipient == ageRecipientPublicKey {
+				return fmt.Errorf("the recovery recipient must differ from the age recipient, or losing one identity loses both")
+			}
 		}
 
-		slog.Debug("Creating runner with new repository", "ageRecipientPublicKey", ageRecipientPublicKey)
+		slog.Debug("Creating runner with new repository", "ageRecipientPublicKey", ageRecipientPublicKey, "recoveryRecipient", initRecoveryRecipient)
 
-		_, err = zfsbackrest.NewRunnerWithNewRepository(context.Background(), cfg, config.Encryption{
+		encryptionConfig := config.Encryption{
 			Age: config.Age{
-				RecipientPublicKey: ageRecipientPublicKey,
+				RecipientPublicKey:         ageRecipientPublicKey,
+				RecoveryRecipientPublicKey: initRecoveryRecipient,
 			},
-		})
+		}
+		if initNoEncryption {
+			slog.Warn("Initializing the repository without encryption. Snapshots are stored as zfs send writes them.")
+			encryptionConfig.Mode = config.EncryptionModeNone
+		}
+
+		_, err := zfsbackrest.NewRunnerWithNewRepository(context.Background(), cfg, encryptionConfig, zfsbackrest.InitOpts{Adopt: initAdopt, Force: initForce})
+		if errors.Is(err, zfsbackrest.ErrRepositoryExists) {
+			return fmt.Errorf("%w. Pass --adopt to use it as is, or --force to overwrite it", err)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to create runner: %w", err)
 		}
 
-		slog.Info("Repository initialized successfully")
+		if initAdopt {
+			slog.Info("Existing repository adopted successfully")
+		} else {
+			slog.Info("Repository initialized successfully")
+		}
 
 		return nil
 	},
@@ -72,4 +118,11 @@ func init() {
 
 func init() {
 	initCmd.Flags().StringVar(&ageRecipientPublicKey, "age-recipient-public-key", "", "The public key to use for age encryption")
+	initCmd.Flags().BoolVar(&initAdopt, "adopt", false, "Use the repository that already exists in the storage as is")
+	initCmd.Flags().BoolVar(&initForce, "force", false, "Overwrite the repository that already exists in the storage")
+	initCmd.Flags().BoolVar(&initNoEncryption, "no-encryption", false, "Initialize the repository without encryption. It can't be enabled later")
+	initCmd.MarkFlagsMutuallyExclusive("adopt", "force")
+	initCmd.Flags().StringVar(&initRecoveryRecipient, "recovery-recipient-public-key", "", "A recipient every backup is also encrypted to, whose identity is kept offline")
+	initCmd.MarkFlagsMutuallyExclusive("age-recipient-public-key", "no-encryption")
+	initCmd.MarkFlagsMutuallyExclusive("recovery-recipient-public-key", "no-encryption")
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+)
+
+var keyEscrowIdentity identityFlags
+var keyEscrowPassphraseFile string
+var keyEscrowOutput string
+
+var keyEscrowStoreGuard *util.CommandGuard
+
+var keyEscrowCmd = &cobra.Command{
+	Use:   "key-escrow",
+	Short: "Keep the age identity in the repository, encrypted with a passphrase",
+	Long: `Keep the age identity in the repository, encrypted with a passphrase.
+
+Key escrow is opt-in. With it, losing the backup host doesn't also mean losing
+the only decryption key, as long as you remember the passphrase. Anyone with
+access to the repository can try to guess the passphrase offline, so pick a
+long one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var keyEscrowStoreCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Escrow the age identity in the repository",
+	Long: `Encrypt the age identity with a passphrase and store it in the repository,
+replacing any earlier escrow. The identity must match the repository's
+recipient.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		keyEscrowStoreGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return keyEscrowStoreGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		identities, err := keyEscrowIdentity.loadReadingStore(cmd, true)
+		if err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		identity, err := currentIdentity(identities, runner.Store.Encryption.Age.RecipientPublicKey)
+		if err != nil {
+			return err
+		}
+
+		passphrase, err := escrowPassphrase(keyEscrowPassphraseFile)
+		if err != nil {
+			return err
+		}
+
+		return repository.EscrowKey(cmd.Context(), runner.Storage, runner.Store, identity, passphrase)
+	},
+}
+
+var keyEscrowFetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Fetch the escrowed age identity from the repository",
+	Long: `Fetch the escrowed age identity from the repository. It stays encrypted
+with its passphrase, and can be passed to restore as is:
+
+  zfsbackrest key-escrow fetch -o key.age
+  zfsbackrest restore -i key.age ...
+
+It only needs the repository configuration, not the store.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		strongStore, err := storage.NewStrongStore(cmd.Context(), &cfg.Repository)
+		if err != nil {
+			return fmt.Errorf("failed to create storage: %w", err)
+		}
+
+		content, err := repository.LoadKeyEscrow(cmd.Context(), strongStore)
+		if err != nil {
+			return err
+		}
+
+		if keyEscrowOutput == "" || keyEscrowOutput == "-" {
+			_, err := os.Stdout.Write(content)
+			return err
+		}
+
+		if err := os.WriteFile(keyEscrowOutput, content, 0o600); err != nil {
+			return fmt.Errorf("failed to write escrowed key: %w", err)
+		}
+
+		slog.Info("Wrote escrowed key", "path", keyEscrowOutput)
+		return nil
+	},
+}
+
+// currentIdentity returns the identity matching recipient.
+func currentIdentity(identities []string, recipient string) (string, error) {
+	for _, identity := range identities {
+		r, err := encryption.RecipientFromIdentity(identity)
+		if err != nil {
+			continue
+		}
+
+		if r == recipient {
+			return identity, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the identities matches the repository recipient %s: %w", recipient, encryption.ErrIdentityMismatch)
+}
+
+// escrowPassphrase reads the escrow passphrase from passphraseFile, or
+// prompts for it twice.
+func escrowPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile != "" {
+		return identityPassphrase("", passphraseFile)()
+	}
+
+	prompt := promptui.Prompt{Label: "Escrow passphrase", Mask: '*'}
+	passphrase, err := prompt.Run()
+	if err != nil {
+		return "", err
+	}
+
+	confirm := promptui.Prompt{Label: "Repeat the escrow passphrase", Mask: '*'}
+	repeated, err := confirm.Run()
+	if err != nil {
+		return "", err
+	}
+
+	if passphrase != repeated {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+func init() {
+	rootCmd.AddCommand(keyEscrowCmd)
+	keyEscrowCmd.AddCommand(keyEscrowStoreCmd)
+	keyEscrowCmd.AddCommand(keyEscrowFetchCmd)
+
+	keyEscrowIdentity.register(keyEscrowStoreCmd)
+	keyEscrowStoreCmd.Flags().StringVar(&keyEscrowPassphraseFile, "escrow-passphrase-file", "", "Path to a file with the passphrase to encrypt the escrowed key with (prompts if not set)")
+
+	keyEscrowFetchCmd.Flags().StringVarP(&keyEscrowOutput, "output", "o", "", "Path to write the escrowed key to (stdout by default)")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var keysIdentity identityFlags
+var keysRotateRecipient string
+var keysRotateReencrypt bool
+var keysRecoveryRecipient string
+var keysRecoveryRemove bool
+var keysReencryptDryRun bool
+var keysReencryptWindow time.Duration
+var keysReencryptIgnoreMaintenance bool
+
+var keysGuard *util.CommandGuard
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Rotate the repository's age recipient",
+	Long: `Rotate the repository's age recipient.
+
+Every backup records the recipient it is encrypted to. After a rotation, new
+backups are encrypted to the new recipient, and the older ones stay encrypted
+to theirs until they are re-encrypted. Restores need an identity for every
+recipient still in use, which keys list shows.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+func keysPreRun(cmd *cobra.Command, args []string) error {
+	var err error
+	keysGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+		NeedsRoot:       true,
+		NeedsGlobalLock: true,
+		BreakStaleLock:  breakLock,
+	})
+	if err != nil {
+		slog.Error("Failed to initialize command guard", "error", err)
+		return fmt.Errorf("failed to initialize command guard: %w", err)
+	}
+
+	return nil
+}
+
+func keysPostRun(cmd *cobra.Command, args []string) error {
+	slog.Debug("Running post-run hook")
+	return keysGuard.OnExit()
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Make a new age recipient the recipient of new backups",
+	Long: `Make a new age recipient the recipient of new backups, and of the store.
+
+The previous recipient is recorded as retired. With --reencrypt, the existing
+backups are re-encrypted to the new recipient right away, which needs
+identities for their recipients and for the new one. Otherwise, run
+keys reencrypt later, e.g. from a timer.`,
+	PreRunE:  keysPreRun,
+	PostRunE: keysPostRun,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := encryption.ValidateRecipientPublicKey(keysRotateRecipient); err != nil {
+			return err
+		}
+
+		identities, err := keysIdentity.loadReadingStore(cmd, keysRotateReencrypt)
+		if err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// Check the identities before rotating, so a rotation isn't left
+		// without the re-encryption it was asked for.
+		var enc encryption.Encryption
+		if keysRotateReencrypt {
+			enc, err = encryption.NewAgeFromIdentities(identities, &config.Age{
+				RecipientPublicKey:         keysRotateRecipient,
+				RecoveryRecipientPublicKey: runner.Store.Encryption.Age.RecoveryRecipientPublicKey,
+			}, keysIdentity.ageOpts())
+			if err != nil {
+				return fmt.Errorf("failed to create encryption instance: %w", err)
+			}
+		}
+
+		if err := runner.RotateKey(cmd.Context(), keysRotateRecipient); err != nil {
+			return fmt.Errorf("failed to rotate key: %w", err)
+		}
+
+		if !keysRotateReencrypt {
+			slog.Info("Existing backups are still encrypted to their recipients. Run `zfsbackrest keys reencrypt` to re-encrypt them.")
+			return nil
+		}
+
+		runner.Encryption = enc
+		return runner.ReencryptBackups(cmd.Context(), zfsbackrest.ReencryptOpts{})
+	},
+}
+
+var keysRecoveryCmd = &cobra.Command{
+	Use:   "recovery",
+	Short: "Set the age recipient every backup is also encrypted to",
+	Long: `Set the recovery recipient, an age recipient every backup and the store are
+also encrypted to, or remove it with --remove.
+
+Keep the recovery identity offline, apart from the day-to-day one, e.g. printed
+or on a hardware token in a safe. If the day-to-day identity is lost, restore
+with the recovery identity alone, then rotate to a new recipient. Existing
+backups are encrypted to the recovery recipient once they are re-encrypted
+with keys reencrypt.`,
+	PreRunE:  keysPreRun,
+	PostRunE: keysPostRun,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if keysRecoveryRecipient == "" && !keysRecoveryRemove {
+			return fmt.Errorf("pass --recipient to set the recovery recipient, or --remove to remove it")
+		}
+
+		if _, err := keysIdentity.loadReadingStore(cmd, false); err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := runner.SetRecoveryKey(cmd.Context(), keysRecoveryRecipient); err != nil {
+			return fmt.Errorf("failed to set recovery key: %w", err)
+		}
+
+		slog.Info("Existing backups keep their recovery recipient. Run `zfsbackrest keys reencrypt` to update them.")
+		return nil
+	},
+}
+
+var keysReencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Re-encrypt backups to the repository's recipient",
+	Long: `Re-encrypt the backups that aren't encrypted to the repository's recipient and
+recovery recipient, oldest first.
+
+Each snapshot is checked against its checksum as it is read, and only replaced
+if it matched. Backups taken before recipients were recorded are re-encrypted
+too. The identities must decrypt the backups, and one of them must match the
+repository's recipient. Runs can be interrupted and picked up later, and
+--window bounds how long a run starts new backups. Replicas hold the previous
+copies until zfsbackrest replicate uploads the re-encrypted ones.`,
+	PreRunE:  keysPreRun,
+	PostRunE: keysPostRun,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if keysReencryptDryRun {
+			slog.Info("Dry run enabled, no backups will be re-encrypted. Set --dry-run=false to actually re-encrypt backups.")
+		}
+
+		if !keysReencryptIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("reencrypt")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		identities, err := keysIdentity.loadReadingStore(cmd, true)
+		if err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !keysReencryptIgnoreMaintenance && skipForRepositoryMaintenance("reencrypt", runner.Store) {
+			return nil
+		}
+
+		enc, err := encryption.NewAgeFromIdentities(identities, &runner.Store.Encryption.Age, keysIdentity.ageOpts())
+		if err != nil {
+			return fmt.Errorf("failed to create encryption instance: %w", err)
+		}
+		runner.Encryption = enc
+
+		return runner.ReencryptBackups(cmd.Context(), zfsbackrest.ReencryptOpts{
+			DryRun: keysReencryptDryRun,
+			Window: keysReencryptWindow,
+		})
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the recipients the backups are encrypted to",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := keysIdentity.loadReadingStore(cmd, false); err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		renderRecipients(runner.Store)
+		return nil
+	},
+}
+
+// renderRecipients lists the current and retired recipients of the
+// repository, and how many backups are encrypted to each.
+func renderRecipients(store *repository.Store) {
+	if store.Encryption.Disabled() {
+		fmt.Println("The repository was initialized without encryption, and has no recipients.")
+		return
+	}
+
+	var counts map[string]int
+	store.View(func() { counts = store.Backups.ByRecipient() })
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Recipients\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Recipient", "Status", "Backups"})
+
+	current := store.Encryption.Age.RecipientPublicKey
+	table.Append([]string{current, "current", strconv.Itoa(counts[current])})
+	listed := map[string]bool{current: true}
+
+	// Backups are encrypted to the recovery recipient on top of theirs, so
+	// it isn't counted with the others.
+	if recovery := store.Encryption.Age.RecoveryRecipientPublicKey; recovery != "" {
+		var n int
+		store.View(func() {
+			for _, b := range store.Backups.All() {
+				if b.RecoveryRecipient == recovery {
+					n++
+				}
+			}
+		})
+		table.Append([]string{recovery, "recovery", strconv.Itoa(n)})
+	}
+
+	// Most recently retired first. A recipient rotated back to is listed
+	// once.
+	for i := len(store.RetiredRecipients) - 1; i >= 0; i-- {
+		retired := store.RetiredRecipients[i]
+		if listed[retired.Recipient] {
+			continue
+		}
+		listed[retired.Recipient] = true
+
+		table.Append([]string{
+			retired.Recipient,
+			"retired " + retired.RetiredAt.Format(time.RFC1123),
+			strconv.Itoa(counts[retired.Recipient]),
+		})
+	}
+	for recipient := range listed {
+		delete(counts, recipient)
+	}
+
+	if n, ok := counts[""]; ok {
+		table.Append([]string{"-", "not recorded", strconv.Itoa(n)})
+		delete(counts, "")
+	}
+	for _, recipient := range slices.Sorted(maps.Keys(counts)) {
+		table.Append([]string{recipient, "unknown", strconv.Itoa(counts[recipient])})
+	}
+
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysRecoveryCmd)
+	keysCmd.AddCommand(keysReencryptCmd)
+	keysCmd.AddCommand(keysListCmd)
+
+	for _, cmd := range []*cobra.Command{keysRotateCmd, keysRecoveryCmd, keysReencryptCmd, keysListCmd} {
+		keysIdentity.register(cmd)
+	}
+
+	keysRotateCmd.Flags().StringVar(&keysRotateRecipient, "recipient", "", "The new age recipient public key")
+	keysRotateCmd.Flags().BoolVar(&keysRotateReencrypt, "reencrypt", false, "Re-encrypt the existing backups after rotating")
+	_ = keysRotateCmd.MarkFlagRequired("recipient")
+
+	keysRecoveryCmd.Flags().StringVar(&keysRecoveryRecipient, "recipient", "", "The age recipient public key of the recovery identity")
+	keysRecoveryCmd.Flags().BoolVar(&keysRecoveryRemove, "remove", false, "Remove the recovery recipient")
+	keysRecoveryCmd.MarkFlagsMutuallyExclusive("recipient", "remove")
+
+	keysReencryptCmd.Flags().BoolVar(&keysReencryptDryRun, "dry-run", true, "Dry run")
+	keysReencryptCmd.Flags().DurationVar(&keysReencryptWindow, "window", 0, "Don't start re-encrypting more backups after this long (0 is unlimited)")
+	keysReencryptCmd.Flags().BoolVar(&keysReencryptIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/glock"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jsonLockStatus  bool
+	jsonLockRemote  bool
+	lockRemoteBreak string
+)
+
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect the zfsbackrest process and repository locks",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var lockStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show who holds the zfsbackrest process lock",
+	Long: `Show who holds the zfsbackrest process lock.
+
+Reads the lock file metadata (pid, start time, command) and checks whether the
+owning process is still alive.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info, err := glock.Inspect("zfsbackrest")
+		if err != nil {
+			return fmt.Errorf("failed to inspect lock: %w", err)
+		}
+
+		slog.Debug("Lock info", "info", info)
+
+		if jsonLockStatus {
+			return json.NewEncoder(os.Stdout).Encode(info)
+		}
+
+		return renderLockStatus(info)
+	},
+}
+
+var lockRemoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Show which hosts hold the repository lock",
+	Long: `Show which hosts hold the repository lock.
+
+Commands that change the store hold a lease in the repository's storage, so two
+hosts sharing it can't change it at the same time. Leases expire on their own
+once their holder stops refreshing them. --break deletes a lease right away,
+e.g. one that can't be decoded; only break the lease of a holder that is gone.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		strongStore, err := storage.NewStrongStore(cmd.Context(), &cfg.Repository)
+		if err != nil {
+			return fmt.Errorf("failed to create storage: %w", err)
+		}
+
+		if lockRemoteBreak != "" {
+			return repository.BreakLease(cmd.Context(), strongStore, lockRemoteBreak)
+		}
+
+		leases, err := repository.ListLeases(cmd.Context(), strongStore)
+		if err != nil {
+			return err
+		}
+
+		if jsonLockRemote {
+			return json.NewEncoder(os.Stdout).Encode(leases)
+		}
+
+		return renderLeases(leases)
+	},
+}
+
+// lockRepository takes the repository lock for a command that changes the
+// store. The returned func releases it.
+func lockRepository(ctx context.Context, runner *zfsbackrest.Runner) (func(), error) {
+	if err := runner.LockRepository(ctx); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := runner.UnlockRepository(context.WithoutCancel(ctx)); err != nil {
+			slog.Warn("Failed to release the repository lock. It expires on its own.", "error", err)
+		}
+	}, nil
+}
+
+func renderLeases(leases []*repository.LeaseInfo) error {
+	if len(leases) == 0 {
+		fmt.Println("No host holds the repository lock.")
+		return nil
+	}
+
+	now := time.Now()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"ID", "Status", "Host", "PID", "Acquired", "Expires", "Command"})
+	for _, lease := range leases {
+		status := "held"
+		if lease.Expired(now) {
+			status = "expired"
+		}
+
+		acquired := "-"
+		if !lease.AcquiredAt.IsZero() {
+			acquired = fmt.Sprintf("%s (%s)", lease.AcquiredAt.Format(time.RFC1123), humanize.Time(lease.AcquiredAt))
+		}
+
+		table.Append([]string{
+			lease.ID,
+			status,
+			lease.Host,
+			fmt.Sprintf("%d", lease.PID),
+			acquired,
+			humanize.Time(lease.ExpiresAt),
+			lease.Command,
+		})
+	}
+	table.Render()
+
+	return nil
+}
+
+func renderLockStatus(info *glock.LockInfo) error {
+	if !info.Exists {
+		fmt.Printf("No lock file at %s. No zfsbackrest instance is running.\n", info.Path)
+		return nil
+	}
+
+	status := "free"
+	switch {
+	case info.Held && info.Alive:
+		status = "held"
+	case info.Held:
+		status = "held (owner process not found)"
+	case info.Alive:
+		status = "free (stale lock file, pid reused)"
+	case info.PID > 0:
+		status = "free (stale lock file)"
+	}
+
+	started := ""
+	if !info.Start.IsZero() {
+		started = fmt.Sprintf("%s (%s)", info.Start.Format(time.RFC1123), humanize.Time(info.Start))
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Path", "Status", "PID", "Process Alive", "Started", "Command"})
+	table.Append([]string{
+		info.Path,
+		status,
+		fmt.Sprintf("%d", info.PID),
+		fmt.Sprintf("%t", info.Alive),
+		started,
+		info.Command,
+	})
+	table.Render()
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	lockCmd.AddCommand(lockStatusCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	lockStatusCmd.Flags().BoolVar(&jsonLockStatus, "json", !isTerminal, "Output in JSON format")
+
+	lockCmd.AddCommand(lockRemoteCmd)
+	lockRemoteCmd.Flags().BoolVar(&jsonLockRemote, "json", !isTerminal, "Output in JSON format")
+	lockRemoteCmd.Flags().StringVar(&lockRemoteBreak, "break", "", "Delete the lease with this ID")
+}
@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/fatih/color"
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var configFile string
+var breakLock bool
+var repairStore bool
+var noColor bool
 var cfg *config.Config
 
 var (
@@ -28,6 +41,10 @@ var rootCmd = &cobra.Command{
 	Long:    `zfsbackrest is a tool for backing up and restoring ZFS filesystems.`,
 	Version: fmt.Sprintf("%s+%s %s", version, commit, date),
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if colorDisabled() {
+			color.NoColor = true
+		}
+
 		v := viper.New()
 		var err error
 		cfg, err = config.LoadConfig(v, configFile)
@@ -36,10 +53,40 @@ var rootCmd = &cobra.Command{
 			return err
 		}
 
-		if cfg.Debug {
-			setSlog(slog.LevelDebug)
-		} else {
-			setSlog(slog.LevelInfo)
+		util.ConfigureProgress(&cfg.Progress, isatty.IsTerminal(os.Stderr.Fd()))
+
+		logOpts, err := util.ParseLogConfig(&cfg.Log, cfg.Debug)
+		if err != nil {
+			slog.Error("Failed to load config", "error", err)
+			return err
+		}
+		setSlog(logOpts)
+
+		// Store saves record the command they are part of in the history log.
+		cmd.SetContext(repository.WithOperation(cmd.Context(), strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")))
+		// They also write the local copy of the store, if one is configured.
+		cmd.SetContext(repository.WithLocalStore(cmd.Context(), cfg.LocalStore))
+		// And keep the earlier versions of the store in the repository.
+		cmd.SetContext(repository.WithStoreVersions(cmd.Context(), cfg.Repository.StoreVersions))
+		// Loading a store whose content doesn't match its hash is refused,
+		// unless --repair is set.
+		if repairStore {
+			cmd.SetContext(repository.WithHashRepair(cmd.Context()))
+		}
+		// And encrypt the store, if store encryption is configured.
+		storeEncryption := cfg.Repository.StoreEncryption
+		if storeEncryption.Enabled && storeEncryption.IdentityFile == "" {
+			return &errclass.ConfigError{Key: "repository.store_encryption.identity_file", Err: errors.New("is required to read the encrypted store back")}
+		}
+		if storeEncryption.IdentityFile != "" {
+			identities, err := readStoreIdentityFile(storeEncryption.IdentityFile)
+			if err != nil {
+				return err
+			}
+			cmd.SetContext(repository.WithStoreEncryption(cmd.Context(), repository.StoreEncryption{
+				Enabled:    storeEncryption.Enabled,
+				Identities: identities,
+			}))
 		}
 
 		slog.Debug("Using log level debug with the config file", "file", configFile)
@@ -53,22 +100,58 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
+	storage.ToolVersion = version
+
 	rootCmd.PersistentFlags().StringVarP(
 		&configFile,
 		"config", "c",
 		"/etc/zfsbackrest.toml",
 		"path for the config file",
 	)
+	rootCmd.PersistentFlags().BoolVar(
+		&breakLock,
+		"break-lock",
+		false,
+		"take over the process lock if the process holding it no longer exists",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&repairStore,
+		"repair",
+		false,
+		"use the store even if its content doesn't match its hash, and correct the hash",
+	)
+	rootCmd.PersistentFlags().BoolVar(
+		&noColor,
+		"no-color",
+		false,
+		"disable colored output, also disabled by setting NO_COLOR",
+	)
+}
+
+// colorDisabled reports whether colors are disabled with --no-color or
+// NO_COLOR (https://no-color.org).
+func colorDisabled() bool {
+	return noColor || os.Getenv("NO_COLOR") != ""
 }
 
 var softExit = false
+var forceExit = false
+
+// forceExitGrace is how long a forced exit waits for interrupted operations
+// to be recorded.
+const forceExitGrace = 20 * time.Second
 
 func main() {
-	setSlog(slog.LevelInfo) // set the log level to info by default
+	setSlog(util.LogOptions{Level: slog.LevelInfo}) // set the log level to info by default
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// The first signal soft cancels the FSMs: they finish their in-flight
+	// step and stop at the next safe state.
+	softExitCh := make(chan struct{})
+	ctx = fsm.WithSoftCancel(ctx, softExitCh)
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
@@ -77,15 +160,46 @@ func main() {
 			if !softExit {
 				slog.Warn("Received signal to terminate, will exit after the current operation. Use Ctrl+C again to force exit.")
 				softExit = true
-			} else {
-				slog.Error("Force exiting. You may have unfinished operations.")
+				close(softExitCh)
+			} else if !forceExit {
+				// Give aborted uploads a moment to be recorded, so the next
+				// run can clean them up.
+				slog.Error("Force exiting. You may have unfinished operations. Use Ctrl+C again to exit right away.")
+				forceExit = true
 				cancel()
+				time.AfterFunc(forceExitGrace, func() { os.Exit(1) })
+			} else {
 				os.Exit(1)
 			}
 		}
 	}()
 
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode maps the class of err to a sysexits(3) style exit code, so that
+// wrappers and systemd units can tell configuration mistakes and lock
+// contention apart from backend failures.
+func exitCode(err error) int {
+	class := errclass.Of(err)
+	slog.Debug("Exiting with error", "class", class, "error", err)
+
+	switch class {
+	case errclass.ClassValidation:
+		return 65 // EX_DATAERR
+	case errclass.ClassStorage:
+		return 69 // EX_UNAVAILABLE
+	case errclass.ClassZFS:
+		return 71 // EX_OSERR
+	case errclass.ClassLock:
+		return 75 // EX_TEMPFAIL
+	case errclass.ClassEncryption:
+		return 77 // EX_NOPERM
+	case errclass.ClassConfig:
+		return 78 // EX_CONFIG
+	default:
+		return 1
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/spf13/cobra"
+)
+
+const (
+	maintenanceScopeLocal      = "local"
+	maintenanceScopeRepository = "repository"
+	maintenanceScopeAll        = "all"
+)
+
+var maintenanceScope string
+var maintenanceReason string
+
+var maintenanceGuard *util.CommandGuard
+
+var maintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Freeze or unfreeze scheduled backups and cleanups",
+	Long: `Freeze or unfreeze scheduled backups and cleanups.
+
+While maintenance mode is on, backup and cleanup exit successfully without
+doing anything. Use it during planned pool maintenance windows. The flag can be
+recorded on this host only (local), in the repository for every host using it
+(repository), or both (all).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var maintenanceOnCmd = &cobra.Command{
+	Use:   "on",
+	Short: "Turn maintenance mode on",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return maintenancePreRun()
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		return maintenanceGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m := repository.NewMaintenance(maintenanceReason)
+		if err := setMaintenance(cmd, m); err != nil {
+			return err
+		}
+
+		slog.Info("Maintenance mode on", "scope", maintenanceScope, "reason", maintenanceReason)
+		return nil
+	},
+}
+
+var maintenanceOffCmd = &cobra.Command{
+	Use:   "off",
+	Short: "Turn maintenance mode off",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return maintenancePreRun()
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		return maintenanceGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setMaintenance(cmd, nil); err != nil {
+			return err
+		}
+
+		slog.Info("Maintenance mode off", "scope", maintenanceScope)
+		return nil
+	},
+}
+
+func maintenancePreRun() error {
+	switch maintenanceScope {
+	case maintenanceScopeLocal, maintenanceScopeRepository, maintenanceScopeAll:
+	default:
+		return fmt.Errorf("invalid scope %q. Valid values are: local, repository, all", maintenanceScope)
+	}
+
+	var err error
+	maintenanceGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+		NeedsRoot:       true,
+		NeedsGlobalLock: true,
+		BreakStaleLock:  breakLock,
+	})
+	if err != nil {
+		slog.Error("Failed to initialize command guard", "error", err)
+		return fmt.Errorf("failed to initialize command guard: %w", err)
+	}
+
+	return nil
+}
+
+func setMaintenance(cmd *cobra.Command, m *repository.Maintenance) error {
+	if maintenanceScope == maintenanceScopeLocal || maintenanceScope == maintenanceScopeAll {
+		slog.Debug("Setting local maintenance flag", "state-dir", cfg.StateDir, "maintenance", m)
+		if err := repository.SaveLocalMaintenance(cfg.StateDir, m); err != nil {
+			return err
+		}
+	}
+
+	if maintenanceScope == maintenanceScopeRepository || maintenanceScope == maintenanceScopeAll {
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := runner.SetRepositoryMaintenance(cmd.Context(), m); err != nil {
+			return fmt.Errorf("failed to set repository maintenance: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// skipForLocalMaintenance reports whether a scheduled operation should be
+// skipped because this host is in maintenance mode.
+func skipForLocalMaintenance(operation string) (bool, error) {
+	m, err := repository.LoadLocalMaintenance(cfg.StateDir)
+	if err != nil {
+		return false, err
+	}
+
+	return skipForMaintenance(operation, maintenanceScopeLocal, m), nil
+}
+
+// skipForRepositoryMaintenance reports whether a scheduled operation should be
+// skipped because the repository is in maintenance mode.
+func skipForRepositoryMaintenance(operation string, store *repository.Store) bool {
+	return skipForMaintenance(operation, maintenanceScopeRepository, store.Maintenance)
+}
+
+func skipForMaintenance(operation string, scope string, m *repository.Maintenance) bool {
+	if m == nil {
+		return false
+	}
+
+	slog.Warn(fmt.Sprintf("Maintenance mode is on, skipping %s. Run `zfsbackrest maintenance off --scope %s` to resume.", operation, scope),
+		"reason", m.Reason,
+		"since", m.Since.Format(time.RFC3339),
+		"host", m.Host,
+	)
+
+	return true
+}
+
+func init() {
+	rootCmd.AddCommand(maintenanceCmd)
+	maintenanceCmd.AddCommand(maintenanceOnCmd)
+	maintenanceCmd.AddCommand(maintenanceOffCmd)
+
+	maintenanceCmd.PersistentFlags().StringVar(&maintenanceScope, "scope", maintenanceScopeLocal, "Where to record the flag. Valid values are: local, repository, all.")
+	maintenanceOnCmd.Flags().StringVar(&maintenanceReason, "reason", "", "Why maintenance mode is on")
+}
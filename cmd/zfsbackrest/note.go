@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var noteGuard *util.CommandGuard
+
+var noteCmd = &cobra.Command{
+	Use:   "note <backup-id> <note>",
+	Short: "Set the note on a backup",
+	Long: `Set the note on a backup, replacing the one it was taken with, if any. An
+empty note clears it.
+
+Notes are free-form, like "state before PostgreSQL 16 migration", to identify
+the right restore point later. They are shown by detail, and kept in the
+backup's manifest, so a rebuilt store has them too.`,
+	Args: cobra.ExactArgs(2),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		noteGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return noteGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := ulid.ParseStrict(args[0])
+		if err != nil {
+			slog.Error("Failed to parse backup ID", "error", err)
+			return &errclass.ValidationError{Subject: "backup ID", Err: err}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if _, err := runner.SetNote(cmd.Context(), id, strings.TrimSpace(args[1])); err != nil {
+			return fmt.Errorf("failed to set note: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(noteCmd)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/zfs"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	permissionsJSON bool
+	permissionsUser string
+)
+
+var permissionsCmd = &cobra.Command{
+	Use:   "permissions",
+	Short: "Check ZFS permissions delegated to zfsbackrest",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var permissionsCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the ZFS permissions delegated on managed datasets",
+	Long: `Check the ZFS permissions delegated on managed datasets.
+
+For each dataset matched by repository.included_datasets, checks which of the
+permissions zfsbackrest needs to snapshot, send, hold, destroy and receive
+snapshots the user has, through "zfs allow". Prints the "zfs allow" command
+that delegates the missing ones. Exits with an error if any are missing.
+
+Restores into a dataset that doesn't exist yet also need receive, create and
+mount on its parent.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		u, err := lookupUser(permissionsUser)
+		if err != nil {
+			return err
+		}
+
+		if u.Uid == "0" {
+			fmt.Printf("%s is root, and needs no delegated permissions.\n", u.Username)
+			return nil
+		}
+
+		groups, err := zfsbackrest.GroupNames(u)
+		if err != nil {
+			return err
+		}
+
+		z, err := zfs.New()
+		if err != nil {
+			return fmt.Errorf("failed to create ZFS client: %w", err)
+		}
+
+		datasets, err := z.ListDatasetsWithGlobs(ctx, cfg.Repository.IncludedDatasets...)
+		if err != nil {
+			return fmt.Errorf("failed to get managed datasets: %w", err)
+		}
+
+		checks, err := zfsbackrest.CheckPermissions(ctx, z, datasets, u.Username, groups)
+		if err != nil {
+			return fmt.Errorf("failed to check permissions: %w", err)
+		}
+
+		slog.Debug("Permission checks", "user", u.Username, "groups", groups, "checks", checks)
+
+		if permissionsJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+				return err
+			}
+		} else {
+			renderPermissionChecks(u.Username, checks)
+		}
+
+		missing := 0
+		for _, check := range checks {
+			if len(check.Missing) > 0 {
+				missing++
+			}
+		}
+		if missing > 0 {
+			return fmt.Errorf("%s is missing permissions on %d datasets", u.Username, missing)
+		}
+
+		return nil
+	},
+}
+
+// lookupUser looks up a user by name, or the current user if name is empty.
+func lookupUser(name string) (*user.User, error) {
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current user: %w", err)
+		}
+		return u, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+	return u, nil
+}
+
+func renderPermissionChecks(username string, checks []*zfsbackrest.PermissionCheck) {
+	if len(checks) == 0 {
+		fmt.Println("No managed datasets.")
+		return
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Permissions of %s\n", username)
+
+	operations := make([]string, 0, len(zfsbackrest.RequiredPermissions))
+	for _, required := range zfsbackrest.RequiredPermissions {
+		operations = append(operations, fmt.Sprintf("%s (%s)", required.Operation, strings.Join(required.Perms, ",")))
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header(append([]string{"Dataset"}, operations...))
+	for _, check := range checks {
+		row := []string{check.Dataset}
+		for _, op := range check.Operations {
+			status := "ok"
+			if len(op.Missing) > 0 {
+				status = "missing " + strings.Join(op.Missing, ",")
+			}
+			row = append(row, status)
+		}
+		table.Append(row)
+	}
+	table.Render()
+
+	var fixes []string
+	for _, check := range checks {
+		if check.Fix != "" {
+			fixes = append(fixes, check.Fix)
+		}
+	}
+
+	if len(fixes) == 0 {
+		fmt.Println("\nAll permissions are delegated.")
+		return
+	}
+
+	fmt.Println()
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "To delegate the missing permissions, run as root\n")
+	for _, fix := range fixes {
+		fmt.Println(fix)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(permissionsCmd)
+	permissionsCmd.AddCommand(permissionsCheckCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	permissionsCheckCmd.Flags().BoolVar(&permissionsJSON, "json", !isTerminal, "Output in JSON format")
+	permissionsCheckCmd.Flags().StringVar(&permissionsUser, "user", "", "The user to check, defaults to the current user")
+}
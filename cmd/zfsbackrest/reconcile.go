@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var reconcileDryRun bool
+var reconcileMinAge time.Duration
+var reconcileJSON bool
+var reconcileIgnoreMaintenance bool
+
+var reconcileGuard *util.CommandGuard
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Cross-check the store with the remote objects and the local snapshots",
+	Long: `Cross-check the store with the remote objects and the local snapshots.
+
+reconcile validates the store, and compares it with the objects in every
+storage tier and route, and with the snapshots of the managed datasets on this
+host and their holds. It reports backups whose snapshot or manifest object is
+missing, backups taken on this host whose local snapshot is gone or not held,
+orphans with nothing left of them, and snapshots and objects the store doesn't
+know about. Anything of backups younger than --min-age is left alone, as they
+may still be uploading.
+
+With --dry-run=false, it fixes what it can: backups with a missing snapshot
+object are marked damaged, missing manifests are written again, local
+snapshots are held again, and orphans with nothing left of them are removed
+from the store. Untracked objects are deleted by repo gc. It exits with an
+error if any discrepancy is left.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		reconcileGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return reconcileGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Reconcile command", "dry-run", reconcileDryRun, "min-age", reconcileMinAge)
+
+		if reconcileDryRun {
+			slog.Info("Dry run enabled, nothing will be fixed. Set --dry-run=false to actually fix discrepancies.")
+		}
+
+		if !reconcileIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("reconcile")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !reconcileIgnoreMaintenance && skipForRepositoryMaintenance("reconcile", runner.Store) {
+			return nil
+		}
+
+		discrepancies, err := runner.Reconcile(cmd.Context(), zfsbackrest.ReconcileOpts{
+			MinAge: reconcileMinAge,
+			DryRun: reconcileDryRun,
+		})
+		if reconcileJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(discrepancies); err != nil {
+				return err
+			}
+		} else {
+			renderDiscrepancies(discrepancies)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reconcile the store: %w", err)
+		}
+
+		left := 0
+		for _, d := range discrepancies {
+			if !d.Fixed {
+				left++
+			}
+		}
+		if left > 0 {
+			return fmt.Errorf("%d discrepancies left", left)
+		}
+
+		return nil
+	},
+}
+
+func renderDiscrepancies(discrepancies []*zfsbackrest.Discrepancy) {
+	if len(discrepancies) == 0 {
+		fmt.Println("No discrepancies found.")
+		return
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Discrepancies\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Kind", "Dataset", "Backup ID", "Storage", "Detail", "Fix"})
+	for _, d := range discrepancies {
+		backup := ""
+		if d.Backup != nil {
+			backup = d.Backup.String()
+		}
+
+		fix := d.Fix
+		switch {
+		case d.Fixed:
+			fix = color.GreenString("fixed: %s", d.Fix)
+		case fix == "":
+			fix = "-"
+		}
+
+		table.Append([]string{
+			string(d.Kind),
+			d.Dataset,
+			backup,
+			d.Storage,
+			d.Detail,
+			fix,
+		})
+	}
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	reconcileCmd.Flags().BoolVar(&reconcileDryRun, "dry-run", true, "Dry run")
+	reconcileCmd.Flags().DurationVar(&reconcileMinAge, "min-age", 24*time.Hour, "Leave backups, orphans, objects and snapshots younger than this alone")
+	reconcileCmd.Flags().BoolVar(&reconcileJSON, "json", !isTerminal, "Output in JSON format")
+	reconcileCmd.Flags().BoolVar(&reconcileIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/spf13/cobra"
+)
+
+var replicateDryRun bool
+var replicateReplica string
+var replicateIgnoreMaintenance bool
+
+var replicateGuard *util.CommandGuard
+
+var replicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "Upload backups missing from the replicas",
+	Long: `Upload every backup that isn't in a replica to it: the ones whose upload to the replica failed during the backup, and the ones taken before the replica was added to repository.replicas.
+
+Snapshots are copied as-is from the repository, without being decrypted.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		replicateGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return replicateGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Replicate command", "dry-run", replicateDryRun, "replica", replicateReplica)
+
+		if replicateDryRun {
+			slog.Info("Dry run enabled, no backups will be uploaded. Set --dry-run=false to actually replicate backups.")
+		}
+
+		if !replicateIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("replicate")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !replicateIgnoreMaintenance && skipForRepositoryMaintenance("replicate", runner.Store) {
+			return nil
+		}
+
+		err = runner.Replicate(cmd.Context(), zfsbackrest.ReplicateOpts{Replica: replicateReplica, DryRun: replicateDryRun})
+		if err != nil {
+			return fmt.Errorf("failed to replicate backups: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replicateCmd)
+
+	replicateCmd.Flags().BoolVar(&replicateDryRun, "dry-run", true, "Dry run")
+	replicateCmd.Flags().StringVar(&replicateReplica, "replica", "", "Only replicate to the replica with this name")
+	replicateCmd.Flags().BoolVar(&replicateIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
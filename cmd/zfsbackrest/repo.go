@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var repoGCDryRun bool
+var repoGCMinAge time.Duration
+var repoGCIgnoreMaintenance bool
+
+var repoGCGuard *util.CommandGuard
+
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Manage the repository's remote objects",
+	Long:  `Manage the repository's remote objects.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var repoGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and delete remote objects the store doesn't know about",
+	Long: `Find and delete snapshot, manifest and checksum objects the store doesn't refer to.
+
+Interrupted runs can leave objects behind that no backup, orphan or trashed
+backup refers to. gc lists every object under snaps/ in the hot and cold
+storage, and deletes the ones the store doesn't know about. Objects named after
+backups younger than --min-age are left alone, as they may still be uploading.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		repoGCGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return repoGCGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Repo gc command", "dry-run", repoGCDryRun, "min-age", repoGCMinAge)
+
+		if repoGCDryRun {
+			slog.Info("Dry run enabled, no objects will be deleted. Set --dry-run=false to actually delete them.")
+		}
+
+		if !repoGCIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("repo gc")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !repoGCIgnoreMaintenance && skipForRepositoryMaintenance("repo gc", runner.Store) {
+			return nil
+		}
+
+		found, err := runner.GarbageCollect(cmd.Context(), zfsbackrest.GCOpts{
+			MinAge: repoGCMinAge,
+			DryRun: repoGCDryRun,
+		})
+		renderGCObjects(found, repoGCDryRun)
+		if err != nil {
+			return fmt.Errorf("failed to collect untracked objects: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func renderGCObjects(found []zfsbackrest.GCObject, dryRun bool) {
+	if len(found) == 0 {
+		fmt.Println("No untracked objects found.")
+		return
+	}
+
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Untracked Objects\n")
+
+	total := int64(0)
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Storage", "Dataset", "Object", "Size", "Created At"})
+	for _, object := range found {
+		createdAt := "-"
+		if !object.CreatedAt.IsZero() {
+			createdAt = object.CreatedAt.Format(time.RFC1123)
+		}
+
+		table.Append([]string{
+			object.Storage,
+			object.Dataset,
+			object.Snapshot,
+			humanize.Bytes(uint64(object.Size)),
+			createdAt,
+		})
+		total += object.Size
+	}
+	table.Render()
+
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d untracked objects, %s.\n", verb, len(found), humanize.Bytes(uint64(total)))
+}
+
+func init() {
+	rootCmd.AddCommand(repoCmd)
+	repoCmd.AddCommand(repoGCCmd)
+
+	repoGCCmd.Flags().BoolVar(&repoGCDryRun, "dry-run", true, "Dry run")
+	repoGCCmd.Flags().DurationVar(&repoGCMinAge, "min-age", 24*time.Hour, "Leave objects named after backups younger than this alone")
+	repoGCCmd.Flags().BoolVar(&repoGCIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
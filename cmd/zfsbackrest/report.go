@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/spf13/cobra"
+)
+
+const formatCSV = "csv"
+
+var reportFormat string
+var reportOutput string
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Export a report of every backup, orphan and trashed backup",
+	Long: `Export a report of every backup, orphan and trashed backup.
+
+The report has a row for each backup, orphan and trashed backup of every
+dataset, with its type, parent, creation time, sizes, storage, host, expiry,
+verification and Object Lock status, tags and note. Backups expire by
+repository.expiry as cleanup --expired would expire them: by their age, with
+the time they expire at, or by the GFS policy, with the rules that keep them.
+Trashed backups expire when the trash is purged.
+
+As CSV, it has a header row, times in RFC 3339 and sizes in bytes, for
+spreadsheets. As JSON, it also has the repository's totals. --output writes it
+to a file instead of stdout.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Report command", "format", reportFormat, "output", reportOutput)
+
+		if reportFormat != formatCSV && reportFormat != formatJSON {
+			return &errclass.ValidationError{Subject: "format", Err: fmt.Errorf("unknown format %q, expected csv or json", reportFormat)}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		report, err := runner.Store.Report(repository.ReportOpts{
+			Expiry:         &cfg.Repository.Expiry,
+			TrashRetention: cfg.Repository.Trash.Retention,
+			Now:            time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to generate report: %w", err)
+		}
+
+		var buf bytes.Buffer
+		if reportFormat == formatJSON {
+			err = json.NewEncoder(&buf).Encode(report)
+		} else {
+			err = report.WriteCSV(&buf)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+
+		if reportOutput == "" || reportOutput == "-" {
+			_, err := os.Stdout.Write(buf.Bytes())
+			return err
+		}
+
+		if err := os.WriteFile(reportOutput, buf.Bytes(), 0o644); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+
+		slog.Info("Wrote report", "path", reportOutput, "rows", len(report.Rows))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+
+	reportCmd.Flags().StringVar(&reportFormat, "format", formatCSV, "Output format: csv or json")
+	reportCmd.Flags().StringVarP(&reportOutput, "output", "o", "", "Path to write the report to (stdout by default)")
+}
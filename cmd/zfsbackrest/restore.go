@@ -3,16 +3,14 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"os"
 
-	"github.com/gargakshit/zfsbackrest/encryption"
 	"github.com/gargakshit/zfsbackrest/internal/util"
 	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
 	"github.com/oklog/ulid/v2"
 	"github.com/spf13/cobra"
 )
 
-var ageIdentityFile string
+var restoreIdentity identityFlags
 var restoreDataset string
 var restoreBackupID string
 var restoreDatasetTo string
@@ -28,6 +26,7 @@ var restoreCmd = &cobra.Command{
 		restoreGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
 			NeedsRoot:       true,
 			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
 		})
 		if err != nil {
 			slog.Error("Failed to initialize command guard", "error", err)
@@ -42,16 +41,13 @@ var restoreCmd = &cobra.Command{
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		slog.Debug("Restoring backup",
-			"age-identity-file", ageIdentityFile,
+			"age-identity-file", restoreIdentity.files,
+			"ssh-agent", restoreIdentity.sshAgent,
 			"dataset", restoreDataset,
 			"backup-id", restoreBackupID,
 			"dataset-to", restoreDatasetTo,
 		)
 
-		if ageIdentityFile == "" {
-			return fmt.Errorf("age identity file is required. Please use --age-identity-file to specify the age identity file")
-		}
-
 		if restoreDataset == "" {
 			return fmt.Errorf("dataset is required. Please use --dataset to specify the dataset to restore")
 		}
@@ -60,10 +56,9 @@ var restoreCmd = &cobra.Command{
 			return fmt.Errorf("dataset-to is required. Please use --dataset-to to specify the dataset to restore to")
 		}
 
-		slog.Debug("Reading age identity file", "age-identity-file", ageIdentityFile)
-		identity, err := os.ReadFile(ageIdentityFile)
+		identities, err := restoreIdentity.loadReadingStore(cmd, false)
 		if err != nil {
-			return fmt.Errorf("failed to read age identity file: %w", err)
+			return err
 		}
 
 		slog.Debug("Creating runner from existing repository", "config", cfg)
@@ -73,8 +68,7 @@ var restoreCmd = &cobra.Command{
 		}
 		slog.Debug("Runner created", "runner", runner)
 
-		slog.Debug("Creating encryption instance from age identity file", "age-identity-file", ageIdentityFile)
-		encryption, err := encryption.NewAgeFromIdentity(string(identity), &runner.Store.Encryption.Age)
+		encryption, err := restoreIdentity.decryption(runner.Store, identities)
 		if err != nil {
 			return fmt.Errorf("failed to create encryption instance: %w", err)
 		}
@@ -111,7 +105,7 @@ var restoreCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(restoreCmd)
 
-	restoreCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "i", "", "Path to the age identity file")
+	restoreIdentity.register(restoreCmd)
 	restoreCmd.Flags().StringVarP(&restoreDataset, "src-dataset", "s", "", "Source dataset to restore. Doesn't necessarily need to exist locally.")
 	restoreCmd.Flags().StringVarP(&restoreBackupID, "backup-id", "b", "", "Backup ID to restore (restores the latest backup by default)")
 	restoreCmd.Flags().StringVarP(&restoreDatasetTo, "dst-dataset", "d", "", "Destination dataset to restore to. Will error if the dataset already exists.")
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	retentionJSON    bool
+	retentionDataset string
+	retentionOutput  tableOutput
+)
+
+var retentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Inspect the retention policy",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var retentionPreviewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Show which backups the GFS retention policy keeps, and why",
+	Long: `Show which backups the GFS retention policy keeps, and why.
+
+Evaluates repository.expiry.gfs for every dataset, and shows for each backup the
+rules that keep it, with the period it is the latest backup of, or the keep tag
+it has, or the kept backups it is a parent of. Backups nothing keeps are deleted by the next
+` + "`cleanup --expired`" + `, unless they are in the last chain of their dataset and
+repository.expiry.keep_last_chain is on.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		gfs := &cfg.Repository.Expiry.GFS
+		if !gfs.Enabled() {
+			return &errclass.ConfigError{Key: "repository.expiry.gfs", Err: fmt.Errorf("no GFS retention policy is configured")}
+		}
+
+		if err := retentionOutput.resolve(retentionJSON); err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		retentions, err := gfsRetentions(runner.Store, &cfg.Repository.Expiry, retentionDataset)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate GFS retention: %w", err)
+		}
+
+		sorted := make([]*repository.Retention, 0, len(retentions))
+		for _, r := range retentions {
+			sorted = append(sorted, r)
+		}
+		slices.SortFunc(sorted, func(a, b *repository.Retention) int {
+			if a.Backup.Dataset != b.Backup.Dataset {
+				return strings.Compare(a.Backup.Dataset, b.Backup.Dataset)
+			}
+			return b.Backup.ID.Compare(a.Backup.ID)
+		})
+
+		if retentionOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(sorted)
+		}
+
+		var lastChains map[ulid.ULID]bool
+		if cfg.Repository.Expiry.KeepLastChain {
+			lastChains, err = runner.Store.Backups.KeptByLastChains(runner.Store.ManagedDatasets)
+			if err != nil {
+				return err
+			}
+		}
+
+		return renderRetentions(sorted, lastChains, &retentionOutput)
+	},
+}
+
+// gfsRetentions evaluates the GFS policy, with the keep tags, for every
+// managed dataset, or only for dataset if it is set.
+func gfsRetentions(store *repository.Store, expiry *config.Expiry, dataset string) (map[ulid.ULID]*repository.Retention, error) {
+	keep, err := repository.KeepTags(expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	retentions := map[ulid.ULID]*repository.Retention{}
+	for _, managed := range store.ManagedDatasets {
+		if dataset != "" && managed != dataset {
+			continue
+		}
+
+		evaluated, err := store.Backups.GFSRetention(managed, &expiry.GFS, keep...)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %s: %w", managed, err)
+		}
+
+		for _, r := range evaluated {
+			retentions[r.Backup.ID] = r
+		}
+	}
+
+	return retentions, nil
+}
+
+// keptBy describes why a backup is kept, for the detail table. lastChain is
+// whether it is in the last chain of its dataset, which is kept too.
+func keptBy(r *repository.Retention, lastChain bool) string {
+	switch {
+	case r == nil:
+		return "-"
+	case len(r.Rules) > 0:
+		names := make([]string, len(r.Rules))
+		for i, rule := range r.Rules {
+			names[i], _, _ = strings.Cut(rule, " ")
+		}
+		return "kept (" + strings.Join(names, ", ") + ")"
+	case len(r.ParentOf) > 0:
+		return "kept (parent)"
+	case lastChain:
+		return "kept (last chain)"
+	default:
+		return color.HiRedString("next cleanup")
+	}
+}
+
+func renderRetentions(retentions []*repository.Retention, lastChains map[ulid.ULID]bool, out *tableOutput) error {
+	out.title("GFS retention")
+
+	header := []string{"Dataset", "Backup ID", "Backup Type", "Created At", "Kept By"}
+	var rows [][]string
+	kept := 0
+	for _, r := range retentions {
+		reason := strings.Join(r.Rules, ", ")
+		if len(r.ParentOf) > 0 {
+			parentOf := make([]string, len(r.ParentOf))
+			for i, id := range r.ParentOf {
+				parentOf[i] = id.String()
+			}
+			reason = strings.TrimPrefix(reason+", parent of "+strings.Join(parentOf, ", "), ", ")
+		}
+		switch {
+		case r.Kept():
+			kept++
+		case lastChains[r.Backup.ID]:
+			reason = "last chain"
+			kept++
+		default:
+			reason = color.HiRedString("expired")
+		}
+
+		rows = append(rows, []string{
+			r.Backup.Dataset,
+			r.Backup.ID.String(),
+			string(r.Backup.Type),
+			r.Backup.CreatedAt.Format(time.RFC1123),
+			reason,
+		})
+	}
+
+	if err := out.render(header, rows); err != nil {
+		return err
+	}
+
+	if !out.tsv() {
+		fmt.Printf("\n%d of %d backups are kept. The others are deleted by the next `cleanup --expired`.\n", kept, len(retentions))
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(retentionCmd)
+	retentionCmd.AddCommand(retentionPreviewCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	retentionPreviewCmd.Flags().BoolVar(&retentionJSON, "json", !isTerminal, "Output in JSON format")
+	retentionPreviewCmd.Flags().StringVar(&retentionDataset, "dataset", "", "Only show the backups of this dataset")
+	retentionOutput.addFlags(retentionPreviewCmd)
+}
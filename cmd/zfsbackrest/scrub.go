@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/spf13/cobra"
+)
+
+var scrubIdentity identityFlags
+var scrubTuning verifyFlags
+var scrubDataset string
+var scrubIgnoreMaintenance bool
+
+var scrubGuard *util.CommandGuard
+
+var scrubCmd = &cobra.Command{
+	Use:   "scrub",
+	Short: "Check every backup for bit rot",
+	Long: `Check every backup for bit rot.
+
+Every snapshot is read back, decrypted, and checked against the size and
+checksum recorded when it was sent, without restoring it. Damaged backups are
+marked in the store and shown by detail. The command exits with an error if any
+backup fails, so a systemd OnFailure= unit can alert on it.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		scrubGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return scrubGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Scrub command", "dataset", scrubDataset)
+
+		if !scrubIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("scrub")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		identities, err := scrubIdentity.loadReadingStore(cmd, false)
+		if err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !scrubIgnoreMaintenance && skipForRepositoryMaintenance("scrub", runner.Store) {
+			return nil
+		}
+
+		encryption, err := scrubIdentity.decryption(runner.Store, identities)
+		if err != nil {
+			return fmt.Errorf("failed to create encryption instance: %w", err)
+		}
+		runner.Encryption = encryption
+
+		opts, err := scrubTuning.opts(cmd)
+		if err != nil {
+			return err
+		}
+
+		return runner.Scrub(cmd.Context(), zfsbackrest.ScrubOpts{VerifyOpts: opts, Dataset: scrubDataset})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scrubCmd)
+
+	scrubIdentity.register(scrubCmd)
+	scrubTuning.register(scrubCmd)
+	scrubCmd.Flags().StringVarP(&scrubDataset, "dataset", "d", "", "Only scrub the backups of this dataset")
+	scrubCmd.Flags().BoolVar(&scrubIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
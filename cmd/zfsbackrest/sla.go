@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var (
+	slaJSON        bool
+	slaMetricsFile string
+)
+
+var slaCmd = &cobra.Command{
+	Use:   "sla",
+	Short: "Check managed datasets against the backup SLA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var slaCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Find datasets that went without a backup for longer than the SLA",
+	Long: `Find datasets that went without a backup for longer than the SLA.
+
+Compares the latest backup of every managed dataset against repository.sla, to
+catch backups that were silently skipped, e.g. because the host was off when
+they were scheduled. Exits with an error if any dataset is out of its SLA, so it
+can be run from a systemd timer or cron job that alerts on failure.
+
+With --metrics-file, also writes the time of the latest backup and whether it is
+overdue, for every dataset and backup type, in the Prometheus text format for
+the node_exporter textfile collector.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sla := &cfg.Repository.SLA
+		if sla.Full <= 0 && sla.Diff <= 0 && sla.Incr <= 0 {
+			return &errclass.ConfigError{Key: "repository.sla", Err: fmt.Errorf("no backup SLA is configured")}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		now := time.Now()
+		missed := runner.Store.MissedBackups(sla, now)
+		slog.Debug("Missed backups", "missed", missed)
+
+		if slaMetricsFile != "" {
+			if err := writeSLAMetrics(slaMetricsFile, runner.Store, sla, missed); err != nil {
+				return err
+			}
+		}
+
+		if slaJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(missed); err != nil {
+				return err
+			}
+		} else if len(missed) == 0 {
+			fmt.Println("All managed datasets are within the backup SLA.")
+		} else {
+			renderMissedBackups(missed)
+		}
+
+		if len(missed) > 0 {
+			for _, m := range missed {
+				slog.Warn("Dataset is out of its backup SLA", "dataset", m.Dataset, "type", m.Type, "max_age", m.MaxAge, "overdue", m.Overdue)
+			}
+			return fmt.Errorf("%d backups are out of their SLA", len(missed))
+		}
+
+		return nil
+	},
+}
+
+func renderMissedBackups(missed []*repository.MissedBackup) {
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Missed backups\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Dataset", "Backup Type", "SLA", "Last Backup", "Overdue By"})
+	for _, m := range missed {
+		last := "never"
+		if m.Last != nil {
+			last = fmt.Sprintf("%s (%s, %s)", m.Last.CreatedAt.Format(time.RFC1123), m.Last.Type, humanize.Time(m.Last.CreatedAt))
+		}
+
+		table.Append([]string{
+			m.Dataset,
+			string(m.Type),
+			m.MaxAge.String(),
+			last,
+			m.Overdue.Round(time.Minute).String(),
+		})
+	}
+	table.Render()
+}
+
+// writeSLAMetrics writes the SLA status of every managed dataset to path, in
+// the Prometheus text format. It writes and renames, so the collector never
+// reads a partial file.
+func writeSLAMetrics(path string, store *repository.Store, sla *config.SLA, missed []*repository.MissedBackup) error {
+	overdue := map[string]bool{}
+	for _, m := range missed {
+		overdue[m.Dataset+"\x00"+string(m.Type)] = true
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP zfsbackrest_last_backup_timestamp_seconds Creation time of the latest backup counting towards the SLA of a backup type.\n")
+	b.WriteString("# TYPE zfsbackrest_last_backup_timestamp_seconds gauge\n")
+	var status strings.Builder
+	status.WriteString("# HELP zfsbackrest_backup_sla_missed Whether a dataset went without a backup of a type for longer than its SLA.\n")
+	status.WriteString("# TYPE zfsbackrest_backup_sla_missed gauge\n")
+
+	for _, dataset := range store.ManagedDatasets {
+		for _, typ := range []repository.BackupType{repository.BackupTypeFull, repository.BackupTypeDiff, repository.BackupTypeIncr} {
+			if repository.SLAMaxAge(sla, typ) <= 0 {
+				continue
+			}
+
+			labels := fmt.Sprintf("{dataset=%q,type=%q}", dataset, typ)
+			if last := store.Backups.LastCovering(dataset, typ); last != nil {
+				fmt.Fprintf(&b, "zfsbackrest_last_backup_timestamp_seconds%s %d\n", labels, last.CreatedAt.Unix())
+			}
+
+			value := 0
+			if overdue[dataset+"\x00"+string(typ)] {
+				value = 1
+			}
+			fmt.Fprintf(&status, "zfsbackrest_backup_sla_missed%s %d\n", labels, value)
+		}
+	}
+
+	b.WriteString(status.String())
+
+	if err := os.WriteFile(path+".tmp", []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(slaCmd)
+	slaCmd.AddCommand(slaCheckCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	slaCheckCmd.Flags().BoolVar(&slaJSON, "json", !isTerminal, "Output in JSON format")
+	slaCheckCmd.Flags().StringVar(&slaMetricsFile, "metrics-file", "", "Write the SLA status to this file for the node_exporter textfile collector, e.g. /var/lib/node_exporter/zfsbackrest.prom")
+}
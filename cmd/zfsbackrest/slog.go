@@ -4,25 +4,26 @@ import (
 	"log/slog"
 	"os"
 
+	"github.com/gargakshit/zfsbackrest/internal/util"
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-isatty"
 )
 
-func setSlog(level slog.Level) {
+func setSlog(opts util.LogOptions) {
 	var handler slog.Handler
 
 	if isatty.IsTerminal(os.Stderr.Fd()) {
-		handler = tint.NewHandler(os.Stderr, &tint.Options{
-			Level:     level,
+		handler = tint.NewHandler(util.Stderr, &tint.Options{
+			Level:     opts.MinLevel(),
 			AddSource: true,
-			NoColor:   false,
+			NoColor:   colorDisabled(),
 		})
 	} else {
-		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level:     level,
+		handler = slog.NewTextHandler(util.Stderr, &slog.HandlerOptions{
+			Level:     opts.MinLevel(),
 			AddSource: true,
 		})
 	}
 
-	slog.SetDefault(slog.New(handler))
+	slog.SetDefault(slog.New(util.NewLogHandler(handler, opts)))
 }
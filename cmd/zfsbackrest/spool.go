@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+var spoolJSON bool
+var spoolOutput tableOutput
+
+var spoolGuard *util.CommandGuard
+
+var spoolCmd = &cobra.Command{
+	Use:   "spool",
+	Short: "List or resume spooled backups",
+	Long: `List or resume spooled backups.
+
+If spool.dir is set, backups write their snapshots to the spool directory before
+uploading them. Backups cut short, e.g. by a reboot, are resumed by the next
+backup, or by spool resume.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var spoolListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List spooled backups that haven't completed",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := spoolOutput.resolve(spoolJSON); err != nil {
+			return err
+		}
+
+		if cfg.Spool.Dir == "" {
+			return &errclass.ConfigError{Key: "spool.dir", Err: fmt.Errorf("spooling is not enabled")}
+		}
+
+		spooled, err := zfsbackrest.ListSpooled(cfg.Spool.Dir)
+		if err != nil {
+			return fmt.Errorf("failed to list spooled backups: %w", err)
+		}
+
+		if spoolOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(spooled)
+		}
+
+		if len(spooled) == 0 && !spoolOutput.tsv() {
+			fmt.Println("No spooled backups.")
+			return nil
+		}
+
+		return renderSpoolTable(spooled, &spoolOutput)
+	},
+}
+
+var spoolResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume spooled backups",
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		spoolGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return spoolGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.Spool.Dir == "" {
+			return &errclass.ConfigError{Key: "spool.dir", Err: fmt.Errorf("spooling is not enabled")}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if err := runner.ResumeSpooled(cmd.Context()); err != nil {
+			return fmt.Errorf("failed to resume spooled backups: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(spoolCmd)
+	spoolCmd.AddCommand(spoolListCmd)
+	spoolCmd.AddCommand(spoolResumeCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	spoolListCmd.Flags().BoolVar(&spoolJSON, "json", !isTerminal, "Output in JSON format")
+	spoolOutput.addFlags(spoolListCmd)
+}
+
+func renderSpoolTable(spooled []*zfsbackrest.BackupFSMData, out *tableOutput) error {
+	out.title("Spooled backups")
+
+	header := []string{"Dataset", "Backup ID", "Backup Type", "Size", "Snapshot"}
+	var rows [][]string
+	for _, data := range spooled {
+		snapshot := "uploaded"
+		if data.SpillPath != "" {
+			snapshot = "spooled"
+		}
+
+		rows = append(rows, []string{
+			data.Dataset,
+			data.Manifest.ID.String(),
+			string(data.BackupType),
+			humanize.Bytes(uint64(data.SnapshotSize)),
+			snapshot,
+		})
+	}
+
+	return out.render(header, rows)
+}
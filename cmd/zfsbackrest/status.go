@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/glock"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show running zfsbackrest operations and their progress",
+	Long: `Show running zfsbackrest operations and their progress.
+
+Backups persist their progress to the state directory as they run, so it can be
+shown from another shell. Progress left behind by a process that is gone is
+shown as stale.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lock, err := glock.Inspect("zfsbackrest")
+		if err != nil {
+			return fmt.Errorf("failed to inspect lock: %w", err)
+		}
+
+		checkpoints, err := zfsbackrest.ListCheckpoints(cfg.StateDir)
+		if err != nil {
+			return fmt.Errorf("failed to list backups in progress: %w", err)
+		}
+
+		slog.Debug("Status", "lock", lock, "checkpoints", checkpoints)
+
+		if statusJSON {
+			return json.NewEncoder(os.Stdout).Encode(struct {
+				Lock    *glock.LockInfo           `json:"lock"`
+				Backups []*zfsbackrest.Checkpoint `json:"backups"`
+			}{lock, checkpoints})
+		}
+
+		if err := renderLockStatus(lock); err != nil {
+			return err
+		}
+
+		fmt.Println()
+		if len(checkpoints) == 0 {
+			fmt.Println("No backups in progress.")
+			return nil
+		}
+
+		renderCheckpointTable(checkpoints)
+		return nil
+	},
+}
+
+func renderCheckpointTable(checkpoints []*zfsbackrest.Checkpoint) {
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Backups in progress\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"Dataset", "Backup ID", "Backup Type", "Phase", "Progress", "Chunk", "Started", "Updated", "PID"})
+	for _, c := range checkpoints {
+		progress := humanize.Bytes(uint64(c.Bytes))
+		if c.Expected > 0 {
+			progress = fmt.Sprintf("%s / %s (%.1f%%)",
+				humanize.Bytes(uint64(c.Bytes)),
+				humanize.Bytes(uint64(c.Expected)),
+				100*float64(c.Bytes)/float64(c.Expected),
+			)
+		}
+
+		pid := fmt.Sprintf("%d", c.PID)
+		if !c.Alive {
+			pid += " (stale)"
+		}
+
+		table.Append([]string{
+			c.Dataset,
+			c.BackupID.String(),
+			string(c.BackupType),
+			c.Phase,
+			progress,
+			fmt.Sprintf("%d", c.Chunk+1),
+			c.StartedAt.Format(time.RFC1123),
+			humanize.Time(c.UpdatedAt),
+			pid,
+		})
+	}
+	table.Render()
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	statusCmd.Flags().BoolVar(&statusJSON, "json", !isTerminal, "Output in JSON format")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/mattn/go-isatty"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var storeRebuildIdentity identityFlags
+var storeRebuildDryRun bool
+var storeRebuildNoEncryption bool
+
+var storeRebuildGuard *util.CommandGuard
+
+var storeVersionsJSON bool
+var storeVersionsOutput tableOutput
+
+var storeRollbackDryRun bool
+
+var storeRollbackGuard *util.CommandGuard
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage the repository store",
+	Long:  `Manage the repository store.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var storeRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "Rebuild the store from the backup manifests",
+	Long: `Rebuild the store from the manifest objects stored next to every snapshot.
+
+This is the recovery path when the store is lost or damaged. The existing store
+is not read. Backups whose snapshot and manifest both exist, and whose parent
+chain is complete, are restored. Snapshots without a manifest, and backups with
+a broken chain, are added as orphans. The age identity is needed to read the
+manifests, unless the repository was initialized with --no-encryption; pass
+--no-encryption here as well then.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		storeRebuildGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return storeRebuildGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if storeRebuildDryRun {
+			slog.Info("Dry run enabled, the store will not be replaced. Set --dry-run=false to actually replace the store.")
+		}
+
+		var identities []string
+		if !storeRebuildNoEncryption {
+			var err error
+			identities, err = storeRebuildIdentity.load()
+			if err != nil {
+				return err
+			}
+		}
+
+		store, err := zfsbackrest.RebuildStore(cmd.Context(), cfg, identities, zfsbackrest.RebuildOpts{
+			DryRun:       storeRebuildDryRun,
+			Age:          storeRebuildIdentity.ageOpts(),
+			NoEncryption: storeRebuildNoEncryption,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Rebuilt store: %d backups, %d orphans, datasets %v\n", store.Backups.Len(), len(store.Orphans), store.ManagedDatasets)
+		return nil
+	},
+}
+
+var storeVersionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "List the earlier versions of the store",
+	Long: `List the earlier versions of the store kept in the repository, oldest first.
+
+Every save keeps the store as saved as a version, up to
+repository.store_versions.keep versions. Roll the store back to one with
+` + "`zfsbackrest store rollback <id>`" + `.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := storeVersionsOutput.resolve(storeVersionsJSON); err != nil {
+			return err
+		}
+
+		strongStore, err := storage.NewStrongStore(cmd.Context(), &cfg.Repository)
+		if err != nil {
+			return fmt.Errorf("failed to create storage: %w", err)
+		}
+
+		versions, err := repository.ListStoreVersions(cmd.Context(), strongStore)
+		if err != nil {
+			return err
+		}
+
+		if storeVersionsOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(versions)
+		}
+
+		if len(versions) == 0 && !storeVersionsOutput.tsv() {
+			fmt.Println("No store versions.")
+			return nil
+		}
+
+		storeVersionsOutput.title("Store Versions")
+
+		header := []string{"ID", "Saved At"}
+		rows := make([][]string, len(versions))
+		for i, version := range versions {
+			rows[i] = []string{version.ID.String(), version.Time.Format(time.RFC1123)}
+		}
+
+		return storeVersionsOutput.render(header, rows)
+	},
+}
+
+var storeRollbackCmd = &cobra.Command{
+	Use:   "rollback <id>",
+	Short: "Roll the store back to an earlier version",
+	Long: `Roll the store back to one of its earlier versions kept in the repository,
+listed by ` + "`zfsbackrest store versions`" + `.
+
+This undoes an accidental destructive change to the store. It only replaces the
+store: snapshots deleted since the version was saved stay deleted, and show up
+as missing in verify. The backups and datasets the rollback changes are shown,
+and recorded in the audit log. The current store doesn't have to load, so a
+damaged store can be rolled back too.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		storeRollbackGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return storeRollbackGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := ulid.ParseStrict(args[0])
+		if err != nil {
+			return &errclass.ValidationError{Subject: "store version ID", Err: err}
+		}
+
+		if storeRollbackDryRun {
+			slog.Info("Dry run enabled, the store will not be replaced. Set --dry-run=false to actually roll it back.")
+		}
+
+		result, err := zfsbackrest.RollbackStore(cmd.Context(), cfg, id, storeRollbackDryRun)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range result.Changes {
+			fields := []string{string(change.Action)}
+			if change.Backup != nil {
+				fields = append(fields, change.Backup.String())
+			}
+			for _, field := range []string{change.Dataset, change.Details} {
+				if field != "" {
+					fields = append(fields, field)
+				}
+			}
+			fmt.Println(strings.Join(fields, " "))
+		}
+		fmt.Printf("Store at version %s: %d backups, %d orphans, datasets %v\n", id, result.Store.Backups.Len(), len(result.Store.Orphans), result.Store.ManagedDatasets)
+		if len(result.Missing) > 0 {
+			fmt.Printf("%s! The snapshots of %d backups of the version were deleted since, and can't be restored:\n", color.HiRedString("WARNING"), len(result.Missing))
+			for _, backup := range result.Missing {
+				fmt.Printf("  %s %s\n", backup.Dataset, backup.ID)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(storeCmd)
+	storeCmd.AddCommand(storeRebuildCmd)
+	storeCmd.AddCommand(storeVersionsCmd)
+	storeCmd.AddCommand(storeRollbackCmd)
+
+	storeRebuildIdentity.register(storeRebuildCmd)
+	storeRebuildCmd.Flags().BoolVar(&storeRebuildDryRun, "dry-run", true, "Dry run")
+	storeRebuildCmd.Flags().BoolVar(&storeRebuildNoEncryption, "no-encryption", false, "Rebuild the store of a repository initialized without encryption")
+
+	storeVersionsCmd.Flags().BoolVar(&storeVersionsJSON, "json", !isatty.IsTerminal(os.Stdout.Fd()), "Output in JSON format")
+	storeVersionsOutput.addFlags(storeVersionsCmd)
+
+	storeRollbackCmd.Flags().BoolVar(&storeRollbackDryRun, "dry-run", true, "Dry run")
+}
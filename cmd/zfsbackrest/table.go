@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+const (
+	formatTable = "table"
+	formatTSV   = "tsv"
+	formatJSON  = "json"
+)
+
+// tableOutput is how a command renders its tables: the format, and the
+// columns to show.
+type tableOutput struct {
+	format  string
+	columns []string
+}
+
+func (o *tableOutput) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.format, "format", "", "Output format: table, tsv or json. Defaults to json if --json is set, and table otherwise")
+	cmd.Flags().StringSliceVar(&o.columns, "columns", nil, "Comma separated columns to show, e.g. dataset,backup-id")
+}
+
+// resolve picks the format from --format, falling back to --json. TSV is
+// meant for scripts, so it is never colored.
+func (o *tableOutput) resolve(jsonFlag bool) error {
+	switch o.format {
+	case "":
+		o.format = formatTable
+		if jsonFlag {
+			o.format = formatJSON
+		}
+	case formatTable, formatJSON:
+	case formatTSV:
+		color.NoColor = true
+	default:
+		return &errclass.ValidationError{Subject: "format", Err: fmt.Errorf("unknown format %q, expected table, tsv or json", o.format)}
+	}
+
+	return nil
+}
+
+func (o *tableOutput) json() bool {
+	return o.format == formatJSON
+}
+
+func (o *tableOutput) tsv() bool {
+	return o.format == formatTSV
+}
+
+// title prints the title of a table. TSV output has none.
+func (o *tableOutput) title(title string) {
+	if o.tsv() {
+		return
+	}
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "%s\n", title)
+}
+
+// render renders rows in the selected columns. TSV output has no header, like
+// `zfs list -H`, so it can be piped straight into cut or awk.
+func (o *tableOutput) render(header []string, rows [][]string, opts ...tablewriter.Option) error {
+	indexes, err := selectColumns(header, o.columns)
+	if err != nil {
+		return err
+	}
+
+	if o.tsv() {
+		for _, row := range rows {
+			cells := make([]string, len(indexes))
+			for i, index := range indexes {
+				cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(strings.TrimSpace(row[index]))
+			}
+			fmt.Println(strings.Join(cells, "\t"))
+		}
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout).Options(opts...)
+	table.Header(pick(header, indexes))
+	for _, row := range rows {
+		table.Append(pick(row, indexes))
+	}
+	table.Render()
+
+	return nil
+}
+
+// selectColumns returns the indexes of columns in header, or of all of them if
+// columns is empty. Columns match case insensitively, ignoring spaces, dashes
+// and underscores, so "backup-id" selects "Backup ID".
+func selectColumns(header []string, columns []string) ([]int, error) {
+	if len(columns) == 0 {
+		indexes := make([]int, len(header))
+		for i := range header {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+
+	indexes := make([]int, 0, len(columns))
+	for _, column := range columns {
+		index := -1
+		for i, name := range header {
+			if normalizeColumn(name) == normalizeColumn(column) {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			available := make([]string, len(header))
+			for i, name := range header {
+				available[i] = strings.ToLower(strings.ReplaceAll(name, " ", "-"))
+			}
+			return nil, &errclass.ValidationError{
+				Subject: "columns",
+				Err:     fmt.Errorf("unknown column %q, expected one of %s", column, strings.Join(available, ", ")),
+			}
+		}
+		indexes = append(indexes, index)
+	}
+
+	return indexes, nil
+}
+
+func normalizeColumn(name string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+func pick(row []string, indexes []int) []string {
+	picked := make([]string, len(indexes))
+	for i, index := range indexes {
+		picked[i] = row[index]
+	}
+	return picked
+}
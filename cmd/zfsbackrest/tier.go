@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/spf13/cobra"
+)
+
+var tierDryRun bool
+var tierIgnoreMaintenance bool
+
+var tierGuard *util.CommandGuard
+
+var tierCmd = &cobra.Command{
+	Use:   "tier",
+	Short: "Move old backups to cold storage",
+	Long: `Move backups older than repository.tiering.cold_after from the hot to the cold storage.
+
+Snapshots are copied as-is, without being decrypted. Restores read from whichever storage a backup is in.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		tierGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return tierGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Tier command", "dry-run", tierDryRun)
+
+		if tierDryRun {
+			slog.Info("Dry run enabled, no backups will be moved. Set --dry-run=false to actually move backups.")
+		}
+
+		if !tierIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("tier")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if !tierIgnoreMaintenance && skipForRepositoryMaintenance("tier", runner.Store) {
+			return nil
+		}
+
+		err = runner.MoveDueToColdTier(cmd.Context(), zfsbackrest.TierOpts{DryRun: tierDryRun})
+		if err != nil {
+			return fmt.Errorf("failed to move backups to the cold tier: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tierCmd)
+
+	tierCmd.Flags().BoolVar(&tierDryRun, "dry-run", true, "Dry run")
+	tierCmd.Flags().BoolVar(&tierIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
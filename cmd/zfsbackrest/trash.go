@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var trashJSON bool
+var trashOutput tableOutput
+var trashRecoverDryRun bool
+
+var trashGuard *util.CommandGuard
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List or recover deleted backups",
+	Long: `List or recover deleted backups.
+
+If repository.trash.retention is set, deleted backups are kept in the trash for
+that long before cleanup --trash removes them for good.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List backups in the trash",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := trashOutput.resolve(trashJSON); err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		if trashOutput.json() {
+			return json.NewEncoder(os.Stdout).Encode(runner.Store.Trash)
+		}
+
+		if len(runner.Store.Trash) == 0 && !trashOutput.tsv() {
+			fmt.Println("The trash is empty.")
+			return nil
+		}
+
+		return renderTrashTable(runner.Store, cfg.Repository.Trash.Retention, &trashOutput)
+	},
+}
+
+var trashRecoverCmd = &cobra.Command{
+	Use:   "recover <backup-id>",
+	Short: "Recover a backup from the trash",
+	Long: `Recover a backup from the trash.
+
+Trashed backups it depends on are recovered with it. It is the same as
+undelete: the snapshots have to still be in the repository.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		trashGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return trashGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := ulid.ParseStrict(args[0])
+		if err != nil {
+			slog.Error("Failed to parse backup ID", "error", err)
+			return &errclass.ValidationError{Subject: "backup ID", Err: err}
+		}
+
+		if trashRecoverDryRun {
+			slog.Info("Dry run enabled, no backups will be recovered. Set --dry-run=false to actually recover backups.")
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// Recovering is undeleting, with the same checks.
+		if _, err := runner.Undelete(cmd.Context(), id, trashRecoverDryRun); err != nil {
+			return fmt.Errorf("failed to recover backup from the trash: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trashCmd)
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashRecoverCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	trashListCmd.Flags().BoolVar(&trashJSON, "json", !isTerminal, "Output in JSON format")
+	trashOutput.addFlags(trashListCmd)
+
+	trashRecoverCmd.Flags().BoolVar(&trashRecoverDryRun, "dry-run", true, "Dry run")
+}
+
+func renderTrashTable(store *repository.Store, retention time.Duration, out *tableOutput) error {
+	out.title("Trash")
+
+	var trashed []*repository.TrashedBackup
+	for _, t := range store.Trash {
+		trashed = append(trashed, t)
+	}
+
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].Backup.ID.Compare(trashed[j].Backup.ID) < 0
+	})
+
+	header := []string{"Dataset", "Backup ID", "Backup Type", "Depends On", "Size", "Deleted At", "Purge After"}
+	var rows [][]string
+	for _, t := range trashed {
+		dependsOn := ""
+		if t.Backup.DependsOn != nil {
+			dependsOn = t.Backup.DependsOn.String()
+		}
+
+		rows = append(rows, []string{
+			t.Backup.Dataset,
+			t.Backup.ID.String(),
+			string(t.Backup.Type),
+			dependsOn,
+			humanize.Bytes(uint64(t.Backup.Size)),
+			t.DeletedAt.Format(time.RFC1123),
+			t.DeletedAt.Add(retention).Format(time.RFC1123),
+		})
+	}
+
+	return out.render(header, rows)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var undeleteDryRun bool
+
+var undeleteGuard *util.CommandGuard
+
+var undeleteCmd = &cobra.Command{
+	Use:   "undelete <backup-id>",
+	Short: "Reverse the deletion of a backup",
+	Long: `Reverse the deletion of a backup.
+
+Backups in the trash, and orphans whose deletion started but didn't finish, are
+moved back to the backups, together with the deleted backups they depend on.
+Their snapshots must still exist in the repository.`,
+	Aliases: []string{"restore-deleted"},
+	Args:    cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		undeleteGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return undeleteGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := ulid.ParseStrict(args[0])
+		if err != nil {
+			slog.Error("Failed to parse backup ID", "error", err)
+			return &errclass.ValidationError{Subject: "backup ID", Err: err}
+		}
+
+		if undeleteDryRun {
+			slog.Info("Dry run enabled, no backups will be undeleted. Set --dry-run=false to actually undelete backups.")
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if _, err := runner.Undelete(cmd.Context(), id, undeleteDryRun); err != nil {
+			return fmt.Errorf("failed to undelete backup: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(undeleteCmd)
+
+	undeleteCmd.Flags().BoolVar(&undeleteDryRun, "dry-run", true, "Dry run")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/spf13/cobra"
+)
+
+var unmanageBackups string
+var unmanageSkipTrash bool
+var unmanageDryRun bool
+
+var unmanageGuard *util.CommandGuard
+
+var unmanageCmd = &cobra.Command{
+	Use:   "unmanage <dataset>",
+	Short: "Stop managing a dataset removed from the included datasets",
+	Long: `Stop managing a dataset removed from repository.included_datasets.
+
+Its backups are kept, expired by the retention policy, or deleted, as --backups
+says. The holds on the local snapshots of the backups kept are released, and
+the dataset is removed from the managed datasets, so it no longer counts
+towards the backup SLA. Backups kept stay restorable, and unmanage can be run
+again later to expire or delete them.
+
+Remove the dataset from repository.included_datasets first, or it is managed
+again by the next run.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		unmanageGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return unmanageGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backups, err := zfsbackrest.ParseUnmanageBackups(unmanageBackups)
+		if err != nil {
+			return err
+		}
+
+		if unmanageDryRun {
+			slog.Info("Dry run enabled, nothing will be deleted or unmanaged. Set --dry-run=false to actually unmanage the dataset.")
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		result, err := runner.Unmanage(cmd.Context(), args[0], zfsbackrest.UnmanageOpts{
+			Backups:   backups,
+			SkipTrash: unmanageSkipTrash,
+			DryRun:    unmanageDryRun,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to unmanage dataset: %w", err)
+		}
+
+		for _, backup := range result.Deleted {
+			fmt.Printf("delete %s %s\n", backup.ID, backup.Type)
+		}
+		for _, backup := range result.Kept {
+			fmt.Printf("keep %s %s\n", backup.ID, backup.Type)
+		}
+		fmt.Printf("Dataset %s: %d backups deleted, %d kept, %d of them held by Object Lock\n", args[0], len(result.Deleted), len(result.Kept), len(result.Held))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unmanageCmd)
+
+	unmanageCmd.Flags().StringVar(&unmanageBackups, "backups", string(zfsbackrest.UnmanageKeep), "What to do with the backups of the dataset: keep, expire or delete")
+	unmanageCmd.Flags().BoolVar(&unmanageSkipTrash, "skip-trash", false, "Delete the backups for good, even if the trash is enabled")
+	unmanageCmd.Flags().BoolVar(&unmanageDryRun, "dry-run", true, "Dry run")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/mattn/go-isatty"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var jsonVerifyHistory bool
+
+var verifyHistoryCmd = &cobra.Command{
+	Use:   "verify-history",
+	Short: "Verify the store against its history log",
+	Long: `Verify the store against its history log.
+
+Every store save appends the store's hash to an append-only history log in the
+repository. This checks that the log is an unbroken chain, and that the current
+store is the last one recorded, so unexpected rollbacks or edits of the
+repository metadata are detected.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		report, verifyErr := repository.VerifyHistory(cmd.Context(), runner.Storage, runner.Store)
+		if report == nil {
+			return verifyErr
+		}
+
+		if jsonVerifyHistory {
+			if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+				return err
+			}
+		} else {
+			renderHistory(report)
+		}
+
+		if verifyErr != nil {
+			slog.Error("Store history verification failed", "error", verifyErr)
+			return verifyErr
+		}
+
+		if len(report.Entries) == 0 {
+			slog.Warn("The store has no history yet. It is recorded from the next store save on.")
+			return nil
+		}
+
+		slog.Info("Store history verified", "entries", len(report.Entries))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyHistoryCmd)
+
+	isTerminal := isatty.IsTerminal(os.Stdout.Fd())
+	verifyHistoryCmd.Flags().BoolVar(&jsonVerifyHistory, "json", !isTerminal, "Output in JSON format")
+}
+
+func renderHistory(report *repository.HistoryReport) {
+	color.New(color.Bold).Add(color.Underline).Fprintf(os.Stdout, "Store History\n")
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.Header([]string{"#", "Time", "Operation", "Host", "Store Hash", "Current"})
+	for i, entry := range report.Entries {
+		current := ""
+		if i == report.MatchedEntry {
+			current = "*"
+		}
+
+		table.Append([]string{
+			fmt.Sprintf("%d", i+1),
+			entry.Time.Format(time.RFC1123),
+			entry.Operation,
+			entry.Host,
+			entry.StoreHash[:min(len(entry.StoreHash), 12)],
+			current,
+		})
+	}
+	table.Render()
+}
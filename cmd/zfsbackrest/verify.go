@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/internal/zfsbackrest"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/oklog/ulid/v2"
+	"github.com/spf13/cobra"
+)
+
+var verifyIdentity identityFlags
+var verifyTuning verifyFlags
+var verifyIgnoreMaintenance bool
+
+var verifyGuard *util.CommandGuard
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [backup-id...]",
+	Short: "Read back backups and check them against their checksums",
+	Long: `Read back backups and check them against their checksums.
+
+Without backup IDs, the backups are picked by the policy under
+repository.verification: a sample fraction of all backups, plus every backup
+not verified within max_age. Run it periodically, e.g. with
+systemd/zfsbackrest-verify.timer. The time of the last successful verification
+of each backup is recorded in the store.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		verifyGuard, err = util.NewCommandGuard(util.CommandGuardOpts{
+			NeedsRoot:       true,
+			NeedsGlobalLock: true,
+			BreakStaleLock:  breakLock,
+		})
+		if err != nil {
+			slog.Error("Failed to initialize command guard", "error", err)
+			return fmt.Errorf("failed to initialize command guard: %w", err)
+		}
+
+		return nil
+	},
+	PostRunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Running post-run hook")
+		return verifyGuard.OnExit()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Debug("Verify command", "backups", args)
+
+		scheduled := len(args) == 0
+		if scheduled && !verifyIgnoreMaintenance {
+			skip, err := skipForLocalMaintenance("verify")
+			if err != nil {
+				return err
+			}
+			if skip {
+				return nil
+			}
+		}
+
+		identities, err := verifyIdentity.loadReadingStore(cmd, false)
+		if err != nil {
+			return err
+		}
+
+		runner, err := zfsbackrest.NewRunnerFromExistingRepository(cmd.Context(), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create runner: %w", err)
+		}
+
+		unlock, err := lockRepository(cmd.Context(), runner)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if scheduled && !verifyIgnoreMaintenance && skipForRepositoryMaintenance("verify", runner.Store) {
+			return nil
+		}
+
+		encryption, err := verifyIdentity.decryption(runner.Store, identities)
+		if err != nil {
+			return fmt.Errorf("failed to create encryption instance: %w", err)
+		}
+		runner.Encryption = encryption
+
+		opts, err := verifyTuning.opts(cmd)
+		if err != nil {
+			return err
+		}
+
+		if scheduled {
+			return runner.VerifyScheduled(cmd.Context(), opts)
+		}
+
+		var backups []*repository.Backup
+		for _, arg := range args {
+			id, err := ulid.ParseStrict(arg)
+			if err != nil {
+				slog.Error("Failed to parse backup ID", "error", err)
+				return &errclass.ValidationError{Subject: "backup ID", Err: err}
+			}
+
+			backup, ok := runner.Store.Backups.Get(id)
+			if !ok {
+				return &errclass.ValidationError{Subject: "backup", Err: fmt.Errorf("backup %s not found", id)}
+			}
+			backups = append(backups, backup)
+		}
+
+		return runner.VerifyBackups(cmd.Context(), backups, opts)
+	},
+}
+
+// verifyFlags override the configured verification concurrency and bandwidth
+// limit for a single run.
+type verifyFlags struct {
+	concurrency    int
+	bandwidthLimit string
+}
+
+func (f *verifyFlags) register(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&f.concurrency, "concurrency", 1, "Number of backups to verify at once (default repository.verification.concurrency)")
+	cmd.Flags().StringVar(&f.bandwidthLimit, "bandwidth-limit", "", `Maximum read rate of all workers together, like "50MB" per second (default repository.verification.bandwidth_limit)`)
+}
+
+func (f *verifyFlags) opts(cmd *cobra.Command) (zfsbackrest.VerifyOpts, error) {
+	verification := cfg.Repository.Verification
+	if cmd.Flags().Changed("concurrency") {
+		verification.Concurrency = f.concurrency
+	}
+	if cmd.Flags().Changed("bandwidth-limit") {
+		verification.BandwidthLimit = f.bandwidthLimit
+	}
+
+	if verification.Concurrency < 1 {
+		return zfsbackrest.VerifyOpts{}, &errclass.ConfigError{
+			Key: "repository.verification.concurrency",
+			Err: fmt.Errorf("concurrency must be at least 1, got %d", verification.Concurrency),
+		}
+	}
+
+	return zfsbackrest.VerifyOptsFromConfig(&verification)
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyIdentity.register(verifyCmd)
+	verifyTuning.register(verifyCmd)
+	verifyCmd.Flags().BoolVar(&verifyIgnoreMaintenance, "ignore-maintenance", false, "Run even if maintenance mode is on")
+}
@@ -0,0 +1,120 @@
+// Package compression compresses snapshots before they are encrypted, and
+// decompresses them after they are decrypted. Encrypted data doesn't
+// compress, so it has to happen first. `zfs send -c` only keeps the blocks of
+// datasets that are compressed already, and sends everything else as is.
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/klauspost/compress/zstd"
+)
+
+// AlgorithmZstd is recorded on backups whose snapshot is compressed with
+// zstd.
+const AlgorithmZstd = "zstd"
+
+var ErrUnknownAlgorithm = errors.New("unknown compression algorithm")
+
+// Validate checks the compression config. An empty algorithm disables
+// compression.
+func Validate(compressionConfig *config.Compression) error {
+	switch compressionConfig.Algorithm {
+	case "":
+		return nil
+	case AlgorithmZstd:
+	default:
+		return &errclass.ConfigError{
+			Key: "repository.compression.algorithm",
+			Err: fmt.Errorf("%w %q, expected %q", ErrUnknownAlgorithm, compressionConfig.Algorithm, AlgorithmZstd),
+		}
+	}
+
+	if compressionConfig.Level < 1 || compressionConfig.Level > 22 {
+		return &errclass.ConfigError{Key: "repository.compression.level", Err: errors.New("must be between 1 and 22")}
+	}
+
+	return nil
+}
+
+// Wrap returns enc, compressing with algorithm before encrypting, and
+// decompressing after decrypting. level only matters for compressing. enc is
+// returned as is if algorithm is empty.
+func Wrap(enc encryption.Encryption, algorithm string, level int) (encryption.Encryption, error) {
+	switch algorithm {
+	case "":
+		return enc, nil
+	case AlgorithmZstd:
+		return &zstdEncryption{enc: enc, level: zstd.EncoderLevelFromZstd(level)}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownAlgorithm, algorithm)
+	}
+}
+
+type zstdEncryption struct {
+	enc   encryption.Encryption
+	level zstd.EncoderLevel
+}
+
+func (z *zstdEncryption) EncryptedWriter(dst io.Writer) (io.WriteCloser, error) {
+	encWriter, err := z.enc.EncryptedWriter(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	zstdWriter, err := zstd.NewWriter(encWriter, zstd.WithEncoderLevel(z.level))
+	if err != nil {
+		_ = encWriter.Close()
+		return nil, err
+	}
+
+	return &zstdWriteCloser{Encoder: zstdWriter, encWriter: encWriter}, nil
+}
+
+func (z *zstdEncryption) DecryptedReader(src io.ReadCloser) (io.ReadCloser, error) {
+	decReader, err := z.enc.DecryptedReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	zstdReader, err := zstd.NewReader(decReader, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = decReader.Close()
+		return nil, err
+	}
+
+	return &zstdReadCloser{Decoder: zstdReader, decReader: decReader}, nil
+}
+
+// zstdWriteCloser flushes the last zstd frame on Close, then closes the
+// encrypted writer it writes to.
+type zstdWriteCloser struct {
+	*zstd.Encoder
+	encWriter io.WriteCloser
+}
+
+func (w *zstdWriteCloser) Close() error {
+	if err := w.Encoder.Close(); err != nil {
+		_ = w.encWriter.Close()
+		return err
+	}
+
+	return w.encWriter.Close()
+}
+
+// zstdReadCloser releases the decoder on Close, and closes the decrypted
+// reader it reads from.
+type zstdReadCloser struct {
+	*zstd.Decoder
+	decReader io.ReadCloser
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.decReader.Close()
+}
@@ -0,0 +1,97 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+)
+
+func TestZstdRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageEnc, err := encryption.NewAgeFromIdentity(identity.String(), &config.Age{RecipientPublicKey: identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := bytes.Repeat([]byte("zfs send stream "), 64*1024)
+
+	for name, enc := range map[string]encryption.Encryption{"age": ageEnc, "passthrough": encryption.Passthrough{}} {
+		t.Run(name, func(t *testing.T) {
+			compressed, err := Wrap(enc, AlgorithmZstd, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var object bytes.Buffer
+			w, err := compressed.EncryptedWriter(&object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(stream); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if object.Len() >= len(stream)/10 {
+				t.Fatalf("expected the stream to compress, got %d of %d bytes", object.Len(), len(stream))
+			}
+
+			r, err := compressed.DecryptedReader(io.NopCloser(&object))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, stream) {
+				t.Fatalf("expected the stream back, got %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestWrapWithoutCompression(t *testing.T) {
+	enc, err := Wrap(encryption.Passthrough{}, "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := enc.(encryption.Passthrough); !ok {
+		t.Fatalf("expected the encryption as is, got %T", enc)
+	}
+
+	if _, err := Wrap(encryption.Passthrough{}, "lz4", 3); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("expected an unknown algorithm to fail, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  config.Compression
+		wantErr bool
+	}{
+		{name: "disabled", config: config.Compression{}},
+		{name: "zstd", config: config.Compression{Algorithm: AlgorithmZstd, Level: 3}},
+		{name: "unknown algorithm", config: config.Compression{Algorithm: "gzip", Level: 3}, wantErr: true},
+		{name: "level too low", config: config.Compression{Algorithm: AlgorithmZstd, Level: 0}, wantErr: true},
+		{name: "level too high", config: config.Compression{Algorithm: AlgorithmZstd, Level: 23}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Validate(&tc.config); (err != nil) != tc.wantErr {
+				t.Fatalf("got %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
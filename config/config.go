@@ -3,6 +3,7 @@ package config
 import (
 	"strings"
 
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/spf13/viper"
 )
 
@@ -11,6 +12,18 @@ type Config struct {
 	Debug             bool              `mapstructure:"debug"`
 	UploadConcurrency UploadConcurrency `mapstructure:"upload_concurrency"`
 	ZFS               ZFS               `mapstructure:"zfs"`
+	Progress          Progress          `mapstructure:"progress"`
+	StateDir          string            `mapstructure:"state_dir"`
+	// SpillDir is where snapshots are spilled, encrypted, before they are
+	// uploaded, so failed uploads are retried without sending them again.
+	// Snapshots are streamed straight to the repository when it is empty.
+	SpillDir string `mapstructure:"spill_dir"`
+	Spool    Spool  `mapstructure:"spool"`
+	Log      Log    `mapstructure:"log"`
+	// LocalStore keeps a local copy of the store for disaster recovery.
+	LocalStore LocalStore `mapstructure:"local_store"`
+	Restore    Restore    `mapstructure:"restore"`
+	Vault      Vault      `mapstructure:"vault"`
 }
 
 func LoadConfig(v *viper.Viper, path string) (*Config, error) {
@@ -21,16 +34,67 @@ func LoadConfig(v *viper.Viper, path string) (*Config, error) {
 	v.AutomaticEnv()
 
 	// Defaults.
+	v.SetDefault("repository.backend", string(BackendS3))
+	v.SetDefault("repository.swift.user_domain", "Default")
+	v.SetDefault("repository.swift.project_domain", "Default")
+	v.SetDefault("repository.swift.segment_size", 512*1024*1024)
+	v.SetDefault("repository.rclone.binary", "rclone")
 	v.SetDefault("repository.s3.part_size", 128*1024*1024)
 	v.SetDefault("repository.s3.upload_threads", 1)
+	v.SetDefault("repository.s3.assume_role.session_name", "zfsbackrest")
+	v.SetDefault("repository.s3.assume_role.duration", "1h")
+	v.SetDefault("repository.s3.retrieval.tier", "Standard")
+	v.SetDefault("repository.s3.retrieval.days", 1)
+	v.SetDefault("repository.s3.retrieval.timeout", "48h")
+	v.SetDefault("repository.s3.retrieval.poll_interval", "5m")
+	v.SetDefault("repository.verification.concurrency", 1)
+	v.SetDefault("repository.retry.max_retries", 3)
+	v.SetDefault("repository.retry.initial_wait", "1s")
+	v.SetDefault("repository.retry.max_wait", "30s")
+	v.SetDefault("repository.retry.timeout", "5m")
+	v.SetDefault("repository.compression.level", 3)
+	v.SetDefault("repository.lock.ttl", "5m")
+	v.SetDefault("repository.expiry.keep_last_chain", true)
+	v.SetDefault("repository.store_versions.keep", 10)
+	v.SetDefault("repository.orphans.min_age", "24h")
+	v.SetDefault("progress.mode", string(ProgressModeAuto))
+	v.SetDefault("progress.log_interval", "1m")
+	v.SetDefault("state_dir", "/var/lib/zfsbackrest")
+	v.SetDefault("spool.max_retries", 20)
+	v.SetDefault("spool.max_wait", "10m")
+	v.SetDefault("local_store.keep", 5)
+	v.SetDefault("log.sampling.interval", "1s")
+	v.SetDefault("log.sampling.initial", 100)
+	v.SetDefault("log.sampling.thereafter", 100)
+	v.SetDefault("vault.timeout", "30s")
+	v.SetDefault("vault.auth.method", VaultAuthToken)
+	v.SetDefault("vault.auth.approle.mount", "approle")
+	v.SetDefault("vault.kv.mount", "secret")
+	v.SetDefault("vault.kv.field", "identity")
+	v.SetDefault("vault.kv.version", 2)
+	v.SetDefault("vault.transit.mount", "transit")
 
 	if err := v.ReadInConfig(); err != nil {
-		return nil, err
+		return nil, &errclass.ConfigError{Err: err}
 	}
 
 	var cfg Config
 	if err := v.Unmarshal(&cfg); err != nil {
-		return nil, err
+		return nil, &errclass.ConfigError{Err: err}
+	}
+
+	for i := range cfg.Repository.Replicas {
+		cfg.Repository.Replicas[i].setDefaults()
+		if cfg.Repository.Replicas[i].Retry == (StorageRetry{}) {
+			cfg.Repository.Replicas[i].Retry = cfg.Repository.Retry
+		}
+	}
+
+	for i := range cfg.Repository.Routes {
+		cfg.Repository.Routes[i].setDefaults()
+		if cfg.Repository.Routes[i].Retry == (StorageRetry{}) {
+			cfg.Repository.Routes[i].Retry = cfg.Repository.Retry
+		}
 	}
 
 	return &cfg, nil
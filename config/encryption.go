@@ -1,9 +1,39 @@
 package config
 
+// EncryptionModeNone is the mode of repositories initialized without
+// encryption. Snapshots are stored as zfs send writes them, which is only
+// safe on storage that is trusted.
+const EncryptionModeNone = "none"
+
 type Encryption struct {
-	Age Age `mapstructure:"age" json:"age"`
+	// Mode is empty for age encryption, or EncryptionModeNone. It is fixed
+	// when the repository is initialized.
+	Mode string `mapstructure:"mode" json:"mode,omitempty"`
+	Age  Age    `mapstructure:"age" json:"age"`
+}
+
+// Disabled reports whether the repository was initialized without
+// encryption.
+func (e *Encryption) Disabled() bool {
+	return e.Mode == EncryptionModeNone
 }
 
 type Age struct {
 	RecipientPublicKey string `mapstructure:"recipient_public_key" json:"recipient_public_key"`
+	// RecoveryRecipientPublicKey is a recipient every backup is encrypted to
+	// as well, whose identity is kept offline, so backups outlive the loss of
+	// the identity of RecipientPublicKey. It is optional.
+	RecoveryRecipientPublicKey string `mapstructure:"recovery_recipient_public_key" json:"recovery_recipient_public_key,omitempty"`
+}
+
+// StoreEncryption encrypts the store at rest with age, to the repository's
+// recipient and to the recipient of IdentityFile. The backup host only has
+// the repository's recipient, so it reads the store back with IdentityFile,
+// an age identity kept on the host. A restore host without it reads the store
+// with the repository's identity.
+type StoreEncryption struct {
+	Enabled bool `mapstructure:"enabled"`
+	// IdentityFile also reads the store after Enabled is turned off, until
+	// it is saved in plaintext again.
+	IdentityFile string `mapstructure:"identity_file"`
 }
@@ -0,0 +1,11 @@
+package config
+
+// LocalStore keeps a copy of the store on local disk, written after every
+// save, so the backup metadata survives a bucket outage. It is disabled when
+// Path is empty.
+type LocalStore struct {
+	Path string `mapstructure:"path"`
+	// Keep is how many earlier copies are kept, as Path.1 (the newest) to
+	// Path.<Keep>.
+	Keep int `mapstructure:"keep"`
+}
@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+type Log struct {
+	// Level is the default log level, e.g. "info". It is debug when debug is
+	// set, and info otherwise, if it is empty.
+	Level string `mapstructure:"level"`
+	// Levels overrides the level of subsystems, the packages log lines come
+	// from, e.g. storage = "debug" or fsm = "warn".
+	Levels   map[string]string `mapstructure:"levels"`
+	Sampling LogSampling       `mapstructure:"sampling"`
+}
+
+// LogSampling limits how often the same debug or info message is logged, so
+// hot paths, like the reads and writes of a transfer, don't flood the log.
+// Warnings and errors are never sampled.
+type LogSampling struct {
+	// Interval is the window messages are counted in. 0 disables sampling.
+	Interval time.Duration `mapstructure:"interval"`
+	// Initial is how many times a message is logged in every interval, before
+	// only every Thereafter-th is. Thereafter 0 drops the rest.
+	Initial    int `mapstructure:"initial"`
+	Thereafter int `mapstructure:"thereafter"`
+}
@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+type ProgressMode string
+
+const (
+	// ProgressModeAuto renders progress bars when stderr is a terminal and
+	// falls back to periodic log lines otherwise.
+	ProgressModeAuto ProgressMode = "auto"
+	ProgressModeBar  ProgressMode = "bar"
+	ProgressModeLog  ProgressMode = "log"
+)
+
+type Progress struct {
+	Mode ProgressMode `mapstructure:"mode"`
+	// LogInterval is the interval between progress log lines when progress
+	// bars are not rendered.
+	LogInterval time.Duration `mapstructure:"log_interval"`
+}
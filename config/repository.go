@@ -4,11 +4,176 @@ import "time"
 
 type Repository struct {
 	Expiry           Expiry           `mapstructure:"expiry"`
+	Backend          Backend          `mapstructure:"backend"`
 	S3               S3Store          `mapstructure:"s3"`
+	Swift            SwiftStore       `mapstructure:"swift"`
+	Rclone           RcloneStore      `mapstructure:"rclone"`
+	Replicas         []Replica        `mapstructure:"replicas"`
+	Routes           []Route          `mapstructure:"routes"`
+	Tiering          Tiering          `mapstructure:"tiering"`
+	Trash            Trash            `mapstructure:"trash"`
+	Orphans          Orphans          `mapstructure:"orphans"`
+	Verification     Verification     `mapstructure:"verification"`
+	SLA              SLA              `mapstructure:"sla"`
 	IncludedDatasets IncludedDatasets `mapstructure:"included_datasets"`
+	Retry            StorageRetry     `mapstructure:"retry"`
+	StoreEncryption  StoreEncryption  `mapstructure:"store_encryption"`
+	Compression      Compression      `mapstructure:"compression"`
+	Lock             RepositoryLock   `mapstructure:"lock"`
+	StoreVersions    StoreVersions    `mapstructure:"store_versions"`
 }
 
+// RepositoryLock is the lease a host holds in the backend while it mutates
+// the store, so hosts sharing a repository don't overwrite each other's
+// changes. It is refreshed every TTL/3, and expires after TTL if its holder
+// dies. Acquiring it retries for Wait before giving up.
+type RepositoryLock struct {
+	TTL  time.Duration `mapstructure:"ttl"`
+	Wait time.Duration `mapstructure:"wait"`
+}
+
+// Compression compresses snapshots with Algorithm before they are encrypted.
+// It is disabled when Algorithm is empty. Level is a zstd level, from 1 to
+// 22; higher levels are mapped to the slowest level the encoder has.
+// Restores decompress whatever each backup was compressed with, so it can be
+// changed at any time.
+type Compression struct {
+	Algorithm string `mapstructure:"algorithm"`
+	Level     int    `mapstructure:"level"`
+}
+
+// Tiering moves backups older than ColdAfter from the hot bucket (or
+// container) to the cold one. It is disabled when ColdAfter is 0.
+type Tiering struct {
+	ColdAfter time.Duration `mapstructure:"cold_after"`
+}
+
+// Trash keeps the snapshots of deleted backups for Retention, so an
+// accidental delete can be undone, until cleanup purges them. It is disabled
+// when Retention is 0.
+type Trash struct {
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// Orphans is how orphans are cleaned up. Uncommitted orphans younger than
+// MinAge are left alone, as their backup may still be uploading from another
+// process. It is disabled when MinAge is 0.
+type Orphans struct {
+	MinAge time.Duration `mapstructure:"min_age"`
+}
+
+// Verification is the policy of scheduled verification runs. Each run
+// verifies a Sample fraction of the backups, and every backup that hasn't been
+// verified within MaxAge. A run stops starting new verifications after
+// Window. MaxAge and Window are unlimited when 0.
+//
+// Concurrency and BandwidthLimit are the defaults for both verify and scrub.
+// BandwidthLimit is a size per second, like "50MB", shared by all workers,
+// and unlimited when empty.
+type Verification struct {
+	Sample         float64       `mapstructure:"sample"`
+	MaxAge         time.Duration `mapstructure:"max_age"`
+	Window         time.Duration `mapstructure:"window"`
+	Concurrency    int           `mapstructure:"concurrency"`
+	BandwidthLimit string        `mapstructure:"bandwidth_limit"`
+}
+
+// Replica is a storage target every backup is replicated to, besides the
+// repository itself. The store stays in the repository. Replicas receive the
+// snapshots and manifests, so `zfsbackrest rebuild` can recreate a store from
+// one.
+type Replica struct {
+	// Name identifies the replica in the store and on the command line.
+	Name    string      `mapstructure:"name"`
+	Backend Backend     `mapstructure:"backend"`
+	S3      S3Store     `mapstructure:"s3"`
+	Swift   SwiftStore  `mapstructure:"swift"`
+	Rclone  RcloneStore `mapstructure:"rclone"`
+	// Retry is the repository's retry policy, unless the replica sets its
+	// own.
+	Retry StorageRetry `mapstructure:"retry"`
+}
+
+// setDefaults fills in the defaults LoadConfig sets for the repository's own
+// backend, which viper doesn't apply to the entries of an array of tables.
+func (r *Replica) setDefaults() {
+	if r.Backend == "" {
+		r.Backend = BackendS3
+	}
+	if r.S3.PartSize == 0 {
+		r.S3.PartSize = 128 * 1024 * 1024
+	}
+	if r.S3.UploadThreads == 0 {
+		r.S3.UploadThreads = 1
+	}
+	if r.S3.AssumeRole.SessionName == "" {
+		r.S3.AssumeRole.SessionName = "zfsbackrest"
+	}
+	if r.S3.AssumeRole.Duration == 0 {
+		r.S3.AssumeRole.Duration = time.Hour
+	}
+	if r.Swift.UserDomain == "" {
+		r.Swift.UserDomain = "Default"
+	}
+	if r.Swift.ProjectDomain == "" {
+		r.Swift.ProjectDomain = "Default"
+	}
+	if r.Swift.SegmentSize == 0 {
+		r.Swift.SegmentSize = 512 * 1024 * 1024
+	}
+	if r.Rclone.Binary == "" {
+		r.Rclone.Binary = "rclone"
+	}
+}
+
+type Backend string
+
+const (
+	BackendS3     Backend = "s3"
+	BackendSwift  Backend = "swift"
+	BackendRclone Backend = "rclone"
+)
+
+// Expiry is how long backups of each type are kept. If GFS is enabled, it
+// decides which backups are kept instead, and the durations are ignored.
+//
+// KeepTags are tag selectors, key=value or a bare key for any value. Backups
+// with any of them never expire, and neither do the backups they depend on.
+//
+// KeepLastChain keeps the latest restore point built on the newest full
+// backup of each dataset from expiring, so a lapsed backup schedule doesn't
+// leave a dataset without backups. It is on by default.
 type Expiry struct {
+	Full          time.Duration `mapstructure:"full"`
+	Diff          time.Duration `mapstructure:"diff"`
+	Incr          time.Duration `mapstructure:"incr"`
+	GFS           GFS           `mapstructure:"gfs"`
+	KeepTags      []string      `mapstructure:"keep_tags"`
+	KeepLastChain bool          `mapstructure:"keep_last_chain"`
+}
+
+// GFS is a grandfather-father-son retention policy, evaluated for each
+// dataset on its own. The latest backup of each of the last Daily days,
+// Weekly ISO weeks, Monthly months and Yearly years that have a backup is
+// kept, along with the backups it depends on. Every other backup expires.
+// Periods are in the local time zone. It is enabled when any count is set.
+type GFS struct {
+	Daily   int `mapstructure:"daily"`
+	Weekly  int `mapstructure:"weekly"`
+	Monthly int `mapstructure:"monthly"`
+	Yearly  int `mapstructure:"yearly"`
+}
+
+// Enabled reports whether the policy keeps any backups.
+func (g *GFS) Enabled() bool {
+	return g.Daily > 0 || g.Weekly > 0 || g.Monthly > 0 || g.Yearly > 0
+}
+
+// SLA is the longest a managed dataset may go without a backup of each type,
+// e.g. because the host was off when it was scheduled. A backup of a more
+// complete type counts too: a full for a diff, and either for an incr. A type
+// isn't checked when it is 0.
+type SLA struct {
 	Full time.Duration `mapstructure:"full"`
 	Diff time.Duration `mapstructure:"diff"`
 	Incr time.Duration `mapstructure:"incr"`
@@ -0,0 +1,12 @@
+package config
+
+// Restore configures restores. While a backup of a chain is received, the next
+// one is downloaded, still encrypted, to PrefetchDir, overlapping the download
+// with `zfs recv`. Prefetching is disabled when PrefetchDir is empty.
+type Restore struct {
+	// PrefetchDir needs room for one snapshot of PrefetchMaxSize.
+	PrefetchDir string `mapstructure:"prefetch_dir"`
+	// PrefetchMaxSize, e.g. "20GiB", caps the size of prefetched snapshots.
+	// Larger ones are streamed. Empty for no limit.
+	PrefetchMaxSize string `mapstructure:"prefetch_max_size"`
+}
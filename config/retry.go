@@ -0,0 +1,17 @@
+package config
+
+import "time"
+
+// StorageRetry retries storage calls that fail with a transient error, like
+// an S3 5xx response or a dropped connection, before the failure reaches the
+// step that made the call. The wait starts at InitialWait and doubles on
+// every retry, up to MaxWait. Retries are disabled when MaxRetries is 0.
+type StorageRetry struct {
+	MaxRetries  int           `mapstructure:"max_retries"`
+	InitialWait time.Duration `mapstructure:"initial_wait"`
+	MaxWait     time.Duration `mapstructure:"max_wait"`
+	// Timeout bounds each attempt of a call, e.g. loading the store. It
+	// bounds opening snapshot streams, but not reading or writing them. It
+	// is unlimited when 0.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
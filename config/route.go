@@ -0,0 +1,14 @@
+package config
+
+// Route sends the snapshots of the datasets matching Datasets to a storage
+// target of its own instead of the repository's, e.g. a hot bucket for VMs
+// and a cheaper one for archives. The target is configured like a replica.
+// The store and the manifests stay in the repository, and the route of each
+// backup is recorded in the store, so changing the routes only affects new
+// backups. The first route matching a dataset wins; datasets no route
+// matches use the repository.
+type Route struct {
+	// Datasets are glob patterns, like included_datasets.
+	Datasets []string `mapstructure:"datasets"`
+	Replica  `mapstructure:",squash"`
+}
@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// Spool writes the encrypted stream of every snapshot to disk before it is
+// uploaded, for hosts with unreliable uplinks. Uploads are retried for much
+// longer than usual, and backups cut short, e.g. by a reboot, are resumed by
+// the next backup.
+type Spool struct {
+	// Dir enables spooling. It needs room for the largest snapshots uploaded
+	// at once.
+	Dir string `mapstructure:"dir"`
+	// MaxRetries is how many times a failed upload is retried.
+	MaxRetries int `mapstructure:"max_retries"`
+	// MaxWait caps the wait between retries, which doubles on every retry.
+	MaxWait time.Duration `mapstructure:"max_wait"`
+	// MinSize and MaxSize, e.g. "1GiB", limit spooling to the snapshots whose
+	// estimated send size is within them. The others are streamed straight to
+	// the repository. Either can be empty for no limit.
+	MinSize string `mapstructure:"min_size"`
+	MaxSize string `mapstructure:"max_size"`
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type S3Store struct {
 	Endpoint string `mapstructure:"endpoint"`
 	Bucket   string `mapstructure:"bucket"`
@@ -7,6 +9,174 @@ type S3Store struct {
 	Secret   string `mapstructure:"secret"`
 	Region   string `mapstructure:"region"`
 
+	// Prefix is prepended to every object key, so several repositories, or
+	// other tools, can share a bucket. It also applies to ColdBucket.
+	Prefix string `mapstructure:"prefix"`
+
+	// ColdBucket receives backups moved out of Bucket by tiering.
+	ColdBucket string `mapstructure:"cold_bucket"`
+
 	PartSize      uint64 `mapstructure:"part_size"`
 	UploadThreads uint   `mapstructure:"upload_threads"`
+
+	// Insecure talks to Endpoint over plain HTTP, e.g. a MinIO on the LAN.
+	// Credentials and metadata are sent in the clear; snapshots are still
+	// encrypted.
+	Insecure bool  `mapstructure:"insecure"`
+	TLS      S3TLS `mapstructure:"tls"`
+
+	// UploadEndpoint, if set, is used for snapshot uploads instead of
+	// Endpoint, e.g. a separate high-bandwidth endpoint. Everything else uses
+	// Endpoint.
+	UploadEndpoint string `mapstructure:"upload_endpoint"`
+	// TransferAcceleration uploads snapshots through the AWS S3 Transfer
+	// Acceleration endpoint. It only works with AWS.
+	TransferAcceleration bool `mapstructure:"transfer_acceleration"`
+
+	Retrieval    S3Retrieval      `mapstructure:"retrieval"`
+	Tags         S3Tags           `mapstructure:"tags"`
+	StorageClass S3StorageClasses `mapstructure:"storage_class"`
+	AssumeRole   S3AssumeRole     `mapstructure:"assume_role"`
+	SSE          S3SSE            `mapstructure:"sse"`
+	ObjectLock   S3ObjectLock     `mapstructure:"object_lock"`
+
+	// PurgeVersions deletes every version of a snapshot when it is deleted,
+	// instead of leaving a delete marker in versioned buckets.
+	PurgeVersions bool `mapstructure:"purge_versions"`
+}
+
+// S3Tags are object tags applied to snapshot uploads, by backup type, so S3
+// lifecycle rules can target a subset of the backups. Manifests are not
+// tagged. Tag keys are lowercased by the config loader.
+type S3Tags struct {
+	Full map[string]string `mapstructure:"full"`
+	Diff map[string]string `mapstructure:"diff"`
+	Incr map[string]string `mapstructure:"incr"`
+}
+
+// S3AssumeRole configures an IAM role that is assumed through STS with Key and
+// Secret. Requests use the role's temporary credentials, which are refreshed
+// before they expire. It is disabled if RoleARN is empty.
+type S3AssumeRole struct {
+	RoleARN    string `mapstructure:"role_arn"`
+	ExternalID string `mapstructure:"external_id"`
+	// SessionName identifies the session in CloudTrail.
+	SessionName string `mapstructure:"session_name"`
+	// Duration is the lifetime of each session, between 15m and 12h.
+	Duration time.Duration `mapstructure:"duration"`
+	// STSEndpoint defaults to the AWS STS endpoint of Region.
+	STSEndpoint string `mapstructure:"sts_endpoint"`
+}
+
+// S3SSE configures the server-side encryption of the objects zfsbackrest
+// writes: the store, the history, manifests and snapshots. Snapshots are
+// encrypted by zfsbackrest either way. If Type is empty, the bucket's default
+// encryption applies.
+type S3SSE struct {
+	// Type is "s3" for SSE-S3, or "kms" for SSE-KMS.
+	Type S3SSEType `mapstructure:"type"`
+	// KMSKeyID is the KMS key for SSE-KMS. If it is empty, the AWS managed
+	// key is used.
+	KMSKeyID string `mapstructure:"kms_key_id"`
+}
+
+type S3SSEType string
+
+const (
+	S3SSETypeS3  S3SSEType = "s3"
+	S3SSETypeKMS S3SSEType = "kms"
+)
+
+// S3ObjectLock locks snapshots with an S3 Object Lock retention when they are
+// uploaded, so they can't be deleted until it ends, even with the
+// repository's credentials. The bucket must have Object Lock enabled.
+// Manifests, the store and the history are not locked.
+type S3ObjectLock struct {
+	// Mode is "governance" or "compliance". Object Lock is disabled if it is
+	// empty.
+	Mode S3ObjectLockMode `mapstructure:"mode"`
+	// Retention is how long a snapshot is locked for after it is uploaded.
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+type S3ObjectLockMode string
+
+const (
+	S3ObjectLockGovernance S3ObjectLockMode = "governance"
+	S3ObjectLockCompliance S3ObjectLockMode = "compliance"
+)
+
+// S3StorageClasses are the storage classes snapshots are uploaded to, by
+// backup type, e.g. GLACIER_IR for fulls while incrementals stay in STANDARD.
+// An empty class uses the bucket's default. Manifests always use the default.
+type S3StorageClasses struct {
+	Full string `mapstructure:"full"`
+	Diff string `mapstructure:"diff"`
+	Incr string `mapstructure:"incr"`
+}
+
+// S3TLS configures TLS for endpoints with a private CA, or fronted by a
+// gateway that requires client certificates.
+type S3TLS struct {
+	// CAFile is a PEM bundle of CA certificates trusted on top of the
+	// system's.
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key for mTLS.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// S3Retrieval configures how snapshots in an archive storage class (Glacier,
+// Deep Archive) are made readable before a restore.
+type S3Retrieval struct {
+	// Tier is the retrieval tier: Expedited, Standard or Bulk.
+	Tier string `mapstructure:"tier"`
+	// Days is how long the retrieved copy is kept readable.
+	Days int `mapstructure:"days"`
+	// Timeout is how long to wait for a retrieval to finish.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// PollInterval is how often the retrieval status is checked.
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// SwiftStore configures an OpenStack Swift container, authenticated against
+// Keystone v3 either with a password or an application credential.
+type SwiftStore struct {
+	AuthURL   string `mapstructure:"auth_url"`
+	Region    string `mapstructure:"region"`
+	Container string `mapstructure:"container"`
+
+	// ColdContainer receives backups moved out of Container by tiering.
+	ColdContainer string `mapstructure:"cold_container"`
+
+	Username      string `mapstructure:"username"`
+	Password      string `mapstructure:"password"`
+	UserDomain    string `mapstructure:"user_domain"`
+	Project       string `mapstructure:"project"`
+	ProjectDomain string `mapstructure:"project_domain"`
+
+	ApplicationCredentialID     string `mapstructure:"application_credential_id"`
+	ApplicationCredentialSecret string `mapstructure:"application_credential_secret"`
+
+	// SegmentSize is the size of each segment of a static large object.
+	SegmentSize uint64 `mapstructure:"segment_size"`
+}
+
+// RcloneStore configures an rclone remote, reached by running the rclone
+// binary. Remote is an rclone path like "b2:zfsbackrest" or
+// "nas:backups/zfsbackrest", using a remote from rclone's own config file.
+type RcloneStore struct {
+	Remote string `mapstructure:"remote"`
+
+	// ColdRemote receives backups moved out of Remote by tiering.
+	ColdRemote string `mapstructure:"cold_remote"`
+
+	// Binary is the rclone binary to run. It is looked up in PATH if it
+	// isn't an absolute path.
+	Binary string `mapstructure:"binary"`
+	// ConfigFile is passed to rclone as --config, if set.
+	ConfigFile string `mapstructure:"config_file"`
+	// Flags are extra flags passed to every rclone command, e.g.
+	// ["--bwlimit", "50M"].
+	Flags []string `mapstructure:"flags"`
 }
@@ -0,0 +1,9 @@
+package config
+
+// StoreVersions keeps earlier versions of the store in the repository,
+// written on every save, so a destructive change to the store can be rolled
+// back. It is disabled when Keep is 0.
+type StoreVersions struct {
+	// Keep is how many of the latest versions are kept.
+	Keep int `mapstructure:"keep"`
+}
@@ -0,0 +1,57 @@
+package config
+
+import "time"
+
+const (
+	VaultAuthToken   = "token"
+	VaultAuthAppRole = "approle"
+)
+
+// Vault fetches the age identity from HashiCorp Vault or OpenBao at runtime,
+// for commands run with --vault, instead of reading it from a file. The
+// identity is either a field of a KV secret, or an identity file encrypted
+// with a transit key. Address, Namespace, CACertFile and the token fall back
+// to VAULT_ADDR, VAULT_NAMESPACE, VAULT_CACERT and VAULT_TOKEN.
+type Vault struct {
+	Address    string        `mapstructure:"address"`
+	Namespace  string        `mapstructure:"namespace"`
+	CACertFile string        `mapstructure:"ca_cert_file"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+	Auth       VaultAuth     `mapstructure:"auth"`
+	// Exactly one of KV and Transit is set.
+	KV      VaultKV      `mapstructure:"kv"`
+	Transit VaultTransit `mapstructure:"transit"`
+}
+
+type VaultAuth struct {
+	// Method is VaultAuthToken or VaultAuthAppRole.
+	Method    string       `mapstructure:"method"`
+	Token     string       `mapstructure:"token"`
+	TokenFile string       `mapstructure:"token_file"`
+	AppRole   VaultAppRole `mapstructure:"approle"`
+}
+
+type VaultAppRole struct {
+	Mount        string `mapstructure:"mount"`
+	RoleID       string `mapstructure:"role_id"`
+	SecretID     string `mapstructure:"secret_id"`
+	SecretIDFile string `mapstructure:"secret_id_file"`
+}
+
+// VaultKV reads the identity from Field of the secret at Path, in the KV
+// engine mounted at Mount.
+type VaultKV struct {
+	Mount string `mapstructure:"mount"`
+	Path  string `mapstructure:"path"`
+	Field string `mapstructure:"field"`
+	// Version is the version of the KV engine, 1 or 2.
+	Version int `mapstructure:"version"`
+}
+
+// VaultTransit decrypts the identity file in CiphertextFile, as written by
+// the encrypt endpoint of the transit engine mounted at Mount, with Key.
+type VaultTransit struct {
+	Mount          string `mapstructure:"mount"`
+	Key            string `mapstructure:"key"`
+	CiphertextFile string `mapstructure:"ciphertext_file"`
+}
@@ -1,4 +1,14 @@
 package config
 
 type ZFS struct {
+	// SendIntermediates sends diff and incremental backups as `zfs send -I`
+	// streams, which also carry the snapshots of the backups taken since the
+	// parent backup, unless snapshots zfsbackrest didn't take are among them.
+	// Restoring such a backup recreates them.
+	SendIntermediates bool `mapstructure:"send_intermediates"`
+	// RawSend sends full backups as `zfs send -w` streams, so encrypted
+	// datasets stay encrypted with their own ZFS key, and restoring them
+	// needs it. Diff and incr backups are sent like their parent, as
+	// `zfs recv` can't apply one kind of stream on top of the other.
+	RawSend bool `mapstructure:"raw_send"`
 }
@@ -1,86 +1,276 @@
 package encryption
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/plugin"
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+var (
+	ErrIdentityMismatch = errors.New("recipient public key does not match identity")
+	ErrIdentityNotSet   = errors.New("identity is not set. Please use NewAgeFromIdentity to create an Age instance with an identity")
 )
 
 type Age struct {
-	RecipientPublicKey *age.X25519Recipient
-	Identity           *age.X25519Identity
+	RecipientPublicKey age.Recipient
+	// RecoveryRecipient is the recovery recipient new data is encrypted to as
+	// well, if the repository has one.
+	RecoveryRecipient age.Recipient
+	// Identities can decrypt, and are tried in order: X25519 identities, the
+	// one matching RecipientPublicKey first, then plugin identities. The
+	// rest are older identities the repository was encrypted to.
+	Identities []age.Identity
 }
 
 func NewAge(ageConfig *config.Age) (*Age, error) {
-	recipient, err := age.ParseX25519Recipient(ageConfig.RecipientPublicKey)
+	return NewAgeWithOpts(ageConfig, AgeOpts{})
+}
+
+// NewAgeWithOpts is like NewAge, but allows configuring plugin recipients.
+func NewAgeWithOpts(ageConfig *config.Age, opts AgeOpts) (*Age, error) {
+	recipient, recovery, err := parseRecipients(ageConfig, opts)
 	if err != nil {
-		slog.Error("Failed to parse age recipient public key", "error", err)
 		return nil, err
 	}
 
-	slog.Debug("Recipient public key parsed successfully", "recipient", recipient.String())
-
 	return &Age{
 		RecipientPublicKey: recipient,
+		RecoveryRecipient:  recovery,
 	}, nil
 }
 
-func NewAgeFromIdentity(identityContent string, ageConfig *config.Age) (*Age, error) {
-	identity, err := age.ParseX25519Identity(strings.TrimSpace(identityContent))
+// parseRecipients parses the recipient of ageConfig, and its recovery
+// recipient, if it has one.
+func parseRecipients(ageConfig *config.Age, opts AgeOpts) (age.Recipient, age.Recipient, error) {
+	recipient, err := parseRecipient(ageConfig.RecipientPublicKey, opts)
 	if err != nil {
-		slog.Error("Failed to parse age identity", "error", err)
-		return nil, err
+		slog.Error("Failed to parse age recipient public key", "error", err)
+		return nil, nil, err
 	}
 
-	slog.Debug("Identity parsed successfully", "identity", identity.String())
+	slog.Debug("Recipient public key parsed successfully", "recipient", ageConfig.RecipientPublicKey)
+
+	if ageConfig.RecoveryRecipientPublicKey == "" {
+		return recipient, nil, nil
+	}
 
-	recipient, err := age.ParseX25519Recipient(ageConfig.RecipientPublicKey)
+	recovery, err := parseRecipient(ageConfig.RecoveryRecipientPublicKey, opts)
+	if err != nil {
+		slog.Error("Failed to parse age recovery recipient public key", "error", err)
+		return nil, nil, err
+	}
+
+	return recipient, recovery, nil
+}
+
+func NewAgeFromIdentity(identityContent string, ageConfig *config.Age) (*Age, error) {
+	return NewAgeFromIdentities([]string{identityContent}, ageConfig, AgeOpts{})
+}
+
+// NewAgeFromIdentities is like NewAgeFromIdentity, but accepts several
+// identities, so backups encrypted to recipients the repository used in the
+// past can still be decrypted. Decryption tries each identity in turn. One of
+// them must match the current recipient.
+//
+// Plugin identities (AGE-PLUGIN-...) are tried after the X25519 ones, so the
+// hardware token is only asked when needed. Whether they match the recipient
+// can only be checked by the plugin, so a plugin identity is assumed to
+// match a recipient of the same plugin. A KMS key is its own identity. SSH
+// private keys match the recipient of their public key.
+//
+// The identity of the recovery recipient matches too, so a repository whose
+// identity was lost can be restored with the recovery identity alone.
+func NewAgeFromIdentities(identityContents []string, ageConfig *config.Age, opts AgeOpts) (*Age, error) {
+	recipient, recovery, err := parseRecipients(ageConfig, opts)
 	if err != nil {
-		slog.Error("Failed to parse age recipient public key", "error", err)
 		return nil, err
 	}
 
-	slog.Debug("Recipient public key parsed successfully", "recipient", recipient.String())
+	matches := func(r string) bool {
+		r = NormalizeRecipient(r)
+		return r == NormalizeRecipient(ageConfig.RecipientPublicKey) ||
+			(ageConfig.RecoveryRecipientPublicKey != "" && r == NormalizeRecipient(ageConfig.RecoveryRecipientPublicKey))
+	}
+	matchesPlugin := func(name string) bool {
+		for _, r := range []age.Recipient{recipient, recovery} {
+			if p, ok := r.(*plugin.Recipient); ok && p.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var current age.Identity
+	var others, plugins []age.Identity
+	for i, content := range identityContents {
+		content = strings.TrimSpace(content)
+
+		if isPluginIdentity(content) {
+			identity, err := plugin.NewIdentity(content, opts.pluginUI())
+			if err != nil {
+				slog.Error("Failed to parse age plugin identity", "index", i, "error", err)
+				return nil, &errclass.EncryptionError{Op: "parse identity", Err: err}
+			}
+
+			slog.Debug("Using age plugin identity", "plugin", identity.Name(), "timeout", opts.PluginTimeout)
+			wrapped := timeoutIdentity{identity: identity, timeout: opts.PluginTimeout}
+			if current == nil && matchesPlugin(identity.Name()) {
+				current = wrapped
+				continue
+			}
+
+			plugins = append(plugins, wrapped)
+			continue
+		}
+
+		if IsKMSKey(content) {
+			identity, err := newKMSKey(content)
+			if err != nil {
+				slog.Error("Failed to parse KMS identity", "index", i, "error", err)
+				return nil, err
+			}
+
+			if current == nil && matches(content) {
+				current = identity
+				continue
+			}
+
+			others = append(others, identity)
+			continue
+		}
+
+		if isSSHIdentity(content) {
+			identity, sshRecipient, err := parseSSHIdentity(content)
+			if err != nil {
+				slog.Error("Failed to parse SSH identity", "index", i, "error", err)
+				return nil, err
+			}
+
+			if current == nil && matches(sshRecipient) {
+				current = identity
+				continue
+			}
 
-	if recipient.String() != identity.Recipient().String() {
-		slog.Error("Recipient public key does not match identity", "recipient", recipient.String(), "identity", identity.Recipient().String())
-		return nil, fmt.Errorf("recipient public key does not match identity")
+			slog.Debug("Identity doesn't match the current recipient, keeping it for older backups", "identity", sshRecipient)
+			others = append(others, identity)
+			continue
+		}
+
+		identity, err := age.ParseX25519Identity(content)
+		if err != nil {
+			slog.Error("Failed to parse age identity", "index", i, "error", err)
+			return nil, &errclass.EncryptionError{Op: "parse identity", Err: err}
+		}
+
+		if current == nil && matches(identity.Recipient().String()) {
+			current = identity
+			continue
+		}
+
+		slog.Debug("Identity doesn't match the current recipient, keeping it for older backups", "identity", identity.Recipient().String())
+		others = append(others, identity)
+	}
+
+	if current == nil {
+		slog.Error("Recipient public key does not match any identity", "recipient", ageConfig.RecipientPublicKey, "identities", len(identityContents))
+		return nil, &errclass.EncryptionError{Op: "match identity", Err: ErrIdentityMismatch}
 	}
 
-	slog.Debug("Identity validated", "identity", identity.String())
+	slog.Debug("Identities validated", "recipient", ageConfig.RecipientPublicKey, "older", len(others), "plugins", len(plugins))
+
+	identities := []age.Identity{current}
+	if _, ok := current.(timeoutIdentity); ok {
+		// Keep the token for last even if it holds the current identity.
+		identities = append(others, current)
+	} else {
+		identities = append(identities, others...)
+	}
 
 	return &Age{
 		RecipientPublicKey: recipient,
-		Identity:           identity,
+		RecoveryRecipient:  recovery,
+		Identities:         append(identities, plugins...),
 	}, nil
 }
 
+// RecipientFromIdentity returns the recipient public key of an age identity.
+// A KMS key is its own recipient, and an SSH private key's is its public key,
+// without a comment.
+func RecipientFromIdentity(identityContent string) (string, error) {
+	if IsKMSKey(identityContent) {
+		return strings.TrimSpace(identityContent), nil
+	}
+
+	if isSSHIdentity(strings.TrimSpace(identityContent)) {
+		_, recipient, err := parseSSHIdentity(strings.TrimSpace(identityContent))
+		return recipient, err
+	}
+
+	if isPluginIdentity(strings.TrimSpace(identityContent)) {
+		return "", &errclass.EncryptionError{Op: "parse identity", Err: errors.New("the recipient of a plugin identity can't be derived. Use an X25519 identity")}
+	}
+
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(identityContent))
+	if err != nil {
+		slog.Error("Failed to parse age identity", "error", err)
+		return "", &errclass.EncryptionError{Op: "parse identity", Err: err}
+	}
+
+	return identity.Recipient().String(), nil
+}
+
 func (a *Age) EncryptedWriter(dst io.Writer) (io.WriteCloser, error) {
-	return age.Encrypt(dst, a.RecipientPublicKey)
+	if a.RecoveryRecipient != nil {
+		return ageEncrypt(dst, a.RecipientPublicKey, a.RecoveryRecipient)
+	}
+
+	return ageEncrypt(dst, a.RecipientPublicKey)
 }
 
+// ValidateRecipientPublicKey checks that recipientPublicKey is an X25519,
+// SSH or age plugin recipient, or a KMS key.
 func ValidateRecipientPublicKey(recipientPublicKey string) error {
-	_, err := age.ParseX25519Recipient(recipientPublicKey)
-	if err != nil {
-		slog.Error("Failed to parse age recipient public key", "error", err)
+	if _, err := age.ParseX25519Recipient(recipientPublicKey); err == nil {
+		return nil
+	}
+
+	if IsKMSKey(recipientPublicKey) {
+		_, err := newKMSClient(recipientPublicKey)
+		return err
+	}
+
+	if isSSHRecipient(strings.TrimSpace(recipientPublicKey)) {
+		_, err := parseSSHRecipient(recipientPublicKey)
 		return err
 	}
 
+	if _, _, err := plugin.ParseRecipient(recipientPublicKey); err != nil {
+		slog.Error("Failed to parse age recipient public key", "error", err)
+		return &errclass.EncryptionError{Op: "parse recipient", Err: err}
+	}
+
 	return nil
 }
 
 func (a *Age) DecryptedReader(src io.ReadCloser) (io.ReadCloser, error) {
-	if a.Identity == nil {
+	if len(a.Identities) == 0 {
 		slog.Error("Identity is not set. Please use NewAgeFromIdentity to create an Age instance with an identity.")
-		return nil, fmt.Errorf("identity is not set. Please use NewAgeFromIdentity to create an Age instance with an identity.")
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: ErrIdentityNotSet}
 	}
 
-	reader, err := age.Decrypt(src, a.Identity)
+	reader, err := age.Decrypt(src, a.Identities...)
 	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, &errclass.EncryptionError{Op: "decrypt", Err: fmt.Errorf("none of the %d identities can decrypt the data: %w", len(a.Identities), err)}
+		}
 		return nil, err
 	}
 
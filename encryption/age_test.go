@@ -0,0 +1,178 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/gargakshit/zfsbackrest/config"
+)
+
+func TestNewAgeFromIdentitiesDecryptsOlderBackups(t *testing.T) {
+	generate := func() *age.X25519Identity {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return identity
+	}
+
+	old, current, unrelated := generate(), generate(), generate()
+	cfg := &config.Age{RecipientPublicKey: current.Recipient().String()}
+
+	encrypt := func(recipient age.Recipient) []byte {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(w, "snapshot")
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	a, err := NewAgeFromIdentities([]string{old.String(), current.String()}, cfg, AgeOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, ok := a.Identities[0].(*age.X25519Identity); !ok || first.String() != current.String() {
+		t.Fatal("expected the current identity first")
+	}
+
+	for _, recipient := range []*age.X25519Recipient{old.Recipient(), current.Recipient()} {
+		r, err := a.DecryptedReader(io.NopCloser(bytes.NewReader(encrypt(recipient))))
+		if err != nil {
+			t.Fatalf("failed to decrypt for %s: %v", recipient, err)
+		}
+		got, _ := io.ReadAll(r)
+		if string(got) != "snapshot" {
+			t.Fatalf("got %q", got)
+		}
+	}
+
+	if _, err := a.DecryptedReader(io.NopCloser(bytes.NewReader(encrypt(unrelated.Recipient())))); err == nil {
+		t.Fatal("expected decryption with an unrelated recipient to fail")
+	}
+
+	if _, err := NewAgeFromIdentities([]string{old.String(), unrelated.String()}, cfg, AgeOpts{}); !errors.Is(err, ErrIdentityMismatch) {
+		t.Fatalf("expected ErrIdentityMismatch, got %v", err)
+	}
+}
+
+func TestRecoveryRecipient(t *testing.T) {
+	current, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Age{RecipientPublicKey: current.Recipient().String(), RecoveryRecipientPublicKey: recovery.Recipient().String()}
+
+	enc, err := NewAge(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := enc.EncryptedWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(w, "snapshot")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identity := range []*age.X25519Identity{current, recovery} {
+		// The recovery identity alone is enough, as when the other one
+		// was lost.
+		dec, err := NewAgeFromIdentities([]string{identity.String()}, cfg, AgeOpts{})
+		if err != nil {
+			t.Fatalf("identity of %s: %v", identity.Recipient(), err)
+		}
+		r, err := dec.DecryptedReader(io.NopCloser(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("failed to decrypt with %s: %v", identity.Recipient(), err)
+		}
+		if got, _ := io.ReadAll(r); string(got) != "snapshot" {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
+
+func TestPluginIdentityTimeout(t *testing.T) {
+	// A plugin that never answers, like a token waiting for a touch.
+	dir := t.TempDir()
+	script := "#!/bin/sh\nsleep 10\n"
+	if err := os.WriteFile(filepath.Join(dir, "age-plugin-zbrtest"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := &config.Age{RecipientPublicKey: plugin.EncodeRecipient("zbrtest", []byte{1})}
+	a, err := NewAgeFromIdentities([]string{plugin.EncodeIdentity("zbrtest", []byte{1})}, cfg, AgeOpts{PluginTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, current.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	start := time.Now()
+	_, err = a.DecryptedReader(io.NopCloser(&buf))
+	if !errors.Is(err, ErrPluginTimeout) {
+		t.Fatalf("expected ErrPluginTimeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("decryption waited for the plugin")
+	}
+}
+
+func TestCheckPlugin(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "age-plugin-zbrtest"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		identity.Recipient().String(),
+		identity.String(),
+		plugin.EncodeRecipient("zbrtest", []byte{1}),
+		plugin.EncodeIdentity("zbrtest", []byte{1}),
+	} {
+		if err := CheckPlugin(s); err != nil {
+			t.Fatalf("expected %s to pass, got %v", s, err)
+		}
+	}
+
+	for _, s := range []string{
+		plugin.EncodeRecipient("zbrmissing", []byte{1}),
+		plugin.EncodeIdentity("zbrmissing", []byte{1}),
+	} {
+		if err := CheckPlugin(s); !errors.Is(err, ErrPluginNotInstalled) {
+			t.Fatalf("expected ErrPluginNotInstalled for %s, got %v", s, err)
+		}
+	}
+}
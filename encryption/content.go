@@ -0,0 +1,113 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// IsEncrypted reports whether content is encrypted with age, armored or not.
+func IsEncrypted(content []byte) bool {
+	return isAgeEncrypted(content)
+}
+
+// EncryptContent encrypts content to every recipient, so any of their
+// identities can decrypt it.
+func EncryptContent(content []byte, recipients []string, opts AgeOpts) ([]byte, error) {
+	var parsed []age.Recipient
+	for _, recipient := range recipients {
+		r, err := parseRecipient(recipient, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, r)
+	}
+
+	var buf bytes.Buffer
+	w, err := ageEncrypt(&buf, parsed...)
+	if err != nil {
+		return nil, encryptionError("encrypt", err)
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+	if err := w.Close(); err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecryptContent decrypts content encrypted by EncryptContent with the first
+// of identities that can. Unlike NewAgeFromIdentities, none of them has to
+// match a recipient. Plugin identities are tried last.
+func DecryptContent(content []byte, identities []string, opts AgeOpts) ([]byte, error) {
+	var parsed, plugins []age.Identity
+	for _, content := range identities {
+		content = strings.TrimSpace(content)
+
+		if isPluginIdentity(content) {
+			identity, err := plugin.NewIdentity(content, opts.pluginUI())
+			if err != nil {
+				return nil, &errclass.EncryptionError{Op: "parse identity", Err: err}
+			}
+
+			plugins = append(plugins, timeoutIdentity{identity: identity, timeout: opts.PluginTimeout})
+			continue
+		}
+
+		if IsKMSKey(content) {
+			identity, err := newKMSKey(content)
+			if err != nil {
+				return nil, err
+			}
+
+			parsed = append(parsed, identity)
+			continue
+		}
+
+		if isSSHIdentity(content) {
+			identity, _, err := parseSSHIdentity(content)
+			if err != nil {
+				return nil, err
+			}
+
+			parsed = append(parsed, identity)
+			continue
+		}
+
+		identity, err := age.ParseX25519Identity(content)
+		if err != nil {
+			return nil, &errclass.EncryptionError{Op: "parse identity", Err: err}
+		}
+
+		parsed = append(parsed, identity)
+	}
+
+	if len(parsed)+len(plugins) == 0 {
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: ErrNoIdentity}
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(content), append(parsed, plugins...)...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, &errclass.EncryptionError{Op: "decrypt", Err: ErrIdentityMismatch}
+		}
+		return nil, encryptionError("decrypt", err)
+	}
+
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return decrypted, nil
+}
@@ -1,16 +1,40 @@
 package encryption
 
 import (
+	"errors"
 	"io"
 
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
 )
 
+var ErrEncryptionDisabled = errors.New("the repository was initialized without encryption")
+
 type Encryption interface {
 	EncryptedWriter(dst io.Writer) (io.WriteCloser, error)
 	DecryptedReader(src io.ReadCloser) (io.ReadCloser, error)
 }
 
+// NewEncryption returns the encryption of new backups. Repositories
+// initialized without encryption store them as is.
 func NewEncryption(encryptionConfig *config.Encryption) (Encryption, error) {
+	if encryptionConfig.Disabled() {
+		return Passthrough{}, nil
+	}
+
 	return NewAge(&encryptionConfig.Age)
 }
+
+// NewDecryption is like NewEncryption, but can also decrypt backups, with
+// identities. Repositories initialized without encryption need none.
+func NewDecryption(identities []string, encryptionConfig *config.Encryption, opts AgeOpts) (Encryption, error) {
+	if encryptionConfig.Disabled() {
+		return Passthrough{}, nil
+	}
+
+	if len(identities) == 0 {
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: ErrNoIdentity}
+	}
+
+	return NewAgeFromIdentities(identities, &encryptionConfig.Age, opts)
+}
@@ -0,0 +1,143 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+var (
+	ErrNoIdentity     = errors.New("no age identity found")
+	ErrWeakPassphrase = fmt.Errorf("passphrase must be at least %d characters long", minPassphraseLength)
+)
+
+// minPassphraseLength is the shortest passphrase EncryptIdentity accepts. The
+// result may be stored next to the backups, so it has to withstand offline
+// guessing.
+const minPassphraseLength = 16
+
+// PassphraseFunc returns the passphrase of an encrypted identity file.
+type PassphraseFunc func() (string, error)
+
+// ReadIdentity returns the X25519 identity from the content of an identity
+// file, as written by age-keygen. Comments and blank lines are skipped.
+// Identity files encrypted with a passphrase (age -p, armored or not) are
+// decrypted first; passphrase is only called for those.
+func ReadIdentity(content []byte, passphrase PassphraseFunc) (string, error) {
+	identities, err := ReadIdentities(content, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	return identities[0], nil
+}
+
+// ReadIdentities is like ReadIdentity, but returns every identity in the
+// file, one per line. An SSH private key file is a single identity; if it is
+// protected by a passphrase, passphrase is called to decrypt it.
+func ReadIdentities(content []byte, passphrase PassphraseFunc) ([]string, error) {
+	if isSSHIdentity(string(bytes.TrimSpace(content))) {
+		identity, err := readSSHIdentity(content, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{identity}, nil
+	}
+
+	if isAgeEncrypted(content) {
+		if passphrase == nil {
+			return nil, &errclass.EncryptionError{Op: "decrypt identity", Err: errors.New("identity file is encrypted, but no passphrase is available")}
+		}
+
+		pass, err := passphrase()
+		if err != nil {
+			return nil, &errclass.EncryptionError{Op: "read passphrase", Err: err}
+		}
+
+		content, err = decryptIdentityFile(content, pass)
+		if err != nil {
+			return nil, &errclass.EncryptionError{Op: "decrypt identity", Err: err}
+		}
+	}
+
+	var identities []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		identities = append(identities, line)
+	}
+
+	if len(identities) == 0 {
+		return nil, &errclass.EncryptionError{Op: "parse identity", Err: ErrNoIdentity}
+	}
+
+	return identities, nil
+}
+
+func isAgeEncrypted(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+	return bytes.HasPrefix(trimmed, []byte("age-encryption.org/")) || bytes.HasPrefix(trimmed, []byte(armor.Header))
+}
+
+func decryptIdentityFile(content []byte, passphrase string) ([]byte, error) {
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var src io.Reader = bytes.NewReader(content)
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(content)))
+	}
+
+	r, err := age.Decrypt(src, identity)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase, or not a passphrase-encrypted file: %w", err)
+	}
+
+	return io.ReadAll(r)
+}
+
+// EncryptIdentity encrypts an identity with a passphrase, like age -p -a. The
+// result can be read back with ReadIdentity.
+func EncryptIdentity(identity string, passphrase string) ([]byte, error) {
+	if len([]rune(passphrase)) < minPassphraseLength {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: ErrWeakPassphrase}
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: err}
+	}
+
+	var buf bytes.Buffer
+	armored := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: err}
+	}
+
+	if _, err := io.WriteString(w, strings.TrimSpace(identity)+"\n"); err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: err}
+	}
+	if err := w.Close(); err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: err}
+	}
+	if err := armored.Close(); err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt identity", Err: err}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func TestReadIdentity(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keygen := "# created: 2024-01-01T00:00:00Z\n# public key: " + identity.Recipient().String() + "\n" + identity.String() + "\n"
+
+	encrypt := func(armored bool) []byte {
+		recipient, err := age.NewScryptRecipient("hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipient.SetWorkFactor(10)
+
+		var buf bytes.Buffer
+		var dst io.WriteCloser = nopCloser{&buf}
+		if armored {
+			dst = armor.NewWriter(&buf)
+		}
+
+		w, err := age.Encrypt(dst, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(w, keygen)
+		_ = w.Close()
+		_ = dst.Close()
+
+		return buf.Bytes()
+	}
+
+	passphrase := func(p string) PassphraseFunc {
+		return func() (string, error) { return p, nil }
+	}
+
+	tests := []struct {
+		name       string
+		content    []byte
+		passphrase PassphraseFunc
+		wantErr    bool
+	}{
+		{name: "plaintext", content: []byte(keygen)},
+		{name: "encrypted", content: encrypt(false), passphrase: passphrase("hunter2")},
+		{name: "armored", content: encrypt(true), passphrase: passphrase("hunter2")},
+		{name: "wrong passphrase", content: encrypt(false), passphrase: passphrase("wrong"), wantErr: true},
+		{name: "no passphrase", content: encrypt(false), wantErr: true},
+		{name: "empty", content: []byte("# nothing here\n"), wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadIdentity(tc.content, tc.passphrase)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != identity.String() {
+				t.Fatalf("expected the identity, got %q", got)
+			}
+		})
+	}
+}
+
+func TestReadIdentityDoesNotPromptForPlaintext(t *testing.T) {
+	prompted := errors.New("prompted")
+	_, err := ReadIdentity([]byte("AGE-SECRET-KEY-1X\n"), func() (string, error) { return "", prompted })
+	if errors.Is(err, prompted) {
+		t.Fatal("passphrase was requested for a plaintext identity")
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// A KMS key can take the place of an age recipient, for setups where the key
+// has to be managed by a KMS. The snapshots are still age files: each gets a
+// random file key, as usual, which is wrapped by the KMS and stored in the
+// file's header. Decrypting asks the KMS to unwrap it, so access to the
+// backups is governed by the key's policy, and the key never leaves the KMS.
+//
+// The key is used as both the recipient and the identity, as in
+// aws-kms:arn:aws:kms:eu-west-1:111122223333:key/<key id>.
+
+const (
+	kmsStanzaType = "zfsbackrest-kms"
+	// kmsTimeout bounds a single call to the KMS.
+	kmsTimeout = 30 * time.Second
+)
+
+var (
+	ErrInvalidKMSKey = errors.New("invalid KMS key")
+	// ErrKMSUnavailable marks a KMS call that failed for reasons other than
+	// the key or the data, like throttling, a server error or the network.
+	ErrKMSUnavailable = errors.New("KMS unavailable")
+)
+
+// kmsClient wraps and unwraps file keys with a key held by a KMS.
+type kmsClient interface {
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// kmsProviders maps the prefix of a KMS key to the client of its KMS.
+var kmsProviders = map[string]func(keyID string) (kmsClient, error){
+	"aws-kms": newAWSKMS,
+}
+
+// IsKMSKey reports whether s names a KMS key rather than an age recipient or
+// identity. It doesn't check the key is valid.
+func IsKMSKey(s string) bool {
+	provider, _, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return false
+	}
+
+	_, ok = kmsProviders[provider]
+	return ok
+}
+
+func newKMSClient(s string) (kmsClient, error) {
+	provider, keyID, _ := strings.Cut(strings.TrimSpace(s), ":")
+	newClient, ok := kmsProviders[provider]
+	if !ok || keyID == "" {
+		return nil, &errclass.EncryptionError{Op: "parse kms key", Err: fmt.Errorf("%w: %q", ErrInvalidKMSKey, s)}
+	}
+
+	client, err := newClient(keyID)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "parse kms key", Err: err}
+	}
+
+	return client, nil
+}
+
+// kmsKey is the recipient and the identity of a KMS key. Stanzas record the
+// key they were wrapped with, so an identity only unwraps its own.
+type kmsKey struct {
+	key    string
+	client kmsClient
+}
+
+var (
+	_ age.Recipient = (*kmsKey)(nil)
+	_ age.Identity  = (*kmsKey)(nil)
+)
+
+func newKMSKey(s string) (*kmsKey, error) {
+	client, err := newKMSClient(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kmsKey{key: strings.TrimSpace(s), client: client}, nil
+}
+
+func (k *kmsKey) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+
+	wrapped, err := k.client.Encrypt(ctx, fileKey)
+	if err != nil {
+		slog.Error("Failed to wrap file key with KMS", "key", k.key, "error", err)
+		return nil, encryptionError("kms encrypt", err)
+	}
+
+	return []*age.Stanza{{Type: kmsStanzaType, Args: []string{k.key}, Body: wrapped}}, nil
+}
+
+func (k *kmsKey) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != kmsStanzaType || len(stanza.Args) != 1 || stanza.Args[0] != k.key {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+		fileKey, err := k.client.Decrypt(ctx, stanza.Body)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to unwrap file key with KMS", "key", k.key, "error", err)
+			return nil, encryptionError("kms decrypt", err)
+		}
+
+		return fileKey, nil
+	}
+
+	return nil, age.ErrIncorrectIdentity
+}
+
+// kmsRecipient is a KMS key as the recipient of one file. It keeps the error
+// of Wrap, which age.Encrypt only reports as a string.
+type kmsRecipient struct {
+	*kmsKey
+	err error
+}
+
+func (r *kmsRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	stanzas, err := r.kmsKey.Wrap(fileKey)
+	r.err = err
+	return stanzas, err
+}
+
+// ageEncrypt is age.Encrypt, but returns the error of a KMS recipient as is,
+// so an unavailable KMS can be told apart and retried.
+func ageEncrypt(dst io.Writer, recipients ...age.Recipient) (io.WriteCloser, error) {
+	var kmsRecipients []*kmsRecipient
+	wrapped := make([]age.Recipient, len(recipients))
+	for i, r := range recipients {
+		if k, ok := r.(*kmsKey); ok {
+			kr := &kmsRecipient{kmsKey: k}
+			kmsRecipients = append(kmsRecipients, kr)
+			r = kr
+		}
+		wrapped[i] = r
+	}
+
+	w, err := age.Encrypt(dst, wrapped...)
+	if err != nil {
+		for _, r := range kmsRecipients {
+			if r.err != nil {
+				return nil, r.err
+			}
+		}
+	}
+
+	return w, err
+}
+
+// encryptionError classifies an error of op, e.g. of a KMS call. An
+// unavailable KMS is left unclassified, so the operation is retried, while
+// the rest, like a key the policy denies or a blob of another key, are
+// encryption errors.
+func encryptionError(op string, err error) error {
+	if errors.Is(err, ErrKMSUnavailable) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &errclass.EncryptionError{Op: op, Err: err}
+}
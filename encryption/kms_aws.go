@@ -0,0 +1,250 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// awsKMSEndpointEnv overrides the KMS endpoint, as in the AWS SDKs, for VPC
+// endpoints and KMS-compatible services.
+const awsKMSEndpointEnv = "AWS_ENDPOINT_URL_KMS"
+
+// awsKMSUnavailableErrors are the KMS error types that don't depend on the
+// key or the request, so the call can be retried.
+var awsKMSUnavailableErrors = []string{
+	"ThrottlingException",
+	"LimitExceededException",
+	"KMSInternalException",
+	"DependencyTimeoutException",
+}
+
+var ErrNoAWSCredentials = errors.New("no AWS credentials found. Set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, use ~/.aws/credentials, or run with an instance role")
+
+// awsKMS calls the AWS KMS JSON API. Credentials are taken from the
+// environment, the shared credentials file, or the instance or task role, in
+// that order, like the AWS CLI does.
+type awsKMS struct {
+	keyARN   string
+	region   string
+	endpoint string
+	creds    *credentials.Credentials
+	client   *http.Client
+}
+
+// newAWSKMS returns the client of a KMS key ARN. The region is taken from the
+// ARN, so aliases have to be given as alias ARNs too.
+func newAWSKMS(keyARN string) (kmsClient, error) {
+	// arn:<partition>:kms:<region>:<account>:key/<id> or alias/<name>
+	parts := strings.SplitN(keyARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "kms" || parts[3] == "" ||
+		!(strings.HasPrefix(parts[5], "key/") || strings.HasPrefix(parts[5], "alias/")) {
+		return nil, fmt.Errorf("%w: expected a key or alias ARN, like arn:aws:kms:<region>:<account>:key/<id>, got %q", ErrInvalidKMSKey, keyARN)
+	}
+
+	region := parts[3]
+	endpoint := os.Getenv(awsKMSEndpointEnv)
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+		if parts[1] == "aws-cn" {
+			endpoint += ".cn"
+		}
+	}
+
+	return &awsKMS{
+		keyARN:   keyARN,
+		region:   region,
+		endpoint: endpoint,
+		creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Timeout: 10 * time.Second}},
+		}),
+		client: &http.Client{},
+	}, nil
+}
+
+func (k *awsKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+
+	err := k.call(ctx, "Encrypt", struct {
+		KeyId     string
+		Plaintext []byte
+	}{k.keyARN, plaintext}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.CiphertextBlob, nil
+}
+
+func (k *awsKMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+
+	// Passing the key makes KMS refuse a blob wrapped by another key.
+	err := k.call(ctx, "Decrypt", struct {
+		KeyId          string
+		CiphertextBlob []byte
+	}{k.keyARN, ciphertext}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Plaintext, nil
+}
+
+// call calls a TrentService action. Binary fields are base64 encoded, which
+// is how encoding/json encodes []byte.
+func (k *awsKMS) call(ctx context.Context, action string, in any, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	creds, err := k.creds.GetWithContext(&credentials.CredContext{Client: k.client})
+	if err != nil {
+		return fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	if creds.SignerType == credentials.SignatureAnonymous {
+		return ErrNoAWSCredentials
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	signAWSRequest(req, body, creds.AccessKeyID, creds.SecretAccessKey, k.region, "kms", time.Now())
+
+	slog.Debug("Calling AWS KMS", "action", action, "key", k.keyARN, "endpoint", k.endpoint)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrKMSUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrKMSUnavailable, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(respBody, &kmsErr)
+
+		// The type may be prefixed with a namespace, as in
+		// com.amazonaws.kms#NotFoundException.
+		_, errType, _ := strings.Cut(kmsErr.Type, "#")
+		if errType == "" {
+			errType = kmsErr.Type
+		}
+
+		err := fmt.Errorf("KMS %s failed with %s: %s", action, errType, kmsErr.Message)
+		if errType == "" {
+			err = fmt.Errorf("KMS %s failed with status %s: %s", action, resp.Status, strings.TrimSpace(string(respBody)))
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || slices.Contains(awsKMSUnavailableErrors, errType) {
+			return fmt.Errorf("%w: %w", ErrKMSUnavailable, err)
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode KMS %s response: %w", action, err)
+	}
+
+	return nil
+}
+
+// signAWSRequest signs req with AWS Signature Version 4. Every header set on
+// req is signed, along with the host.
+func signAWSRequest(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
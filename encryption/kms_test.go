@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// fakeKMS "wraps" a key by prefixing it with the key ARN, and refuses to
+// unwrap a blob of another key, like KMS does.
+func fakeKMS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			t.Errorf("request isn't signed: %q", r.Header.Get("Authorization"))
+		}
+
+		var req struct {
+			KeyId          string
+			Plaintext      []byte
+			CiphertextBlob []byte
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			_ = json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": append([]byte(req.KeyId+"|"), req.Plaintext...)})
+		case "TrentService.Decrypt":
+			key, plaintext, _ := bytes.Cut(req.CiphertextBlob, []byte("|"))
+			if string(key) != req.KeyId {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"__type":"IncorrectKeyException","message":"wrong key"}`)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": plaintext})
+		default:
+			t.Errorf("unexpected target %q", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+}
+
+func TestKMSEnvelopeEncryption(t *testing.T) {
+	server := fakeKMS(t)
+	defer server.Close()
+
+	t.Setenv(awsKMSEndpointEnv, server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	key := "aws-kms:arn:aws:kms:eu-west-1:111122223333:key/current"
+	other := "aws-kms:arn:aws:kms:eu-west-1:111122223333:key/other"
+	cfg := &config.Age{RecipientPublicKey: key}
+
+	if err := ValidateRecipientPublicKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateRecipientPublicKey("aws-kms:not-an-arn"); err == nil {
+		t.Fatal("expected an invalid key ARN to be rejected")
+	}
+	if recipient, err := RecipientFromIdentity(key); err != nil || recipient != key {
+		t.Fatalf("got %q, %v", recipient, err)
+	}
+
+	enc, err := NewAge(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := enc.EncryptedWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(w, "snapshot")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewAgeFromIdentities([]string{other, key}, cfg, AgeOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dec.DecryptedReader(io.NopCloser(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "snapshot" {
+		t.Fatalf("got %q", got)
+	}
+
+	if _, err := NewAgeFromIdentities([]string{other}, cfg, AgeOpts{}); err == nil {
+		t.Fatal("expected another KMS key not to match the recipient")
+	}
+
+	sealed, err := EncryptContent([]byte("store"), []string{key}, AgeOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptContent(sealed, []string{key}, AgeOpts{}); err != nil || string(got) != "store" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestKMSUnavailable(t *testing.T) {
+	var status int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	t.Setenv(awsKMSEndpointEnv, server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	key := "aws-kms:arn:aws:kms:eu-west-1:111122223333:key/current"
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		unavailable bool
+	}{
+		{"throttled", http.StatusBadRequest, `{"__type":"ThrottlingException","message":"Rate exceeded"}`, true},
+		{"server error", http.StatusServiceUnavailable, "unavailable", true},
+		{"internal error", http.StatusInternalServerError, `{"__type":"com.amazonaws.kms#KMSInternalException"}`, true},
+		{"access denied", http.StatusBadRequest, `{"__type":"AccessDeniedException","message":"denied"}`, false},
+		{"invalid ciphertext", http.StatusBadRequest, `{"__type":"InvalidCiphertextException"}`, false},
+	}
+
+	for _, tt := range tests {
+		status, body = tt.status, tt.body
+
+		_, err := EncryptContent([]byte("store"), []string{key}, AgeOpts{})
+		if err == nil {
+			t.Fatalf("%s: expected the KMS call to fail", tt.name)
+		}
+		if errors.Is(err, ErrKMSUnavailable) != tt.unavailable || errors.Is(err, errclass.ErrEncryption) == tt.unavailable {
+			t.Errorf("%s: expected unavailable %v, got %v", tt.name, tt.unavailable, err)
+		}
+	}
+
+	// A KMS that can't be reached is unavailable too.
+	server.Close()
+	_, err := EncryptContent([]byte("store"), []string{key}, AgeOpts{})
+	if !errors.Is(err, ErrKMSUnavailable) || errors.Is(err, errclass.ErrEncryption) {
+		t.Errorf("expected an unreachable KMS to be unavailable, got %v", err)
+	}
+}
+
+// TestSignAWSRequest checks the signer against the example of the AWS
+// Signature Version 4 documentation.
+func TestSignAWSRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "iam", now)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,22 @@
+package encryption
+
+import "io"
+
+// Passthrough neither encrypts nor decrypts. It is used to move objects that
+// are already encrypted between stores without access to the identity, and
+// is the encryption of repositories initialized without encryption.
+type Passthrough struct{}
+
+func (Passthrough) EncryptedWriter(dst io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{dst}, nil
+}
+
+func (Passthrough) DecryptedReader(src io.ReadCloser) (io.ReadCloser, error) {
+	return src, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,151 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// age plugins (age-plugin-yubikey and friends) keep the identity on a
+// hardware token, and may ask for a PIN or a touch while unwrapping a file
+// key. They run as a separate age-plugin-<name> binary, which has to be in
+// $PATH.
+
+var (
+	ErrPluginTimeout      = errors.New("timed out waiting for the age plugin. Did you confirm on the hardware token?")
+	ErrPluginNotInstalled = errors.New("the age plugin is not installed")
+)
+
+// AgeOpts controls how plugin identities and recipients interact with the
+// user.
+type AgeOpts struct {
+	// PluginUI handles plugin prompts. If nil, prompts fail instead of
+	// blocking, and messages are logged.
+	PluginUI *plugin.ClientUI
+	// PluginTimeout bounds how long a plugin may take to unwrap a file key,
+	// including waiting for the user. Zero means no limit.
+	PluginTimeout time.Duration
+}
+
+func (o AgeOpts) pluginUI() *plugin.ClientUI {
+	if o.PluginUI != nil {
+		return o.PluginUI
+	}
+
+	return NonInteractivePluginUI()
+}
+
+// NonInteractivePluginUI logs plugin messages and fails every request for
+// input, so unattended runs never block on a prompt.
+func NonInteractivePluginUI() *plugin.ClientUI {
+	return &plugin.ClientUI{
+		DisplayMessage: func(name, message string) error {
+			slog.Info("Message from age plugin", "plugin", name, "message", message)
+			return nil
+		},
+		RequestValue: func(name, prompt string, secret bool) (string, error) {
+			slog.Error("age plugin requested input, but prompts are not available", "plugin", name, "prompt", prompt)
+			return "", fmt.Errorf("plugin %s requested input, but prompts are not available", name)
+		},
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			slog.Error("age plugin requested confirmation, but prompts are not available", "plugin", name, "prompt", prompt)
+			return false, fmt.Errorf("plugin %s requested confirmation, but prompts are not available", name)
+		},
+		WaitTimer: func(name string) {
+			slog.Warn("Waiting for age plugin. You may need to touch your hardware token.", "plugin", name)
+		},
+	}
+}
+
+// CheckPlugin checks that the age-plugin-<name> binary of a plugin recipient
+// or identity is in $PATH. The plugin is only run once a file key is wrapped
+// or unwrapped, so without the check a missing binary fails a backup only
+// once the snapshot is being sent. X25519 recipients and identities need no
+// plugin.
+func CheckPlugin(s string) error {
+	s = strings.TrimSpace(s)
+
+	name, _, err := plugin.ParseRecipient(s)
+	if err != nil {
+		name, _, err = plugin.ParseIdentity(s)
+	}
+	if err != nil {
+		return nil
+	}
+
+	if _, err := exec.LookPath("age-plugin-" + name); err != nil {
+		slog.Error("age plugin binary not found", "plugin", name, "error", err)
+		return &errclass.EncryptionError{Op: "find plugin", Err: fmt.Errorf("age-plugin-%s is not in $PATH: %w", name, ErrPluginNotInstalled)}
+	}
+
+	return nil
+}
+
+func isPluginIdentity(s string) bool {
+	return strings.HasPrefix(s, "AGE-PLUGIN-")
+}
+
+func parseRecipient(s string, opts AgeOpts) (age.Recipient, error) {
+	if recipient, err := age.ParseX25519Recipient(s); err == nil {
+		return recipient, nil
+	}
+
+	if IsKMSKey(s) {
+		return newKMSKey(s)
+	}
+
+	if isSSHRecipient(strings.TrimSpace(s)) {
+		return parseSSHRecipient(s)
+	}
+
+	if _, _, err := plugin.ParseRecipient(s); err != nil {
+		return nil, &errclass.EncryptionError{Op: "parse recipient", Err: fmt.Errorf("not an X25519, SSH, plugin or KMS recipient: %q", s)}
+	}
+
+	recipient, err := plugin.NewRecipient(s, opts.pluginUI())
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "parse recipient", Err: err}
+	}
+
+	return recipient, nil
+}
+
+// timeoutIdentity stops waiting for a plugin after a timeout, so a restore
+// fails instead of hanging on a token nobody touches. The plugin process
+// is left to exit on its own.
+type timeoutIdentity struct {
+	identity *plugin.Identity
+	timeout  time.Duration
+}
+
+func (t timeoutIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if t.timeout <= 0 {
+		return t.identity.Unwrap(stanzas)
+	}
+
+	type result struct {
+		fileKey []byte
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		fileKey, err := t.identity.Unwrap(stanzas)
+		done <- result{fileKey, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.fileKey, r.err
+	case <-time.After(t.timeout):
+		slog.Error("Timed out waiting for age plugin", "plugin", t.identity.Name(), "timeout", t.timeout)
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: fmt.Errorf("%s: %w", t.identity.Name(), ErrPluginTimeout)}
+	}
+}
@@ -0,0 +1,115 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"golang.org/x/crypto/ssh"
+)
+
+// An SSH key can take the place of an age keypair, like with age -R
+// ~/.ssh/id_ed25519.pub and age -i ~/.ssh/id_ed25519. The recipient is the
+// public key, as written in authorized_keys, and the identity is the private
+// key file. Ed25519 and RSA keys are supported.
+
+var ErrUnsupportedSSHKey = errors.New("unsupported SSH key. Use an ssh-ed25519 or ssh-rsa key")
+
+func isSSHRecipient(s string) bool {
+	return strings.HasPrefix(s, "ssh-ed25519 ") || strings.HasPrefix(s, "ssh-rsa ")
+}
+
+func isSSHIdentity(s string) bool {
+	return strings.HasPrefix(s, "-----BEGIN ") && strings.Contains(s, "PRIVATE KEY-----")
+}
+
+// NormalizeRecipient returns recipient without the comment of an SSH public
+// key, so the same key is always recorded the same way. Other recipients are
+// returned as is.
+func NormalizeRecipient(recipient string) string {
+	recipient = strings.TrimSpace(recipient)
+	if !isSSHRecipient(recipient) {
+		return recipient
+	}
+
+	fields := strings.Fields(recipient)
+	return fields[0] + " " + fields[1]
+}
+
+func parseSSHRecipient(s string) (age.Recipient, error) {
+	recipient, err := agessh.ParseRecipient(NormalizeRecipient(s))
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "parse recipient", Err: err}
+	}
+
+	return recipient, nil
+}
+
+// parseSSHIdentity returns the identity of an unencrypted SSH private key,
+// and its recipient.
+func parseSSHIdentity(s string) (age.Identity, string, error) {
+	key, err := ssh.ParseRawPrivateKey([]byte(s))
+	if err != nil {
+		return nil, "", &errclass.EncryptionError{Op: "parse identity", Err: err}
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, "", &errclass.EncryptionError{Op: "parse identity", Err: err}
+	}
+
+	identity, err := agessh.ParseIdentity([]byte(s))
+	if err != nil {
+		return nil, "", &errclass.EncryptionError{Op: "parse identity", Err: ErrUnsupportedSSHKey}
+	}
+
+	return identity, NormalizeRecipient(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// readSSHIdentity returns the private key of an SSH private key file. If the
+// key is protected by a passphrase, it is decrypted, and returned
+// unencrypted. The result is only kept in memory.
+func readSSHIdentity(content []byte, passphrase PassphraseFunc) (string, error) {
+	content = bytes.TrimSpace(content)
+
+	_, err := ssh.ParseRawPrivateKey(content)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		return string(content), nil
+	case !errors.As(err, &missing):
+		return "", &errclass.EncryptionError{Op: "parse identity", Err: err}
+	}
+
+	if passphrase == nil {
+		return "", &errclass.EncryptionError{Op: "decrypt identity", Err: errors.New("SSH key is protected by a passphrase, but no passphrase is available")}
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "read passphrase", Err: err}
+	}
+
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(content, []byte(pass))
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "decrypt identity", Err: err}
+	}
+
+	// ParseRawPrivateKey returns Ed25519 keys by pointer, which
+	// MarshalPrivateKey doesn't take.
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "decrypt identity", Err: err}
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
@@ -0,0 +1,128 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHKey(t *testing.T, passphrase string) (recipient string, identityFile []byte) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "backup@host")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "backup@host", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " backup@host"
+	return authorizedKey, pem.EncodeToMemory(block)
+}
+
+func TestSSHKeys(t *testing.T) {
+	recipient, identityFile := newSSHKey(t, "")
+	_, otherFile := newSSHKey(t, "")
+
+	if err := ValidateRecipientPublicKey(recipient); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateRecipientPublicKey("ssh-ed25519 not-base64"); err == nil {
+		t.Fatal("expected an invalid SSH key to be rejected")
+	}
+
+	normalized := NormalizeRecipient(recipient)
+	if strings.Contains(normalized, "backup@host") {
+		t.Fatalf("comment wasn't dropped: %q", normalized)
+	}
+
+	identities, err := ReadIdentities(identityFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("got %d identities", len(identities))
+	}
+	if got, err := RecipientFromIdentity(identities[0]); err != nil || got != normalized {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	cfg := &config.Age{RecipientPublicKey: recipient}
+	enc, err := NewAge(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := enc.EncryptedWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(w, "snapshot")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewAgeFromIdentities([]string{string(otherFile), identities[0]}, cfg, AgeOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dec.DecryptedReader(io.NopCloser(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "snapshot" {
+		t.Fatalf("got %q", got)
+	}
+
+	if _, err := NewAgeFromIdentities([]string{string(otherFile)}, cfg, AgeOpts{}); err == nil {
+		t.Fatal("expected another SSH key not to match the recipient")
+	}
+
+	sealed, err := EncryptContent([]byte("store"), []string{normalized}, AgeOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptContent(sealed, identities, AgeOpts{}); err != nil || string(got) != "store" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestReadEncryptedSSHIdentity(t *testing.T) {
+	recipient, identityFile := newSSHKey(t, "correct horse")
+
+	if _, err := ReadIdentities(identityFile, nil); err == nil {
+		t.Fatal("expected a protected key to need a passphrase")
+	}
+	if _, err := ReadIdentities(identityFile, func() (string, error) { return "wrong", nil }); err == nil {
+		t.Fatal("expected a wrong passphrase to be rejected")
+	}
+
+	identities, err := ReadIdentities(identityFile, func() (string, error) { return "correct horse", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := RecipientFromIdentity(identities[0]); err != nil || got != NormalizeRecipient(recipient) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
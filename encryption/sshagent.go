@@ -0,0 +1,178 @@
+package encryption
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An age identity can be derived from an Ed25519 key held by ssh-agent, so
+// the secret never touches the disk of the restore host. The agent signs a
+// fixed challenge; Ed25519 signatures are deterministic, so the signature is
+// a stable secret that only the key holder can produce. The X25519 identity
+// is derived from it with HKDF. Use the recipient of the derived identity
+// when initializing the repository.
+
+const (
+	sshAgentChallenge = "zfsbackrest age identity derivation v1"
+	sshAgentHKDFInfo  = "zfsbackrest-age-x25519-v1"
+)
+
+var (
+	ErrSSHAgentUnavailable = errors.New("ssh-agent is not available. Is SSH_AUTH_SOCK set?")
+	ErrSSHAgentNoKey       = errors.New("no matching Ed25519 key in ssh-agent")
+	ErrSSHAgentAmbiguous   = errors.New("several Ed25519 keys in ssh-agent. Select one by fingerprint or comment")
+	// ErrSSHAgentSSHRecipient is returned when the repository is encrypted to
+	// an SSH public key. age's SSH recipients need the private key itself to
+	// decrypt, which ssh-agent never hands out; it only signs.
+	ErrSSHAgentSSHRecipient = errors.New("the repository is encrypted to an SSH public key, which ssh-agent can't decrypt. " +
+		"Pass the SSH private key with --age-identity-file, or rotate to the recipient printed by `zfsbackrest ssh-agent-recipient`")
+)
+
+// IdentityFromSSHAgent derives an age identity from an Ed25519 key in the
+// ssh-agent at $SSH_AUTH_SOCK. selector is the key's SHA256 fingerprint or
+// comment, and may be empty if the agent holds a single Ed25519 key.
+func IdentityFromSSHAgent(selector string) (string, error) {
+	var identity string
+	err := withSSHAgent(func(a agent.Agent) error {
+		var err error
+		identity, err = identityFromAgent(a, selector)
+		return err
+	})
+
+	return identity, err
+}
+
+// IdentitiesFromSSHAgent derives an age identity from every Ed25519 key in
+// the ssh-agent at $SSH_AUTH_SOCK that matches selector, or from every one if
+// selector is empty. Decryption tries each in turn, so a restore host reached
+// with a forwarded agent doesn't need to know which key the repository uses.
+func IdentitiesFromSSHAgent(selector string) ([]string, error) {
+	var identities []string
+	err := withSSHAgent(func(a agent.Agent) error {
+		var err error
+		identities, err = identitiesFromAgent(a, selector)
+		return err
+	})
+
+	return identities, err
+}
+
+func withSSHAgent(fn func(a agent.Agent) error) error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return &errclass.EncryptionError{Op: "ssh-agent", Err: ErrSSHAgentUnavailable}
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return &errclass.EncryptionError{Op: "ssh-agent", Err: fmt.Errorf("%w: %w", ErrSSHAgentUnavailable, err)}
+	}
+	defer conn.Close()
+
+	return fn(agent.NewClient(conn))
+}
+
+func identityFromAgent(a agent.Agent, selector string) (string, error) {
+	matched, err := agentKeys(a, selector)
+	if err != nil {
+		return "", err
+	}
+	if len(matched) > 1 {
+		return "", &errclass.EncryptionError{Op: "ssh-agent", Err: ErrSSHAgentAmbiguous}
+	}
+
+	return deriveIdentity(a, matched[0])
+}
+
+func identitiesFromAgent(a agent.Agent, selector string) ([]string, error) {
+	matched, err := agentKeys(a, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make([]string, 0, len(matched))
+	for _, key := range matched {
+		identity, err := deriveIdentity(a, key)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// agentKeys returns the Ed25519 keys in the agent that match selector. There
+// is at least one.
+func agentKeys(a agent.Agent, selector string) ([]*agent.Key, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "ssh-agent", Err: fmt.Errorf("failed to list keys: %w", err)}
+	}
+
+	var matched []*agent.Key
+	for _, key := range keys {
+		if key.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+
+		if selector == "" || selector == key.Comment || selector == ssh.FingerprintSHA256(key) ||
+			"SHA256:"+selector == ssh.FingerprintSHA256(key) {
+			matched = append(matched, key)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, &errclass.EncryptionError{Op: "ssh-agent", Err: ErrSSHAgentNoKey}
+	}
+
+	return matched, nil
+}
+
+func deriveIdentity(a agent.Agent, key *agent.Key) (string, error) {
+	slog.Debug("Deriving age identity from ssh-agent key", "fingerprint", ssh.FingerprintSHA256(key), "comment", key.Comment)
+
+	signature, err := a.Sign(key, []byte(sshAgentChallenge))
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "ssh-agent", Err: fmt.Errorf("failed to sign: %w", err)}
+	}
+
+	scalar, err := hkdf.Key(sha256.New, signature.Blob, nil, sshAgentHKDFInfo, 32)
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "ssh-agent", Err: err}
+	}
+
+	encoded, err := bech32Encode("age-secret-key-", scalar)
+	if err != nil {
+		return "", &errclass.EncryptionError{Op: "ssh-agent", Err: err}
+	}
+
+	identity := strings.ToUpper(encoded)
+	if _, err := age.ParseX25519Identity(identity); err != nil {
+		return "", &errclass.EncryptionError{Op: "ssh-agent", Err: err}
+	}
+
+	return identity, nil
+}
+
+// CheckSSHAgentRecipient returns ErrSSHAgentSSHRecipient if recipient is an
+// SSH public key, which identities from ssh-agent can't decrypt.
+func CheckSSHAgentRecipient(recipient string) error {
+	if isSSHRecipient(strings.TrimSpace(recipient)) {
+		return &errclass.EncryptionError{Op: "ssh-agent", Err: ErrSSHAgentSSHRecipient}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package encryption
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestIdentityFromAgent(t *testing.T) {
+	keyring := agent.NewKeyring()
+
+	add := func(comment string) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := identityFromAgent(keyring, ""); !errors.Is(err, ErrSSHAgentNoKey) {
+		t.Fatalf("expected ErrSSHAgentNoKey, got %v", err)
+	}
+
+	add("first")
+
+	identity, err := identityFromAgent(keyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := age.ParseX25519Identity(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != identity {
+		t.Fatalf("identity doesn't round trip: %s != %s", parsed.String(), identity)
+	}
+
+	again, err := identityFromAgent(keyring, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != identity {
+		t.Fatal("derivation is not deterministic")
+	}
+
+	add("second")
+
+	if _, err := identityFromAgent(keyring, ""); !errors.Is(err, ErrSSHAgentAmbiguous) {
+		t.Fatalf("expected ErrSSHAgentAmbiguous, got %v", err)
+	}
+
+	other, err := identityFromAgent(keyring, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == identity {
+		t.Fatal("different keys derived the same identity")
+	}
+}
+
+func TestIdentitiesFromAgent(t *testing.T) {
+	keyring := agent.NewKeyring()
+	for _, comment := range []string{"first", "second"} {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := identityFromAgent(keyring, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := identityFromAgent(keyring, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identities, err := identitiesFromAgent(keyring, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 2 || identities[0] != first || identities[1] != second {
+		t.Fatalf("expected an identity from each key, got %v", identities)
+	}
+
+	identities, err = identitiesFromAgent(keyring, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0] != second {
+		t.Fatalf("expected the selected key's identity, got %v", identities)
+	}
+
+	// Either derived identity decrypts a repository encrypted to the second.
+	parsed, err := age.ParseX25519Identity(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAgeFromIdentities([]string{first, second}, &config.Age{RecipientPublicKey: parsed.Recipient().String()}, AgeOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckSSHAgentRecipient("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN"); !errors.Is(err, ErrSSHAgentSSHRecipient) {
+		t.Fatalf("expected ErrSSHAgentSSHRecipient, got %v", err)
+	}
+	if err := CheckSSHAgentRecipient(parsed.Recipient().String()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package encryption
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// HashiCorp Vault and OpenBao share their API, so both are supported by the
+// same client. The token, or the AppRole secret ID, is the only secret left
+// on the host; the identity itself is only held in memory.
+
+var ErrVaultNotConfigured = errors.New("vault is not configured. Set vault.address, and vault.kv.path or vault.transit.key")
+
+// IdentitiesFromVault fetches the age identities from Vault, as configured
+// in vaultConfig.
+func IdentitiesFromVault(ctx context.Context, vaultConfig *config.Vault) ([]string, error) {
+	client, err := newVaultClient(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if vaultConfig.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vaultConfig.Timeout)
+		defer cancel()
+	}
+
+	if err := client.login(ctx, &vaultConfig.Auth); err != nil {
+		return nil, &errclass.EncryptionError{Op: "vault login", Err: err}
+	}
+
+	var content []byte
+	if vaultConfig.Transit.Key != "" {
+		content, err = client.transitDecrypt(ctx, &vaultConfig.Transit)
+	} else {
+		content, err = client.readKV(ctx, &vaultConfig.KV)
+	}
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "fetch identity from vault", Err: err}
+	}
+
+	identities, err := ReadIdentities(content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Fetched age identities from vault", "address", client.address, "count", len(identities))
+	return identities, nil
+}
+
+type vaultClient struct {
+	address   string
+	namespace string
+	token     string
+	client    *http.Client
+}
+
+func newVaultClient(vaultConfig *config.Vault) (*vaultClient, error) {
+	address := cmp.Or(vaultConfig.Address, os.Getenv("VAULT_ADDR"))
+	if address == "" || (vaultConfig.KV.Path == "" && vaultConfig.Transit.Key == "") {
+		return nil, &errclass.ConfigError{Key: "vault", Err: ErrVaultNotConfigured}
+	}
+	if vaultConfig.KV.Path != "" && vaultConfig.Transit.Key != "" {
+		return nil, &errclass.ConfigError{Key: "vault", Err: errors.New("set only one of vault.kv.path and vault.transit.key")}
+	}
+	if vaultConfig.KV.Path != "" && vaultConfig.KV.Version != 1 && vaultConfig.KV.Version != 2 {
+		return nil, &errclass.ConfigError{Key: "vault.kv.version", Err: fmt.Errorf("must be 1 or 2, got %d", vaultConfig.KV.Version)}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := cmp.Or(vaultConfig.CACertFile, os.Getenv("VAULT_CACERT")); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, &errclass.ConfigError{Key: "vault.ca_cert_file", Err: err}
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &errclass.ConfigError{Key: "vault.ca_cert_file", Err: fmt.Errorf("no certificates in %s", caFile)}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &vaultClient{
+		address:   strings.TrimRight(address, "/"),
+		namespace: cmp.Or(vaultConfig.Namespace, os.Getenv("VAULT_NAMESPACE")),
+		client:    &http.Client{Transport: transport},
+	}, nil
+}
+
+// login sets the client's token, read from the config, or got from an
+// AppRole login.
+func (c *vaultClient) login(ctx context.Context, auth *config.VaultAuth) error {
+	switch auth.Method {
+	case "", config.VaultAuthToken:
+		token, err := secretValue(auth.Token, auth.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read vault.auth.token_file: %w", err)
+		}
+
+		c.token = cmp.Or(token, os.Getenv("VAULT_TOKEN"))
+		if c.token == "" {
+			return &errclass.ConfigError{Key: "vault.auth.token", Err: errors.New("no Vault token. Set vault.auth.token, vault.auth.token_file or VAULT_TOKEN")}
+		}
+		return nil
+
+	case config.VaultAuthAppRole:
+		secretID, err := secretValue(auth.AppRole.SecretID, auth.AppRole.SecretIDFile)
+		if err != nil {
+			return fmt.Errorf("failed to read vault.auth.approle.secret_id_file: %w", err)
+		}
+		if auth.AppRole.RoleID == "" {
+			return &errclass.ConfigError{Key: "vault.auth.approle.role_id", Err: errors.New("is required for AppRole auth")}
+		}
+
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		err = c.call(ctx, http.MethodPost, "auth/"+auth.AppRole.Mount+"/login", map[string]string{
+			"role_id":   auth.AppRole.RoleID,
+			"secret_id": secretID,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+
+		slog.Debug("Logged in to vault with AppRole", "mount", auth.AppRole.Mount)
+		c.token = resp.Auth.ClientToken
+		return nil
+
+	default:
+		return &errclass.ConfigError{Key: "vault.auth.method", Err: fmt.Errorf("unknown method %q, expected %q or %q", auth.Method, config.VaultAuthToken, config.VaultAuthAppRole)}
+	}
+}
+
+func (c *vaultClient) readKV(ctx context.Context, kv *config.VaultKV) ([]byte, error) {
+	path := kv.Mount + "/" + strings.TrimLeft(kv.Path, "/")
+	if kv.Version == 2 {
+		path = kv.Mount + "/data/" + strings.TrimLeft(kv.Path, "/")
+	}
+
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := c.call(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	// KV version 2 nests the secret's data with its metadata.
+	data := resp.Data
+	if kv.Version == 2 {
+		data, _ = resp.Data["data"].(map[string]any)
+	}
+
+	value, ok := data[kv.Field].(string)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("the secret at %s has no field %q", path, kv.Field)
+	}
+
+	return []byte(value), nil
+}
+
+func (c *vaultClient) transitDecrypt(ctx context.Context, transit *config.VaultTransit) ([]byte, error) {
+	ciphertext, err := os.ReadFile(transit.CiphertextFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault.transit.ciphertext_file: %w", err)
+	}
+
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err = c.call(ctx, http.MethodPost, transit.Mount+"/decrypt/"+url.PathEscape(transit.Key), map[string]string{
+		"ciphertext": strings.TrimSpace(string(ciphertext)),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the transit plaintext: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// call calls the Vault API at path, relative to /v1/.
+func (c *vaultClient) call(ctx context.Context, method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	slog.Debug("Calling vault", "method", method, "path", path)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(respBody, &vaultErr)
+		if len(vaultErr.Errors) == 0 {
+			return fmt.Errorf("vault %s %s failed with status %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("vault %s %s failed with status %s: %s", method, path, resp.Status, strings.Join(vaultErr.Errors, "; "))
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode vault response: %w", err)
+	}
+
+	return nil
+}
+
+// secretValue returns value, or the content of file if value is empty.
+func secretValue(value string, file string) (string, error) {
+	if value != "" || file == "" {
+		return value, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
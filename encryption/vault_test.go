@@ -0,0 +1,114 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+)
+
+// fakeVault serves an AppRole login, a KV version 2 secret, and a transit
+// key that "encrypts" by prefixing the base64 plaintext.
+func fakeVault(t *testing.T, identity string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Namespace") != "backups" {
+			t.Errorf("missing namespace on %s", r.URL.Path)
+		}
+
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req["role_id"] != "role" || req["secret_id"] != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": "approle-token"}})
+			return
+		}
+
+		if token := r.Header.Get("X-Vault-Token"); token != "approle-token" && token != "static-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/zfsbackrest":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+				"data":     map[string]any{"identity": identity},
+				"metadata": map[string]any{"version": 1},
+			}})
+		case "/v1/transit/decrypt/zfsbackrest":
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"plaintext": req["ciphertext"][len("vault:v1:"):]}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestIdentitiesFromVault(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := fakeVault(t, "# created by age-keygen\n"+identity.String()+"\n")
+	defer server.Close()
+
+	ciphertextFile := filepath.Join(t.TempDir(), "identity.vault")
+	ciphertext := "vault:v1:" + base64.StdEncoding.EncodeToString([]byte(identity.String()))
+	if err := os.WriteFile(ciphertextFile, []byte(ciphertext+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, cfg := range map[string]config.Vault{
+		"kv with approle": {
+			Auth: config.VaultAuth{Method: config.VaultAuthAppRole, AppRole: config.VaultAppRole{Mount: "approle", RoleID: "role", SecretID: "secret"}},
+			KV:   config.VaultKV{Mount: "secret", Path: "zfsbackrest", Field: "identity", Version: 2},
+		},
+		"transit with a token": {
+			Auth:    config.VaultAuth{Method: config.VaultAuthToken, Token: "static-token"},
+			Transit: config.VaultTransit{Mount: "transit", Key: "zfsbackrest", CiphertextFile: ciphertextFile},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg.Address = server.URL
+			cfg.Namespace = "backups"
+			cfg.Timeout = 10 * time.Second
+
+			identities, err := IdentitiesFromVault(t.Context(), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(identities) != 1 || identities[0] != identity.String() {
+				t.Fatalf("got %v", identities)
+			}
+		})
+	}
+
+	denied := config.Vault{
+		Address:   server.URL,
+		Namespace: "backups",
+		Auth:      config.VaultAuth{Method: config.VaultAuthAppRole, AppRole: config.VaultAppRole{Mount: "approle", RoleID: "role", SecretID: "wrong"}},
+		KV:        config.VaultKV{Mount: "secret", Path: "zfsbackrest", Field: "identity", Version: 2},
+	}
+	if _, err := IdentitiesFromVault(t.Context(), &denied); err == nil {
+		t.Fatal("expected a failed login to fail")
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := IdentitiesFromVault(t.Context(), &config.Vault{}); err == nil {
+		t.Fatal("expected an unconfigured vault to fail")
+	}
+}
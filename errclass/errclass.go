@@ -0,0 +1,184 @@
+// Package errclass provides typed errors that classify failures by the
+// subsystem they originate from, so callers can branch on the class of an
+// error with errors.Is / errors.As instead of matching on strings.
+package errclass
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Class string
+
+const (
+	ClassUnknown    Class = "unknown"
+	ClassZFS        Class = "zfs"
+	ClassStorage    Class = "storage"
+	ClassValidation Class = "validation"
+	ClassLock       Class = "lock"
+	ClassEncryption Class = "encryption"
+	ClassConfig     Class = "config"
+)
+
+// Sentinels for matching a class with errors.Is.
+var (
+	ErrZFS        = errors.New("zfs error")
+	ErrStorage    = errors.New("storage error")
+	ErrValidation = errors.New("validation error")
+	ErrLock       = errors.New("lock error")
+	ErrEncryption = errors.New("encryption error")
+	ErrConfig     = errors.New("config error")
+
+	// ErrNotFound matches storage errors caused by a missing object.
+	ErrNotFound = errors.New("not found")
+)
+
+// ZFSError is returned when a zfs command fails.
+type ZFSError struct {
+	Op       string
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *ZFSError) Error() string {
+	msg := fmt.Sprintf("zfs %s failed", e.Op)
+	if e.ExitCode > 0 {
+		msg += fmt.Sprintf(" (exit code %d)", e.ExitCode)
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *ZFSError) Unwrap() error { return e.Err }
+
+func (e *ZFSError) Is(target error) bool { return target == ErrZFS }
+
+// StorageError is returned when an operation against the repository storage
+// backend fails.
+type StorageError struct {
+	Op       string
+	Backend  string
+	Path     string
+	NotFound bool
+	Err      error
+}
+
+func (e *StorageError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s storage: %s: %v", e.Backend, e.Op, e.Err)
+	}
+
+	return fmt.Sprintf("%s storage: %s %s: %v", e.Backend, e.Op, e.Path, e.Err)
+}
+
+func (e *StorageError) Unwrap() error { return e.Err }
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrStorage || (e.NotFound && target == ErrNotFound)
+}
+
+// ValidationError is returned when the repository, a backup, or user input
+// is not in the shape zfsbackrest expects. Retrying does not help.
+type ValidationError struct {
+	Subject string
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Subject, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// LockError is returned when the process lock could not be acquired or
+// released.
+type LockError struct {
+	Path string
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("lock %s: %v", e.Path, e.Err)
+}
+
+func (e *LockError) Unwrap() error { return e.Err }
+
+func (e *LockError) Is(target error) bool { return target == ErrLock }
+
+// EncryptionError is returned when keys can't be parsed, don't match the
+// repository, or a stream fails to encrypt or decrypt.
+type EncryptionError struct {
+	Op  string
+	Err error
+}
+
+func (e *EncryptionError) Error() string {
+	return fmt.Sprintf("encryption: %s: %v", e.Op, e.Err)
+}
+
+func (e *EncryptionError) Unwrap() error { return e.Err }
+
+func (e *EncryptionError) Is(target error) bool { return target == ErrEncryption }
+
+// ConfigError is returned when the configuration can't be loaded or is
+// invalid.
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("config: %v", e.Err)
+	}
+
+	return fmt.Sprintf("config %s: %v", e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+func (e *ConfigError) Is(target error) bool { return target == ErrConfig }
+
+// Of returns the class of the outermost classified error in err's chain.
+func Of(err error) Class {
+	for err != nil {
+		switch err.(type) {
+		case *ZFSError:
+			return ClassZFS
+		case *StorageError:
+			return ClassStorage
+		case *ValidationError:
+			return ClassValidation
+		case *LockError:
+			return ClassLock
+		case *EncryptionError:
+			return ClassEncryption
+		case *ConfigError:
+			return ClassConfig
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				if class := Of(inner); class != ClassUnknown {
+					return class
+				}
+			}
+			return ClassUnknown
+		default:
+			return ClassUnknown
+		}
+	}
+
+	return ClassUnknown
+}
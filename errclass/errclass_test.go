@@ -0,0 +1,78 @@
+package errclass
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestIsAndOf(t *testing.T) {
+	base := errors.New("boom")
+
+	tests := []struct {
+		name     string
+		err      error
+		sentinel error
+		class    Class
+	}{
+		{"zfs", &ZFSError{Op: "send", Err: base}, ErrZFS, ClassZFS},
+		{"storage", &StorageError{Op: "get", Backend: "s3", Err: base}, ErrStorage, ClassStorage},
+		{"validation", &ValidationError{Subject: "store", Err: base}, ErrValidation, ClassValidation},
+		{"lock", &LockError{Path: "/tmp/x.lock", Err: base}, ErrLock, ClassLock},
+		{"encryption", &EncryptionError{Op: "decrypt", Err: base}, ErrEncryption, ClassEncryption},
+		{"config", &ConfigError{Err: base}, ErrConfig, ClassConfig},
+		{"wrapped", fmt.Errorf("outer: %w", &LockError{Err: base}), ErrLock, ClassLock},
+		{"joined", errors.Join(errors.New("other"), &ZFSError{Err: base}), ErrZFS, ClassZFS},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if !errors.Is(tc.err, tc.sentinel) {
+				t.Fatalf("expected errors.Is(%v, %v)", tc.err, tc.sentinel)
+			}
+			if !errors.Is(tc.err, base) {
+				t.Fatalf("expected the cause to stay in the chain")
+			}
+			if got := Of(tc.err); got != tc.class {
+				t.Fatalf("Of() = %v, want %v", got, tc.class)
+			}
+		})
+	}
+}
+
+func TestOfUnknown(t *testing.T) {
+	if got := Of(errors.New("plain")); got != ClassUnknown {
+		t.Fatalf("Of() = %v, want %v", got, ClassUnknown)
+	}
+	if got := Of(nil); got != ClassUnknown {
+		t.Fatalf("Of(nil) = %v, want %v", got, ClassUnknown)
+	}
+}
+
+func TestStorageNotFound(t *testing.T) {
+	err := &StorageError{Op: "get", Backend: "s3", NotFound: true, Err: errors.New("NoSuchKey")}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found")
+	}
+
+	err.NotFound = false
+	if errors.Is(err, ErrNotFound) {
+		t.Fatalf("did not expect not found")
+	}
+}
+
+func TestZFSErrorKeepsExitError(t *testing.T) {
+	exitErr := &exec.ExitError{}
+	err := &ZFSError{Op: "list", ExitCode: 1, Stderr: "dataset does not exist\n", Err: exitErr}
+
+	var target *exec.ExitError
+	if !errors.As(err, &target) {
+		t.Fatalf("expected exec.ExitError to be reachable with errors.As")
+	}
+
+	want := "zfs list failed (exit code 1): dataset does not exist: " + exitErr.Error()
+	if err.Error() != want {
+		t.Fatalf("Error() = %q, want %q", err.Error(), want)
+	}
+}
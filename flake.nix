@@ -76,7 +76,14 @@
               "cmd/zfsbackrest"
             ];
             
-            vendorHash = "sha256-7vtRH5ookHyEPKiI/4Dz9AZk0vfxQWbQExL8MQSZVJE=";
+            vendorHash = "sha256-T5BGIZX304wbBtjh2HXLuFZpo9nNHqjBMYDNMVCosUY=";
+
+            nativeBuildInputs = [ pkgs.installShellFiles ];
+
+            postInstall = pkgs.lib.optionalString (pkgs.stdenv.buildPlatform.canExecute pkgs.stdenv.hostPlatform) ''
+              $out/bin/zfsbackrest docs gen --format man --output man
+              installManPage man/*.8
+            '';
 
             meta = {
               description = "pgbackrest style encrypted backups for ZFS filesystems";
@@ -0,0 +1,283 @@
+// Package framing splits snapshot streams into authenticated chunks, so a
+// restore that reads a truncated or tampered snapshot fails at the chunk it
+// is damaged at, instead of after `zfs recv` was fed everything before it.
+//
+// The stream is framed after it is compressed, and before it is encrypted.
+// A framed stream starts with a header holding a random key, followed by
+// chunks of up to ChunkSize bytes, each sealed with ChaCha20-Poly1305:
+//
+//	header: magic, key (32 bytes)
+//	chunk:  length (4 bytes, big endian, high bit set on the last chunk),
+//	        sealed data (length + 16 bytes)
+//
+// The nonce is the chunk's index, and the last chunk's is marked, so chunks
+// can't be reordered, and a stream cut at a chunk boundary is still detected.
+// The last chunk may be empty. In encrypted repositories, the key is
+// encrypted with the rest of the stream. In repositories initialized without
+// encryption it is stored as is, so the chunks are only protected against
+// corruption and truncation, not against deliberate tampering.
+package framing
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChunkSize is the most data a chunk holds.
+const ChunkSize = 1 << 20
+
+const (
+	magic     = "zfsbackrest-frames/v1\n"
+	finalFlag = 1 << 31
+)
+
+var (
+	ErrTruncated = errors.New("snapshot stream is truncated")
+	ErrTampered  = errors.New("snapshot stream chunk failed authentication")
+)
+
+// Wrap returns enc, framing the stream before encrypting it, and checking
+// the frames after decrypting it.
+func Wrap(enc encryption.Encryption) encryption.Encryption {
+	return &framedEncryption{enc: enc}
+}
+
+type framedEncryption struct {
+	enc encryption.Encryption
+}
+
+func (f *framedEncryption) EncryptedWriter(dst io.Writer) (io.WriteCloser, error) {
+	encWriter, err := f.enc.EncryptedWriter(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		_ = encWriter.Close()
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		_ = encWriter.Close()
+		return nil, err
+	}
+
+	if _, err := encWriter.Write(append([]byte(magic), key...)); err != nil {
+		_ = encWriter.Close()
+		return nil, err
+	}
+
+	return &framedWriter{aead: aead, encWriter: encWriter, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (f *framedEncryption) DecryptedReader(src io.ReadCloser) (io.ReadCloser, error) {
+	decReader, err := f.enc.DecryptedReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(magic)+chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(decReader, header); err != nil {
+		_ = decReader.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, frameError(fmt.Errorf("%w: the header is incomplete", ErrTruncated))
+		}
+		return nil, err
+	}
+
+	if string(header[:len(magic)]) != magic {
+		_ = decReader.Close()
+		return nil, frameError(fmt.Errorf("%w: the header is not of a framed stream", ErrTampered))
+	}
+
+	aead, err := chacha20poly1305.New(header[len(magic):])
+	if err != nil {
+		_ = decReader.Close()
+		return nil, err
+	}
+
+	return &framedReader{aead: aead, decReader: decReader, offset: int64(len(header))}, nil
+}
+
+func frameError(err error) error {
+	return &errclass.ValidationError{Subject: "snapshot stream", Err: err}
+}
+
+func nonce(index uint64, final bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[3:11], index)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+// framedWriter buffers a chunk, and seals it once it is full. The last chunk
+// is sealed on Close.
+type framedWriter struct {
+	aead      cipher.AEAD
+	encWriter io.WriteCloser
+	buf       []byte
+	index     uint64
+	err       error
+}
+
+func (w *framedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := min(len(p), ChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *framedWriter) seal(final bool) error {
+	length := uint32(len(w.buf))
+	if final {
+		length |= finalFlag
+	}
+
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(w.buf)+w.aead.Overhead()), length)
+	frame = w.aead.Seal(frame, nonce(w.index, final), w.buf, frame[:4])
+	if _, err := w.encWriter.Write(frame); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// Close seals the last chunk, then closes the encrypted writer it writes to.
+// If a chunk failed to be written, the stream has no last chunk, and Close
+// fails with that error, so the stream isn't committed truncated.
+func (w *framedWriter) Close() error {
+	if w.err != nil {
+		return errors.Join(w.err, w.encWriter.Close())
+	}
+
+	if err := w.seal(true); err != nil {
+		return errors.Join(err, w.encWriter.Close())
+	}
+
+	return w.encWriter.Close()
+}
+
+// framedReader opens a chunk at a time, and only returns its data once it
+// was authenticated.
+type framedReader struct {
+	aead      cipher.AEAD
+	decReader io.ReadCloser
+	index     uint64
+	// offset is where the next chunk starts in the decrypted stream.
+	offset int64
+	chunk  bytes.Reader
+	sealed []byte
+	final  bool
+	err    error
+}
+
+func (r *framedReader) Read(p []byte) (int, error) {
+	for r.chunk.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.final {
+			r.err = r.checkEnd()
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			continue
+		}
+
+		r.err = r.next()
+	}
+
+	return r.chunk.Read(p)
+}
+
+// next opens the next chunk.
+func (r *framedReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.decReader, length[:]); err != nil {
+		return r.truncated(err)
+	}
+
+	final := binary.BigEndian.Uint32(length[:])&finalFlag != 0
+	size := int(binary.BigEndian.Uint32(length[:]) &^ finalFlag)
+	if size > ChunkSize {
+		return frameError(fmt.Errorf("%w: chunk %d at byte %d claims %d bytes, more than the %d a chunk holds", ErrTampered, r.index, r.offset, size, ChunkSize))
+	}
+
+	r.sealed = r.sealed[:0]
+	r.sealed = append(r.sealed, make([]byte, size+r.aead.Overhead())...)
+	if _, err := io.ReadFull(r.decReader, r.sealed); err != nil {
+		return r.truncated(err)
+	}
+
+	data, err := r.aead.Open(nil, nonce(r.index, final), r.sealed, length[:])
+	if err != nil {
+		return frameError(fmt.Errorf("%w: chunk %d at byte %d", ErrTampered, r.index, r.offset))
+	}
+
+	r.chunk.Reset(data)
+	r.final = final
+	r.index++
+	r.offset += int64(len(length) + len(r.sealed))
+	return nil
+}
+
+func (r *framedReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return frameError(fmt.Errorf("%w: it ends in chunk %d at byte %d, before the last chunk", ErrTruncated, r.index, r.offset))
+	}
+	return err
+}
+
+// checkEnd checks nothing follows the last chunk.
+func (r *framedReader) checkEnd() error {
+	n, err := r.decReader.Read(make([]byte, 1))
+	for n == 0 && err == nil {
+		n, err = r.decReader.Read(make([]byte, 1))
+	}
+
+	switch {
+	case n > 0:
+		return frameError(fmt.Errorf("%w: data follows the last chunk at byte %d", ErrTampered, r.offset))
+	case errors.Is(err, io.EOF):
+		return nil
+	default:
+		return err
+	}
+}
+
+// Close closes the decrypted reader it reads from.
+func (r *framedReader) Close() error {
+	return r.decReader.Close()
+}
@@ -0,0 +1,138 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+)
+
+func frame(t *testing.T, enc encryption.Encryption, stream []byte) []byte {
+	t.Helper()
+
+	var object bytes.Buffer
+	w, err := Wrap(enc).EncryptedWriter(&object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return object.Bytes()
+}
+
+func unframe(enc encryption.Encryption, object []byte) ([]byte, error) {
+	r, err := Wrap(enc).DecryptedReader(io.NopCloser(bytes.NewReader(object)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageEnc, err := encryption.NewAgeFromIdentity(identity.String(), &config.Age{RecipientPublicKey: identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, stream := range map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("zfs send stream"),
+		"one chunk":  bytes.Repeat([]byte{1}, ChunkSize),
+		"two chunks": bytes.Repeat([]byte{1}, ChunkSize+1),
+	} {
+		for encName, enc := range map[string]encryption.Encryption{"age": ageEnc, "passthrough": encryption.Passthrough{}} {
+			t.Run(name+"/"+encName, func(t *testing.T) {
+				got, err := unframe(enc, frame(t, enc, stream))
+				if err != nil || !bytes.Equal(got, stream) {
+					t.Fatalf("expected the stream back, got %d bytes, %v", len(got), err)
+				}
+			})
+		}
+	}
+}
+
+func TestDetectsDamage(t *testing.T) {
+	enc := encryption.Passthrough{}
+	stream := bytes.Repeat([]byte("zfs send stream "), ChunkSize/4)
+	object := frame(t, enc, stream)
+	header := len(magic) + 32
+	chunk := 4 + ChunkSize + 16
+
+	tampered := bytes.Clone(object)
+	tampered[header+chunk+100] ^= 1
+	got, err := unframe(enc, tampered)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected a tampered chunk to fail, got %v", err)
+	}
+	if len(got) != ChunkSize {
+		t.Fatalf("expected the chunk before the tampered one, got %d bytes", len(got))
+	}
+
+	// Cutting the stream at a chunk boundary drops the last chunk.
+	if _, err := unframe(enc, object[:header+3*chunk]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected a stream cut at a chunk boundary to be truncated, got %v", err)
+	}
+	if _, err := unframe(enc, object[:len(object)-1]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected a stream cut in a chunk to be truncated, got %v", err)
+	}
+	if _, err := unframe(enc, object[:10]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected a stream cut in the header to be truncated, got %v", err)
+	}
+
+	swapped := append(bytes.Clone(object[:header]), object[header+chunk:header+2*chunk]...)
+	swapped = append(swapped, object[header:header+chunk]...)
+	swapped = append(swapped, object[header+2*chunk:]...)
+	if _, err := unframe(enc, swapped); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected reordered chunks to fail, got %v", err)
+	}
+
+	if _, err := unframe(enc, append(bytes.Clone(object), 0)); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected data after the last chunk to fail, got %v", err)
+	}
+}
+
+// failingWriter fails every write after the first limit bytes.
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errWriteFailed
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestCloseAfterFailedWrite(t *testing.T) {
+	// The header is written, the first chunk isn't.
+	w, err := Wrap(encryption.Passthrough{}).EncryptedWriter(&failingWriter{limit: len(magic) + 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(bytes.Repeat([]byte{1}, ChunkSize+1)); !errors.Is(err, errWriteFailed) {
+		t.Fatalf("expected the chunk write to fail, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, errWriteFailed) {
+		t.Fatalf("expected Close to fail after a failed write, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrStopped is returned by Run when a soft cancel was requested and the FSM
+// stopped at a safe state.
+var ErrStopped = errors.New("stopped at a safe state after a soft cancel")
+
+type softCancelKey struct{}
+
+// WithSoftCancel returns a context carrying a soft cancel signal. Once done is
+// closed, FSMs run with the context finish their in-flight transition, and the
+// ones needed to reach a safe state, then stop with ErrStopped.
+func WithSoftCancel(ctx context.Context, done <-chan struct{}) context.Context {
+	return context.WithValue(ctx, softCancelKey{}, done)
+}
+
+// SoftCancelled reports whether a soft cancel was requested.
+func SoftCancelled(ctx context.Context) bool {
+	done, ok := ctx.Value(softCancelKey{}).(<-chan struct{})
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,74 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSoftCancelStopsAtSafeState(t *testing.T) {
+	done := make(chan struct{})
+	ctx := WithSoftCancel(context.Background(), done)
+
+	var ran []string
+	step := func(name string, cancel bool) func(context.Context, *struct{}) error {
+		return func(context.Context, *struct{}) error {
+			ran = append(ran, name)
+			if cancel {
+				close(done)
+			}
+			return nil
+		}
+	}
+
+	f := NewFSM(
+		"test",
+		State[string, struct{}]{ID: "initial", Data: &struct{}{}},
+		map[string]Transition[string, struct{}]{
+			"start":  {From: "initial", To: "started", Run: step("start", true)},
+			"finish": {From: "started", To: "recorded", Run: step("finish", false)},
+			"next":   {From: "recorded", To: "done", Run: step("next", false)},
+		},
+		RetryExponentialBackoffConfig{},
+	).WithSafeStates("initial", "recorded", "done")
+
+	// The soft cancel arrives during start. "started" isn't safe, so finish
+	// still runs, and the FSM stops before next.
+	err := f.RunSequence(ctx, "start", "finish", "next")
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	if len(ran) != 2 || ran[0] != "start" || ran[1] != "finish" {
+		t.Fatalf("unexpected transitions run: %v", ran)
+	}
+	if f.CurrentState().ID != "recorded" {
+		t.Fatalf("expected to stop at recorded, got %v", f.CurrentState().ID)
+	}
+}
+
+func TestSoftCancelWithoutSafeStates(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	ctx := WithSoftCancel(context.Background(), done)
+
+	f := NewFSM(
+		"test",
+		State[string, struct{}]{ID: "initial", Data: &struct{}{}},
+		map[string]Transition[string, struct{}]{
+			"start": {From: "initial", To: "started", Run: func(context.Context, *struct{}) error {
+				t.Fatal("start should not run after a soft cancel")
+				return nil
+			}},
+		},
+		RetryExponentialBackoffConfig{},
+	)
+
+	if err := f.Run(ctx, "start"); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	if SoftCancelled(context.Background()) {
+		t.Fatal("context without a soft cancel signal should not be soft cancelled")
+	}
+}
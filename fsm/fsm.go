@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -34,7 +35,10 @@ type FSM[StateT comparable, ActionT comparable, DataT any] struct {
 	defaultRetryStrategy RetryStrategy
 	transitions          map[ActionT]Transition[StateT, DataT]
 	current              State[StateT, DataT]
-	lock                 sync.RWMutex
+	// safeStates are the states the FSM may stop at after a soft cancel. Every
+	// state is safe if it is nil.
+	safeStates map[StateT]bool
+	lock       sync.RWMutex
 }
 
 func NewFSM[StateT comparable, ActionT comparable, DataT any](
@@ -53,6 +57,27 @@ func NewFSM[StateT comparable, ActionT comparable, DataT any](
 	}
 }
 
+// WithSafeStates sets the states the FSM may stop at after a soft cancel, the
+// ones from which an interrupted operation can be cleaned up or resumed. Until
+// it reaches one, the FSM keeps running.
+func (f *FSM[StateT, ActionT, DataT]) WithSafeStates(states ...StateT) *FSM[StateT, ActionT, DataT] {
+	f.safeStates = make(map[StateT]bool, len(states))
+	for _, state := range states {
+		f.safeStates[state] = true
+	}
+	return f
+}
+
+// stopping reports whether the FSM should stop, because a soft cancel was
+// requested and it is at a safe state.
+func (f *FSM[StateT, ActionT, DataT]) stopping(ctx context.Context) bool {
+	if !SoftCancelled(ctx) {
+		return false
+	}
+
+	return f.safeStates == nil || f.safeStates[f.current.ID]
+}
+
 func (f *FSM[StateT, ActionT, DataT]) Run(ctx context.Context, action ActionT) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -66,6 +91,11 @@ func (f *FSM[StateT, ActionT, DataT]) Run(ctx context.Context, action ActionT) e
 		return fmt.Errorf("FSM is in a terminal state, cannot run action %v", action)
 	}
 
+	if f.stopping(ctx) {
+		slog.Info("Soft cancel requested, stopping at a safe state", "name", f.name, "action", action, "state", f.current.ID)
+		return ErrStopped
+	}
+
 	slog.Debug("Running FSM", "name", f.name, "action", action)
 
 	transition, ok := f.transitions[action]
@@ -116,6 +146,11 @@ func (f *FSM[StateT, ActionT, DataT]) Run(ctx context.Context, action ActionT) e
 		default:
 		}
 
+		if f.stopping(ctx) {
+			slog.Info("Soft cancel requested, not retrying", "name", f.name, "action", action, "state", f.current.ID, "error", err)
+			return errors.Join(ErrStopped, err)
+		}
+
 		wait, err := retryRunner.RetryAfter(err)
 		if err != nil {
 			slog.Error("Error retrying", "name", f.name, "action", action, "error", err)
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"log/slog"
 	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
 )
 
 var (
@@ -11,8 +13,13 @@ var (
 	RetryAttemptsExhausted = errors.New("retry attempts exhausted")
 )
 
+// IsUnrecoverableError reports whether retrying err is pointless. Besides
+// errors explicitly marked with NewUnrecoverableError, validation and
+// encryption errors never succeed on retry.
 func IsUnrecoverableError(err error) bool {
-	return errors.Is(err, UnrecoverableError)
+	return errors.Is(err, UnrecoverableError) ||
+		errors.Is(err, errclass.ErrValidation) ||
+		errors.Is(err, errclass.ErrEncryption)
 }
 
 func NewUnrecoverableError(err error) error {
@@ -54,7 +61,8 @@ func (r *RetryExponentialBackoff) RetryAfter(err error) (time.Duration, error) {
 
 	if r.currentRetry >= r.Config.MaxRetries {
 		slog.Error("Retry attempts exhausted", "error", err)
-		return 0, RetryAttemptsExhausted
+		// Keep the last error in the chain so callers can still classify it.
+		return 0, errors.Join(RetryAttemptsExhausted, err)
 	}
 
 	wait := min(r.Config.WaitIncrements*(1<<time.Duration(r.currentRetry)), r.Config.MaxWait)
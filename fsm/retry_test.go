@@ -4,6 +4,8 @@ import (
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
 )
 
 func TestIsAndNewUnrecoverableError(t *testing.T) {
@@ -140,3 +142,28 @@ func TestRetryExponentialBackoff_ZeroIncrement(t *testing.T) {
 		}
 	}
 }
+
+func TestIsUnrecoverableError_Classified(t *testing.T) {
+	if !IsUnrecoverableError(&errclass.ValidationError{Subject: "store", Err: errors.New("boom")}) {
+		t.Fatalf("validation errors should be unrecoverable")
+	}
+	if !IsUnrecoverableError(&errclass.EncryptionError{Op: "decrypt", Err: errors.New("boom")}) {
+		t.Fatalf("encryption errors should be unrecoverable")
+	}
+	if IsUnrecoverableError(&errclass.StorageError{Op: "get", Backend: "s3", Err: errors.New("boom")}) {
+		t.Fatalf("storage errors should be retried")
+	}
+}
+
+func TestRetryExponentialBackoff_ExhaustedKeepsLastError(t *testing.T) {
+	r := NewRetryExponentialBackoff(RetryExponentialBackoffConfig{MaxRetries: 0})
+	last := &errclass.StorageError{Op: "put", Backend: "s3", Err: errors.New("boom")}
+
+	_, err := r.RetryAfter(last)
+	if !errors.Is(err, RetryAttemptsExhausted) {
+		t.Fatalf("expected RetryAttemptsExhausted, got %v", err)
+	}
+	if !errors.Is(err, errclass.ErrStorage) {
+		t.Fatalf("expected the last error to stay in the chain, got %v", err)
+	}
+}
@@ -3,15 +3,26 @@
 package glock
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"golang.org/x/sys/unix"
 )
 
+var (
+	// ErrLockHeld is returned when another process holds the lock.
+	ErrLockHeld = errors.New("another instance appears to be running")
+	// ErrStaleLock is returned when the lock is held, but the process recorded
+	// in the lock file no longer exists.
+	ErrStaleLock = errors.New("lock is held but its owning process no longer exists")
+)
+
 // GlobalLock provides a system-wide single-instance lock using a filesystem lock file.
 // On Unix-like systems this uses flock with an exclusive, non-blocking lock.
 type GlobalLock struct {
@@ -22,30 +33,97 @@ type GlobalLock struct {
 // Acquire attempts to acquire a global lock for the given application name.
 // The lock file will live in the system temp dir as <appName>.lock.
 func Acquire(appName string) (*GlobalLock, error) {
-	lockPath := filepath.Join(os.TempDir(), fmt.Sprintf("%s.lock", appName))
-	return AcquireAtPath(lockPath)
+	return AcquireAtPath(LockPath(appName))
+}
+
+// LockPath returns the path of the lock file for the given application name.
+func LockPath(appName string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s.lock", appName))
+}
+
+// AcquireOpts controls how a lock is acquired.
+type AcquireOpts struct {
+	// BreakStale takes over a lock whose owning process no longer exists.
+	BreakStale bool
 }
 
 // AcquireAtPath attempts to acquire a global lock at a specific lock file path.
 func AcquireAtPath(lockPath string) (*GlobalLock, error) {
+	return AcquireAtPathWithOpts(lockPath, AcquireOpts{})
+}
+
+// AcquireWithOpts is like Acquire, but allows breaking stale locks.
+func AcquireWithOpts(appName string, opts AcquireOpts) (*GlobalLock, error) {
+	return AcquireAtPathWithOpts(LockPath(appName), opts)
+}
+
+// AcquireAtPathWithOpts is like AcquireAtPath, but allows breaking stale
+// locks. A lock is stale if it is held but the process recorded in the lock
+// file no longer exists. Locks held by a live process are never broken.
+func AcquireAtPathWithOpts(lockPath string, opts AcquireOpts) (*GlobalLock, error) {
+	lock, err := tryAcquire(lockPath)
+	if !errors.Is(err, ErrLockHeld) {
+		return lock, err
+	}
+
+	info, inspectErr := InspectAtPath(lockPath)
+	if inspectErr != nil {
+		slog.Warn("Failed to inspect held lock", "path", lockPath, "error", inspectErr)
+		return nil, err
+	}
+
+	if info.PID == 0 || info.Alive {
+		return nil, &errclass.LockError{
+			Path: lockPath,
+			Err:  fmt.Errorf("%w (pid %d, started %s, command %q)", ErrLockHeld, info.PID, info.Start.Format(time.RFC3339), info.Command),
+		}
+	}
+
+	if !opts.BreakStale {
+		return nil, &errclass.LockError{
+			Path: lockPath,
+			Err:  fmt.Errorf("%w (pid %d, started %s, command %q)", ErrStaleLock, info.PID, info.Start.Format(time.RFC3339), info.Command),
+		}
+	}
+
+	slog.Warn("Breaking stale lock. The process that held it no longer exists.",
+		"audit", true,
+		"path", lockPath,
+		"stale_pid", info.PID,
+		"stale_start", info.Start,
+		"stale_command", info.Command,
+		"pid", os.Getpid(),
+		"uid", os.Getuid(),
+	)
+
+	// Unlinking the file lets us lock a fresh inode at the same path. Whatever
+	// still references the old inode keeps a lock nobody else will look at.
+	if err := os.Remove(lockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, &errclass.LockError{Path: lockPath, Err: fmt.Errorf("remove stale lock file: %w", err)}
+	}
+
+	return tryAcquire(lockPath)
+}
+
+func tryAcquire(lockPath string) (*GlobalLock, error) {
 	if err := os.MkdirAll(filepath.Dir(lockPath), 0o755); err != nil {
-		return nil, fmt.Errorf("create lock dir: %w", err)
+		return nil, &errclass.LockError{Path: lockPath, Err: fmt.Errorf("create lock dir: %w", err)}
 	}
 
 	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
 	if err != nil {
-		return nil, fmt.Errorf("open lock file: %w", err)
+		return nil, &errclass.LockError{Path: lockPath, Err: fmt.Errorf("open lock file: %w", err)}
 	}
 
 	// Try to acquire exclusive non-blocking lock
 	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
 		_ = f.Close()
-		return nil, fmt.Errorf("another instance appears to be running (lock held at %s)", lockPath)
+		return nil, &errclass.LockError{Path: lockPath, Err: ErrLockHeld}
 	}
 
-	// Write some metadata (pid, start time) for observability. Best-effort.
+	// Write some metadata (pid, start time, command) for observability. Best-effort.
 	_ = f.Truncate(0)
-	_, _ = f.WriteAt([]byte(fmt.Sprintf("pid=%d\nstart=%s\n", os.Getpid(), time.Now().Format(time.RFC3339))), 0)
+	_, _ = f.WriteAt([]byte(formatLockMetadata(os.Getpid(), time.Now(), strings.Join(os.Args, " "))), 0)
 	_ = f.Sync()
 
 	slog.Debug("Acquired global process lock", "path", lockPath)
@@ -0,0 +1,125 @@
+//go:build !windows
+
+package glock
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"golang.org/x/sys/unix"
+)
+
+func TestInspectAtPath(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "test.lock")
+
+	info, err := InspectAtPath(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Exists || info.Held {
+		t.Fatalf("expected no lock, got %+v", info)
+	}
+
+	lock, err := AcquireAtPath(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err = InspectAtPath(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !info.Exists || !info.Held || !info.Alive {
+		t.Fatalf("expected a held lock owned by a live process, got %+v", info)
+	}
+	if info.PID != os.Getpid() {
+		t.Fatalf("pid = %d, want %d", info.PID, os.Getpid())
+	}
+	if info.Start.IsZero() || info.Command == "" {
+		t.Fatalf("expected start time and command, got %+v", info)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err = InspectAtPath(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Exists {
+		t.Fatalf("expected lock file to be removed, got %+v", info)
+	}
+}
+
+// holdLockAs locks lockPath through a separate file description and records
+// pid as the owner, simulating another process holding the lock.
+func holdLockAs(t *testing.T, lockPath string, pid int) {
+	t.Helper()
+
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.WriteString(formatLockMetadata(pid, time.Now(), "zfsbackrest backup")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func deadPID(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("can't spawn a process: %v", err)
+	}
+
+	return cmd.ProcessState.Pid()
+}
+
+func TestAcquireStaleLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "test.lock")
+	holdLockAs(t, lockPath, deadPID(t))
+
+	_, err := AcquireAtPath(lockPath)
+	if !errors.Is(err, ErrStaleLock) {
+		t.Fatalf("expected ErrStaleLock, got %v", err)
+	}
+	if !errors.Is(err, errclass.ErrLock) {
+		t.Fatalf("expected a lock error, got %v", err)
+	}
+
+	lock, err := AcquireAtPathWithOpts(lockPath, AcquireOpts{BreakStale: true})
+	if err != nil {
+		t.Fatalf("expected to break the stale lock, got %v", err)
+	}
+	defer lock.Release()
+
+	info, err := InspectAtPath(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.PID != os.Getpid() || !info.Held {
+		t.Fatalf("expected the lock to be ours, got %+v", info)
+	}
+}
+
+func TestAcquireNeverBreaksLiveLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "test.lock")
+	holdLockAs(t, lockPath, os.Getpid())
+
+	_, err := AcquireAtPathWithOpts(lockPath, AcquireOpts{BreakStale: true})
+	if !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+}
@@ -11,6 +11,9 @@ import (
 type CommandGuardOpts struct {
 	NeedsRoot       bool
 	NeedsGlobalLock bool
+	// BreakStaleLock takes over the global lock if the process holding it no
+	// longer exists.
+	BreakStaleLock bool
 }
 
 type CommandGuard struct {
@@ -28,9 +31,16 @@ func NewCommandGuard(opts CommandGuardOpts) (*CommandGuard, error) {
 		slog.Debug("Acquiring global process lock")
 
 		var err error
-		lock, err = glock.Acquire("zfsbackrest")
+		lock, err = glock.AcquireWithOpts("zfsbackrest", glock.AcquireOpts{BreakStale: opts.BreakStaleLock})
 		if err != nil {
-			slog.Error("Failed to acquire global lock", "error", err)
+			switch {
+			case errors.Is(err, glock.ErrStaleLock):
+				slog.Error("Failed to acquire global lock. The process holding it no longer exists. Use --break-lock to take it over.", "error", err)
+			case errors.Is(err, glock.ErrLockHeld):
+				slog.Error("Failed to acquire global lock. Run `zfsbackrest lock status` to see who holds it.", "error", err)
+			default:
+				slog.Error("Failed to acquire global lock", "error", err)
+			}
 			return nil, err
 		}
 	}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// NewBandwidthLimiter returns a limiter for bytesPerSecond, to be shared by
+// every reader that counts towards the same cap. It returns nil, meaning
+// unlimited, if bytesPerSecond is 0.
+func NewBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+}
+
+// LimitedReader throttles reads to the rate of a shared limiter.
+type LimitedReader struct {
+	ctx        context.Context
+	underlying io.ReadCloser
+	limiter    *rate.Limiter
+}
+
+// NewLimitedReader throttles underlying with limiter. A nil limiter doesn't
+// throttle.
+func NewLimitedReader(ctx context.Context, underlying io.ReadCloser, limiter *rate.Limiter) *LimitedReader {
+	return &LimitedReader{ctx: ctx, underlying: underlying, limiter: limiter}
+}
+
+func (r *LimitedReader) Read(p []byte) (int, error) {
+	if r.limiter == nil {
+		return r.underlying.Read(p)
+	}
+
+	// Never ask the limiter for more than it can hand out at once.
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+
+	n, err := r.underlying.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+func (r *LimitedReader) Close() error {
+	return r.underlying.Close()
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// maxSampledMessages caps the messages the sampler keeps counts for. Messages
+// are mostly constant strings, but don't grow without bound if they aren't.
+const maxSampledMessages = 4096
+
+// LogOptions configures the levels and sampling of a LogHandler.
+type LogOptions struct {
+	Level slog.Level
+	// Levels overrides Level for subsystems, the last element of the path of
+	// the package a log line comes from, e.g. "storage".
+	Levels   map[string]slog.Level
+	Sampling config.LogSampling
+}
+
+// ParseLogConfig parses the log configuration. debug is the top level debug
+// option, which the log level defaults to.
+func ParseLogConfig(cfg *config.Log, debug bool) (LogOptions, error) {
+	opts := LogOptions{Level: slog.LevelInfo, Sampling: cfg.Sampling}
+	if debug {
+		opts.Level = slog.LevelDebug
+	}
+
+	if cfg.Level != "" {
+		if err := opts.Level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return LogOptions{}, &errclass.ConfigError{Key: "log.level", Err: err}
+		}
+	}
+
+	opts.Levels = make(map[string]slog.Level, len(cfg.Levels))
+	for subsystem, level := range cfg.Levels {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return LogOptions{}, &errclass.ConfigError{Key: "log.levels." + subsystem, Err: err}
+		}
+		opts.Levels[strings.ToLower(subsystem)] = l
+	}
+
+	if cfg.Sampling.Initial < 0 || cfg.Sampling.Thereafter < 0 {
+		return LogOptions{}, &errclass.ConfigError{Key: "log.sampling", Err: fmt.Errorf("initial and thereafter can't be negative")}
+	}
+
+	return opts, nil
+}
+
+// MinLevel is the lowest level any subsystem logs at.
+func (o LogOptions) MinLevel() slog.Level {
+	level := o.Level
+	for _, l := range o.Levels {
+		level = min(level, l)
+	}
+	return level
+}
+
+// LogHandler filters the records of a handler by the level of the subsystem
+// they come from, and samples frequent messages.
+type LogHandler struct {
+	handler slog.Handler
+	opts    LogOptions
+	minimum slog.Level
+	sampler *logSampler
+}
+
+// NewLogHandler wraps handler, which should accept records at opts.MinLevel().
+func NewLogHandler(handler slog.Handler, opts LogOptions) *LogHandler {
+	var sampler *logSampler
+	if opts.Sampling.Interval > 0 {
+		sampler = &logSampler{cfg: opts.Sampling, counts: map[sampleKey]*sampleCount{}}
+	}
+
+	return &LogHandler{
+		handler: handler,
+		opts:    opts,
+		minimum: opts.MinLevel(),
+		sampler: sampler,
+	}
+}
+
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	// The subsystem is only known once there is a record.
+	return level >= h.minimum && h.handler.Enabled(ctx, level)
+}
+
+func (h *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	level, ok := h.opts.Levels[subsystem(record.PC)]
+	if !ok {
+		level = h.opts.Level
+	}
+	if record.Level < level {
+		return nil
+	}
+
+	if h.sampler != nil && record.Level < slog.LevelWarn {
+		keep, dropped := h.sampler.sample(record.Level, record.Message, record.Time)
+		if !keep {
+			return nil
+		}
+		if dropped > 0 {
+			record = record.Clone()
+			record.AddAttrs(slog.Int("sampled_dropped", dropped))
+		}
+	}
+
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.handler = h.handler.WithAttrs(attrs)
+	return &clone
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.handler = h.handler.WithGroup(name)
+	return &clone
+}
+
+// subsystem is the last element of the path of the package the function at pc
+// is in, e.g. "storage" for
+// github.com/gargakshit/zfsbackrest/storage.(*swiftSegmentWriter).Write.
+func subsystem(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := frame.Function
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+type sampleCount struct {
+	start   time.Time
+	n       int
+	dropped int
+}
+
+// logSampler logs the first Initial records of every message in an interval,
+// and every Thereafter-th after them.
+type logSampler struct {
+	cfg config.LogSampling
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+// sample reports whether to keep a record, and how many records of the message
+// were dropped since the last one kept.
+func (s *logSampler) sample(level slog.Level, message string, now time.Time) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sampleKey{level: level, message: message}
+	count, ok := s.counts[key]
+	if !ok {
+		if len(s.counts) >= maxSampledMessages {
+			clear(s.counts)
+		}
+		count = &sampleCount{start: now}
+		s.counts[key] = count
+	}
+
+	if now.Sub(count.start) >= s.cfg.Interval {
+		count.start = now
+		count.n = 0
+	}
+
+	count.n++
+	if count.n <= s.cfg.Initial ||
+		s.cfg.Thereafter > 0 && (count.n-s.cfg.Initial)%s.cfg.Thereafter == 0 {
+		dropped := count.dropped
+		count.dropped = 0
+		return true, dropped
+	}
+
+	count.dropped++
+	return false, 0
+}
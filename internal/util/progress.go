@@ -0,0 +1,263 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/config"
+	"golang.org/x/sys/unix"
+)
+
+// Progress is reported either as a live bar on the terminal, or as periodic
+// log lines when running under systemd/cron where a bar would only flood the
+// journal.
+
+const (
+	defaultProgressLogInterval = time.Minute
+	progressRenderInterval     = 200 * time.Millisecond
+)
+
+var progressSettings = struct {
+	sync.RWMutex
+	bars        bool
+	logInterval time.Duration
+}{
+	logInterval: defaultProgressLogInterval,
+}
+
+// ConfigureProgress sets how transfer progress is reported. isTerminal should
+// indicate whether stderr is attached to a terminal.
+func ConfigureProgress(cfg *config.Progress, isTerminal bool) {
+	progressSettings.Lock()
+	defer progressSettings.Unlock()
+
+	switch cfg.Mode {
+	case config.ProgressModeBar:
+		progressSettings.bars = true
+	case config.ProgressModeLog:
+		progressSettings.bars = false
+	default:
+		progressSettings.bars = isTerminal
+	}
+
+	progressSettings.logInterval = cfg.LogInterval
+	if progressSettings.logInterval <= 0 {
+		progressSettings.logInterval = defaultProgressLogInterval
+	}
+
+	slog.Debug("Configured progress reporting", "bars", progressSettings.bars, "logInterval", progressSettings.logInterval)
+}
+
+// Stderr is a progress-aware stderr. Anything written through it (usually log
+// lines) is printed above the live progress bar instead of garbling it.
+var Stderr io.Writer = board
+
+var board = &progressBoard{out: os.Stderr}
+
+type progressTracker struct {
+	tag      string
+	verb     string
+	expected int64
+	total    atomic.Int64
+	started  time.Time
+	bars     bool
+	interval time.Duration
+	lastLog  time.Time
+}
+
+func newProgressTracker(tag string, verb string, expected int64) *progressTracker {
+	progressSettings.RLock()
+	defer progressSettings.RUnlock()
+
+	t := &progressTracker{
+		tag:      tag,
+		verb:     verb,
+		expected: expected,
+		started:  time.Now(),
+		bars:     progressSettings.bars,
+		interval: progressSettings.logInterval,
+	}
+	t.lastLog = t.started
+
+	if t.bars {
+		board.add(t)
+	}
+
+	return t
+}
+
+// add records n transferred bytes. It must only be called from one goroutine.
+func (t *progressTracker) add(n int) {
+	total := t.total.Add(int64(n))
+
+	if t.bars {
+		board.render(false)
+		return
+	}
+
+	if time.Since(t.lastLog) < t.interval {
+		return
+	}
+
+	t.lastLog = time.Now()
+	if t.expected > 0 {
+		slog.Info(t.verb,
+			"tag", t.tag,
+			"total", total,
+			"expected", t.expected,
+			"progress", float64(total)/float64(t.expected),
+			"rate", t.rate(total),
+		)
+	} else {
+		slog.Info(t.verb,
+			"tag", t.tag,
+			"total", total,
+			"rate", t.rate(total),
+		)
+	}
+}
+
+func (t *progressTracker) done() {
+	total := t.total.Load()
+	if t.bars {
+		board.remove(t)
+	}
+
+	slog.Info(t.verb+" finished",
+		"tag", t.tag,
+		"total", total,
+		"elapsed", time.Since(t.started).Round(time.Second),
+		"rate", t.rate(total),
+	)
+}
+
+func (t *progressTracker) rate(total int64) string {
+	elapsed := time.Since(t.started).Seconds()
+	if elapsed <= 0 {
+		return "0 B/s"
+	}
+
+	return humanize.Bytes(uint64(float64(total)/elapsed)) + "/s"
+}
+
+func (t *progressTracker) line(width int) string {
+	total := t.total.Load()
+	stats := fmt.Sprintf("%s %s", humanize.Bytes(uint64(total)), t.rate(total))
+	if t.expected <= 0 {
+		return fmt.Sprintf("%s %s", t.tag, stats)
+	}
+
+	fraction := min(float64(total)/float64(t.expected), 1)
+	stats = fmt.Sprintf("%3.0f%% %s/%s %s",
+		fraction*100,
+		humanize.Bytes(uint64(total)),
+		humanize.Bytes(uint64(t.expected)),
+		t.rate(total),
+	)
+
+	barWidth := width - len(t.tag) - len(stats) - 4
+	if barWidth < 10 {
+		return fmt.Sprintf("%s %s", t.tag, stats)
+	}
+
+	filled := int(fraction * float64(barWidth))
+	return fmt.Sprintf("%s [%s%s] %s", t.tag, strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), stats)
+}
+
+// progressBoard draws all active trackers on the last line of the terminal.
+type progressBoard struct {
+	mu         sync.Mutex
+	out        io.Writer
+	trackers   []*progressTracker
+	drawn      bool
+	lastRender time.Time
+}
+
+func (b *progressBoard) add(t *progressTracker) {
+	b.mu.Lock()
+	b.trackers = append(b.trackers, t)
+	b.mu.Unlock()
+
+	b.render(true)
+}
+
+func (b *progressBoard) remove(t *progressTracker) {
+	b.mu.Lock()
+	for i, tracker := range b.trackers {
+		if tracker == t {
+			b.trackers = append(b.trackers[:i], b.trackers[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	b.render(true)
+}
+
+func (b *progressBoard) render(force bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !force && time.Since(b.lastRender) < progressRenderInterval {
+		return
+	}
+
+	b.lastRender = time.Now()
+	b.clearLocked()
+	b.drawLocked()
+}
+
+func (b *progressBoard) clearLocked() {
+	if b.drawn {
+		fmt.Fprint(b.out, "\r\033[K")
+		b.drawn = false
+	}
+}
+
+func (b *progressBoard) drawLocked() {
+	if len(b.trackers) == 0 {
+		return
+	}
+
+	width := terminalWidth()
+	perTracker := width / len(b.trackers)
+	lines := make([]string, len(b.trackers))
+	for i, t := range b.trackers {
+		lines[i] = t.line(perTracker - 3)
+	}
+
+	line := strings.Join(lines, " | ")
+	if len(line) > width-1 {
+		line = line[:width-1]
+	}
+
+	fmt.Fprint(b.out, line)
+	b.drawn = true
+}
+
+func (b *progressBoard) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clearLocked()
+	n, err := b.out.Write(p)
+	b.drawLocked()
+
+	return n, err
+}
+
+func terminalWidth() int {
+	ws, err := unix.IoctlGetWinsize(int(os.Stderr.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		return 80
+	}
+
+	return int(ws.Col)
+}
@@ -2,17 +2,27 @@ package zfsbackrest
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log/slog"
 	"time"
 
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/gargakshit/zfsbackrest/fsm"
 	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/zfs"
 	"github.com/oklog/ulid/v2"
 	"github.com/sourcegraph/conc/pool"
 )
 
+var ErrParentSnapshotReplaced = errors.New("snapshot of the parent backup is not the snapshot that was backed up")
+
 type BackupState string
 type BackupAction string
 
@@ -24,36 +34,65 @@ const (
 	BackupStateCreatedBackupManifest BackupState = "created_backup_manifest"
 	BackupStateAddedOrphan           BackupState = "added_orphan"
 	BackupStateUploadedSnapshot      BackupState = "uploaded_snapshot"
+	BackupStateUploadedManifest      BackupState = "uploaded_manifest"
 	BackupStateUpdatedStore          BackupState = "updated_store"
 	BackupStateCompleted             BackupState = "completed"
 )
 
+// BackupFSMData is the state of a backup in progress. Spooled backups persist
+// it, to be resumed later.
 type BackupFSMData struct {
-	Dataset      string
-	BackupID     ulid.ULID
-	BackupType   repository.BackupType
-	ParentBackup *repository.Backup
-	Manifest     *repository.Backup
-	SnapshotSize int64
+	Dataset      string                `json:"dataset"`
+	BackupID     ulid.ULID             `json:"backup_id"`
+	BackupType   repository.BackupType `json:"backup_type"`
+	ParentBackup *repository.Backup    `json:"parent_backup,omitempty"`
+	Manifest     *repository.Backup    `json:"manifest"`
+	SnapshotSize int64                 `json:"snapshot_size"`
+	Checksum     string                `json:"checksum"`
+	// ObjectChecksum and ObjectSize describe the snapshot object as it was
+	// uploaded, after encryption.
+	ObjectChecksum string `json:"object_checksum,omitempty"`
+	ObjectSize     int64  `json:"object_size,omitempty"`
+	// SpillPath is the encrypted snapshot spilled to disk, while it is being
+	// uploaded.
+	SpillPath string `json:"spill_path,omitempty"`
+	// EstimatedSize is the size `zfs send` estimates for the snapshot, if it
+	// was asked for.
+	EstimatedSize *int64 `json:"estimated_size,omitempty"`
+	// Tags and Note are what the backup is labelled with.
+	Tags map[string]string `json:"tags,omitempty"`
+	Note string            `json:"note,omitempty"`
+
+	progress      *checkpointer
+	uploadStarted bool
+}
+
+// BackupLabels are what the backups of a run are labelled with, to tell them
+// apart later. Both are optional.
+type BackupLabels struct {
+	Tags map[string]string
+	Note string
 }
 
-func (r *Runner) BackupAllManaged(ctx context.Context, concurrency *config.UploadConcurrency, typ repository.BackupType) error {
+// BackupAllManaged backs up every managed dataset.
+func (r *Runner) BackupAllManaged(ctx context.Context, concurrency *config.UploadConcurrency, typ repository.BackupType, labels BackupLabels) error {
 	datasets := r.Store.ManagedDatasets
 	slog.Info("Backing up managed datasets", "datasets", datasets)
-	return r.BackupConcurrent(ctx, concurrency, typ, datasets...)
+	return r.BackupConcurrent(ctx, concurrency, typ, labels, datasets...)
 }
 
 func (r *Runner) BackupConcurrent(
 	ctx context.Context,
 	concurrency *config.UploadConcurrency,
 	typ repository.BackupType,
+	labels BackupLabels,
 	datasets ...string,
 ) error {
-	slog.Debug("Creating backup FSMs", "datasets", datasets)
+	slog.Debug("Creating backup FSMs", "datasets", datasets, "labels", labels)
 	fsms := make([]*fsm.FSM[BackupState, BackupAction, BackupFSMData], len(datasets))
 	for i, dataset := range datasets {
 		var err error
-		fsms[i], err = r.createBackupFSM(ctx, typ, dataset)
+		fsms[i], err = r.createBackupFSM(ctx, typ, labels, dataset)
 		if err != nil {
 			slog.Error("Failed to create backup FSM", "dataset", dataset, "error", err)
 			return fmt.Errorf("failed to create backup FSM: %w", err)
@@ -62,6 +101,14 @@ func (r *Runner) BackupConcurrent(
 
 	// By this step, we ensured that all datasets exist.
 
+	// Checkpoints are removed as backups complete. Don't leave the ones of
+	// failed backups behind.
+	defer func() {
+		for _, fsm := range fsms {
+			fsm.CurrentState().Data.progress.remove()
+		}
+	}()
+
 	// We run everything sequentially, other than uploads, which are concurrent.
 	slog.Debug("Running backup FSMs sequentially",
 		"datasets", datasets,
@@ -93,6 +140,16 @@ func (r *Runner) BackupConcurrent(
 	// Upload concurrently.
 	slog.Info("Uploading snapshots concurrently", "max_concurrency", maxConcurrency)
 	pool := pool.New().WithMaxGoroutines(maxConcurrency).WithErrors().WithContext(ctx)
+	// Spill files are removed once uploaded. Don't leave the ones of failed
+	// uploads behind, unless they are spooled to be resumed.
+	defer func() {
+		if r.spooling() {
+			return
+		}
+		for _, fsm := range fsms {
+			r.removeSpill(fsm.CurrentState().Data)
+		}
+	}()
 	for _, fsm := range fsms {
 		fsm := fsm
 		pool.Go(func(ctx context.Context) error {
@@ -103,13 +160,17 @@ func (r *Runner) BackupConcurrent(
 	err := pool.Wait()
 	if err != nil {
 		slog.Error("Failed to upload snapshots", "error", err)
+		if ctx.Err() != nil {
+			r.recordPartialUploads(ctx, fsms)
+		}
 		return fmt.Errorf("failed to upload snapshots: %w", err)
 	}
 
-	// Update store and complete.
-	slog.Debug("Running backup FSMs sequentially", "actions", []BackupAction{"update_store", "complete"})
+	// Upload manifests, update store and complete.
+	slog.Debug("Running backup FSMs sequentially", "actions", []BackupAction{"upload_manifest", "update_store", "complete"})
 	for _, fsm := range fsms {
 		err := fsm.RunSequence(ctx,
+			"upload_manifest",
 			"update_store",
 			"complete",
 		)
@@ -123,7 +184,7 @@ func (r *Runner) BackupConcurrent(
 	return nil
 }
 
-func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType, dataset string) (*fsm.FSM[BackupState, BackupAction, BackupFSMData], error) {
+func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType, labels BackupLabels, dataset string) (*fsm.FSM[BackupState, BackupAction, BackupFSMData], error) {
 	id := ulid.Make()
 	slog.Debug("Creating backup FSM", "type", typ, "dataset", dataset, "id", id)
 
@@ -136,20 +197,32 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 
 	if !exists {
 		slog.Error("Dataset does not exist", "dataset", dataset)
-		return nil, fmt.Errorf("dataset does not exist: %s", dataset)
+		return nil, &errclass.ValidationError{Subject: "dataset", Err: fmt.Errorf("dataset does not exist: %s", dataset)}
 	}
 
-	fsm := fsm.NewFSM(
+	data := &BackupFSMData{
+		Dataset:      dataset,
+		BackupID:     id,
+		BackupType:   typ,
+		ParentBackup: nil,
+		Tags:         labels.Tags,
+		Note:         labels.Note,
+	}
+	data.progress = r.newCheckpointer(data)
+	data.progress.phase(PhasePreparing, 0)
+
+	return r.newBackupFSM(fsm.State[BackupState, BackupFSMData]{
+		ID:   BackupStateInitial,
+		Data: data,
+	}), nil
+}
+
+// newBackupFSM creates a backup FSM starting from state. Backups start from
+// the initial state, and spooled ones are resumed from where they stopped.
+func (r *Runner) newBackupFSM(state fsm.State[BackupState, BackupFSMData]) *fsm.FSM[BackupState, BackupAction, BackupFSMData] {
+	return fsm.NewFSM(
 		"backup",
-		fsm.State[BackupState, BackupFSMData]{
-			ID: BackupStateInitial,
-			Data: &BackupFSMData{
-				Dataset:      dataset,
-				BackupID:     id,
-				BackupType:   typ,
-				ParentBackup: nil,
-			},
-		},
+		state,
 		map[BackupAction]fsm.Transition[BackupState, BackupFSMData]{
 			"get_parent": {
 				From: BackupStateInitial,
@@ -157,7 +230,11 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 				Run: func(ctx context.Context, data *BackupFSMData) error {
 					slog.Debug("Getting parent backup", "dataset", data.Dataset, "backup_type", data.BackupType)
 
-					parent, err := r.Store.Backups.GetParent(data.Dataset, data.BackupType)
+					var parent *repository.Backup
+					var err error
+					r.Store.View(func() {
+						parent, err = r.Store.Backups.GetParent(data.Dataset, data.BackupType)
+					})
 					if err != nil {
 						slog.Error("Failed to get parent backup", "error", err)
 						return fsm.NewUnrecoverableError(fmt.Errorf("failed to get parent backup: %w", err))
@@ -171,6 +248,14 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 						return nil
 					}
 
+					if parent.Imported != nil {
+						slog.Error("Parent backup was imported", "dataset", data.Dataset, "parent", parent, "snapshot", parent.Imported.Snapshot)
+						return fsm.NewUnrecoverableError(&errclass.ValidationError{
+							Subject: "backup " + parent.ID.String(),
+							Err:     fmt.Errorf("parent backup was imported from snapshot %s, which backups can't be taken from. Take a full backup first", parent.Imported.Snapshot),
+						})
+					}
+
 					slog.Debug("Checking if snapshot for parent exists", "dataset", data.Dataset, "parent", parent)
 					exists, err := r.ZFS.SnapshotExists(ctx, data.Dataset, parent.ID)
 					if err != nil {
@@ -241,10 +326,19 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 					slog.Debug("Creating backup manifest", "dataset", data.Dataset)
 
 					manifest := repository.Backup{
-						ID:        data.BackupID,
-						Type:      data.BackupType,
-						CreatedAt: time.Now(),
-						Dataset:   data.Dataset,
+						ID:                data.BackupID,
+						Type:              data.BackupType,
+						CreatedAt:         time.Now(),
+						Dataset:           data.Dataset,
+						Recipient:         r.Store.Encryption.Age.RecipientPublicKey,
+						RecoveryRecipient: r.Store.Encryption.Age.RecoveryRecipientPublicKey,
+						Tags:              data.Tags,
+						Note:              data.Note,
+					}
+					manifest.NewFormat(&r.Store.Encryption, r.Config.Repository.Compression.Algorithm)
+					if route := r.routeFor(data.Dataset); route != nil {
+						slog.Debug("Routing backup", "dataset", data.Dataset, "route", route.Name)
+						manifest.Route = route.Name
 					}
 
 					// Sanity checks.
@@ -262,6 +356,23 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 						manifest.DependsOn = &data.ParentBackup.ID
 					}
 
+					if r.Config.ZFS.SendIntermediates && data.ParentBackup != nil {
+						intermediates, err := r.intermediates(ctx, data.Dataset, data.ParentBackup.ID, data.BackupID)
+						if err != nil {
+							return err
+						}
+						manifest.Intermediates = intermediates
+					}
+
+					send, err := r.sendStream(ctx, data.Dataset, data.ParentBackup)
+					if err != nil {
+						return err
+					}
+					manifest.Send = send
+
+					manifest.Space = r.snapshotSpace(ctx, data.Dataset, data.BackupID)
+					manifest.Origin = r.origin(ctx, data.Dataset)
+
 					data.Manifest = &manifest
 					slog.Info("Created backup manifest", "manifest", data.Manifest)
 
@@ -290,44 +401,150 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 				},
 			},
 			"upload_snapshot": {
-				From: BackupStateAddedOrphan,
-				To:   BackupStateUploadedSnapshot,
+				From:          BackupStateAddedOrphan,
+				To:            BackupStateUploadedSnapshot,
+				RetryStrategy: r.uploadRetryStrategy(),
 				Run: func(ctx context.Context, data *BackupFSMData) error {
 					slog.Debug("Uploading snapshot", "dataset", data.Dataset)
+					data.uploadStarted = true
+
+					ctx = storage.WithSnapshotMetadata(ctx, data.Manifest.ObjectMetadata(storage.ObjectKindSnapshot, r.Encryption))
+
+					var parentID *ulid.ULID
+					if data.ParentBackup != nil {
+						parentID = &data.ParentBackup.ID
+					}
+
+					spill := r.spillDir() != ""
+					if spill && r.spooling() && data.SpillPath == "" {
+						var err error
+						spill, err = r.shouldSpool(ctx, data, parentID)
+						if err != nil {
+							return err
+						}
+					}
 
-					writeStream, err := r.Storage.OpenSnapshotWriteStream(
-						ctx,
-						data.Dataset,
-						data.Manifest.ID.String(),
-						-1,
-						r.Encryption,
-					)
+					if spill {
+						// Retries upload the spill file again, rather than
+						// sending the snapshot again.
+						if data.SpillPath == "" {
+							if err := r.spillSnapshot(ctx, data, parentID); err != nil {
+								return err
+							}
+						}
+						return r.uploadSpilled(ctx, data)
+					}
+
+					var expected int64
+					if data.EstimatedSize != nil {
+						expected = *data.EstimatedSize
+					}
+					data.progress.phase(PhaseUploading, expected)
+
+					// Cancelling the upload's context keeps a failed upload
+					// from being committed.
+					uploadCtx, cancelUpload := context.WithCancel(ctx)
+					defer cancelUpload()
+
+					writeStream, err := r.openSnapshotWriteStream(uploadCtx, data, -1)
 					if err != nil {
 						slog.Error("Failed to open snapshot write stream", "error", err)
 						return fmt.Errorf("failed to open snapshot write stream: %w", err)
 					}
 
-					var parentID *ulid.ULID
-					if data.ParentBackup != nil {
-						parentID = &data.ParentBackup.ID
+					snapshotEncryption, err := r.snapshotEncryption(data.Manifest)
+					if err != nil {
+						cancelUpload()
+						_ = writeStream.Close()
+						return fsm.NewUnrecoverableError(err)
 					}
 
-					size, err := r.ZFS.SendSnapshot(ctx, data.Dataset, data.Manifest.ID, parentID, writeStream)
+					objectStream := &checksumWriteCloser{WriteCloser: writeStream, hash: sha256.New()}
+					encStream, err := snapshotEncryption.EncryptedWriter(objectStream)
+					if err != nil {
+						cancelUpload()
+						_ = writeStream.Close()
+						return fsm.NewUnrecoverableError(&errclass.EncryptionError{Op: "encrypt", Err: err})
+					}
+
+					checksumStream := &checksumWriteCloser{
+						WriteCloser: &checkpointWriteCloser{
+							WriteCloser: &encryptingWriteCloser{enc: encStream, object: objectStream, abort: cancelUpload},
+							progress:    data.progress,
+						},
+						hash: sha256.New(),
+					}
+					size, err := r.ZFS.SendSnapshot(ctx, data.Dataset, data.Manifest.ID, parentID, checksumStream, sendOptions(data.Manifest))
 					if err != nil {
 						slog.Error("Failed to send snapshot", "error", err)
 						return fmt.Errorf("failed to send snapshot: %w", err)
 					}
 
 					data.SnapshotSize = size
+					data.Checksum = hex.EncodeToString(checksumStream.hash.Sum(nil))
+					data.ObjectSize = objectStream.size
+					data.ObjectChecksum = hex.EncodeToString(objectStream.hash.Sum(nil))
 
 					return nil
 				},
 			},
-			"update_store": {
+			"upload_manifest": {
 				From: BackupStateUploadedSnapshot,
+				To:   BackupStateUploadedManifest,
+				Run: func(ctx context.Context, data *BackupFSMData) error {
+					slog.Debug("Uploading manifest", "dataset", data.Dataset, "backup", data.Manifest.ID)
+					data.progress.phase(PhaseManifest, 0)
+
+					// Record the snapshot's GUID, so restores can check they
+					// received the snapshot that was backed up. Imports
+					// recorded it when they listed the snapshot.
+					guid := data.Manifest.GUID
+					if data.Manifest.Imported == nil {
+						var err error
+						guid, err = r.ZFS.SnapshotGUID(ctx, data.Dataset, data.Manifest.ID)
+						if err != nil {
+							slog.Error("Failed to get snapshot GUID", "error", err)
+							return fmt.Errorf("failed to get snapshot GUID: %w", err)
+						}
+					}
+
+					// Update manifest with the snapshot size, checksums and GUID.
+					data.Manifest.Size = data.SnapshotSize
+					data.Manifest.Checksum = data.Checksum
+					data.Manifest.ObjectChecksum = data.ObjectChecksum
+					data.Manifest.ObjectSize = data.ObjectSize
+					data.Manifest.GUID = guid
+
+					// The lock was set when the upload started, so it ends
+					// before this.
+					snapshotStorage, err := r.snapshotStorage(data.Manifest)
+					if err != nil {
+						return err
+					}
+					if locking, ok := storage.As[storage.LockingStore](snapshotStorage); ok {
+						if retention := locking.SnapshotRetention(); retention > 0 {
+							lockedUntil := time.Now().Add(retention)
+							data.Manifest.LockedUntil = &lockedUntil
+						}
+					}
+
+					r.writeReplicaManifests(ctx, data.Manifest)
+
+					err = repository.WriteManifest(ctx, r.Storage, r.Encryption, data.Manifest)
+					if err != nil {
+						slog.Error("Failed to upload manifest", "error", err)
+						return fmt.Errorf("failed to upload manifest: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"update_store": {
+				From: BackupStateUploadedManifest,
 				To:   BackupStateUpdatedStore,
 				Run: func(ctx context.Context, data *BackupFSMData) error {
 					slog.Debug("Updating store", "dataset", data.Dataset)
+					data.progress.phase(PhaseStore, 0)
 
 					// Remove orphan.
 					slog.Debug("Removing orphan", "backup", data.Manifest)
@@ -337,9 +554,6 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 						return fsm.NewUnrecoverableError(fmt.Errorf("failed to remove orphan: %w", err))
 					}
 
-					// Update manifest with the snapshot size.
-					data.Manifest.Size = data.SnapshotSize
-
 					// Add backup.
 					slog.Debug("Adding backup", "backup", data.Manifest)
 					err = r.Store.AddBackup(ctx, *data.Manifest)
@@ -362,6 +576,8 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 				From: BackupStateUpdatedStore,
 				To:   BackupStateCompleted,
 				Run: func(ctx context.Context, data *BackupFSMData) error {
+					r.removeSpoolManifest(data)
+					data.progress.remove()
 					slog.Info("Backup completed", "dataset", data.Dataset, "backup", data.Manifest)
 					return nil
 				},
@@ -372,7 +588,214 @@ func (r *Runner) createBackupFSM(ctx context.Context, typ repository.BackupType,
 			WaitIncrements: 2 * time.Second,
 			MaxWait:        10 * time.Second,
 		},
+	).WithSafeStates(
+		// A snapshot that was taken but isn't recorded as an orphan yet would be
+		// left dangling.
+		BackupStateInitial,
+		BackupStateGotParent,
+		BackupStateAddedOrphan,
+		BackupStateUploadedSnapshot,
+		BackupStateUploadedManifest,
+		BackupStateUpdatedStore,
+		BackupStateCompleted,
 	)
+}
+
+// checksumWriteCloser hashes and counts everything written through it.
+type checksumWriteCloser struct {
+	io.WriteCloser
+	hash hash.Hash
+	size int64
+}
+
+func (w *checksumWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// encryptingWriteCloser encrypts a snapshot on its way to the storage, which
+// stores it as is. Encrypting it here rather than in the storage lets the
+// object be hashed as it is stored, and gives every replica the same object.
+type encryptingWriteCloser struct {
+	enc    io.WriteCloser
+	object io.WriteCloser
+	// abort cancels the upload, so closing the object doesn't commit it.
+	abort context.CancelFunc
+}
+
+func (w *encryptingWriteCloser) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *encryptingWriteCloser) Close() error {
+	// Close the encryption stream first to flush and finalize. If that fails,
+	// the upload must not be completed, or we'd commit a truncated object.
+	if err := w.enc.Close(); err != nil {
+		w.abort()
+		_ = w.object.Close()
+		return err
+	}
+
+	return w.object.Close()
+}
 
-	return fsm, nil
+// intermediates returns the backups of a dataset between the parent backup
+// and the new one, which a `zfs send -I` stream carries as well. -I sends
+// every snapshot in the range, so if the range holds snapshots zfsbackrest
+// didn't take, or of backups it doesn't know of, there are none, and the
+// backup is sent with -i.
+func (r *Runner) intermediates(ctx context.Context, dataset string, parentID ulid.ULID, id ulid.ULID) ([]ulid.ULID, error) {
+	snapshots, err := r.ZFS.ListSnapshotsByCreation(ctx, dataset)
+	if err != nil {
+		slog.Error("Failed to list snapshots", "dataset", dataset, "error", err)
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var between []*repository.Backup
+	r.Store.View(func() { between = r.Store.Backups.Between(dataset, parentID, id) })
+
+	intermediates, foreign := planIntermediates(snapshots, between, parentID, id)
+	if len(foreign) > 0 {
+		slog.Info("Snapshots between the parent and the backup aren't backups. Sending it without them.",
+			"dataset", dataset,
+			"parent", parentID,
+			"snapshots", foreign,
+		)
+		return nil, nil
+	}
+
+	slog.Debug("Intermediate snapshots", "dataset", dataset, "parent", parentID, "intermediates", intermediates)
+	return intermediates, nil
+}
+
+// planIntermediates returns the backups whose snapshots lie between the
+// snapshots of the parent backup and the new one, in the order snapshots
+// lists them, and the names of the snapshots in between that aren't of any
+// of the backups between them.
+func planIntermediates(snapshots []zfs.Snapshot, between []*repository.Backup, parentID ulid.ULID, id ulid.ULID) ([]ulid.ULID, []string) {
+	backups := make(map[string]ulid.ULID, len(between))
+	for _, backup := range between {
+		backups[zfs.SnapshotName(backup.ID)] = backup.ID
+	}
+
+	var intermediates []ulid.ULID
+	var foreign []string
+	inRange := false
+	for _, snapshot := range snapshots {
+		switch snapshot.Name {
+		case zfs.SnapshotName(parentID):
+			inRange = true
+			continue
+		case zfs.SnapshotName(id):
+			return intermediates, foreign
+		}
+		if !inRange {
+			continue
+		}
+
+		if backupID, ok := backups[snapshot.Name]; ok {
+			intermediates = append(intermediates, backupID)
+		} else {
+			foreign = append(foreign, snapshot.Name)
+		}
+	}
+
+	// The new snapshot wasn't listed after the parent's, so -I can't be used.
+	return nil, nil
+}
+
+// sendOptions returns how the snapshot of a backup is sent. Backups with
+// intermediates are sent with `zfs send -I`, the others with -i. Imported
+// backups are sent from the snapshots they were imported from.
+func sendOptions(manifest *repository.Backup) zfs.SendOptions {
+	opts := zfs.SendOptions{
+		Intermediates: len(manifest.Intermediates) > 0,
+		Raw:           manifest.Send.IsRaw(),
+	}
+	if manifest.Imported != nil {
+		opts.Snapshot = manifest.Imported.Snapshot
+		opts.From = manifest.Imported.From
+	}
+
+	return opts
+}
+
+// sendStream returns how the snapshot of a backup with parent is sent. Full
+// backups are sent raw if zfs.raw_send is set, and the others like their
+// parent, as zfs recv can't apply a raw incremental stream on a snapshot
+// received from a non-raw one. The GUID of the parent's snapshot is recorded
+// as the one the stream is incremental from, once it is checked to be the
+// snapshot the parent backup sent.
+func (r *Runner) sendStream(ctx context.Context, dataset string, parent *repository.Backup) (*repository.SendStream, error) {
+	raw := r.Config.ZFS.RawSend
+	send := &repository.SendStream{LargeBlocks: true, Properties: true}
+
+	if parent != nil {
+		raw = parent.Send.IsRaw()
+		if raw != r.Config.ZFS.RawSend {
+			slog.Debug("Sending the backup like its parent, not as zfs.raw_send says", "dataset", dataset, "parent", parent.ID, "raw", raw)
+		}
+
+		guid, err := r.ZFS.SnapshotGUID(ctx, dataset, parent.ID)
+		if err != nil {
+			slog.Error("Failed to get parent snapshot GUID", "error", err)
+			return nil, fmt.Errorf("failed to get parent snapshot GUID: %w", err)
+		}
+		if parent.GUID != "" && guid != parent.GUID {
+			slog.Error("Parent snapshot is not the one that was backed up", "dataset", dataset, "parent", parent.ID, "guid", guid, "expected", parent.GUID)
+			return nil, fsm.NewUnrecoverableError(&errclass.ValidationError{
+				Subject: "snapshot " + parent.ID.String(),
+				Err:     fmt.Errorf("%w: local GUID %s, backed up %s", ErrParentSnapshotReplaced, guid, parent.GUID),
+			})
+		}
+		send.FromGUID = guid
+	}
+
+	send.Raw = raw
+	send.Compressed = !raw
+	return send, nil
+}
+
+// origin returns the machine the backup of dataset is taken on. It is
+// informational, so it doesn't fail the backup if the pool GUID can't be
+// gotten.
+func (r *Runner) origin(ctx context.Context, dataset string) *repository.Origin {
+	guid, err := r.ZFS.PoolGUID(ctx, dataset)
+	if err != nil {
+		slog.Warn("Failed to get pool GUID. The backup won't record it.", "dataset", dataset, "error", err)
+	}
+
+	return repository.NewOrigin(guid)
+}
+
+// snapshotSpace returns the space usage of the dataset being backed up, and
+// the data written to it since its last backup. It is informational, for the
+// change rate report, so it doesn't fail the backup if it can't be gotten.
+func (r *Runner) snapshotSpace(ctx context.Context, dataset string, id ulid.ULID) *repository.Space {
+	var since *ulid.ULID
+	var latest *repository.Backup
+	r.Store.View(func() { latest = r.Store.Backups.Latest(dataset) })
+	if latest != nil {
+		exists, err := r.ZFS.SnapshotExists(ctx, dataset, latest.ID)
+		if err != nil {
+			slog.Warn("Failed to check if snapshot of the last backup exists", "dataset", dataset, "backup", latest.ID, "error", err)
+		} else if exists {
+			since = &latest.ID
+		}
+	}
+
+	space, err := r.ZFS.SnapshotSpace(ctx, dataset, id, since)
+	if err != nil {
+		slog.Warn("Failed to get space usage of the dataset. The change rate report won't include this backup.", "dataset", dataset, "error", err)
+		return nil
+	}
+
+	recorded := &repository.Space{Used: space.Used, Referenced: space.Referenced}
+	if space.Written != nil {
+		recorded.Written = space.Written
+		recorded.Since = since
+	}
+	return recorded
 }
@@ -0,0 +1,51 @@
+package zfsbackrest
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/zfs"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestPlanIntermediates(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 4*time.Hour)
+	first := b.Diff(full, 3*time.Hour)
+	second := b.Diff(full, 2*time.Hour)
+	id := ulid.Make()
+
+	snapshots := func(names ...string) []zfs.Snapshot {
+		var s []zfs.Snapshot
+		for _, name := range names {
+			s = append(s, zfs.Snapshot{Name: name})
+		}
+		return s
+	}
+	between := []*repository.Backup{first, second}
+
+	intermediates, foreign := planIntermediates(
+		snapshots(zfs.SnapshotName(full.ID), zfs.SnapshotName(first.ID), zfs.SnapshotName(second.ID), zfs.SnapshotName(id)),
+		between, full.ID, id,
+	)
+	if !slices.Equal(intermediates, []ulid.ULID{first.ID, second.ID}) || len(foreign) != 0 {
+		t.Fatalf("expected both diffs as intermediates, got %v and %v", intermediates, foreign)
+	}
+
+	// Snapshots zfsbackrest didn't take would be sent along with -I.
+	_, foreign = planIntermediates(
+		snapshots("autosnap_daily", zfs.SnapshotName(full.ID), zfs.SnapshotName(first.ID), "autosnap_hourly", zfs.SnapshotName(id)),
+		between, full.ID, id,
+	)
+	if !slices.Equal(foreign, []string{"autosnap_hourly"}) {
+		t.Fatalf("expected the snapshot in the range to be foreign, got %v", foreign)
+	}
+
+	// The parent's snapshot is gone.
+	if intermediates, _ := planIntermediates(snapshots(zfs.SnapshotName(first.ID), zfs.SnapshotName(id)), between, full.ID, id); intermediates != nil {
+		t.Fatalf("expected no intermediates without the parent's snapshot, got %v", intermediates)
+	}
+}
@@ -0,0 +1,231 @@
+package zfsbackrest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/glock"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/oklog/ulid/v2"
+)
+
+// checkpointInterval is how often the progress of a transfer is persisted.
+const checkpointInterval = 5 * time.Second
+
+// Backup phases recorded in checkpoints.
+const (
+	PhasePreparing = "preparing"
+	PhaseSpooling  = "spooling"
+	PhaseUploading = "uploading"
+	PhaseManifest  = "manifest"
+	PhaseStore     = "store"
+)
+
+// Checkpoint is the persisted progress of an in-flight backup, so that other
+// processes, like `zfsbackrest status`, can show it.
+type Checkpoint struct {
+	Dataset    string                `json:"dataset"`
+	BackupID   ulid.ULID             `json:"backup_id"`
+	BackupType repository.BackupType `json:"backup_type"`
+	PID        int                   `json:"pid"`
+	Phase      string                `json:"phase"`
+	// Bytes is how much of the snapshot was transferred in the current phase.
+	Bytes int64 `json:"bytes"`
+	// Expected is the size of the transfer, if it is known.
+	Expected int64 `json:"expected,omitempty"`
+	// Chunk is the part or segment of the snapshot object being uploaded.
+	Chunk     int64     `json:"chunk"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Alive is set by ListCheckpoints. It is false if the process writing the
+	// checkpoint is gone, and the checkpoint stale.
+	Alive bool `json:"alive"`
+}
+
+func checkpointDir(stateDir string) string {
+	return filepath.Join(stateDir, "progress")
+}
+
+// checkpointer persists the progress of a backup. It is not safe for
+// concurrent use, and all of its methods are no-ops on a nil checkpointer.
+type checkpointer struct {
+	path       string
+	chunkSize  int64
+	checkpoint Checkpoint
+	lastWrite  time.Time
+	failed     bool
+}
+
+func (r *Runner) newCheckpointer(data *BackupFSMData) *checkpointer {
+	now := time.Now()
+	return &checkpointer{
+		path:      filepath.Join(checkpointDir(r.Config.StateDir), data.BackupID.String()+".json"),
+		chunkSize: chunkSize(&r.Config.Repository),
+		checkpoint: Checkpoint{
+			Dataset:    data.Dataset,
+			BackupID:   data.BackupID,
+			BackupType: data.BackupType,
+			PID:        os.Getpid(),
+			Phase:      PhasePreparing,
+			StartedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+}
+
+// chunkSize is the size of the parts or segments snapshot objects are uploaded
+// in. It is 0 for rclone, which chunks uploads on its own.
+func chunkSize(repoConfig *config.Repository) int64 {
+	switch repoConfig.Backend {
+	case config.BackendSwift:
+		return int64(repoConfig.Swift.SegmentSize)
+	case config.BackendRclone:
+		return 0
+	default:
+		return int64(repoConfig.S3.PartSize)
+	}
+}
+
+// phase starts a phase of expected bytes, 0 if unknown, and persists it right
+// away.
+func (c *checkpointer) phase(phase string, expected int64) {
+	if c == nil {
+		return
+	}
+
+	c.checkpoint.Phase = phase
+	c.checkpoint.Bytes = 0
+	c.checkpoint.Expected = expected
+	c.checkpoint.Chunk = 0
+	c.write()
+}
+
+// add records n transferred bytes, and persists them every
+// checkpointInterval.
+func (c *checkpointer) add(n int) {
+	if c == nil {
+		return
+	}
+
+	c.checkpoint.Bytes += int64(n)
+	if c.chunkSize > 0 {
+		c.checkpoint.Chunk = c.checkpoint.Bytes / c.chunkSize
+	}
+
+	if time.Since(c.lastWrite) >= checkpointInterval {
+		c.write()
+	}
+}
+
+// bytes is how much was transferred in the current phase.
+func (c *checkpointer) bytes() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.checkpoint.Bytes
+}
+
+func (c *checkpointer) write() {
+	c.lastWrite = time.Now()
+	c.checkpoint.UpdatedAt = c.lastWrite
+
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+			return err
+		}
+
+		content, err := json.Marshal(c.checkpoint)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(c.path+".tmp", content, 0o644); err != nil {
+			return err
+		}
+
+		return os.Rename(c.path+".tmp", c.path)
+	}()
+
+	// Progress is informational. Don't fail the backup, or flood the log, if
+	// it can't be written.
+	if err != nil && !c.failed {
+		slog.Warn("Failed to write progress checkpoint", "path", c.path, "error", err)
+	}
+	c.failed = err != nil
+}
+
+// remove removes the checkpoint once the backup is no longer in flight.
+func (c *checkpointer) remove() {
+	if c == nil {
+		return
+	}
+
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove progress checkpoint", "path", c.path, "error", err)
+	}
+}
+
+// checkpointWriteCloser records the bytes written through it in a
+// checkpointer.
+type checkpointWriteCloser struct {
+	io.WriteCloser
+	progress *checkpointer
+}
+
+func (w *checkpointWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.progress.add(n)
+	return n, err
+}
+
+// ListCheckpoints lists the progress checkpoints in stateDir, oldest first.
+func ListCheckpoints(stateDir string) ([]*Checkpoint, error) {
+	dir := checkpointDir(stateDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read progress checkpoints: %w", err)
+	}
+
+	var checkpoints []*Checkpoint
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read progress checkpoint: %w", err)
+		}
+
+		var checkpoint Checkpoint
+		if err := json.Unmarshal(content, &checkpoint); err != nil {
+			slog.Warn("Skipping invalid progress checkpoint", "path", entry.Name(), "error", err)
+			continue
+		}
+
+		checkpoint.Alive = checkpoint.PID > 0 && glock.ProcessAlive(checkpoint.PID)
+		checkpoints = append(checkpoints, &checkpoint)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].BackupID.Compare(checkpoints[j].BackupID) < 0
+	})
+
+	return checkpoints, nil
+}
@@ -0,0 +1,55 @@
+package zfsbackrest
+
+import (
+	"testing"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestCheckpoints(t *testing.T) {
+	stateDir := t.TempDir()
+	r := &Runner{Config: &config.Config{
+		StateDir:   stateDir,
+		Repository: config.Repository{S3: config.S3Store{PartSize: 1024}},
+	}}
+
+	data := &BackupFSMData{Dataset: "tank/data", BackupID: ulid.Make(), BackupType: repository.BackupTypeIncr}
+	progress := r.newCheckpointer(data)
+	progress.phase(PhaseUploading, 4096)
+
+	// Writes are throttled, so the second add isn't persisted yet.
+	progress.add(1500)
+	progress.lastWrite = progress.lastWrite.Add(-checkpointInterval)
+	progress.add(1000)
+	progress.add(100)
+
+	checkpoints, err := ListCheckpoints(stateDir)
+	if err != nil {
+		t.Fatalf("list checkpoints: %v", err)
+	}
+	if len(checkpoints) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(checkpoints))
+	}
+
+	c := checkpoints[0]
+	if c.BackupID != data.BackupID || c.Phase != PhaseUploading || c.Expected != 4096 {
+		t.Fatalf("unexpected checkpoint: %+v", c)
+	}
+	if c.Bytes != 2500 || c.Chunk != 2 {
+		t.Fatalf("checkpoint at %d bytes, chunk %d, want 2500 bytes, chunk 2", c.Bytes, c.Chunk)
+	}
+	if !c.Alive {
+		t.Fatal("checkpoint of this process should be alive")
+	}
+
+	progress.remove()
+	checkpoints, err = ListCheckpoints(stateDir)
+	if err != nil {
+		t.Fatalf("list checkpoints: %v", err)
+	}
+	if len(checkpoints) != 0 {
+		t.Fatalf("expected no checkpoints after remove, got %d", len(checkpoints))
+	}
+}
@@ -0,0 +1,133 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// checksumHoldback is how much of the end of a snapshot stream is held back
+// until the whole stream matched its checksum. It is much larger than the
+// END record `zfs recv` commits a received snapshot on.
+const checksumHoldback = 64 * 1024
+
+// checksumReader checks a stream against the size and SHA-256 checksum
+// recorded for it, as it is read. Either is skipped if it wasn't recorded.
+// The last holdback bytes are only returned once the whole stream matched,
+// so whatever reads a corrupted stream fails before it sees its end.
+type checksumReader struct {
+	io.ReadCloser
+	subject  string
+	checksum string
+	size     int64
+	holdback int
+	// object checks the ciphertext a decrypted stream is read from. It is
+	// read to its end before the stream is checked, so it is checked as
+	// well.
+	object *checksumReader
+
+	hash  hash.Hash
+	read  int64
+	buf   bytes.Buffer
+	chunk []byte
+	// done is set once the whole stream matched.
+	done bool
+	err  error
+}
+
+func newChecksumReader(src io.ReadCloser, subject string, checksum string, size int64, holdback int) *checksumReader {
+	return &checksumReader{
+		ReadCloser: src,
+		subject:    subject,
+		checksum:   checksum,
+		size:       size,
+		holdback:   holdback,
+		hash:       sha256.New(),
+		chunk:      make([]byte, 32*1024),
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	for {
+		if c.done {
+			if c.buf.Len() == 0 {
+				return 0, io.EOF
+			}
+			return c.buf.Read(p)
+		}
+
+		if available := c.buf.Len() - c.holdback; available > 0 {
+			return c.buf.Read(p[:min(len(p), available)])
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		n, err := c.ReadCloser.Read(c.chunk)
+		c.hash.Write(c.chunk[:n])
+		c.buf.Write(c.chunk[:n])
+		c.read += int64(n)
+
+		switch {
+		case err == io.EOF:
+			if err := c.verify(); err != nil {
+				c.err = err
+				return 0, err
+			}
+			c.done = true
+		case err != nil:
+			c.err = err
+			return 0, err
+		}
+	}
+}
+
+func (c *checksumReader) verify() error {
+	if c.object != nil {
+		if _, err := io.Copy(io.Discard, c.object); err != nil {
+			return err
+		}
+	}
+
+	if c.size > 0 && c.read != c.size {
+		return &errclass.ValidationError{
+			Subject: c.subject,
+			Err:     fmt.Errorf("%w: read %d bytes, expected %d", ErrSnapshotSizeMismatch, c.read, c.size),
+		}
+	}
+
+	if c.checksum == "" {
+		return nil
+	}
+
+	if checksum := hex.EncodeToString(c.hash.Sum(nil)); checksum != c.checksum {
+		return &errclass.ValidationError{
+			Subject: c.subject,
+			Err:     fmt.Errorf("%w: got %s, expected %s", ErrSnapshotChecksumMismatch, checksum, c.checksum),
+		}
+	}
+
+	return nil
+}
+
+// mismatch returns the error of the stream, or the object it is decrypted
+// from, not matching its size or checksum, or of a damaged chunk of a framed
+// stream, if there was one.
+func (c *checksumReader) mismatch() error {
+	if c.object != nil {
+		if err := c.object.mismatch(); err != nil {
+			return err
+		}
+	}
+
+	if isDamage(c.err) {
+		return c.err
+	}
+	return nil
+}
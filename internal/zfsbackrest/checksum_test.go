@@ -0,0 +1,183 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/compression"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/framing"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestChecksumReader(t *testing.T) {
+	stream := bytes.Repeat([]byte("zfs send stream"), 16*1024)
+	sum := sha256.Sum256(stream)
+	checksum := hex.EncodeToString(sum[:])
+
+	reader := newChecksumReader(io.NopCloser(bytes.NewReader(stream)), "snapshot", checksum, int64(len(stream)), checksumHoldback)
+	received, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(received, stream) {
+		t.Fatalf("expected the whole stream, got %d bytes, %v", len(received), err)
+	}
+
+	corrupted := bytes.Clone(stream)
+	corrupted[100] ^= 1
+	reader = newChecksumReader(io.NopCloser(bytes.NewReader(corrupted)), "snapshot", checksum, int64(len(stream)), checksumHoldback)
+	received, err = io.ReadAll(reader)
+	if !errors.Is(err, ErrSnapshotChecksumMismatch) || reader.mismatch() == nil {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if len(received) > len(stream)-checksumHoldback {
+		t.Fatalf("expected the end of the corrupted stream to be held back, got %d of %d bytes", len(received), len(stream))
+	}
+
+	reader = newChecksumReader(io.NopCloser(bytes.NewReader(stream[:1000])), "snapshot", "", int64(len(stream)), checksumHoldback)
+	if _, err := io.ReadAll(reader); !errors.Is(err, ErrSnapshotSizeMismatch) {
+		t.Fatalf("expected a size mismatch for a truncated stream, got %v", err)
+	}
+}
+
+func TestOpenRestoreStreamChecksObject(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	backup := repositorytest.NewStore("tank/data").Full("tank/data", time.Hour)
+	stream := bytes.Repeat([]byte("zfs send stream"), 1024)
+	sum := sha256.Sum256(stream)
+	// Only the object's size and checksum are recorded, so the object is
+	// what fails.
+	backup.Size = 0
+	backup.ObjectSize = int64(len(stream))
+	backup.ObjectChecksum = hex.EncodeToString(sum[:])
+
+	truncated := stream[:len(stream)-10]
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(truncated)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Storage: hot, Encryption: encryption.Passthrough{}}
+	reader, err := r.openRestoreStream(ctx, &RestoreFSMData{Backup: backup}, hot)
+	if err != nil {
+		t.Fatalf("open restore stream: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Fatal("expected reading a truncated object to fail")
+	}
+	if mismatch := reader.mismatch(); !errors.Is(mismatch, ErrSnapshotSizeMismatch) {
+		t.Fatalf("expected the object's size mismatch, got %v", mismatch)
+	}
+}
+
+func TestOpenRestoreStreamDecompresses(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	backup := repositorytest.NewStore("tank/data").Full("tank/data", time.Hour)
+	stream := bytes.Repeat([]byte("zfs send stream"), 16*1024)
+	sum := sha256.Sum256(stream)
+	backup.Size = int64(len(stream))
+	backup.Checksum = hex.EncodeToString(sum[:])
+	backup.Compression = compression.AlgorithmZstd
+
+	r := &Runner{Config: &config.Config{}, Storage: hot, Encryption: encryption.Passthrough{}}
+	enc, err := r.snapshotEncryption(backup)
+	if err != nil {
+		t.Fatalf("snapshot encryption: %v", err)
+	}
+
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, enc)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(stream)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+	if raw, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String()); len(raw) >= len(stream) {
+		t.Fatalf("expected the stored snapshot to be compressed, got %d of %d bytes", len(raw), len(stream))
+	}
+
+	reader, err := r.openRestoreStream(ctx, &RestoreFSMData{Backup: backup}, hot)
+	if err != nil {
+		t.Fatalf("open restore stream: %v", err)
+	}
+	defer reader.Close()
+
+	received, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(received, stream) {
+		t.Fatalf("expected the decompressed stream, got %d bytes, %v", len(received), err)
+	}
+}
+
+func TestOpenRestoreStreamStopsAtDamagedChunk(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	backup := repositorytest.NewStore("tank/data").Full("tank/data", time.Hour)
+	stream := bytes.Repeat([]byte("zfs send stream "), framing.ChunkSize/4)
+	sum := sha256.Sum256(stream)
+	backup.Size = int64(len(stream))
+	backup.Checksum = hex.EncodeToString(sum[:])
+	backup.FormatVersion = repository.FormatVersion
+
+	r := &Runner{Config: &config.Config{}, Storage: hot, Encryption: encryption.Passthrough{}}
+	enc, err := r.snapshotEncryption(backup)
+	if err != nil {
+		t.Fatalf("snapshot encryption: %v", err)
+	}
+
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, enc)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(stream)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	// Damage the second of the four chunks.
+	raw, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	raw[framing.ChunkSize*3/2] ^= 1
+	w, err = hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(raw)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	reader, err := r.openRestoreStream(ctx, &RestoreFSMData{Backup: backup}, hot)
+	if err != nil {
+		t.Fatalf("open restore stream: %v", err)
+	}
+	defer reader.Close()
+
+	received, err := io.ReadAll(reader)
+	if !errors.Is(err, framing.ErrTampered) {
+		t.Fatalf("expected the damaged chunk to fail, got %v", err)
+	}
+	if len(received) > framing.ChunkSize {
+		t.Fatalf("expected only the first chunk to be read, got %d bytes", len(received))
+	}
+	if mismatch := reader.mismatch(); !errors.Is(mismatch, framing.ErrTampered) {
+		t.Fatalf("expected the damaged chunk to be reported as damage, got %v", mismatch)
+	}
+}
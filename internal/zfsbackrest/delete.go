@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/gargakshit/zfsbackrest/fsm"
 	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -20,6 +22,12 @@ type DeleteFSMData struct {
 	Dataset string
 	Backup  *repository.Backup
 	Orphan  bool
+	// PartialUpload is set for orphans whose upload was aborted midway, which
+	// may have left parts or segments behind.
+	PartialUpload bool
+	// Trash keeps the remote snapshot and records the backup in the trash
+	// instead of removing it.
+	Trash bool
 }
 
 const (
@@ -38,7 +46,10 @@ type DeleteOpts struct {
 	SkipOrphaning                 bool
 	SkipLocalSnapshotRemoval      bool
 	SkipRemoteSnapshotRemoval     bool
-	DryRun                        bool
+	// SkipTrash removes the remote snapshot right away, even if the trash is
+	// enabled.
+	SkipTrash bool
+	DryRun    bool
 }
 
 func (r *Runner) DeleteAllOrphans(ctx context.Context, opts DeleteOpts) error {
@@ -46,7 +57,14 @@ func (r *Runner) DeleteAllOrphans(ctx context.Context, opts DeleteOpts) error {
 
 	opts.SkipOrphaning = true
 
+	minAge := r.Config.Repository.Orphans.MinAge
+	now := time.Now()
 	for _, orphan := range r.Store.Orphans {
+		if !orphan.SafeToDelete(minAge, now) {
+			slog.Info("Skipping orphan that isn't safe to delete, e.g. as it may still be uploading", "dataset", orphan.Backup.Dataset, "orphan", orphan.Backup.ID, "reason", orphan.Reason, "age", now.Sub(orphan.Backup.CreatedAt).Round(time.Second), "min_age", minAge)
+			continue
+		}
+
 		slog.Debug("Deleting orphan", "orphan", orphan.Backup.ID)
 		err := r.Delete(ctx, orphan.Backup.Dataset, orphan.Backup.ID, opts)
 		if err != nil {
@@ -79,15 +97,24 @@ func (r *Runner) DeleteExpired(ctx context.Context, dataset string, opts DeleteO
 		return fmt.Errorf("failed to get expired backups: %w", err)
 	}
 
-	if len(expired) == 0 {
+	held := r.Store.Backups.HoldLocked(expired, time.Now())
+	for _, backup := range held {
+		slog.Info("Expired backup is locked by Object Lock, or has locked children. Deleting it is delayed.",
+			"dataset", dataset,
+			"backup", backup.ID,
+			"locked_until", backup.LockedUntil,
+		)
+	}
+
+	if expired.Len() == 0 {
 		slog.Info("No expired backups found", "dataset", dataset)
 		return nil
 	}
 
-	slog.Debug("Deleting expired backups", "dataset", dataset, "count", len(expired))
+	slog.Debug("Deleting expired backups", "dataset", dataset, "count", expired.Len())
 
-	sorted := make([]*repository.Backup, 0, len(expired))
-	for _, backup := range expired {
+	sorted := make([]*repository.Backup, 0, expired.Len())
+	for _, backup := range expired.All() {
 		sorted = append(sorted, backup)
 	}
 
@@ -107,6 +134,17 @@ func (r *Runner) DeleteExpired(ctx context.Context, dataset string, opts DeleteO
 		}
 	}
 
+	if !opts.DryRun {
+		err := repository.AppendAudit(ctx, r.Storage, repository.AuditEntry{
+			Action:  repository.AuditExpiryRun,
+			Dataset: dataset,
+			Details: fmt.Sprintf("%d expired, %d held by Object Lock", len(sorted), len(held)),
+		})
+		if err != nil {
+			slog.Warn("Failed to append to the audit log", "error", err)
+		}
+	}
+
 	return nil
 }
 
@@ -115,7 +153,7 @@ func (r *Runner) DeleteRecursive(ctx context.Context, dataset string, id ulid.UL
 	slog.Debug("Deleting backup recursively", "dataset", dataset, "id", id, "opts", opts)
 
 	children := r.Store.Backups.GetChildren(id)
-	for _, child := range children {
+	for _, child := range children.All() {
 		slog.Debug("Deleting child", "dataset", dataset, "id", child)
 		err := r.DeleteRecursive(ctx, dataset, child.ID, opts)
 		if err != nil {
@@ -136,7 +174,11 @@ func (r *Runner) DeleteRecursive(ctx context.Context, dataset string, id ulid.UL
 func (r *Runner) Delete(ctx context.Context, dataset string, id ulid.ULID, opts DeleteOpts) error {
 	slog.Debug("Deleting backup", "dataset", dataset, "id", id, "opts", opts)
 
-	fsm, err := r.createDeleteFSM(dataset, id)
+	// Only committed backups go to the trash. Orphans are deleted for good.
+	_, committed := r.Store.Backups.Get(id)
+	trash := committed && r.Config.Repository.Trash.Retention > 0 && !opts.SkipTrash && !opts.SkipRemoteSnapshotRemoval
+
+	fsm, err := r.createDeleteFSM(dataset, id, trash)
 	if err != nil {
 		return fmt.Errorf("failed to create delete FSM: %w", err)
 	}
@@ -162,13 +204,16 @@ func (r *Runner) Delete(ctx context.Context, dataset string, id ulid.ULID, opts
 
 	if opts.SkipRemoteSnapshotRemoval {
 		action_sequence = append(action_sequence, "skip_remove_remote")
+	} else if trash {
+		action_sequence = append(action_sequence, "trash_remote")
 	} else {
 		action_sequence = append(action_sequence, "remove_remote")
 	}
 
 	action_sequence = append(action_sequence, "update_store")
 
-	if opts.SkipLocalSnapshotRemoval {
+	// The local snapshot of an imported backup isn't zfsbackrest's to remove.
+	if opts.SkipLocalSnapshotRemoval || fsm.CurrentState().Data.Backup.Imported != nil {
 		action_sequence = append(action_sequence, "skip_local_removal")
 	} else {
 		action_sequence = append(action_sequence, "release_snapshot")
@@ -181,25 +226,27 @@ func (r *Runner) Delete(ctx context.Context, dataset string, id ulid.ULID, opts
 	return fsm.RunSequence(ctx, action_sequence...)
 }
 
-func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteState, DeleteAction, DeleteFSMData], error) {
-	slog.Debug("Creating delete FSM", "dataset", dataset, "id", id)
+func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID, trash bool) (*fsm.FSM[DeleteState, DeleteAction, DeleteFSMData], error) {
+	slog.Debug("Creating delete FSM", "dataset", dataset, "id", id, "trash", trash)
 
 	isOrphan := false
-	backup, ok := r.Store.Backups[id]
+	partialUpload := false
+	backup, ok := r.Store.Backups.Get(id)
 	if !ok {
 		orphan, ok := r.Store.Orphans[id]
 		if !ok {
 			slog.Error("Backup not found", "id", id)
-			return nil, fmt.Errorf("backup not found for dataset %s: %s", dataset, id)
+			return nil, &errclass.ValidationError{Subject: "backup", Err: fmt.Errorf("backup not found for dataset %s: %s", dataset, id)}
 		}
 
 		backup = &orphan.Backup
 		isOrphan = true
+		partialUpload = orphan.PartialUpload != nil
 	}
 
 	if backup.Dataset != dataset {
 		slog.Error("Backup dataset mismatch", "backup", backup.ID, "dataset", backup.Dataset, "expected", dataset)
-		return nil, fmt.Errorf("backup dataset mismatch for dataset %s: %s", dataset, id)
+		return nil, &errclass.ValidationError{Subject: "backup", Err: fmt.Errorf("backup dataset mismatch for dataset %s: %s", dataset, id)}
 	}
 
 	return fsm.NewFSM(
@@ -207,9 +254,11 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 		fsm.State[DeleteState, DeleteFSMData]{
 			ID: DeleteStateInitial,
 			Data: &DeleteFSMData{
-				Dataset: dataset,
-				Backup:  backup,
-				Orphan:  isOrphan,
+				Dataset:       dataset,
+				Backup:        backup,
+				Orphan:        isOrphan,
+				PartialUpload: partialUpload,
+				Trash:         trash,
 			},
 		},
 		map[DeleteAction]fsm.Transition[DeleteState, DeleteFSMData]{
@@ -227,8 +276,9 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 					// Check if the backup has dependent backups.
 					slog.Debug("Getting children of backup", "backup", data.Backup.ID)
 
-					children := r.Store.Backups.GetChildren(data.Backup.ID)
-					if len(children) > 0 {
+					var children repository.Backups
+					r.Store.View(func() { children = r.Store.Backups.GetChildren(data.Backup.ID) })
+					if children.Len() > 0 {
 						slog.Error("Backup has dependent backups", "dataset", data.Dataset, "backup", data.Backup.ID, "children", children)
 						return fsm.NewUnrecoverableError(fmt.Errorf("backup has dependent backups: %s", data.Backup.ID))
 					}
@@ -272,7 +322,7 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 					slog.Debug("Orphaning backup", "dataset", data.Dataset, "backup", data.Backup.ID)
 
 					slog.Debug("Removing backup from store", "backup", data.Backup.ID)
-					err := r.Store.Backups.RemoveBackup(data.Backup.ID)
+					err := r.Store.RemoveBackup(data.Backup.ID)
 					if err != nil {
 						slog.Error("Failed to remove backup", "error", err)
 						return fsm.NewUnrecoverableError(fmt.Errorf("failed to remove backup: %w", err))
@@ -306,18 +356,60 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 					return nil
 				},
 			},
+			"trash_remote": {
+				From: DeleteStateOrphaned,
+				To:   DeleteStateRemoteRemoved,
+				Run: func(ctx context.Context, data *DeleteFSMData) error {
+					slog.Info("Keeping the remote snapshot in the trash",
+						"dataset", data.Dataset,
+						"backup", data.Backup.ID,
+						"retention", r.Config.Repository.Trash.Retention,
+					)
+					return nil
+				},
+			},
 			"remove_remote": {
 				From: DeleteStateOrphaned,
 				To:   DeleteStateRemoteRemoved,
 				Run: func(ctx context.Context, data *DeleteFSMData) error {
 					slog.Debug("Removing backup from remote", "dataset", data.Dataset, "backup", data.Backup.ID)
 
-					err := r.Storage.DeleteSnapshot(ctx, data.Dataset, data.Backup.ID.String())
+					snapshotStorage, err := r.snapshotStorage(data.Backup)
+					if err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					if data.Backup.Locked(time.Now()) {
+						slog.Warn("Snapshot is locked by Object Lock. It stays in the bucket until the lock ends, and a cleanup removes it.",
+							"dataset", data.Dataset,
+							"backup", data.Backup.ID,
+							"locked_until", data.Backup.LockedUntil,
+						)
+					}
+
+					err = snapshotStorage.DeleteSnapshot(ctx, data.Dataset, data.Backup.ID.String())
 					if err != nil {
 						slog.Error("Failed to delete backup from remote store", "error", err)
 						return fmt.Errorf("failed to delete backup from remote store: %w", err)
 					}
 
+					if partial, ok := storage.As[storage.PartialUploadStore](snapshotStorage); ok && data.PartialUpload {
+						err = partial.AbortPartialUpload(ctx, data.Dataset, data.Backup.ID.String())
+						if err != nil {
+							slog.Error("Failed to abort partial upload", "error", err)
+							return fmt.Errorf("failed to abort partial upload: %w", err)
+						}
+					}
+
+					// Manifests always live in the hot storage.
+					err = repository.DeleteManifest(ctx, r.Storage, data.Dataset, data.Backup.ID)
+					if err != nil {
+						slog.Error("Failed to delete backup manifest from remote store", "error", err)
+						return fmt.Errorf("failed to delete backup manifest from remote store: %w", err)
+					}
+
+					r.deleteFromReplicas(ctx, data.Backup)
+
 					slog.Debug("Snapshot removed from remote store", "dataset", data.Dataset, "backup", data.Backup.ID)
 
 					return nil
@@ -329,6 +421,14 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 				Run: func(ctx context.Context, data *DeleteFSMData) error {
 					slog.Debug("Updating store", "dataset", data.Dataset, "backup", data.Backup.ID)
 
+					if data.Trash {
+						slog.Debug("Adding backup to the trash", "backup", data.Backup.ID)
+						if err := r.Store.AddToTrash(ctx, *data.Backup, time.Now()); err != nil {
+							slog.Error("Failed to add backup to the trash", "error", err)
+							return fsm.NewUnrecoverableError(fmt.Errorf("failed to add backup to the trash: %w", err))
+						}
+					}
+
 					// Remove orphaned backup from the store.
 					slog.Debug("Removing orphaned backup from store", "backup", data.Backup.ID)
 					err := r.Store.RemoveOrphan(ctx, *data.Backup)
@@ -411,5 +511,14 @@ func (r *Runner) createDeleteFSM(dataset string, id ulid.ULID) (*fsm.FSM[DeleteS
 			WaitIncrements: 2 * time.Second,
 			MaxWait:        10 * time.Second,
 		},
+	).WithSafeStates(
+		// While the backup is an orphan, cleanup can finish deleting it. Once it
+		// is removed from the store, the local snapshot has to be removed too.
+		DeleteStateInitial,
+		DeleteStatePrerequisitesVerified,
+		DeleteStateOrphaned,
+		DeleteStateRemoteRemoved,
+		DeleteStateLocalRemoved,
+		DeleteStateCompleted,
 	), nil
 }
@@ -0,0 +1,410 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/glock"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/zfs"
+)
+
+type DoctorStatus string
+
+const (
+	DoctorPass DoctorStatus = "pass"
+	DoctorWarn DoctorStatus = "warn"
+	DoctorFail DoctorStatus = "fail"
+)
+
+// DoctorCheck is the result of one check of the environment, with a hint on
+// how to fix it if it didn't pass.
+type DoctorCheck struct {
+	Name   string       `json:"name"`
+	Status DoctorStatus `json:"status"`
+	Detail string       `json:"detail"`
+	Hint   string       `json:"hint,omitempty"`
+}
+
+func pass(name string, detail string) *DoctorCheck {
+	return &DoctorCheck{Name: name, Status: DoctorPass, Detail: detail}
+}
+
+func warn(name string, detail string, hint string) *DoctorCheck {
+	return &DoctorCheck{Name: name, Status: DoctorWarn, Detail: detail, Hint: hint}
+}
+
+func fail(name string, detail string, hint string) *DoctorCheck {
+	return &DoctorCheck{Name: name, Status: DoctorFail, Detail: detail, Hint: hint}
+}
+
+// DoctorOpts are options for Doctor.
+type DoctorOpts struct {
+	// Identities are checked against the repository's recipient, if set.
+	Identities []string
+	AgeOpts    encryption.AgeOpts
+	// WriteTest uploads and deletes a small object, to check the repository
+	// is writable.
+	WriteTest bool
+}
+
+const (
+	// maxClockSkew is the skew S3 rejects requests at.
+	maxClockSkew = 15 * time.Minute
+	// warnClockSkew is the skew that makes backup times misleading.
+	warnClockSkew = time.Minute
+)
+
+// Doctor checks the environment zfsbackrest runs in: ZFS, the pools,
+// privileges, the config, the repository, the clock, the process lock and
+// the age keys. Checks that can't run because an earlier one failed are
+// skipped.
+func Doctor(ctx context.Context, cfg *config.Config, opts DoctorOpts) []*DoctorCheck {
+	z, _ := zfs.New()
+
+	checks := []*DoctorCheck{checkZFS(ctx, z)}
+	if checks[0].Status != DoctorFail {
+		checks = append(checks,
+			checkPools(ctx, z),
+			checkPrivileges(ctx, z, cfg),
+			checkConfig(ctx, z, cfg),
+		)
+	}
+
+	repo, store := checkRepository(ctx, cfg, opts.WriteTest)
+	checks = append(checks,
+		repo,
+		checkClock(ctx, &cfg.Repository),
+		checkLock(),
+	)
+
+	if store != nil {
+		checks = append(checks, checkEncryption(store, opts.Identities, opts.AgeOpts))
+	}
+
+	return checks
+}
+
+func checkZFS(ctx context.Context, z *zfs.ZFS) *DoctorCheck {
+	const name = "zfs"
+
+	path, err := exec.LookPath("zfs")
+	if err != nil {
+		return fail(name, "zfs is not in $PATH", "Install OpenZFS, or add the directory of the zfs binary to $PATH")
+	}
+
+	version, err := z.Version(ctx)
+	if err != nil {
+		return warn(name, fmt.Sprintf("%s doesn't report its version: %v", path, err), "OpenZFS 0.8 or newer is recommended")
+	}
+
+	return pass(name, fmt.Sprintf("%s (%s)", version, path))
+}
+
+func checkPools(ctx context.Context, z *zfs.ZFS) *DoctorCheck {
+	const name = "pools"
+
+	pools, err := z.Pools(ctx)
+	if err != nil {
+		return fail(name, fmt.Sprintf("failed to list pools: %v", err), "Check that the ZFS kernel module is loaded and zpool works")
+	}
+
+	if len(pools) == 0 {
+		return fail(name, "no pools are imported", "Import the pools with the datasets to back up, with `zpool import`")
+	}
+
+	var unhealthy []string
+	faulted := false
+	for _, pool := range pools {
+		switch pool.Health {
+		case "ONLINE":
+		case "DEGRADED":
+			unhealthy = append(unhealthy, pool.Name+" is "+pool.Health)
+		default:
+			unhealthy = append(unhealthy, pool.Name+" is "+pool.Health)
+			faulted = true
+		}
+	}
+
+	if faulted {
+		return fail(name, strings.Join(unhealthy, ", "), "Run `zpool status -x` and repair the pools")
+	}
+	if len(unhealthy) > 0 {
+		return warn(name, strings.Join(unhealthy, ", "), "Run `zpool status -x` and replace the failed devices")
+	}
+
+	return pass(name, fmt.Sprintf("%d pools online", len(pools)))
+}
+
+// checkPrivileges checks zfsbackrest runs as root, or else that the ZFS
+// permissions it needs are delegated.
+func checkPrivileges(ctx context.Context, z *zfs.ZFS, cfg *config.Config) *DoctorCheck {
+	const name = "privileges"
+
+	u, err := user.Current()
+	if err != nil {
+		return fail(name, fmt.Sprintf("failed to get current user: %v", err), "")
+	}
+
+	if u.Uid == "0" {
+		return pass(name, "running as root")
+	}
+
+	const rootHint = "Backups, restores and cleanups must run as root"
+
+	datasets, err := z.ListDatasetsWithGlobs(ctx, cfg.Repository.IncludedDatasets...)
+	if err != nil {
+		return warn(name, fmt.Sprintf("running as %s, and failed to list datasets: %v", u.Username, err), rootHint)
+	}
+
+	groups, err := GroupNames(u)
+	if err != nil {
+		return warn(name, fmt.Sprintf("running as %s: %v", u.Username, err), rootHint)
+	}
+
+	permissions, err := CheckPermissions(ctx, z, datasets, u.Username, groups)
+	if err != nil {
+		return warn(name, fmt.Sprintf("running as %s, and failed to check delegated permissions: %v", u.Username, err), rootHint)
+	}
+
+	var fixes []string
+	for _, check := range permissions {
+		if check.Fix != "" {
+			fixes = append(fixes, check.Fix)
+		}
+	}
+
+	if len(fixes) > 0 {
+		return warn(name,
+			fmt.Sprintf("running as %s, which is missing ZFS permissions on %d datasets", u.Username, len(fixes)),
+			rootHint+". To delegate the missing permissions, run as root: "+strings.Join(fixes, "; "),
+		)
+	}
+
+	return warn(name, fmt.Sprintf("running as %s, with the ZFS permissions delegated", u.Username), rootHint)
+}
+
+// checkConfig checks the parts of the config that are only parsed, or only
+// matched against the host, when they are used.
+func checkConfig(ctx context.Context, z *zfs.ZFS, cfg *config.Config) *DoctorCheck {
+	const name = "config"
+
+	if len(cfg.Repository.IncludedDatasets) == 0 {
+		return fail(name, "repository.included_datasets is empty", "List the datasets to back up, glob patterns are supported")
+	}
+
+	for _, glob := range cfg.Repository.IncludedDatasets {
+		datasets, err := z.ListDatasetsWithGlobs(ctx, glob)
+		if err != nil {
+			return fail(name, fmt.Sprintf("failed to match %q: %v", glob, err), "Fix the pattern in repository.included_datasets")
+		}
+		if len(datasets) == 0 {
+			return warn(name, fmt.Sprintf("%q in repository.included_datasets matches no dataset", glob), "Check for typos, or remove the pattern")
+		}
+	}
+
+	if _, _, err := spoolSizeLimits(&cfg.Spool); err != nil {
+		return configFailure(name, err)
+	}
+	if _, err := prefetchMaxSize(&cfg.Restore); err != nil {
+		return configFailure(name, err)
+	}
+	if _, err := util.ParseLogConfig(&cfg.Log, cfg.Debug); err != nil {
+		return configFailure(name, err)
+	}
+
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(cfg.StateDir, 0o700); err != nil {
+			return warn(name, fmt.Sprintf("state_dir %s is not writable: %v", cfg.StateDir, err), "Create the directory, or point state_dir elsewhere")
+		}
+	}
+
+	return pass(name, fmt.Sprintf("%d dataset patterns", len(cfg.Repository.IncludedDatasets)))
+}
+
+func configFailure(name string, err error) *DoctorCheck {
+	var configErr *errclass.ConfigError
+	if errors.As(err, &configErr) && configErr.Key != "" {
+		return fail(name, err.Error(), "Fix "+configErr.Key)
+	}
+
+	return fail(name, err.Error(), "")
+}
+
+// checkRepository checks the repository is reachable, and that the store can
+// be read and the snapshots listed. It returns the store if it was loaded.
+func checkRepository(ctx context.Context, cfg *config.Config, writeTest bool) (*DoctorCheck, *repository.Store) {
+	s, err := storage.NewStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		return configFailure("repository", err), nil
+	}
+
+	return checkStorage(ctx, s, writeTest)
+}
+
+func checkStorage(ctx context.Context, s storage.StrongStore, writeTest bool) (*DoctorCheck, *repository.Store) {
+	const name = "repository"
+
+	store, err := repository.LoadStore(ctx, s)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return fail(name, "the repository has no store", "Run `zfsbackrest init` to create the repository"), nil
+	}
+	if err != nil {
+		return fail(name, fmt.Sprintf("failed to load the store: %v", err), "Check the endpoint, the bucket and the credentials can read it"), nil
+	}
+
+	objects, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return fail(name, fmt.Sprintf("failed to list snapshots: %v", err), "Allow the credentials to list the bucket"), store
+	}
+
+	detail := fmt.Sprintf("%d backups, %d snapshot objects", store.Backups.Len(), len(objects))
+	if !writeTest {
+		return pass(name, detail+", writes not tested"), store
+	}
+
+	if err := storage.ProbeWrite(ctx, s); err != nil {
+		return fail(name, fmt.Sprintf("%s, but %v", detail, err), "Allow the credentials to write, read and delete objects in the bucket"), store
+	}
+
+	return pass(name, detail+", writable"), store
+}
+
+// checkClock compares the local clock with the Date header of the
+// repository's endpoint.
+func checkClock(ctx context.Context, repoConfig *config.Repository) *DoctorCheck {
+	const name = "clock"
+
+	if repoConfig.Backend == config.BackendRclone {
+		return pass(name, "not checked, the rclone backend has no endpoint to compare with")
+	}
+
+	endpoint := "https://" + repoConfig.S3.Endpoint
+	if repoConfig.S3.Insecure {
+		endpoint = "http://" + repoConfig.S3.Endpoint
+	}
+	if repoConfig.Backend == config.BackendSwift {
+		endpoint = repoConfig.Swift.AuthURL
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	serverTime, err := endpointTime(ctx, endpoint)
+	if err != nil {
+		return warn(name, fmt.Sprintf("failed to get the time of %s: %v", endpoint, err), "")
+	}
+
+	return clockCheck(time.Since(serverTime))
+}
+
+func endpointTime(ctx context.Context, endpoint string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_ = resp.Body.Close()
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, errors.New("no Date header in the response")
+	}
+
+	return http.ParseTime(date)
+}
+
+// clockCheck classifies how far the local clock is ahead of the endpoint's.
+// The Date header has a resolution of a second.
+func clockCheck(skew time.Duration) *DoctorCheck {
+	const name = "clock"
+	const hint = "Sync the clock, e.g. with chrony or systemd-timesyncd"
+
+	abs := skew.Abs().Truncate(time.Second)
+	detail := fmt.Sprintf("%s ahead of the repository", abs)
+	if skew < 0 {
+		detail = fmt.Sprintf("%s behind the repository", abs)
+	}
+
+	switch {
+	case abs >= maxClockSkew:
+		return fail(name, detail+", requests will be rejected", hint)
+	case abs >= warnClockSkew:
+		return warn(name, detail, hint)
+	default:
+		return pass(name, detail)
+	}
+}
+
+func checkLock() *DoctorCheck {
+	info, err := glock.Inspect("zfsbackrest")
+	if err != nil {
+		return fail("lock", fmt.Sprintf("failed to inspect the lock: %v", err), "Check the permissions of the lock file")
+	}
+
+	return lockCheck(info)
+}
+
+func lockCheck(info *glock.LockInfo) *DoctorCheck {
+	const name = "lock"
+
+	switch {
+	case !info.Exists:
+		return pass(name, "no zfsbackrest instance is running")
+	case info.Held && info.Alive:
+		return warn(name, fmt.Sprintf("held by pid %d (%s)", info.PID, info.Command), "Wait for it to finish, see `zfsbackrest status`")
+	case info.Held:
+		return warn(name, fmt.Sprintf("held, but pid %d no longer exists", info.PID), "Pass --break-lock to the next command to take it over")
+	default:
+		return pass(name, "free")
+	}
+}
+
+// checkEncryption checks the repository's recipient parses, that its age
+// plugin is installed if it needs one, and that one of identities, if any,
+// matches it.
+func checkEncryption(store *repository.Store, identities []string, opts encryption.AgeOpts) *DoctorCheck {
+	const name = "age keys"
+
+	if store.Encryption.Disabled() {
+		return pass(name, "the repository was initialized without encryption, no keys are needed")
+	}
+
+	if err := encryption.CheckPlugin(store.Encryption.Age.RecipientPublicKey); err != nil {
+		return fail(name, fmt.Sprintf("the repository's recipient needs an age plugin: %v", err), "Install the plugin on this host, backups can't be encrypted without it")
+	}
+
+	if len(identities) == 0 {
+		if _, err := encryption.NewAgeWithOpts(&store.Encryption.Age, opts); err != nil {
+			return fail(name, fmt.Sprintf("the repository's recipient doesn't parse: %v", err), "Check the store wasn't edited by hand")
+		}
+		return pass(name, "the repository's recipient parses, pass an identity to check it matches")
+	}
+
+	if _, err := encryption.NewAgeFromIdentities(identities, &store.Encryption.Age, opts); err != nil {
+		if errors.Is(err, encryption.ErrIdentityMismatch) {
+			return fail(name, "no identity matches the repository's recipient "+store.Encryption.Age.RecipientPublicKey, "Pass the identity of the current recipient")
+		}
+		return fail(name, err.Error(), "Check the identity files")
+	}
+
+	slog.Debug("Identities match the repository's recipient", "count", len(identities))
+	return pass(name, fmt.Sprintf("%d identities, one matches the repository's recipient", len(identities)))
+}
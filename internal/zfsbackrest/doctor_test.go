@@ -0,0 +1,90 @@
+package zfsbackrest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/glock"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestClockCheck(t *testing.T) {
+	tests := []struct {
+		skew time.Duration
+		want DoctorStatus
+	}{
+		{skew: 2 * time.Second, want: DoctorPass},
+		{skew: -5 * time.Minute, want: DoctorWarn},
+		{skew: 20 * time.Minute, want: DoctorFail},
+	}
+
+	for _, tc := range tests {
+		if got := clockCheck(tc.skew); got.Status != tc.want {
+			t.Errorf("skew %s: expected %s, got %s (%s)", tc.skew, tc.want, got.Status, got.Detail)
+		}
+	}
+}
+
+func TestLockCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		info glock.LockInfo
+		want DoctorStatus
+	}{
+		{name: "no lock file", info: glock.LockInfo{}, want: DoctorPass},
+		{name: "free", info: glock.LockInfo{Exists: true, PID: 42}, want: DoctorPass},
+		{name: "held", info: glock.LockInfo{Exists: true, Held: true, Alive: true, PID: 42}, want: DoctorWarn},
+		{name: "held by a dead process", info: glock.LockInfo{Exists: true, Held: true, PID: 42}, want: DoctorWarn},
+	}
+
+	for _, tc := range tests {
+		if got := lockCheck(&tc.info); got.Status != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got.Status)
+		}
+	}
+}
+
+func TestCheckStorage(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	if check, store := checkStorage(ctx, hot, false); check.Status != DoctorFail || store != nil {
+		t.Fatalf("expected a repository without a store to fail, got %s", check.Status)
+	}
+
+	if _, err := repositorytest.NewStore("tank/data").Save(ctx, hot); err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	check, store := checkStorage(ctx, hot, true)
+	if check.Status != DoctorPass || store == nil {
+		t.Fatalf("expected the repository to pass, got %s (%s)", check.Status, check.Detail)
+	}
+	if snapshots := hot.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("expected the write test to clean up, got %v", snapshots)
+	}
+}
+
+func TestCheckEncryption(t *testing.T) {
+	current, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+
+	store := repositorytest.NewStore("tank/data").
+		WithEncryption(config.Encryption{Age: config.Age{RecipientPublicKey: current.Recipient().String()}}).
+		Build()
+
+	if check := checkEncryption(store, nil, encryption.AgeOpts{}); check.Status != DoctorPass {
+		t.Fatalf("expected the recipient to parse, got %s (%s)", check.Status, check.Detail)
+	}
+	if check := checkEncryption(store, []string{other.String(), current.String()}, encryption.AgeOpts{}); check.Status != DoctorPass {
+		t.Fatalf("expected the identities to match, got %s (%s)", check.Status, check.Detail)
+	}
+	if check := checkEncryption(store, []string{other.String()}, encryption.AgeOpts{}); check.Status != DoctorFail {
+		t.Fatalf("expected a mismatched identity to fail, got %s", check.Status)
+	}
+}
@@ -0,0 +1,69 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+)
+
+type GCOpts struct {
+	// MinAge skips objects named after backups younger than it, which may be
+	// uploading.
+	MinAge time.Duration
+	DryRun bool
+}
+
+// GCObject is an untracked object found by GarbageCollect, in the storage it
+// was found in, as named by TierStores.
+type GCObject struct {
+	Storage string
+	repository.UntrackedObject
+}
+
+// GarbageCollect finds the snapshot and manifest objects in every storage
+// tier and route that the store doesn't refer to, and deletes them unless
+// it's a dry run. It returns the objects it found.
+func (r *Runner) GarbageCollect(ctx context.Context, opts GCOpts) ([]GCObject, error) {
+	slog.Debug("Collecting untracked objects", "opts", opts)
+
+	var found []GCObject
+	stores := r.TierStores()
+	names := []string{string(repository.TierHot), string(repository.TierCold)}
+	for _, route := range r.Routes {
+		names = append(names, route.StorageName())
+	}
+
+	for _, name := range names {
+		s, ok := stores[name]
+		if !ok {
+			continue
+		}
+
+		objects, err := s.ListSnapshots(ctx)
+		if err != nil {
+			return found, fmt.Errorf("failed to list %s objects: %w", name, err)
+		}
+
+		untracked := r.Store.UntrackedObjects(objects, opts.MinAge, time.Now())
+		slog.Info("Found untracked objects", "storage", name, "objects", len(objects), "untracked", len(untracked))
+
+		for _, object := range untracked {
+			found = append(found, GCObject{Storage: name, UntrackedObject: object})
+
+			if opts.DryRun {
+				slog.Info("Dry run. Untracked object would be deleted.", "storage", name, "dataset", object.Dataset, "object", object.Snapshot, "size", object.Size)
+				continue
+			}
+
+			slog.Info("Deleting untracked object", "storage", name, "dataset", object.Dataset, "object", object.Snapshot, "size", object.Size)
+			if err := s.DeleteSnapshot(ctx, object.Dataset, object.Snapshot); err != nil {
+				return found, fmt.Errorf("failed to delete untracked object %s/%s: %w", object.Dataset, object.Snapshot, err)
+			}
+		}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,64 @@
+package zfsbackrest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	tracked := b.Full("tank/data", 72*time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	leftover := ulid.MustNew(ulid.Timestamp(time.Now().Add(-48*time.Hour)), ulid.DefaultEntropy())
+	uploading := ulid.MustNew(ulid.Timestamp(time.Now()), ulid.DefaultEntropy())
+	for _, id := range []ulid.ULID{tracked.ID, leftover, uploading} {
+		w, err := hot.OpenSnapshotWriteStream(ctx, "tank/data", id.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write([]byte("snapshot"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	found, err := r.GarbageCollect(ctx, GCOpts{MinAge: 24 * time.Hour, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(found) != 1 || found[0].Storage != string(repository.TierHot) || found[0].Snapshot != leftover.String() {
+		t.Fatalf("expected only the old leftover object to be found, got %+v", found)
+	}
+	if len(hot.Snapshots()) != 3 {
+		t.Fatalf("expected a dry run to keep every object, got %v", hot.Snapshots())
+	}
+
+	if _, err := r.GarbageCollect(ctx, GCOpts{MinAge: 24 * time.Hour}); err != nil {
+		t.Fatalf("garbage collect: %v", err)
+	}
+	if _, ok := hot.RawSnapshot("tank/data", leftover.String()); ok {
+		t.Fatal("expected the leftover object to be deleted")
+	}
+	for _, id := range []ulid.ULID{tracked.ID, uploading} {
+		if _, ok := hot.RawSnapshot("tank/data", id.String()); !ok {
+			t.Fatalf("expected object %s to be kept", id)
+		}
+	}
+}
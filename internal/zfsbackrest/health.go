@@ -0,0 +1,69 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// StorageHealth checks every storage target of the repository: the hot
+// storage, the cold storage if tiering is enabled, and each replica. Unlike
+// Doctor, it doesn't need ZFS, root or an initialized repository, so it can
+// validate a config before the first backup.
+func StorageHealth(ctx context.Context, cfg *config.Config, write bool) []*DoctorCheck {
+	var checks []*DoctorCheck
+
+	hot, err := storage.NewStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		checks = append(checks, configFailure("storage", err))
+	} else {
+		checks = append(checks, storageHealthCheck(ctx, "storage", hot, write, true))
+	}
+
+	cold, err := storage.NewColdStrongStore(ctx, &cfg.Repository)
+	switch {
+	case err != nil:
+		checks = append(checks, configFailure("cold storage", err))
+	case cold != nil:
+		checks = append(checks, storageHealthCheck(ctx, "cold storage", cold, write, false))
+	}
+
+	for i := range cfg.Repository.Replicas {
+		replica := &cfg.Repository.Replicas[i]
+		name := "replica " + replica.Name
+
+		s, err := storage.NewReplicaStrongStore(ctx, replica)
+		if err != nil {
+			checks = append(checks, configFailure(name, err))
+			continue
+		}
+		checks = append(checks, storageHealthCheck(ctx, name, s, write, false))
+	}
+
+	return checks
+}
+
+// storageHealthCheck runs storage.HealthCheck on s. Only the hot storage
+// holds the store, so a missing store is only reported for it.
+func storageHealthCheck(ctx context.Context, name string, s storage.StrongStore, write bool, hasStore bool) *DoctorCheck {
+	health, err := storage.HealthCheck(ctx, s, write)
+	if err != nil {
+		return fail(name, err.Error(), "Check the endpoint, the bucket and that the credentials can list, read, write and delete objects in it")
+	}
+
+	detail := fmt.Sprintf("%d snapshot objects", health.Snapshots)
+	if health.Writable {
+		detail += fmt.Sprintf(", writable (round-trip %s)", health.Latency.Round(time.Millisecond))
+	} else {
+		detail += ", writes not tested"
+	}
+
+	if hasStore && !health.Initialized {
+		return warn(name, detail+", no store", "Run `zfsbackrest init` to create the repository")
+	}
+
+	return pass(name, detail)
+}
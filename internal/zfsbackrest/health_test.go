@@ -0,0 +1,41 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestStorageHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	if check := storageHealthCheck(ctx, "storage", hot, true, true); check.Status != DoctorWarn {
+		t.Fatalf("expected storage without a store to warn, got %s (%s)", check.Status, check.Detail)
+	}
+	if check := storageHealthCheck(ctx, "cold storage", hot, true, false); check.Status != DoctorPass {
+		t.Fatalf("expected cold storage without a store to pass, got %s (%s)", check.Status, check.Detail)
+	}
+
+	if _, err := repositorytest.NewStore("tank/data").Save(ctx, hot); err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	if check := storageHealthCheck(ctx, "storage", hot, true, true); check.Status != DoctorPass {
+		t.Fatalf("expected the storage to pass, got %s (%s)", check.Status, check.Detail)
+	}
+	if snapshots := hot.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("expected the probe object to be deleted, got %v", snapshots)
+	}
+
+	hot.FailNext(storagetest.OpRead, errors.New("boom"))
+	if check := storageHealthCheck(ctx, "storage", hot, true, true); check.Status != DoctorFail {
+		t.Fatalf("expected a failed read back to fail, got %s (%s)", check.Status, check.Detail)
+	}
+	if snapshots := hot.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("expected the probe object to be deleted after a failed read back, got %v", snapshots)
+	}
+}
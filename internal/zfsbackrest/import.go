@@ -0,0 +1,257 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/zfs"
+	"github.com/gobwas/glob"
+	"github.com/oklog/ulid/v2"
+)
+
+// ImportOpts are the options of Import.
+type ImportOpts struct {
+	// Match is a glob the names of the snapshots to import, after the @, have
+	// to match. Every snapshot is imported if it is empty.
+	Match string
+	// FullEvery starts a new chain with a full backup every so many
+	// snapshots. The others are diffs of the chain's full backup. With 0,
+	// only the first snapshot is imported as a full backup.
+	FullEvery int
+	DryRun    bool
+	Labels    BackupLabels
+}
+
+// ImportedSnapshot is a snapshot Import imports as a backup, or skips.
+type ImportedSnapshot struct {
+	Dataset  string                `json:"dataset"`
+	Snapshot string                `json:"snapshot"`
+	Created  time.Time             `json:"created"`
+	Type     repository.BackupType `json:"type,omitempty"`
+	Backup   *ulid.ULID            `json:"backup,omitempty"`
+	// DependsOn and From are the parent backup of a diff, and the snapshot it
+	// was imported from.
+	DependsOn *ulid.ULID `json:"depends_on,omitempty"`
+	From      string     `json:"from,omitempty"`
+	// Skipped is why the snapshot isn't imported, if it isn't.
+	Skipped string `json:"skipped,omitempty"`
+	// Imported is set once the backup is committed.
+	Imported bool `json:"imported"`
+
+	guid string
+}
+
+// Import imports the existing snapshots of a managed dataset, e.g. the ones
+// sanoid takes, as backups, oldest first. The first snapshot, and every
+// FullEvery-th one after it, is imported as a full backup, and the others as
+// diffs of it. Snapshots already backed up, by GUID, are skipped, so an
+// import can be run again to import newer snapshots. Imported snapshots are
+// neither held nor destroyed, and later backups don't depend on them.
+func (r *Runner) Import(ctx context.Context, dataset string, opts ImportOpts) ([]*ImportedSnapshot, error) {
+	slog.Debug("Importing snapshots", "dataset", dataset, "opts", opts)
+
+	var match glob.Glob
+	if opts.Match != "" {
+		var err error
+		match, err = glob.Compile(opts.Match)
+		if err != nil {
+			return nil, &errclass.ValidationError{Subject: "match", Err: err}
+		}
+	}
+
+	if opts.FullEvery < 0 {
+		return nil, &errclass.ValidationError{Subject: "full every", Err: fmt.Errorf("must not be negative, got %d", opts.FullEvery)}
+	}
+
+	var managed bool
+	r.Store.View(func() { managed = slices.Contains(r.Store.ManagedDatasets, dataset) })
+	if !managed {
+		return nil, &errclass.ValidationError{
+			Subject: "dataset",
+			Err:     fmt.Errorf("dataset %s isn't managed. Add it to repository.included_datasets first", dataset),
+		}
+	}
+
+	exists, err := r.ZFS.DatasetExists(ctx, dataset)
+	if err != nil {
+		slog.Error("Failed to check if dataset exists", "dataset", dataset, "error", err)
+		return nil, fmt.Errorf("failed to check if dataset exists: %w", err)
+	}
+	if !exists {
+		return nil, &errclass.ValidationError{Subject: "dataset", Err: fmt.Errorf("dataset does not exist: %s", dataset)}
+	}
+
+	snapshots, err := r.ZFS.ListSnapshotsByCreation(ctx, dataset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of %s: %w", dataset, err)
+	}
+
+	var backups repository.Backups
+	r.Store.View(func() { backups = r.Store.Backups.OfDataset(dataset) })
+
+	plan := planImport(backups, dataset, snapshots, match, opts.FullEvery)
+	slog.Info("Planned import", "dataset", dataset, "snapshots", len(plan))
+	if opts.DryRun {
+		slog.Warn("Dry run. Skipping importing snapshots.", "dataset", dataset)
+		return plan, nil
+	}
+
+	for _, s := range plan {
+		if s.Skipped != "" {
+			continue
+		}
+
+		if err := r.importSnapshot(ctx, s, opts.Labels); err != nil {
+			return plan, fmt.Errorf("failed to import snapshot %s@%s: %w", dataset, s.Snapshot, err)
+		}
+		s.Imported = true
+	}
+
+	slog.Info("Import completed", "dataset", dataset)
+	return plan, nil
+}
+
+// planImport returns the snapshots of dataset to import, oldest first, and
+// the ones skipped because they are already backed up. Snapshots zfsbackrest
+// took, and the ones not matching match, are left out.
+func planImport(backups repository.Backups, dataset string, snapshots []zfs.Snapshot, match glob.Glob, fullEvery int) []*ImportedSnapshot {
+	byGUID := map[string]*repository.Backup{}
+	for _, b := range backups.All() {
+		if b.GUID != "" {
+			byGUID[b.GUID] = b
+		}
+	}
+
+	var plan []*ImportedSnapshot
+	// full is the full backup of the current chain, and chain the number of
+	// backups in it.
+	var full *ulid.ULID
+	var fullSnapshot string
+	chain := 0
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Name, "zfsbackrest-") || (match != nil && !match.Match(snapshot.Name)) {
+			continue
+		}
+
+		s := &ImportedSnapshot{Dataset: dataset, Snapshot: snapshot.Name, Created: snapshot.Creation, guid: snapshot.GUID}
+		plan = append(plan, s)
+
+		// Imports run again continue the chain of the last one, as long as
+		// the snapshot of its full backup is still around.
+		if existing, ok := byGUID[snapshot.GUID]; ok {
+			s.Skipped = fmt.Sprintf("already backed up as %s", existing.ID)
+			switch {
+			case existing.Imported != nil && existing.Type == repository.BackupTypeFull:
+				full, fullSnapshot, chain = &existing.ID, snapshot.Name, 1
+			case full != nil && existing.DependsOn != nil && *existing.DependsOn == *full:
+				chain++
+			}
+			continue
+		}
+
+		id := ulid.MustNew(ulid.Timestamp(snapshot.Creation), ulid.DefaultEntropy())
+		s.Backup = &id
+		if full == nil || (fullEvery > 0 && chain >= fullEvery) {
+			s.Type = repository.BackupTypeFull
+			full, fullSnapshot, chain = &id, snapshot.Name, 1
+			continue
+		}
+
+		s.Type = repository.BackupTypeDiff
+		s.DependsOn = full
+		s.From = fullSnapshot
+		chain++
+	}
+
+	return plan
+}
+
+// importSnapshot imports a snapshot as a backup. The manifest is made here,
+// and the rest is done by the backup FSM, from the upload on.
+func (r *Runner) importSnapshot(ctx context.Context, s *ImportedSnapshot, labels BackupLabels) error {
+	slog.Info("Importing snapshot", "dataset", s.Dataset, "snapshot", s.Snapshot, "type", s.Type, "backup", s.Backup)
+
+	var parent *repository.Backup
+	if s.DependsOn != nil {
+		var ok bool
+		r.Store.View(func() { parent, ok = r.Store.Backups.Get(*s.DependsOn) })
+		if !ok {
+			return fmt.Errorf("%w: %s", repository.ErrParentBackupNotFound, s.DependsOn)
+		}
+	}
+
+	manifest := repository.Backup{
+		ID:                *s.Backup,
+		Type:              s.Type,
+		CreatedAt:         s.Created,
+		Dataset:           s.Dataset,
+		GUID:              s.guid,
+		Recipient:         r.Store.Encryption.Age.RecipientPublicKey,
+		RecoveryRecipient: r.Store.Encryption.Age.RecoveryRecipientPublicKey,
+		Tags:              labels.Tags,
+		Note:              labels.Note,
+		Imported: &repository.Import{
+			Snapshot:   s.Snapshot,
+			From:       s.From,
+			ImportedAt: time.Now(),
+		},
+	}
+	manifest.NewFormat(&r.Store.Encryption, r.Config.Repository.Compression.Algorithm)
+	if route := r.routeFor(s.Dataset); route != nil {
+		manifest.Route = route.Name
+	}
+
+	// Like backups, diffs are sent like their parent.
+	raw := r.Config.ZFS.RawSend
+	manifest.Send = &repository.SendStream{LargeBlocks: true, Properties: true}
+	if parent != nil {
+		manifest.DependsOn = &parent.ID
+		manifest.Send.FromGUID = parent.GUID
+		raw = parent.Send.IsRaw()
+	}
+	manifest.Send.Raw = raw
+	manifest.Send.Compressed = !raw
+	manifest.Origin = r.origin(ctx, s.Dataset)
+
+	data := &BackupFSMData{
+		Dataset:      s.Dataset,
+		BackupID:     manifest.ID,
+		BackupType:   manifest.Type,
+		ParentBackup: parent,
+		Manifest:     &manifest,
+		Tags:         labels.Tags,
+		Note:         labels.Note,
+	}
+	data.progress = r.newCheckpointer(data)
+	data.progress.phase(PhasePreparing, 0)
+	defer data.progress.remove()
+	defer func() {
+		if !r.spooling() {
+			r.removeSpill(data)
+		}
+	}()
+
+	backupFSM := r.newBackupFSM(fsm.State[BackupState, BackupFSMData]{
+		ID:   BackupStateCreatedBackupManifest,
+		Data: data,
+	})
+	err := backupFSM.RunSequence(ctx,
+		"add_orphan",
+		"upload_snapshot",
+		"upload_manifest",
+		"update_store",
+		"complete",
+	)
+	if err != nil && ctx.Err() != nil {
+		r.recordPartialUploads(ctx, []*fsm.FSM[BackupState, BackupAction, BackupFSMData]{backupFSM})
+	}
+
+	return err
+}
@@ -0,0 +1,76 @@
+package zfsbackrest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/zfs"
+	"github.com/gobwas/glob"
+)
+
+func TestPlanImport(t *testing.T) {
+	start := time.Now().Add(-30 * 24 * time.Hour)
+	var snapshots []zfs.Snapshot
+	for i := range 5 {
+		snapshots = append(snapshots, zfs.Snapshot{
+			Name:     fmt.Sprintf("autosnap_%d_daily", i),
+			GUID:     fmt.Sprint(1000 + i),
+			Creation: start.Add(time.Duration(i) * 24 * time.Hour),
+		})
+	}
+	snapshots = append(snapshots,
+		zfs.Snapshot{Name: "autosnap_5_hourly", GUID: "2000", Creation: start.Add(5 * 24 * time.Hour)},
+		zfs.Snapshot{Name: "zfsbackrest-01J00000000000000000000000", GUID: "3000", Creation: start.Add(6 * 24 * time.Hour)},
+	)
+
+	plan := planImport(repository.NewBackups(), "tank/data", snapshots, glob.MustCompile("*_daily"), 3)
+	if len(plan) != 5 {
+		t.Fatalf("expected the 5 daily snapshots to be planned, got %d", len(plan))
+	}
+
+	wantTypes := []repository.BackupType{"full", "diff", "diff", "full", "diff"}
+	for i, s := range plan {
+		if s.Type != wantTypes[i] || s.Backup == nil || s.Skipped != "" {
+			t.Fatalf("expected snapshot %d to be imported as %s, got %+v", i, wantTypes[i], s)
+		}
+		if got := s.Backup.Timestamp(); !got.Equal(snapshots[i].Creation.Truncate(time.Millisecond)) {
+			t.Errorf("expected the backup ID of snapshot %d to have its creation time, got %s", i, got)
+		}
+	}
+	if *plan[2].DependsOn != *plan[0].Backup || plan[2].From != "autosnap_0_daily" {
+		t.Errorf("expected the diff to depend on the first full, got %+v", plan[2])
+	}
+	if *plan[4].DependsOn != *plan[3].Backup || plan[4].From != "autosnap_3_daily" {
+		t.Errorf("expected the diff to depend on the second full, got %+v", plan[4])
+	}
+
+	// Run again, after the first three were imported and the first snapshot
+	// destroyed, the import starts a new chain.
+	backups := repository.NewBackups()
+	for _, s := range plan[:3] {
+		backups.Add(&repository.Backup{
+			ID:        *s.Backup,
+			Type:      s.Type,
+			CreatedAt: s.Created,
+			DependsOn: s.DependsOn,
+			Dataset:   "tank/data",
+			GUID:      s.guid,
+			Imported:  &repository.Import{Snapshot: s.Snapshot, From: s.From},
+		})
+	}
+
+	again := planImport(backups, "tank/data", snapshots[1:], glob.MustCompile("*_daily"), 0)
+	if len(again) != 4 {
+		t.Fatalf("expected 4 snapshots to be planned, got %d", len(again))
+	}
+	for _, s := range again[:2] {
+		if s.Skipped == "" || s.Backup != nil {
+			t.Errorf("expected the imported snapshot to be skipped, got %+v", s)
+		}
+	}
+	if again[2].Type != repository.BackupTypeFull || again[3].Type != repository.BackupTypeDiff || *again[3].DependsOn != *again[2].Backup {
+		t.Errorf("expected a new chain, got %+v and %+v", again[2], again[3])
+	}
+}
@@ -0,0 +1,363 @@
+package zfsbackrest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// ErrNoAtomicReplace is returned when re-encrypting a backup whose storage
+// can't replace its snapshot object atomically.
+var ErrNoAtomicReplace = errors.New("the storage can't replace a snapshot object atomically, so it can't be re-encrypted in place")
+
+type ReencryptState string
+type ReencryptAction string
+
+const (
+	ReencryptStateInitial      ReencryptState = "initial"
+	ReencryptStateUnpinned     ReencryptState = "unpinned"
+	ReencryptStateRewritten    ReencryptState = "rewritten"
+	ReencryptStateUpdatedStore ReencryptState = "updated_store"
+	ReencryptStateCompleted    ReencryptState = "completed"
+)
+
+type ReencryptFSMData struct {
+	Backup *repository.Backup
+
+	// ObjectChecksum and ObjectSize describe the re-encrypted snapshot
+	// object.
+	ObjectChecksum string
+	ObjectSize     int64
+}
+
+type ReencryptOpts struct {
+	DryRun bool
+	// Window stops new re-encryptions from starting once it has passed. It
+	// is unlimited when 0.
+	Window time.Duration
+}
+
+// RotateKey makes recipient the recipient of new backups, and of the store.
+// Existing backups stay encrypted to the recipient they were taken with until
+// they are re-encrypted.
+func (r *Runner) RotateKey(ctx context.Context, recipient string) error {
+	previous := r.Store.Encryption.Age.RecipientPublicKey
+	if err := r.Store.RotateRecipient(recipient, time.Now()); err != nil {
+		return err
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return fmt.Errorf("failed to save store: %w", err)
+	}
+
+	slog.Info("Rotated the repository key", "from", previous, "to", recipient)
+
+	_, err := r.Storage.LoadKeyEscrowContent(ctx)
+	switch {
+	case err == nil:
+		slog.Warn("The escrowed key is the previous one. Run `zfsbackrest key-escrow store` with the new identity to replace it.")
+	case !errors.Is(err, errclass.ErrNotFound):
+		slog.Warn("Failed to check for an escrowed key", "error", err)
+	}
+
+	return nil
+}
+
+// SetRecoveryKey makes recipient the recovery recipient of new backups, and
+// of the store, or removes the recovery recipient if it is empty. Existing
+// backups are encrypted to it once they are re-encrypted.
+func (r *Runner) SetRecoveryKey(ctx context.Context, recipient string) error {
+	if err := r.Store.SetRecoveryRecipient(recipient); err != nil {
+		return err
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return fmt.Errorf("failed to save store: %w", err)
+	}
+
+	if recipient == "" {
+		slog.Info("Removed the repository's recovery key")
+	} else {
+		slog.Info("Set the repository's recovery key", "recipient", r.Store.Encryption.Age.RecoveryRecipientPublicKey)
+	}
+
+	return nil
+}
+
+// ReencryptBackups re-encrypts the backups that aren't encrypted to the
+// repository's recipient and recovery recipient, oldest first, within the
+// window. r.Encryption must be able to decrypt them. A backup that fails is
+// skipped, and retried on the next run.
+func (r *Runner) ReencryptBackups(ctx context.Context, opts ReencryptOpts) error {
+	if r.Store.Encryption.Disabled() {
+		return &errclass.ValidationError{Subject: "repository", Err: encryption.ErrEncryptionDisabled}
+	}
+
+	recipient := r.Store.Encryption.Age.RecipientPublicKey
+	recovery := r.Store.Encryption.Age.RecoveryRecipientPublicKey
+
+	var due []*repository.Backup
+	r.Store.View(func() { due = r.Store.Backups.NotEncryptedTo(recipient, recovery) })
+	slog.Info("Re-encrypting backups", "count", len(due), "recipient", recipient, "recovery_recipient", recovery, "window", opts.Window, "dry_run", opts.DryRun)
+
+	var deadline time.Time
+	if opts.Window > 0 {
+		deadline = time.Now().Add(opts.Window)
+	}
+
+	var errs []error
+	reencrypted := 0
+	for _, backup := range due {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			slog.Info("Re-encryption window passed, stopping", "remaining", len(due)-reencrypted-len(errs))
+			break
+		}
+
+		if err := r.ReencryptBackup(ctx, backup, opts); err != nil {
+			slog.Error("Failed to re-encrypt backup", "dataset", backup.Dataset, "backup", backup.ID, "error", err)
+			errs = append(errs, fmt.Errorf("failed to re-encrypt backup %s: %w", backup.ID, err))
+			continue
+		}
+		reencrypted++
+	}
+
+	slog.Info("Re-encryption finished", "reencrypted", reencrypted, "failed", len(errs))
+	return errors.Join(errs...)
+}
+
+// ReencryptBackup rewrites the snapshot of a backup encrypted to the
+// repository's recipient, and records the recipient in the store and the
+// manifest. The snapshot is checked against its checksum as it is read, and
+// replaced only if it matched.
+//
+// The object checksum is dropped from the store before the snapshot is
+// rewritten, so an interrupted rewrite doesn't leave the backup looking
+// damaged. The backup still isn't recorded as re-encrypted, so the next run
+// picks it up again.
+func (r *Runner) ReencryptBackup(ctx context.Context, backup *repository.Backup, opts ReencryptOpts) error {
+	slog.Debug("Re-encrypting backup", "dataset", backup.Dataset, "backup", backup.ID, "opts", opts)
+
+	// The snapshot is rewritten under the key it is read from.
+	snapshotStorage, err := r.snapshotStorage(backup)
+	if err != nil {
+		return err
+	}
+	if replacer, ok := storage.As[storage.AtomicReplaceStore](snapshotStorage); !ok || !replacer.AtomicSnapshotReplace() {
+		slog.Error("Refusing to re-encrypt the backup", "dataset", backup.Dataset, "backup", backup.ID, "error", ErrNoAtomicReplace)
+		return &errclass.ValidationError{Subject: "backup " + backup.ID.String(), Err: ErrNoAtomicReplace}
+	}
+
+	fsm := r.createReencryptFSM(backup)
+
+	if opts.DryRun {
+		return fsm.Run(ctx, "dry_run")
+	}
+
+	return fsm.RunSequence(ctx, "unpin_object", "rewrite_snapshot", "update_store", "complete")
+}
+
+func (r *Runner) createReencryptFSM(backup *repository.Backup) *fsm.FSM[ReencryptState, ReencryptAction, ReencryptFSMData] {
+	return fsm.NewFSM(
+		"reencrypt",
+		fsm.State[ReencryptState, ReencryptFSMData]{
+			ID:   ReencryptStateInitial,
+			Data: &ReencryptFSMData{Backup: backup},
+		},
+		map[ReencryptAction]fsm.Transition[ReencryptState, ReencryptFSMData]{
+			"dry_run": {
+				From: ReencryptStateInitial,
+				To:   ReencryptStateCompleted,
+				Run: func(ctx context.Context, data *ReencryptFSMData) error {
+					slog.Warn("Dry run. Backup would be re-encrypted.",
+						"dataset", data.Backup.Dataset,
+						"backup", data.Backup.ID,
+						"recipient", data.Backup.Recipient,
+					)
+					return nil
+				},
+			},
+			"unpin_object": {
+				From: ReencryptStateInitial,
+				To:   ReencryptStateUnpinned,
+				Run: func(ctx context.Context, data *ReencryptFSMData) error {
+					if data.Backup.ObjectChecksum == "" && data.Backup.ObjectSize == 0 {
+						return nil
+					}
+
+					slog.Debug("Dropping the object checksum of the backup", "backup", data.Backup.ID)
+					r.Store.Update(func() {
+						data.Backup.ObjectChecksum = ""
+						data.Backup.ObjectSize = 0
+					})
+					if err := r.Store.Save(ctx, r.Storage); err != nil {
+						slog.Error("Failed to save store", "error", err)
+						return fmt.Errorf("failed to save store: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"rewrite_snapshot": {
+				From: ReencryptStateUnpinned,
+				To:   ReencryptStateRewritten,
+				Run: func(ctx context.Context, data *ReencryptFSMData) error {
+					return r.rewriteSnapshot(ctx, data)
+				},
+			},
+			"update_store": {
+				From: ReencryptStateRewritten,
+				To:   ReencryptStateUpdatedStore,
+				Run: func(ctx context.Context, data *ReencryptFSMData) error {
+					slog.Debug("Recording the recipient in the store", "backup", data.Backup.ID)
+
+					r.Store.Update(func() {
+						data.Backup.Recipient = r.Store.Encryption.Age.RecipientPublicKey
+						data.Backup.RecoveryRecipient = r.Store.Encryption.Age.RecoveryRecipientPublicKey
+						data.Backup.ObjectChecksum = data.ObjectChecksum
+						data.Backup.ObjectSize = data.ObjectSize
+						// The replicas hold the snapshot encrypted to the
+						// previous recipient, until it is replicated again.
+						data.Backup.Replicas = nil
+					})
+					if err := r.Store.Save(ctx, r.Storage); err != nil {
+						slog.Error("Failed to save store", "error", err)
+						return fmt.Errorf("failed to save store: %w", err)
+					}
+
+					if err := repository.WriteManifest(ctx, r.Storage, r.Encryption, data.Backup); err != nil {
+						slog.Error("Failed to update manifest", "error", err)
+						return fmt.Errorf("failed to update manifest: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"complete": {
+				From: ReencryptStateUpdatedStore,
+				To:   ReencryptStateCompleted,
+				Run: func(ctx context.Context, data *ReencryptFSMData) error {
+					slog.Info("Backup re-encrypted", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+					return nil
+				},
+			},
+		},
+		fsm.RetryExponentialBackoffConfig{
+			MaxRetries:     5,
+			WaitIncrements: 2 * time.Second,
+			MaxWait:        10 * time.Second,
+		},
+	).WithSafeStates(
+		ReencryptStateInitial,
+		ReencryptStateUnpinned,
+		ReencryptStateUpdatedStore,
+		ReencryptStateCompleted,
+	)
+}
+
+// rewriteSnapshot replaces the snapshot object of a backup with one
+// encrypted to the repository's recipient. The new object is written under
+// the same key while the current one is read, which ReencryptBackup only
+// allows on storage.AtomicReplaceStore stores.
+func (r *Runner) rewriteSnapshot(ctx context.Context, data *ReencryptFSMData) error {
+	slog.Debug("Rewriting snapshot", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+
+	snapshotStorage, err := r.snapshotStorage(data.Backup)
+	if err != nil {
+		return fsm.NewUnrecoverableError(err)
+	}
+
+	if archive, ok := storage.As[storage.ArchiveStore](snapshotStorage); ok {
+		err := archive.RetrieveSnapshot(ctx, data.Backup.Dataset, data.Backup.ID.String(), true)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve archived snapshot: %w", err)
+		}
+	}
+
+	// The snapshot keeps the compression it was taken with.
+	snapshotEncryption, err := r.snapshotEncryption(data.Backup)
+	if err != nil {
+		return fsm.NewUnrecoverableError(err)
+	}
+
+	reader, err := r.openCheckedSnapshot(ctx, data.Backup, snapshotStorage)
+	if err != nil {
+		if errclass.Of(err) == errclass.ClassEncryption {
+			return fsm.NewUnrecoverableError(err)
+		}
+		return fmt.Errorf("failed to open snapshot read stream: %w", err)
+	}
+	defer reader.Close()
+
+	// Cancelling the write's context keeps a failed rewrite from replacing
+	// the snapshot.
+	writeCtx, cancelWrite := context.WithCancel(ctx)
+	defer cancelWrite()
+
+	writeCtx = storage.WithSnapshotMetadata(writeCtx, data.Backup.ObjectMetadata(storage.ObjectKindSnapshot, r.Encryption))
+	writeStream, err := snapshotStorage.OpenSnapshotWriteStream(writeCtx, data.Backup.Dataset, data.Backup.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		slog.Error("Failed to open snapshot write stream", "error", err)
+		return fmt.Errorf("failed to open snapshot write stream: %w", err)
+	}
+
+	objectStream := &checksumWriteCloser{WriteCloser: writeStream, hash: sha256.New()}
+	encStream, err := snapshotEncryption.EncryptedWriter(objectStream)
+	if err != nil {
+		cancelWrite()
+		_ = writeStream.Close()
+		return fsm.NewUnrecoverableError(&errclass.EncryptionError{Op: "encrypt", Err: err})
+	}
+
+	writer := util.NewLoggedWriter("reencrypt "+data.Backup.ID.String(),
+		&encryptingWriteCloser{enc: encStream, object: objectStream, abort: cancelWrite},
+		data.Backup.Size,
+	)
+	if _, err := io.Copy(writer, reader); err != nil {
+		cancelWrite()
+		_ = writer.Close()
+		slog.Error("Failed to re-encrypt snapshot", "error", err)
+		if isDamage(err) {
+			return fsm.NewUnrecoverableError(err)
+		}
+		return fmt.Errorf("failed to re-encrypt snapshot: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		slog.Error("Failed to close snapshot write stream", "error", err)
+		return fmt.Errorf("failed to close snapshot write stream: %w", err)
+	}
+
+	object, err := snapshotStorage.StatSnapshot(ctx, data.Backup.Dataset, data.Backup.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to check the rewritten snapshot: %w", err)
+	}
+	if object.Size != objectStream.size {
+		slog.Error("Rewritten snapshot is incomplete", "backup", data.Backup.ID, "size", object.Size, "written", objectStream.size)
+		return fsm.NewUnrecoverableError(&errclass.ValidationError{
+			Subject: "snapshot " + data.Backup.ID.String(),
+			Err:     fmt.Errorf("%w: stored %d bytes, wrote %d", ErrSnapshotSizeMismatch, object.Size, objectStream.size),
+		})
+	}
+
+	data.ObjectChecksum = hex.EncodeToString(objectStream.hash.Sum(nil))
+	data.ObjectSize = objectStream.size
+	return nil
+}
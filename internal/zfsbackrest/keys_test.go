@@ -0,0 +1,165 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestRotateAndReencrypt(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	oldIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	newIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	oldConfig := config.Age{RecipientPublicKey: oldIdentity.Recipient().String()}
+	newConfig := config.Age{RecipientPublicKey: newIdentity.Recipient().String()}
+
+	oldEnc, err := encryption.NewAgeFromIdentities([]string{oldIdentity.String()}, &oldConfig, encryption.AgeOpts{})
+	if err != nil {
+		t.Fatalf("create encryption: %v", err)
+	}
+
+	b := repositorytest.NewStore("tank/data").WithEncryption(config.Encryption{Age: oldConfig})
+	backup := b.Full("tank/data", time.Hour)
+	backup.Recipient = oldConfig.RecipientPublicKey
+	backup.MarkReplicated("offsite", time.Now())
+
+	stream := bytes.Repeat([]byte("zfs send stream"), 1024)
+	checksum := sha256.Sum256(stream)
+	backup.Size = int64(len(stream))
+	backup.Checksum = hex.EncodeToString(checksum[:])
+
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, oldEnc)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(stream)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+	object, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	objectChecksum := sha256.Sum256(object)
+	oldObjectChecksum := hex.EncodeToString(objectChecksum[:])
+	backup.ObjectChecksum = oldObjectChecksum
+	backup.ObjectSize = int64(len(object))
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: oldEnc}
+	if err := r.RotateKey(ctx, newConfig.RecipientPublicKey); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if len(store.Backups.NotEncryptedTo(newConfig.RecipientPublicKey, "")) != 1 {
+		t.Fatal("expected the existing backup to still be encrypted to the old recipient")
+	}
+
+	r.Encryption, err = encryption.NewAgeFromIdentities([]string{newIdentity.String(), oldIdentity.String()}, &newConfig, encryption.AgeOpts{})
+	if err != nil {
+		t.Fatalf("create encryption: %v", err)
+	}
+	if err := r.ReencryptBackups(ctx, ReencryptOpts{}); err != nil {
+		t.Fatalf("reencrypt: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	reencrypted := loaded.Backups.Find(backup.ID)
+	if reencrypted.Recipient != newConfig.RecipientPublicKey {
+		t.Fatalf("expected the backup to record the new recipient, got %s", reencrypted.Recipient)
+	}
+	if reencrypted.ObjectChecksum == "" || reencrypted.ObjectChecksum == oldObjectChecksum {
+		t.Fatalf("expected the object checksum of the re-encrypted snapshot, got %s", reencrypted.ObjectChecksum)
+	}
+	if reencrypted.Replicated("offsite") {
+		t.Fatal("expected the replica to need the re-encrypted snapshot")
+	}
+	if len(loaded.RetiredRecipients) != 1 || loaded.RetiredRecipients[0].Recipient != oldConfig.RecipientPublicKey {
+		t.Fatalf("expected the old recipient to be retired, got %+v", loaded.RetiredRecipients)
+	}
+
+	// Only the new identity is needed now.
+	newEnc, err := encryption.NewAgeFromIdentities([]string{newIdentity.String()}, &newConfig, encryption.AgeOpts{})
+	if err != nil {
+		t.Fatalf("create encryption: %v", err)
+	}
+	reader, err := hot.OpenSnapshotReadStream(ctx, backup.Dataset, backup.ID.String(), newEnc)
+	if err != nil {
+		t.Fatalf("open read stream: %v", err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(content, stream) {
+		t.Fatal("expected the re-encrypted snapshot to decrypt to the original stream")
+	}
+	if _, err := repository.ReadManifest(ctx, hot, newEnc, backup.Dataset, backup.ID); err != nil {
+		t.Fatalf("expected the manifest to be encrypted to the new recipient: %v", err)
+	}
+
+	raw, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	rawChecksum := sha256.Sum256(raw)
+	if hex.EncodeToString(rawChecksum[:]) != reencrypted.ObjectChecksum {
+		t.Fatal("expected the recorded object checksum to match the stored object")
+	}
+}
+
+// nonAtomicStore hides the atomic replace of the store it wraps, like the
+// rclone backend.
+type nonAtomicStore struct {
+	storage.StrongStore
+}
+
+func TestReencryptRefusesNonAtomicStorage(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	cfg := config.Age{RecipientPublicKey: identity.Recipient().String()}
+
+	b := repositorytest.NewStore("tank/data").WithEncryption(config.Encryption{Age: cfg})
+	backup := b.Full("tank/data", time.Hour)
+	backup.ObjectChecksum = "checksum"
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: nonAtomicStore{hot}}
+	err = r.ReencryptBackup(ctx, backup, ReencryptOpts{})
+	if !errors.Is(err, ErrNoAtomicReplace) || errclass.Of(err) != errclass.ClassValidation {
+		t.Fatalf("expected ErrNoAtomicReplace, got %v", err)
+	}
+	if backup.ObjectChecksum != "checksum" {
+		t.Fatal("expected the backup to be left as it was")
+	}
+}
@@ -0,0 +1,27 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+)
+
+// SetRepositoryMaintenance freezes (m != nil) or unfreezes (m == nil) the
+// repository for all hosts using it.
+func (r *Runner) SetRepositoryMaintenance(ctx context.Context, m *repository.Maintenance) error {
+	if m == nil {
+		r.Store.Unfreeze()
+	} else {
+		r.Store.Freeze(m)
+	}
+
+	slog.Debug("Saving store", "maintenance", m)
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return fmt.Errorf("failed to save store: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/oklog/ulid/v2"
+)
+
+// SetNote sets the note on a backup, or clears it if note is empty, in the
+// store and in the backup's manifest, so a rebuilt store keeps it too.
+func (r *Runner) SetNote(ctx context.Context, id ulid.ULID, note string) (*repository.Backup, error) {
+	backup, err := r.Store.SetNote(id, note)
+	if err != nil {
+		return nil, &errclass.ValidationError{Subject: "backup", Err: err}
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return nil, fmt.Errorf("failed to save store: %w", err)
+	}
+
+	if err := repository.WriteManifest(ctx, r.Storage, r.Encryption, backup); err != nil {
+		slog.Error("Failed to update manifest", "error", err)
+		return nil, fmt.Errorf("failed to update manifest: %w", err)
+	}
+
+	// The replicas' manifests are only for rebuilding a store, so a stale
+	// note there isn't worth failing for.
+	for _, replica := range r.Replicas {
+		if !backup.Replicated(replica.Name) {
+			continue
+		}
+
+		if err := repository.WriteManifest(ctx, replica.Storage, r.Encryption, backup); err != nil {
+			slog.Warn("Failed to update manifest in replica", "replica", replica.Name, "backup", backup.ID, "error", err)
+		}
+	}
+
+	slog.Info("Set backup note", "dataset", backup.Dataset, "backup", backup.ID, "note", backup.Note)
+	return backup, nil
+}
@@ -0,0 +1,64 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestSetNote(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 24*time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	note := "state before PostgreSQL 16 migration"
+	if _, err := r.SetNote(ctx, full.ID, note); err != nil {
+		t.Fatalf("set note: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if got := loaded.Backups.Find(full.ID).Note; got != note {
+		t.Fatalf("expected the note to be saved in the store, got %q", got)
+	}
+
+	manifest, err := repository.ReadManifest(ctx, hot, encryption.Passthrough{}, full.Dataset, full.ID)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if manifest.Backup.Note != note {
+		t.Fatalf("expected the note to be written to the manifest, got %q", manifest.Backup.Note)
+	}
+
+	entries, err := repository.LoadAudit(ctx, hot, &repository.AuditFilter{Actions: []repository.AuditAction{repository.AuditNoteChanged}})
+	if err != nil {
+		t.Fatalf("load audit: %v", err)
+	}
+	if len(entries) != 1 || *entries[0].Backup != full.ID || entries[0].Details != note {
+		t.Fatalf("expected the note change to be audited, got %+v", entries)
+	}
+
+	var validationErr *errclass.ValidationError
+	if _, err := r.SetNote(ctx, ulid.Make(), note); !errors.As(err, &validationErr) || !errors.Is(err, repository.ErrBackupNotFound) {
+		t.Fatalf("expected an unknown backup to be a validation error, got %v", err)
+	}
+}
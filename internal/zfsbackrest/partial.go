@@ -0,0 +1,84 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/repository"
+)
+
+// partialUploadSaveTimeout bounds how long a forced exit waits for partial
+// uploads to be recorded.
+const partialUploadSaveTimeout = 15 * time.Second
+
+// recordPartialUploads marks the backups whose upload was cut short by a
+// forced exit, so the next backup removes what was uploaded and the snapshot.
+// Spooled backups are left alone, the next backup resumes them instead.
+func (r *Runner) recordPartialUploads(ctx context.Context, fsms []*fsm.FSM[BackupState, BackupAction, BackupFSMData]) {
+	// The context is cancelled, but the store still has to be saved.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), partialUploadSaveTimeout)
+	defer cancel()
+
+	marked := 0
+	for _, backupFSM := range fsms {
+		state := backupFSM.CurrentState()
+		data := state.Data
+		if state.ID != BackupStateAddedOrphan || !data.uploadStarted {
+			continue
+		}
+
+		if r.spooling() && data.SpillPath != "" {
+			slog.Info("Upload aborted. The spooled backup is resumed by the next backup.", "dataset", data.Dataset, "backup", data.Manifest.ID)
+			continue
+		}
+
+		partial := repository.PartialUpload{Bytes: data.progress.bytes(), AbortedAt: time.Now()}
+		if err := r.Store.MarkPartialUpload(data.Manifest.ID, partial); err != nil {
+			slog.Error("Failed to record partial upload", "dataset", data.Dataset, "backup", data.Manifest.ID, "error", err)
+			continue
+		}
+
+		slog.Warn("Upload aborted. It is removed by the next backup.", "dataset", data.Dataset, "backup", data.Manifest.ID, "bytes", partial.Bytes)
+		marked++
+	}
+
+	if marked == 0 {
+		return
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save partial uploads. They are left as uncommitted orphans.", "error", err)
+	}
+}
+
+// CleanupPartialUploads deletes the backups whose upload was aborted by a
+// forced exit: the partially uploaded snapshot in the repository, and the
+// local snapshot.
+func (r *Runner) CleanupPartialUploads(ctx context.Context) error {
+	partial := r.Store.Orphans.PartialUploads()
+	if len(partial) == 0 {
+		return nil
+	}
+
+	slog.Info("Removing partial uploads", "count", len(partial))
+
+	var errs []error
+	for _, orphan := range partial {
+		slog.Info("Removing partial upload",
+			"dataset", orphan.Backup.Dataset,
+			"backup", orphan.Backup.ID,
+			"aborted_at", orphan.PartialUpload.AbortedAt,
+		)
+
+		err := r.Delete(ctx, orphan.Backup.Dataset, orphan.Backup.ID, DeleteOpts{SkipOrphaning: true})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove partial upload %s: %w", orphan.Backup.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,114 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/user"
+	"slices"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/zfs"
+)
+
+// OperationPermissions is the ZFS permissions an operation needs on managed
+// datasets.
+type OperationPermissions struct {
+	Operation string   `json:"operation"`
+	Perms     []string `json:"perms"`
+}
+
+// RequiredPermissions lists the ZFS permissions each operation needs. `zfs
+// allow` requires mount alongside snapshot, destroy and receive.
+var RequiredPermissions = []OperationPermissions{
+	{Operation: "snapshot", Perms: []string{"snapshot", "mount"}},
+	{Operation: "send", Perms: []string{"send"}},
+	{Operation: "hold", Perms: []string{"hold", "release"}},
+	{Operation: "destroy", Perms: []string{"destroy", "mount"}},
+	{Operation: "recv", Perms: []string{"receive", "create", "mount"}},
+}
+
+// OperationCheck is the outcome of checking the permissions of an operation
+// on a dataset.
+type OperationCheck struct {
+	Operation string   `json:"operation"`
+	Missing   []string `json:"missing"`
+}
+
+// PermissionCheck is the outcome of checking the delegated permissions of a
+// user on a dataset.
+type PermissionCheck struct {
+	Dataset    string           `json:"dataset"`
+	Operations []OperationCheck `json:"operations"`
+	// Missing is all the permissions missing on the dataset.
+	Missing []string `json:"missing"`
+	// Fix is the `zfs allow` command that delegates the missing permissions,
+	// or empty if none are missing.
+	Fix string `json:"fix,omitempty"`
+}
+
+// CheckPermissions checks which of the permissions zfsbackrest needs user, a
+// member of groups, is missing on each dataset.
+func CheckPermissions(ctx context.Context, z *zfs.ZFS, datasets []string, user string, groups []string) ([]*PermissionCheck, error) {
+	checks := make([]*PermissionCheck, 0, len(datasets))
+	for _, dataset := range datasets {
+		delegation, err := z.Allowed(ctx, dataset)
+		if err != nil {
+			return nil, err
+		}
+
+		check := checkDelegation(delegation, user, groups)
+		slog.Debug("Checked ZFS permissions", "dataset", dataset, "user", user, "missing", check.Missing)
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+func checkDelegation(delegation *zfs.Delegation, user string, groups []string) *PermissionCheck {
+	has := delegation.PermissionsOf(user, groups)
+	check := &PermissionCheck{Dataset: delegation.Dataset, Missing: []string{}}
+
+	for _, required := range RequiredPermissions {
+		op := OperationCheck{Operation: required.Operation, Missing: []string{}}
+		for _, perm := range required.Perms {
+			if has[perm] {
+				continue
+			}
+
+			op.Missing = append(op.Missing, perm)
+			if !slices.Contains(check.Missing, perm) {
+				check.Missing = append(check.Missing, perm)
+			}
+		}
+
+		check.Operations = append(check.Operations, op)
+	}
+
+	if len(check.Missing) > 0 {
+		check.Fix = fmt.Sprintf("zfs allow -u %s %s %s", user, strings.Join(check.Missing, ","), delegation.Dataset)
+	}
+
+	return check
+}
+
+// GroupNames returns the names of the groups of u. Groups that can't be looked
+// up are skipped.
+func GroupNames(u *user.User) ([]string, error) {
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get groups of %s: %w", u.Username, err)
+	}
+
+	names := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		group, err := user.LookupGroupId(gid)
+		if err != nil {
+			slog.Warn("Failed to look up group", "gid", gid, "error", err)
+			continue
+		}
+		names = append(names, group.Name)
+	}
+
+	return names, nil
+}
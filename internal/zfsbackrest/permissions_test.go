@@ -0,0 +1,61 @@
+package zfsbackrest
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gargakshit/zfsbackrest/zfs"
+)
+
+const allowOutput = `---- Permissions on tank/data/home ------------------------------------
+Permission sets:
+	@backup snapshot,mount,@holds
+Local permissions:
+	user backup @backup
+Descendent permissions:
+	user backup destroy
+---- Permissions on tank/data -----------------------------------------
+Permission sets:
+	@holds hold,release
+	@backup send
+Descendent permissions:
+	group operators send
+Local permissions:
+	user backup receive
+Local+Descendent permissions:
+	everyone create
+`
+
+func TestCheckDelegation(t *testing.T) {
+	delegation, err := zfs.ParseAllowed("tank/data/home", []byte(allowOutput))
+	if err != nil {
+		t.Fatalf("parse zfs allow output: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		groups  []string
+		missing []string
+	}{
+		// Local permissions on an ancestor and descendent permissions on the
+		// dataset itself don't apply, and the nearest @backup wins.
+		{name: "user", user: "backup", missing: []string{"send", "destroy", "receive"}},
+		{name: "group", user: "backup", groups: []string{"operators"}, missing: []string{"destroy", "receive"}},
+		{name: "everyone", user: "nobody", missing: []string{"snapshot", "mount", "send", "hold", "release", "destroy", "receive"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkDelegation(delegation, tt.user, tt.groups)
+			if !slices.Equal(check.Missing, tt.missing) {
+				t.Fatalf("missing = %v, want %v", check.Missing, tt.missing)
+			}
+		})
+	}
+
+	check := checkDelegation(delegation, "backup", []string{"operators"})
+	if want := "zfs allow -u backup destroy,receive tank/data/home"; check.Fix != want {
+		t.Fatalf("fix = %q, want %q", check.Fix, want)
+	}
+}
@@ -0,0 +1,164 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// prefetch is the download of a snapshot, still encrypted, to a file in the
+// prefetch directory. It runs while the previous backup of the chain being
+// restored is received.
+type prefetch struct {
+	backup *repository.Backup
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// path and err are set once done is closed.
+	path string
+	err  error
+}
+
+// prefetchMaxSize parses restore.prefetch_max_size. It is 0 if it isn't set.
+func prefetchMaxSize(cfg *config.Restore) (int64, error) {
+	if cfg.PrefetchMaxSize == "" {
+		return 0, nil
+	}
+
+	size, err := humanize.ParseBytes(cfg.PrefetchMaxSize)
+	if err != nil {
+		return 0, &errclass.ConfigError{Key: "restore.prefetch_max_size", Err: err}
+	}
+
+	return int64(size), nil
+}
+
+// startPrefetch starts downloading the snapshot of backup in the background.
+// It returns nil if prefetching is disabled, or the snapshot is larger than
+// maxSize, in which case the snapshot is streamed when it is restored.
+func (r *Runner) startPrefetch(ctx context.Context, backup *repository.Backup, maxSize int64) *prefetch {
+	dir := r.Config.Restore.PrefetchDir
+	if dir == "" {
+		return nil
+	}
+
+	if maxSize > 0 && backup.Size > maxSize {
+		slog.Info("Snapshot is too large to prefetch. It is streamed instead.", "backup", backup.ID, "size", backup.Size, "max_size", maxSize)
+		return nil
+	}
+
+	slog.Debug("Prefetching snapshot", "dataset", backup.Dataset, "backup", backup.ID, "dir", dir)
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetch{
+		backup: backup,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		p.path, p.err = r.downloadSnapshot(ctx, dir, backup)
+		if p.err != nil {
+			slog.Warn("Failed to prefetch snapshot. It is streamed instead.", "backup", backup.ID, "error", p.err)
+		}
+	}()
+
+	return p
+}
+
+// downloadSnapshot downloads the snapshot of backup as it is stored, so it
+// stays encrypted on disk, and returns the file it was written to. The
+// download fails if the object doesn't match its recorded checksum.
+func (r *Runner) downloadSnapshot(ctx context.Context, dir string, backup *repository.Backup) (string, error) {
+	snapshotStorage, err := r.snapshotStorage(backup)
+	if err != nil {
+		return "", err
+	}
+
+	if archive, ok := storage.As[storage.ArchiveStore](snapshotStorage); ok {
+		err := archive.RetrieveSnapshot(ctx, backup.Dataset, backup.ID.String(), true)
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve archived snapshot: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", &errclass.ConfigError{Key: "restore.prefetch_dir", Err: err}
+	}
+
+	file, err := os.CreateTemp(dir, backup.ID.String()+"-*.prefetch")
+	if err != nil {
+		return "", &errclass.ConfigError{Key: "restore.prefetch_dir", Err: err}
+	}
+
+	reader, err := snapshotStorage.OpenSnapshotReadStream(ctx, backup.Dataset, backup.ID.String(), encryption.Passthrough{})
+	if err == nil {
+		object := newChecksumReader(reader, "snapshot object "+backup.ID.String(), backup.ObjectChecksum, backup.ObjectSize, 0)
+		_, err = io.Copy(file, object)
+		_ = reader.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("failed to download snapshot: %w", err)
+	}
+
+	slog.Debug("Snapshot prefetched", "dataset", backup.Dataset, "backup", backup.ID, "path", file.Name())
+	return file.Name(), nil
+}
+
+// open waits for the download to finish, and opens the decrypted snapshot.
+func (p *prefetch) open(ctx context.Context, enc encryption.Encryption) (io.ReadCloser, error) {
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open prefetched snapshot: %w", err)
+	}
+
+	reader, err := enc.DecryptedReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return reader, nil
+}
+
+// discard stops the download if it is still running, and removes the
+// downloaded file.
+func (p *prefetch) discard() {
+	p.cancel()
+	<-p.done
+
+	if p.path == "" {
+		return
+	}
+
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove prefetched snapshot", "path", p.path, "error", err)
+		return
+	}
+
+	p.path = ""
+}
@@ -0,0 +1,98 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	dir := t.TempDir()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	ageConfig := config.Age{RecipientPublicKey: identity.Recipient().String()}
+	enc, err := encryption.NewAgeFromIdentities([]string{identity.String()}, &ageConfig, encryption.AgeOpts{})
+	if err != nil {
+		t.Fatalf("create encryption: %v", err)
+	}
+
+	b := repositorytest.NewStore("tank/data")
+	backup := b.Full("tank/data", time.Hour)
+
+	stream := bytes.Repeat([]byte("zfs send stream"), 1024)
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, enc)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(stream)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{Restore: config.Restore{PrefetchDir: dir}}, Storage: hot, Encryption: enc}
+
+	if p := r.startPrefetch(ctx, backup, backup.Size-1); p != nil {
+		t.Fatal("expected a snapshot larger than the limit not to be prefetched")
+	}
+
+	p := r.startPrefetch(ctx, backup, 0)
+	if p == nil {
+		t.Fatal("expected the snapshot to be prefetched")
+	}
+
+	reader, err := p.open(ctx, enc)
+	if err != nil {
+		t.Fatalf("open prefetched snapshot: %v", err)
+	}
+	received, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil || !bytes.Equal(received, stream) {
+		t.Fatalf("expected the decrypted stream, got %d bytes, %v", len(received), err)
+	}
+
+	// The snapshot stays encrypted on disk.
+	stored, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	onDisk, err := os.ReadFile(p.path)
+	if err != nil || !bytes.Equal(onDisk, stored) {
+		t.Fatalf("expected the prefetched file to hold the stored object, %v", err)
+	}
+
+	p.discard()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected the prefetched file to be removed, got %v", entries)
+	}
+}
+
+func TestPrefetchFailure(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	dir := filepath.Join(t.TempDir(), "prefetch")
+
+	backup := repositorytest.NewStore("tank/data").Full("tank/data", time.Hour)
+
+	r := &Runner{Config: &config.Config{Restore: config.Restore{PrefetchDir: dir}}, Storage: hot, Encryption: encryption.Passthrough{}}
+	p := r.startPrefetch(ctx, backup, 0)
+	if _, err := p.open(ctx, r.Encryption); err == nil {
+		t.Fatal("expected prefetching a missing snapshot to fail")
+	}
+
+	p.discard()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no prefetched file to be left, got %v", entries)
+	}
+}
@@ -0,0 +1,124 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+type RebuildOpts struct {
+	DryRun bool
+	Age    encryption.AgeOpts
+	// NoEncryption rebuilds the store of a repository initialized without
+	// encryption. No identities are needed.
+	NoEncryption bool
+}
+
+// RebuildStore reconstructs the store from the manifest objects in the
+// repository and, unless it's a dry run, replaces the existing store with it.
+// It doesn't read the existing store, so it works even if the store is
+// damaged. The first identity becomes the recipient of the rebuilt store; the
+// rest are only used to read manifests encrypted to older recipients.
+func RebuildStore(ctx context.Context, cfg *config.Config, identities []string, opts RebuildOpts) (*repository.Store, error) {
+	slog.Debug("Rebuilding store", "opts", opts, "identities", len(identities))
+
+	encryptionConfig, enc, err := rebuildEncryption(identities, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	coldStorage, err := storage.NewColdStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		slog.Error("Failed to create cold storage", "backend", cfg.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create cold storage: %w", err)
+	}
+
+	hotStorage, err := storage.NewStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		slog.Error("Failed to create storage", "backend", cfg.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	routes, err := newRoutes(ctx, cfg.Repository.Routes)
+	if err != nil {
+		slog.Error("Failed to create routes", "error", err)
+		return nil, fmt.Errorf("failed to create routes: %w", err)
+	}
+
+	routeStorage := make(map[string]storage.StrongStore, len(routes))
+	for _, route := range routes {
+		routeStorage[route.Name] = route.Storage
+	}
+
+	store, err := repository.Rebuild(ctx, repository.RebuildOpts{
+		Hot:              hotStorage,
+		Cold:             coldStorage,
+		Routes:           routeStorage,
+		Encryption:       enc,
+		EncryptionConfig: encryptionConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild store: %w", err)
+	}
+
+	if opts.DryRun {
+		slog.Warn("Dry run. The rebuilt store was not saved.")
+		return store, nil
+	}
+
+	lease, err := repository.AcquireLease(ctx, hotStorage, repository.LeaseOpts{
+		TTL:     cfg.Repository.Lock.TTL,
+		Wait:    cfg.Repository.Lock.Wait,
+		Command: strings.Join(os.Args, " "),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	defer func() {
+		if err := lease.Release(context.WithoutCancel(ctx)); err != nil {
+			slog.Warn("Failed to release the repository lock. It expires on its own.", "error", err)
+		}
+	}()
+
+	store.SetLease(lease)
+	if err := store.Save(ctx, hotStorage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return nil, fmt.Errorf("failed to save store: %w", err)
+	}
+
+	slog.Info("Saved rebuilt store")
+	return store, nil
+}
+
+// rebuildEncryption returns the encryption config of the rebuilt store, and
+// the encryption that reads the manifests.
+func rebuildEncryption(identities []string, opts RebuildOpts) (config.Encryption, encryption.Encryption, error) {
+	if opts.NoEncryption {
+		return config.Encryption{Mode: config.EncryptionModeNone}, encryption.Passthrough{}, nil
+	}
+
+	if len(identities) == 0 {
+		return config.Encryption{}, nil, &errclass.EncryptionError{Op: "rebuild", Err: encryption.ErrNoIdentity}
+	}
+
+	recipient, err := encryption.RecipientFromIdentity(identities[0])
+	if err != nil {
+		return config.Encryption{}, nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	encryptionConfig := config.Encryption{Age: config.Age{RecipientPublicKey: recipient}}
+	age, err := encryption.NewAgeFromIdentities(identities, &encryptionConfig.Age, opts.Age)
+	if err != nil {
+		return config.Encryption{}, nil, fmt.Errorf("failed to create encryption: %w", err)
+	}
+
+	return encryptionConfig, age, nil
+}
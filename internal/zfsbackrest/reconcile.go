@@ -0,0 +1,375 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// DiscrepancyKind is a kind of mismatch between the store, the objects in the
+// remote storage, and the local snapshots.
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyInvalidStore is a store that fails validation. It is only
+	// reported.
+	DiscrepancyInvalidStore DiscrepancyKind = "invalid_store"
+	// DiscrepancyMissingRemote is a backup whose snapshot object is missing
+	// from its storage. It is fixed by marking the backup damaged.
+	DiscrepancyMissingRemote DiscrepancyKind = "missing_remote"
+	// DiscrepancyMissingManifest is a backup whose manifest object is
+	// missing. It is fixed by writing the manifest again from the store.
+	DiscrepancyMissingManifest DiscrepancyKind = "missing_manifest"
+	// DiscrepancyMissingLocal is a backup taken on this host whose local
+	// snapshot is gone, so no backup can be sent from it. It is only
+	// reported.
+	DiscrepancyMissingLocal DiscrepancyKind = "missing_local"
+	// DiscrepancyMissingHold is the local snapshot of a backup that isn't
+	// held, so it can be destroyed by hand. It is fixed by holding it again.
+	DiscrepancyMissingHold DiscrepancyKind = "missing_hold"
+	// DiscrepancyUntrackedSnapshot is a local snapshot taken by zfsbackrest
+	// that the store doesn't know about. It is only reported.
+	DiscrepancyUntrackedSnapshot DiscrepancyKind = "untracked_snapshot"
+	// DiscrepancyUntrackedObject is a remote object the store doesn't refer
+	// to. It is only reported, `repo gc` deletes them.
+	DiscrepancyUntrackedObject DiscrepancyKind = "untracked_object"
+	// DiscrepancyDanglingOrphan is an orphan with neither a remote snapshot
+	// nor a local one left. It is fixed by removing it from the store.
+	DiscrepancyDanglingOrphan DiscrepancyKind = "dangling_orphan"
+)
+
+// Discrepancy is a mismatch found by Reconcile.
+type Discrepancy struct {
+	Kind    DiscrepancyKind `json:"kind"`
+	Storage string          `json:"storage,omitempty"`
+	Dataset string          `json:"dataset,omitempty"`
+	Backup  *ulid.ULID      `json:"backup,omitempty"`
+	Detail  string          `json:"detail"`
+	// Fix is how Reconcile fixes the discrepancy, or empty if it can't.
+	Fix string `json:"fix,omitempty"`
+	// Fixed is set once it was fixed.
+	Fixed bool `json:"fixed"`
+}
+
+type ReconcileOpts struct {
+	// MinAge skips orphans, objects and local snapshots of backups younger
+	// than it, which may be uploading.
+	MinAge time.Duration
+	DryRun bool
+}
+
+// reconcileState is what Reconcile compares the store with.
+type reconcileState struct {
+	// host is the host Reconcile runs on. Only the local snapshots of the
+	// backups taken on it are checked.
+	host string
+	// remote are the objects in each storage, by storage name, as named by
+	// TierStores. Storages that weren't listed aren't checked.
+	remote map[string][]storage.SnapshotObject
+	// local are the snapshots zfsbackrest took of each managed dataset that
+	// exists on this host, and whether they are held.
+	local map[string]map[ulid.ULID]bool
+}
+
+// Reconcile cross-checks the store with the objects in every storage tier
+// and route, and with the local snapshots of the managed datasets and their
+// holds. It returns the discrepancies it found, and fixes the ones it can
+// unless it's a dry run.
+func (r *Runner) Reconcile(ctx context.Context, opts ReconcileOpts) ([]*Discrepancy, error) {
+	slog.Debug("Reconciling the store", "opts", opts)
+
+	state, err := r.reconcileState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	discrepancies := planReconcile(r.Store, state, opts.MinAge, time.Now())
+	slog.Info("Reconciled the store", "discrepancies", len(discrepancies))
+	if opts.DryRun {
+		slog.Warn("Dry run. Skipping fixing anything.", "discrepancies", len(discrepancies))
+		return discrepancies, nil
+	}
+
+	return discrepancies, r.fixDiscrepancies(ctx, discrepancies)
+}
+
+func (r *Runner) reconcileState(ctx context.Context) (*reconcileState, error) {
+	host, _ := os.Hostname()
+	state := &reconcileState{
+		host:   host,
+		remote: map[string][]storage.SnapshotObject{},
+		local:  map[string]map[ulid.ULID]bool{},
+	}
+
+	for name, s := range r.TierStores() {
+		objects, err := s.ListSnapshots(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s objects: %w", name, err)
+		}
+		state.remote[name] = objects
+	}
+
+	var datasets []string
+	r.Store.View(func() { datasets = slices.Clone(r.Store.ManagedDatasets) })
+	for _, dataset := range datasets {
+		exists, err := r.ZFS.DatasetExists(ctx, dataset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if dataset exists: %w", err)
+		}
+		if !exists {
+			slog.Debug("Dataset doesn't exist on this host. Skipping its local snapshots.", "dataset", dataset)
+			continue
+		}
+
+		ids, err := r.ZFS.ListBackupSnapshots(ctx, dataset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots of %s: %w", dataset, err)
+		}
+
+		state.local[dataset] = make(map[ulid.ULID]bool, len(ids))
+		for _, id := range ids {
+			held, err := r.ZFS.SnapshotHeld(ctx, dataset, id)
+			if err != nil {
+				return nil, err
+			}
+			state.local[dataset][id] = held
+		}
+	}
+
+	return state, nil
+}
+
+// planReconcile returns the discrepancies between the store and state,
+// ordered by dataset and backup. Anything of backups created less than
+// minAge before now is left out.
+func planReconcile(store *repository.Store, state *reconcileState, minAge time.Duration, now time.Time) []*Discrepancy {
+	var discrepancies []*Discrepancy
+	add := func(d *Discrepancy) { discrepancies = append(discrepancies, d) }
+
+	if err := store.Validate(); err != nil {
+		add(&Discrepancy{Kind: DiscrepancyInvalidStore, Detail: err.Error()})
+	}
+
+	// Objects by storage, then by dataset and object name.
+	remote := map[string]map[string]bool{}
+	for name, objects := range state.remote {
+		remote[name] = make(map[string]bool, len(objects))
+		for _, object := range objects {
+			remote[name][object.Dataset+"/"+object.Snapshot] = true
+		}
+	}
+	hasRemote := func(name string, dataset string, object string) (has bool, listed bool) {
+		objects, listed := remote[name]
+		return objects[dataset+"/"+object], listed
+	}
+	recent := func(id ulid.ULID) bool {
+		return now.Sub(ulid.Time(id.Time())) < minAge
+	}
+
+	store.View(func() {
+		for id, b := range store.Backups.All() {
+			if recent(id) {
+				continue
+			}
+
+			name := backupStorageName(b)
+			if has, listed := hasRemote(name, b.Dataset, id.String()); listed && !has {
+				d := &Discrepancy{
+					Kind:    DiscrepancyMissingRemote,
+					Storage: name,
+					Dataset: b.Dataset,
+					Backup:  &id,
+					Detail:  fmt.Sprintf("%s backup has no snapshot object in the %s storage", b.Type, name),
+				}
+				if b.Damage == nil {
+					d.Fix = "mark the backup damaged"
+				}
+				add(d)
+			}
+
+			if has, listed := hasRemote(string(repository.TierHot), b.Dataset, repository.ManifestObjectName(id)); listed && !has {
+				add(&Discrepancy{
+					Kind:    DiscrepancyMissingManifest,
+					Storage: string(repository.TierHot),
+					Dataset: b.Dataset,
+					Backup:  &id,
+					Detail:  "backup has no manifest object",
+					Fix:     "write the manifest again",
+				})
+			}
+
+			// Imported backups have no snapshot named after them.
+			local, ok := state.local[b.Dataset]
+			if !ok || b.Imported != nil || (b.Origin != nil && b.Origin.Host != state.host) {
+				continue
+			}
+
+			held, exists := local[id]
+			switch {
+			case !exists:
+				add(&Discrepancy{
+					Kind:    DiscrepancyMissingLocal,
+					Dataset: b.Dataset,
+					Backup:  &id,
+					Detail:  fmt.Sprintf("%s backup has no local snapshot", b.Type),
+				})
+			case !held:
+				add(&Discrepancy{
+					Kind:    DiscrepancyMissingHold,
+					Dataset: b.Dataset,
+					Backup:  &id,
+					Detail:  "local snapshot of the backup isn't held",
+					Fix:     "hold the snapshot",
+				})
+			}
+		}
+
+		for id, o := range store.Orphans {
+			// Partial uploads are cleaned up by the next backup.
+			if !o.SafeToDelete(minAge, now) || o.Reason == repository.OrphanReasonPartialUpload {
+				continue
+			}
+
+			name := backupStorageName(&o.Backup)
+			has, listed := hasRemote(name, o.Backup.Dataset, id.String())
+			if !listed || has {
+				continue
+			}
+			if _, ok := state.local[o.Backup.Dataset][id]; ok {
+				continue
+			}
+
+			add(&Discrepancy{
+				Kind:    DiscrepancyDanglingOrphan,
+				Storage: name,
+				Dataset: o.Backup.Dataset,
+				Backup:  &id,
+				Detail:  fmt.Sprintf("%s orphan has neither a snapshot object nor a local snapshot", o.Reason),
+				Fix:     "remove the orphan from the store",
+			})
+		}
+
+		for dataset, local := range state.local {
+			for id := range local {
+				if recent(id) {
+					continue
+				}
+				if _, ok := store.Backups.Get(id); ok {
+					continue
+				}
+				if _, ok := store.Orphans[id]; ok {
+					continue
+				}
+				if _, ok := store.Trash[id]; ok {
+					continue
+				}
+
+				add(&Discrepancy{
+					Kind:    DiscrepancyUntrackedSnapshot,
+					Dataset: dataset,
+					Backup:  &id,
+					Detail:  "local snapshot isn't tracked by the store",
+				})
+			}
+		}
+	})
+
+	for name, objects := range state.remote {
+		for _, object := range store.UntrackedObjects(objects, minAge, now) {
+			add(&Discrepancy{
+				Kind:    DiscrepancyUntrackedObject,
+				Storage: name,
+				Dataset: object.Dataset,
+				Detail:  fmt.Sprintf("object %s isn't tracked by the store", object.Snapshot),
+			})
+		}
+	}
+
+	sort.SliceStable(discrepancies, func(i, j int) bool {
+		a, b := discrepancies[i], discrepancies[j]
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		if (a.Backup == nil) != (b.Backup == nil) {
+			return a.Backup != nil
+		}
+		if a.Backup != nil && *a.Backup != *b.Backup {
+			return a.Backup.Compare(*b.Backup) < 0
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Detail < b.Detail
+	})
+
+	return discrepancies
+}
+
+// backupStorageName is the name of the storage the backup's snapshot lives
+// in, as named by TierStores.
+func backupStorageName(b *repository.Backup) string {
+	if b.Route != "" {
+		return (&Route{Name: b.Route}).StorageName()
+	}
+
+	return string(b.StorageTier())
+}
+
+// fixDiscrepancies fixes the discrepancies that can be fixed, and saves the
+// store if it changed.
+func (r *Runner) fixDiscrepancies(ctx context.Context, discrepancies []*Discrepancy) error {
+	changed := false
+	for _, d := range discrepancies {
+		if d.Fix == "" {
+			continue
+		}
+
+		slog.Info("Fixing discrepancy", "kind", d.Kind, "dataset", d.Dataset, "backup", d.Backup, "fix", d.Fix)
+		switch d.Kind {
+		case DiscrepancyMissingRemote:
+			r.Store.Update(func() {
+				if b, ok := r.Store.Backups.Get(*d.Backup); ok {
+					b.MarkDamaged(time.Now(), "snapshot object missing from the "+d.Storage+" storage")
+				}
+			})
+			changed = true
+		case DiscrepancyMissingManifest:
+			var backup repository.Backup
+			r.Store.View(func() { backup = *r.Store.Backups.Find(*d.Backup) })
+			if err := repository.WriteManifest(ctx, r.Storage, r.Encryption, &backup); err != nil {
+				return fmt.Errorf("failed to write manifest of backup %s: %w", d.Backup, err)
+			}
+		case DiscrepancyMissingHold:
+			if err := r.ZFS.HoldSnapshot(ctx, d.Dataset, *d.Backup); err != nil {
+				return fmt.Errorf("failed to hold snapshot of backup %s: %w", d.Backup, err)
+			}
+		case DiscrepancyDanglingOrphan:
+			var orphan repository.Backup
+			r.Store.View(func() { orphan = r.Store.Orphans[*d.Backup].Backup })
+			if err := r.Store.RemoveOrphan(ctx, orphan); err != nil {
+				return fmt.Errorf("failed to remove orphan %s: %w", d.Backup, err)
+			}
+			changed = true
+		}
+		d.Fixed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return fmt.Errorf("failed to save store: %w", err)
+	}
+
+	return nil
+}
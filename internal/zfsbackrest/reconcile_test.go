@@ -0,0 +1,136 @@
+package zfsbackrest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	enc := encryption.Passthrough{}
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 36*time.Hour)
+	recent := b.Full("tank/data", time.Hour)
+	dangling := b.Full("tank/data", 96*time.Hour)
+	b.Orphan(dangling, repository.OrphanReasonStartedDeletion)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	writeObject := func(id ulid.ULID) {
+		t.Helper()
+		w, err := hot.OpenSnapshotWriteStream(ctx, "tank/data", id.String(), -1, enc)
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write([]byte("snapshot"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	// The diff's snapshot object is missing, and the incremental's
+	// manifest. The recent backup is still uploading.
+	leftover := ulid.MustNew(ulid.Timestamp(time.Now().Add(-48*time.Hour)), ulid.DefaultEntropy())
+	for _, backup := range []*repository.Backup{full, incr} {
+		writeObject(backup.ID)
+	}
+	writeObject(leftover)
+	for _, backup := range []*repository.Backup{full, diff} {
+		if err := repository.WriteManifest(ctx, hot, enc, backup); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+	}
+
+	objects, err := hot.ListSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("list objects: %v", err)
+	}
+
+	untracked := ulid.MustNew(ulid.Timestamp(time.Now().Add(-48*time.Hour)), ulid.DefaultEntropy())
+	state := &reconcileState{
+		remote: map[string][]storage.SnapshotObject{string(repository.TierHot): objects},
+		local: map[string]map[ulid.ULID]bool{
+			"tank/data": {full.ID: true, diff.ID: false, untracked: true},
+		},
+	}
+
+	discrepancies := planReconcile(store, state, 24*time.Hour, time.Now())
+	kinds := map[DiscrepancyKind][]ulid.ULID{}
+	for _, d := range discrepancies {
+		var id ulid.ULID
+		if d.Backup != nil {
+			id = *d.Backup
+		}
+		kinds[d.Kind] = append(kinds[d.Kind], id)
+	}
+
+	want := map[DiscrepancyKind][]ulid.ULID{
+		DiscrepancyMissingRemote:     {diff.ID},
+		DiscrepancyMissingManifest:   {incr.ID},
+		DiscrepancyMissingHold:       {diff.ID},
+		DiscrepancyMissingLocal:      {incr.ID},
+		DiscrepancyDanglingOrphan:    {dangling.ID},
+		DiscrepancyUntrackedSnapshot: {untracked},
+		DiscrepancyUntrackedObject:   {{}},
+	}
+	if len(kinds) != len(want) {
+		t.Fatalf("expected %d kinds of discrepancies, got %+v", len(want), kinds)
+	}
+	for kind, ids := range want {
+		if len(kinds[kind]) != len(ids) || kinds[kind][0] != ids[0] {
+			t.Errorf("expected %s for %v, got %v", kind, ids, kinds[kind])
+		}
+	}
+	for _, d := range discrepancies {
+		if d.Backup != nil && *d.Backup == recent.ID {
+			t.Errorf("expected the recent backup to be left alone, got %+v", d)
+		}
+	}
+
+	// Holds need ZFS, the other fixes don't.
+	var fixable []*Discrepancy
+	for _, d := range discrepancies {
+		if d.Kind != DiscrepancyMissingHold {
+			fixable = append(fixable, d)
+		}
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: enc}
+	if err := r.fixDiscrepancies(ctx, fixable); err != nil {
+		t.Fatalf("fix: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if loaded.Backups.Find(diff.ID).Damage == nil {
+		t.Error("expected the backup without a snapshot object to be marked damaged")
+	}
+	if _, ok := loaded.Orphans[dangling.ID]; ok {
+		t.Error("expected the dangling orphan to be removed")
+	}
+	if _, err := repository.ReadManifest(ctx, hot, enc, "tank/data", incr.ID); err != nil {
+		t.Errorf("expected the missing manifest to be written again: %v", err)
+	}
+	for _, d := range fixable {
+		if d.Fixed != (d.Fix != "") {
+			t.Errorf("expected only the fixable discrepancies to be fixed, got %+v", d)
+		}
+	}
+}
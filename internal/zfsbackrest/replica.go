@@ -0,0 +1,375 @@
+package zfsbackrest
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// Replica is a storage target backups are replicated to.
+type Replica struct {
+	Name    string
+	Storage storage.StrongStore
+}
+
+// newReplicas creates the storage of every configured replica.
+func newReplicas(ctx context.Context, cfgs []config.Replica) ([]*Replica, error) {
+	seen := make(map[string]bool, len(cfgs))
+	replicas := make([]*Replica, 0, len(cfgs))
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		key := fmt.Sprintf("repository.replicas[%d].name", i)
+
+		if cfg.Name == "" {
+			return nil, &errclass.ConfigError{Key: key, Err: errors.New("required")}
+		}
+		if seen[cfg.Name] {
+			return nil, &errclass.ConfigError{Key: key, Err: fmt.Errorf("duplicate replica %q", cfg.Name)}
+		}
+		seen[cfg.Name] = true
+
+		replicaStorage, err := storage.NewReplicaStrongStore(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage of replica %s: %w", cfg.Name, err)
+		}
+
+		replicas = append(replicas, &Replica{Name: cfg.Name, Storage: replicaStorage})
+	}
+
+	return replicas, nil
+}
+
+// openSnapshotWriteStream opens the write stream of a backup's snapshot in the
+// repository, or the route it's sent to, and in every replica the backup isn't
+// uploaded to yet. Writes fan out to all of them. A replica that fails is
+// recorded as failed in the manifest and dropped; only the repository failing
+// fails the upload. The snapshot is written encrypted already, so they all
+// store the same object.
+func (r *Runner) openSnapshotWriteStream(
+	ctx context.Context,
+	data *BackupFSMData,
+	size int64,
+) (io.WriteCloser, error) {
+	snapshotStorage, err := r.snapshotStorage(data.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	writeStream, err := snapshotStorage.OpenSnapshotWriteStream(ctx, data.Dataset, data.Manifest.ID.String(), size, encryption.Passthrough{})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &replicatingWriteCloser{WriteCloser: writeStream, manifest: data.Manifest}
+	for _, replica := range r.Replicas {
+		if data.Manifest.Replicated(replica.Name) {
+			continue
+		}
+
+		replicaStream, err := replica.Storage.OpenSnapshotWriteStream(ctx, data.Dataset, data.Manifest.ID.String(), size, encryption.Passthrough{})
+		if err != nil {
+			slog.Warn("Failed to open replica snapshot write stream. Run `zfsbackrest replicate` to retry.",
+				"replica", replica.Name, "backup", data.Manifest.ID, "error", err)
+			data.Manifest.MarkReplicationFailed(replica.Name, time.Now(), err.Error())
+			continue
+		}
+
+		w.replicas = append(w.replicas, &replicaWriteCloser{WriteCloser: replicaStream, name: replica.Name})
+	}
+
+	return w, nil
+}
+
+// replicatingWriteCloser writes a snapshot to the repository and its replicas
+// at once.
+type replicatingWriteCloser struct {
+	io.WriteCloser
+	manifest *repository.Backup
+	replicas []*replicaWriteCloser
+}
+
+type replicaWriteCloser struct {
+	io.WriteCloser
+	name string
+	err  error
+}
+
+func (w *replicatingWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+
+	for _, replica := range w.replicas {
+		if replica.err != nil {
+			continue
+		}
+
+		if _, replica.err = replica.Write(p[:n]); replica.err != nil {
+			slog.Warn("Failed to write to replica. Run `zfsbackrest replicate` to retry.",
+				"replica", replica.name, "backup", w.manifest.ID, "error", replica.err)
+		}
+	}
+
+	return n, err
+}
+
+// Close finishes the uploads, and records which replicas the snapshot was
+// uploaded to. A replica whose writes failed is closed as well, which doesn't
+// commit anything since its upload failed already.
+func (w *replicatingWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+
+	for _, replica := range w.replicas {
+		replica.err = cmp.Or(replica.err, replica.Close())
+		if replica.err != nil {
+			slog.Warn("Failed to upload snapshot to replica. Run `zfsbackrest replicate` to retry.",
+				"replica", replica.name, "backup", w.manifest.ID, "error", replica.err)
+			w.manifest.MarkReplicationFailed(replica.name, time.Now(), replica.err.Error())
+			continue
+		}
+
+		w.manifest.MarkReplicated(replica.name, time.Now())
+	}
+
+	return err
+}
+
+// writeReplicaManifests writes the manifest of a backup to the replicas its
+// snapshot was uploaded to. A replica that fails is recorded as failed.
+func (r *Runner) writeReplicaManifests(ctx context.Context, manifest *repository.Backup) {
+	for _, replica := range r.Replicas {
+		if !manifest.Replicated(replica.Name) {
+			continue
+		}
+
+		if err := repository.WriteManifest(ctx, replica.Storage, r.Encryption, manifest); err != nil {
+			slog.Warn("Failed to upload manifest to replica. Run `zfsbackrest replicate` to retry.",
+				"replica", replica.Name, "backup", manifest.ID, "error", err)
+			manifest.MarkReplicationFailed(replica.Name, time.Now(), err.Error())
+		}
+	}
+}
+
+// deleteFromReplicas removes a backup's snapshot and manifest from every
+// replica. A failure only leaves objects behind in a replica, so it is logged
+// rather than failing the delete.
+func (r *Runner) deleteFromReplicas(ctx context.Context, backup *repository.Backup) {
+	for _, replica := range r.Replicas {
+		if err := replica.Storage.DeleteSnapshot(ctx, backup.Dataset, backup.ID.String()); err != nil {
+			slog.Warn("Failed to delete snapshot from replica", "replica", replica.Name, "backup", backup.ID, "error", err)
+			continue
+		}
+
+		if err := repository.DeleteManifest(ctx, replica.Storage, backup.Dataset, backup.ID); err != nil {
+			slog.Warn("Failed to delete manifest from replica", "replica", replica.Name, "backup", backup.ID, "error", err)
+		}
+	}
+}
+
+type ReplicateState string
+type ReplicateAction string
+
+const (
+	ReplicateStateInitial      ReplicateState = "initial"
+	ReplicateStateCopied       ReplicateState = "copied"
+	ReplicateStateUpdatedStore ReplicateState = "updated_store"
+	ReplicateStateCompleted    ReplicateState = "completed"
+)
+
+type ReplicateFSMData struct {
+	Backup  *repository.Backup
+	Replica *Replica
+}
+
+type ReplicateOpts struct {
+	// Replica limits replication to the replica with this name.
+	Replica string
+	DryRun  bool
+}
+
+// Replicate uploads every backup that isn't in a replica to it: the ones whose
+// upload to it failed, and the ones taken before it was added. A backup that
+// fails is recorded as failed, and the others are still replicated.
+func (r *Runner) Replicate(ctx context.Context, opts ReplicateOpts) error {
+	if len(r.Replicas) == 0 {
+		return &errclass.ConfigError{Key: "repository.replicas", Err: errors.New("no replicas are configured")}
+	}
+
+	replicas := r.Replicas
+	if opts.Replica != "" {
+		replicas = nil
+		for _, replica := range r.Replicas {
+			if replica.Name == opts.Replica {
+				replicas = append(replicas, replica)
+			}
+		}
+
+		if len(replicas) == 0 {
+			return &errclass.ValidationError{Subject: "replica", Err: fmt.Errorf("unknown replica %q", opts.Replica)}
+		}
+	}
+
+	failed := 0
+	for _, replica := range replicas {
+		var pending []*repository.Backup
+		r.Store.View(func() { pending = r.Store.Backups.PendingReplication(replica.Name) })
+		slog.Info("Replicating backups", "replica", replica.Name, "count", len(pending), "dry_run", opts.DryRun)
+
+		for _, backup := range pending {
+			err := r.ReplicateBackup(ctx, replica, backup, opts)
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+
+			slog.Error("Failed to replicate backup", "replica", replica.Name, "backup", backup.ID, "error", err)
+			failed++
+
+			r.Store.Update(func() { backup.MarkReplicationFailed(replica.Name, time.Now(), err.Error()) })
+			if err := r.Store.Save(ctx, r.Storage); err != nil {
+				slog.Error("Failed to save store", "error", err)
+				return fmt.Errorf("failed to save store: %w", err)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to replicate %d backups", failed)
+	}
+
+	return nil
+}
+
+// ReplicateBackup copies a backup's snapshot and manifest to a replica, and
+// records it in the store. The snapshot is copied as-is and never decrypted.
+func (r *Runner) ReplicateBackup(ctx context.Context, replica *Replica, backup *repository.Backup, opts ReplicateOpts) error {
+	slog.Debug("Replicating backup", "replica", replica.Name, "backup", backup.ID, "dataset", backup.Dataset, "opts", opts)
+
+	fsm := r.createReplicateFSM(replica, backup)
+
+	if opts.DryRun {
+		return fsm.Run(ctx, "dry_run")
+	}
+
+	return fsm.RunSequence(ctx, "copy_to_replica", "update_store", "complete")
+}
+
+func (r *Runner) createReplicateFSM(replica *Replica, backup *repository.Backup) *fsm.FSM[ReplicateState, ReplicateAction, ReplicateFSMData] {
+	return fsm.NewFSM(
+		"replicate",
+		fsm.State[ReplicateState, ReplicateFSMData]{
+			ID:   ReplicateStateInitial,
+			Data: &ReplicateFSMData{Backup: backup, Replica: replica},
+		},
+		map[ReplicateAction]fsm.Transition[ReplicateState, ReplicateFSMData]{
+			"dry_run": {
+				From: ReplicateStateInitial,
+				To:   ReplicateStateCompleted,
+				Run: func(ctx context.Context, data *ReplicateFSMData) error {
+					slog.Warn("Dry run. Backup would be replicated.",
+						"replica", data.Replica.Name,
+						"dataset", data.Backup.Dataset,
+						"backup", data.Backup.ID,
+						"size", data.Backup.Size,
+					)
+					return nil
+				},
+			},
+			"copy_to_replica": {
+				From: ReplicateStateInitial,
+				To:   ReplicateStateCopied,
+				Run: func(ctx context.Context, data *ReplicateFSMData) error {
+					slog.Debug("Copying snapshot to replica", "replica", data.Replica.Name, "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+
+					snapshotStorage, err := r.snapshotStorage(data.Backup)
+					if err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					if archive, ok := storage.As[storage.ArchiveStore](snapshotStorage); ok {
+						err := archive.RetrieveSnapshot(ctx, data.Backup.Dataset, data.Backup.ID.String(), true)
+						if err != nil {
+							slog.Error("Failed to retrieve archived snapshot", "error", err)
+							return fmt.Errorf("failed to retrieve archived snapshot: %w", err)
+						}
+					}
+
+					reader, err := snapshotStorage.OpenSnapshotReadStream(ctx, data.Backup.Dataset, data.Backup.ID.String(), encryption.Passthrough{})
+					if err != nil {
+						slog.Error("Failed to open snapshot read stream", "error", err)
+						return fmt.Errorf("failed to open snapshot read stream: %w", err)
+					}
+					defer reader.Close()
+
+					// The copy passes the ciphertext through, but the object is
+					// encrypted with the repository's encryption.
+					ctx = storage.WithSnapshotMetadata(ctx, data.Backup.ObjectMetadata(storage.ObjectKindSnapshot, r.Encryption))
+					writer, err := data.Replica.Storage.OpenSnapshotWriteStream(ctx, data.Backup.Dataset, data.Backup.ID.String(), -1, encryption.Passthrough{})
+					if err != nil {
+						slog.Error("Failed to open replica snapshot write stream", "error", err)
+						return fmt.Errorf("failed to open replica snapshot write stream: %w", err)
+					}
+
+					wrappedWriter := util.NewLoggedWriter("replicate "+data.Backup.ID.String(), writer, -1)
+					if _, err := io.Copy(wrappedWriter, reader); err != nil {
+						_ = wrappedWriter.Close()
+						slog.Error("Failed to copy snapshot", "error", err)
+						return fmt.Errorf("failed to copy snapshot: %w", err)
+					}
+
+					if err := wrappedWriter.Close(); err != nil {
+						slog.Error("Failed to close replica snapshot write stream", "error", err)
+						return fmt.Errorf("failed to close replica snapshot write stream: %w", err)
+					}
+
+					if err := repository.WriteManifest(ctx, data.Replica.Storage, r.Encryption, data.Backup); err != nil {
+						slog.Error("Failed to upload manifest to replica", "error", err)
+						return fmt.Errorf("failed to upload manifest to replica: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"update_store": {
+				From: ReplicateStateCopied,
+				To:   ReplicateStateUpdatedStore,
+				Run: func(ctx context.Context, data *ReplicateFSMData) error {
+					slog.Debug("Recording replication in store", "replica", data.Replica.Name, "backup", data.Backup.ID)
+
+					r.Store.Update(func() { data.Backup.MarkReplicated(data.Replica.Name, time.Now()) })
+					if err := r.Store.Save(ctx, r.Storage); err != nil {
+						slog.Error("Failed to save store", "error", err)
+						return fmt.Errorf("failed to save store: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"complete": {
+				From: ReplicateStateUpdatedStore,
+				To:   ReplicateStateCompleted,
+				Run: func(ctx context.Context, data *ReplicateFSMData) error {
+					slog.Info("Backup replicated", "replica", data.Replica.Name, "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+					return nil
+				},
+			},
+		},
+		fsm.RetryExponentialBackoffConfig{
+			MaxRetries:     5,
+			WaitIncrements: 2 * time.Second,
+			MaxWait:        10 * time.Second,
+		},
+	)
+}
@@ -0,0 +1,127 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestReplicatingWriteStream(t *testing.T) {
+	ctx := context.Background()
+	primary := storagetest.NewMemoryStore()
+	healthy := storagetest.NewMemoryStore()
+	broken := storagetest.NewMemoryStore()
+	done := storagetest.NewMemoryStore()
+	broken.FailNext(storagetest.OpWrite, errors.New("connection refused"))
+
+	manifest := &repository.Backup{ID: ulid.Make(), Type: repository.BackupTypeFull, CreatedAt: time.Now(), Dataset: "tank/data"}
+	manifest.MarkReplicated("done", time.Now())
+	data := &BackupFSMData{Dataset: manifest.Dataset, Manifest: manifest}
+
+	r := &Runner{
+		Config:  &config.Config{},
+		Storage: primary,
+		Replicas: []*Replica{
+			{Name: "healthy", Storage: healthy},
+			{Name: "broken", Storage: broken},
+			{Name: "done", Storage: done},
+		},
+	}
+
+	w, err := r.openSnapshotWriteStream(ctx, data, -1)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	if _, err := w.Write([]byte("snapshot")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	for name, s := range map[string]*storagetest.MemoryStore{"primary": primary, "healthy": healthy} {
+		if content, ok := s.RawSnapshot(manifest.Dataset, manifest.ID.String()); !ok || string(content) != "snapshot" {
+			t.Fatalf("expected the snapshot in %s, got %q", name, content)
+		}
+	}
+	if _, ok := done.RawSnapshot(manifest.Dataset, manifest.ID.String()); ok {
+		t.Fatal("expected the replica the backup is in already to be skipped")
+	}
+
+	if !manifest.Replicated("healthy") {
+		t.Fatal("expected the healthy replica to be recorded as uploaded")
+	}
+	if got := manifest.Replicas["broken"]; got == nil || got.Status != repository.ReplicationFailed {
+		t.Fatalf("expected the broken replica to be recorded as failed, got %+v", got)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	replica := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	pending := b.Full("tank/data", 2*time.Hour)
+	replicated := b.Full("tank/data", time.Hour)
+	replicated.MarkReplicated("offsite", time.Now())
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	ciphertext := []byte("already encrypted")
+	for _, backup := range []*repository.Backup{pending, replicated} {
+		w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write(ciphertext)
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	r := &Runner{
+		Config:     &config.Config{},
+		Store:      store,
+		Storage:    hot,
+		Replicas:   []*Replica{{Name: "offsite", Storage: replica}},
+		Encryption: encryption.Passthrough{},
+	}
+
+	if err := r.Replicate(ctx, ReplicateOpts{Replica: "nas"}); err == nil {
+		t.Fatal("expected an unknown replica to be rejected")
+	}
+
+	if err := r.Replicate(ctx, ReplicateOpts{}); err != nil {
+		t.Fatalf("replicate: %v", err)
+	}
+
+	if content, ok := replica.RawSnapshot(pending.Dataset, pending.ID.String()); !ok || !bytes.Equal(content, ciphertext) {
+		t.Fatalf("expected the pending snapshot to be copied as-is to the replica, got %q", content)
+	}
+	if _, ok := replica.RawSnapshot(pending.Dataset, repository.ManifestObjectName(pending.ID)); !ok {
+		t.Fatal("expected the manifest to be written to the replica")
+	}
+	if _, ok := replica.RawSnapshot(replicated.Dataset, replicated.ID.String()); ok {
+		t.Fatal("expected the replicated backup to be skipped")
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if !loaded.Backups.Find(pending.ID).Replicated("offsite") {
+		t.Fatal("expected the pending backup to be recorded as replicated")
+	}
+}
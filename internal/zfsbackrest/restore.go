@@ -2,20 +2,24 @@ package zfsbackrest
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/gargakshit/zfsbackrest/fsm"
 	"github.com/gargakshit/zfsbackrest/internal/util"
 	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
 	"github.com/gargakshit/zfsbackrest/zfs"
 	"github.com/oklog/ulid/v2"
 )
 
 func (r *Runner) GetLatestRestoreBackupID(ctx context.Context, dataset string) (ulid.ULID, error) {
 	var latestRestorableBackup *repository.Backup
-	for _, backup := range r.Store.Backups {
+	for _, backup := range r.Store.Backups.All() {
 		if backup.Dataset == dataset &&
 			(latestRestorableBackup == nil || backup.CreatedAt.After(latestRestorableBackup.CreatedAt)) {
 			latestRestorableBackup = backup
@@ -23,56 +27,232 @@ func (r *Runner) GetLatestRestoreBackupID(ctx context.Context, dataset string) (
 	}
 
 	if latestRestorableBackup == nil {
-		return ulid.ULID{}, fmt.Errorf("no restorable backup found for dataset %s", dataset)
+		return ulid.ULID{}, &errclass.ValidationError{Subject: "dataset", Err: fmt.Errorf("no restorable backup found for dataset %s", dataset)}
 	}
 
 	return latestRestorableBackup.ID, nil
 }
 
+var (
+	ErrSnapshotGUIDMismatch = errors.New("received snapshot is not the snapshot that was backed up")
+	ErrWrongIdentity        = errors.New("the identities can't decrypt the backup. Pass the identity of the recipient it was encrypted to")
+)
+
 type RestoreState string
 type RestoreAction string
 
 const (
 	RestoreStateInitial              RestoreState = "initial"
 	RestoreStateParentSnapshotExists RestoreState = "parent_snapshot_exists"
+	RestoreStateRetrieved            RestoreState = "retrieved"
 	RestoreStateRestored             RestoreState = "restored"
+	RestoreStateVerified             RestoreState = "verified"
 	RestoreStateCompleted            RestoreState = "completed"
 )
 
 type RestoreFSMData struct {
 	DestinationDataset string
 	Backup             *repository.Backup
+
+	// prefetched is the download of the snapshot started while its parent
+	// was received, if any.
+	prefetched *prefetch
 }
 
 // RestoreRecursive restores a backup and all its dependencies recursively.
+// While a backup is received, the next one of the chain is prefetched if
+// restore.prefetch_dir is set.
 func (r *Runner) RestoreRecursive(ctx context.Context, destinationDataset string, backupID ulid.ULID) error {
 	slog.Debug("Restoring recursively", "destination-dataset", destinationDataset, "backup-id", backupID)
 
-	backup, ok := r.Store.Backups[backupID]
-	if !ok {
-		slog.Error("Backup not found", "backup-id", backupID)
-		return fmt.Errorf("backup %s not found", backupID)
+	chain, err := r.restorableChain(ctx, backupID)
+	if err != nil {
+		return err
 	}
 
-	if backup.DependsOn != nil {
-		slog.Debug("Parent backup found. Restoring parent first.", "destination-dataset", destinationDataset, "backup", backup)
-		err := r.RestoreRecursive(ctx, destinationDataset, *backup.DependsOn)
-		if err != nil {
+	if err := checkRestoreStreams(chain); err != nil {
+		return err
+	}
+
+	if err := r.checkRestoreIdentities(ctx, chain); err != nil {
+		return err
+	}
+
+	maxSize, err := prefetchMaxSize(&r.Config.Restore)
+	if err != nil {
+		return err
+	}
+
+	// Archived snapshots can take hours to retrieve. Request the whole chain up
+	// front so the retrievals run in parallel instead of one after another.
+	r.requestRetrievalChain(ctx, backupID)
+
+	// Only the next backup is prefetched, so at most two snapshots are on
+	// disk at once: the one being received, and the one after it.
+	var next *prefetch
+	defer func() {
+		if next != nil {
+			next.discard()
+		}
+	}()
+
+	for i, backup := range chain {
+		current := next
+		next = nil
+		if i+1 < len(chain) {
+			next = r.startPrefetch(ctx, chain[i+1], maxSize)
+		}
+
+		slog.Debug("Restoring backup", "destination-dataset", destinationDataset, "backup", backup)
+		err := r.restore(ctx, destinationDataset, backup.ID, current)
+		if current != nil {
+			current.discard()
+		}
+
+		if err != nil && i < len(chain)-1 {
 			slog.Error("Failed to restore parent", "error", err)
 			return fmt.Errorf("failed to restore parent: %w", err)
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-		slog.Debug("Parent backup restored", "destination-dataset", destinationDataset, "backup", backup)
+// restorableChain returns the backups restoring backupID receives, parents
+// first, after checking every one of them is in the store and has its
+// snapshot object in the storage.
+func (r *Runner) restorableChain(ctx context.Context, backupID ulid.ULID) ([]*repository.Backup, error) {
+	chain, err := r.Store.Restorable(backupID, func(backup *repository.Backup) (bool, error) {
+		return r.hasSnapshotObject(ctx, backup)
+	})
+	if err != nil {
+		if isBrokenChain(err) {
+			return nil, &errclass.ValidationError{Subject: "backup " + backupID.String(), Err: err}
+		}
+		return nil, err
 	}
 
-	slog.Debug("Restoring backup", "destination-dataset", destinationDataset, "backup", backup)
-	return r.Restore(ctx, destinationDataset, backupID)
+	return chain, nil
+}
+
+// isBrokenChain reports whether Store.Restorable failed because a backup of
+// the chain is missing, rather than because the storage couldn't be read.
+func isBrokenChain(err error) bool {
+	return errors.Is(err, repository.ErrBackupNotFound) ||
+		errors.Is(err, repository.ErrParentBackupNotFound) ||
+		errors.Is(err, repository.ErrBackupChainCycle) ||
+		errors.Is(err, repository.ErrBackupOrphaned) ||
+		errors.Is(err, repository.ErrBackupInTrash) ||
+		errors.Is(err, repository.ErrSnapshotObjectMissing)
+}
+
+// hasSnapshotObject reports whether the snapshot object of a backup exists in
+// its storage.
+func (r *Runner) hasSnapshotObject(ctx context.Context, backup *repository.Backup) (bool, error) {
+	snapshotStorage, err := r.snapshotStorage(backup)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = snapshotStorage.StatSnapshot(ctx, backup.Dataset, backup.ID.String())
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, errclass.ErrNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// checkRestoreStreams checks zfs recv can receive the stream of every backup
+// of the chain on top of its parent's, before any snapshot is downloaded.
+func checkRestoreStreams(chain []*repository.Backup) error {
+	var parent *repository.Backup
+	for _, backup := range chain {
+		if err := backup.CheckReceivable(parent); err != nil {
+			slog.Error("Backup stream can't be restored", "backup", backup.ID, "error", err)
+			return &errclass.ValidationError{Subject: "backup " + backup.ID.String(), Err: err}
+		}
+		parent = backup
+	}
+
+	return nil
+}
+
+// checkRestoreIdentities checks the identities can decrypt the chain before
+// any snapshot is downloaded, by decrypting the manifest of one backup per
+// recipient the chain is encrypted to. Manifests are small, and always in the
+// hot storage, so a wrong identity fails right away, instead of after the
+// parents were received. Backups whose manifest can't be read are left to
+// fail when they are restored.
+func (r *Runner) checkRestoreIdentities(ctx context.Context, chain []*repository.Backup) error {
+	checked := make(map[string]bool)
+	for _, backup := range chain {
+		if backup.EncryptionScheme() == repository.EncryptionSchemeNone || checked[backup.Recipient] {
+			continue
+		}
+
+		_, err := repository.ReadManifest(ctx, r.Storage, r.Encryption, backup.Dataset, backup.ID)
+		switch {
+		case err == nil:
+			checked[backup.Recipient] = true
+		case errclass.Of(err) == errclass.ClassEncryption:
+			recipient := backup.Recipient
+			if recipient == "" {
+				recipient = "an unrecorded recipient"
+			}
+			slog.Error("The identities can't decrypt the backup", "backup", backup.ID, "recipient", recipient, "error", err)
+			return &errclass.EncryptionError{Op: "check identity", Err: fmt.Errorf("%w: backup %s is encrypted to %s: %w", ErrWrongIdentity, backup.ID, recipient, err)}
+		default:
+			slog.Warn("Can't read the backup's manifest to check the identities", "backup", backup.ID, "error", err)
+		}
+	}
+
+	slog.Debug("Identities can decrypt the backup chain", "backups", len(chain), "recipients", len(checked))
+	return nil
+}
+
+// requestRetrievalChain requests the retrieval of every archived snapshot in
+// a backup's chain without waiting for them. Failures are only logged; the
+// restore FSM requests the retrieval again before reading a snapshot.
+func (r *Runner) requestRetrievalChain(ctx context.Context, backupID ulid.ULID) {
+	for {
+		backup, ok := r.Store.Backups.Get(backupID)
+		if !ok {
+			return
+		}
+
+		snapshotStorage, err := r.snapshotStorage(backup)
+		if err != nil {
+			return
+		}
+
+		if archive, ok := storage.As[storage.ArchiveStore](snapshotStorage); ok {
+			err := archive.RetrieveSnapshot(ctx, backup.Dataset, backup.ID.String(), false)
+			if err != nil {
+				slog.Warn("Failed to request snapshot retrieval", "backup", backup.ID, "error", err)
+			}
+		}
+
+		if backup.DependsOn == nil {
+			return
+		}
+		backupID = *backup.DependsOn
+	}
 }
 
 func (r *Runner) Restore(ctx context.Context, destinationDataset string, backupID ulid.ULID) error {
+	return r.restore(ctx, destinationDataset, backupID, nil)
+}
+
+func (r *Runner) restore(ctx context.Context, destinationDataset string, backupID ulid.ULID, prefetched *prefetch) error {
 	slog.Info("Restoring", "destination-dataset", destinationDataset, "backup-id", backupID)
 
-	fsm, err := r.createRestoreFSM(destinationDataset, backupID)
+	fsm, err := r.createRestoreFSM(destinationDataset, backupID, prefetched)
 	if err != nil {
 		slog.Error("Failed to create restore FSM", "error", err)
 		return fmt.Errorf("failed to create restore FSM: %w", err)
@@ -81,23 +261,28 @@ func (r *Runner) Restore(ctx context.Context, destinationDataset string, backupI
 	slog.Debug("Running restore FSM",
 		"destination-dataset", destinationDataset,
 		"backup-id", backupID,
-		"sequence", []RestoreAction{"check_parent_snapshot", "restore", "complete"},
+		"sequence", []RestoreAction{"check_parent_snapshot", "retrieve", "restore", "verify_guid", "complete"},
 	)
-	return fsm.RunSequence(ctx, "check_parent_snapshot", "restore", "complete")
+	return fsm.RunSequence(ctx, "check_parent_snapshot", "retrieve", "restore", "verify_guid", "complete")
 }
 
-func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID) (*fsm.FSM[RestoreState, RestoreAction, RestoreFSMData], error) {
+func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID, prefetched *prefetch) (*fsm.FSM[RestoreState, RestoreAction, RestoreFSMData], error) {
 	slog.Debug("Creating restore FSM", "destination-dataset", destinationDataset, "backup-id", backupID)
 
-	backup, ok := r.Store.Backups[backupID]
+	backup, ok := r.Store.Backups.Get(backupID)
 	if !ok {
 		slog.Error("Backup not found", "backup-id", backupID)
-		return nil, fmt.Errorf("backup %s not found", backupID)
+		return nil, &errclass.ValidationError{Subject: "backup", Err: fmt.Errorf("backup %s not found", backupID)}
+	}
+
+	if origin := backup.Origin; origin != nil {
+		slog.Info("Backup was taken on", "backup", backup.ID, "host", origin.Host, "pool_guid", origin.PoolGUID, "version", origin.Version)
 	}
 
 	data := RestoreFSMData{
 		DestinationDataset: destinationDataset,
 		Backup:             backup,
+		prefetched:         prefetched,
 	}
 
 	return fsm.NewFSM(
@@ -113,10 +298,19 @@ func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID)
 				Run: func(ctx context.Context, data *RestoreFSMData) error {
 					slog.Debug("Checking if parent snapshot exists", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
 					if data.Backup.DependsOn == nil {
+						if err := checkRestoreStreams([]*repository.Backup{data.Backup}); err != nil {
+							return fsm.NewUnrecoverableError(err)
+						}
 						slog.Debug("No parent backup needed.", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
 						return nil
 					}
 
+					if parent, ok := r.Store.Backups.Get(*data.Backup.DependsOn); ok {
+						if err := checkRestoreStreams([]*repository.Backup{parent, data.Backup}); err != nil {
+							return fsm.NewUnrecoverableError(err)
+						}
+					}
+
 					parentBackupID := data.Backup.DependsOn
 					exists, err := r.ZFS.SnapshotExists(ctx, data.DestinationDataset, *parentBackupID)
 					if err != nil {
@@ -130,26 +324,86 @@ func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID)
 					}
 
 					slog.Debug("Parent snapshot exists", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
+
+					// zfs recv refuses a stream whose source isn't the
+					// parent snapshot, but only after it is downloaded.
+					expected := r.Store.Backups.SourceGUID(data.Backup)
+					if expected == "" {
+						return nil
+					}
+
+					guid, err := r.ZFS.SnapshotGUID(ctx, data.DestinationDataset, *parentBackupID)
+					if err != nil {
+						slog.Error("Failed to get parent snapshot GUID", "error", err)
+						return fmt.Errorf("failed to get parent snapshot GUID: %w", err)
+					}
+					if guid != expected {
+						slog.Error("Parent snapshot is not the one the backup was sent from. Can't restore.", "destination-dataset", data.DestinationDataset, "backup", data.Backup.ID, "guid", guid, "expected", expected)
+						return fsm.NewUnrecoverableError(&errclass.ValidationError{
+							Subject: "snapshot " + parentBackupID.String(),
+							Err:     fmt.Errorf("%w: parent GUID %s, the stream is incremental from %s", ErrSnapshotGUIDMismatch, guid, expected),
+						})
+					}
+
 					return nil
 				},
 			},
-			"restore": {
+			"retrieve": {
 				From: RestoreStateParentSnapshotExists,
+				To:   RestoreStateRetrieved,
+				Run: func(ctx context.Context, data *RestoreFSMData) error {
+					snapshotStorage, err := r.snapshotStorage(data.Backup)
+					if err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					archive, ok := storage.As[storage.ArchiveStore](snapshotStorage)
+					if !ok {
+						slog.Debug("Storage has no archive tier. Nothing to retrieve.", "backup", data.Backup.ID)
+						return nil
+					}
+
+					slog.Debug("Retrieving snapshot from the archive tier if needed", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+					err = archive.RetrieveSnapshot(ctx, data.Backup.Dataset, data.Backup.ID.String(), true)
+					if err != nil {
+						slog.Error("Failed to retrieve archived snapshot", "error", err)
+						if errors.Is(err, storage.ErrRetrievalTimeout) {
+							return fsm.NewUnrecoverableError(err)
+						}
+						return fmt.Errorf("failed to retrieve archived snapshot: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"restore": {
+				From: RestoreStateRetrieved,
 				To:   RestoreStateRestored,
 				Run: func(ctx context.Context, data *RestoreFSMData) error {
 					slog.Debug("Restoring snapshot", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
 
-					slog.Debug("Opening snapshot read stream", "dataset", data.Backup.Dataset, "snapshot", data.Backup.ID.String())
-					reader, err := r.Storage.OpenSnapshotReadStream(ctx, data.Backup.Dataset, data.Backup.ID.String(), r.Encryption)
+					snapshotStorage, err := r.snapshotStorage(data.Backup)
+					if err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					reader, err := r.openRestoreStream(ctx, data, snapshotStorage)
 					if err != nil {
 						slog.Error("Failed to open snapshot read stream", "error", err)
 						return fmt.Errorf("failed to open snapshot read stream: %w", err)
 					}
 
-					wrappedReader := util.NewLoggedReader("restore", reader, 1*time.Second, data.Backup.Size)
+					wrappedReader := util.NewLoggedReader("restore", reader, data.Backup.Size)
+					defer wrappedReader.Close()
 
 					slog.Debug("Starting ZFS recv", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
 					err = r.ZFS.Recv(ctx, data.DestinationDataset, data.Backup.ID, wrappedReader, zfs.RecvOptions{KeepUnmounted: true})
+					if mismatch := reader.mismatch(); mismatch != nil {
+						// zfs recv never saw the end of the stream, so it
+						// received nothing.
+						slog.Error("Snapshot doesn't match its checksum. It is corrupted.", "backup", data.Backup.ID, "error", mismatch)
+						return fsm.NewUnrecoverableError(mismatch)
+					}
 					if err != nil {
 						slog.Error("Failed to receive snapshot", "error", err)
 						return fmt.Errorf("failed to receive snapshot: %w", err)
@@ -159,11 +413,43 @@ func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID)
 					return nil
 				},
 			},
-			"complete": {
+			"verify_guid": {
 				From: RestoreStateRestored,
+				To:   RestoreStateVerified,
+				Run: func(ctx context.Context, data *RestoreFSMData) error {
+					if data.Backup.GUID == "" {
+						slog.Warn("Backup has no recorded snapshot GUID. Can't check the received snapshot.", "backup", data.Backup.ID)
+						r.checkIntermediates(ctx, data)
+						return nil
+					}
+
+					guid, err := r.ZFS.SnapshotGUID(ctx, data.DestinationDataset, data.Backup.ID)
+					if err != nil {
+						slog.Error("Failed to get received snapshot GUID", "error", err)
+						return fmt.Errorf("failed to get received snapshot GUID: %w", err)
+					}
+
+					if guid != data.Backup.GUID {
+						slog.Error("Received snapshot doesn't match the backup", "backup", data.Backup.ID, "guid", guid, "expected", data.Backup.GUID)
+						return fsm.NewUnrecoverableError(&errclass.ValidationError{
+							Subject: "snapshot " + data.Backup.ID.String(),
+							Err:     fmt.Errorf("%w: received GUID %s, expected %s", ErrSnapshotGUIDMismatch, guid, data.Backup.GUID),
+						})
+					}
+
+					slog.Debug("Received snapshot matches the backup", "backup", data.Backup.ID, "guid", guid)
+					r.checkIntermediates(ctx, data)
+					return nil
+				},
+			},
+			"complete": {
+				From: RestoreStateVerified,
 				To:   RestoreStateCompleted,
 				Run: func(ctx context.Context, data *RestoreFSMData) error {
 					slog.Info("Restore completed", "destination-dataset", data.DestinationDataset, "backup", data.Backup)
+					if data.Backup.Send.IsRaw() {
+						slog.Info("Backup was sent raw. Load the key of the dataset with `zfs load-key` to mount it.", "destination-dataset", data.DestinationDataset)
+					}
 					return nil
 				},
 			},
@@ -173,5 +459,89 @@ func (r *Runner) createRestoreFSM(destinationDataset string, backupID ulid.ULID)
 			WaitIncrements: 2 * time.Second,
 			MaxWait:        10 * time.Second,
 		},
+	).WithSafeStates(
+		// A received snapshot is checked before stopping.
+		RestoreStateInitial,
+		RestoreStateParentSnapshotExists,
+		RestoreStateRetrieved,
+		RestoreStateVerified,
+		RestoreStateCompleted,
 	), nil
 }
+
+// openRestoreStream opens the decrypted snapshot of the backup being
+// restored, from its prefetched copy if it has one. If the prefetch failed,
+// the snapshot is streamed from the storage instead.
+func (r *Runner) openRestoreStream(ctx context.Context, data *RestoreFSMData, snapshotStorage storage.StrongStore) (*checksumReader, error) {
+	subject := "snapshot " + data.Backup.ID.String()
+
+	snapshotEncryption, err := r.snapshotEncryption(data.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.prefetched != nil {
+		// The object was checked when it was downloaded.
+		reader, err := data.prefetched.open(ctx, snapshotEncryption)
+		if err == nil {
+			slog.Debug("Reading prefetched snapshot", "dataset", data.Backup.Dataset, "snapshot", data.Backup.ID.String(), "path", data.prefetched.path)
+			return newChecksumReader(reader, subject, data.Backup.Checksum, data.Backup.Size, checksumHoldback), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		slog.Warn("Can't read the prefetched snapshot. Streaming it instead.", "backup", data.Backup.ID, "error", err)
+		data.prefetched = nil
+	}
+
+	return r.openCheckedSnapshot(ctx, data.Backup, snapshotStorage)
+}
+
+// openCheckedSnapshot opens the decrypted snapshot of a backup, checked
+// against the checksums recorded when it was uploaded as it is read: the
+// object's before it is decrypted, and the stream's after.
+func (r *Runner) openCheckedSnapshot(ctx context.Context, backup *repository.Backup, snapshotStorage storage.StrongStore) (*checksumReader, error) {
+	snapshotEncryption, err := r.snapshotEncryption(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Opening snapshot read stream", "dataset", backup.Dataset, "snapshot", backup.ID.String(), "tier", backup.StorageTier(), "compression", backup.Compression)
+	raw, err := snapshotStorage.OpenSnapshotReadStream(ctx, backup.Dataset, backup.ID.String(), encryption.Passthrough{})
+	if err != nil {
+		return nil, err
+	}
+
+	object := newChecksumReader(raw, "snapshot object "+backup.ID.String(), backup.ObjectChecksum, backup.ObjectSize, 0)
+	reader, err := snapshotEncryption.DecryptedReader(object)
+	if err != nil {
+		_ = raw.Close()
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	stream := newChecksumReader(reader, "snapshot "+backup.ID.String(), backup.Checksum, backup.Size, checksumHoldback)
+	stream.object = object
+	return stream, nil
+}
+
+// checkIntermediates warns about intermediate snapshots a `zfs send -I`
+// stream should have recreated, but didn't. Only the backup itself is needed
+// for the restore to succeed.
+func (r *Runner) checkIntermediates(ctx context.Context, data *RestoreFSMData) {
+	for _, id := range data.Backup.Intermediates {
+		exists, err := r.ZFS.SnapshotExists(ctx, data.DestinationDataset, id)
+		if err != nil {
+			slog.Warn("Failed to check if intermediate snapshot was received", "backup", data.Backup.ID, "intermediate", id, "error", err)
+			continue
+		}
+
+		if !exists {
+			slog.Warn("Intermediate snapshot was not received", "backup", data.Backup.ID, "intermediate", id)
+		}
+	}
+
+	if len(data.Backup.Intermediates) > 0 {
+		slog.Info("Received intermediate snapshots", "destination-dataset", data.DestinationDataset, "backup", data.Backup.ID, "count", len(data.Backup.Intermediates))
+	}
+}
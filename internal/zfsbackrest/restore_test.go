@@ -0,0 +1,107 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestCheckRestoreIdentities(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Age{RecipientPublicKey: identity.Recipient().String()}
+
+	store := repositorytest.NewStore("tank/data")
+	full := store.Full("tank/data", 2*time.Hour)
+	full.Recipient = cfg.RecipientPublicKey
+	incr := store.Diff(full, time.Hour)
+	incr.Recipient = cfg.RecipientPublicKey
+
+	enc, err := encryption.NewAge(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.WriteManifest(ctx, hot, enc, full); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := []*repository.Backup{full, incr}
+
+	r := &Runner{Config: &config.Config{}, Storage: hot, Encryption: &encryption.Age{Identities: []age.Identity{wrong}}}
+	if err := r.checkRestoreIdentities(ctx, chain); !errors.Is(err, ErrWrongIdentity) {
+		t.Fatalf("expected a wrong identity to be refused, got %v", err)
+	}
+
+	r.Encryption, err = encryption.NewAgeFromIdentity(identity.String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkRestoreIdentities(ctx, chain); err != nil {
+		t.Fatalf("expected the identity to be accepted, got %v", err)
+	}
+
+	// Backups without a manifest are left to the restore.
+	if err := r.checkRestoreIdentities(ctx, []*repository.Backup{incr}); err != nil {
+		t.Fatalf("expected a missing manifest to be skipped, got %v", err)
+	}
+}
+
+func TestRestorableChain(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 2*time.Hour)
+	diff := b.Diff(full, time.Hour)
+	store := b.Build()
+
+	w, err := hot.OpenSnapshotWriteStream(ctx, diff.Dataset, diff.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write([]byte("zfs send stream"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	// The full backup's snapshot was lost, so the diff can't be restored.
+	_, err = r.restorableChain(ctx, diff.ID)
+	var validationErr *errclass.ValidationError
+	if !errors.Is(err, repository.ErrSnapshotObjectMissing) || !errors.As(err, &validationErr) {
+		t.Fatalf("expected the missing snapshot object to be refused, got %v", err)
+	}
+
+	w, err = hot.OpenSnapshotWriteStream(ctx, full.Dataset, full.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write([]byte("zfs send stream"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	chain, err := r.restorableChain(ctx, diff.ID)
+	if err != nil || len(chain) != 2 || chain[0] != full {
+		t.Fatalf("expected the chain to be restorable, got %v, %v", chain, err)
+	}
+}
@@ -0,0 +1,162 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// RollbackResult is what rolling the store back changed, or would change on a
+// dry run.
+type RollbackResult struct {
+	Store *repository.Store
+	// Changes are the audit entries of the rollback. They are only known if
+	// the current store could be loaded.
+	Changes []repository.AuditEntry
+	// Missing are the backups of the version whose snapshot objects were
+	// deleted since it was saved. They can't be restored.
+	Missing []*repository.Backup
+}
+
+// RollbackStore replaces the store with one of its earlier versions kept in
+// the repository, unless it's a dry run. The current store doesn't have to
+// load, so a damaged store can be rolled back too. The store keeps its
+// current encryption, or the newest version's if it doesn't load, and the
+// backups of the version whose snapshot objects are gone are reported.
+func RollbackStore(ctx context.Context, cfg *config.Config, id ulid.ULID, dryRun bool) (*RollbackResult, error) {
+	slog.Debug("Rolling back store", "id", id, "dry_run", dryRun)
+
+	strongStore, err := storage.NewStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		slog.Error("Failed to create storage", "backend", cfg.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	lease, err := repository.AcquireLease(ctx, strongStore, repository.LeaseOpts{
+		TTL:     cfg.Repository.Lock.TTL,
+		Wait:    cfg.Repository.Lock.Wait,
+		Command: strings.Join(os.Args, " "),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	defer func() {
+		if err := lease.Release(context.WithoutCancel(ctx)); err != nil {
+			slog.Warn("Failed to release the repository lock. It expires on its own.", "error", err)
+		}
+	}()
+
+	version, err := repository.LoadStoreVersion(ctx, strongStore, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Roll the current store back in place, so the save records what changed
+	// in the audit log.
+	store, err := repository.LoadStore(ctx, strongStore)
+	if err != nil {
+		slog.Warn("Failed to load the current store. The rollback replaces it without recording what changed.", "error", err)
+		store, err = newestStoreVersion(ctx, strongStore, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	store.RollBackTo(version)
+
+	missing, err := missingSnapshotObjects(ctx, cfg, strongStore, store)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RollbackResult{Store: store, Changes: store.PendingChanges(), Missing: missing}
+	if dryRun {
+		slog.Warn("Dry run. The store was not rolled back.")
+		return result, nil
+	}
+
+	store.SetLease(lease)
+	if err := store.Save(ctx, strongStore); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return nil, fmt.Errorf("failed to save store: %w", err)
+	}
+
+	if err := repository.AppendAudit(ctx, strongStore, repository.AuditEntry{
+		Action:  repository.AuditStoreRolledBack,
+		Details: "to version " + id.String(),
+	}); err != nil {
+		slog.Warn("Failed to append to the audit log", "error", err)
+	}
+
+	slog.Info("Rolled back the store", "id", id)
+	return result, nil
+}
+
+// newestStoreVersion loads the newest version of the store saved after the
+// version with id, for a damaged store to keep its encryption from. It falls
+// back to the version with id itself if no later version loads.
+func newestStoreVersion(ctx context.Context, strongStore storage.StrongStore, id ulid.ULID) (*repository.Store, error) {
+	versions, err := repository.ListStoreVersions(ctx, strongStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list store versions: %w", err)
+	}
+
+	for _, v := range slices.Backward(versions) {
+		if v.ID.Compare(id) <= 0 {
+			break
+		}
+
+		store, err := repository.LoadStoreVersion(ctx, strongStore, v.ID)
+		if err == nil {
+			slog.Info("Keeping the encryption of the newest store version", "id", v.ID)
+			return store, nil
+		}
+		slog.Warn("Failed to load store version", "id", v.ID, "error", err)
+	}
+
+	slog.Warn("No later store version loads. The rollback keeps the encryption of the version, and undoes any key rotation since.", "id", id)
+	return repository.LoadStoreVersion(ctx, strongStore, id)
+}
+
+// missingSnapshotObjects returns the backups of store whose snapshot objects
+// no longer exist, e.g. as they were deleted after the version store was
+// rolled back to was saved.
+func missingSnapshotObjects(ctx context.Context, cfg *config.Config, strongStore storage.StrongStore, store *repository.Store) ([]*repository.Backup, error) {
+	coldStorage, err := storage.NewColdStrongStore(ctx, &cfg.Repository)
+	if err != nil {
+		slog.Error("Failed to create cold storage", "backend", cfg.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create cold storage: %w", err)
+	}
+
+	routes, err := newRoutes(ctx, cfg.Repository.Routes)
+	if err != nil {
+		slog.Error("Failed to create routes", "error", err)
+		return nil, fmt.Errorf("failed to create routes: %w", err)
+	}
+
+	r := &Runner{Config: cfg, Store: store, Storage: strongStore, ColdStorage: coldStorage, Routes: routes}
+
+	var missing []*repository.Backup
+	for _, backup := range store.Backups.All() {
+		ok, err := r.hasSnapshotObject(ctx, backup)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the snapshot object of backup %s: %w", backup.ID, err)
+		}
+		if !ok {
+			slog.Warn("The snapshot object of the backup was deleted since the version was saved", "dataset", backup.Dataset, "backup", backup.ID)
+			missing = append(missing, backup)
+		}
+	}
+
+	slices.SortFunc(missing, func(a, b *repository.Backup) int {
+		return a.ID.Compare(b.ID)
+	})
+	return missing, nil
+}
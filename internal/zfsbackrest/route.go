@@ -0,0 +1,107 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gobwas/glob"
+)
+
+// Route is a storage target the snapshots of some datasets are sent to
+// instead of the repository's.
+type Route struct {
+	Name     string
+	Datasets []glob.Glob
+	Storage  storage.StrongStore
+}
+
+// StorageName is the name the route's storage is listed under, next to the
+// hot and cold tiers.
+func (r *Route) StorageName() string {
+	return "route:" + r.Name
+}
+
+// Matches reports whether the route's patterns match dataset.
+func (r *Route) Matches(dataset string) bool {
+	for _, pattern := range r.Datasets {
+		if pattern.Match(dataset) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRoutes creates the storage of every configured route. The routes are
+// validated before any storage is created.
+func newRoutes(ctx context.Context, cfgs []config.Route) ([]*Route, error) {
+	seen := make(map[string]bool, len(cfgs))
+	routes := make([]*Route, 0, len(cfgs))
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		key := fmt.Sprintf("repository.routes[%d]", i)
+
+		if cfg.Name == "" {
+			return nil, &errclass.ConfigError{Key: key + ".name", Err: errors.New("required")}
+		}
+		if seen[cfg.Name] {
+			return nil, &errclass.ConfigError{Key: key + ".name", Err: fmt.Errorf("duplicate route %q", cfg.Name)}
+		}
+		seen[cfg.Name] = true
+
+		if len(cfg.Datasets) == 0 {
+			return nil, &errclass.ConfigError{Key: key + ".datasets", Err: errors.New("required")}
+		}
+
+		route := &Route{Name: cfg.Name}
+		for _, pattern := range cfg.Datasets {
+			g, err := glob.Compile(pattern)
+			if err != nil {
+				return nil, &errclass.ConfigError{Key: key + ".datasets", Err: fmt.Errorf("invalid glob pattern %q: %w", pattern, err)}
+			}
+			route.Datasets = append(route.Datasets, g)
+		}
+
+		routes = append(routes, route)
+	}
+
+	for i, route := range routes {
+		routeStorage, err := storage.NewReplicaStrongStore(ctx, &cfgs[i].Replica)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage of route %s: %w", route.Name, err)
+		}
+		route.Storage = routeStorage
+	}
+
+	return routes, nil
+}
+
+// routeFor returns the first route matching dataset, or nil if its snapshots
+// go to the repository.
+func (r *Runner) routeFor(dataset string) *Route {
+	for _, route := range r.Routes {
+		if route.Matches(dataset) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// route returns the route named name.
+func (r *Runner) route(name string) (*Route, error) {
+	for _, route := range r.Routes {
+		if route.Name == name {
+			return route, nil
+		}
+	}
+
+	return nil, &errclass.ConfigError{
+		Key: "repository.routes",
+		Err: fmt.Errorf("route %q is not configured, but backups are stored in it", name),
+	}
+}
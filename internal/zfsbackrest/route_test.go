@@ -0,0 +1,88 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/gobwas/glob"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestRoutedWriteStream(t *testing.T) {
+	ctx := context.Background()
+	primary := storagetest.NewMemoryStore()
+	vms := storagetest.NewMemoryStore()
+
+	r := &Runner{
+		Config:  &config.Config{},
+		Storage: primary,
+		Routes: []*Route{
+			{Name: "vm", Datasets: []glob.Glob{glob.MustCompile("tank/vm/*")}, Storage: vms},
+		},
+	}
+
+	if route := r.routeFor("tank/vm/web"); route == nil || route.Name != "vm" {
+		t.Fatalf("expected tank/vm/web to be routed to vm, got %v", route)
+	}
+	if route := r.routeFor("tank/data"); route != nil {
+		t.Fatalf("expected tank/data not to be routed, got %s", route.Name)
+	}
+
+	manifest := &repository.Backup{ID: ulid.Make(), Type: repository.BackupTypeFull, CreatedAt: time.Now(), Dataset: "tank/vm/web", Route: "vm"}
+	data := &BackupFSMData{Dataset: manifest.Dataset, Manifest: manifest}
+
+	w, err := r.openSnapshotWriteStream(ctx, data, -1)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	if _, err := w.Write([]byte("snapshot")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if content, ok := vms.RawSnapshot(manifest.Dataset, manifest.ID.String()); !ok || string(content) != "snapshot" {
+		t.Fatalf("expected the snapshot in the route, got %q", content)
+	}
+	if _, ok := primary.RawSnapshot(manifest.Dataset, manifest.ID.String()); ok {
+		t.Fatal("expected the routed snapshot not to be written to the repository")
+	}
+
+	// A backup whose route was removed from the config can't be found.
+	manifest.Route = "removed"
+	if _, err := r.snapshotStorage(manifest); !errors.Is(err, errclass.ErrConfig) {
+		t.Fatalf("expected a config error for an unconfigured route, got %v", err)
+	}
+}
+
+func TestNewRoutesValidation(t *testing.T) {
+	ctx := context.Background()
+
+	cases := map[string][]config.Route{
+		"missing name":     {{Datasets: []string{"tank/*"}}},
+		"missing datasets": {{Replica: config.Replica{Name: "vm"}}},
+		"invalid glob":     {{Datasets: []string{"tank/[vm"}, Replica: config.Replica{Name: "vm"}}},
+		"duplicate name": {
+			{Datasets: []string{"tank/vm/*"}, Replica: config.Replica{Name: "vm"}},
+			{Datasets: []string{"tank/ct/*"}, Replica: config.Replica{Name: "vm"}},
+		},
+	}
+
+	for name, cfgs := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newRoutes(ctx, cfgs)
+			var configErr *errclass.ConfigError
+			if !errors.As(err, &configErr) || !strings.HasPrefix(configErr.Key, "repository.routes[") {
+				t.Fatalf("expected a config error of the routes, got %v", err)
+			}
+		})
+	}
+}
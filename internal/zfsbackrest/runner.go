@@ -10,8 +10,11 @@ import (
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/gargakshit/zfsbackrest/compression"
 	"github.com/gargakshit/zfsbackrest/config"
 	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/framing"
 	"github.com/gargakshit/zfsbackrest/repository"
 	"github.com/gargakshit/zfsbackrest/storage"
 	"github.com/gargakshit/zfsbackrest/zfs"
@@ -19,26 +22,166 @@ import (
 )
 
 type Runner struct {
-	Config     *config.Config
-	ZFS        *zfs.ZFS
-	Store      *repository.Store
-	Storage    storage.StrongStore
+	Config  *config.Config
+	ZFS     *zfs.ZFS
+	Store   *repository.Store
+	Storage storage.StrongStore
+	// ColdStorage holds backups moved to the cold tier. It is nil if tiering
+	// is disabled.
+	ColdStorage storage.StrongStore
+	// Replicas are the storage targets backups are replicated to.
+	Replicas []*Replica
+	// Routes are the storage targets the snapshots of some datasets are
+	// sent to instead of Storage.
+	Routes     []*Route
 	Encryption encryption.Encryption
+
+	// lease is the repository lock, once it is taken.
+	lease *repository.Lease
+}
+
+// LockRepository takes the repository lock, so no other host mutates the
+// store until UnlockRepository. An interrupted store save is finished, and
+// the store is loaded again under the lock, as another host may have changed
+// it since the runner was created.
+func (r *Runner) LockRepository(ctx context.Context) error {
+	lease, err := repository.AcquireLease(ctx, r.Storage, repository.LeaseOpts{
+		TTL:     r.Config.Repository.Lock.TTL,
+		Wait:    r.Config.Repository.Lock.Wait,
+		Command: strings.Join(os.Args, " "),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lock repository: %w", err)
+	}
+
+	if _, err := repository.RecoverJournal(ctx, r.Storage); err != nil {
+		slog.Error("Failed to recover the interrupted store save", "error", err)
+		return errors.Join(fmt.Errorf("failed to recover the interrupted store save: %w", err), lease.Release(ctx))
+	}
+
+	store, err := repository.LoadStore(ctx, r.Storage)
+	if err != nil {
+		slog.Error("Failed to load store content", "error", err)
+		return errors.Join(fmt.Errorf("failed to load store content: %w", err), lease.Release(ctx))
+	}
+
+	enc, err := encryption.NewEncryption(&store.Encryption)
+	if err != nil {
+		slog.Error("Failed to create encryption", "error", err)
+		return errors.Join(fmt.Errorf("failed to create encryption: %w", err), lease.Release(ctx))
+	}
+
+	store.SetLease(lease)
+
+	if store.HashMismatch() {
+		slog.Warn("Saving the store to correct its hash")
+		if err := store.Save(ctx, r.Storage); err != nil {
+			return errors.Join(fmt.Errorf("failed to save store content: %w", err), lease.Release(ctx))
+		}
+	}
+
+	r.Store = store
+	r.Encryption = enc
+	r.lease = lease
+	return nil
+}
+
+// UnlockRepository releases the repository lock, if it is held.
+func (r *Runner) UnlockRepository(ctx context.Context) error {
+	if r.lease == nil {
+		return nil
+	}
+
+	lease := r.lease
+	r.lease = nil
+	return lease.Release(ctx)
+}
+
+// snapshotStorage returns the storage the backup's snapshot lives in.
+func (r *Runner) snapshotStorage(backup *repository.Backup) (storage.StrongStore, error) {
+	if backup.Route != "" {
+		route, err := r.route(backup.Route)
+		if err != nil {
+			return nil, err
+		}
+		return route.Storage, nil
+	}
+
+	if backup.StorageTier() != repository.TierCold {
+		return r.Storage, nil
+	}
+
+	if r.ColdStorage == nil {
+		return nil, &errclass.ConfigError{
+			Key: "repository.tiering",
+			Err: fmt.Errorf("backup %s is in the cold tier, but tiering is not configured", backup.ID),
+		}
+	}
+
+	return r.ColdStorage, nil
+}
+
+// snapshotEncryption returns the pipeline the backup's snapshot is encoded
+// and decoded with, as recorded in its format: the compression it was taken
+// with, its framing, then the repository's encryption, unless it was taken
+// without.
+func (r *Runner) snapshotEncryption(backup *repository.Backup) (encryption.Encryption, error) {
+	if err := backup.CheckFormat(); err != nil {
+		return nil, err
+	}
+
+	enc := r.Encryption
+	if backup.EncryptionScheme() == repository.EncryptionSchemeNone {
+		enc = encryption.Passthrough{}
+	}
+
+	if backup.Framed() {
+		enc = framing.Wrap(enc)
+	}
+
+	enc, err := compression.Wrap(enc, backup.Compression, r.Config.Repository.Compression.Level)
+	if err != nil {
+		return nil, &errclass.ValidationError{Subject: "backup " + backup.ID.String(), Err: err}
+	}
+
+	return enc, nil
 }
 
 func NewRunnerFromExistingRepository(ctx context.Context, config *config.Config) (*Runner, error) {
 	slog.Debug("Creating runner", "config", config)
 
+	if err := compression.Validate(&config.Repository.Compression); err != nil {
+		return nil, err
+	}
+
 	zfs, err := zfs.New()
 	if err != nil {
 		slog.Error("Failed to create ZFS client", "error", err)
 		return nil, fmt.Errorf("failed to create ZFS client: %w", err)
 	}
 
-	storage, err := storage.NewS3StrongStorage(ctx, &config.Repository.S3)
+	coldStorage, err := storage.NewColdStrongStore(ctx, &config.Repository)
 	if err != nil {
-		slog.Error("Failed to create S3 storage", "error", err)
-		return nil, fmt.Errorf("failed to create S3 storage: %w", err)
+		slog.Error("Failed to create cold storage", "backend", config.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create cold storage: %w", err)
+	}
+
+	replicas, err := newReplicas(ctx, config.Repository.Replicas)
+	if err != nil {
+		slog.Error("Failed to create replicas", "error", err)
+		return nil, fmt.Errorf("failed to create replicas: %w", err)
+	}
+
+	routes, err := newRoutes(ctx, config.Repository.Routes)
+	if err != nil {
+		slog.Error("Failed to create routes", "error", err)
+		return nil, fmt.Errorf("failed to create routes: %w", err)
+	}
+
+	storage, err := storage.NewStrongStore(ctx, &config.Repository)
+	if err != nil {
+		slog.Error("Failed to create storage", "backend", config.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create storage: %w", err)
 	}
 
 	store, err := repository.LoadStore(ctx, storage)
@@ -74,6 +217,11 @@ func NewRunnerFromExistingRepository(ctx context.Context, config *config.Config)
 
 		fmt.Println(color.New(color.Bold).Sprintf("\nPlan: %s", color.New(color.Faint).Sprintf("%d to add, %d to remove.\n", len(diff.Added), len(diff.Removed))))
 
+		if len(diff.Removed) > 0 {
+			fmt.Println("The backups of removed datasets are kept, and no longer expire. Run `zfsbackrest unmanage <dataset>` to expire or delete them.")
+			fmt.Println()
+		}
+
 		prompt := promptui.Prompt{
 			Label:     "Accept Changes",
 			IsConfirm: true,
@@ -86,7 +234,7 @@ func NewRunnerFromExistingRepository(ctx context.Context, config *config.Config)
 		}
 
 		if strings.ToLower(res) == "y" {
-			store.ManagedDatasets = cfgDatasets
+			store.SetManagedDatasets(cfgDatasets, time.Now())
 			if err := store.Save(ctx, storage); err != nil {
 				slog.Error("Failed to save store content", "error", err)
 				return nil, fmt.Errorf("failed to save store content: %w", err)
@@ -110,23 +258,39 @@ func NewRunnerFromExistingRepository(ctx context.Context, config *config.Config)
 		}
 	}
 
-	encryption, err := encryption.NewAge(&store.Encryption.Age)
+	encryption, err := encryption.NewEncryption(&store.Encryption)
 	if err != nil {
 		slog.Error("Failed to create encryption", "error", err)
 		return nil, fmt.Errorf("failed to create encryption: %w", err)
 	}
 
 	return &Runner{
-		Config:     config,
-		ZFS:        zfs,
-		Store:      store,
-		Storage:    storage,
-		Encryption: encryption,
+		Config:      config,
+		ZFS:         zfs,
+		Store:       store,
+		Storage:     storage,
+		ColdStorage: coldStorage,
+		Replicas:    replicas,
+		Routes:      routes,
+		Encryption:  encryption,
 	}, nil
 }
 
-func NewRunnerWithNewRepository(ctx context.Context, config *config.Config, encryptionConfig config.Encryption) (*Runner, error) {
-	slog.Debug("Creating runner with new repository", "config", config, "encryption", encryptionConfig)
+// InitOpts is what to do when initializing a repository whose storage already
+// has a store. By default, it is refused.
+type InitOpts struct {
+	// Adopt uses the existing repository as is.
+	Adopt bool
+	// Force overwrites the existing store. The backups it lists are lost.
+	Force bool
+}
+
+// ErrRepositoryExists is returned when initializing a repository whose storage
+// already has a store, without adopting or overwriting it.
+var ErrRepositoryExists = errors.New("a repository already exists in the storage")
+
+func NewRunnerWithNewRepository(ctx context.Context, config *config.Config, encryptionConfig config.Encryption, opts InitOpts) (*Runner, error) {
+	slog.Debug("Creating runner with new repository", "config", config, "encryption", encryptionConfig, "opts", opts)
 
 	zfs, err := zfs.New()
 	if err != nil {
@@ -145,16 +309,39 @@ func NewRunnerWithNewRepository(ctx context.Context, config *config.Config, encr
 	store := &repository.Store{
 		Version:         1,
 		CreatedAt:       time.Now(),
-		Backups:         repository.Backups{},
+		Backups:         repository.NewBackups(),
 		Orphans:         repository.Orphans{},
 		Encryption:      encryptionConfig,
 		ManagedDatasets: managedDatasets,
 	}
 
-	storage, err := storage.NewS3StrongStorage(ctx, &config.Repository.S3)
+	coldStorage, err := storage.NewColdStrongStore(ctx, &config.Repository)
 	if err != nil {
-		slog.Error("Failed to create S3 storage", "error", err)
-		return nil, fmt.Errorf("failed to create S3 storage: %w", err)
+		slog.Error("Failed to create cold storage", "backend", config.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create cold storage: %w", err)
+	}
+
+	storage, err := storage.NewStrongStore(ctx, &config.Repository)
+	if err != nil {
+		slog.Error("Failed to create storage", "backend", config.Repository.Backend, "error", err)
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	exists, err := repository.StoreExists(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case exists && opts.Adopt:
+		return adoptRepository(ctx, config, encryptionConfig)
+	case opts.Adopt:
+		return nil, &errclass.ValidationError{Subject: "repository", Err: errors.New("there is no repository in the storage to adopt")}
+	case exists && opts.Force:
+		slog.Warn("Overwriting the existing repository. The backups it lists are no longer tracked.")
+	case exists:
+		slog.Error("Refusing to overwrite the existing repository")
+		return nil, &errclass.ValidationError{Subject: "repository", Err: ErrRepositoryExists}
 	}
 
 	slog.Debug("Saving store content",
@@ -168,17 +355,51 @@ func NewRunnerWithNewRepository(ctx context.Context, config *config.Config, encr
 		return nil, fmt.Errorf("failed to save store content: %w", err)
 	}
 
-	encryption, err := encryption.NewAge(&store.Encryption.Age)
+	encryption, err := encryption.NewEncryption(&store.Encryption)
 	if err != nil {
 		slog.Error("Failed to create encryption", "error", err)
 		return nil, fmt.Errorf("failed to create encryption: %w", err)
 	}
 
 	return &Runner{
-		Config:     config,
-		ZFS:        zfs,
-		Store:      store,
-		Storage:    storage,
-		Encryption: encryption,
+		Config:      config,
+		ZFS:         zfs,
+		Store:       store,
+		Storage:     storage,
+		ColdStorage: coldStorage,
+		Encryption:  encryption,
 	}, nil
 }
+
+// adoptRepository uses the repository that already exists in the storage as
+// is. If a recipient was given, it must be the repository's, and if
+// encryption was disabled, the repository must have been initialized without
+// it.
+func adoptRepository(ctx context.Context, config *config.Config, encryptionConfig config.Encryption) (*Runner, error) {
+	slog.Info("Adopting the existing repository")
+
+	runner, err := NewRunnerFromExistingRepository(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptionConfig.Disabled() && !runner.Store.Encryption.Disabled() {
+		return nil, &errclass.ValidationError{
+			Subject: "encryption",
+			Err:     fmt.Errorf("the existing repository is encrypted to %s", runner.Store.Encryption.Age.RecipientPublicKey),
+		}
+	}
+
+	recipient := encryptionConfig.Age.RecipientPublicKey
+	if recipient != "" && runner.Store.Encryption.Disabled() {
+		return nil, &errclass.ValidationError{Subject: "age recipient public key", Err: encryption.ErrEncryptionDisabled}
+	}
+	if recipient != "" && recipient != runner.Store.Encryption.Age.RecipientPublicKey {
+		return nil, &errclass.ValidationError{
+			Subject: "age recipient public key",
+			Err:     fmt.Errorf("the existing repository is encrypted to %s", runner.Store.Encryption.Age.RecipientPublicKey),
+		}
+	}
+
+	return runner, nil
+}
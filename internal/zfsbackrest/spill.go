@@ -0,0 +1,170 @@
+package zfsbackrest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/oklog/ulid/v2"
+)
+
+// spillSnapshot sends a snapshot, encrypted, to a file in the spill
+// directory. Uploads read from that file, so a failed upload is retried
+// without running `zfs send` again.
+func (r *Runner) spillSnapshot(ctx context.Context, data *BackupFSMData, parentID *ulid.ULID) error {
+	dir := r.spillDir()
+	slog.Debug("Spilling snapshot to disk", "dataset", data.Dataset, "backup", data.Manifest.ID, "dir", dir)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fsm.NewUnrecoverableError(&errclass.ConfigError{Key: r.spillDirKey(), Err: err})
+	}
+
+	snapshotEncryption, err := r.snapshotEncryption(data.Manifest)
+	if err != nil {
+		return fsm.NewUnrecoverableError(err)
+	}
+
+	file, err := os.CreateTemp(dir, data.Manifest.ID.String()+"-*.spill")
+	if err != nil {
+		return fsm.NewUnrecoverableError(&errclass.ConfigError{Key: r.spillDirKey(), Err: err})
+	}
+
+	encWriter, err := snapshotEncryption.EncryptedWriter(file)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+
+	var expected int64
+	if data.EstimatedSize != nil {
+		expected = *data.EstimatedSize
+	}
+	data.progress.phase(PhaseSpooling, expected)
+
+	// SendSnapshot closes the encrypted writer, which doesn't close the file.
+	checksumStream := &checksumWriteCloser{
+		WriteCloser: &checkpointWriteCloser{WriteCloser: encWriter, progress: data.progress},
+		hash:        sha256.New(),
+	}
+	size, err := r.ZFS.SendSnapshot(ctx, data.Dataset, data.Manifest.ID, parentID, checksumStream, sendOptions(data.Manifest))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		slog.Error("Failed to spill snapshot", "error", err)
+		return fmt.Errorf("failed to spill snapshot: %w", err)
+	}
+
+	data.SpillPath = file.Name()
+	data.SnapshotSize = size
+	data.Checksum = hex.EncodeToString(checksumStream.hash.Sum(nil))
+
+	if r.spooling() {
+		if err := r.writeSpoolManifest(data); err != nil {
+			r.removeSpill(data)
+			return err
+		}
+	}
+
+	slog.Debug("Snapshot spilled", "dataset", data.Dataset, "backup", data.Manifest.ID, "path", data.SpillPath)
+	return nil
+}
+
+// spillDir is the directory snapshots are spilled to, or empty if they are
+// streamed straight to the repository. The spool directory takes precedence.
+func (r *Runner) spillDir() string {
+	if r.spooling() {
+		return r.Config.Spool.Dir
+	}
+	return r.Config.SpillDir
+}
+
+func (r *Runner) spillDirKey() string {
+	if r.spooling() {
+		return "spool.dir"
+	}
+	return "spill_dir"
+}
+
+// uploadSpilled uploads the spill file of a backup as is, since it is
+// encrypted already, and removes it once the upload succeeds.
+func (r *Runner) uploadSpilled(ctx context.Context, data *BackupFSMData) error {
+	slog.Debug("Uploading spilled snapshot", "dataset", data.Dataset, "backup", data.Manifest.ID, "path", data.SpillPath)
+
+	file, err := os.Open(data.SpillPath)
+	if err != nil {
+		return fsm.NewUnrecoverableError(fmt.Errorf("failed to open spill file: %w", err))
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fsm.NewUnrecoverableError(fmt.Errorf("failed to stat spill file: %w", err))
+	}
+
+	writeStream, err := r.openSnapshotWriteStream(ctx, data, info.Size())
+	if err != nil {
+		slog.Error("Failed to open snapshot write stream", "error", err)
+		return fmt.Errorf("failed to open snapshot write stream: %w", err)
+	}
+
+	data.progress.phase(PhaseUploading, info.Size())
+	objectStream := &checksumWriteCloser{WriteCloser: writeStream, hash: sha256.New()}
+	wrappedWriteStream := util.NewLoggedWriter(
+		data.Manifest.ID.String(),
+		&checkpointWriteCloser{WriteCloser: objectStream, progress: data.progress},
+		info.Size(),
+	)
+	if _, err := io.Copy(wrappedWriteStream, file); err != nil {
+		slog.Error("Failed to upload spilled snapshot", "error", err)
+		return fmt.Errorf("failed to upload spilled snapshot: %w", err)
+	}
+
+	if err := wrappedWriteStream.Close(); err != nil {
+		slog.Error("Failed to close write stream", "error", err)
+		return fmt.Errorf("failed to close write stream: %w", err)
+	}
+
+	data.ObjectSize = objectStream.size
+	data.ObjectChecksum = hex.EncodeToString(objectStream.hash.Sum(nil))
+
+	if r.spooling() {
+		// Record that the snapshot is uploaded, so a resumed backup carries
+		// on from the manifest.
+		uploaded := *data
+		uploaded.SpillPath = ""
+		if err := r.writeSpoolManifest(&uploaded); err != nil {
+			slog.Warn("Failed to record the spooled upload. A resumed backup uploads it again.", "error", err)
+			return nil
+		}
+	}
+
+	r.removeSpill(data)
+	return nil
+}
+
+// removeSpill removes the spill file of a backup, if it has one.
+func (r *Runner) removeSpill(data *BackupFSMData) {
+	if data.SpillPath == "" {
+		return
+	}
+
+	if err := os.Remove(data.SpillPath); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove spill file", "path", data.SpillPath, "error", err)
+		return
+	}
+
+	data.SpillPath = ""
+}
@@ -0,0 +1,161 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestUploadSpilledRetry(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	backup := b.Full("tank/data", time.Hour)
+
+	spilled := []byte("encrypted zfs send stream")
+	spillPath := filepath.Join(t.TempDir(), backup.ID.String()+".spill")
+	if err := os.WriteFile(spillPath, spilled, 0o600); err != nil {
+		t.Fatalf("write spill file: %v", err)
+	}
+
+	// The spill file is encrypted already, so it must not be encrypted again.
+	r := &Runner{Config: &config.Config{}, Storage: hot, Encryption: failingEncryption{}}
+	data := &BackupFSMData{Dataset: backup.Dataset, Manifest: backup, SpillPath: spillPath}
+
+	hot.FailNext(storagetest.OpWrite, errors.New("connection reset"))
+	if err := r.uploadSpilled(ctx, data); err == nil {
+		t.Fatal("expected the first upload to fail")
+	}
+	if _, err := os.Stat(spillPath); err != nil {
+		t.Fatalf("spill file should be kept for the retry: %v", err)
+	}
+
+	if err := r.uploadSpilled(ctx, data); err != nil {
+		t.Fatalf("retry upload: %v", err)
+	}
+
+	raw, ok := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	if !ok || !bytes.Equal(raw, spilled) {
+		t.Fatalf("uploaded snapshot = %q, want %q", raw, spilled)
+	}
+
+	sum := sha256.Sum256(spilled)
+	if data.ObjectChecksum != hex.EncodeToString(sum[:]) || data.ObjectSize != int64(len(spilled)) {
+		t.Fatalf("expected the object checksum and size of the upload, got %q and %d", data.ObjectChecksum, data.ObjectSize)
+	}
+
+	if data.SpillPath != "" {
+		t.Fatalf("spill path should be cleared, got %q", data.SpillPath)
+	}
+	if _, err := os.Stat(spillPath); !os.IsNotExist(err) {
+		t.Fatalf("spill file should be removed, got %v", err)
+	}
+}
+
+type failingEncryption struct {
+	encryption.Passthrough
+}
+
+func (failingEncryption) EncryptedWriter(dst io.Writer) (io.WriteCloser, error) {
+	return nil, errors.New("unexpected encryption")
+}
+
+func TestResumeSpooledDiscardsCompleted(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	b := repositorytest.NewStore("tank/data")
+	completed := b.Full("tank/data", time.Hour)
+	store, err := b.Save(ctx, storagetest.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{Spool: config.Spool{Dir: dir}}, Store: store}
+
+	// A backup whose upload was recorded, but that completed before its
+	// spool manifest was removed.
+	spillPath := filepath.Join(dir, completed.ID.String()+"-1.spill")
+	if err := os.WriteFile(spillPath, []byte("spooled"), 0o600); err != nil {
+		t.Fatalf("write spill file: %v", err)
+	}
+	if err := r.writeSpoolManifest(&BackupFSMData{Dataset: completed.Dataset, Manifest: completed, SpillPath: spillPath}); err != nil {
+		t.Fatalf("write spool manifest: %v", err)
+	}
+
+	// The spill file of a send that was cut short.
+	stale := filepath.Join(dir, "01ARZ3NDEKTSV4RRFFQ69G5FAV-2.spill")
+	if err := os.WriteFile(stale, []byte("partial"), 0o600); err != nil {
+		t.Fatalf("write stale spill file: %v", err)
+	}
+
+	spooled, err := ListSpooled(dir)
+	if err != nil {
+		t.Fatalf("list spooled: %v", err)
+	}
+	if len(spooled) != 1 || spooled[0].Manifest.ID != completed.ID || spooled[0].SpillPath != spillPath {
+		t.Fatalf("unexpected spooled backups: %+v", spooled)
+	}
+
+	if err := r.ResumeSpooled(ctx); err != nil {
+		t.Fatalf("resume spooled: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read spool dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("spool dir should be empty, got %d entries", len(entries))
+	}
+}
+
+func TestSpoolSizeLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Spool
+		size    int64
+		spool   bool
+		wantErr bool
+	}{
+		{name: "no limits", size: 1 << 40, spool: true},
+		{name: "small incremental", cfg: config.Spool{MaxSize: "1GiB"}, size: 1 << 20, spool: true},
+		{name: "large full", cfg: config.Spool{MaxSize: "1GiB"}, size: 2 << 30, spool: false},
+		{name: "at the limit", cfg: config.Spool{MaxSize: "1GiB"}, size: 1 << 30, spool: true},
+		{name: "only large ones", cfg: config.Spool{MinSize: "1GiB"}, size: 1 << 20, spool: false},
+		{name: "within both", cfg: config.Spool{MinSize: "1MiB", MaxSize: "1GiB"}, size: 1 << 25, spool: true},
+		{name: "invalid", cfg: config.Spool{MaxSize: "lots"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minSize, maxSize, err := spoolSizeLimits(&tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("spool size limits: %v", err)
+			}
+
+			if got := withinSpoolLimits(tt.size, minSize, maxSize); got != tt.spool {
+				t.Fatalf("withinSpoolLimits(%d) = %v, want %v", tt.size, got, tt.spool)
+			}
+		})
+	}
+}
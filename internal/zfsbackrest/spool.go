@@ -0,0 +1,247 @@
+package zfsbackrest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/oklog/ulid/v2"
+)
+
+// spooling reports whether snapshots are spooled to disk to be uploaded, and
+// backups cut short are resumed.
+func (r *Runner) spooling() bool {
+	return r.Config.Spool.Dir != ""
+}
+
+// uploadRetryStrategy retries spooled uploads for much longer than the other
+// steps, since retrying them doesn't send the snapshot again. It is nil, the
+// FSM's default, when not spooling.
+func (r *Runner) uploadRetryStrategy() fsm.RetryStrategy {
+	if !r.spooling() {
+		return nil
+	}
+
+	return fsm.RetryExponentialBackoffConfig{
+		MaxRetries:     r.Config.Spool.MaxRetries,
+		WaitIncrements: 2 * time.Second,
+		MaxWait:        r.Config.Spool.MaxWait,
+	}
+}
+
+// shouldSpool decides whether a backup is spooled or streamed, by the size
+// `zfs send` estimates for it and the configured size limits. That way small,
+// frequent incrementals get the reliability of the spool, and fulls don't need
+// twice their size on disk, or the other way around.
+func (r *Runner) shouldSpool(ctx context.Context, data *BackupFSMData, parentID *ulid.ULID) (bool, error) {
+	minSize, maxSize, err := spoolSizeLimits(&r.Config.Spool)
+	if err != nil {
+		return false, fsm.NewUnrecoverableError(err)
+	}
+
+	if minSize == 0 && maxSize == 0 {
+		return true, nil
+	}
+
+	if data.EstimatedSize == nil {
+		size, err := r.ZFS.EstimateSendSize(ctx, data.Dataset, data.Manifest.ID, parentID, sendOptions(data.Manifest))
+		if err != nil {
+			return false, err
+		}
+		data.EstimatedSize = &size
+	}
+
+	spool := withinSpoolLimits(*data.EstimatedSize, minSize, maxSize)
+	slog.Info("Picked how to upload snapshot",
+		"dataset", data.Dataset,
+		"backup", data.Manifest.ID,
+		"estimated_size", *data.EstimatedSize,
+		"spool", spool,
+	)
+	return spool, nil
+}
+
+// spoolSizeLimits parses the spool size limits. A limit is 0 if it isn't set.
+func spoolSizeLimits(cfg *config.Spool) (minSize int64, maxSize int64, err error) {
+	if cfg.MinSize != "" {
+		size, err := humanize.ParseBytes(cfg.MinSize)
+		if err != nil {
+			return 0, 0, &errclass.ConfigError{Key: "spool.min_size", Err: err}
+		}
+		minSize = int64(size)
+	}
+
+	if cfg.MaxSize != "" {
+		size, err := humanize.ParseBytes(cfg.MaxSize)
+		if err != nil {
+			return 0, 0, &errclass.ConfigError{Key: "spool.max_size", Err: err}
+		}
+		maxSize = int64(size)
+	}
+
+	return minSize, maxSize, nil
+}
+
+func withinSpoolLimits(size int64, minSize int64, maxSize int64) bool {
+	return (minSize == 0 || size >= minSize) && (maxSize == 0 || size <= maxSize)
+}
+
+func spoolManifestPath(dir string, id ulid.ULID) string {
+	return filepath.Join(dir, id.String()+".json")
+}
+
+// writeSpoolManifest persists the state of a spooled backup next to its spill
+// file.
+func (r *Runner) writeSpoolManifest(data *BackupFSMData) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spool manifest: %w", err)
+	}
+
+	// Write and rename, so a crash never leaves a partial manifest behind.
+	path := spoolManifestPath(r.Config.Spool.Dir, data.Manifest.ID)
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		return fmt.Errorf("failed to write spool manifest: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write spool manifest: %w", err)
+	}
+
+	return nil
+}
+
+// removeSpoolManifest removes a spooled backup from the spool, once it is
+// completed.
+func (r *Runner) removeSpoolManifest(data *BackupFSMData) {
+	if !r.spooling() {
+		return
+	}
+
+	r.removeSpill(data)
+
+	path := spoolManifestPath(r.Config.Spool.Dir, data.Manifest.ID)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove spool manifest", "path", path, "error", err)
+	}
+}
+
+// ListSpooled lists the backups in the spool directory that haven't completed
+// yet, oldest first.
+func ListSpooled(dir string) ([]*BackupFSMData, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &errclass.ConfigError{Key: "spool.dir", Err: err}
+	}
+
+	var spooled []*BackupFSMData
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spool manifest %s: %w", path, err)
+		}
+
+		var data BackupFSMData
+		if err := json.Unmarshal(content, &data); err != nil || data.Manifest == nil {
+			return nil, &errclass.ValidationError{Subject: "spool manifest " + path, Err: errors.Join(errors.New("invalid spool manifest"), err)}
+		}
+
+		spooled = append(spooled, &data)
+	}
+
+	sort.Slice(spooled, func(i, j int) bool {
+		return spooled[i].Manifest.ID.Compare(spooled[j].Manifest.ID) < 0
+	})
+
+	return spooled, nil
+}
+
+// ResumeSpooled completes the backups an earlier run left in the spool
+// directory, e.g. because it was cut short by a reboot. Backups that are no
+// longer orphans were completed or cleaned up since, and are discarded.
+func (r *Runner) ResumeSpooled(ctx context.Context) error {
+	if !r.spooling() {
+		return nil
+	}
+
+	spooled, err := ListSpooled(r.Config.Spool.Dir)
+	if err != nil {
+		return err
+	}
+
+	r.removeStaleSpills(spooled)
+
+	var errs []error
+	for _, data := range spooled {
+		if _, ok := r.Store.Orphans[data.Manifest.ID]; !ok {
+			slog.Warn("Spooled backup is no longer an orphan. Discarding it.", "dataset", data.Dataset, "backup", data.Manifest.ID)
+			r.removeSpoolManifest(data)
+			continue
+		}
+
+		state := BackupStateAddedOrphan
+		actions := []BackupAction{"upload_snapshot", "upload_manifest", "update_store", "complete"}
+		if data.SpillPath == "" {
+			state = BackupStateUploadedSnapshot
+			actions = actions[1:]
+		}
+
+		slog.Info("Resuming spooled backup", "dataset", data.Dataset, "backup", data.Manifest.ID, "state", state)
+		data.progress = r.newCheckpointer(data)
+		backupFSM := r.newBackupFSM(fsm.State[BackupState, BackupFSMData]{ID: state, Data: data})
+		err := backupFSM.RunSequence(ctx, actions...)
+		data.progress.remove()
+		if err != nil {
+			slog.Error("Failed to resume spooled backup", "dataset", data.Dataset, "backup", data.Manifest.ID, "error", err)
+			errs = append(errs, fmt.Errorf("failed to resume spooled backup %s: %w", data.Manifest.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeStaleSpills removes the files in the spool directory no spooled
+// backup refers to, like the spill files of sends that were cut short.
+func (r *Runner) removeStaleSpills(spooled []*BackupFSMData) {
+	referenced := map[string]bool{}
+	for _, data := range spooled {
+		referenced[filepath.Clean(data.SpillPath)] = true
+	}
+
+	entries, err := os.ReadDir(r.Config.Spool.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(r.Config.Spool.Dir, name)
+		if entry.IsDir() || referenced[path] || !(strings.HasSuffix(name, ".spill") || strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+
+		slog.Info("Removing stale spill file", "path", path)
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Failed to remove stale spill file", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+type TierState string
+type TierAction string
+
+const (
+	TierStateInitial      TierState = "initial"
+	TierStateCopied       TierState = "copied"
+	TierStateUpdatedStore TierState = "updated_store"
+	TierStateHotRemoved   TierState = "hot_removed"
+	TierStateCompleted    TierState = "completed"
+)
+
+type TierFSMData struct {
+	Backup *repository.Backup
+}
+
+type TierOpts struct {
+	DryRun bool
+}
+
+// MoveDueToColdTier moves every backup older than the configured threshold
+// from the hot to the cold storage.
+func (r *Runner) MoveDueToColdTier(ctx context.Context, opts TierOpts) error {
+	coldAfter := r.Config.Repository.Tiering.ColdAfter
+	if r.ColdStorage == nil {
+		return &errclass.ConfigError{Key: "repository.tiering.cold_after", Err: errors.New("tiering is not enabled")}
+	}
+
+	due := r.Store.Backups.DueForCold(coldAfter)
+	slog.Info("Moving backups to the cold tier", "count", len(due), "cold_after", coldAfter, "dry_run", opts.DryRun)
+
+	for _, backup := range due {
+		if err := r.MoveToColdTier(ctx, backup, opts); err != nil {
+			return fmt.Errorf("failed to move backup %s to the cold tier: %w", backup.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// MoveToColdTier copies a backup's snapshot to the cold storage, records the
+// new location in the store, and then removes it from the hot storage. The
+// snapshot is copied as-is and never decrypted.
+func (r *Runner) MoveToColdTier(ctx context.Context, backup *repository.Backup, opts TierOpts) error {
+	slog.Debug("Moving backup to the cold tier", "backup", backup.ID, "dataset", backup.Dataset, "opts", opts)
+
+	fsm := r.createTierFSM(backup)
+
+	if opts.DryRun {
+		return fsm.Run(ctx, "dry_run")
+	}
+
+	return fsm.RunSequence(ctx, "copy_to_cold", "update_store", "remove_hot", "complete")
+}
+
+func (r *Runner) createTierFSM(backup *repository.Backup) *fsm.FSM[TierState, TierAction, TierFSMData] {
+	return fsm.NewFSM(
+		"tier",
+		fsm.State[TierState, TierFSMData]{
+			ID:   TierStateInitial,
+			Data: &TierFSMData{Backup: backup},
+		},
+		map[TierAction]fsm.Transition[TierState, TierFSMData]{
+			"dry_run": {
+				From: TierStateInitial,
+				To:   TierStateCompleted,
+				Run: func(ctx context.Context, data *TierFSMData) error {
+					slog.Warn("Dry run. Backup would be moved to the cold tier.",
+						"dataset", data.Backup.Dataset,
+						"backup", data.Backup.ID,
+						"created_at", data.Backup.CreatedAt,
+					)
+					return nil
+				},
+			},
+			"copy_to_cold": {
+				From: TierStateInitial,
+				To:   TierStateCopied,
+				Run: func(ctx context.Context, data *TierFSMData) error {
+					slog.Debug("Copying snapshot to the cold tier", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+
+					reader, err := r.Storage.OpenSnapshotReadStream(ctx, data.Backup.Dataset, data.Backup.ID.String(), encryption.Passthrough{})
+					if err != nil {
+						slog.Error("Failed to open hot snapshot read stream", "error", err)
+						return fmt.Errorf("failed to open hot snapshot read stream: %w", err)
+					}
+					defer reader.Close()
+
+					// The copy passes the ciphertext through, but the object is
+					// encrypted with the repository's encryption.
+					ctx = storage.WithSnapshotMetadata(ctx, data.Backup.ObjectMetadata(storage.ObjectKindSnapshot, r.Encryption))
+					writer, err := r.ColdStorage.OpenSnapshotWriteStream(ctx, data.Backup.Dataset, data.Backup.ID.String(), -1, encryption.Passthrough{})
+					if err != nil {
+						slog.Error("Failed to open cold snapshot write stream", "error", err)
+						return fmt.Errorf("failed to open cold snapshot write stream: %w", err)
+					}
+
+					wrappedWriter := util.NewLoggedWriter("tier "+data.Backup.ID.String(), writer, -1)
+					if _, err := io.Copy(wrappedWriter, reader); err != nil {
+						_ = wrappedWriter.Close()
+						slog.Error("Failed to copy snapshot", "error", err)
+						return fmt.Errorf("failed to copy snapshot: %w", err)
+					}
+
+					if err := wrappedWriter.Close(); err != nil {
+						slog.Error("Failed to close cold snapshot write stream", "error", err)
+						return fmt.Errorf("failed to close cold snapshot write stream: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"update_store": {
+				From: TierStateCopied,
+				To:   TierStateUpdatedStore,
+				Run: func(ctx context.Context, data *TierFSMData) error {
+					slog.Debug("Recording cold tier in store", "backup", data.Backup.ID)
+
+					r.Store.Update(func() { data.Backup.Tier = repository.TierCold })
+					if err := r.Store.Save(ctx, r.Storage); err != nil {
+						slog.Error("Failed to save store", "error", err)
+						return fmt.Errorf("failed to save store: %w", err)
+					}
+
+					// Manifests stay in the hot storage, but record the new tier.
+					if err := repository.WriteManifest(ctx, r.Storage, r.Encryption, data.Backup); err != nil {
+						slog.Error("Failed to update manifest", "error", err)
+						return fmt.Errorf("failed to update manifest: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"remove_hot": {
+				From: TierStateUpdatedStore,
+				To:   TierStateHotRemoved,
+				Run: func(ctx context.Context, data *TierFSMData) error {
+					slog.Debug("Removing snapshot from the hot tier", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+
+					err := r.Storage.DeleteSnapshot(ctx, data.Backup.Dataset, data.Backup.ID.String())
+					if err != nil {
+						slog.Error("Failed to delete hot snapshot", "error", err)
+						return fmt.Errorf("failed to delete hot snapshot: %w", err)
+					}
+
+					return nil
+				},
+			},
+			"complete": {
+				From: TierStateHotRemoved,
+				To:   TierStateCompleted,
+				Run: func(ctx context.Context, data *TierFSMData) error {
+					slog.Info("Backup moved to the cold tier", "dataset", data.Backup.Dataset, "backup", data.Backup.ID)
+					return nil
+				},
+			},
+		},
+		fsm.RetryExponentialBackoffConfig{
+			MaxRetries:     5,
+			WaitIncrements: 2 * time.Second,
+			MaxWait:        10 * time.Second,
+		},
+	).WithSafeStates(
+		// Stop only once the snapshot is in a single tier.
+		TierStateInitial,
+		TierStateHotRemoved,
+		TierStateCompleted,
+	)
+}
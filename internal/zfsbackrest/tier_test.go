@@ -0,0 +1,74 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestMoveDueToColdTier(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	cold := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	old := b.Full("tank/data", 72*time.Hour)
+	recent := b.Full("tank/data", time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	ciphertext := []byte("already encrypted")
+	for _, backup := range []*repository.Backup{old, recent} {
+		w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write(ciphertext)
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	cfg := &config.Config{}
+	cfg.Repository.Tiering.ColdAfter = 24 * time.Hour
+
+	r := &Runner{Config: cfg, Store: store, Storage: hot, ColdStorage: cold, Encryption: encryption.Passthrough{}}
+	if err := r.MoveDueToColdTier(ctx, TierOpts{}); err != nil {
+		t.Fatalf("move to cold tier: %v", err)
+	}
+
+	if content, ok := cold.RawSnapshot(old.Dataset, old.ID.String()); !ok || !bytes.Equal(content, ciphertext) {
+		t.Fatalf("expected the old snapshot to be copied as-is to the cold store, got %q", content)
+	}
+	if metadata, ok := cold.Metadata(old.Dataset, old.ID.String()); !ok || metadata.Kind != storage.ObjectKindSnapshot ||
+		metadata.BackupID != old.ID.String() || metadata.BackupType != string(old.Type) {
+		t.Fatalf("expected the cold snapshot to carry the backup's metadata, got %+v", metadata)
+	}
+	if _, ok := hot.RawSnapshot(old.Dataset, old.ID.String()); ok {
+		t.Fatal("expected the old snapshot to be removed from the hot store")
+	}
+	if _, ok := hot.RawSnapshot(recent.Dataset, recent.ID.String()); !ok {
+		t.Fatal("expected the recent snapshot to stay in the hot store")
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if loaded.Backups.Find(old.ID).StorageTier() != repository.TierCold {
+		t.Fatalf("expected the old backup to be recorded as cold, got %q", loaded.Backups.Find(old.ID).StorageTier())
+	}
+	if loaded.Backups.Find(recent.ID).StorageTier() != repository.TierHot {
+		t.Fatalf("expected the recent backup to stay hot, got %q", loaded.Backups.Find(recent.ID).StorageTier())
+	}
+}
@@ -0,0 +1,140 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/repository"
+)
+
+type PurgeState string
+type PurgeAction string
+
+const (
+	PurgeStateInitial       PurgeState = "initial"
+	PurgeStateRemoteRemoved PurgeState = "remote_removed"
+	PurgeStateCompleted     PurgeState = "completed"
+)
+
+type PurgeFSMData struct {
+	Trashed *repository.TrashedBackup
+}
+
+type PurgeOpts struct {
+	DryRun bool
+}
+
+// PurgeDueFromTrash permanently deletes the snapshots of backups that have
+// been in the trash longer than the configured retention.
+func (r *Runner) PurgeDueFromTrash(ctx context.Context, opts PurgeOpts) error {
+	retention := r.Config.Repository.Trash.Retention
+	if retention == 0 && len(r.Store.Trash) > 0 {
+		slog.Warn("The trash is disabled, but still holds backups. Purging all of them.", "count", len(r.Store.Trash))
+	}
+
+	due := r.Store.Trash.DueForPurge(retention)
+	slog.Info("Purging backups from the trash", "count", len(due), "retention", retention, "dry_run", opts.DryRun)
+
+	for _, trashed := range due {
+		if err := r.PurgeFromTrash(ctx, trashed, opts); err != nil {
+			return fmt.Errorf("failed to purge backup %s from the trash: %w", trashed.Backup.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// PurgeFromTrash permanently deletes the snapshot and manifest of a trashed
+// backup, and then forgets it.
+func (r *Runner) PurgeFromTrash(ctx context.Context, trashed *repository.TrashedBackup, opts PurgeOpts) error {
+	slog.Debug("Purging backup from the trash", "backup", trashed.Backup.ID, "dataset", trashed.Backup.Dataset, "opts", opts)
+
+	fsm := r.createPurgeFSM(trashed)
+
+	if opts.DryRun {
+		return fsm.Run(ctx, "dry_run")
+	}
+
+	return fsm.RunSequence(ctx, "remove_remote", "update_store")
+}
+
+func (r *Runner) createPurgeFSM(trashed *repository.TrashedBackup) *fsm.FSM[PurgeState, PurgeAction, PurgeFSMData] {
+	return fsm.NewFSM(
+		"purge",
+		fsm.State[PurgeState, PurgeFSMData]{
+			ID:   PurgeStateInitial,
+			Data: &PurgeFSMData{Trashed: trashed},
+		},
+		map[PurgeAction]fsm.Transition[PurgeState, PurgeFSMData]{
+			"dry_run": {
+				From: PurgeStateInitial,
+				To:   PurgeStateCompleted,
+				Run: func(ctx context.Context, data *PurgeFSMData) error {
+					slog.Warn("Dry run. Backup would be purged from the trash.",
+						"dataset", data.Trashed.Backup.Dataset,
+						"backup", data.Trashed.Backup.ID,
+						"deleted_at", data.Trashed.DeletedAt,
+					)
+					return nil
+				},
+			},
+			"remove_remote": {
+				From: PurgeStateInitial,
+				To:   PurgeStateRemoteRemoved,
+				Run: func(ctx context.Context, data *PurgeFSMData) error {
+					backup := &data.Trashed.Backup
+					slog.Debug("Removing trashed backup from remote", "dataset", backup.Dataset, "backup", backup.ID)
+
+					snapshotStorage, err := r.snapshotStorage(backup)
+					if err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					if err := snapshotStorage.DeleteSnapshot(ctx, backup.Dataset, backup.ID.String()); err != nil {
+						slog.Error("Failed to delete backup from remote store", "error", err)
+						return fmt.Errorf("failed to delete backup from remote store: %w", err)
+					}
+
+					// Manifests always live in the hot storage.
+					if err := repository.DeleteManifest(ctx, r.Storage, backup.Dataset, backup.ID); err != nil {
+						slog.Error("Failed to delete backup manifest from remote store", "error", err)
+						return fmt.Errorf("failed to delete backup manifest from remote store: %w", err)
+					}
+
+					r.deleteFromReplicas(ctx, backup)
+
+					return nil
+				},
+			},
+			"update_store": {
+				From: PurgeStateRemoteRemoved,
+				To:   PurgeStateCompleted,
+				Run: func(ctx context.Context, data *PurgeFSMData) error {
+					if err := r.Store.RemoveFromTrash(ctx, data.Trashed.Backup.ID); err != nil {
+						return fsm.NewUnrecoverableError(err)
+					}
+
+					if err := r.Store.Save(ctx, r.Storage); err != nil {
+						slog.Error("Failed to save store", "error", err)
+						return fmt.Errorf("failed to save store: %w", err)
+					}
+
+					slog.Info("Backup purged from the trash", "dataset", data.Trashed.Backup.Dataset, "backup", data.Trashed.Backup.ID)
+					return nil
+				},
+			},
+		},
+		fsm.RetryExponentialBackoffConfig{
+			MaxRetries:     5,
+			WaitIncrements: 2 * time.Second,
+			MaxWait:        10 * time.Second,
+		},
+	).WithSafeStates(
+		// Once the snapshot is removed, the store has to be updated.
+		PurgeStateInitial,
+		PurgeStateCompleted,
+	)
+}
@@ -0,0 +1,124 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/oklog/ulid/v2"
+)
+
+// Undelete moves a backup that is in the trash, or whose deletion didn't
+// finish, back to the backups, together with the deleted backups it depends
+// on. It fails if the snapshot of any of them is gone from the repository,
+// and warns about the ones whose local snapshot was destroyed.
+func (r *Runner) Undelete(ctx context.Context, id ulid.ULID, dryRun bool) ([]*repository.Backup, error) {
+	chain, err := r.Store.DeletedChain(id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotDeleted) ||
+			errors.Is(err, repository.ErrOrphanUncommitted) ||
+			errors.Is(err, repository.ErrTrashParentPurged) {
+			return nil, &errclass.ValidationError{Subject: "backup", Err: err}
+		}
+		return nil, err
+	}
+
+	if err := r.verifyRemoteSnapshots(ctx, chain); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		for _, backup := range chain {
+			slog.Warn("Dry run. Backup would be undeleted.", "dataset", backup.Dataset, "backup", backup.ID)
+		}
+		return chain, nil
+	}
+
+	undeleted, err := r.Store.Undelete(ctx, id)
+	if err != nil {
+		return nil, &errclass.ValidationError{Subject: "backup", Err: err}
+	}
+
+	if err := r.Store.Save(ctx, r.Storage); err != nil {
+		slog.Error("Failed to save store", "error", err)
+		return nil, fmt.Errorf("failed to save store: %w", err)
+	}
+
+	for _, backup := range undeleted {
+		slog.Info("Undeleted backup", "dataset", backup.Dataset, "backup", backup.ID)
+	}
+
+	r.warnMissingLocalSnapshots(ctx, undeleted)
+	return undeleted, nil
+}
+
+// warnMissingLocalSnapshots warns about undeleted backups whose local snapshot
+// was destroyed when they were deleted. They can be restored, but the next
+// backup can't be taken on top of them.
+func (r *Runner) warnMissingLocalSnapshots(ctx context.Context, undeleted []*repository.Backup) {
+	for _, backup := range undeleted {
+		if backup.Imported != nil {
+			continue
+		}
+
+		exists, err := r.ZFS.SnapshotExists(ctx, backup.Dataset, backup.ID)
+		if err != nil {
+			slog.Warn("Failed to check if the local snapshot of the undeleted backup exists", "dataset", backup.Dataset, "backup", backup.ID, "error", err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		var parent bool
+		r.Store.View(func() { parent = isNextParent(r.Store.Backups, backup) })
+		if parent {
+			slog.Warn("The local snapshot of the undeleted backup was destroyed, and the next diff or incr backup of its dataset is taken on top of it, which fails. Take a new full backup of the dataset.",
+				"dataset", backup.Dataset, "backup", backup.ID, "type", backup.Type)
+			continue
+		}
+
+		slog.Info("The local snapshot of the undeleted backup was destroyed. It can be restored, but new backups can't be taken on top of it.", "dataset", backup.Dataset, "backup", backup.ID)
+	}
+}
+
+// isNextParent reports whether the next diff or incr backup of backup's
+// dataset would be taken on top of backup.
+func isNextParent(bs repository.Backups, backup *repository.Backup) bool {
+	for _, typ := range []repository.BackupType{repository.BackupTypeDiff, repository.BackupTypeIncr} {
+		if parent, err := bs.GetParent(backup.Dataset, typ); err == nil && parent.ID == backup.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyRemoteSnapshots checks that the snapshots of backups still exist in
+// the storage of their tier.
+func (r *Runner) verifyRemoteSnapshots(ctx context.Context, backups []*repository.Backup) error {
+	for _, backup := range backups {
+		snapshotStorage, err := r.snapshotStorage(backup)
+		if err != nil {
+			return err
+		}
+
+		_, err = snapshotStorage.StatSnapshot(ctx, backup.Dataset, backup.ID.String())
+		if errors.Is(err, errclass.ErrNotFound) {
+			slog.Error("Remote snapshot no longer exists", "dataset", backup.Dataset, "backup", backup.ID)
+			return &errclass.ValidationError{
+				Subject: "backup",
+				Err:     fmt.Errorf("the snapshot of backup %s no longer exists in the repository", backup.ID),
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to check remote snapshot", "dataset", backup.Dataset, "backup", backup.ID, "error", err)
+			return fmt.Errorf("failed to check remote snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
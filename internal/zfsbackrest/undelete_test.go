@@ -0,0 +1,114 @@
+package zfsbackrest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestUndelete(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	b.Trash(incr, time.Hour)
+	b.Orphan(diff, repository.OrphanReasonStartedDeletion)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	for _, backup := range []*repository.Backup{full, diff, incr} {
+		w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	undeleted, err := r.Undelete(ctx, incr.ID, true)
+	if err != nil {
+		t.Fatalf("undelete dry run: %v", err)
+	}
+	if len(undeleted) != 2 || undeleted[0].ID != diff.ID || undeleted[1].ID != incr.ID {
+		t.Fatalf("expected the diff and then the incr to be undeleted, got %v", undeleted)
+	}
+	if _, ok := store.Backups.Get(incr.ID); ok {
+		t.Fatal("expected a dry run to leave the store as it was")
+	}
+
+	if _, err := r.Undelete(ctx, incr.ID, false); err != nil {
+		t.Fatalf("undelete: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if loaded.Backups.Len() != 3 || len(loaded.Orphans) != 0 || len(loaded.Trash) != 0 {
+		t.Fatalf("expected every backup to be live, got %d backups, %d orphans and %d trashed",
+			loaded.Backups.Len(), len(loaded.Orphans), len(loaded.Trash))
+	}
+}
+
+func TestUndeleteRemoteSnapshotMissing(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 72*time.Hour)
+	b.Trash(full, time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	_, err = r.Undelete(ctx, full.ID, false)
+	var validationErr *errclass.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if _, ok := store.Trash[full.ID]; !ok {
+		t.Fatal("expected the backup to stay in the trash")
+	}
+}
+
+func TestIsNextParent(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	oldFull := b.Full("tank/data", 96*time.Hour)
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	store := b.Build()
+
+	for _, tt := range []struct {
+		backup *repository.Backup
+		parent bool
+	}{
+		{oldFull, false},
+		{full, true},
+		{diff, true},
+		{incr, false},
+	} {
+		if got := isNextParent(store.Backups, tt.backup); got != tt.parent {
+			t.Errorf("backup %s (%s): expected next parent %v, got %v", tt.backup.ID, tt.backup.Type, tt.parent, got)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gobwas/glob"
+)
+
+// UnmanageBackups is what unmanaging a dataset does with its backups.
+type UnmanageBackups string
+
+const (
+	// UnmanageKeep keeps every backup, to be restored or deleted later.
+	UnmanageKeep UnmanageBackups = "keep"
+	// UnmanageExpire deletes the backups the retention policy expires, and
+	// keeps the others.
+	UnmanageExpire UnmanageBackups = "expire"
+	// UnmanageDelete deletes every backup.
+	UnmanageDelete UnmanageBackups = "delete"
+)
+
+var unmanageBackups = []UnmanageBackups{UnmanageKeep, UnmanageExpire, UnmanageDelete}
+
+// ParseUnmanageBackups parses what to do with the backups of an unmanaged
+// dataset.
+func ParseUnmanageBackups(s string) (UnmanageBackups, error) {
+	if !slices.Contains(unmanageBackups, UnmanageBackups(s)) {
+		return "", &errclass.ValidationError{Subject: "backups", Err: fmt.Errorf("unknown action %q, expected one of %v", s, unmanageBackups)}
+	}
+
+	return UnmanageBackups(s), nil
+}
+
+type UnmanageOpts struct {
+	Backups UnmanageBackups
+	// SkipTrash deletes the backups for good, even if the trash is enabled.
+	SkipTrash bool
+	DryRun    bool
+}
+
+// UnmanageResult is what unmanaging a dataset did, or would do in a dry run.
+type UnmanageResult struct {
+	// Deleted are the backups deleted, newest first.
+	Deleted []*repository.Backup
+	// Kept are the backups left in the repository, oldest first. The holds
+	// on their local snapshots are released.
+	Kept []*repository.Backup
+	// Held are the backups that expired, but are kept until their Object
+	// Lock ends, oldest first. They are in Kept too.
+	Held []*repository.Backup
+}
+
+// Unmanage stops managing a dataset that was removed from
+// repository.included_datasets. Its backups are kept, expired or deleted as
+// opts say, the holds on the local snapshots of the ones kept are released,
+// as no backup will be sent from them anymore, and the dataset is removed
+// from the managed datasets. Unmanaging a dataset that isn't managed anymore,
+// but still has backups, handles its backups again.
+func (r *Runner) Unmanage(ctx context.Context, dataset string, opts UnmanageOpts) (*UnmanageResult, error) {
+	slog.Debug("Unmanaging dataset", "dataset", dataset, "opts", opts)
+
+	if err := checkNotIncluded(&r.Config.Repository, dataset); err != nil {
+		return nil, err
+	}
+
+	var backups repository.Backups
+	var managed bool
+	r.Store.View(func() {
+		backups = r.Store.Backups.OfDataset(dataset)
+		managed = slices.Contains(r.Store.ManagedDatasets, dataset)
+	})
+	if !managed && backups.Len() == 0 {
+		return nil, &errclass.ValidationError{Subject: "dataset", Err: fmt.Errorf("%s is not managed and has no backups", dataset)}
+	}
+
+	result, err := planUnmanage(backups, dataset, opts.Backups, &r.Config.Repository.Expiry, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		slog.Warn("Dry run. Skipping mutating anything.", "dataset", dataset, "delete", len(result.Deleted), "keep", len(result.Kept))
+		return result, nil
+	}
+
+	// The dataset may have been destroyed already, with its snapshots.
+	exists, err := r.ZFS.DatasetExists(ctx, dataset)
+	if err != nil {
+		slog.Error("Failed to check if dataset exists", "dataset", dataset, "error", err)
+		return nil, fmt.Errorf("failed to check if dataset exists: %w", err)
+	}
+	if !exists {
+		slog.Info("Dataset doesn't exist anymore. Leaving local snapshots alone.", "dataset", dataset)
+	}
+
+	deleteOpts := DeleteOpts{SkipTrash: opts.SkipTrash, SkipLocalSnapshotRemoval: !exists}
+	for _, backup := range result.Deleted {
+		if err := r.Delete(ctx, dataset, backup.ID, deleteOpts); err != nil {
+			return nil, fmt.Errorf("failed to delete backup %s: %w", backup.ID, err)
+		}
+	}
+
+	if exists {
+		for _, backup := range result.Kept {
+			if err := r.ZFS.ReleaseSnapshot(ctx, true, dataset, backup.ID); err != nil {
+				slog.Warn("Failed to release snapshot. Its non-fatal.", "dataset", dataset, "backup", backup.ID, "error", err)
+			}
+		}
+	}
+
+	if r.Store.Unmanage(dataset) {
+		if err := r.Store.Save(ctx, r.Storage); err != nil {
+			slog.Error("Failed to save store", "error", err)
+			return nil, fmt.Errorf("failed to save store: %w", err)
+		}
+	}
+
+	slog.Info("Dataset unmanaged", "dataset", dataset, "deleted", len(result.Deleted), "kept", len(result.Kept))
+	return result, nil
+}
+
+// checkNotIncluded checks dataset isn't matched by the included datasets
+// anymore, as it would be managed again by the next run otherwise.
+func checkNotIncluded(cfg *config.Repository, dataset string) error {
+	for _, pattern := range cfg.IncludedDatasets {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return &errclass.ConfigError{Key: "repository.included_datasets", Err: fmt.Errorf("invalid glob pattern %q: %w", pattern, err)}
+		}
+
+		if g.Match(dataset) {
+			return &errclass.ValidationError{
+				Subject: "dataset",
+				Err:     fmt.Errorf("%s still matches %q in repository.included_datasets. Remove it from there first", dataset, pattern),
+			}
+		}
+	}
+
+	return nil
+}
+
+// planUnmanage splits the backups of dataset into the ones to delete, and the
+// ones to keep.
+func planUnmanage(backups repository.Backups, dataset string, action UnmanageBackups, expiry *config.Expiry, now time.Time) (*UnmanageResult, error) {
+	deleted := repository.NewBackups()
+	result := &UnmanageResult{}
+
+	switch action {
+	case UnmanageKeep:
+	case UnmanageExpire:
+		expired, err := backups.ExpiredBackupsForDataset(dataset, expiry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get expired backups: %w", err)
+		}
+		result.Held = backups.HoldLocked(expired, now)
+		deleted = expired
+	case UnmanageDelete:
+		deleted = backups
+	default:
+		return nil, &errclass.ValidationError{Subject: "backups", Err: fmt.Errorf("unknown action %q, expected one of %v", action, unmanageBackups)}
+	}
+
+	for id, backup := range backups.All() {
+		if _, ok := deleted.Get(id); ok {
+			result.Deleted = append(result.Deleted, backup)
+		} else {
+			result.Kept = append(result.Kept, backup)
+		}
+	}
+
+	// Children are deleted before their parents.
+	sort.Slice(result.Deleted, func(i, j int) bool {
+		return result.Deleted[i].ID.Compare(result.Deleted[j].ID) > 0
+	})
+	sort.Slice(result.Kept, func(i, j int) bool {
+		return result.Kept[i].ID.Compare(result.Kept[j].ID) < 0
+	})
+
+	return result, nil
+}
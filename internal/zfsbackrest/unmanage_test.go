@@ -0,0 +1,92 @@
+package zfsbackrest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestPlanUnmanage(t *testing.T) {
+	now := time.Now()
+	expiry := &config.Expiry{Full: 72 * time.Hour, Diff: 72 * time.Hour, Incr: 72 * time.Hour}
+
+	b := repositorytest.NewStore("tank/data", "tank/other")
+	oldFull := b.Full("tank/data", 96*time.Hour)
+	oldDiff := b.Diff(oldFull, 90*time.Hour)
+	full := b.Full("tank/data", 24*time.Hour)
+	b.Full("tank/other", 96*time.Hour)
+	backups := b.Build().Backups.OfDataset("tank/data")
+
+	ids := func(backups []*repository.Backup) []ulid.ULID {
+		var ids []ulid.ULID
+		for _, backup := range backups {
+			ids = append(ids, backup.ID)
+		}
+		return ids
+	}
+	check := func(t *testing.T, action UnmanageBackups, deleted, kept []*repository.Backup) *UnmanageResult {
+		t.Helper()
+		result, err := planUnmanage(backups, "tank/data", action, expiry, now)
+		if err != nil {
+			t.Fatalf("plan: %v", err)
+		}
+		if got, want := ids(result.Deleted), ids(deleted); !slices.Equal(got, want) {
+			t.Errorf("expected to delete %v, got %v", want, got)
+		}
+		if got, want := ids(result.Kept), ids(kept); !slices.Equal(got, want) {
+			t.Errorf("expected to keep %v, got %v", want, got)
+		}
+		return result
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		check(t, UnmanageKeep, nil, []*repository.Backup{oldFull, oldDiff, full})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		// Children are deleted before their parents.
+		check(t, UnmanageDelete, []*repository.Backup{full, oldDiff, oldFull}, nil)
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		check(t, UnmanageExpire, []*repository.Backup{oldDiff, oldFull}, []*repository.Backup{full})
+	})
+
+	t.Run("expire holds locked backups", func(t *testing.T) {
+		lockedUntil := now.Add(time.Hour)
+		oldDiff.LockedUntil = &lockedUntil
+		defer func() { oldDiff.LockedUntil = nil }()
+
+		result := check(t, UnmanageExpire, nil, []*repository.Backup{oldFull, oldDiff, full})
+		if len(result.Held) != 2 {
+			t.Errorf("expected the locked diff and its parent to be held, got %v", ids(result.Held))
+		}
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		var validationErr *errclass.ValidationError
+		if _, err := planUnmanage(backups, "tank/data", "archive", expiry, now); !errors.As(err, &validationErr) {
+			t.Fatalf("expected a validation error, got %v", err)
+		}
+	})
+}
+
+func TestCheckNotIncluded(t *testing.T) {
+	cfg := &config.Repository{IncludedDatasets: []string{"tank/data", "pool/*"}}
+
+	if err := checkNotIncluded(cfg, "tank/old"); err != nil {
+		t.Errorf("expected a removed dataset to pass, got %v", err)
+	}
+
+	var validationErr *errclass.ValidationError
+	if err := checkNotIncluded(cfg, "pool/vm"); !errors.As(err, &validationErr) {
+		t.Errorf("expected a dataset still matched by a pattern to be refused, got %v", err)
+	}
+}
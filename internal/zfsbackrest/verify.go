@@ -0,0 +1,348 @@
+package zfsbackrest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/framing"
+	"github.com/gargakshit/zfsbackrest/fsm"
+	"github.com/gargakshit/zfsbackrest/internal/util"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/zfs"
+	"github.com/sourcegraph/conc/pool"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrSnapshotSizeMismatch     = errors.New("snapshot size does not match the backup")
+	ErrSnapshotChecksumMismatch = errors.New("snapshot checksum does not match the backup")
+	ErrSnapshotCorrupted        = errors.New("snapshot can't be decrypted, it is corrupted")
+)
+
+// isDamage reports whether a verification error means the snapshot itself is
+// damaged, rather than that it couldn't be read.
+func isDamage(err error) bool {
+	return errors.Is(err, ErrSnapshotSizeMismatch) ||
+		errors.Is(err, ErrSnapshotChecksumMismatch) ||
+		errors.Is(err, ErrSnapshotCorrupted) ||
+		errors.Is(err, repository.ErrStreamGUIDMismatch) ||
+		errors.Is(err, zfs.ErrNotSendStream) ||
+		errors.Is(err, framing.ErrTruncated) ||
+		errors.Is(err, framing.ErrTampered)
+}
+
+// VerifyOpts tune how backups are read back.
+type VerifyOpts struct {
+	// Window stops new verifications from starting once it has passed. It is
+	// unlimited when 0.
+	Window time.Duration
+	// Concurrency is how many backups are verified at once.
+	Concurrency int
+	// BandwidthLimit caps the bytes per second read by all verifications
+	// together. It is unlimited when 0.
+	BandwidthLimit int64
+}
+
+// VerifyOptsFromConfig returns the configured verification concurrency and
+// bandwidth limit.
+func VerifyOptsFromConfig(cfg *config.Verification) (VerifyOpts, error) {
+	opts := VerifyOpts{Concurrency: cfg.Concurrency}
+
+	if cfg.BandwidthLimit != "" {
+		limit, err := humanize.ParseBytes(cfg.BandwidthLimit)
+		if err != nil {
+			return VerifyOpts{}, &errclass.ConfigError{Key: "repository.verification.bandwidth_limit", Err: err}
+		}
+		opts.BandwidthLimit = int64(limit)
+	}
+
+	return opts, nil
+}
+
+// VerifyScheduled verifies the backups picked by the configured verification
+// policy, within the configured window.
+func (r *Runner) VerifyScheduled(ctx context.Context, opts VerifyOpts) error {
+	policy := r.Config.Repository.Verification
+	if policy.Sample < 0 || policy.Sample > 1 {
+		return &errclass.ConfigError{
+			Key: "repository.verification.sample",
+			Err: fmt.Errorf("sample must be between 0 and 1, got %v", policy.Sample),
+		}
+	}
+
+	due := r.Store.Backups.DueForVerification(policy.Sample, policy.MaxAge, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+	slog.Info("Verifying backups", "count", len(due), "total", r.Store.Backups.Len(), "sample", policy.Sample, "max_age", policy.MaxAge)
+
+	opts.Window = policy.Window
+	return r.VerifyBackups(ctx, due, opts)
+}
+
+type ScrubOpts struct {
+	VerifyOpts
+	// Dataset limits the scrub to the backups of a dataset.
+	Dataset string
+}
+
+// Scrub verifies every backup, like `zpool scrub` does for a pool. Damaged
+// backups are recorded in the store, and reported at the end.
+func (r *Runner) Scrub(ctx context.Context, opts ScrubOpts) error {
+	var backups []*repository.Backup
+	for _, backup := range r.Store.Backups.All() {
+		if opts.Dataset == "" || backup.Dataset == opts.Dataset {
+			backups = append(backups, backup)
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID.Compare(backups[j].ID) < 0
+	})
+
+	slog.Info("Scrubbing backups", "count", len(backups), "dataset", opts.Dataset)
+	err := r.VerifyBackups(ctx, backups, opts.VerifyOpts)
+
+	for _, backup := range r.Store.Backups.Damaged() {
+		slog.Error("Backup is damaged. Restores of it, and of the backups depending on it, will fail.",
+			"dataset", backup.Dataset,
+			"backup", backup.ID,
+			"detected_at", backup.Damage.DetectedAt,
+			"reason", backup.Damage.Reason,
+		)
+	}
+
+	return err
+}
+
+// VerifyBackups verifies backups with a pool of opts.Concurrency workers, and
+// records the verified and the damaged ones in the store. It returns the
+// errors of every failed verification.
+func (r *Runner) VerifyBackups(ctx context.Context, backups []*repository.Backup, opts VerifyOpts) error {
+	slog.Debug("Verifying backups", "count", len(backups), "opts", opts)
+
+	start := time.Now()
+	limiter := util.NewBandwidthLimiter(opts.BandwidthLimit)
+
+	var mu sync.Mutex
+	var errs []error
+	verified, damaged, skipped := 0, 0, 0
+
+	workers := pool.New().WithMaxGoroutines(max(opts.Concurrency, 1))
+	for _, backup := range backups {
+		workers.Go(func() {
+			if opts.Window > 0 && time.Since(start) > opts.Window {
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+				return
+			}
+
+			// Verifications in flight finish after a soft cancel, the
+			// remaining ones are skipped.
+			if ctx.Err() != nil || fsm.SoftCancelled(ctx) {
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+				return
+			}
+
+			err := r.verifyBackup(ctx, backup, limiter)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to verify backup %s: %w", backup.ID, err))
+				if !isDamage(err) {
+					slog.Error("Backup verification failed", "dataset", backup.Dataset, "backup", backup.ID, "error", err)
+					return
+				}
+
+				slog.Error("Backup is damaged", "dataset", backup.Dataset, "backup", backup.ID, "error", err)
+				r.Store.Update(func() { backup.MarkDamaged(time.Now(), err.Error()) })
+				damaged++
+				return
+			}
+
+			r.Store.Update(func() { backup.MarkVerified(time.Now()) })
+			verified++
+		})
+	}
+	workers.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	} else if skipped > 0 && fsm.SoftCancelled(ctx) {
+		errs = append(errs, fsm.ErrStopped)
+	}
+
+	if skipped > 0 && opts.Window > 0 && time.Since(start) > opts.Window {
+		slog.Warn("Verification window is over. The remaining backups are left for the next run.", "remaining", skipped)
+	}
+
+	if verified > 0 || damaged > 0 {
+		// Don't lose the results if the run was cancelled.
+		if err := r.Store.Save(context.WithoutCancel(ctx), r.Storage); err != nil {
+			slog.Error("Failed to save store", "error", err)
+			errs = append(errs, fmt.Errorf("failed to save store: %w", err))
+		}
+	}
+
+	slog.Info("Verification finished", "verified", verified, "damaged", damaged, "failed", len(errs), "skipped", skipped)
+	return errors.Join(errs...)
+}
+
+// VerifyBackup checks the chain of a backup is complete, reads back its
+// snapshot and checks it against the size and checksum recorded when it was
+// sent, and, if its stream was recorded, the GUIDs in the stream header
+// against the recorded ones.
+func (r *Runner) VerifyBackup(ctx context.Context, backup *repository.Backup) error {
+	return r.verifyBackup(ctx, backup, nil)
+}
+
+// verifyBackup is VerifyBackup, throttled by limiter.
+func (r *Runner) verifyBackup(ctx context.Context, backup *repository.Backup, limiter *rate.Limiter) error {
+	slog.Debug("Verifying backup", "dataset", backup.Dataset, "backup", backup.ID, "tier", backup.StorageTier())
+
+	// However intact its snapshot is, a backup can't be restored if its chain
+	// is broken. The objects of its parents are left to their own
+	// verification.
+	if _, err := r.Store.Restorable(backup.ID, nil); err != nil {
+		return &errclass.ValidationError{Subject: "backup " + backup.ID.String(), Err: err}
+	}
+
+	snapshotStorage, err := r.snapshotStorage(backup)
+	if err != nil {
+		return err
+	}
+
+	if archive, ok := storage.As[storage.ArchiveStore](snapshotStorage); ok {
+		err := archive.RetrieveSnapshot(ctx, backup.Dataset, backup.ID.String(), true)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve archived snapshot: %w", err)
+		}
+	}
+
+	snapshotEncryption, err := r.snapshotEncryption(backup)
+	if err != nil {
+		return err
+	}
+
+	// Read the snapshot as stored and decrypt it here, so read errors of the
+	// storage can be told apart from a corrupted snapshot.
+	raw, err := snapshotStorage.OpenSnapshotReadStream(ctx, backup.Dataset, backup.ID.String(), encryption.Passthrough{})
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot read stream: %w", err)
+	}
+
+	subject := "snapshot " + backup.ID.String()
+	tracked := &readErrorTracker{ReadCloser: util.NewLimitedReader(ctx, raw, limiter)}
+	reader, err := snapshotEncryption.DecryptedReader(tracked)
+	if err != nil {
+		_ = raw.Close()
+		if tracked.err != nil || errclass.Of(err) == errclass.ClassEncryption {
+			return fmt.Errorf("failed to decrypt snapshot: %w", err)
+		}
+		return &errclass.ValidationError{Subject: subject, Err: fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)}
+	}
+
+	wrappedReader := util.NewLoggedReader("verify", reader, backup.Size)
+	defer wrappedReader.Close()
+
+	hash := sha256.New()
+	header := &headWriter{limit: zfs.StreamHeaderSize}
+	size, err := io.Copy(io.MultiWriter(hash, header), wrappedReader)
+	if err != nil {
+		if tracked.err != nil || ctx.Err() != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		return &errclass.ValidationError{Subject: subject, Err: fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)}
+	}
+
+	if backup.Size > 0 && size != backup.Size {
+		return &errclass.ValidationError{
+			Subject: subject,
+			Err:     fmt.Errorf("%w: read %d bytes, expected %d", ErrSnapshotSizeMismatch, size, backup.Size),
+		}
+	}
+
+	if err := r.checkStreamHeader(backup, header.buf); err != nil {
+		return &errclass.ValidationError{Subject: subject, Err: err}
+	}
+
+	if backup.Checksum == "" {
+		slog.Warn("Backup has no checksum. Only checked that its snapshot can be read.", "backup", backup.ID)
+		return nil
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != backup.Checksum {
+		return &errclass.ValidationError{
+			Subject: subject,
+			Err:     fmt.Errorf("%w: got %s, expected %s", ErrSnapshotChecksumMismatch, checksum, backup.Checksum),
+		}
+	}
+
+	slog.Info("Backup verified", "dataset", backup.Dataset, "backup", backup.ID, "size", size)
+	return nil
+}
+
+// checkStreamHeader checks the GUIDs in the header of the stream of a backup
+// against the recorded ones. Backups taken before the stream was recorded
+// aren't checked.
+func (r *Runner) checkStreamHeader(backup *repository.Backup, head []byte) error {
+	if backup.Send == nil {
+		return nil
+	}
+
+	header, err := zfs.ParseStreamHeader(head)
+	if err != nil {
+		return err
+	}
+	if header.Compound {
+		slog.Debug("Snapshot stream is compound. Not checking its GUIDs.", "backup", backup.ID)
+		return nil
+	}
+
+	r.Store.View(func() { err = r.Store.Backups.CheckStreamGUIDs(backup, header.ToGUID, header.FromGUID) })
+	return err
+}
+
+// headWriter keeps the first limit bytes written to it.
+type headWriter struct {
+	limit int
+	buf   []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), w.limit-len(w.buf)); n > 0 {
+		w.buf = append(w.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// readErrorTracker remembers the first error of the underlying reader, other
+// than io.EOF.
+type readErrorTracker struct {
+	io.ReadCloser
+	err error
+}
+
+func (t *readErrorTracker) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
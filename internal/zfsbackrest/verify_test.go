@@ -0,0 +1,187 @@
+package zfsbackrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+	"github.com/gargakshit/zfsbackrest/zfs"
+)
+
+func TestVerifyBackups(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	good := b.Full("tank/data", 48*time.Hour)
+	corrupt := b.Full("tank/data", 24*time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	stream := []byte("zfs send stream")
+	checksum := sha256.Sum256(stream)
+	for _, backup := range []*repository.Backup{good, corrupt} {
+		backup.Size = int64(len(stream))
+		backup.Checksum = hex.EncodeToString(checksum[:])
+	}
+
+	for backup, content := range map[*repository.Backup][]byte{good: stream, corrupt: []byte("zfs send strea!")} {
+		w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write(content)
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	err = r.VerifyBackups(ctx, []*repository.Backup{good, corrupt}, VerifyOpts{Concurrency: 2})
+	if !errors.Is(err, ErrSnapshotChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, hot)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	if loaded.Backups.Find(good.ID).VerifiedAt == nil {
+		t.Fatal("expected the good backup to be recorded as verified")
+	}
+	if loaded.Backups.Find(corrupt.ID).VerifiedAt != nil {
+		t.Fatal("expected the corrupt backup not to be recorded as verified")
+	}
+	if loaded.Backups.Find(corrupt.ID).Damage == nil {
+		t.Fatal("expected the corrupt backup to be marked as damaged")
+	}
+}
+
+func TestScrubCorruptedCiphertext(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	ageConfig := config.Age{RecipientPublicKey: identity.Recipient().String()}
+	enc, err := encryption.NewAgeFromIdentities([]string{identity.String()}, &ageConfig, encryption.AgeOpts{})
+	if err != nil {
+		t.Fatalf("create encryption: %v", err)
+	}
+
+	b := repositorytest.NewStore("tank/data").WithEncryption(config.Encryption{Age: ageConfig})
+	backup := b.Full("tank/data", time.Hour)
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, enc)
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(bytes.Repeat([]byte("zfs send stream"), 1024))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	// Flip a bit in the payload, past the age header.
+	content, _ := hot.RawSnapshot(backup.Dataset, backup.ID.String())
+	content[len(content)-100] ^= 1
+	if err := hot.DeleteSnapshot(ctx, backup.Dataset, backup.ID.String()); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	w, err = hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	_, _ = w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close write stream: %v", err)
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: enc}
+	if err := r.Scrub(ctx, ScrubOpts{}); !errors.Is(err, ErrSnapshotCorrupted) {
+		t.Fatalf("expected the snapshot to be reported as corrupted, got %v", err)
+	}
+	if store.Backups.Find(backup.ID).Damage == nil {
+		t.Fatal("expected the backup to be marked as damaged")
+	}
+}
+
+func TestVerifyStreamGUIDs(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 48*time.Hour)
+	full.GUID = "100"
+	full.Send = &repository.SendStream{Compressed: true}
+	diff := b.Diff(full, 24*time.Hour)
+	diff.GUID = "200"
+	diff.Send = &repository.SendStream{Compressed: true, FromGUID: "100"}
+	store, err := b.Save(ctx, hot)
+	if err != nil {
+		t.Fatalf("save store: %v", err)
+	}
+
+	// The BEGIN record of a stream, as sent by a little-endian host.
+	header := func(toGUID, fromGUID uint64) []byte {
+		h := make([]byte, 64)
+		binary.LittleEndian.PutUint64(h[8:], 0x2F5bacbac)
+		binary.LittleEndian.PutUint64(h[16:], 1)
+		binary.LittleEndian.PutUint64(h[40:], toGUID)
+		binary.LittleEndian.PutUint64(h[48:], fromGUID)
+		return h
+	}
+	write := func(backup *repository.Backup, stream []byte) {
+		t.Helper()
+		checksum := sha256.Sum256(stream)
+		backup.Size = int64(len(stream))
+		backup.Checksum = hex.EncodeToString(checksum[:])
+
+		w, err := hot.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		_, _ = w.Write(stream)
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+
+	r := &Runner{Config: &config.Config{}, Store: store, Storage: hot, Encryption: encryption.Passthrough{}}
+
+	write(full, header(100, 0))
+	write(diff, header(200, 100))
+	if err := r.VerifyBackups(ctx, []*repository.Backup{full, diff}, VerifyOpts{Concurrency: 1}); err != nil {
+		t.Fatalf("expected the streams to match, got %v", err)
+	}
+
+	// A stream incremental from another snapshot than the parent's.
+	write(diff, header(200, 300))
+	if err := r.VerifyBackup(ctx, diff); !errors.Is(err, repository.ErrStreamGUIDMismatch) || !isDamage(err) {
+		t.Fatalf("expected a GUID mismatch, got %v", err)
+	}
+
+	write(full, []byte("not a zfs send stream"))
+	if err := r.VerifyBackup(ctx, full); !errors.Is(err, zfs.ErrNotSendStream) {
+		t.Fatalf("expected the stream to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package zfsbackrest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// TierStores returns the hot storage, the cold storage if tiering is enabled,
+// and the storage of every route, by name.
+func (r *Runner) TierStores() map[string]storage.StrongStore {
+	stores := map[string]storage.StrongStore{"hot": r.Storage}
+	if r.ColdStorage != nil {
+		stores["cold"] = r.ColdStorage
+	}
+	for _, route := range r.Routes {
+		stores[route.StorageName()] = route.Storage
+	}
+
+	return stores
+}
+
+// PurgeNoncurrentVersions removes the noncurrent versions and delete markers
+// of snapshot objects from every versioned storage of the repository.
+func (r *Runner) PurgeNoncurrentVersions(ctx context.Context, dryRun bool) error {
+	for tier, s := range r.TierStores() {
+		versioned, ok := storage.As[storage.VersionedStore](s)
+		if !ok {
+			slog.Debug("Storage doesn't support versioning, skipping", "tier", tier)
+			continue
+		}
+
+		usage, err := versioned.PurgeNoncurrentVersions(ctx, dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to purge noncurrent versions from the %s storage: %w", tier, err)
+		}
+
+		slog.Info("Purged noncurrent snapshot versions",
+			"tier", tier,
+			"versioning", usage.Status,
+			"versions", usage.NoncurrentVersions,
+			"bytes", usage.NoncurrentBytes,
+			"delete_markers", usage.DeleteMarkers,
+			"dry_run", dryRun,
+		)
+	}
+
+	return nil
+}
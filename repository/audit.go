@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// The audit log records who changed the repository, when, and how, one JSON
+// entry per line. Unlike the history log, which only proves the store wasn't
+// rolled back, it says what each save changed. Backups created and deleted,
+// and changes to the managed datasets, are found by comparing the store with
+// the one last loaded or saved; other operations append their own entries.
+
+// AuditAction is what an audit entry records.
+type AuditAction string
+
+const (
+	AuditBackupCreated   AuditAction = "backup_created"
+	AuditBackupDeleted   AuditAction = "backup_deleted"
+	AuditExpiryRun       AuditAction = "expiry_run"
+	AuditDatasetsChanged AuditAction = "datasets_changed"
+	AuditStoreRolledBack AuditAction = "store_rolled_back"
+	AuditNoteChanged     AuditAction = "note_changed"
+)
+
+// AuditEntry records a change to the repository.
+type AuditEntry struct {
+	Time      time.Time   `json:"time"`
+	Host      string      `json:"host"`
+	User      string      `json:"user"`
+	Operation string      `json:"operation"`
+	Action    AuditAction `json:"action"`
+	Dataset   string      `json:"dataset,omitempty"`
+	Backup    *ulid.ULID  `json:"backup,omitempty"`
+	Type      BackupType  `json:"type,omitempty"`
+	Details   string      `json:"details,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actions []AuditAction
+	Dataset string
+	Backup  *ulid.ULID
+	Since   time.Time
+}
+
+func (f *AuditFilter) Match(entry *AuditEntry) bool {
+	switch {
+	case len(f.Actions) > 0 && !slices.Contains(f.Actions, entry.Action):
+		return false
+	case f.Dataset != "" && entry.Dataset != f.Dataset:
+		return false
+	case f.Backup != nil && (entry.Backup == nil || *entry.Backup != *f.Backup):
+		return false
+	case entry.Time.Before(f.Since):
+		return false
+	}
+
+	return true
+}
+
+// auditBaseline is the part of the store the audit log compares saves with.
+type auditBaseline struct {
+	backups  map[ulid.ULID]*Backup
+	datasets []string
+}
+
+// newAuditBaseline records the store as it is. The caller holds s.mu.
+func (s *Store) newAuditBaseline() *auditBaseline {
+	baseline := &auditBaseline{
+		backups:  make(map[ulid.ULID]*Backup, s.Backups.Len()),
+		datasets: slices.Clone(s.ManagedDatasets),
+	}
+	for id, b := range s.Backups.All() {
+		copied := *b
+		baseline.backups[id] = &copied
+	}
+
+	return baseline
+}
+
+// auditChanges returns the entries for what changed since the baseline,
+// oldest backup first. A store that was never loaded or saved has no
+// baseline, e.g. a new or rebuilt one, and nothing is recorded for it. The
+// caller holds s.mu and s.saveMu.
+func (s *Store) auditChanges() []AuditEntry {
+	if s.audited == nil {
+		return nil
+	}
+
+	var entries []AuditEntry
+	for id, b := range s.Backups.All() {
+		if _, ok := s.audited.backups[id]; !ok {
+			details := fmt.Sprintf("%d bytes", b.Size)
+			if len(b.Tags) > 0 {
+				details += ", tags " + FormatTags(b.Tags)
+			}
+			entries = append(entries, AuditEntry{
+				Action:  AuditBackupCreated,
+				Dataset: b.Dataset,
+				Backup:  &id,
+				Type:    b.Type,
+				Details: details,
+			})
+		}
+	}
+	for id, b := range s.audited.backups {
+		if current, ok := s.Backups.Get(id); ok {
+			if current.Note != b.Note {
+				entries = append(entries, AuditEntry{
+					Action:  AuditNoteChanged,
+					Dataset: b.Dataset,
+					Backup:  &id,
+					Type:    b.Type,
+					Details: current.Note,
+				})
+			}
+			continue
+		}
+
+		details := ""
+		if _, ok := s.Trash[id]; ok {
+			details = "moved to the trash"
+		}
+		entries = append(entries, AuditEntry{
+			Action:  AuditBackupDeleted,
+			Dataset: b.Dataset,
+			Backup:  &id,
+			Type:    b.Type,
+			Details: details,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Backup.Compare(*entries[j].Backup) < 0
+	})
+
+	var added, removed []string
+	for _, dataset := range s.ManagedDatasets {
+		if !slices.Contains(s.audited.datasets, dataset) {
+			added = append(added, "+"+dataset)
+		}
+	}
+	for _, dataset := range s.audited.datasets {
+		if !slices.Contains(s.ManagedDatasets, dataset) {
+			removed = append(removed, "-"+dataset)
+		}
+	}
+	if changed := slices.Concat(added, removed); len(changed) > 0 {
+		entries = append(entries, AuditEntry{
+			Action:  AuditDatasetsChanged,
+			Details: strings.Join(changed, " "),
+		})
+	}
+
+	return entries
+}
+
+// AppendAudit appends entries to the audit log. The time, host, user and
+// operation of the entries are filled in if they are empty.
+func AppendAudit(ctx context.Context, storage storage.StrongStore, entries ...AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	content, err := storage.LoadAuditContent(ctx)
+	if err != nil && !errors.Is(err, errclass.ErrNotFound) {
+		return fmt.Errorf("failed to load audit log: %w", err)
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+
+	now := time.Now()
+	host, _ := os.Hostname()
+	who := auditUser()
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			entry.Time = now
+		}
+		if entry.Host == "" {
+			entry.Host = host
+		}
+		if entry.User == "" {
+			entry.User = who
+		}
+		if entry.Operation == "" {
+			entry.Operation = operationFromContext(ctx)
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit entry: %w", err)
+		}
+		content = append(append(content, line...), '\n')
+	}
+
+	slog.Debug("Appending audit log entries", "count", len(entries))
+	if err := storage.SaveAuditContent(ctx, content); err != nil {
+		return fmt.Errorf("failed to save audit log: %w", err)
+	}
+
+	return nil
+}
+
+// LoadAudit loads the audit log entries that match filter, oldest first. A
+// missing log is empty.
+func LoadAudit(ctx context.Context, storage storage.StrongStore, filter *AuditFilter) ([]AuditEntry, error) {
+	content, err := storage.LoadAuditContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit log: %w", err)
+	}
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, &errclass.ValidationError{Subject: "audit log", Err: fmt.Errorf("line %d: %w", line, err)}
+		}
+
+		if filter.Match(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &errclass.ValidationError{Subject: "audit log", Err: err}
+	}
+
+	return entries, nil
+}
+
+// auditUser is the user running zfsbackrest, with the user who ran sudo, if
+// it was run through sudo.
+func auditUser() string {
+	name := ""
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != name {
+		return sudoUser + " (as " + name + ")"
+	}
+
+	return name
+}
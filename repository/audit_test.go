@@ -0,0 +1,81 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := repository.WithOperation(context.Background(), "backup")
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	old := b.Full("tank/data", 48*time.Hour)
+	store, err := b.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// A store that was never loaded or saved has nothing to compare with.
+	entries, err := repository.LoadAudit(ctx, s, &repository.AuditFilter{})
+	if err != nil {
+		t.Fatalf("load audit: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries for a new store, got %v", entries)
+	}
+
+	created := b.Full("tank/data", time.Hour)
+	b.Trash(old, 0)
+	store.ManagedDatasets = []string{"tank/data", "tank/other"}
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	if err := repository.AppendAudit(ctx, s, repository.AuditEntry{Action: repository.AuditExpiryRun, Dataset: "tank/data"}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	entries, err = repository.LoadAudit(ctx, s, &repository.AuditFilter{})
+	if err != nil {
+		t.Fatalf("load audit: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %+v", entries)
+	}
+
+	deleted, added, datasets, expiry := entries[0], entries[1], entries[2], entries[3]
+	if deleted.Action != repository.AuditBackupDeleted || *deleted.Backup != old.ID || deleted.Details != "moved to the trash" {
+		t.Errorf("expected the old backup to be trashed, got %+v", deleted)
+	}
+	if added.Action != repository.AuditBackupCreated || *added.Backup != created.ID || added.Type != repository.BackupTypeFull {
+		t.Errorf("expected the new backup to be created, got %+v", added)
+	}
+	if datasets.Action != repository.AuditDatasetsChanged || datasets.Details != "+tank/other" {
+		t.Errorf("expected tank/other to be added, got %+v", datasets)
+	}
+	if expiry.Action != repository.AuditExpiryRun || expiry.Operation != "backup" || expiry.Host == "" || expiry.Time.IsZero() {
+		t.Errorf("expected the expiry run with its operation, host and time, got %+v", expiry)
+	}
+
+	// Saving again without changes records nothing.
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	filtered, err := repository.LoadAudit(ctx, s, &repository.AuditFilter{
+		Actions: []repository.AuditAction{repository.AuditBackupCreated, repository.AuditBackupDeleted},
+		Backup:  &created.ID,
+	})
+	if err != nil {
+		t.Fatalf("load audit: %v", err)
+	}
+	if len(filtered) != 1 || *filtered[0].Backup != created.ID {
+		t.Fatalf("expected only the created backup, got %+v", filtered)
+	}
+}
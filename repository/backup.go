@@ -1,12 +1,11 @@
 package repository
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log/slog"
-	"maps"
+	"sort"
 	"time"
 
 	"github.com/gargakshit/zfsbackrest/config"
@@ -22,8 +21,6 @@ const (
 	BackupTypeIncr BackupType = "incr"
 )
 
-type Backups map[ulid.ULID]*Backup
-
 type Backup struct {
 	ID        ulid.ULID  `json:"id"`
 	Type      BackupType `json:"type"`
@@ -31,6 +28,69 @@ type Backup struct {
 	DependsOn *ulid.ULID `json:"depends_on"`
 	Dataset   string     `json:"dataset"`
 	Size      int64      `json:"size"`
+	Checksum  string     `json:"checksum,omitempty"` // hex SHA-256 of the zfs send stream, before encryption
+	GUID      string     `json:"guid,omitempty"`     // ZFS GUID of the sent snapshot, kept by zfs recv
+	Tier      Tier       `json:"tier,omitempty"`
+	// Recipient is the age recipient the snapshot and manifest are encrypted
+	// to. It is empty for backups taken before it was recorded.
+	Recipient string `json:"recipient,omitempty"`
+	// RecoveryRecipient is the recovery recipient the snapshot and manifest
+	// are also encrypted to, if the repository had one.
+	RecoveryRecipient string `json:"recovery_recipient,omitempty"`
+	// FormatVersion, Encryption and Compression are the format the snapshot
+	// was written in. See format.go.
+	FormatVersion int    `json:"format_version,omitempty"`
+	Encryption    string `json:"encryption,omitempty"`
+	Compression   string `json:"compression,omitempty"`
+	// Route is the name of the route whose storage the snapshot lives in,
+	// or empty if it lives in the repository's. Routed backups aren't
+	// tiered.
+	Route string `json:"route,omitempty"`
+	// ObjectChecksum is the hex SHA-256 of the snapshot object as it is
+	// stored, after encryption, and ObjectSize its size. They are recorded
+	// during the upload, and empty for backups taken before they were.
+	ObjectChecksum string `json:"object_checksum,omitempty"`
+	ObjectSize     int64  `json:"object_size,omitempty"`
+	// VerifiedAt is when the snapshot was last read back and matched its
+	// checksum.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// Damage is set when a verification found the snapshot damaged.
+	Damage *Damage `json:"damage,omitempty"`
+	// Space is the space usage of the dataset when it was backed up, if it
+	// was recorded.
+	Space *Space `json:"space,omitempty"`
+	// Intermediates are the backups of the dataset taken between the parent
+	// and this one, whose snapshots the stream carries as well, if it was
+	// sent with `zfs send -I`. They don't depend on this backup.
+	Intermediates []ulid.ULID `json:"intermediates,omitempty"`
+	// Send is how the snapshot was sent, if it was recorded. See send.go.
+	Send *SendStream `json:"send,omitempty"`
+	// Origin is the machine the backup was taken on, if it was recorded.
+	Origin *Origin `json:"origin,omitempty"`
+	// LockedUntil is when the Object Lock retention of the snapshot ends, if
+	// it was uploaded with one. It can't be deleted before then.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// Replicas is the status of the backup's upload to each replica, by
+	// replica name. Replicas missing from it haven't been uploaded to.
+	Replicas map[string]*Replication `json:"replicas,omitempty"`
+	// Tags are the key=value labels the backup was taken with.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Note is a free-form note on the backup, to identify it later. It can
+	// be edited after the backup is taken.
+	Note string `json:"note,omitempty"`
+	// Imported is set on backups imported from a snapshot zfsbackrest didn't
+	// take. Their local snapshot isn't named after the backup, and isn't
+	// zfsbackrest's to hold or destroy.
+	Imported *Import `json:"imported,omitempty"`
+}
+
+// Import is the snapshot a backup was imported from.
+type Import struct {
+	// Snapshot is the name of the snapshot after the @, and From the one the
+	// stream is incremental from, if any.
+	Snapshot   string    `json:"snapshot"`
+	From       string    `json:"from,omitempty"`
+	ImportedAt time.Time `json:"imported_at"`
 }
 
 // Error variables for backup validation
@@ -44,21 +104,105 @@ var (
 	ErrUnknownBackupType       = errors.New("unknown backup type")
 	ErrBackupIDMismatch        = errors.New("backup ID mismatch")
 	ErrParentBackupNotFound    = errors.New("parent backup not found")
+	ErrBackupNotFound          = errors.New("backup not found")
+	ErrNullBackup              = errors.New("backup is null")
+	ErrZeroBackupID            = errors.New("backup ID is zero")
+	ErrBackupNoCreationTime    = errors.New("backup has no creation time")
+	ErrNegativeBackupSize      = errors.New("backup size is negative")
+	ErrIntermediatesNoParent   = errors.New("backup carries intermediate snapshots, but does not depend on a parent backup")
+	ErrFullBackupFromGUID      = errors.New("full backup stream is incremental from a snapshot")
+	ErrBackupDependsOnItself   = errors.New("backup depends on itself")
+	ErrParentBackupDataset     = errors.New("backup depends on a parent backup of another dataset")
+	ErrBackupChainCycle        = errors.New("backup chain depends on itself")
 )
 
+// validateFields checks the fields of a single backup stored under id,
+// without looking at its parents.
+func (b *Backup) validateFields(id ulid.ULID) error {
+	if b == nil {
+		return ErrNullBackup
+	}
+
+	if id == (ulid.ULID{}) || b.ID == (ulid.ULID{}) {
+		return ErrZeroBackupID
+	}
+
+	if b.ID != id {
+		return ErrBackupIDMismatch
+	}
+
+	if b.CreatedAt.IsZero() {
+		return ErrBackupNoCreationTime
+	}
+
+	if b.Size < 0 {
+		return ErrNegativeBackupSize
+	}
+
+	if b.DependsOn != nil && *b.DependsOn == (ulid.ULID{}) {
+		return ErrZeroBackupID
+	}
+
+	if b.DependsOn != nil && *b.DependsOn == b.ID {
+		return ErrBackupDependsOnItself
+	}
+
+	if len(b.Intermediates) > 0 && b.DependsOn == nil {
+		return ErrIntermediatesNoParent
+	}
+
+	if b.DependsOn == nil && b.Send != nil && b.Send.FromGUID != "" {
+		return ErrFullBackupFromGUID
+	}
+
+	for key := range b.Tags {
+		if err := validateTagKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Validate validates the backup identified by id and its parent chain.
 func (bs Backups) Validate(id ulid.ULID) error {
 	slog.Debug("Validating backup", "backup", id)
 
-	b, ok := bs[id]
+	if err := bs.checkChainCycle(id); err != nil {
+		slog.Error("Backup validation failed", "backup", id, "error", err.Error())
+		return err
+	}
+
+	return bs.validate(id)
+}
+
+// checkChainCycle follows the parents of the backup identified by id, and
+// fails if the chain comes back to a backup it went through. A backup
+// depending on itself is left to validateFields.
+func (bs Backups) checkChainCycle(id ulid.ULID) error {
+	visited := map[ulid.ULID]bool{}
+	for b, ok := bs.Get(id); ok && b != nil && b.DependsOn != nil && *b.DependsOn != b.ID; b, ok = bs.Get(*b.DependsOn) {
+		visited[b.ID] = true
+		if visited[*b.DependsOn] {
+			return ErrBackupChainCycle
+		}
+	}
+
+	return nil
+}
+
+// validate validates the backup identified by id and its parent chain, once
+// the chain is known not to have a cycle.
+func (bs Backups) validate(id ulid.ULID) error {
+	b, ok := bs.Get(id)
 	if !ok {
 		slog.Error("Backup validation failed", "backup", id, "error", ErrParentBackupNotFound.Error())
 		return ErrParentBackupNotFound
 	}
 
-	if !bytes.Equal(b.ID[:], id[:]) {
-		slog.Error("Backup validation failed", "backup", id, "error", ErrBackupIDMismatch.Error())
-		return ErrBackupIDMismatch
+	if err := b.validateFields(id); err != nil {
+		slog.Error("Backup validation failed", "backup", id, "error", err.Error())
+		return err
 	}
 
 	if b.CreatedAt.After(time.Now()) {
@@ -81,7 +225,7 @@ func (bs Backups) Validate(id ulid.ULID) error {
 		}
 
 		parentID := *b.DependsOn
-		parentBackup, ok := bs[parentID]
+		parentBackup, ok := bs.Get(parentID)
 		if !ok {
 			slog.Error("Backup validation failed", "backup", b.ID, "error", ErrParentBackupNotFound.Error())
 			return ErrParentBackupNotFound
@@ -92,7 +236,12 @@ func (bs Backups) Validate(id ulid.ULID) error {
 			return ErrDiffBackupParentNotFull
 		}
 
-		return bs.Validate(parentID)
+		if parentBackup.Dataset != b.Dataset {
+			slog.Error("Backup validation failed", "backup", b.ID, "dataset", b.Dataset, "parent_dataset", parentBackup.Dataset, "error", ErrParentBackupDataset.Error())
+			return ErrParentBackupDataset
+		}
+
+		return bs.validate(parentID)
 
 	case BackupTypeIncr:
 		if b.DependsOn == nil {
@@ -101,7 +250,7 @@ func (bs Backups) Validate(id ulid.ULID) error {
 		}
 
 		parentID := *b.DependsOn
-		parentBackup, ok := bs[parentID]
+		parentBackup, ok := bs.Get(parentID)
 		if !ok {
 			slog.Error("Backup validation failed", "backup", b.ID, "error", ErrParentBackupNotFound.Error())
 			return ErrParentBackupNotFound
@@ -112,7 +261,12 @@ func (bs Backups) Validate(id ulid.ULID) error {
 			return ErrIncrBackupParentNotDiff
 		}
 
-		return bs.Validate(parentID)
+		if parentBackup.Dataset != b.Dataset {
+			slog.Error("Backup validation failed", "backup", b.ID, "dataset", b.Dataset, "parent_dataset", parentBackup.Dataset, "error", ErrParentBackupDataset.Error())
+			return ErrParentBackupDataset
+		}
+
+		return bs.validate(parentID)
 
 	default:
 		slog.Error("Backup validation failed", "backup", b.ID, "error", ErrUnknownBackupType.Error())
@@ -129,7 +283,7 @@ func (bs Backups) Expired(id ulid.ULID, expiry *config.Expiry) (bool, error) {
 		return false, err
 	}
 
-	b := bs[id]
+	b := bs.Find(id)
 	switch b.Type {
 	case BackupTypeFull:
 		return b.CreatedAt.Before(time.Now().Add(-expiry.Full)), nil
@@ -155,19 +309,44 @@ func (bs Backups) Expired(id ulid.ULID, expiry *config.Expiry) (bool, error) {
 	}
 }
 
+// ExpiredBackupsForDataset returns the expired backups of dataset, by the
+// GFS policy if it is enabled, and by their age otherwise. Backups kept by
+// tags never expire, and neither does the last chain of the dataset if
+// expiry.KeepLastChain is set.
 func (bs Backups) ExpiredBackupsForDataset(dataset string, expiry *config.Expiry) (Backups, error) {
 	slog.Debug("Getting expired backups for dataset", "dataset", dataset)
 
-	expired := make(Backups)
-	for _, b := range bs {
-		if b.Dataset == dataset {
-			didExpire, err := bs.Expired(b.ID, expiry)
-			if err != nil {
-				return nil, err
-			}
+	keep, err := KeepTags(expiry)
+	if err != nil {
+		return Backups{}, err
+	}
+
+	var expired Backups
+	if expiry.GFS.Enabled() {
+		expired, err = bs.expiredByGFS(dataset, &expiry.GFS, keep)
+		if err != nil {
+			return Backups{}, err
+		}
+	} else {
+		expired, err = bs.expiredByAge(dataset, expiry, keep)
+		if err != nil {
+			return Backups{}, err
+		}
+	}
+
+	if expiry.KeepLastChain {
+		lastChain, err := bs.LastChain(dataset)
+		if err != nil {
+			return Backups{}, err
+		}
 
-			if didExpire {
-				expired[b.ID] = b
+		for _, b := range lastChain {
+			if _, ok := expired.Get(b.ID); ok {
+				slog.Warn("Expired backup is kept, as it is in the last chain of the dataset. Take a new full backup to let it expire.",
+					"dataset", dataset,
+					"backup", b.ID,
+				)
+				expired.remove(b.ID)
 			}
 		}
 	}
@@ -175,56 +354,92 @@ func (bs Backups) ExpiredBackupsForDataset(dataset string, expiry *config.Expiry
 	return expired, nil
 }
 
+// expiredByAge returns the backups of dataset expired by their age, other
+// than the ones kept by the keep tags.
+func (bs Backups) expiredByAge(dataset string, expiry *config.Expiry, keep []TagSelector) (Backups, error) {
+	expired := NewBackups()
+	for _, b := range bs.byDataset[dataset] {
+		didExpire, err := bs.Expired(b.ID, expiry)
+		if err != nil {
+			return Backups{}, err
+		}
+
+		if didExpire {
+			expired.Add(b)
+		}
+	}
+
+	for id, tag := range bs.KeptByTags(keep) {
+		if _, ok := expired.Get(id); ok {
+			slog.Debug("Expired backup is kept by a tag", "backup", id, "tag", tag)
+			expired.remove(id)
+		}
+	}
+
+	return expired, nil
+}
+
 func (bs Backups) TimeTillExpiry(id ulid.ULID, expiry *config.Expiry) (time.Duration, error) {
 	slog.Debug("Calculating time till expiry", "backup", id)
 
-	if err := bs.Validate(id); err != nil {
+	expiresAt, err := bs.ExpiresAt(id, expiry)
+	if err != nil {
 		return 0, err
 	}
 
+	return time.Until(expiresAt), nil
+}
+
+// ExpiresAt returns when a backup expires by its age: when its own time
+// lapses, or when its parent expires, whichever is first.
+func (bs Backups) ExpiresAt(id ulid.ULID, expiry *config.Expiry) (time.Time, error) {
+	if err := bs.Validate(id); err != nil {
+		return time.Time{}, err
+	}
+
 	// get the backup
-	b := bs[id]
+	b := bs.Find(id)
 
 	switch b.Type {
 	case BackupTypeFull:
-		return time.Until(b.CreatedAt.Add(expiry.Full)), nil
+		return b.CreatedAt.Add(expiry.Full), nil
 
 	case BackupTypeDiff:
-		parentExpiry, err := bs.TimeTillExpiry(*b.DependsOn, expiry)
+		parentExpiry, err := bs.ExpiresAt(*b.DependsOn, expiry)
 		if err != nil {
-			return 0, err
+			return time.Time{}, err
 		}
 
-		myExpiry := time.Until(b.CreatedAt.Add(expiry.Diff))
-		if myExpiry < parentExpiry {
+		myExpiry := b.CreatedAt.Add(expiry.Diff)
+		if myExpiry.Before(parentExpiry) {
 			return myExpiry, nil
 		}
 
 		return parentExpiry, nil
 
 	case BackupTypeIncr:
-		parentExpiry, err := bs.TimeTillExpiry(*b.DependsOn, expiry)
+		parentExpiry, err := bs.ExpiresAt(*b.DependsOn, expiry)
 		if err != nil {
-			return 0, err
+			return time.Time{}, err
 		}
 
-		myExpiry := time.Until(b.CreatedAt.Add(expiry.Incr))
-		if myExpiry < parentExpiry {
+		myExpiry := b.CreatedAt.Add(expiry.Incr)
+		if myExpiry.Before(parentExpiry) {
 			return myExpiry, nil
 		}
 
 		return parentExpiry, nil
 
 	default:
-		return 0, ErrUnknownBackupType
+		return time.Time{}, ErrUnknownBackupType
 	}
 }
 
 // LatestFull returns the latest full backup.
 func (bs Backups) LatestFull(dataset string) *Backup {
 	var backup *Backup
-	for _, b := range bs {
-		if b.Type == BackupTypeFull && b.Dataset == dataset {
+	for _, b := range bs.byDataset[dataset] {
+		if b.Type == BackupTypeFull {
 			if backup == nil || backup.CreatedAt.Before(b.CreatedAt) {
 				backup = b
 			}
@@ -237,8 +452,8 @@ func (bs Backups) LatestFull(dataset string) *Backup {
 // LatestDiff returns the latest diff backup.
 func (bs Backups) LatestDiff(dataset string) *Backup {
 	var backup *Backup
-	for _, b := range bs {
-		if b.Type == BackupTypeDiff && b.Dataset == dataset {
+	for _, b := range bs.byDataset[dataset] {
+		if b.Type == BackupTypeDiff {
 			if backup == nil || backup.CreatedAt.Before(b.CreatedAt) {
 				backup = b
 			}
@@ -251,8 +466,8 @@ func (bs Backups) LatestDiff(dataset string) *Backup {
 // LatestIncr returns the latest incremental backup.
 func (bs Backups) LatestIncr(dataset string) *Backup {
 	var backup *Backup
-	for _, b := range bs {
-		if b.Type == BackupTypeIncr && b.Dataset == dataset {
+	for _, b := range bs.byDataset[dataset] {
+		if b.Type == BackupTypeIncr {
 			if backup == nil || backup.CreatedAt.Before(b.CreatedAt) {
 				backup = b
 			}
@@ -262,6 +477,18 @@ func (bs Backups) LatestIncr(dataset string) *Backup {
 	return backup
 }
 
+// Latest returns the latest backup of a dataset, of any type.
+func (bs Backups) Latest(dataset string) *Backup {
+	var backup *Backup
+	for _, b := range bs.byDataset[dataset] {
+		if backup == nil || backup.CreatedAt.Before(b.CreatedAt) {
+			backup = b
+		}
+	}
+
+	return backup
+}
+
 func (bs Backups) GetParent(dataset string, typ BackupType) (*Backup, error) {
 	switch typ {
 	case BackupTypeFull:
@@ -296,25 +523,24 @@ func (bs Backups) GetChildren(id ulid.ULID) Backups {
 	slog.Debug("Getting children of backup", "backup", id)
 
 	// Check if backup exists in the first place.
-	if _, ok := bs[id]; !ok {
+	b, ok := bs.Get(id)
+	if !ok {
 		slog.Error("Backup not found", "backup", id)
-		return nil
+		return Backups{}
 	}
 
 	// Short circuit for incrementals.
-	if bs[id].Type == BackupTypeIncr {
+	if b.Type == BackupTypeIncr {
 		slog.Debug("Skipping children for incremental backup", "backup", id)
-		return nil
+		return Backups{}
 	}
 
-	children := make(Backups)
-	for _, b := range bs {
-		if b.DependsOn != nil && *b.DependsOn == id {
-			children[b.ID] = b
-		}
+	children := NewBackups()
+	for childID, child := range bs.children[id] {
+		children.index(childID, child)
 	}
 
-	slog.Debug("Found children", "children", len(children))
+	slog.Debug("Found children", "children", children.Len())
 
 	return children
 }
@@ -323,48 +549,75 @@ func (bs Backups) GetAllChildren(id ulid.ULID) Backups {
 	slog.Debug("Getting all children of backup", "backup", id)
 
 	// Check if backup exists in the first place.
-	if _, ok := bs[id]; !ok {
+	b, ok := bs.Get(id)
+	if !ok {
 		slog.Error("Backup not found", "backup", id)
-		return nil
+		return Backups{}
 	}
 
 	// Short circuit for incrementals.
-	if bs[id].Type == BackupTypeIncr {
+	if b.Type == BackupTypeIncr {
 		slog.Debug("Skipping children for incremental backup", "backup", id)
-		return nil
+		return Backups{}
 	}
 
-	children := make(Backups)
-	for _, b := range bs {
-		if b.DependsOn != nil && *b.DependsOn == id {
-			children[b.ID] = b
+	children := NewBackups()
+	bs.collectChildren(id, children)
+
+	slog.Debug("Found children", "children", children.Len())
+
+	return children
+}
+
+// collectChildren adds the children of id, and theirs, to children. Backups
+// collected already aren't gone through again, so a chain with a cycle in a
+// corrupted store doesn't recurse forever.
+func (bs Backups) collectChildren(id ulid.ULID, children Backups) {
+	for childID, child := range bs.children[id] {
+		if _, ok := children.Get(childID); ok {
+			continue
 		}
+
+		children.index(childID, child)
+		bs.collectChildren(childID, children)
 	}
+}
 
-	for _, child := range children {
-		maps.Copy(children, bs.GetAllChildren(child.ID))
+// Between returns the backups of dataset created after the backup after and
+// before the backup before, oldest first.
+func (bs Backups) Between(dataset string, after ulid.ULID, before ulid.ULID) []*Backup {
+	var between []*Backup
+	for _, backup := range bs.byDataset[dataset] {
+		if backup.ID.Compare(after) > 0 && backup.ID.Compare(before) < 0 {
+			between = append(between, backup)
+		}
 	}
 
-	slog.Debug("Found children", "children", len(children))
+	sort.Slice(between, func(i, j int) bool {
+		return between[i].ID.Compare(between[j].ID) < 0
+	})
 
-	return children
+	return between
 }
 
 func (bs Backups) RemoveBackup(id ulid.ULID) error {
 	slog.Debug("Removing backup", "backup", id)
 
-	if _, ok := bs[id]; !ok {
+	if _, ok := bs.Get(id); !ok {
 		slog.Error("Backup not found", "backup", id)
 		return fmt.Errorf("backup not found: %s", id)
 	}
 
-	delete(bs, id)
+	bs.remove(id)
 
 	return nil
 }
 
 func (s *Store) AddBackup(ctx context.Context, backup Backup) error {
-	if existingBackup, ok := s.Backups[backup.ID]; ok {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existingBackup, ok := s.Backups.Get(backup.ID); ok {
 		if cmp.Equal(existingBackup, &backup) {
 			slog.Debug("Backup already exists, skipping addition (idempotency)", "backup", backup.ID)
 			return nil
@@ -373,7 +626,33 @@ func (s *Store) AddBackup(ctx context.Context, backup Backup) error {
 		return fmt.Errorf("backup %s already exists", backup.ID)
 	}
 
-	s.Backups[backup.ID] = &backup
+	s.Backups.Add(&backup)
 
 	return nil
 }
+
+// SetNote sets the note on a backup, or clears it if note is empty. It
+// returns a copy of the backup, to write its manifest with.
+func (s *Store) SetNote(id ulid.ULID, note string) (*Backup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.Backups.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+	}
+
+	slog.Debug("Setting backup note", "backup", id, "note", note)
+	b.Note = note
+
+	copied := *b
+	return &copied, nil
+}
+
+// RemoveBackup removes a backup from the store's backups.
+func (s *Store) RemoveBackup(id ulid.ULID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Backups.RemoveBackup(id)
+}
@@ -26,9 +26,9 @@ func TestBackupValidate(t *testing.T) {
 			name: "full: valid (no parent)",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: nil,
@@ -38,21 +38,32 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeFull, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrFullBackupHasParent,
 		},
+		{
+			name: "full: has intermediates -> ErrIntermediatesNoParent",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: past, Intermediates: []ulid.ULID{newID()}},
+				)
+				return bs, id
+			},
+			wantErr: ErrIntermediatesNoParent,
+		},
 		{
 			name: "full: created in future -> ErrBackupCreatedInFuture",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeFull, CreatedAt: future},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: future},
+				)
 				return bs, id
 			},
 			wantErr: ErrBackupCreatedInFuture,
@@ -61,9 +72,9 @@ func TestBackupValidate(t *testing.T) {
 			name: "diff: no parent -> ErrDiffBackupNoParent",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeDiff, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrDiffBackupNoParent,
@@ -73,9 +84,9 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				missing := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &missing},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &missing},
+				)
 				return bs, id
 			},
 			wantErr: ErrParentBackupNotFound,
@@ -85,10 +96,10 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeDiff, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeDiff, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrDiffBackupParentNotFull,
@@ -98,10 +109,10 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: nil,
@@ -111,10 +122,10 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: future},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: future},
+				)
 				return bs, id
 			},
 			wantErr: ErrBackupCreatedInFuture,
@@ -125,11 +136,11 @@ func TestBackupValidate(t *testing.T) {
 				id := newID()
 				parent := newID()
 				gparent := newID()
-				bs := Backups{
-					id:      {ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
-					parent:  {ID: parent, Type: BackupTypeFull, CreatedAt: past, DependsOn: &gparent},
-					gparent: {ID: gparent, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past, DependsOn: &gparent},
+					&Backup{ID: gparent, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrFullBackupHasParent,
@@ -138,9 +149,9 @@ func TestBackupValidate(t *testing.T) {
 			name: "incr: no parent -> ErrIncrBackupNoParent",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeIncr, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrIncrBackupNoParent,
@@ -150,10 +161,10 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrIncrBackupParentNotDiff,
@@ -163,10 +174,10 @@ func TestBackupValidate(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				parent := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeDiff, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeDiff, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrDiffBackupNoParent,
@@ -177,26 +188,93 @@ func TestBackupValidate(t *testing.T) {
 				id := newID()
 				parent := newID()
 				gparent := newID()
-				bs := Backups{
-					id:      {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
-					parent:  {ID: parent, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &gparent},
-					gparent: {ID: gparent, Type: BackupTypeIncr, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &gparent},
+					&Backup{ID: gparent, Type: BackupTypeIncr, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrDiffBackupParentNotFull,
 		},
+		{
+			name: "diff: depends on itself -> ErrBackupDependsOnItself",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &id},
+				)
+				return bs, id
+			},
+			wantErr: ErrBackupDependsOnItself,
+		},
+		{
+			name: "diff: parent of another dataset -> ErrParentBackupDataset",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				parent := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, Dataset: "tank/a", DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past, Dataset: "tank/b"},
+				)
+				return bs, id
+			},
+			wantErr: ErrParentBackupDataset,
+		},
+		{
+			name: "incr: parent diff of another dataset -> ErrParentBackupDataset",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				diffID := newID()
+				fullID := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, Dataset: "tank/a", DependsOn: &diffID},
+					&Backup{ID: diffID, Type: BackupTypeDiff, CreatedAt: past, Dataset: "tank/b", DependsOn: &fullID},
+					&Backup{ID: fullID, Type: BackupTypeFull, CreatedAt: past, Dataset: "tank/b"},
+				)
+				return bs, id
+			},
+			wantErr: ErrParentBackupDataset,
+		},
+		{
+			name: "diff: parent full depends on it -> ErrBackupChainCycle",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				parent := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: past, DependsOn: &id},
+				)
+				return bs, id
+			},
+			wantErr: ErrBackupChainCycle,
+		},
+		{
+			name: "incr: chain of three back to itself -> ErrBackupChainCycle",
+			setup: func() (Backups, ulid.ULID) {
+				id := newID()
+				diffID := newID()
+				fullID := newID()
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
+					&Backup{ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
+					&Backup{ID: fullID, Type: BackupTypeFull, CreatedAt: past, DependsOn: &id},
+				)
+				return bs, id
+			},
+			wantErr: ErrBackupChainCycle,
+		},
 		{
 			name: "incr: parent diff -> parent full valid -> ok",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
 				diffID := newID()
 				fullID := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
-					diffID: {ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
-					fullID: {ID: fullID, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
+					&Backup{ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
+					&Backup{ID: fullID, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: nil,
@@ -207,11 +285,11 @@ func TestBackupValidate(t *testing.T) {
 				id := newID()
 				diffID := newID()
 				fullID := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
-					diffID: {ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
-					fullID: {ID: fullID, Type: BackupTypeFull, CreatedAt: future},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
+					&Backup{ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
+					&Backup{ID: fullID, Type: BackupTypeFull, CreatedAt: future},
+				)
 				return bs, id
 			},
 			wantErr: ErrBackupCreatedInFuture,
@@ -223,12 +301,12 @@ func TestBackupValidate(t *testing.T) {
 				diffID := newID()
 				fullID := newID()
 				x := newID()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
-					diffID: {ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
-					fullID: {ID: fullID, Type: BackupTypeFull, CreatedAt: past, DependsOn: &x},
-					x:      {ID: x, Type: BackupTypeFull, CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: past, DependsOn: &diffID},
+					&Backup{ID: diffID, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &fullID},
+					&Backup{ID: fullID, Type: BackupTypeFull, CreatedAt: past, DependsOn: &x},
+					&Backup{ID: x, Type: BackupTypeFull, CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrFullBackupHasParent,
@@ -237,9 +315,9 @@ func TestBackupValidate(t *testing.T) {
 			name: "unknown type -> ErrUnknownBackupType",
 			setup: func() (Backups, ulid.ULID) {
 				id := newID()
-				bs := Backups{
-					id: {ID: id, Type: BackupType("unknown"), CreatedAt: past},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupType("unknown"), CreatedAt: past},
+				)
 				return bs, id
 			},
 			wantErr: ErrUnknownBackupType,
@@ -265,6 +343,26 @@ func TestBackupValidate(t *testing.T) {
 	}
 }
 
+func TestBackupChainCycle(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	full, diff := ulid.Make(), ulid.Make()
+	bs := NewBackups(
+		&Backup{ID: full, Type: BackupTypeFull, CreatedAt: past, DependsOn: &diff},
+		&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: past, DependsOn: &full},
+	)
+
+	// Walking the chain either way stops instead of recursing forever.
+	if _, err := bs.Expired(diff, &config.Expiry{Full: time.Hour, Diff: time.Hour}); !errors.Is(err, ErrBackupChainCycle) {
+		t.Errorf("expected ErrBackupChainCycle, got %v", err)
+	}
+	if depth := bs.ChainDepth(diff); depth != 2 {
+		t.Errorf("expected a chain depth of 2, got %d", depth)
+	}
+	if children := bs.GetAllChildren(full); children.Len() != 2 {
+		t.Errorf("expected both backups as children, got %d", children.Len())
+	}
+}
+
 func TestBackupExpired(t *testing.T) {
 	now := time.Now()
 	oneHour := time.Hour
@@ -289,9 +387,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "full: not expired (created 30m ago, expiry 1h)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -302,9 +400,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "full: expired (created 2h ago, expiry 1h)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -315,9 +413,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "full: validate error (future time)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeFull, CreatedAt: now.Add(2 * time.Minute)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeFull, CreatedAt: now.Add(2 * time.Minute)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -330,9 +428,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "diff: validate error (no parent)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -344,10 +442,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -359,10 +457,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -374,10 +472,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-twoHours), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-twoHours), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -389,10 +487,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -404,10 +502,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(2 * time.Minute)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(2 * time.Minute)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -420,9 +518,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "incr: validate error (no parent)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -434,10 +532,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -449,10 +547,10 @@ func TestBackupExpired(t *testing.T) {
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
 				parent := ulid.Make()
-				bs := Backups{
-					id:     {ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
-					parent: {ID: parent, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &parent},
+					&Backup{ID: parent, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -465,11 +563,11 @@ func TestBackupExpired(t *testing.T) {
 				incr := ulid.Make()
 				diff := ulid.Make()
 				full := ulid.Make()
-				bs := Backups{
-					incr: {ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
-					diff: {ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
-					full: {ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
+					&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
+					&Backup{ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, incr
 			},
 			expiry:      expiry,
@@ -482,11 +580,11 @@ func TestBackupExpired(t *testing.T) {
 				incr := ulid.Make()
 				diff := ulid.Make()
 				full := ulid.Make()
-				bs := Backups{
-					incr: {ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-twoHours), DependsOn: &diff},
-					diff: {ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
-					full: {ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-twoHours), DependsOn: &diff},
+					&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
+					&Backup{ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, incr
 			},
 			expiry:      expiry,
@@ -499,11 +597,11 @@ func TestBackupExpired(t *testing.T) {
 				incr := ulid.Make()
 				diff := ulid.Make()
 				full := ulid.Make()
-				bs := Backups{
-					incr: {ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
-					diff: {ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-twoHours), DependsOn: &full},
-					full: {ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
+					&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-twoHours), DependsOn: &full},
+					&Backup{ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, incr
 			},
 			expiry:      expiry,
@@ -516,11 +614,11 @@ func TestBackupExpired(t *testing.T) {
 				incr := ulid.Make()
 				diff := ulid.Make()
 				full := ulid.Make()
-				bs := Backups{
-					incr: {ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
-					diff: {ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
-					full: {ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
-				}
+				bs := NewBackups(
+					&Backup{ID: incr, Type: BackupTypeIncr, CreatedAt: now.Add(-thirtyMin), DependsOn: &diff},
+					&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: now.Add(-thirtyMin), DependsOn: &full},
+					&Backup{ID: full, Type: BackupTypeFull, CreatedAt: now.Add(-twoHours)},
+				)
 				return bs, incr
 			},
 			expiry:      expiry,
@@ -531,9 +629,9 @@ func TestBackupExpired(t *testing.T) {
 			name: "unknown type -> ErrUnknownBackupType (from validate)",
 			setup: func() (Backups, ulid.ULID) {
 				id := ulid.Make()
-				bs := Backups{
-					id: {ID: id, Type: BackupType("unknown"), CreatedAt: now.Add(-thirtyMin)},
-				}
+				bs := NewBackups(
+					&Backup{ID: id, Type: BackupType("unknown"), CreatedAt: now.Add(-thirtyMin)},
+				)
 				return bs, id
 			},
 			expiry:      expiry,
@@ -583,44 +681,44 @@ func TestLatestFull(t *testing.T) {
 	}{
 		{
 			name:   "empty -> nil",
-			build:  func() Backups { return Backups{} },
+			build:  func() Backups { return NewBackups() },
 			wantID: nil,
 		},
 		{
 			name: "only non-full -> nil",
 			build: func() Backups {
-				d1, id1 := mk(BackupTypeDiff, earlier)
-				i1, id2 := mk(BackupTypeIncr, later)
-				return Backups{id1: d1, id2: i1}
+				d1, _ := mk(BackupTypeDiff, earlier)
+				i1, _ := mk(BackupTypeIncr, later)
+				return NewBackups(d1, i1)
 			},
 			wantID: nil,
 		},
 		{
 			name: "single full -> that id",
 			build: func() Backups {
-				f1, id := mk(BackupTypeFull, mid)
-				return Backups{id: f1}
+				f1, _ := mk(BackupTypeFull, mid)
+				return NewBackups(f1)
 			},
 			wantID: func() *ulid.ULID { id := ulid.Make(); return &id }(), // placeholder, replaced below
 		},
 		{
 			name: "multiple full -> latest by CreatedAt",
 			build: func() Backups {
-				fOld, idOld := mk(BackupTypeFull, earlier)
-				fMid, idMid := mk(BackupTypeFull, mid)
-				fNew, idNew := mk(BackupTypeFull, later)
-				x, idx := mk(BackupTypeDiff, now) // ensure mixed types ignored
-				return Backups{idOld: fOld, idMid: fMid, idNew: fNew, idx: x}
+				fOld, _ := mk(BackupTypeFull, earlier)
+				fMid, _ := mk(BackupTypeFull, mid)
+				fNew, _ := mk(BackupTypeFull, later)
+				x, _ := mk(BackupTypeDiff, now) // ensure mixed types ignored
+				return NewBackups(fOld, fMid, fNew, x)
 			},
 			wantID: func() *ulid.ULID { id := ulid.Make(); return &id }(), // placeholder, replaced below
 		},
 		{
 			name: "mixed types with one full -> that full",
 			build: func() Backups {
-				d, idd := mk(BackupTypeDiff, later)
-				i, idi := mk(BackupTypeIncr, later)
-				f, idf := mk(BackupTypeFull, mid)
-				return Backups{idd: d, idi: i, idf: f}
+				d, _ := mk(BackupTypeDiff, later)
+				i, _ := mk(BackupTypeIncr, later)
+				f, _ := mk(BackupTypeFull, mid)
+				return NewBackups(d, i, f)
 			},
 			wantID: func() *ulid.ULID { id := ulid.Make(); return &id }(), // placeholder, replaced below
 		},
@@ -633,7 +731,7 @@ func TestLatestFull(t *testing.T) {
 		var expected *ulid.ULID
 		switch tests[ti].name {
 		case "single full -> that id":
-			for id, b := range bset {
+			for id, b := range bset.All() {
 				if b.Type == BackupTypeFull && b.Dataset == dataset {
 					idCopy := id
 					expected = &idCopy
@@ -642,7 +740,7 @@ func TestLatestFull(t *testing.T) {
 		case "multiple full -> latest by CreatedAt":
 			var want *Backup
 			var wantID ulid.ULID
-			for id, b := range bset {
+			for id, b := range bset.All() {
 				if b.Type != BackupTypeFull || b.Dataset != dataset {
 					continue
 				}
@@ -653,7 +751,7 @@ func TestLatestFull(t *testing.T) {
 			}
 			expected = &wantID
 		case "mixed types with one full -> that full":
-			for id, b := range bset {
+			for id, b := range bset.All() {
 				if b.Type == BackupTypeFull && b.Dataset == dataset {
 					idCopy := id
 					expected = &idCopy
@@ -689,29 +787,29 @@ func TestLatestDiff(t *testing.T) {
 		build  func() Backups
 		wantID *ulid.ULID
 	}{
-		{name: "empty -> nil", build: func() Backups { return Backups{} }},
+		{name: "empty -> nil", build: func() Backups { return NewBackups() }},
 		{
 			name: "only non-diff -> nil",
 			build: func() Backups {
-				f, idf := mk(BackupTypeFull, earlier)
-				i, idi := mk(BackupTypeIncr, later)
-				return Backups{idf: f, idi: i}
+				f, _ := mk(BackupTypeFull, earlier)
+				i, _ := mk(BackupTypeIncr, later)
+				return NewBackups(f, i)
 			},
 		},
 		{
 			name: "single diff -> that id",
 			build: func() Backups {
-				d, id := mk(BackupTypeDiff, earlier)
-				return Backups{id: d}
+				d, _ := mk(BackupTypeDiff, earlier)
+				return NewBackups(d)
 			},
 		},
 		{
 			name: "multiple diff -> latest by CreatedAt",
 			build: func() Backups {
-				d1, id1 := mk(BackupTypeDiff, earlier)
-				d2, id2 := mk(BackupTypeDiff, later)
-				f, idf := mk(BackupTypeFull, now)
-				return Backups{id1: d1, id2: d2, idf: f}
+				d1, _ := mk(BackupTypeDiff, earlier)
+				d2, _ := mk(BackupTypeDiff, later)
+				f, _ := mk(BackupTypeFull, now)
+				return NewBackups(d1, d2, f)
 			},
 		},
 	}
@@ -721,7 +819,7 @@ func TestLatestDiff(t *testing.T) {
 		got := bs.LatestDiff(dataset)
 		// compute expected
 		var want *Backup
-		for _, b := range bs {
+		for _, b := range bs.All() {
 			if b.Type != BackupTypeDiff || b.Dataset != dataset {
 				continue
 			}
@@ -756,29 +854,29 @@ func TestLatestIncr(t *testing.T) {
 		name  string
 		build func() Backups
 	}{
-		{name: "empty -> nil", build: func() Backups { return Backups{} }},
+		{name: "empty -> nil", build: func() Backups { return NewBackups() }},
 		{
 			name: "only non-incr -> nil",
 			build: func() Backups {
-				f, idf := mk(BackupTypeFull, earlier)
-				d, idd := mk(BackupTypeDiff, later)
-				return Backups{idf: f, idd: d}
+				f, _ := mk(BackupTypeFull, earlier)
+				d, _ := mk(BackupTypeDiff, later)
+				return NewBackups(f, d)
 			},
 		},
 		{
 			name: "single incr -> that id",
 			build: func() Backups {
-				i, id := mk(BackupTypeIncr, later)
-				return Backups{id: i}
+				i, _ := mk(BackupTypeIncr, later)
+				return NewBackups(i)
 			},
 		},
 		{
 			name: "multiple incr -> latest by CreatedAt",
 			build: func() Backups {
-				i1, id1 := mk(BackupTypeIncr, earlier)
-				i2, id2 := mk(BackupTypeIncr, later)
-				f, idf := mk(BackupTypeFull, now)
-				return Backups{id1: i1, id2: i2, idf: f}
+				i1, _ := mk(BackupTypeIncr, earlier)
+				i2, _ := mk(BackupTypeIncr, later)
+				f, _ := mk(BackupTypeFull, now)
+				return NewBackups(i1, i2, f)
 			},
 		},
 	}
@@ -788,7 +886,7 @@ func TestLatestIncr(t *testing.T) {
 		got := bs.LatestIncr(dataset)
 		// compute expected
 		var want *Backup
-		for _, b := range bs {
+		for _, b := range bs.All() {
 			if b.Type != BackupTypeIncr || b.Dataset != dataset {
 				continue
 			}
@@ -807,3 +905,31 @@ func TestLatestIncr(t *testing.T) {
 		}
 	}
 }
+
+func TestBetween(t *testing.T) {
+	now := time.Now()
+	mk := func(dataset string, age time.Duration) *Backup {
+		createdAt := now.Add(-age)
+		return &Backup{ID: ulid.MustNew(ulid.Timestamp(createdAt), ulid.DefaultEntropy()), Type: BackupTypeIncr, CreatedAt: createdAt, Dataset: dataset}
+	}
+
+	diff := mk("tank/data", 4*time.Hour)
+	first := mk("tank/data", 3*time.Hour)
+	second := mk("tank/data", 2*time.Hour)
+	other := mk("tank/other", 2*time.Hour)
+	latest := mk("tank/data", time.Hour)
+
+	bs := NewBackups()
+	for _, b := range []*Backup{diff, first, second, other, latest} {
+		bs.Add(b)
+	}
+
+	between := bs.Between("tank/data", diff.ID, latest.ID)
+	if len(between) != 2 || between[0] != first || between[1] != second {
+		t.Fatalf("expected the two backups in between, oldest first, got %v", between)
+	}
+
+	if between := bs.Between("tank/data", second.ID, latest.ID); len(between) != 0 {
+		t.Fatalf("expected no backups in between, got %v", between)
+	}
+}
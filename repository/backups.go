@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"iter"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Backups are backups by ID. They are indexed by dataset and by parent, so
+// the backups of a dataset, and the children of a backup, are found without
+// scanning every backup. Add and RemoveBackup keep the indexes up to date, so
+// the dataset and parent of a backup mustn't be changed in place.
+//
+// Copies share their backups. The zero value is empty, and Add makes it
+// ready to use; NewBackups makes ones that can be copied before.
+type Backups struct {
+	byID      map[ulid.ULID]*Backup
+	byDataset map[string]map[ulid.ULID]*Backup
+	children  map[ulid.ULID]map[ulid.ULID]*Backup
+}
+
+// NewBackups returns backups holding backups.
+func NewBackups(backups ...*Backup) Backups {
+	bs := Backups{
+		byID:      make(map[ulid.ULID]*Backup, len(backups)),
+		byDataset: make(map[string]map[ulid.ULID]*Backup),
+		children:  make(map[ulid.ULID]map[ulid.ULID]*Backup),
+	}
+	for _, b := range backups {
+		bs.Add(b)
+	}
+
+	return bs
+}
+
+// Get returns the backup with id, and whether there is one.
+func (bs Backups) Get(id ulid.ULID) (*Backup, bool) {
+	b, ok := bs.byID[id]
+	return b, ok
+}
+
+// Find returns the backup with id, or nil if there is none.
+func (bs Backups) Find(id ulid.ULID) *Backup {
+	return bs.byID[id]
+}
+
+// Len returns the number of backups.
+func (bs Backups) Len() int {
+	return len(bs.byID)
+}
+
+// All iterates over the backups by ID, in no particular order. Backups can
+// be removed while iterating.
+func (bs Backups) All() iter.Seq2[ulid.ULID, *Backup] {
+	return func(yield func(ulid.ULID, *Backup) bool) {
+		for id, b := range bs.byID {
+			if !yield(id, b) {
+				return
+			}
+		}
+	}
+}
+
+// Add adds b, replacing the backup with the same ID, if any.
+func (bs *Backups) Add(b *Backup) {
+	if bs.byID == nil {
+		*bs = NewBackups()
+	}
+
+	bs.remove(b.ID)
+	bs.index(b.ID, b)
+}
+
+// index adds b under id. The caller removed the backup under id, if any.
+func (bs Backups) index(id ulid.ULID, b *Backup) {
+	bs.byID[id] = b
+	if b == nil {
+		// Kept, so validation reports it.
+		return
+	}
+
+	addToIndex(bs.byDataset, b.Dataset, id, b)
+	if b.DependsOn != nil {
+		addToIndex(bs.children, *b.DependsOn, id, b)
+	}
+}
+
+// remove removes the backup with id, if there is one.
+func (bs Backups) remove(id ulid.ULID) {
+	b, ok := bs.byID[id]
+	if !ok {
+		return
+	}
+
+	delete(bs.byID, id)
+	if b == nil {
+		return
+	}
+
+	removeFromIndex(bs.byDataset, b.Dataset, id)
+	if b.DependsOn != nil {
+		removeFromIndex(bs.children, *b.DependsOn, id)
+	}
+}
+
+// Clone returns a copy of bs, sharing the backups themselves.
+func (bs Backups) Clone() Backups {
+	clone := NewBackups()
+	for id, b := range bs.byID {
+		clone.index(id, b)
+	}
+
+	return clone
+}
+
+// OfDataset returns the backups of dataset.
+func (bs Backups) OfDataset(dataset string) Backups {
+	backups := NewBackups()
+	for id, b := range bs.byDataset[dataset] {
+		backups.index(id, b)
+	}
+
+	return backups
+}
+
+func addToIndex[K comparable](index map[K]map[ulid.ULID]*Backup, key K, id ulid.ULID, b *Backup) {
+	if index[key] == nil {
+		index[key] = make(map[ulid.ULID]*Backup)
+	}
+	index[key][id] = b
+}
+
+func removeFromIndex[K comparable](index map[K]map[ulid.ULID]*Backup, key K, id ulid.ULID) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// MarshalJSON encodes the backups as an object by ID, like a map.
+func (bs Backups) MarshalJSON() ([]byte, error) {
+	if bs.byID == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(bs.byID)
+}
+
+// UnmarshalJSON decodes an object of backups by ID. Unknown fields are
+// errors, as they are for the rest of the store.
+func (bs *Backups) UnmarshalJSON(content []byte) error {
+	var byID map[ulid.ULID]*Backup
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&byID); err != nil {
+		return err
+	}
+
+	*bs = NewBackups()
+	for id, b := range byID {
+		bs.index(id, b)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestBackupsIndex(t *testing.T) {
+	now := time.Now()
+	full := &Backup{ID: ulid.Make(), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now.Add(-3 * time.Hour)}
+	diff := &Backup{ID: ulid.Make(), Type: BackupTypeDiff, Dataset: "tank/data", CreatedAt: now.Add(-2 * time.Hour), DependsOn: &full.ID}
+	incr := &Backup{ID: ulid.Make(), Type: BackupTypeIncr, Dataset: "tank/data", CreatedAt: now.Add(-time.Hour), DependsOn: &diff.ID}
+	other := &Backup{ID: ulid.Make(), Type: BackupTypeFull, Dataset: "tank/other", CreatedAt: now}
+
+	bs := NewBackups(full, diff, incr, other)
+	if got := bs.OfDataset("tank/data").Len(); got != 3 {
+		t.Fatalf("expected 3 backups of tank/data, got %d", got)
+	}
+	if got := bs.LatestFull("tank/data"); got != full {
+		t.Fatalf("expected the full backup of tank/data, got %v", got)
+	}
+	if got := bs.GetAllChildren(full.ID); got.Len() != 2 || got.Find(incr.ID) == nil {
+		t.Fatalf("expected the diff and the incremental as children, got %d", got.Len())
+	}
+
+	if err := bs.RemoveBackup(incr.ID); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if got := bs.GetChildren(diff.ID); got.Len() != 0 {
+		t.Fatalf("expected the removed incremental to leave the children index, got %d", got.Len())
+	}
+	if got := bs.LatestIncr("tank/data"); got != nil {
+		t.Fatalf("expected the removed incremental to leave the dataset index, got %v", got)
+	}
+
+	// Replacing a backup moves it to its new dataset.
+	moved := *other
+	moved.Dataset = "tank/data"
+	bs.Add(&moved)
+	if bs.OfDataset("tank/other").Len() != 0 || bs.Latest("tank/data") != &moved {
+		t.Fatal("expected the replaced backup to move to tank/data")
+	}
+}
+
+func TestBackupsJSON(t *testing.T) {
+	full := &Backup{ID: ulid.Make(), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: time.Now().UTC()}
+	diff := &Backup{ID: ulid.Make(), Type: BackupTypeDiff, Dataset: "tank/data", CreatedAt: time.Now().UTC(), DependsOn: &full.ID}
+
+	// Backups are encoded as they were when they were a map.
+	want, err := json.Marshal(map[ulid.ULID]*Backup{full.ID: full, diff.ID: diff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(NewBackups(full, diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	var decoded Backups
+	if err := json.Unmarshal(got, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if decoded.Len() != 2 || decoded.GetChildren(full.ID).Find(diff.ID) == nil {
+		t.Fatal("expected the decoded backups to be indexed")
+	}
+
+	if empty, _ := json.Marshal(Backups{}); string(empty) != "{}" {
+		t.Fatalf("expected empty backups to encode as {}, got %s", empty)
+	}
+
+	unknown := []byte(`{"` + full.ID.String() + `":{"id":"` + full.ID.String() + `","bogus":1}}`)
+	if err := json.Unmarshal(unknown, &decoded); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	ErrBackupOrphaned        = errors.New("backup is an orphan")
+	ErrSnapshotObjectMissing = errors.New("snapshot object of the backup is missing")
+)
+
+// Chain returns the backups restoring the backup with id receives, in the
+// order they are received: its full backup, then its diff and incremental
+// backups, and the backup itself last.
+func (bs Backups) Chain(id ulid.ULID) ([]*Backup, error) {
+	var chain []*Backup
+	visited := make(map[ulid.ULID]bool)
+	for next := &id; next != nil; {
+		if visited[*next] {
+			return nil, fmt.Errorf("%w: %s", ErrBackupChainCycle, *next)
+		}
+		visited[*next] = true
+
+		b, ok := bs.Get(*next)
+		if !ok {
+			if *next == id {
+				return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, id)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrParentBackupNotFound, *next)
+		}
+
+		chain = append(chain, b)
+		next = b.DependsOn
+	}
+
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// Restorable checks the backup with id can be restored, and returns its
+// chain. Every backup of the chain has to be in the store, rather than
+// orphaned or in the trash, and its snapshot object has to exist, as
+// hasObject reports. The objects aren't checked if hasObject is nil.
+func (s *Store) Restorable(id ulid.ULID, hasObject func(*Backup) (bool, error)) ([]*Backup, error) {
+	chain, err := s.restorableChain(id)
+	if err != nil {
+		slog.Error("Backup is not restorable", "backup", id, "error", err)
+		return nil, err
+	}
+
+	if hasObject == nil {
+		return chain, nil
+	}
+
+	// The objects are checked without the store locked, as it takes a request
+	// to the storage per backup.
+	for _, b := range chain {
+		ok, err := hasObject(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the snapshot object of backup %s: %w", b.ID, err)
+		}
+		if !ok {
+			slog.Error("Backup is not restorable", "backup", id, "error", ErrSnapshotObjectMissing, "missing", b.ID)
+			return nil, fmt.Errorf("%w: %s", ErrSnapshotObjectMissing, b.ID)
+		}
+	}
+
+	return chain, nil
+}
+
+// restorableChain returns the chain of the backup with id, or why a link of
+// it isn't in the store.
+func (s *Store) restorableChain(id ulid.ULID) ([]*Backup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chain, err := s.Backups.Chain(id)
+	if err != nil && !errors.Is(err, ErrBackupNotFound) && !errors.Is(err, ErrParentBackupNotFound) {
+		return nil, err
+	}
+
+	// Find the missing link, and tell whether it was orphaned or deleted.
+	// Links left in the orphans, e.g. by a crash, are orphans too.
+	for next := &id; next != nil; {
+		b, ok := s.Backups.Get(*next)
+		_, orphaned := s.Orphans[*next]
+		switch {
+		case orphaned:
+			return nil, fmt.Errorf("%w: %s", ErrBackupOrphaned, *next)
+		case ok:
+			next = b.DependsOn
+			continue
+		}
+
+		if _, trashed := s.Trash[*next]; trashed {
+			return nil, fmt.Errorf("%w: %s", ErrBackupInTrash, *next)
+		}
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// LastChain returns the chain of the latest restore point of dataset built on
+// its newest full backup: that backup, and its newest diff and incremental
+// backups, parents first. It is empty if the dataset has no full backup.
+func (bs Backups) LastChain(dataset string) ([]*Backup, error) {
+	var full *Backup
+	for _, b := range bs.byDataset[dataset] {
+		if b.Type == BackupTypeFull && (full == nil || b.ID.Compare(full.ID) > 0) {
+			full = b
+		}
+	}
+	if full == nil {
+		return nil, nil
+	}
+
+	latest := full
+	for id, b := range bs.GetAllChildren(full.ID).All() {
+		if id.Compare(latest.ID) > 0 {
+			latest = b
+		}
+	}
+
+	return bs.Chain(latest.ID)
+}
+
+// KeptByLastChains returns the backups of the last chain of each of datasets,
+// which expiry.KeepLastChain keeps from expiring.
+func (bs Backups) KeptByLastChains(datasets []string) (map[ulid.ULID]bool, error) {
+	kept := make(map[ulid.ULID]bool)
+	for _, dataset := range datasets {
+		chain, err := bs.LastChain(dataset)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %s: %w", dataset, err)
+		}
+		for _, b := range chain {
+			kept[b.ID] = true
+		}
+	}
+
+	return kept, nil
+}
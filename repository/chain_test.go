@@ -0,0 +1,144 @@
+package repository_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestBackupsChain(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	store := b.Build()
+
+	chain, err := store.Backups.Chain(incr.ID)
+	if err != nil {
+		t.Fatalf("chain: %v", err)
+	}
+	if len(chain) != 3 || chain[0] != full || chain[1] != diff || chain[2] != incr {
+		t.Fatalf("expected full, diff and incr, got %v", chain)
+	}
+
+	if _, err := store.Backups.Chain(ulid.Make()); !errors.Is(err, repository.ErrBackupNotFound) {
+		t.Errorf("expected ErrBackupNotFound, got %v", err)
+	}
+
+	if err := store.Backups.RemoveBackup(full.ID); err != nil {
+		t.Fatalf("remove backup: %v", err)
+	}
+	if _, err := store.Backups.Chain(incr.ID); !errors.Is(err, repository.ErrParentBackupNotFound) {
+		t.Errorf("expected ErrParentBackupNotFound, got %v", err)
+	}
+
+	diff.DependsOn = &incr.ID
+	if _, err := store.Backups.Chain(incr.ID); !errors.Is(err, repository.ErrBackupChainCycle) {
+		t.Errorf("expected ErrBackupChainCycle, got %v", err)
+	}
+}
+
+func TestStoreRestorable(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	other := b.Full("tank/data", 96*time.Hour)
+	otherDiff := b.Diff(other, 90*time.Hour)
+	store := b.Build()
+
+	hasObject := func(missing ...ulid.ULID) func(*repository.Backup) (bool, error) {
+		return func(b *repository.Backup) (bool, error) {
+			for _, id := range missing {
+				if b.ID == id {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+	}
+
+	chain, err := store.Restorable(incr.ID, hasObject())
+	if err != nil || len(chain) != 3 {
+		t.Fatalf("expected the chain of 3 backups to be restorable, got %v, %v", chain, err)
+	}
+
+	if _, err := store.Restorable(incr.ID, hasObject(diff.ID)); !errors.Is(err, repository.ErrSnapshotObjectMissing) {
+		t.Errorf("expected ErrSnapshotObjectMissing, got %v", err)
+	}
+
+	storageErr := errors.New("storage unavailable")
+	_, err = store.Restorable(incr.ID, func(*repository.Backup) (bool, error) { return false, storageErr })
+	if !errors.Is(err, storageErr) {
+		t.Errorf("expected the storage error, got %v", err)
+	}
+
+	// Orphan the diff, and trash the other full backup.
+	for _, id := range []ulid.ULID{diff.ID, other.ID} {
+		if err := store.RemoveBackup(id); err != nil {
+			t.Fatalf("remove backup: %v", err)
+		}
+	}
+	store.Orphans[diff.ID] = &repository.Orphan{Backup: *diff, Reason: repository.OrphanReasonUncommitted}
+	store.Trash = repository.Trash{other.ID: {Backup: *other, DeletedAt: time.Now()}}
+
+	if _, err := store.Restorable(incr.ID, nil); !errors.Is(err, repository.ErrBackupOrphaned) {
+		t.Errorf("expected ErrBackupOrphaned, got %v", err)
+	}
+	if _, err := store.Restorable(otherDiff.ID, nil); !errors.Is(err, repository.ErrBackupInTrash) {
+		t.Errorf("expected ErrBackupInTrash, got %v", err)
+	}
+	if _, err := store.Restorable(ulid.Make(), nil); !errors.Is(err, repository.ErrBackupNotFound) {
+		t.Errorf("expected ErrBackupNotFound, got %v", err)
+	}
+}
+
+func TestExpiredKeepsLastChain(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	old := b.Full("tank/data", 60*24*time.Hour)
+	oldDiff := b.Diff(old, 59*24*time.Hour)
+	full := b.Full("tank/data", 40*24*time.Hour)
+	diff := b.Diff(full, 39*24*time.Hour)
+	incr := b.Incr(diff, 38*24*time.Hour)
+	olderDiff := b.Diff(full, 39*24*time.Hour+time.Hour)
+	store := b.Build()
+
+	chain, err := store.Backups.LastChain("tank/data")
+	if err != nil {
+		t.Fatalf("last chain: %v", err)
+	}
+	if len(chain) != 3 || chain[0] != full || chain[1] != diff || chain[2] != incr {
+		t.Fatalf("expected the chain of the latest incr, got %v", chain)
+	}
+
+	// Every backup is past its expiry, as backups stopped being taken.
+	expiry := &config.Expiry{Full: 30 * 24 * time.Hour, Diff: 7 * 24 * time.Hour, Incr: 24 * time.Hour}
+	expired, err := store.Backups.ExpiredBackupsForDataset("tank/data", expiry)
+	if err != nil {
+		t.Fatalf("expired backups: %v", err)
+	}
+	if expired.Len() != 6 {
+		t.Fatalf("expected every backup to expire, got %d", expired.Len())
+	}
+
+	expiry.KeepLastChain = true
+	expired, err = store.Backups.ExpiredBackupsForDataset("tank/data", expiry)
+	if err != nil {
+		t.Fatalf("expired backups: %v", err)
+	}
+	for _, want := range []*repository.Backup{old, oldDiff, olderDiff} {
+		if _, ok := expired.Get(want.ID); !ok {
+			t.Errorf("expected backup %s to expire", want.ID)
+		}
+	}
+	for _, kept := range chain {
+		if _, ok := expired.Get(kept.ID); ok {
+			t.Errorf("expected backup %s of the last chain to be kept", kept.ID)
+		}
+	}
+}
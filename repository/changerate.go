@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Space is the space usage of a dataset when it was backed up.
+type Space struct {
+	// Used is the space used by the dataset, its snapshots and descendants.
+	Used int64 `json:"used"`
+	// Referenced is the data the snapshot of the backup refers to.
+	Referenced int64 `json:"referenced"`
+	// Written is the data written to the dataset since the backup Since, the
+	// one before it, if its snapshot still existed.
+	Written *int64     `json:"written,omitempty"`
+	Since   *ulid.ULID `json:"since,omitempty"`
+}
+
+// ChangeRate is how fast a dataset, and its backups, changed over a window.
+// Rates are per day.
+type ChangeRate struct {
+	Dataset string `json:"dataset"`
+	// Backups is the number of backups in the window.
+	Backups int `json:"backups"`
+	// Span is the time between the first and the last of them.
+	Span time.Duration `json:"span"`
+	// WrittenPerDay is the data written to the dataset.
+	WrittenPerDay int64 `json:"written_per_day"`
+	// UsedPerDay is the growth of the space used by the dataset. It is
+	// negative if the dataset shrank.
+	UsedPerDay int64 `json:"used_per_day"`
+	// StoredPerDay is the growth of the repository, from the sizes of the
+	// backups after the first.
+	StoredPerDay int64 `json:"stored_per_day"`
+	// AverageSize is the average size of the backups of each type.
+	AverageSize map[BackupType]int64 `json:"average_size"`
+}
+
+// ChangeRates returns the change rate of every dataset with backups created
+// in the window before now, ordered by dataset.
+func (bs Backups) ChangeRates(window time.Duration, now time.Time) []*ChangeRate {
+	byDataset := map[string][]*Backup{}
+	for _, b := range bs.All() {
+		if b.CreatedAt.After(now.Add(-window)) && !b.CreatedAt.After(now) {
+			byDataset[b.Dataset] = append(byDataset[b.Dataset], b)
+		}
+	}
+
+	rates := make([]*ChangeRate, 0, len(byDataset))
+	for dataset, backups := range byDataset {
+		sort.Slice(backups, func(i, j int) bool {
+			return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+		})
+		rates = append(rates, bs.changeRate(dataset, backups))
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Dataset < rates[j].Dataset
+	})
+
+	return rates
+}
+
+// changeRate computes the change rate of a dataset from its backups, oldest
+// first.
+func (bs Backups) changeRate(dataset string, backups []*Backup) *ChangeRate {
+	rate := &ChangeRate{
+		Dataset:     dataset,
+		Backups:     len(backups),
+		Span:        backups[len(backups)-1].CreatedAt.Sub(backups[0].CreatedAt),
+		AverageSize: map[BackupType]int64{},
+	}
+
+	sizes := map[BackupType]int64{}
+	counts := map[BackupType]int64{}
+	var stored int64
+	var written int64
+	var writtenOver time.Duration
+	var first, last *Backup
+	for i, b := range backups {
+		sizes[b.Type] += b.Size
+		counts[b.Type]++
+		if i > 0 {
+			stored += b.Size
+		}
+
+		if b.Space == nil {
+			continue
+		}
+
+		if first == nil {
+			first = b
+		}
+		last = b
+
+		// The backup Written was measured since may have expired since.
+		if b.Space.Written == nil || b.Space.Since == nil {
+			continue
+		}
+		since, ok := bs.Get(*b.Space.Since)
+		if !ok || !since.CreatedAt.Before(b.CreatedAt) {
+			continue
+		}
+		written += *b.Space.Written
+		writtenOver += b.CreatedAt.Sub(since.CreatedAt)
+	}
+
+	for typ, size := range sizes {
+		rate.AverageSize[typ] = size / counts[typ]
+	}
+
+	rate.StoredPerDay = perDay(stored, rate.Span)
+	rate.WrittenPerDay = perDay(written, writtenOver)
+	if first != nil && last != first {
+		rate.UsedPerDay = perDay(last.Space.Used-first.Space.Used, last.CreatedAt.Sub(first.CreatedAt))
+	}
+
+	return rate
+}
+
+func perDay(bytes int64, over time.Duration) int64 {
+	if over <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / over.Hours() * 24)
+}
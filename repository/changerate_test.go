@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestChangeRates(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	written := func(n int64) *int64 { return &n }
+
+	full := ulid.Make()
+	diff := ulid.Make()
+	incr := ulid.Make()
+	old := ulid.Make()
+	other := ulid.Make()
+	expired := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: old, Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now.Add(-40 * day), Size: 1 << 40},
+		&Backup{ID: full, Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now.Add(-4 * day), Size: 1000, Space: &Space{Used: 1000}},
+		&Backup{
+			ID: diff, Type: BackupTypeDiff, Dataset: "tank/data", CreatedAt: now.Add(-2 * day), Size: 300,
+			Space: &Space{Used: 1200, Written: written(400), Since: &full},
+		},
+		// Measured since a backup that expired since, so not counted.
+		&Backup{
+			ID: incr, Type: BackupTypeIncr, Dataset: "tank/data", CreatedAt: now, Size: 100,
+			Space: &Space{Used: 1400, Written: written(900), Since: &expired},
+		},
+		&Backup{ID: other, Type: BackupTypeFull, Dataset: "tank/other", CreatedAt: now.Add(-day), Size: 50},
+	)
+
+	rates := bs.ChangeRates(30*day, now)
+	if len(rates) != 2 || rates[0].Dataset != "tank/data" || rates[1].Dataset != "tank/other" {
+		t.Fatalf("unexpected change rates: %+v", rates)
+	}
+
+	rate := rates[0]
+	if rate.Backups != 3 || rate.Span != 4*day {
+		t.Fatalf("backups = %d, span = %s, want 3 and 96h", rate.Backups, rate.Span)
+	}
+	if rate.WrittenPerDay != 200 {
+		t.Fatalf("written per day = %d, want 200", rate.WrittenPerDay)
+	}
+	if rate.UsedPerDay != 100 {
+		t.Fatalf("used per day = %d, want 100", rate.UsedPerDay)
+	}
+	if rate.StoredPerDay != 100 {
+		t.Fatalf("stored per day = %d, want 100", rate.StoredPerDay)
+	}
+	if rate.AverageSize[BackupTypeFull] != 1000 || rate.AverageSize[BackupTypeIncr] != 100 {
+		t.Fatalf("unexpected average sizes: %v", rate.AverageSize)
+	}
+
+	// A single backup has no rates.
+	if rates[1].StoredPerDay != 0 || rates[1].Span != 0 {
+		t.Fatalf("unexpected change rate of a single backup: %+v", rates[1])
+	}
+}
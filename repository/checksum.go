@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// The checksum of a snapshot object, as it is stored, is kept in a small
+// plain-text object next to the backup's manifest, in the format of
+// `sha256sum`. Unlike the manifest, it isn't encrypted, so the repository can
+// be audited for bit rot and truncated uploads without the identity.
+
+const checksumSuffix = ".sha256"
+
+// ChecksumObjectName returns the name of the checksum object of a backup,
+// relative to its dataset.
+func ChecksumObjectName(id ulid.ULID) string {
+	return id.String() + checksumSuffix
+}
+
+// writeChecksum writes the checksum object of a backup, replacing any
+// existing one. Backups without an object checksum have none.
+func writeChecksum(ctx context.Context, s storage.StrongStore, backup *Backup) error {
+	if backup.ObjectChecksum == "" {
+		return nil
+	}
+
+	slog.Debug("Writing backup checksum", "dataset", backup.Dataset, "backup", backup.ID)
+
+	content := []byte(fmt.Sprintf("%s  %s\n", backup.ObjectChecksum, backup.ID))
+
+	metadata := backup.ObjectMetadata(storage.ObjectKindChecksum, encryption.Passthrough{})
+	ctx = storage.WithSnapshotMetadata(ctx, metadata)
+	w, err := s.OpenSnapshotWriteStream(ctx, backup.Dataset, ChecksumObjectName(backup.ID), int64(len(content)), encryption.Passthrough{})
+	if err != nil {
+		return fmt.Errorf("failed to open checksum write stream: %w", err)
+	}
+
+	if _, err := w.Write(content); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write checksum: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close checksum write stream: %w", err)
+	}
+
+	return nil
+}
+
+// deleteChecksum deletes the checksum object of a backup. Deleting a missing
+// checksum is not an error.
+func deleteChecksum(ctx context.Context, s storage.StrongStore, dataset string, id ulid.ULID) error {
+	slog.Debug("Deleting backup checksum", "dataset", dataset, "backup", id)
+	return s.DeleteSnapshot(ctx, dataset, ChecksumObjectName(id))
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Unmanage removes dataset from the managed datasets, and reports whether it
+// was managed. Its backups are left in the store, where they can still be
+// restored, and are deleted by hand.
+func (s *Store) Unmanage(dataset string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.ManagedDatasets, dataset)
+	if i < 0 {
+		return false
+	}
+
+	slog.Debug("Removing managed dataset", "dataset", dataset)
+	s.ManagedDatasets = slices.Delete(s.ManagedDatasets, i, i+1)
+	delete(s.ManagedSince, dataset)
+	return true
+}
+
+// SetManagedDatasets replaces the managed datasets, and records the datasets
+// that weren't managed yet as managed since now.
+func (s *Store) SetManagedDatasets(datasets []string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, dataset := range datasets {
+		if slices.Contains(s.ManagedDatasets, dataset) {
+			continue
+		}
+
+		slog.Debug("Adding managed dataset", "dataset", dataset, "since", now)
+		if s.ManagedSince == nil {
+			s.ManagedSince = make(map[string]time.Time)
+		}
+		s.ManagedSince[dataset] = now
+	}
+
+	for dataset := range s.ManagedSince {
+		if !slices.Contains(datasets, dataset) {
+			delete(s.ManagedSince, dataset)
+		}
+	}
+
+	s.ManagedDatasets = datasets
+}
+
+// managedSince returns when dataset became managed. Datasets managed before
+// that was recorded are managed since the repository was created.
+func (s *Store) managedSince(dataset string) time.Time {
+	if since, ok := s.ManagedSince[dataset]; ok {
+		return since
+	}
+
+	return s.CreatedAt
+}
@@ -0,0 +1,166 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestStoreSaveLoadRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 48*time.Hour)
+	diff := b.Diff(full, 24*time.Hour)
+	incr := b.Incr(diff, time.Hour)
+	b.Orphan(incr, repository.OrphanReasonUncommitted)
+
+	saved, err := b.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, s)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if loaded.Backups.Len() != saved.Backups.Len() || len(loaded.Orphans) != 1 {
+		t.Fatalf("expected %d backups and 1 orphan, got %d and %d", saved.Backups.Len(), loaded.Backups.Len(), len(loaded.Orphans))
+	}
+	if loaded.Backups.Find(diff.ID).DependsOn == nil || *loaded.Backups.Find(diff.ID).DependsOn != full.ID {
+		t.Fatal("diff backup lost its parent")
+	}
+}
+
+func TestStoreExists(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	exists, err := repository.StoreExists(ctx, s)
+	if err != nil || exists {
+		t.Fatalf("expected no store, got %v, %v", exists, err)
+	}
+
+	if _, err := repositorytest.NewStore("tank/data").Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	exists, err = repository.StoreExists(ctx, s)
+	if err != nil || !exists {
+		t.Fatalf("expected a store, got %v, %v", exists, err)
+	}
+}
+
+func TestStoreHashCheck(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	b.Full("tank/data", time.Hour)
+	if _, err := b.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s.SetStoreContent(bytes.Replace(s.StoreContent(), []byte("tank/data"), []byte("tank/edit"), 1))
+
+	if _, err := repository.LoadStore(ctx, s); !errors.Is(err, repository.ErrStoreHashMismatch) {
+		t.Fatalf("expected ErrStoreHashMismatch, got %v", err)
+	}
+
+	// Repairing saves the store with its hash corrected.
+	store, err := repository.LoadStore(repository.WithHashRepair(ctx), s)
+	if err != nil {
+		t.Fatalf("load with repair: %v", err)
+	}
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if store.HashMismatch() {
+		t.Fatal("expected the save to correct the hash")
+	}
+	if _, err := repository.LoadStore(ctx, s); err != nil {
+		t.Fatalf("load after repair: %v", err)
+	}
+
+	// A store saved before hashes were recorded has none to check.
+	s.SetStoreContent(repositorytest.NewStore("tank/data").JSON())
+	if _, err := repository.LoadStore(ctx, s); err != nil {
+		t.Fatalf("load without a hash: %v", err)
+	}
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	source := repositorytest.NewStore("tank/data")
+	for i := range 16 {
+		source.Full("tank/data", time.Duration(i+1)*time.Hour)
+	}
+	backups := source.Build().Backups
+
+	store := repositorytest.NewStore("tank/data").Build()
+
+	// Every backup goes through the backup flow in its own goroutine, like
+	// concurrently running backup FSMs sharing a store.
+	var wg sync.WaitGroup
+	errs := make(chan error, backups.Len())
+	for _, backup := range backups.All() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			steps := []func() error{
+				func() error { return store.AddOrphan(ctx, *backup, repository.OrphanReasonUncommitted) },
+				func() error { return store.Save(ctx, s) },
+				func() error { return store.RemoveOrphan(ctx, *backup) },
+				func() error { return store.AddBackup(ctx, *backup) },
+				func() error { return store.Save(ctx, s) },
+			}
+			for _, step := range steps {
+				if err := step(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("concurrent update: %v", err)
+	}
+
+	loaded, err := repository.LoadStore(ctx, s)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.Backups.Len() != backups.Len() || len(loaded.Orphans) != 0 {
+		t.Fatalf("expected %d backups and no orphans, got %d and %d", backups.Len(), loaded.Backups.Len(), len(loaded.Orphans))
+	}
+
+	report, err := repository.VerifyHistory(ctx, s, loaded)
+	if err != nil {
+		t.Fatalf("verify history: %v", err)
+	}
+	if len(report.Entries) != 2*backups.Len() || report.MatchedEntry != len(report.Entries)-1 {
+		t.Fatalf("expected %d history entries ending with the store, got %d matching %d", 2*backups.Len(), len(report.Entries), report.MatchedEntry)
+	}
+}
+
+func TestLoadStoreMissing(t *testing.T) {
+	_, err := repository.LoadStore(context.Background(), storagetest.NewMemoryStore())
+	if !errors.Is(err, errclass.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
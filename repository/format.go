@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// Every backup records the format its snapshot object was written in: the
+// version of the object format, the encryption scheme, and the compression
+// algorithm. Restores decode each backup the way it was written, whatever the
+// repository's settings are now, so backups of different formats coexist in
+// one repository. Backups taken before the format was recorded are version 1,
+// encrypted with age, and not compressed.
+//
+// Version 1 is the zfs send stream, compressed, then encrypted. Version 2
+// frames the compressed stream in authenticated chunks before encrypting it,
+// see package framing.
+
+const (
+	// FormatVersion is the version of the snapshot object format this
+	// version of zfsbackrest writes.
+	FormatVersion = 2
+
+	EncryptionSchemeAge  = "age"
+	EncryptionSchemeNone = config.EncryptionModeNone
+)
+
+var ErrUnsupportedFormat = errors.New("the backup's format is not supported")
+
+// NewFormat sets the format of a new backup of a repository with the
+// encryption config, compressed with compression.
+func (b *Backup) NewFormat(encryptionConfig *config.Encryption, compression string) {
+	b.FormatVersion = FormatVersion
+	b.Encryption = EncryptionSchemeAge
+	if encryptionConfig.Disabled() {
+		b.Encryption = EncryptionSchemeNone
+	}
+	b.Compression = compression
+}
+
+// EncryptionScheme returns the scheme the snapshot is encrypted with.
+func (b *Backup) EncryptionScheme() string {
+	if b.Encryption == "" {
+		return EncryptionSchemeAge
+	}
+	return b.Encryption
+}
+
+// Framed reports whether the snapshot's stream is framed in authenticated
+// chunks.
+func (b *Backup) Framed() bool {
+	return b.FormatVersion >= 2
+}
+
+// CheckFormat checks that the snapshot's format can be read by this version
+// of zfsbackrest. The compression algorithm is checked when the snapshot is
+// decompressed.
+func (b *Backup) CheckFormat() error {
+	if b.FormatVersion > FormatVersion {
+		return &errclass.ValidationError{
+			Subject: "backup " + b.ID.String(),
+			Err:     fmt.Errorf("%w: format version %d is newer than the supported version %d, upgrade zfsbackrest", ErrUnsupportedFormat, b.FormatVersion, FormatVersion),
+		}
+	}
+
+	switch b.EncryptionScheme() {
+	case EncryptionSchemeAge, EncryptionSchemeNone:
+		return nil
+	default:
+		return &errclass.ValidationError{
+			Subject: "backup " + b.ID.String(),
+			Err:     fmt.Errorf("%w: unknown encryption scheme %q", ErrUnsupportedFormat, b.Encryption),
+		}
+	}
+}
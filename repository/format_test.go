@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestBackupFormat(t *testing.T) {
+	legacy := &Backup{ID: ulid.Make()}
+	if legacy.EncryptionScheme() != EncryptionSchemeAge {
+		t.Fatalf("expected backups without a recorded format to be age encrypted, got %q", legacy.EncryptionScheme())
+	}
+	if err := legacy.CheckFormat(); err != nil {
+		t.Fatalf("expected backups without a recorded format to be supported, got %v", err)
+	}
+	if legacy.Framed() {
+		t.Fatal("expected backups without a recorded format not to be framed")
+	}
+
+	b := &Backup{ID: ulid.Make()}
+	b.NewFormat(&config.Encryption{Mode: config.EncryptionModeNone}, "zstd")
+	if b.FormatVersion != FormatVersion || b.Encryption != EncryptionSchemeNone || b.Compression != "zstd" {
+		t.Fatalf("unexpected format %d, %q, %q", b.FormatVersion, b.Encryption, b.Compression)
+	}
+	if !b.Framed() {
+		t.Fatal("expected new backups to be framed")
+	}
+
+	newer := &Backup{ID: ulid.Make(), FormatVersion: FormatVersion + 1}
+	if err := newer.CheckFormat(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected a newer format to be refused, got %v", err)
+	}
+
+	unknown := &Backup{ID: ulid.Make(), FormatVersion: FormatVersion, Encryption: "rot13"}
+	if err := unknown.CheckFormat(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected an unknown encryption scheme to be refused, got %v", err)
+	}
+}
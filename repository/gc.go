@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// UntrackedObject is a snapshot, manifest or checksum object that no backup,
+// orphan or trashed backup of the store refers to, like the leftovers of an
+// interrupted run.
+type UntrackedObject struct {
+	storage.SnapshotObject
+	// CreatedAt is the time of the backup ID the object is named after. It
+	// is zero for objects not named after a backup.
+	CreatedAt time.Time
+}
+
+// UntrackedObjects returns the objects the store doesn't refer to, oldest
+// first. Objects named after a backup created less than minAge before now
+// are skipped, as they may belong to a backup that is being uploaded.
+func (s *Store) UntrackedObjects(objects []storage.SnapshotObject, minAge time.Duration, now time.Time) []UntrackedObject {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var untracked []UntrackedObject
+	for _, object := range objects {
+		name, _ := strings.CutSuffix(object.Snapshot, manifestSuffix)
+		name, _ = strings.CutSuffix(name, checksumSuffix)
+
+		id, err := ulid.ParseStrict(name)
+		if err != nil {
+			slog.Debug("Object is not named after a backup", "dataset", object.Dataset, "object", object.Snapshot)
+			untracked = append(untracked, UntrackedObject{SnapshotObject: object})
+			continue
+		}
+
+		if dataset, ok := s.trackedDataset(id); ok && dataset == object.Dataset {
+			continue
+		}
+
+		createdAt := ulid.Time(id.Time())
+		if now.Sub(createdAt) < minAge {
+			slog.Debug("Untracked object is too recent to collect", "dataset", object.Dataset, "object", object.Snapshot, "created_at", createdAt)
+			continue
+		}
+
+		untracked = append(untracked, UntrackedObject{SnapshotObject: object, CreatedAt: createdAt})
+	}
+
+	sort.Slice(untracked, func(i, j int) bool {
+		if !untracked[i].CreatedAt.Equal(untracked[j].CreatedAt) {
+			return untracked[i].CreatedAt.Before(untracked[j].CreatedAt)
+		}
+		return untracked[i].Snapshot < untracked[j].Snapshot
+	})
+
+	return untracked
+}
+
+// trackedDataset returns the dataset of the backup, orphan or trashed backup
+// with the ID. The caller must hold s.mu.
+func (s *Store) trackedDataset(id ulid.ULID) (string, bool) {
+	if b, ok := s.Backups.Get(id); ok {
+		return b.Dataset, true
+	}
+	if o, ok := s.Orphans[id]; ok {
+		return o.Backup.Dataset, true
+	}
+	if t, ok := s.Trash[id]; ok {
+		return t.Backup.Dataset, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestUntrackedObjects(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	idAt := func(at time.Time) ulid.ULID {
+		return ulid.MustNew(ulid.Timestamp(at), ulid.DefaultEntropy())
+	}
+
+	tracked := Backup{ID: idAt(old), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: old}
+	trashed := Backup{ID: idAt(old), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: old}
+	s := &Store{
+		Version: 1,
+		Backups: NewBackups(&tracked),
+		Orphans: Orphans{},
+		Trash:   Trash{trashed.ID: {Backup: trashed, DeletedAt: now}},
+	}
+
+	leftover := idAt(old.Add(time.Hour))
+	recent := idAt(now.Add(-time.Minute))
+	objects := []storage.SnapshotObject{
+		{Dataset: "tank/data", Snapshot: tracked.ID.String(), Size: 10},
+		{Dataset: "tank/data", Snapshot: tracked.ID.String() + manifestSuffix, Size: 1},
+		{Dataset: "tank/data", Snapshot: tracked.ID.String() + checksumSuffix, Size: 1},
+		{Dataset: "tank/data", Snapshot: trashed.ID.String(), Size: 10},
+		{Dataset: "tank/other", Snapshot: tracked.ID.String(), Size: 10},
+		{Dataset: "tank/data", Snapshot: leftover.String(), Size: 20},
+		{Dataset: "tank/data", Snapshot: recent.String(), Size: 30},
+		{Dataset: "tank/data", Snapshot: "stray", Size: 40},
+	}
+
+	untracked := s.UntrackedObjects(objects, 24*time.Hour, now)
+	if len(untracked) != 3 {
+		t.Fatalf("expected 3 untracked objects, got %+v", untracked)
+	}
+
+	// Objects not named after a backup have no creation time, so they sort
+	// first.
+	if untracked[0].Snapshot != "stray" || !untracked[0].CreatedAt.IsZero() {
+		t.Fatalf("expected the stray object first, got %+v", untracked[0])
+	}
+	if untracked[1].Dataset != "tank/other" || untracked[1].Snapshot != tracked.ID.String() {
+		t.Fatalf("expected the object under the wrong dataset to be untracked, got %+v", untracked[1])
+	}
+	if untracked[2].Snapshot != leftover.String() || untracked[2].CreatedAt.IsZero() {
+		t.Fatalf("expected the old leftover object last, got %+v", untracked[2])
+	}
+}
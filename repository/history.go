@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// Every store save appends an entry to the history log, an append-only log of
+// store hashes. Each entry includes the hash of the entry before it, so
+// entries can't be removed or edited without breaking the chain, and a store
+// that doesn't match the last entry has been rolled back or changed outside
+// zfsbackrest.
+
+// HistoryEntry records a single store save.
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Host      string    `json:"host"`
+	StoreHash string    `json:"store_hash"`
+	// Previous is the hash of the previous entry's line, or empty for the
+	// first entry.
+	Previous string `json:"previous"`
+}
+
+var (
+	ErrHistoryChainBroken  = errors.New("history chain is broken")
+	ErrStoreRolledBack     = errors.New("store was rolled back to an earlier version")
+	ErrStoreNotInHistory   = errors.New("store does not match any history entry")
+	ErrStoreHashMismatch   = errors.New("store content does not match its recorded hash")
+	ErrHistoryEntryInvalid = errors.New("invalid history entry")
+)
+
+type operationKey struct{}
+
+// WithOperation records the operation that store saves in ctx are part of.
+func WithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+func operationFromContext(ctx context.Context) string {
+	if operation, ok := ctx.Value(operationKey{}).(string); ok {
+		return operation
+	}
+
+	return "unknown"
+}
+
+// ComputeHash returns the hex SHA-256 of the store's content, excluding the
+// Hash field itself.
+func (s *Store) ComputeHash() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.computeHash()
+}
+
+// computeHash hashes the store with its Hash cleared. The caller holds s.mu
+// for writing.
+func (s *Store) computeHash() (string, error) {
+	hash := s.Hash
+	s.Hash = nil
+	defer func() { s.Hash = hash }()
+
+	content, err := s.marshal()
+	if err != nil {
+		return "", err
+	}
+
+	return hashHex(content), nil
+}
+
+func hashHex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadHistory loads and parses the history log. A missing log is empty.
+func LoadHistory(ctx context.Context, storage storage.StrongStore) ([]HistoryEntry, error) {
+	entries, _, err := loadHistory(ctx, storage)
+	return entries, err
+}
+
+// loadHistory is like LoadHistory, but also returns the raw line of each
+// entry, which the next entry's Previous hash is computed over.
+func loadHistory(ctx context.Context, storage storage.StrongStore) ([]HistoryEntry, [][]byte, error) {
+	content, err := storage.LoadHistoryContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load history: %w", err)
+	}
+
+	var entries []HistoryEntry
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := bytes.Clone(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry HistoryEntry
+		if err := strictUnmarshal(line, &entry); err != nil {
+			return nil, nil, &errclass.ValidationError{
+				Subject: "history",
+				Err:     fmt.Errorf("%w: line %d: %w", ErrHistoryEntryInvalid, len(entries)+1, err),
+			}
+		}
+
+		entries = append(entries, entry)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, &errclass.ValidationError{Subject: "history", Err: err}
+	}
+
+	return entries, lines, nil
+}
+
+// appendHistory appends an entry for a store with the given hash.
+func appendHistory(ctx context.Context, storage storage.StrongStore, storeHash string) error {
+	content, err := storage.LoadHistoryContent(ctx)
+	if err != nil && !errors.Is(err, errclass.ErrNotFound) {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+
+	previous := ""
+	lines := bytes.Split(bytes.TrimRight(content, "\n"), []byte("\n"))
+	if last := lines[len(lines)-1]; len(last) > 0 {
+		previous = hashHex(last)
+	}
+
+	host, _ := os.Hostname()
+	line, err := json.Marshal(HistoryEntry{
+		Time:      time.Now(),
+		Operation: operationFromContext(ctx),
+		Host:      host,
+		StoreHash: storeHash,
+		Previous:  previous,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal history entry: %w", err)
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(append(content, line...), '\n')
+
+	slog.Debug("Appending store history entry", "store_hash", storeHash, "previous", previous)
+	if err := storage.SaveHistoryContent(ctx, content); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+
+	return nil
+}
+
+// HistoryReport is the result of VerifyHistory.
+type HistoryReport struct {
+	Entries []HistoryEntry `json:"entries"`
+	// StoreHash is the computed hash of the current store.
+	StoreHash string `json:"store_hash"`
+	// MatchedEntry is the index of the last entry matching the current store,
+	// or -1.
+	MatchedEntry int `json:"matched_entry"`
+}
+
+// VerifyHistory checks that the history log is an unbroken chain, and that
+// the store matches its last entry. It returns a report even when
+// verification fails, if the history could be loaded.
+func VerifyHistory(ctx context.Context, storage storage.StrongStore, store *Store) (*HistoryReport, error) {
+	entries, lines, err := loadHistory(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	storeHash, err := store.ComputeHash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash store: %w", err)
+	}
+
+	report := &HistoryReport{Entries: entries, StoreHash: storeHash, MatchedEntry: -1}
+
+	if store.Hash != nil && *store.Hash != storeHash {
+		return report, &errclass.ValidationError{
+			Subject: "history",
+			Err:     fmt.Errorf("%w: recorded %s, computed %s", ErrStoreHashMismatch, *store.Hash, storeHash),
+		}
+	}
+
+	for i, entry := range entries {
+		want := ""
+		if i > 0 {
+			want = hashHex(lines[i-1])
+		}
+
+		if entry.Previous != want {
+			return report, &errclass.ValidationError{
+				Subject: "history",
+				Err:     fmt.Errorf("%w at entry %d (%s)", ErrHistoryChainBroken, i+1, entry.Time.Format(time.RFC3339)),
+			}
+		}
+
+		if entry.StoreHash == storeHash {
+			report.MatchedEntry = i
+		}
+	}
+
+	if len(entries) == 0 {
+		return report, nil
+	}
+
+	switch report.MatchedEntry {
+	case len(entries) - 1:
+		return report, nil
+	case -1:
+		return report, &errclass.ValidationError{Subject: "history", Err: ErrStoreNotInHistory}
+	default:
+		matched := entries[report.MatchedEntry]
+		return report, &errclass.ValidationError{
+			Subject: "history",
+			Err: fmt.Errorf("%w: store matches entry %d of %d (%s, %s)",
+				ErrStoreRolledBack, report.MatchedEntry+1, len(entries), matched.Operation, matched.Time.Format(time.RFC3339)),
+		}
+	}
+}
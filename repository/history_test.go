@@ -0,0 +1,98 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestVerifyHistory(t *testing.T) {
+	ctx := repository.WithOperation(context.Background(), "test")
+
+	setup := func(t *testing.T) (*storagetest.MemoryStore, []byte) {
+		t.Helper()
+		s := storagetest.NewMemoryStore()
+
+		b := repositorytest.NewStore("tank/data")
+		b.Full("tank/data", 48*time.Hour)
+		store, err := b.Save(ctx, s)
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		first := s.StoreContent()
+
+		store.ManagedDatasets = append(store.ManagedDatasets, "tank/other")
+		if err := store.Save(ctx, s); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+
+		return s, first
+	}
+
+	verify := func(t *testing.T, s *storagetest.MemoryStore) (*repository.HistoryReport, error) {
+		t.Helper()
+		store, err := repository.LoadStore(ctx, s)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		return repository.VerifyHistory(ctx, s, store)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		s, _ := setup(t)
+		report, err := verify(t, s)
+		if err != nil {
+			t.Fatalf("expected history to verify, got %v", err)
+		}
+		if len(report.Entries) != 2 || report.MatchedEntry != 1 {
+			t.Fatalf("expected 2 entries matching the last, got %d matching %d", len(report.Entries), report.MatchedEntry)
+		}
+		if report.Entries[0].Operation != "test" {
+			t.Fatalf("expected operation %q, got %q", "test", report.Entries[0].Operation)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		s, first := setup(t)
+		s.SetStoreContent(first)
+		if _, err := verify(t, s); !errors.Is(err, repository.ErrStoreRolledBack) {
+			t.Fatalf("expected ErrStoreRolledBack, got %v", err)
+		}
+	})
+
+	t.Run("edited store", func(t *testing.T) {
+		s, _ := setup(t)
+		s.SetStoreContent(bytes.Replace(s.StoreContent(), []byte("tank/other"), []byte("tank/edit!"), 1))
+
+		// The store is refused on load, unless repairing it.
+		if _, err := repository.LoadStore(ctx, s); !errors.Is(err, repository.ErrStoreHashMismatch) {
+			t.Fatalf("expected LoadStore to refuse the store, got %v", err)
+		}
+
+		store, err := repository.LoadStore(repository.WithHashRepair(ctx), s)
+		if err != nil {
+			t.Fatalf("load with repair: %v", err)
+		}
+		if !store.HashMismatch() {
+			t.Fatal("expected the hash mismatch to be reported")
+		}
+		if _, err := repository.VerifyHistory(ctx, s, store); !errors.Is(err, repository.ErrStoreHashMismatch) {
+			t.Fatalf("expected ErrStoreHashMismatch, got %v", err)
+		}
+	})
+
+	t.Run("removed entry", func(t *testing.T) {
+		s, _ := setup(t)
+		lines := bytes.SplitAfter(s.HistoryContent(), []byte("\n"))
+		s.SetHistoryContent(lines[1])
+		if _, err := verify(t, s); !errors.Is(err, repository.ErrHistoryChainBroken) {
+			t.Fatalf("expected ErrHistoryChainBroken, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// A store save is three writes: the store, its history entry, and the local
+// copy. Before the first, the sealed store is written to a journal, which is
+// deleted once the history entry is appended. A journal found later belongs
+// to a save that was interrupted, and RecoverJournal finishes it: the journal
+// is the commit point, so an intact journal is replayed, and a damaged one,
+// from a crash while it was being written, is rolled back by discarding it. A
+// save that fails before the store is written discards its journal, as its
+// caller sees the error.
+
+// JournalOutcome is what RecoverJournal did with the journal it found.
+type JournalOutcome string
+
+const (
+	// JournalNone means there was no journal.
+	JournalNone JournalOutcome = "none"
+	// JournalReplayed means the store was rewritten from the journal.
+	JournalReplayed JournalOutcome = "replayed"
+	// JournalCompleted means the store had been written, and only the
+	// history entry was missing, or the journal wasn't deleted.
+	JournalCompleted JournalOutcome = "completed"
+	// JournalRolledBack means the journal was damaged and discarded. The
+	// store is as it was before the interrupted save.
+	JournalRolledBack JournalOutcome = "rolled_back"
+)
+
+var ErrJournalChecksum = errors.New("journal content does not match its checksum")
+
+type journal struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Operation string    `json:"operation"`
+	Host      string    `json:"host"`
+	StoreHash string    `json:"store_hash"`
+	// Checksum is the hex SHA-256 of Store, to tell a journal that was cut
+	// short from a complete one.
+	Checksum string `json:"checksum"`
+	// Store is the store as saved, sealed if store encryption is enabled.
+	Store []byte `json:"store"`
+}
+
+func writeJournal(ctx context.Context, storage storage.StrongStore, storeHash string, storeBytes []byte) error {
+	host, _ := os.Hostname()
+	content, err := json.Marshal(journal{
+		Version:   1,
+		CreatedAt: time.Now(),
+		Operation: operationFromContext(ctx),
+		Host:      host,
+		StoreHash: storeHash,
+		Checksum:  hashHex(storeBytes),
+		Store:     storeBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %w", err)
+	}
+
+	slog.Debug("Writing store journal", "store_hash", storeHash)
+	if err := storage.SaveJournalContent(ctx, content); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
+
+// discardJournal deletes the journal of a save that failed. If it can't be,
+// the next RecoverJournal replays the save.
+func discardJournal(ctx context.Context, storage storage.StrongStore) {
+	if err := storage.DeleteJournalContent(ctx); err != nil {
+		slog.Warn("Failed to discard the journal of a failed store save. It will be replayed.", "error", err)
+	}
+}
+
+func decodeJournal(content []byte) (*journal, error) {
+	var j journal
+	if err := strictUnmarshal(content, &j); err != nil {
+		return nil, err
+	}
+
+	if j.Version != 1 {
+		return nil, fmt.Errorf("unsupported journal version %d", j.Version)
+	}
+	if hashHex(j.Store) != j.Checksum {
+		return nil, ErrJournalChecksum
+	}
+
+	return &j, nil
+}
+
+// HasJournal reports whether storage has the journal of an interrupted store
+// save.
+func HasJournal(ctx context.Context, storage storage.StrongStore) (bool, error) {
+	_, err := storage.LoadJournalContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load journal: %w", err)
+	}
+
+	return true, nil
+}
+
+// RecoverJournal finishes a store save that was interrupted, if storage has
+// its journal. It must run under the repository lock, as it writes the store.
+func RecoverJournal(ctx context.Context, storage storage.StrongStore) (JournalOutcome, error) {
+	content, err := storage.LoadJournalContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return JournalNone, nil
+	}
+	if err != nil {
+		slog.Error("Failed to load journal", "error", err)
+		return "", fmt.Errorf("failed to load journal: %w", err)
+	}
+
+	j, err := decodeJournal(content)
+	if err != nil {
+		slog.Warn("Journal of an interrupted store save is damaged. Rolling it back; the store is left as it was.", "error", err)
+		if err := storage.DeleteJournalContent(ctx); err != nil {
+			return "", fmt.Errorf("failed to delete journal: %w", err)
+		}
+		return JournalRolledBack, nil
+	}
+
+	slog.Warn("Found the journal of an interrupted store save. Finishing it.",
+		"operation", j.Operation, "host", j.Host, "created_at", j.CreatedAt, "store_hash", j.StoreHash)
+
+	outcome := JournalCompleted
+	current, err := storage.LoadStoreContent(ctx)
+	if err != nil && !errors.Is(err, errclass.ErrNotFound) {
+		return "", fmt.Errorf("failed to load store content: %w", err)
+	}
+	if !bytes.Equal(current, j.Store) {
+		slog.Info("Replaying the store from the journal", "store_hash", j.StoreHash)
+		if err := storage.SaveStoreContent(ctx, j.Store); err != nil {
+			return "", fmt.Errorf("failed to save store content: %w", err)
+		}
+		outcome = JournalReplayed
+	}
+
+	entries, _, err := loadHistory(ctx, storage)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 || entries[len(entries)-1].StoreHash != j.StoreHash {
+		if err := appendHistory(WithOperation(ctx, j.Operation+" (replayed)"), storage, j.StoreHash); err != nil {
+			return "", err
+		}
+	}
+
+	if err := storage.DeleteJournalContent(ctx); err != nil {
+		return "", fmt.Errorf("failed to delete journal: %w", err)
+	}
+
+	saveLocalCopy(ctx, j.Store)
+
+	slog.Info("Finished the interrupted store save", "outcome", outcome)
+	return outcome, nil
+}
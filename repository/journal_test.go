@@ -0,0 +1,122 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestRecoverJournal(t *testing.T) {
+	ctx := repository.WithOperation(context.Background(), "test")
+	errInjected := errors.New("injected")
+
+	setup := func(t *testing.T) (*storagetest.MemoryStore, *repository.Store) {
+		t.Helper()
+		s := storagetest.NewMemoryStore()
+
+		b := repositorytest.NewStore("tank/data")
+		b.Full("tank/data", 48*time.Hour)
+		store, err := b.Save(ctx, s)
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if s.JournalContent() != nil {
+			t.Fatal("expected a finished save to delete its journal")
+		}
+
+		store.ManagedDatasets = append(store.ManagedDatasets, "tank/other")
+		return s, store
+	}
+
+	recoverJournal := func(t *testing.T, s *storagetest.MemoryStore, want repository.JournalOutcome) {
+		t.Helper()
+		outcome, err := repository.RecoverJournal(ctx, s)
+		if err != nil {
+			t.Fatalf("recover: %v", err)
+		}
+		if outcome != want {
+			t.Fatalf("expected %s, got %s", want, outcome)
+		}
+		if s.JournalContent() != nil {
+			t.Fatal("expected the journal to be deleted")
+		}
+	}
+
+	checkSaved := func(t *testing.T, s *storagetest.MemoryStore) {
+		t.Helper()
+		loaded, err := repository.LoadStore(ctx, s)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		if len(loaded.ManagedDatasets) != 2 {
+			t.Fatalf("expected the interrupted change to be saved, got %v", loaded.ManagedDatasets)
+		}
+		if _, err := repository.VerifyHistory(ctx, s, loaded); err != nil {
+			t.Fatalf("expected the history to match the store: %v", err)
+		}
+	}
+
+	t.Run("no journal", func(t *testing.T) {
+		s, _ := setup(t)
+		recoverJournal(t, s, repository.JournalNone)
+	})
+
+	t.Run("failed save is discarded", func(t *testing.T) {
+		s, store := setup(t)
+		before := s.StoreContent()
+
+		s.FailNext(storagetest.OpSaveStore, errInjected)
+		if err := store.Save(ctx, s); !errors.Is(err, errInjected) {
+			t.Fatalf("expected the save to fail, got %v", err)
+		}
+		if s.JournalContent() != nil {
+			t.Fatal("expected the journal of a failed save to be discarded")
+		}
+		if !bytes.Equal(s.StoreContent(), before) {
+			t.Fatal("expected the store to be unchanged")
+		}
+	})
+
+	t.Run("interrupted before the store is written", func(t *testing.T) {
+		s, store := setup(t)
+
+		// The journal outlives the failed save, like after a crash.
+		s.FailNext(storagetest.OpSaveStore, errInjected)
+		s.FailNext(storagetest.OpDelJrnl, errInjected)
+		if err := store.Save(ctx, s); err == nil {
+			t.Fatal("expected the save to fail")
+		}
+
+		recoverJournal(t, s, repository.JournalReplayed)
+		checkSaved(t, s)
+	})
+
+	t.Run("interrupted before the history is appended", func(t *testing.T) {
+		s, store := setup(t)
+
+		s.FailNext(storagetest.OpSaveHist, errInjected)
+		if err := store.Save(ctx, s); !errors.Is(err, errInjected) {
+			t.Fatalf("expected the history append to fail, got %v", err)
+		}
+
+		recoverJournal(t, s, repository.JournalCompleted)
+		checkSaved(t, s)
+	})
+
+	t.Run("damaged journal is rolled back", func(t *testing.T) {
+		s, _ := setup(t)
+		before := s.StoreContent()
+
+		s.SetJournalContent([]byte(`{"version":1,"store_hash":"`))
+		recoverJournal(t, s, repository.JournalRolledBack)
+		if !bytes.Equal(s.StoreContent(), before) {
+			t.Fatal("expected the store to be left as it was")
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// Key escrow is opt-in. It keeps the repository's age identity inside the
+// repository, encrypted with a passphrase, so losing the backup host doesn't
+// also lose the only decryption key. The escrow is in the format of
+// age -p -a, so it can be decrypted by age, or passed to restore as is.
+
+var ErrNoKeyEscrow = errors.New("the repository has no escrowed key")
+
+// EscrowKey encrypts identity with passphrase and stores it in the
+// repository, replacing any earlier escrow. identity must match the
+// recipient of the store.
+func EscrowKey(ctx context.Context, storage storage.StrongStore, store *Store, identity string, passphrase string) error {
+	if store.Encryption.Disabled() {
+		return &errclass.EncryptionError{Op: "escrow key", Err: encryption.ErrEncryptionDisabled}
+	}
+
+	recipient, err := encryption.RecipientFromIdentity(identity)
+	if err != nil {
+		return err
+	}
+
+	if recipient != store.Encryption.Age.RecipientPublicKey {
+		slog.Error("Identity does not match the repository recipient", "recipient", store.Encryption.Age.RecipientPublicKey, "identity", recipient)
+		return &errclass.EncryptionError{Op: "escrow key", Err: encryption.ErrIdentityMismatch}
+	}
+
+	content, err := encryption.EncryptIdentity(identity, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the passphrase opens what we're about to store.
+	check, err := encryption.ReadIdentity(content, func() (string, error) { return passphrase, nil })
+	if err != nil {
+		return fmt.Errorf("failed to decrypt the escrowed key: %w", err)
+	}
+	if check != identity {
+		return &errclass.EncryptionError{Op: "escrow key", Err: errors.New("escrowed key does not decrypt back to the identity")}
+	}
+
+	if err := storage.SaveKeyEscrowContent(ctx, content); err != nil {
+		slog.Error("Failed to save key escrow", "error", err)
+		return fmt.Errorf("failed to save key escrow: %w", err)
+	}
+
+	slog.Info("Escrowed the age identity in the repository", "recipient", recipient)
+	return nil
+}
+
+// LoadKeyEscrow returns the escrowed identity, still encrypted with its
+// passphrase.
+func LoadKeyEscrow(ctx context.Context, storage storage.StrongStore) ([]byte, error) {
+	content, err := storage.LoadKeyEscrowContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return nil, &errclass.EncryptionError{Op: "load key escrow", Err: ErrNoKeyEscrow}
+	}
+	if err != nil {
+		slog.Error("Failed to load key escrow", "error", err)
+		return nil, fmt.Errorf("failed to load key escrow: %w", err)
+	}
+
+	return content, nil
+}
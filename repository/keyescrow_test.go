@@ -0,0 +1,67 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestKeyEscrow(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := repositorytest.NewStore("tank/data").
+		WithEncryption(config.Encryption{Age: config.Age{RecipientPublicKey: identity.Recipient().String()}}).
+		Build()
+
+	const passphrase = "correct horse battery staple"
+
+	if _, err := repository.LoadKeyEscrow(ctx, s); !errors.Is(err, repository.ErrNoKeyEscrow) {
+		t.Fatalf("expected ErrNoKeyEscrow, got %v", err)
+	}
+
+	if err := repository.EscrowKey(ctx, s, store, identity.String(), "short"); !errors.Is(err, encryption.ErrWeakPassphrase) {
+		t.Fatalf("expected ErrWeakPassphrase, got %v", err)
+	}
+
+	if err := repository.EscrowKey(ctx, s, store, other.String(), passphrase); !errors.Is(err, encryption.ErrIdentityMismatch) {
+		t.Fatalf("expected ErrIdentityMismatch, got %v", err)
+	}
+
+	if err := repository.EscrowKey(ctx, s, store, identity.String(), passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := repository.LoadKeyEscrow(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := encryption.ReadIdentity(content, func() (string, error) { return passphrase, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != identity.String() {
+		t.Fatal("escrowed key does not decrypt to the identity")
+	}
+
+	if _, err := encryption.ReadIdentity(content, func() (string, error) { return "wrong passphrase, long enough", nil }); err == nil {
+		t.Fatal("expected a wrong passphrase to fail")
+	}
+}
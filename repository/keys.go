@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// Rotating the key makes a new age recipient the recipient of new backups.
+// Existing backups stay encrypted to the recipient they were taken with,
+// which each backup records, until they are re-encrypted. Restores need an
+// identity for every recipient still in use.
+//
+// A repository may also have a recovery recipient, whose identity is kept
+// offline. Every backup is encrypted to it as well, so losing the identity of
+// the day-to-day recipient doesn't lose the backups.
+
+var (
+	ErrSameRecipient     = errors.New("the recipient is the repository's recipient already")
+	ErrRecoveryRecipient = errors.New("the recovery recipient must differ from the repository's recipient")
+)
+
+// RetiredRecipient is a recipient the repository used before a key rotation.
+type RetiredRecipient struct {
+	Recipient string    `json:"recipient"`
+	RetiredAt time.Time `json:"retired_at"`
+}
+
+// RotateRecipient makes recipient the recipient of new backups, and records
+// the current one as retired. A repository initialized without encryption
+// can't be given a recipient.
+func (s *Store) RotateRecipient(recipient string, now time.Time) error {
+	recipient = encryption.NormalizeRecipient(recipient)
+	if err := encryption.ValidateRecipientPublicKey(recipient); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Encryption.Disabled() {
+		return &errclass.ValidationError{Subject: "recipient", Err: encryption.ErrEncryptionDisabled}
+	}
+
+	current := s.Encryption.Age.RecipientPublicKey
+	if recipient == current {
+		return &errclass.ValidationError{Subject: "recipient", Err: ErrSameRecipient}
+	}
+	if recipient == s.Encryption.Age.RecoveryRecipientPublicKey {
+		return &errclass.ValidationError{Subject: "recipient", Err: ErrRecoveryRecipient}
+	}
+
+	slog.Debug("Rotating recipient", "from", current, "to", recipient)
+	s.RetiredRecipients = append(s.RetiredRecipients, RetiredRecipient{Recipient: current, RetiredAt: now})
+	s.Encryption.Age.RecipientPublicKey = recipient
+	return nil
+}
+
+// SetRecoveryRecipient makes recipient the recovery recipient of new
+// backups, or removes the recovery recipient if it is empty. Existing backups
+// are encrypted to it once they are re-encrypted.
+func (s *Store) SetRecoveryRecipient(recipient string) error {
+	recipient = encryption.NormalizeRecipient(recipient)
+	if recipient != "" {
+		if err := encryption.ValidateRecipientPublicKey(recipient); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Encryption.Disabled() {
+		return &errclass.ValidationError{Subject: "recovery recipient", Err: encryption.ErrEncryptionDisabled}
+	}
+	if recipient != "" && recipient == s.Encryption.Age.RecipientPublicKey {
+		return &errclass.ValidationError{Subject: "recovery recipient", Err: ErrRecoveryRecipient}
+	}
+
+	slog.Debug("Setting recovery recipient", "from", s.Encryption.Age.RecoveryRecipientPublicKey, "to", recipient)
+	s.Encryption.Age.RecoveryRecipientPublicKey = recipient
+	return nil
+}
+
+// EncryptedTo reports whether the backup is known to be encrypted to
+// recipient. Backups taken before recipients were recorded aren't.
+func (b *Backup) EncryptedTo(recipient string) bool {
+	return b.Recipient != "" && b.Recipient == recipient
+}
+
+// NotEncryptedTo returns the backups that aren't known to be encrypted to
+// recipient, and to the recovery recipient recovery or to none if it is
+// empty, oldest first.
+func (bs Backups) NotEncryptedTo(recipient string, recovery string) []*Backup {
+	var due []*Backup
+	for _, b := range bs.All() {
+		if !b.EncryptedTo(recipient) || b.RecoveryRecipient != recovery {
+			due = append(due, b)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ID.Compare(due[j].ID) < 0
+	})
+
+	return due
+}
+
+// ByRecipient counts the backups by the recipient they are encrypted to.
+// Backups taken before recipients were recorded are counted under "".
+func (bs Backups) ByRecipient() map[string]int {
+	counts := map[string]int{}
+	for _, b := range bs.All() {
+		counts[b.Recipient]++
+	}
+
+	return counts
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestRotateRecipient(t *testing.T) {
+	oldIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	newIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	oldRecipient := oldIdentity.Recipient().String()
+	newRecipient := newIdentity.Recipient().String()
+
+	s := &Store{Encryption: config.Encryption{Age: config.Age{RecipientPublicKey: oldRecipient}}}
+
+	if err := s.RotateRecipient(oldRecipient, time.Now()); !errors.Is(err, ErrSameRecipient) {
+		t.Fatalf("expected rotating to the current recipient to fail, got %v", err)
+	}
+	if err := s.RotateRecipient("not a recipient", time.Now()); err == nil {
+		t.Fatal("expected rotating to an invalid recipient to fail")
+	}
+
+	now := time.Now()
+	if err := s.RotateRecipient(newRecipient, now); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if s.Encryption.Age.RecipientPublicKey != newRecipient {
+		t.Fatalf("expected the new recipient to be current, got %s", s.Encryption.Age.RecipientPublicKey)
+	}
+	if len(s.RetiredRecipients) != 1 || s.RetiredRecipients[0].Recipient != oldRecipient || !s.RetiredRecipients[0].RetiredAt.Equal(now) {
+		t.Fatalf("expected the old recipient to be retired, got %+v", s.RetiredRecipients)
+	}
+}
+
+func TestRollBackKeepsRecipient(t *testing.T) {
+	oldIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	newIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	oldRecipient := oldIdentity.Recipient().String()
+	newRecipient := newIdentity.Recipient().String()
+
+	version := &Store{Encryption: config.Encryption{Age: config.Age{RecipientPublicKey: oldRecipient}}, Backups: NewBackups()}
+	s := &Store{Encryption: version.Encryption}
+	if err := s.RotateRecipient(newRecipient, time.Now()); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	s.RollBackTo(version)
+	if s.Encryption.Age.RecipientPublicKey != newRecipient {
+		t.Fatalf("expected rolling back past the rotation to keep the new recipient, got %s", s.Encryption.Age.RecipientPublicKey)
+	}
+	if len(s.RetiredRecipients) != 1 || s.RetiredRecipients[0].Recipient != oldRecipient {
+		t.Fatalf("expected the old recipient to stay retired, got %+v", s.RetiredRecipients)
+	}
+}
+
+func TestRotateRecipientWithoutEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+
+	s := &Store{Encryption: config.Encryption{Mode: config.EncryptionModeNone}}
+	if err := s.RotateRecipient(identity.Recipient().String(), time.Now()); !errors.Is(err, encryption.ErrEncryptionDisabled) {
+		t.Fatalf("expected rotating an unencrypted repository to fail, got %v", err)
+	}
+	if s.Encryption.Age.RecipientPublicKey != "" || len(s.RetiredRecipients) != 0 {
+		t.Fatalf("expected the store to be unchanged, got %+v", s.Encryption)
+	}
+}
+
+func TestSetRecoveryRecipient(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	recoveryIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	recipient := identity.Recipient().String()
+	recovery := recoveryIdentity.Recipient().String()
+
+	s := &Store{Encryption: config.Encryption{Age: config.Age{RecipientPublicKey: recipient}}}
+
+	if err := s.SetRecoveryRecipient(recipient); !errors.Is(err, ErrRecoveryRecipient) {
+		t.Fatalf("expected the repository's recipient to be refused, got %v", err)
+	}
+	if err := s.SetRecoveryRecipient(recovery); err != nil {
+		t.Fatalf("set recovery recipient: %v", err)
+	}
+	if s.Encryption.Age.RecoveryRecipientPublicKey != recovery {
+		t.Fatalf("expected the recovery recipient to be set, got %q", s.Encryption.Age.RecoveryRecipientPublicKey)
+	}
+	if err := s.RotateRecipient(recovery, time.Now()); !errors.Is(err, ErrRecoveryRecipient) {
+		t.Fatalf("expected rotating to the recovery recipient to fail, got %v", err)
+	}
+
+	if err := s.SetRecoveryRecipient(""); err != nil || s.Encryption.Age.RecoveryRecipientPublicKey != "" {
+		t.Fatalf("expected the recovery recipient to be removed, got %q, %v", s.Encryption.Age.RecoveryRecipientPublicKey, err)
+	}
+
+	unencrypted := &Store{Encryption: config.Encryption{Mode: config.EncryptionModeNone}}
+	if err := unencrypted.SetRecoveryRecipient(recovery); !errors.Is(err, encryption.ErrEncryptionDisabled) {
+		t.Fatalf("expected a recovery recipient to be refused without encryption, got %v", err)
+	}
+}
+
+func TestNotEncryptedTo(t *testing.T) {
+	now := time.Now()
+	current := ulid.Make()
+	previous := ulid.Make()
+	unrecorded := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: current, Type: BackupTypeFull, CreatedAt: now, Recipient: "age1new"},
+		&Backup{ID: previous, Type: BackupTypeFull, CreatedAt: now, Recipient: "age1old"},
+		&Backup{ID: unrecorded, Type: BackupTypeFull, CreatedAt: now},
+	)
+
+	due := bs.NotEncryptedTo("age1new", "")
+	if len(due) != 2 || due[0].ID != previous || due[1].ID != unrecorded {
+		t.Fatalf("expected the backups of other recipients ordered by ID, got %v", due)
+	}
+
+	bs.Find(current).RecoveryRecipient = "age1recovery"
+	due = bs.NotEncryptedTo("age1new", "age1recovery")
+	if len(due) != 2 || due[0].ID != previous || due[1].ID != unrecorded {
+		t.Fatalf("expected the backups without the recovery recipient, got %v", due)
+	}
+	if due := bs.NotEncryptedTo("age1new", ""); len(due) != 3 {
+		t.Fatalf("expected a removed recovery recipient to make every backup due, got %v", due)
+	}
+
+	counts := bs.ByRecipient()
+	if counts["age1new"] != 1 || counts["age1old"] != 1 || counts[""] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
@@ -0,0 +1,309 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// The local process lock only keeps two runs on the same host apart. Hosts
+// sharing a repository are kept apart by a lease: each writes its own lock
+// object to the storage, then lists the others. If another unexpired lease
+// exists, it backs off and retries, so two hosts racing each other both back
+// off rather than both going ahead. Expiry is judged against the local clock,
+// so the hosts' clocks must agree to well within the TTL.
+
+const (
+	DefaultLeaseTTL = 5 * time.Minute
+
+	leaseMinBackoff = time.Second
+	leaseMaxBackoff = 10 * time.Second
+)
+
+var (
+	// ErrLeaseHeld is returned when another holder's lease is still live
+	// after waiting for it.
+	ErrLeaseHeld = errors.New("the repository is locked by another host")
+	// ErrLeaseLost is returned when the lease expired before it could be
+	// refreshed, so another host may have taken it over.
+	ErrLeaseLost = errors.New("the repository lock expired before it could be refreshed")
+)
+
+// LeaseInfo is the content of a lock object.
+type LeaseInfo struct {
+	ID         string    `json:"id"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	Command    string    `json:"command"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the lease has expired at now.
+func (i *LeaseInfo) Expired(now time.Time) bool {
+	return !now.Before(i.ExpiresAt)
+}
+
+func (i *LeaseInfo) String() string {
+	return fmt.Sprintf("%s (host %s, pid %d, command %q, expires %s)", i.ID, i.Host, i.PID, i.Command, i.ExpiresAt.Format(time.RFC3339))
+}
+
+type LeaseOpts struct {
+	// TTL is how long the lease lives without being refreshed. It is
+	// refreshed every TTL/3. DefaultLeaseTTL is used when it is 0.
+	TTL time.Duration
+	// Wait is how long to retry for while another host holds the lease.
+	Wait time.Duration
+	// Command is recorded in the lock object, to tell who holds it.
+	Command string
+}
+
+// Lease is a lock on the repository held in its storage. It is refreshed in
+// the background until it is released.
+type Lease struct {
+	storage storage.StrongStore
+	ttl     time.Duration
+
+	mu   sync.Mutex
+	info LeaseInfo
+	err  error
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// AcquireLease takes the repository's lease, waiting up to opts.Wait for
+// other holders to release theirs, or for their leases to expire.
+func AcquireLease(ctx context.Context, storage storage.StrongStore, opts LeaseOpts) (*Lease, error) {
+	ttl := cmp.Or(opts.TTL, DefaultLeaseTTL)
+	host, _ := os.Hostname()
+
+	l := &Lease{
+		storage: storage,
+		ttl:     ttl,
+		info: LeaseInfo{
+			ID:      ulid.Make().String(),
+			Host:    host,
+			PID:     os.Getpid(),
+			Command: opts.Command,
+		},
+	}
+
+	slog.Debug("Acquiring repository lock", "id", l.info.ID, "ttl", ttl, "wait", opts.Wait)
+
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		holder, err := l.tryAcquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			break
+		}
+
+		backoff := leaseMinBackoff + rand.N(leaseMaxBackoff-leaseMinBackoff)
+		if time.Now().Add(backoff).After(deadline) {
+			slog.Error("Repository is locked by another host", "holder", holder)
+			return nil, &errclass.LockError{Path: "repository", Err: fmt.Errorf("%w: %s", ErrLeaseHeld, holder)}
+		}
+
+		slog.Info("Repository is locked by another host. Waiting for it.", "holder", holder, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	slog.Debug("Acquired repository lock", "id", l.info.ID, "expires_at", l.info.ExpiresAt)
+
+	// Refreshes outlive a cancelled command, so the lease is kept until it
+	// is released.
+	refreshCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	l.stop = stop
+	l.done = make(chan struct{})
+	go l.keepalive(refreshCtx)
+
+	return l, nil
+}
+
+// tryAcquire writes the lease, then returns the live lease of another holder,
+// if there is one. In that case, its own is deleted again.
+func (l *Lease) tryAcquire(ctx context.Context) (*LeaseInfo, error) {
+	now := time.Now()
+	l.info.AcquiredAt = now
+	l.info.ExpiresAt = now.Add(l.ttl)
+
+	if err := l.write(ctx, l.info); err != nil {
+		return nil, err
+	}
+
+	leases, err := ListLeases(ctx, l.storage)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, other := range leases {
+		if other.ID == l.info.ID || other.Expired(time.Now()) {
+			continue
+		}
+
+		if err := l.storage.DeleteLockContent(ctx, l.info.ID); err != nil {
+			slog.Error("Failed to withdraw repository lock", "id", l.info.ID, "error", err)
+			return nil, err
+		}
+
+		return other, nil
+	}
+
+	return nil, nil
+}
+
+func (l *Lease) keepalive(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		info := l.info
+		l.mu.Unlock()
+
+		// Once expired, another host may hold the lease, so it must not
+		// be taken back.
+		now := time.Now()
+		if info.Expired(now) {
+			slog.Error("Repository lock expired before it could be refreshed", "id", info.ID, "expired_at", info.ExpiresAt)
+			l.lost()
+			return
+		}
+
+		info.ExpiresAt = now.Add(l.ttl)
+		if err := l.write(ctx, info); err != nil {
+			slog.Warn("Failed to refresh repository lock. Retrying on the next refresh.", "id", info.ID, "error", err)
+			continue
+		}
+
+		slog.Debug("Refreshed repository lock", "id", info.ID, "expires_at", info.ExpiresAt)
+		l.mu.Lock()
+		l.info = info
+		l.mu.Unlock()
+	}
+}
+
+func (l *Lease) lost() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.err = &errclass.LockError{Path: "repository", Err: ErrLeaseLost}
+}
+
+func (l *Lease) write(ctx context.Context, info LeaseInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if err := l.storage.SaveLockContent(ctx, info.ID, content); err != nil {
+		slog.Error("Failed to write repository lock", "id", info.ID, "error", err)
+		return fmt.Errorf("failed to write repository lock: %w", err)
+	}
+
+	return nil
+}
+
+// Info returns the lease as last written.
+func (l *Lease) Info() LeaseInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.info
+}
+
+// Check returns ErrLeaseLost if the lease has expired.
+func (l *Lease) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	if l.info.Expired(time.Now()) {
+		return &errclass.LockError{Path: "repository", Err: ErrLeaseLost}
+	}
+
+	return nil
+}
+
+// Release stops refreshing the lease and deletes it.
+func (l *Lease) Release(ctx context.Context) error {
+	l.stop()
+	<-l.done
+
+	slog.Debug("Releasing repository lock", "id", l.info.ID)
+	if err := l.storage.DeleteLockContent(ctx, l.info.ID); err != nil {
+		slog.Error("Failed to release repository lock", "id", l.info.ID, "error", err)
+		return fmt.Errorf("failed to release repository lock: %w", err)
+	}
+
+	return nil
+}
+
+// ListLeases returns the leases in the storage, expired or not, oldest first.
+// A lock object that can't be decoded is returned with only its ID, and never
+// expires, as there is no telling when its holder is done.
+func ListLeases(ctx context.Context, storage storage.StrongStore) ([]*LeaseInfo, error) {
+	contents, err := storage.LoadLockContents(ctx)
+	if err != nil {
+		slog.Error("Failed to list repository locks", "error", err)
+		return nil, fmt.Errorf("failed to list repository locks: %w", err)
+	}
+
+	leases := make([]*LeaseInfo, 0, len(contents))
+	for id, content := range contents {
+		var info LeaseInfo
+		if err := json.Unmarshal(content, &info); err != nil || info.ID != id {
+			slog.Warn("Repository lock can't be decoded. Break it with `zfsbackrest lock remote --break` once its holder is gone.", "id", id, "error", err)
+			info = LeaseInfo{ID: id, ExpiresAt: time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)}
+		}
+
+		leases = append(leases, &info)
+	}
+
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].AcquiredAt.Before(leases[j].AcquiredAt)
+	})
+
+	return leases, nil
+}
+
+// BreakLease deletes the lease with the given ID, e.g. one whose holder
+// crashed and left an undecodable lock object.
+func BreakLease(ctx context.Context, storage storage.StrongStore, id string) error {
+	slog.Warn("Breaking repository lock", "id", id)
+
+	if err := storage.DeleteLockContent(ctx, id); err != nil {
+		return fmt.Errorf("failed to break repository lock: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package repository_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	first, err := repository.AcquireLease(ctx, s, repository.LeaseOpts{TTL: time.Minute, Command: "backup"})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	if _, err := repository.AcquireLease(ctx, s, repository.LeaseOpts{TTL: time.Minute}); !errors.Is(err, repository.ErrLeaseHeld) {
+		t.Fatalf("expected ErrLeaseHeld while the lease is held, got %v", err)
+	}
+
+	// The loser withdraws its own lock object.
+	leases, err := repository.ListLeases(ctx, s)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(leases) != 1 || leases[0].ID != first.Info().ID || leases[0].Command != "backup" {
+		t.Fatalf("expected only the holder's lease, got %v", leases)
+	}
+
+	if err := first.Release(ctx); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	second, err := repository.AcquireLease(ctx, s, repository.LeaseOpts{TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	if err := second.Release(ctx); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// An expired lease, left by a holder that died, is ignored.
+	expired, _ := json.Marshal(repository.LeaseInfo{ID: "dead", ExpiresAt: time.Now().Add(-time.Second)})
+	if err := s.SaveLockContent(ctx, "dead", expired); err != nil {
+		t.Fatal(err)
+	}
+	third, err := repository.AcquireLease(ctx, s, repository.LeaseOpts{TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("acquire over an expired lease: %v", err)
+	}
+	if err := third.Release(ctx); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+}
+
+func TestLeaseRefreshAndLoss(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	b.Full("tank/data", time.Hour)
+	store, err := b.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	ttl := 150 * time.Millisecond
+	lease, err := repository.AcquireLease(ctx, s, repository.LeaseOpts{TTL: ttl})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	store.SetLease(lease)
+
+	// Refreshes keep the lease alive past its TTL.
+	acquired := lease.Info()
+	time.Sleep(2 * ttl)
+	if err := lease.Check(); err != nil {
+		t.Fatalf("expected the refreshed lease to be live, got %v", err)
+	}
+	if !lease.Info().ExpiresAt.After(acquired.ExpiresAt) {
+		t.Fatal("expected the lease to be refreshed")
+	}
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save under the lease: %v", err)
+	}
+
+	// Once it is no longer refreshed, it expires, and the store can't be
+	// saved under it.
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	time.Sleep(ttl)
+	if err := store.Save(ctx, s); !errors.Is(err, repository.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/gargakshit/zfsbackrest/config"
+)
+
+type localStoreKey struct{}
+
+// WithLocalStore makes store saves in ctx also write a copy of the store to
+// local disk.
+func WithLocalStore(ctx context.Context, cfg config.LocalStore) context.Context {
+	return context.WithValue(ctx, localStoreKey{}, cfg)
+}
+
+func localStoreFromContext(ctx context.Context) (config.LocalStore, bool) {
+	cfg, ok := ctx.Value(localStoreKey{}).(config.LocalStore)
+	return cfg, ok && cfg.Path != ""
+}
+
+// saveLocalCopy writes content to the local copy of the store, if one is
+// configured, after rotating the earlier copies. The copy is a fallback, so
+// failing to write it only warns.
+func saveLocalCopy(ctx context.Context, content []byte) {
+	cfg, ok := localStoreFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	if err := writeLocalCopy(cfg, content); err != nil {
+		slog.Warn("Failed to write the local copy of the store", "path", cfg.Path, "error", err)
+		return
+	}
+
+	slog.Debug("Wrote the local copy of the store", "path", cfg.Path)
+}
+
+func writeLocalCopy(cfg config.LocalStore, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o700); err != nil {
+		return err
+	}
+
+	// Shift path.<n-1> to path.<n>, down to path to path.1. The oldest falls
+	// off the end.
+	for n := cfg.Keep; n > 0; n-- {
+		from := localCopyPath(cfg.Path, n-1)
+		if err := os.Rename(from, localCopyPath(cfg.Path, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate %s: %w", from, err)
+		}
+	}
+
+	// Write and rename, so a crash never leaves a partial copy behind.
+	if err := os.WriteFile(cfg.Path+".tmp", content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(cfg.Path+".tmp", cfg.Path)
+}
+
+// localCopyPath is the path of the n-th earlier copy, or of the latest one if
+// n is 0.
+func localCopyPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
@@ -0,0 +1,60 @@
+package repository_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestSaveWritesLocalCopy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "store.json")
+	ctx := repository.WithLocalStore(context.Background(), config.LocalStore{Path: path, Keep: 2})
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", time.Hour)
+	store, err := b.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// Three more saves rotate the copies, and drop the oldest.
+	for range 3 {
+		if err := store.Save(ctx, s); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected %s: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 earlier copies, got %v", err)
+	}
+
+	// The copy is the store as saved, and loads from a fresh bucket.
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read local copy: %v", err)
+	}
+	recovered := storagetest.NewMemoryStore()
+	if err := recovered.SaveStoreContent(context.Background(), content); err != nil {
+		t.Fatalf("save store content: %v", err)
+	}
+	loaded, err := repository.LoadStore(context.Background(), recovered)
+	if err != nil {
+		t.Fatalf("load recovered store: %v", err)
+	}
+	if _, ok := loaded.Backups.Get(full.ID); !ok {
+		t.Fatal("recovered store lost a backup")
+	}
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Locked reports whether the backup's snapshot is still locked against
+// deletion at now, by an Object Lock retention set when it was uploaded.
+func (b *Backup) Locked(now time.Time) bool {
+	return b.LockedUntil != nil && b.LockedUntil.After(now)
+}
+
+// HoldLocked removes the backups that are locked at now from expired, along
+// with their parents, which can't be deleted while they have children. It
+// returns the backups it removed, oldest first. They expire again on a later
+// cleanup, once their lock has ended.
+func (bs Backups) HoldLocked(expired Backups, now time.Time) []*Backup {
+	var held []*Backup
+	for _, b := range expired.All() {
+		if !b.Locked(now) {
+			continue
+		}
+
+		slog.Debug("Expired backup is locked", "backup", b.ID, "locked_until", b.LockedUntil)
+		for cur := b; cur != nil; {
+			if _, ok := expired.Get(cur.ID); !ok {
+				break
+			}
+
+			expired.remove(cur.ID)
+			held = append(held, cur)
+
+			if cur.DependsOn == nil {
+				break
+			}
+			cur = bs.Find(*cur.DependsOn)
+		}
+	}
+
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].ID.Compare(held[j].ID) < 0
+	})
+
+	return held
+}
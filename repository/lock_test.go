@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestHoldLocked(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	full := ulid.Make()
+	diff := ulid.Make()
+	incr := ulid.Make()
+	unlocked := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: full, Type: BackupTypeFull},
+		&Backup{ID: diff, Type: BackupTypeDiff, DependsOn: &full},
+		&Backup{ID: incr, Type: BackupTypeIncr, DependsOn: &diff, LockedUntil: &later},
+		&Backup{ID: unlocked, Type: BackupTypeFull, LockedUntil: &earlier},
+	)
+
+	expired := NewBackups(bs.Find(full), bs.Find(diff), bs.Find(incr), bs.Find(unlocked))
+	held := bs.HoldLocked(expired, now)
+
+	if len(held) != 3 {
+		t.Fatalf("expected the locked backup and its parents to be held, got %d", len(held))
+	}
+	if held[0].ID != full || held[1].ID != diff || held[2].ID != incr {
+		t.Fatalf("expected held backups ordered by ID, got %s, %s, %s", held[0].ID, held[1].ID, held[2].ID)
+	}
+	if expired.Len() != 1 || expired.Find(unlocked) == nil {
+		t.Fatalf("expected only the backup whose lock ended to stay expired, got %v", expired)
+	}
+}
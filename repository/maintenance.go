@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Maintenance records that a repository (or a single host) is frozen for
+// planned maintenance. While frozen, backups and cleanups are no-ops.
+type Maintenance struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Host   string    `json:"host"`
+}
+
+func NewMaintenance(reason string) *Maintenance {
+	host, err := os.Hostname()
+	if err != nil {
+		slog.Warn("Failed to get hostname", "error", err)
+	}
+
+	return &Maintenance{
+		Reason: reason,
+		Since:  time.Now(),
+		Host:   host,
+	}
+}
+
+// Freeze puts the repository in maintenance mode.
+func (s *Store) Freeze(m *Maintenance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slog.Debug("Freezing repository", "maintenance", m)
+	s.Maintenance = m
+}
+
+// Unfreeze takes the repository out of maintenance mode.
+func (s *Store) Unfreeze() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slog.Debug("Unfreezing repository")
+	s.Maintenance = nil
+}
+
+const localMaintenanceFile = "maintenance.json"
+
+// LoadLocalMaintenance reads the host-local maintenance flag from stateDir.
+// It returns nil if the host is not in maintenance mode.
+func LoadLocalMaintenance(stateDir string) (*Maintenance, error) {
+	content, err := os.ReadFile(filepath.Join(stateDir, localMaintenanceFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local maintenance flag: %w", err)
+	}
+
+	var m Maintenance
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse local maintenance flag: %w", err)
+	}
+
+	return &m, nil
+}
+
+// SaveLocalMaintenance writes the host-local maintenance flag to stateDir.
+// A nil m removes the flag.
+func SaveLocalMaintenance(stateDir string, m *Maintenance) error {
+	path := filepath.Join(stateDir, localMaintenanceFile)
+
+	if m == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove local maintenance flag: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal local maintenance flag: %w", err)
+	}
+
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write local maintenance flag: %w", err)
+	}
+
+	return nil
+}
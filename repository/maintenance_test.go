@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"testing"
+)
+
+func TestLocalMaintenanceRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := LoadLocalMaintenance(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != nil {
+		t.Fatalf("expected no maintenance flag, got %v", m)
+	}
+
+	want := NewMaintenance("replacing disks")
+	if err := SaveLocalMaintenance(dir, want); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := LoadLocalMaintenance(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got == nil || got.Reason != want.Reason || !got.Since.Equal(want.Since) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if err := SaveLocalMaintenance(dir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Removing twice is fine.
+	if err := SaveLocalMaintenance(dir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m, err = LoadLocalMaintenance(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != nil {
+		t.Fatalf("expected no maintenance flag after removal, got %v", m)
+	}
+}
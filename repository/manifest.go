@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// Every backup has a small manifest object stored next to its snapshot. It
+// describes the backup on its own, so backups stay recoverable even if the
+// store is lost or damaged. Manifests are encrypted like snapshots.
+
+const (
+	manifestVersion = 1
+	manifestSuffix  = ".manifest"
+)
+
+// Manifest is the content of a backup's manifest object.
+type Manifest struct {
+	Version int    `json:"version"`
+	Backup  Backup `json:"backup"`
+}
+
+// ManifestObjectName returns the name of the manifest object of a backup,
+// relative to its dataset.
+func ManifestObjectName(id ulid.ULID) string {
+	return id.String() + manifestSuffix
+}
+
+// ObjectMetadata returns the metadata to attach to the backup's objects in
+// the storage. enc is the repository's encryption, even if the object is
+// copied with a passthrough encryption.
+func (b *Backup) ObjectMetadata(kind storage.ObjectKind, enc encryption.Encryption) storage.SnapshotMetadata {
+	_, plain := enc.(encryption.Passthrough)
+
+	return storage.SnapshotMetadata{
+		Kind:       kind,
+		BackupID:   b.ID.String(),
+		Dataset:    b.Dataset,
+		BackupType: string(b.Type),
+		CreatedAt:  b.CreatedAt,
+		Encrypted:  !plain,
+	}
+}
+
+// WriteManifest writes the manifest object of a backup, and its checksum
+// object, replacing any existing ones.
+func WriteManifest(ctx context.Context, s storage.StrongStore, enc encryption.Encryption, backup *Backup) error {
+	if err := writeChecksum(ctx, s, backup); err != nil {
+		return err
+	}
+
+	slog.Debug("Writing backup manifest", "dataset", backup.Dataset, "backup", backup.ID)
+
+	content, err := json.Marshal(Manifest{Version: manifestVersion, Backup: *backup})
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	ctx = storage.WithSnapshotMetadata(ctx, backup.ObjectMetadata(storage.ObjectKindManifest, enc))
+	w, err := s.OpenSnapshotWriteStream(ctx, backup.Dataset, ManifestObjectName(backup.ID), int64(len(content)), enc)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest write stream: %w", err)
+	}
+
+	if _, err := w.Write(content); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest write stream: %w", err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads and validates the manifest object of a backup.
+func ReadManifest(ctx context.Context, s storage.StrongStore, enc encryption.Encryption, dataset string, id ulid.ULID) (*Manifest, error) {
+	slog.Debug("Reading backup manifest", "dataset", dataset, "backup", id)
+
+	r, err := s.OpenSnapshotReadStream(ctx, dataset, ManifestObjectName(id), enc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest read stream: %w", err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := strictUnmarshal(content, &manifest); err != nil {
+		return nil, &errclass.ValidationError{Subject: "manifest " + id.String(), Err: err}
+	}
+
+	if manifest.Version != manifestVersion {
+		return nil, &errclass.ValidationError{
+			Subject: "manifest " + id.String(),
+			Err:     fmt.Errorf("%w: %d", ErrInvalidStoreVersion, manifest.Version),
+		}
+	}
+
+	if err := manifest.Backup.validateFields(id); err != nil {
+		return nil, &errclass.ValidationError{Subject: "manifest " + id.String(), Err: err}
+	}
+
+	if manifest.Backup.Dataset != dataset {
+		return nil, &errclass.ValidationError{
+			Subject: "manifest " + id.String(),
+			Err:     fmt.Errorf("manifest is for dataset %s, but is stored under %s", manifest.Backup.Dataset, dataset),
+		}
+	}
+
+	return &manifest, nil
+}
+
+// DeleteManifest deletes the manifest object of a backup, and its checksum
+// object. Deleting a missing manifest is not an error.
+func DeleteManifest(ctx context.Context, s storage.StrongStore, dataset string, id ulid.ULID) error {
+	slog.Debug("Deleting backup manifest", "dataset", dataset, "backup", id)
+	if err := s.DeleteSnapshot(ctx, dataset, ManifestObjectName(id)); err != nil {
+		return err
+	}
+
+	return deleteChecksum(ctx, s, dataset, id)
+}
@@ -0,0 +1,92 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 48*time.Hour)
+	diff := b.Diff(full, 24*time.Hour)
+	diff.Checksum = "abc"
+
+	if err := repository.WriteManifest(ctx, s, encryption.Passthrough{}, diff); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	manifest, err := repository.ReadManifest(ctx, s, encryption.Passthrough{}, "tank/data", diff.ID)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	got := manifest.Backup
+	if got.ID != diff.ID || got.Type != repository.BackupTypeDiff || got.DependsOn == nil || *got.DependsOn != full.ID ||
+		got.Size != diff.Size || got.Checksum != "abc" || got.Dataset != "tank/data" {
+		t.Fatalf("manifest does not match the backup: %+v", got)
+	}
+
+	metadata, ok := s.Metadata("tank/data", repository.ManifestObjectName(diff.ID))
+	if !ok || metadata.Kind != storage.ObjectKindManifest || metadata.BackupID != diff.ID.String() ||
+		metadata.Dataset != "tank/data" || metadata.ContentType() != "application/json" {
+		t.Fatalf("unexpected manifest metadata: %+v", metadata)
+	}
+
+	if _, err := repository.ReadManifest(ctx, s, encryption.Passthrough{}, "tank/other", diff.ID); !errors.Is(err, errclass.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for another dataset, got %v", err)
+	}
+
+	if err := repository.DeleteManifest(ctx, s, "tank/data", diff.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := repository.ReadManifest(ctx, s, encryption.Passthrough{}, "tank/data", diff.ID); !errors.Is(err, errclass.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestManifestChecksumObject(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", time.Hour)
+	if err := repository.WriteManifest(ctx, s, encryption.Passthrough{}, full); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, ok := s.RawSnapshot("tank/data", repository.ChecksumObjectName(full.ID)); ok {
+		t.Fatal("expected no checksum object for a backup without an object checksum")
+	}
+
+	full.ObjectChecksum = "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26"
+	if err := repository.WriteManifest(ctx, s, encryption.Passthrough{}, full); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	content, ok := s.RawSnapshot("tank/data", repository.ChecksumObjectName(full.ID))
+	if want := full.ObjectChecksum + "  " + full.ID.String() + "\n"; !ok || string(content) != want {
+		t.Fatalf("checksum object = %q, want %q", content, want)
+	}
+	if metadata, ok := s.Metadata("tank/data", repository.ChecksumObjectName(full.ID)); !ok ||
+		metadata.Kind != storage.ObjectKindChecksum || metadata.Encrypted || metadata.ContentType() != "text/plain" {
+		t.Fatalf("unexpected checksum metadata: %+v", metadata)
+	}
+
+	if err := repository.DeleteManifest(ctx, s, "tank/data", full.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if snapshots := s.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("expected the manifest and checksum objects to be deleted, got %v", snapshots)
+	}
+}
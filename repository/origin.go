@@ -0,0 +1,26 @@
+package repository
+
+import (
+	"os"
+
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// Origin is the machine a backup was taken on, so backups of repositories
+// shared by several machines, and restores after losing one, can be told
+// apart.
+type Origin struct {
+	Host string `json:"host"`
+	// Version is the version of zfsbackrest that took the backup.
+	Version string `json:"version"`
+	// PoolGUID is the GUID of the pool of the dataset, or empty if it
+	// couldn't be read.
+	PoolGUID string `json:"pool_guid,omitempty"`
+}
+
+// NewOrigin returns the origin of a backup taken on this machine, of a
+// dataset in the pool with poolGUID.
+func NewOrigin(poolGUID string) *Origin {
+	host, _ := os.Hostname()
+	return &Origin{Host: host, Version: storage.ToolVersion, PoolGUID: poolGUID}
+}
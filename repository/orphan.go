@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sort"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/oklog/ulid/v2"
@@ -14,6 +16,10 @@ type OrphanReason string
 const (
 	OrphanReasonUncommitted     OrphanReason = "uncommitted"
 	OrphanReasonStartedDeletion OrphanReason = "started_deletion"
+	// OrphanReasonPartialUpload marks a backup whose upload was aborted by a
+	// forced exit. The next backup removes what was uploaded, and the
+	// snapshot.
+	OrphanReasonPartialUpload OrphanReason = "partial_upload"
 )
 
 type Orphans map[ulid.ULID]*Orphan
@@ -21,13 +27,41 @@ type Orphans map[ulid.ULID]*Orphan
 type Orphan struct {
 	Backup Backup       `json:"backup"`
 	Reason OrphanReason `json:"reason"`
+	// PartialUpload is set for OrphanReasonPartialUpload.
+	PartialUpload *PartialUpload `json:"partial_upload,omitempty"`
 }
 
-func (o *Orphan) SafeToDelete() bool {
-	return o.Reason == OrphanReasonUncommitted
+// PartialUpload describes an upload aborted midway.
+type PartialUpload struct {
+	// Bytes is roughly how much of the snapshot was uploaded.
+	Bytes     int64     `json:"bytes"`
+	AbortedAt time.Time `json:"aborted_at"`
+}
+
+// Pending reports whether o is an uncommitted orphan created less than minAge
+// before now. Its backup may still be uploading from another process.
+func (o *Orphan) Pending(minAge time.Duration, now time.Time) bool {
+	return o.Reason == OrphanReasonUncommitted && now.Sub(o.Backup.CreatedAt) < minAge
+}
+
+// SafeToDelete reports whether o can be cleaned up: its deletion was started,
+// or it is left from an upload that can't finish anymore, as it was aborted
+// or has been uncommitted for at least minAge.
+func (o *Orphan) SafeToDelete(minAge time.Duration, now time.Time) bool {
+	switch o.Reason {
+	case OrphanReasonUncommitted:
+		return !o.Pending(minAge, now)
+	case OrphanReasonPartialUpload, OrphanReasonStartedDeletion:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Store) AddOrphan(ctx context.Context, backup Backup, reason OrphanReason) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	orphan := &Orphan{
 		Backup: backup,
 		Reason: reason,
@@ -47,7 +81,46 @@ func (s *Store) AddOrphan(ctx context.Context, backup Backup, reason OrphanReaso
 	return nil
 }
 
+// MarkPartialUpload records that the upload of an uncommitted backup was
+// aborted midway.
+func (s *Store) MarkPartialUpload(id ulid.ULID, partial PartialUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orphan, ok := s.Orphans[id]
+	if !ok {
+		return fmt.Errorf("orphan %s not found", id)
+	}
+
+	if orphan.Reason != OrphanReasonUncommitted && orphan.Reason != OrphanReasonPartialUpload {
+		return fmt.Errorf("orphan %s is %s, not an upload", id, orphan.Reason)
+	}
+
+	orphan.Reason = OrphanReasonPartialUpload
+	orphan.PartialUpload = &partial
+	return nil
+}
+
+// PartialUploads returns the orphans whose upload was aborted midway.
+func (o Orphans) PartialUploads() []*Orphan {
+	var partial []*Orphan
+	for _, orphan := range o {
+		if orphan.Reason == OrphanReasonPartialUpload {
+			partial = append(partial, orphan)
+		}
+	}
+
+	sort.Slice(partial, func(i, j int) bool {
+		return partial[i].Backup.ID.Compare(partial[j].Backup.ID) < 0
+	})
+
+	return partial
+}
+
 func (s *Store) RemoveOrphan(ctx context.Context, backup Backup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, ok := s.Orphans[backup.ID]; !ok {
 		slog.Error("Orphan not found, skipping removal", "backup", backup.ID)
 		return fmt.Errorf("orphan not found")
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestMarkPartialUpload(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	uploading := Backup{ID: ulid.Make(), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now}
+	deleting := Backup{ID: ulid.Make(), Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now}
+
+	s := &Store{Version: 1, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}}
+	if err := s.AddOrphan(ctx, uploading, OrphanReasonUncommitted); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.AddOrphan(ctx, deleting, OrphanReasonStartedDeletion); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(s.Orphans.PartialUploads()) != 0 {
+		t.Fatal("expected no partial uploads before marking")
+	}
+
+	partial := PartialUpload{Bytes: 4096, AbortedAt: now}
+	if err := s.MarkPartialUpload(uploading.ID, partial); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only uploads can be aborted midway.
+	if err := s.MarkPartialUpload(deleting.ID, partial); err == nil {
+		t.Fatal("expected an error marking a deletion as a partial upload")
+	}
+	if err := s.MarkPartialUpload(ulid.Make(), partial); err == nil {
+		t.Fatal("expected an error marking an unknown backup")
+	}
+
+	got := s.Orphans.PartialUploads()
+	if len(got) != 1 || got[0].Backup.ID != uploading.ID {
+		t.Fatalf("unexpected partial uploads: %+v", got)
+	}
+	if got[0].Reason != OrphanReasonPartialUpload || got[0].PartialUpload.Bytes != 4096 || !got[0].SafeToDelete(24*time.Hour, now) {
+		t.Fatalf("unexpected partial upload orphan: %+v", got[0])
+	}
+}
+
+func TestOrphanMinAge(t *testing.T) {
+	now := time.Now()
+	minAge := 24 * time.Hour
+
+	orphan := func(reason OrphanReason, age time.Duration) *Orphan {
+		return &Orphan{Backup: Backup{ID: ulid.Make(), CreatedAt: now.Add(-age)}, Reason: reason}
+	}
+
+	tests := []struct {
+		name    string
+		orphan  *Orphan
+		pending bool
+		safe    bool
+	}{
+		{"young uncommitted", orphan(OrphanReasonUncommitted, time.Hour), true, false},
+		{"old uncommitted", orphan(OrphanReasonUncommitted, 48*time.Hour), false, true},
+		{"young partial upload", orphan(OrphanReasonPartialUpload, time.Hour), false, true},
+		{"young started deletion", orphan(OrphanReasonStartedDeletion, time.Hour), false, true},
+		{"unknown reason", orphan("unknown", 48*time.Hour), false, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.orphan.Pending(minAge, now); got != tt.pending {
+			t.Errorf("%s: expected pending %v, got %v", tt.name, tt.pending, got)
+		}
+		if got := tt.orphan.SafeToDelete(minAge, now); got != tt.safe {
+			t.Errorf("%s: expected safe to delete %v, got %v", tt.name, tt.safe, got)
+		}
+	}
+
+	if orphan(OrphanReasonUncommitted, time.Hour).Pending(0, now) {
+		t.Error("expected no orphan to be pending without a minimum age")
+	}
+}
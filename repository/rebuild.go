@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// OrphanReasonBrokenChain marks a backup found while rebuilding the store
+// whose parent chain is incomplete, so it can't be restored.
+const OrphanReasonBrokenChain OrphanReason = "broken_chain"
+
+// RebuildOpts controls how a store is rebuilt from manifest objects.
+type RebuildOpts struct {
+	// Hot is the storage manifests and hot snapshots live in.
+	Hot storage.StrongStore
+	// Cold is the storage cold snapshots live in. It may be nil.
+	Cold storage.StrongStore
+	// Routes are the storages of routed snapshots, by route name.
+	Routes map[string]storage.StrongStore
+	// Encryption must be able to decrypt manifests.
+	Encryption encryption.Encryption
+	// EncryptionConfig is recorded in the rebuilt store.
+	EncryptionConfig config.Encryption
+}
+
+// Rebuild reconstructs a store from the manifest objects next to every
+// snapshot. Backups with a manifest and a snapshot whose chain is complete
+// become backups, and everything else that has a snapshot becomes an orphan.
+// Manifests without a snapshot are skipped.
+func Rebuild(ctx context.Context, opts RebuildOpts) (*Store, error) {
+	slog.Info("Rebuilding store from manifests")
+
+	hotSnapshots, manifests, err := listBackupObjects(ctx, opts.Hot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hot storage: %w", err)
+	}
+
+	coldSnapshots := map[ulid.ULID]string{}
+	if opts.Cold != nil {
+		coldSnapshots, _, err = listBackupObjects(ctx, opts.Cold)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list cold storage: %w", err)
+		}
+	}
+
+	routedSnapshots := map[string]map[ulid.ULID]string{}
+	for name, s := range opts.Routes {
+		routedSnapshots[name], _, err = listBackupObjects(ctx, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the storage of route %s: %w", name, err)
+		}
+	}
+
+	store := &Store{
+		Version:    1,
+		CreatedAt:  time.Now(),
+		Backups:    NewBackups(),
+		Orphans:    Orphans{},
+		Encryption: opts.EncryptionConfig,
+	}
+
+	for id, dataset := range manifests {
+		manifest, err := ReadManifest(ctx, opts.Hot, opts.Encryption, dataset, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest of backup %s: %w", id, err)
+		}
+
+		// The snapshot's location wins over the tier recorded in the manifest,
+		// in case a tier migration was interrupted.
+		backup := manifest.Backup
+		route := snapshotRoute(routedSnapshots, id)
+		switch {
+		case hotSnapshots[id] != "":
+			backup.Tier = ""
+			backup.Route = ""
+		case coldSnapshots[id] != "":
+			backup.Tier = TierCold
+			backup.Route = ""
+		case route != "":
+			backup.Tier = ""
+			backup.Route = route
+		default:
+			slog.Warn("Skipping backup whose snapshot is missing", "dataset", dataset, "backup", id)
+			continue
+		}
+
+		store.Backups.Add(&backup)
+	}
+
+	// Snapshots without a manifest were never committed.
+	for _, snapshots := range []map[ulid.ULID]string{hotSnapshots, coldSnapshots} {
+		for id, dataset := range snapshots {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+
+			slog.Warn("Snapshot has no manifest. Adding it as an orphan.", "dataset", dataset, "backup", id)
+			store.Orphans[id] = &Orphan{
+				Backup: Backup{ID: id, Dataset: dataset, CreatedAt: ulid.Time(id.Time())},
+				Reason: OrphanReasonUncommitted,
+			}
+		}
+	}
+	for route, snapshots := range routedSnapshots {
+		for id, dataset := range snapshots {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+
+			slog.Warn("Snapshot has no manifest. Adding it as an orphan.", "route", route, "dataset", dataset, "backup", id)
+			store.Orphans[id] = &Orphan{
+				Backup: Backup{ID: id, Dataset: dataset, CreatedAt: ulid.Time(id.Time()), Route: route},
+				Reason: OrphanReasonUncommitted,
+			}
+		}
+	}
+
+	// Removing a backup can break the chains of its children, so repeat
+	// until every remaining backup validates.
+	for broken := true; broken; {
+		broken = false
+		for id, backup := range store.Backups.All() {
+			err := store.Backups.Validate(id)
+			if err == nil {
+				continue
+			}
+
+			slog.Warn("Backup chain is broken. Adding it as an orphan.", "dataset", backup.Dataset, "backup", id, "error", err)
+			store.Backups.remove(id)
+			store.Orphans[id] = &Orphan{Backup: *backup, Reason: OrphanReasonBrokenChain}
+			broken = true
+		}
+	}
+
+	datasets := map[string]bool{}
+	for _, backup := range store.Backups.All() {
+		datasets[backup.Dataset] = true
+	}
+	for dataset := range datasets {
+		store.ManagedDatasets = append(store.ManagedDatasets, dataset)
+	}
+	slices.Sort(store.ManagedDatasets)
+
+	if err := store.Validate(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Rebuilt store", "backups", store.Backups.Len(), "orphans", len(store.Orphans), "datasets", store.ManagedDatasets)
+
+	return store, nil
+}
+
+// snapshotRoute returns the name of the route whose storage has the snapshot
+// of backup id, or "" if none has.
+func snapshotRoute(routedSnapshots map[string]map[ulid.ULID]string, id ulid.ULID) string {
+	for _, route := range slices.Sorted(maps.Keys(routedSnapshots)) {
+		if routedSnapshots[route][id] != "" {
+			return route
+		}
+	}
+
+	return ""
+}
+
+// listBackupObjects returns the datasets of the snapshots and manifests in s,
+// by backup ID. Objects that aren't named after a backup are ignored.
+func listBackupObjects(ctx context.Context, s storage.StrongStore) (map[ulid.ULID]string, map[ulid.ULID]string, error) {
+	objects, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshots := map[ulid.ULID]string{}
+	manifests := map[ulid.ULID]string{}
+	for _, object := range objects {
+		name, isManifest := strings.CutSuffix(object.Snapshot, manifestSuffix)
+
+		id, err := ulid.ParseStrict(name)
+		if err != nil {
+			slog.Debug("Ignoring object not named after a backup", "dataset", object.Dataset, "object", object.Snapshot)
+			continue
+		}
+
+		target := snapshots
+		if isManifest {
+			target = manifests
+		}
+
+		if existing, ok := target[id]; ok && existing != object.Dataset {
+			return nil, nil, errors.Join(ErrBackupIDMismatch, fmt.Errorf("backup %s is stored under both %s and %s", id, existing, object.Dataset))
+		}
+		target[id] = object.Dataset
+	}
+
+	return snapshots, manifests, nil
+}
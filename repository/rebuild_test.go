@@ -0,0 +1,145 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	cold := storagetest.NewMemoryStore()
+
+	writeSnapshot := func(s storage.StrongStore, b *repository.Backup) {
+		t.Helper()
+		w, err := s.OpenSnapshotWriteStream(ctx, b.Dataset, b.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+	writeManifest := func(b *repository.Backup) {
+		t.Helper()
+		if err := repository.WriteManifest(ctx, hot, encryption.Passthrough{}, b); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+	}
+
+	b := repositorytest.NewStore("tank/a", "tank/b")
+
+	// A complete chain, with the full backup in the cold tier.
+	full := b.Full("tank/a", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	writeSnapshot(cold, full)
+	writeManifest(full)
+	for _, backup := range []*repository.Backup{diff, incr} {
+		writeSnapshot(hot, backup)
+		writeManifest(backup)
+	}
+
+	// A chain whose full backup was never committed.
+	uncommitted := b.Full("tank/b", 72*time.Hour)
+	brokenDiff := b.Diff(uncommitted, 48*time.Hour)
+	brokenIncr := b.Incr(brokenDiff, 24*time.Hour)
+	writeSnapshot(hot, uncommitted)
+	for _, backup := range []*repository.Backup{brokenDiff, brokenIncr} {
+		writeSnapshot(hot, backup)
+		writeManifest(backup)
+	}
+
+	// A manifest whose snapshot is gone.
+	deleted := b.Full("tank/b", time.Hour)
+	writeManifest(deleted)
+
+	store, err := repository.Rebuild(ctx, repository.RebuildOpts{
+		Hot:        hot,
+		Cold:       cold,
+		Encryption: encryption.Passthrough{},
+	})
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+
+	if store.Backups.Len() != 3 {
+		t.Fatalf("expected 3 backups, got %d", store.Backups.Len())
+	}
+	for _, backup := range []*repository.Backup{full, diff, incr} {
+		if _, ok := store.Backups.Get(backup.ID); !ok {
+			t.Fatalf("expected backup %s to be rebuilt", backup.ID)
+		}
+	}
+	if store.Backups.Find(full.ID).StorageTier() != repository.TierCold {
+		t.Fatalf("expected the full backup to be cold, got %q", store.Backups.Find(full.ID).StorageTier())
+	}
+	if store.Backups.Find(diff.ID).StorageTier() != repository.TierHot {
+		t.Fatalf("expected the diff backup to be hot, got %q", store.Backups.Find(diff.ID).StorageTier())
+	}
+
+	wantOrphans := map[string]repository.OrphanReason{
+		uncommitted.ID.String(): repository.OrphanReasonUncommitted,
+		brokenDiff.ID.String():  repository.OrphanReasonBrokenChain,
+		brokenIncr.ID.String():  repository.OrphanReasonBrokenChain,
+	}
+	if len(store.Orphans) != len(wantOrphans) {
+		t.Fatalf("expected %d orphans, got %d", len(wantOrphans), len(store.Orphans))
+	}
+	for id, orphan := range store.Orphans {
+		if want := wantOrphans[id.String()]; orphan.Reason != want {
+			t.Fatalf("expected orphan %s to have reason %q, got %q", id, want, orphan.Reason)
+		}
+	}
+
+	if len(store.ManagedDatasets) != 1 || store.ManagedDatasets[0] != "tank/a" {
+		t.Fatalf("expected managed datasets [tank/a], got %v", store.ManagedDatasets)
+	}
+}
+
+func TestRebuildRoutedSnapshots(t *testing.T) {
+	ctx := context.Background()
+	hot := storagetest.NewMemoryStore()
+	vms := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/vm/web")
+	routed := b.Full("tank/vm/web", 24*time.Hour)
+	routed.Route = "vm"
+	uncommitted := b.Full("tank/vm/web", 48*time.Hour)
+
+	for _, backup := range []*repository.Backup{routed, uncommitted} {
+		w, err := vms.OpenSnapshotWriteStream(ctx, backup.Dataset, backup.ID.String(), -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close write stream: %v", err)
+		}
+	}
+	if err := repository.WriteManifest(ctx, hot, encryption.Passthrough{}, routed); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+
+	store, err := repository.Rebuild(ctx, repository.RebuildOpts{
+		Hot:        hot,
+		Routes:     map[string]storage.StrongStore{"vm": vms},
+		Encryption: encryption.Passthrough{},
+	})
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+
+	if backup, ok := store.Backups.Get(routed.ID); !ok || backup.Route != "vm" {
+		t.Fatalf("expected the routed backup to be rebuilt with its route, got %+v", backup)
+	}
+	if orphan, ok := store.Orphans[uncommitted.ID]; !ok || orphan.Backup.Route != "vm" {
+		t.Fatalf("expected the routed snapshot without a manifest to be an orphan in its route, got %+v", orphan)
+	}
+}
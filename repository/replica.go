@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"sort"
+	"time"
+)
+
+// ReplicationStatus is the status of a backup's upload to a replica.
+type ReplicationStatus string
+
+const (
+	ReplicationUploaded ReplicationStatus = "uploaded"
+	ReplicationFailed   ReplicationStatus = "failed"
+)
+
+// Replication records the last upload of a backup's snapshot and manifest to
+// a replica.
+type Replication struct {
+	Status    ReplicationStatus `json:"status"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	// Error is why the upload failed.
+	Error string `json:"error,omitempty"`
+}
+
+// MarkReplicated records that the backup was uploaded to the replica.
+func (b *Backup) MarkReplicated(replica string, at time.Time) {
+	b.setReplication(replica, &Replication{Status: ReplicationUploaded, UpdatedAt: at})
+}
+
+// MarkReplicationFailed records a failed upload of the backup to the replica,
+// to be retried by `zfsbackrest replicate`.
+func (b *Backup) MarkReplicationFailed(replica string, at time.Time, reason string) {
+	b.setReplication(replica, &Replication{Status: ReplicationFailed, UpdatedAt: at, Error: reason})
+}
+
+func (b *Backup) setReplication(replica string, replication *Replication) {
+	if b.Replicas == nil {
+		b.Replicas = make(map[string]*Replication)
+	}
+	b.Replicas[replica] = replication
+}
+
+// Replicated returns whether the backup was uploaded to the replica.
+func (b *Backup) Replicated(replica string) bool {
+	replication, ok := b.Replicas[replica]
+	return ok && replication.Status == ReplicationUploaded
+}
+
+// PendingReplication returns the backups that aren't uploaded to the replica,
+// oldest first. These are the backups whose upload failed, and the ones taken
+// before the replica was added.
+func (bs Backups) PendingReplication(replica string) []*Backup {
+	var pending []*Backup
+	for _, b := range bs.All() {
+		if !b.Replicated(replica) {
+			pending = append(pending, b)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ID.Compare(pending[j].ID) < 0
+	})
+
+	return pending
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestPendingReplication(t *testing.T) {
+	now := time.Now()
+
+	replicated := ulid.Make()
+	failed := ulid.Make()
+	missing := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: replicated, Type: BackupTypeFull, CreatedAt: now},
+		&Backup{ID: failed, Type: BackupTypeFull, CreatedAt: now},
+		&Backup{ID: missing, Type: BackupTypeFull, CreatedAt: now},
+	)
+	bs.Find(replicated).MarkReplicated("offsite", now)
+	bs.Find(failed).MarkReplicationFailed("offsite", now, "connection reset")
+	// Uploads to other replicas don't count.
+	bs.Find(missing).MarkReplicated("nas", now)
+
+	pending := bs.PendingReplication("offsite")
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 backups pending, got %d", len(pending))
+	}
+	if pending[0].ID != failed || pending[1].ID != missing {
+		t.Fatalf("expected backups ordered by ID, got %s, %s", pending[0].ID, pending[1].ID)
+	}
+
+	if got := bs.Find(failed).Replicas["offsite"]; got.Status != ReplicationFailed || got.Error != "connection reset" {
+		t.Fatalf("expected the failure to be recorded, got %+v", got)
+	}
+
+	bs.Find(failed).MarkReplicated("offsite", now)
+	if got := bs.Find(failed).Replicas["offsite"]; got.Status != ReplicationUploaded || got.Error != "" {
+		t.Fatalf("expected a successful upload to clear the failure, got %+v", got)
+	}
+}
@@ -0,0 +1,268 @@
+package repository
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/oklog/ulid/v2"
+)
+
+// ReportKind is what a row of a report describes.
+type ReportKind string
+
+const (
+	ReportKindBackup  ReportKind = "backup"
+	ReportKindOrphan  ReportKind = "orphan"
+	ReportKindTrashed ReportKind = "trashed"
+)
+
+// Report lists every backup, orphan and trashed backup of a repository, with
+// its size and expiry, to feed into spreadsheets or keep as compliance
+// evidence.
+type Report struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Stats       *Stats       `json:"stats"`
+	Rows        []*ReportRow `json:"rows"`
+}
+
+// ReportRow is a backup, orphan or trashed backup in a report.
+type ReportRow struct {
+	Kind      ReportKind `json:"kind"`
+	Dataset   string     `json:"dataset"`
+	ID        ulid.ULID  `json:"id"`
+	Type      BackupType `json:"type"`
+	DependsOn *ulid.ULID `json:"depends_on,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Size      int64      `json:"size"`
+	// ObjectSize is 0 for backups taken before it was recorded.
+	ObjectSize int64 `json:"object_size,omitempty"`
+	// Storage is the tier the snapshot is stored in, or route:<name> for
+	// routed backups.
+	Storage string `json:"storage"`
+	Host    string `json:"host,omitempty"`
+	// ExpiresAt is when a backup expires by its age, or when a trashed
+	// backup is purged. KeptBy is what keeps a backup from expiring instead,
+	// and Expired whether the next cleanup deletes it. Orphans don't expire.
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	KeptBy       string            `json:"kept_by,omitempty"`
+	Expired      bool              `json:"expired"`
+	VerifiedAt   *time.Time        `json:"verified_at,omitempty"`
+	Damaged      bool              `json:"damaged"`
+	LockedUntil  *time.Time        `json:"locked_until,omitempty"`
+	OrphanReason OrphanReason      `json:"orphan_reason,omitempty"`
+	DeletedAt    *time.Time        `json:"deleted_at,omitempty"`
+	ImportedFrom string            `json:"imported_from,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Note         string            `json:"note,omitempty"`
+}
+
+// ReportOpts are the policies a report evaluates expiries by, and the time it
+// is generated at.
+type ReportOpts struct {
+	Expiry         *config.Expiry
+	TrashRetention time.Duration
+	Now            time.Time
+}
+
+// Report reports on the store. Backups of datasets that aren't managed
+// anymore never expire. With a GFS policy, backups expire at the next cleanup
+// or are kept by its rules, so they have no expiry time. Expired backups of
+// the last chain of a dataset are kept if opts.Expiry.KeepLastChain is set.
+func (s *Store) Report(opts ReportOpts) (*Report, error) {
+	keep, err := KeepTags(opts.Expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{GeneratedAt: opts.Now, Stats: s.Stats()}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var retentions map[ulid.ULID]*Retention
+	var keptByTags map[ulid.ULID]TagSelector
+	if opts.Expiry.GFS.Enabled() {
+		retentions = map[ulid.ULID]*Retention{}
+		for _, dataset := range s.ManagedDatasets {
+			evaluated, err := s.Backups.GFSRetention(dataset, &opts.Expiry.GFS, keep...)
+			if err != nil {
+				return nil, fmt.Errorf("dataset %s: %w", dataset, err)
+			}
+			for _, r := range evaluated {
+				retentions[r.Backup.ID] = r
+			}
+		}
+	} else {
+		keptByTags = s.Backups.KeptByTags(keep)
+	}
+
+	var lastChains map[ulid.ULID]bool
+	if opts.Expiry.KeepLastChain {
+		lastChains, err = s.Backups.KeptByLastChains(s.ManagedDatasets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for id, b := range s.Backups.All() {
+		row := newReportRow(ReportKindBackup, b)
+		switch {
+		case !slices.Contains(s.ManagedDatasets, b.Dataset):
+			row.KeptBy = "unmanaged dataset"
+		case retentions != nil:
+			r := retentions[id]
+			switch {
+			case (r == nil || !r.Kept()) && lastChains[id]:
+				row.KeptBy = "last chain"
+			case r == nil || !r.Kept():
+				row.Expired = true
+			case len(r.Rules) > 0:
+				row.KeptBy = strings.Join(r.Rules, ", ")
+			default:
+				row.KeptBy = "parent"
+			}
+		default:
+			if tag, ok := keptByTags[id]; ok {
+				row.KeptBy = "tag " + tag.String()
+				break
+			}
+
+			expiresAt, err := s.Backups.ExpiresAt(id, opts.Expiry)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the expiry of backup %s: %w", id, err)
+			}
+			row.ExpiresAt = &expiresAt
+			row.Expired = !expiresAt.After(opts.Now)
+			if row.Expired && lastChains[id] {
+				row.KeptBy = "last chain"
+				row.Expired = false
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	for _, o := range s.Orphans {
+		row := newReportRow(ReportKindOrphan, &o.Backup)
+		row.OrphanReason = o.Reason
+		report.Rows = append(report.Rows, row)
+	}
+
+	for _, t := range s.Trash {
+		row := newReportRow(ReportKindTrashed, &t.Backup)
+		deletedAt := t.DeletedAt
+		row.DeletedAt = &deletedAt
+		if opts.TrashRetention > 0 {
+			purgedAt := deletedAt.Add(opts.TrashRetention)
+			row.ExpiresAt = &purgedAt
+			row.Expired = !purgedAt.After(opts.Now)
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	slices.SortFunc(report.Rows, func(a, b *ReportRow) int {
+		return cmp.Or(
+			strings.Compare(a.Dataset, b.Dataset),
+			a.ID.Compare(b.ID),
+			strings.Compare(string(a.Kind), string(b.Kind)),
+		)
+	})
+
+	return report, nil
+}
+
+func newReportRow(kind ReportKind, b *Backup) *ReportRow {
+	row := &ReportRow{
+		Kind:        kind,
+		Dataset:     b.Dataset,
+		ID:          b.ID,
+		Type:        b.Type,
+		DependsOn:   b.DependsOn,
+		CreatedAt:   b.CreatedAt,
+		Size:        b.Size,
+		ObjectSize:  b.ObjectSize,
+		Storage:     string(b.StorageTier()),
+		VerifiedAt:  b.VerifiedAt,
+		Damaged:     b.Damage != nil,
+		LockedUntil: b.LockedUntil,
+		Tags:        b.Tags,
+		Note:        b.Note,
+	}
+	if b.Route != "" {
+		row.Storage = "route:" + b.Route
+	}
+	if b.Origin != nil {
+		row.Host = b.Origin.Host
+	}
+	if b.Imported != nil {
+		row.ImportedFrom = b.Imported.Snapshot
+	}
+
+	return row
+}
+
+// ReportColumns are the columns of a report written as CSV.
+var ReportColumns = []string{
+	"kind", "dataset", "id", "type", "depends_on", "created_at", "size", "object_size", "storage", "host",
+	"expires_at", "kept_by", "expired", "verified_at", "damaged", "locked_until", "orphan_reason", "deleted_at",
+	"imported_from", "tags", "note",
+}
+
+// WriteCSV writes the rows of the report as CSV, with a header of
+// ReportColumns. Times are in RFC 3339, and sizes in bytes.
+func (r *Report) WriteCSV(w io.Writer) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(ReportColumns); err != nil {
+		return err
+	}
+
+	for _, row := range r.Rows {
+		dependsOn := ""
+		if row.DependsOn != nil {
+			dependsOn = row.DependsOn.String()
+		}
+
+		err := cw.Write([]string{
+			string(row.Kind),
+			row.Dataset,
+			row.ID.String(),
+			string(row.Type),
+			dependsOn,
+			formatTime(&row.CreatedAt),
+			strconv.FormatInt(row.Size, 10),
+			strconv.FormatInt(row.ObjectSize, 10),
+			row.Storage,
+			row.Host,
+			formatTime(row.ExpiresAt),
+			row.KeptBy,
+			strconv.FormatBool(row.Expired),
+			formatTime(row.VerifiedAt),
+			strconv.FormatBool(row.Damaged),
+			formatTime(row.LockedUntil),
+			string(row.OrphanReason),
+			formatTime(row.DeletedAt),
+			row.ImportedFrom,
+			FormatTags(row.Tags),
+			row.Note,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,86 @@
+package repository_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+)
+
+func TestStoreReport(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	old := b.Full("tank/data", 40*24*time.Hour)
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	kept := b.Full("tank/data", 50*24*time.Hour)
+	kept.Tags = map[string]string{"reason": "audit"}
+	unmanaged := b.Full("tank/old", 400*24*time.Hour)
+	orphan := b.Full("tank/data", time.Hour)
+	b.Orphan(orphan, repository.OrphanReasonUncommitted)
+	trashed := b.Trash(b.Full("tank/data", 10*24*time.Hour), 24*time.Hour)
+	store := b.Build()
+
+	now := time.Now()
+	report, err := store.Report(repository.ReportOpts{
+		Expiry: &config.Expiry{
+			Full:     30 * 24 * time.Hour,
+			Diff:     24 * time.Hour,
+			Incr:     24 * time.Hour,
+			KeepTags: []string{"reason"},
+		},
+		TrashRetention: 7 * 24 * time.Hour,
+		Now:            now,
+	})
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if len(report.Rows) != 7 || report.Stats.Backups != 5 {
+		t.Fatalf("expected 7 rows and the stats of 5 backups, got %d and %d", len(report.Rows), report.Stats.Backups)
+	}
+
+	rows := map[string]*repository.ReportRow{}
+	for _, row := range report.Rows {
+		rows[row.ID.String()] = row
+	}
+
+	if row := rows[old.ID.String()]; !row.Expired || row.ExpiresAt == nil {
+		t.Errorf("expected the old full backup to be expired, got %+v", row)
+	}
+	if row := rows[full.ID.String()]; row.Expired || !row.ExpiresAt.Equal(full.CreatedAt.Add(30*24*time.Hour)) {
+		t.Errorf("expected the full backup to expire in 27 days, got %+v", row)
+	}
+	if row := rows[diff.ID.String()]; !row.Expired || *row.DependsOn != full.ID {
+		t.Errorf("expected the diff backup to be expired, got %+v", row)
+	}
+	if row := rows[kept.ID.String()]; row.Expired || row.ExpiresAt != nil || row.KeptBy != "tag reason" {
+		t.Errorf("expected the tagged backup to be kept, got %+v", row)
+	}
+	if row := rows[unmanaged.ID.String()]; row.Expired || row.KeptBy != "unmanaged dataset" {
+		t.Errorf("expected the backup of the unmanaged dataset to be kept, got %+v", row)
+	}
+	if row := rows[orphan.ID.String()]; row.Kind != repository.ReportKindOrphan || row.OrphanReason != repository.OrphanReasonUncommitted || row.Expired {
+		t.Errorf("expected the orphan, got %+v", row)
+	}
+	if row := rows[trashed.ID.String()]; row.Kind != repository.ReportKindTrashed || row.Expired || row.DeletedAt == nil {
+		t.Errorf("expected the trashed backup to be purged later, got %+v", row)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatalf("write CSV: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("read CSV: %v", err)
+	}
+	if len(records) != 8 || len(records[0]) != len(repository.ReportColumns) {
+		t.Fatalf("expected a header and 7 rows of %d columns, got %d rows", len(repository.ReportColumns), len(records))
+	}
+	if records[1][1] != "tank/data" || records[len(records)-1][1] != "tank/old" {
+		t.Errorf("expected the rows sorted by dataset, got %v", records)
+	}
+}
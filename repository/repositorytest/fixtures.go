@@ -0,0 +1,127 @@
+// Package repositorytest builds repository.Store fixtures for tests.
+package repositorytest
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// StoreBuilder builds a valid repository.Store. Backups are created with IDs
+// matching their creation time, like the ones zfsbackrest creates.
+//
+//	b := repositorytest.NewStore("tank/data")
+//	full := b.Full("tank/data", 48*time.Hour)
+//	diff := b.Diff(full, 24*time.Hour)
+//	b.Incr(diff, time.Hour)
+//	store := b.Build()
+type StoreBuilder struct {
+	store *repository.Store
+	now   time.Time
+}
+
+// NewStore starts a store managing the given datasets, created a year ago.
+func NewStore(datasets ...string) *StoreBuilder {
+	now := time.Now()
+
+	return &StoreBuilder{
+		now: now,
+		store: &repository.Store{
+			Version:         1,
+			CreatedAt:       now.Add(-365 * 24 * time.Hour),
+			Backups:         repository.NewBackups(),
+			Orphans:         repository.Orphans{},
+			ManagedDatasets: datasets,
+		},
+	}
+}
+
+// WithEncryption sets the store's encryption config.
+func (b *StoreBuilder) WithEncryption(encryption config.Encryption) *StoreBuilder {
+	b.store.Encryption = encryption
+	return b
+}
+
+// Full adds a full backup of dataset created age ago.
+func (b *StoreBuilder) Full(dataset string, age time.Duration) *repository.Backup {
+	return b.add(repository.BackupTypeFull, dataset, nil, age)
+}
+
+// Diff adds a diff backup on top of the full backup parent, created age ago.
+func (b *StoreBuilder) Diff(parent *repository.Backup, age time.Duration) *repository.Backup {
+	return b.add(repository.BackupTypeDiff, parent.Dataset, &parent.ID, age)
+}
+
+// Incr adds an incremental backup on top of the diff backup parent, created
+// age ago.
+func (b *StoreBuilder) Incr(parent *repository.Backup, age time.Duration) *repository.Backup {
+	return b.add(repository.BackupTypeIncr, parent.Dataset, &parent.ID, age)
+}
+
+// Orphan moves backup to the orphans with the given reason.
+func (b *StoreBuilder) Orphan(backup *repository.Backup, reason repository.OrphanReason) *StoreBuilder {
+	if err := b.store.Backups.RemoveBackup(backup.ID); err != nil {
+		panic(err)
+	}
+	b.store.Orphans[backup.ID] = &repository.Orphan{Backup: *backup, Reason: reason}
+	return b
+}
+
+// Trash moves backup to the trash, deleted age ago.
+func (b *StoreBuilder) Trash(backup *repository.Backup, age time.Duration) *repository.Backup {
+	if err := b.store.Backups.RemoveBackup(backup.ID); err != nil {
+		panic(err)
+	}
+	if b.store.Trash == nil {
+		b.store.Trash = repository.Trash{}
+	}
+	b.store.Trash[backup.ID] = &repository.TrashedBackup{Backup: *backup, DeletedAt: b.now.Add(-age)}
+	return backup
+}
+
+func (b *StoreBuilder) add(typ repository.BackupType, dataset string, parent *ulid.ULID, age time.Duration) *repository.Backup {
+	createdAt := b.now.Add(-age)
+
+	backup := &repository.Backup{
+		ID:        ulid.MustNew(ulid.Timestamp(createdAt), ulid.DefaultEntropy()),
+		Type:      typ,
+		CreatedAt: createdAt,
+		DependsOn: parent,
+		Dataset:   dataset,
+		Size:      1024,
+	}
+	b.store.Backups.Add(backup)
+
+	return backup
+}
+
+// Build returns the store. It panics if the store is invalid, which is a bug
+// in the test.
+func (b *StoreBuilder) Build() *repository.Store {
+	if err := b.store.Validate(); err != nil {
+		panic(err)
+	}
+
+	return b.store
+}
+
+// Save builds the store and saves it to s.
+func (b *StoreBuilder) Save(ctx context.Context, s storage.StrongStore) (*repository.Store, error) {
+	store := b.Build()
+	return store, store.Save(ctx, s)
+}
+
+// JSON builds the store and returns its serialized form.
+func (b *StoreBuilder) JSON() []byte {
+	content, err := json.Marshal(b.Build())
+	if err != nil {
+		panic(err)
+	}
+
+	return content
+}
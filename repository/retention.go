@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/oklog/ulid/v2"
+)
+
+var ErrNegativeGFSCount = errors.New("GFS counts can't be negative")
+
+// GFS rules, from the shortest period to the longest.
+const (
+	GFSDaily   = "daily"
+	GFSWeekly  = "weekly"
+	GFSMonthly = "monthly"
+	GFSYearly  = "yearly"
+)
+
+// Retention is whether a GFS policy keeps a backup, and why.
+type Retention struct {
+	Backup *Backup `json:"backup"`
+	// Rules are the rules that keep the backup, with the period it is the
+	// latest backup of, like "weekly 2025-W07".
+	Rules []string `json:"rules,omitempty"`
+	// ParentOf are the kept backups that depend on this one. It is kept for
+	// them, even if no rule keeps it.
+	ParentOf []ulid.ULID `json:"parent_of,omitempty"`
+}
+
+// Kept reports whether the backup is kept.
+func (r *Retention) Kept() bool {
+	return len(r.Rules) > 0 || len(r.ParentOf) > 0
+}
+
+type gfsRule struct {
+	name   string
+	count  int
+	period func(b *Backup) string
+}
+
+func gfsRules(gfs *config.GFS) []gfsRule {
+	return []gfsRule{
+		{GFSDaily, gfs.Daily, func(b *Backup) string { return b.CreatedAt.Local().Format("2006-01-02") }},
+		{GFSWeekly, gfs.Weekly, func(b *Backup) string {
+			year, week := b.CreatedAt.Local().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{GFSMonthly, gfs.Monthly, func(b *Backup) string { return b.CreatedAt.Local().Format("2006-01") }},
+		{GFSYearly, gfs.Yearly, func(b *Backup) string { return b.CreatedAt.Local().Format("2006") }},
+	}
+}
+
+// GFSRetention evaluates the GFS policy for the backups of dataset, and
+// returns whether each is kept, newest first. Every backup is a restore point,
+// whatever its type; a kept diff or incr keeps the backups it depends on.
+// Backups with any of the keep tags are kept too, by a "tag" rule.
+func (bs Backups) GFSRetention(dataset string, gfs *config.GFS, keep ...TagSelector) ([]*Retention, error) {
+	slog.Debug("Evaluating GFS retention", "dataset", dataset, "gfs", gfs)
+
+	if gfs.Daily < 0 || gfs.Weekly < 0 || gfs.Monthly < 0 || gfs.Yearly < 0 {
+		return nil, &errclass.ConfigError{Key: "repository.expiry.gfs", Err: ErrNegativeGFSCount}
+	}
+
+	var retentions []*Retention
+	byID := map[ulid.ULID]*Retention{}
+	for _, b := range bs.All() {
+		if b.Dataset != dataset {
+			continue
+		}
+
+		if err := bs.Validate(b.ID); err != nil {
+			return nil, err
+		}
+
+		r := &Retention{Backup: b}
+		retentions = append(retentions, r)
+		byID[b.ID] = r
+	}
+
+	sort.Slice(retentions, func(i, j int) bool {
+		return retentions[i].Backup.ID.Compare(retentions[j].Backup.ID) > 0
+	})
+
+	// Going from the newest backup, the first of each period is its latest.
+	for _, rule := range gfsRules(gfs) {
+		kept := 0
+		last := ""
+		for _, r := range retentions {
+			if kept == rule.count {
+				break
+			}
+
+			period := rule.period(r.Backup)
+			if period == last {
+				continue
+			}
+
+			last = period
+			kept++
+			r.Rules = append(r.Rules, rule.name+" "+period)
+		}
+	}
+
+	for _, r := range retentions {
+		if tag, ok := r.Backup.keptTag(keep); ok {
+			r.Rules = append(r.Rules, "tag "+tag.String())
+		}
+	}
+
+	for _, r := range retentions {
+		if len(r.Rules) == 0 {
+			continue
+		}
+
+		for b := r.Backup; b.DependsOn != nil; b = bs.Find(*b.DependsOn) {
+			parent := byID[*b.DependsOn]
+			parent.ParentOf = append(parent.ParentOf, r.Backup.ID)
+		}
+	}
+
+	return retentions, nil
+}
+
+// expiredByGFS returns the backups of dataset the GFS policy doesn't keep.
+func (bs Backups) expiredByGFS(dataset string, gfs *config.GFS, keep []TagSelector) (Backups, error) {
+	retentions, err := bs.GFSRetention(dataset, gfs, keep...)
+	if err != nil {
+		return Backups{}, err
+	}
+
+	expired := NewBackups()
+	for _, r := range retentions {
+		if !r.Kept() {
+			expired.Add(r.Backup)
+		}
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestGFSRetention(t *testing.T) {
+	bs := NewBackups()
+	add := func(typ BackupType, dataset string, parent *Backup, createdAt time.Time) *Backup {
+		b := &Backup{
+			ID:        ulid.MustNew(ulid.Timestamp(createdAt), ulid.DefaultEntropy()),
+			Type:      typ,
+			CreatedAt: createdAt,
+			Dataset:   dataset,
+		}
+		if parent != nil {
+			b.DependsOn = &parent.ID
+		}
+		bs.Add(b)
+		return b
+	}
+	at := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2025, month, day, hour, 0, 0, 0, time.Local)
+	}
+
+	// Fulls on the first of each month, a diff every day, and incrs in
+	// between. 2025-03-03 is a Monday.
+	janFull := add(BackupTypeFull, "tank/data", nil, at(time.January, 1, 1))
+	febFull := add(BackupTypeFull, "tank/data", nil, at(time.February, 1, 1))
+	febDiff := add(BackupTypeDiff, "tank/data", febFull, at(time.February, 20, 1))
+	marFull := add(BackupTypeFull, "tank/data", nil, at(time.March, 1, 1))
+	sunDiff := add(BackupTypeDiff, "tank/data", marFull, at(time.March, 2, 1))
+	monDiff := add(BackupTypeDiff, "tank/data", marFull, at(time.March, 3, 1))
+	monIncr := add(BackupTypeIncr, "tank/data", monDiff, at(time.March, 3, 12))
+	tueDiff := add(BackupTypeDiff, "tank/data", marFull, at(time.March, 4, 1))
+	tueIncr := add(BackupTypeIncr, "tank/data", tueDiff, at(time.March, 4, 12))
+	other := add(BackupTypeFull, "tank/other", nil, at(time.January, 15, 1))
+
+	gfs := &config.GFS{Daily: 2, Weekly: 2, Monthly: 2}
+	retentions, err := bs.GFSRetention("tank/data", gfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[ulid.ULID]*Retention{}
+	for _, r := range retentions {
+		got[r.Backup.ID] = r
+	}
+	if len(got) != 9 {
+		t.Fatalf("expected the 9 backups of the dataset, got %d", len(got))
+	}
+
+	wantRules := map[*Backup][]string{
+		tueIncr: {"daily 2025-03-04", "weekly 2025-W10", "monthly 2025-03"},
+		monIncr: {"daily 2025-03-03"},
+		sunDiff: {"weekly 2025-W09"},
+		febDiff: {"monthly 2025-02"},
+	}
+	for _, b := range []*Backup{janFull, febFull, febDiff, marFull, sunDiff, monDiff, monIncr, tueDiff, tueIncr} {
+		if !slices.Equal(got[b.ID].Rules, wantRules[b]) {
+			t.Errorf("backup of %s: got rules %v, want %v", b.CreatedAt, got[b.ID].Rules, wantRules[b])
+		}
+	}
+
+	// Parents of kept backups are kept for them.
+	if !slices.Contains(got[marFull.ID].ParentOf, tueIncr.ID) || !slices.Contains(got[tueDiff.ID].ParentOf, tueIncr.ID) {
+		t.Fatalf("expected the chain of a kept incr to be kept, got %+v, %+v", got[marFull.ID], got[tueDiff.ID])
+	}
+	if !got[febFull.ID].Kept() || !got[monDiff.ID].Kept() {
+		t.Fatal("expected the parents of kept backups to be kept")
+	}
+
+	expired, err := bs.ExpiredBackupsForDataset("tank/data", &config.Expiry{GFS: *gfs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Len() != 1 || expired.Find(janFull.ID) == nil {
+		t.Fatalf("expected only the January full to expire, got %v", expired)
+	}
+
+	// Each dataset is evaluated on its own.
+	otherRetentions, err := bs.GFSRetention("tank/other", &config.GFS{Yearly: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(otherRetentions) != 1 || otherRetentions[0].Backup != other || !slices.Equal(otherRetentions[0].Rules, []string{"yearly 2025"}) {
+		t.Fatalf("expected the other dataset's only backup to be kept, got %+v", otherRetentions)
+	}
+
+	if _, err := bs.GFSRetention("tank/data", &config.GFS{Daily: -1}); !errors.Is(err, ErrNegativeGFSCount) {
+		t.Fatalf("expected ErrNegativeGFSCount, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SendStream is how the snapshot of a backup was sent with `zfs send`, so
+// restore can tell whether it can receive it, and verification can check the
+// stream carries the snapshots recorded. Backups taken before it was recorded
+// were sent with -LPpc, and no other flag.
+type SendStream struct {
+	// Raw is set for streams sent with -w, whose blocks are as they are on
+	// disk. Encrypted datasets stay encrypted with their own key.
+	Raw bool `json:"raw,omitempty"`
+	// Compressed is set for streams sent with -c, whose blocks stay
+	// compressed as they are on disk.
+	Compressed  bool `json:"compressed,omitempty"`
+	LargeBlocks bool `json:"large_blocks,omitempty"` // -L
+	Properties  bool `json:"properties,omitempty"`   // -p
+	// Recursive is set for streams of a dataset and its descendants, sent
+	// with -R.
+	Recursive bool `json:"recursive,omitempty"`
+	// Resumable is set for streams resumed from a receive token, sent with
+	// -t.
+	Resumable bool `json:"resumable,omitempty"`
+	// FromGUID is the ZFS GUID of the snapshot the stream is incremental
+	// from, or empty for a full stream.
+	FromGUID string `json:"from_guid,omitempty"`
+}
+
+// IsRaw reports whether the stream was sent raw. It is false for backups
+// taken before the stream was recorded.
+func (s *SendStream) IsRaw() bool {
+	return s != nil && s.Raw
+}
+
+var (
+	ErrStreamNotReceivable = errors.New("backup stream can't be received by restore")
+	ErrStreamRawMismatch   = errors.New("backup stream and its parent's are not both raw, or both not raw")
+	ErrStreamGUIDMismatch  = errors.New("snapshot stream does not carry the snapshots of the backup")
+)
+
+// CheckReceivable checks restore can receive the stream of the backup on top
+// of the one of parent, which is nil for a full backup. zfs recv can't apply
+// a raw incremental stream on a snapshot received from a non-raw one, or the
+// other way around.
+func (b *Backup) CheckReceivable(parent *Backup) error {
+	if b.Send != nil && b.Send.Recursive {
+		return fmt.Errorf("%w: it was sent with -R", ErrStreamNotReceivable)
+	}
+	if b.Send != nil && b.Send.Resumable {
+		return fmt.Errorf("%w: it was resumed from a receive token", ErrStreamNotReceivable)
+	}
+	if parent != nil && b.Send.IsRaw() != parent.Send.IsRaw() {
+		return fmt.Errorf("%w: backup %s raw %t, parent %s raw %t", ErrStreamRawMismatch, b.ID, b.Send.IsRaw(), parent.ID, parent.Send.IsRaw())
+	}
+
+	return nil
+}
+
+// SourceGUID returns the GUID of the snapshot the stream of b is incremental
+// from: the one recorded with the stream, or else the parent's. It is empty
+// for full backups, and if neither was recorded.
+func (bs Backups) SourceGUID(b *Backup) string {
+	if b.Send != nil && b.Send.FromGUID != "" {
+		return b.Send.FromGUID
+	}
+	if b.DependsOn == nil {
+		return ""
+	}
+	if parent, ok := bs.Get(*b.DependsOn); ok {
+		return parent.GUID
+	}
+
+	return ""
+}
+
+// CheckStreamGUIDs checks the GUIDs read from the header of the stream of b
+// against the recorded ones. toGUID is the snapshot the stream starts with,
+// and fromGUID the one it is incremental from, or empty for a full stream.
+// Streams with intermediates start with the first intermediate snapshot, so
+// only fromGUID is checked for them. GUIDs that weren't recorded aren't
+// checked.
+func (bs Backups) CheckStreamGUIDs(b *Backup, toGUID, fromGUID string) error {
+	if len(b.Intermediates) == 0 && b.GUID != "" && toGUID != b.GUID {
+		return fmt.Errorf("%w: stream carries snapshot %s, expected %s", ErrStreamGUIDMismatch, toGUID, b.GUID)
+	}
+
+	if b.DependsOn == nil {
+		if fromGUID != "" {
+			return fmt.Errorf("%w: full backup has an incremental stream from %s", ErrStreamGUIDMismatch, fromGUID)
+		}
+		return nil
+	}
+
+	if expected := bs.SourceGUID(b); expected != "" && fromGUID != expected {
+		return fmt.Errorf("%w: stream is incremental from %q, expected %s", ErrStreamGUIDMismatch, fromGUID, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package repository_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestCheckReceivable(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	legacy := b.Full("tank/data", 72*time.Hour)
+	full := b.Full("tank/data", 48*time.Hour)
+	full.Send = &repository.SendStream{Raw: true}
+	diff := b.Diff(full, 24*time.Hour)
+	diff.Send = &repository.SendStream{Raw: true}
+	legacyDiff := b.Diff(full, time.Hour)
+
+	if err := legacy.CheckReceivable(nil); err != nil {
+		t.Errorf("expected a backup without a recorded stream to be receivable, got %v", err)
+	}
+	if err := diff.CheckReceivable(full); err != nil {
+		t.Errorf("expected a raw diff on a raw full to be receivable, got %v", err)
+	}
+	if err := legacyDiff.CheckReceivable(full); !errors.Is(err, repository.ErrStreamRawMismatch) {
+		t.Errorf("expected a non-raw diff on a raw full to be refused, got %v", err)
+	}
+
+	full.Send.Recursive = true
+	if err := full.CheckReceivable(nil); !errors.Is(err, repository.ErrStreamNotReceivable) {
+		t.Errorf("expected a recursive stream to be refused, got %v", err)
+	}
+}
+
+func TestCheckStreamGUIDs(t *testing.T) {
+	b := repositorytest.NewStore("tank/data")
+	full := b.Full("tank/data", 48*time.Hour)
+	full.GUID = "1"
+	diff := b.Diff(full, 24*time.Hour)
+	diff.GUID = "3"
+	diff.Intermediates = []ulid.ULID{b.Full("tank/data", 36*time.Hour).ID}
+	backups := b.Build().Backups
+
+	if err := backups.CheckStreamGUIDs(full, "1", ""); err != nil {
+		t.Errorf("expected the full stream to match, got %v", err)
+	}
+	if err := backups.CheckStreamGUIDs(full, "2", ""); !errors.Is(err, repository.ErrStreamGUIDMismatch) {
+		t.Errorf("expected another snapshot to be refused, got %v", err)
+	}
+	if err := backups.CheckStreamGUIDs(full, "1", "9"); !errors.Is(err, repository.ErrStreamGUIDMismatch) {
+		t.Errorf("expected an incremental stream of a full backup to be refused, got %v", err)
+	}
+
+	// Without a recorded source, the parent's GUID is expected. The stream
+	// starts with the intermediate snapshot.
+	if err := backups.CheckStreamGUIDs(diff, "2", "1"); err != nil {
+		t.Errorf("expected the diff stream to match, got %v", err)
+	}
+
+	diff.Send = &repository.SendStream{FromGUID: "5"}
+	if err := backups.CheckStreamGUIDs(diff, "2", "1"); !errors.Is(err, repository.ErrStreamGUIDMismatch) {
+		t.Errorf("expected the recorded source to be checked, got %v", err)
+	}
+}
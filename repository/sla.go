@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+)
+
+// MissedBackup is a dataset that went without a backup of a type for longer
+// than its SLA.
+type MissedBackup struct {
+	Dataset string        `json:"dataset"`
+	Type    BackupType    `json:"type"`
+	MaxAge  time.Duration `json:"max_age"`
+	// Last is the latest backup that counts towards the SLA, or nil if there
+	// is none.
+	Last *Backup `json:"last,omitempty"`
+	// Overdue is how long past the SLA the dataset is. It is measured from
+	// when the dataset became managed if it was never backed up.
+	Overdue time.Duration `json:"overdue"`
+}
+
+// SLAMaxAge returns the SLA of backups of type typ, or 0 if it isn't checked.
+func SLAMaxAge(sla *config.SLA, typ BackupType) time.Duration {
+	switch typ {
+	case BackupTypeFull:
+		return sla.Full
+	case BackupTypeDiff:
+		return sla.Diff
+	case BackupTypeIncr:
+		return sla.Incr
+	default:
+		return 0
+	}
+}
+
+// covers reports whether a backup of type typ counts towards the SLA of
+// backups of type sla.
+func covers(typ BackupType, sla BackupType) bool {
+	switch sla {
+	case BackupTypeFull:
+		return typ == BackupTypeFull
+	case BackupTypeDiff:
+		return typ == BackupTypeFull || typ == BackupTypeDiff
+	default:
+		return true
+	}
+}
+
+// LastCovering returns the latest backup of a dataset that counts towards the
+// SLA of backups of type typ.
+func (bs Backups) LastCovering(dataset string, typ BackupType) *Backup {
+	var backup *Backup
+	for _, b := range bs.All() {
+		if b.Dataset == dataset && covers(b.Type, typ) {
+			if backup == nil || backup.CreatedAt.Before(b.CreatedAt) {
+				backup = b
+			}
+		}
+	}
+
+	return backup
+}
+
+// MissedBackups returns the datasets that are out of their SLA at now.
+func (s *Store) MissedBackups(sla *config.SLA, now time.Time) []*MissedBackup {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var missed []*MissedBackup
+	for _, dataset := range s.ManagedDatasets {
+		for _, typ := range []BackupType{BackupTypeFull, BackupTypeDiff, BackupTypeIncr} {
+			maxAge := SLAMaxAge(sla, typ)
+			if maxAge <= 0 {
+				continue
+			}
+
+			last := s.Backups.LastCovering(dataset, typ)
+			since := s.managedSince(dataset)
+			if last != nil {
+				since = last.CreatedAt
+			}
+
+			if overdue := now.Sub(since) - maxAge; overdue > 0 {
+				missed = append(missed, &MissedBackup{
+					Dataset: dataset,
+					Type:    typ,
+					MaxAge:  maxAge,
+					Last:    last,
+					Overdue: overdue,
+				})
+			}
+		}
+	}
+
+	return missed
+}
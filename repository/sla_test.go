@@ -0,0 +1,74 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+)
+
+func TestMissedBackups(t *testing.T) {
+	day := 24 * time.Hour
+
+	b := repositorytest.NewStore("tank/data", "tank/home", "tank/new")
+	b.Full("tank/data", 3*day)
+	// A full counts as the latest diff and incr too.
+	b.Full("tank/home", 10*time.Hour)
+	store := b.Build()
+	store.CreatedAt = time.Now().Add(-30 * day)
+
+	sla := &config.SLA{Full: 7 * day, Diff: 2 * day, Incr: 12 * time.Hour}
+	missed := store.MissedBackups(sla, time.Now())
+
+	got := map[string]bool{}
+	for _, m := range missed {
+		got[m.Dataset+" "+string(m.Type)] = true
+	}
+
+	want := []string{"tank/data diff", "tank/data incr", "tank/new full", "tank/new diff", "tank/new incr"}
+	if len(missed) != len(want) {
+		t.Fatalf("missed %v, want %v", got, want)
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Fatalf("missed %v, want %v", got, want)
+		}
+	}
+
+	for _, m := range missed {
+		if m.Dataset == "tank/new" && (m.Last != nil || m.Overdue < 20*day) {
+			t.Fatalf("a dataset never backed up should be overdue since the repository was created, got %+v", m)
+		}
+	}
+}
+
+func TestMissedBackupsNewlyManaged(t *testing.T) {
+	day := 24 * time.Hour
+
+	store := repositorytest.NewStore("tank/data").Build()
+	store.CreatedAt = time.Now().Add(-30 * day)
+	store.SetManagedDatasets([]string{"tank/data", "tank/new"}, time.Now().Add(-time.Hour))
+
+	sla := &config.SLA{Full: 7 * day}
+	missed := store.MissedBackups(sla, time.Now())
+	if len(missed) != 1 || missed[0].Dataset != "tank/data" {
+		t.Fatalf("expected only the dataset managed since the repository was created to be missed, got %+v", missed)
+	}
+
+	// A week after it became managed, it is overdue from then.
+	missed = store.MissedBackups(sla, time.Now().Add(7*day))
+	for _, m := range missed {
+		if m.Dataset == "tank/new" && m.Overdue > 2*time.Hour {
+			t.Fatalf("expected the new dataset to be overdue since it became managed, got %+v", m)
+		}
+	}
+	if len(missed) != 2 {
+		t.Fatalf("expected both datasets to be missed, got %+v", missed)
+	}
+
+	store.Unmanage("tank/new")
+	if _, ok := store.ManagedSince["tank/new"]; ok {
+		t.Fatal("expected unmanaging the dataset to forget when it became managed")
+	}
+}
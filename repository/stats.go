@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"slices"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Stats are statistics of the backups in a store, derived once for whoever
+// shows or exports them.
+type Stats struct {
+	Backups int `json:"backups"`
+	Orphans int `json:"orphans"`
+	Trashed int `json:"trashed"`
+	// Size is the total size of the send streams of the backups, and
+	// ObjectSize of their snapshot objects as they are stored, after
+	// compression and encryption. ObjectSize only counts the backups it was
+	// recorded for, which UnsizedObjects counts the others of.
+	Size           int64 `json:"size"`
+	ObjectSize     int64 `json:"object_size"`
+	UnsizedObjects int   `json:"unsized_objects,omitempty"`
+	// Oldest and Newest are the oldest and newest backups, or nil if there
+	// are none.
+	Oldest *Backup `json:"oldest,omitempty"`
+	Newest *Backup `json:"newest,omitempty"`
+	// Datasets are the statistics of each managed dataset, and of each
+	// dataset that has backups or orphans, by dataset.
+	Datasets map[string]*DatasetStats `json:"datasets"`
+}
+
+// DatasetStats are statistics of the backups of a dataset.
+type DatasetStats struct {
+	Managed        bool  `json:"managed"`
+	Full           int   `json:"full"`
+	Diff           int   `json:"diff"`
+	Incr           int   `json:"incr"`
+	Orphans        int   `json:"orphans"`
+	Size           int64 `json:"size"`
+	ObjectSize     int64 `json:"object_size"`
+	UnsizedObjects int   `json:"unsized_objects,omitempty"`
+	// ChainDepth is the number of backups restoring the deepest backup
+	// takes, the backup included.
+	ChainDepth int     `json:"chain_depth"`
+	Oldest     *Backup `json:"oldest,omitempty"`
+	Newest     *Backup `json:"newest,omitempty"`
+}
+
+// Backups returns the number of backups of the dataset.
+func (d *DatasetStats) Backups() int {
+	return d.Full + d.Diff + d.Incr
+}
+
+// Stats returns the statistics of the store.
+func (s *Store) Stats() *Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := &Stats{
+		Backups:  s.Backups.Len(),
+		Orphans:  len(s.Orphans),
+		Trashed:  len(s.Trash),
+		Datasets: make(map[string]*DatasetStats),
+	}
+
+	dataset := func(name string) *DatasetStats {
+		d, ok := stats.Datasets[name]
+		if !ok {
+			d = &DatasetStats{Managed: slices.Contains(s.ManagedDatasets, name)}
+			stats.Datasets[name] = d
+		}
+		return d
+	}
+	for _, name := range s.ManagedDatasets {
+		dataset(name)
+	}
+
+	for _, b := range s.Backups.All() {
+		d := dataset(b.Dataset)
+		switch b.Type {
+		case BackupTypeFull:
+			d.Full++
+		case BackupTypeDiff:
+			d.Diff++
+		case BackupTypeIncr:
+			d.Incr++
+		}
+
+		d.Size += b.Size
+		d.ObjectSize += b.ObjectSize
+		if b.ObjectSize == 0 {
+			d.UnsizedObjects++
+		}
+		d.ChainDepth = max(d.ChainDepth, s.Backups.ChainDepth(b.ID))
+		d.Oldest, d.Newest = older(d.Oldest, b), newer(d.Newest, b)
+
+		stats.Size += b.Size
+		stats.ObjectSize += b.ObjectSize
+		if b.ObjectSize == 0 {
+			stats.UnsizedObjects++
+		}
+		stats.Oldest, stats.Newest = older(stats.Oldest, b), newer(stats.Newest, b)
+	}
+
+	for _, o := range s.Orphans {
+		dataset(o.Backup.Dataset).Orphans++
+	}
+
+	return stats
+}
+
+// ChainDepth returns the number of backups restoring the backup with id
+// takes, the backup included. Missing parents end the chain, and so does
+// coming back to a backup in it, in a corrupted store.
+func (bs Backups) ChainDepth(id ulid.ULID) int {
+	depth := 0
+	visited := map[ulid.ULID]bool{}
+	for b, ok := bs.Get(id); ok && b != nil && !visited[b.ID]; {
+		visited[b.ID] = true
+		depth++
+		if b.DependsOn == nil {
+			break
+		}
+		b, ok = bs.Get(*b.DependsOn)
+	}
+
+	return depth
+}
+
+func older(oldest *Backup, b *Backup) *Backup {
+	if oldest == nil || b.CreatedAt.Before(oldest.CreatedAt) {
+		return b
+	}
+	return oldest
+}
+
+func newer(newest *Backup, b *Backup) *Backup {
+	if newest == nil || newest.CreatedAt.Before(b.CreatedAt) {
+		return b
+	}
+	return newest
+}
@@ -0,0 +1,45 @@
+package repository_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+)
+
+func TestStoreStats(t *testing.T) {
+	b := repositorytest.NewStore("tank/data", "tank/empty")
+	full := b.Full("tank/data", 72*time.Hour)
+	diff := b.Diff(full, 48*time.Hour)
+	incr := b.Incr(diff, 24*time.Hour)
+	other := b.Full("tank/other", time.Hour)
+	b.Orphan(b.Full("tank/data", 96*time.Hour), repository.OrphanReasonBrokenChain)
+	incr.ObjectSize = 512
+
+	stats := b.Build().Stats()
+	if stats.Backups != 4 || stats.Orphans != 1 {
+		t.Fatalf("expected 4 backups and 1 orphan, got %d and %d", stats.Backups, stats.Orphans)
+	}
+	if stats.Size != 4*1024 || stats.ObjectSize != 512 || stats.UnsizedObjects != 3 {
+		t.Fatalf("expected the sizes of all backups, got %d, %d and %d unsized", stats.Size, stats.ObjectSize, stats.UnsizedObjects)
+	}
+	if stats.Oldest != full || stats.Newest != other {
+		t.Fatalf("expected the oldest and newest backups, got %v and %v", stats.Oldest, stats.Newest)
+	}
+
+	data := stats.Datasets["tank/data"]
+	if !data.Managed || data.Backups() != 3 || data.Full != 1 || data.Diff != 1 || data.Incr != 1 {
+		t.Fatalf("expected a managed dataset with one backup of each type, got %+v", data)
+	}
+	if data.ChainDepth != 3 || data.Orphans != 1 || data.Newest != incr {
+		t.Fatalf("expected a chain of 3, an orphan and the incremental as newest, got %+v", data)
+	}
+
+	if empty := stats.Datasets["tank/empty"]; !empty.Managed || empty.Backups() != 0 || empty.Newest != nil {
+		t.Fatalf("expected the managed dataset without backups, got %+v", empty)
+	}
+	if unmanaged := stats.Datasets["tank/other"]; unmanaged.Managed || unmanaged.ChainDepth != 1 {
+		t.Fatalf("expected the unmanaged dataset with its backup, got %+v", unmanaged)
+	}
+}
@@ -1,14 +1,20 @@
 package repository
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/gargakshit/zfsbackrest/storage"
 )
 
@@ -38,9 +44,12 @@ import (
 // Full Reconciliation flow:
 // 1. Load the store.
 // 2. Validate the store.
-// 3. Delete the backups from the orphan list that are "safe to delete".
-// 4. Commit the store.
-// 5. Start the expiry sequence.
+// 3. Compare it with the remote objects, and with the local snapshots and
+//    their holds.
+// 4. Mark the backups whose snapshot is missing damaged, write missing
+//    manifests again, and hold local snapshots again.
+// 5. Remove the orphans with neither a remote nor a local snapshot left.
+// 6. Commit the store.
 
 // Store is the main struct that contains the backups and orphans.
 // It is made to be stored in a single file, usually on the same filesystem as
@@ -52,7 +61,50 @@ type Store struct {
 	Orphans         Orphans           `json:"orphans"`
 	Encryption      config.Encryption `json:"encryption"`
 	ManagedDatasets []string          `json:"managed_datasets"`
-	Hash            *string           `json:"hash"`
+	// ManagedSince is when each managed dataset was added to the managed
+	// datasets, if it was after the repository was created.
+	ManagedSince map[string]time.Time `json:"managed_since,omitempty"`
+	Hash         *string              `json:"hash"`
+	Maintenance  *Maintenance         `json:"maintenance,omitempty"`
+	Trash        Trash                `json:"trash,omitempty"`
+	// RetiredRecipients are the recipients the repository used before its
+	// key was rotated, oldest first.
+	RetiredRecipients []RetiredRecipient `json:"retired_recipients,omitempty"`
+
+	// unknownFields holds top-level fields written by a newer zfsbackrest.
+	// They are written back on save, so running an older binary against the
+	// repository doesn't silently drop them.
+	unknownFields map[string]json.RawMessage
+
+	// lease is the repository lock the store is saved under, if any.
+	lease *Lease
+	// audited is the store as last loaded or saved, which the audit log
+	// compares saves with. It is guarded by saveMu.
+	audited *auditBaseline
+	// hashMismatch is set when the store was loaded with a hash that
+	// doesn't match its content, with WithHashRepair.
+	hashMismatch bool
+
+	// mu guards the store against FSMs running concurrently. Its methods
+	// lock it, code reading or changing the backups in place uses View and
+	// Update. saveMu serialises saves, so they reach the storage in order.
+	mu     sync.RWMutex
+	saveMu sync.Mutex
+}
+
+// View calls fn with the store locked for reading.
+func (s *Store) View(fn func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fn()
+}
+
+// Update calls fn with the store locked for writing, for changes made to the
+// backups in place.
+func (s *Store) Update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
 }
 
 func LoadStore(ctx context.Context, storage storage.StrongStore) (*Store, error) {
@@ -64,52 +116,357 @@ func LoadStore(ctx context.Context, storage storage.StrongStore) (*Store, error)
 		return nil, fmt.Errorf("failed to load store content: %w", err)
 	}
 
-	var store Store
-	if err := json.Unmarshal(storeBytes, &store); err != nil {
-		slog.Error("Failed to unmarshal store content", "error", err)
-		return nil, fmt.Errorf("failed to unmarshal store content: %w", err)
+	store, err := openStoreContent(ctx, storeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	store.audited = store.newAuditBaseline()
+
+	if interrupted, err := HasJournal(ctx, storage); err != nil {
+		slog.Warn("Failed to check for an interrupted store save", "error", err)
+	} else if interrupted {
+		slog.Warn("A store save was interrupted. The next command that changes the repository finishes it; until then, the store may be missing its last change.")
+	}
+
+	return store, nil
+}
+
+// openStoreContent decrypts, decodes and checks the store as saved.
+func openStoreContent(ctx context.Context, storeBytes []byte) (*Store, error) {
+	storeBytes, err := openStore(ctx, storeBytes)
+	if err != nil {
+		slog.Error("Failed to decrypt store content", "error", err)
+		return nil, fmt.Errorf("failed to decrypt store content: %w", err)
+	}
+
+	store, err := decodeStore(storeBytes)
+	if err != nil {
+		slog.Error("Failed to decode store content", "error", err)
+		return nil, &errclass.ValidationError{Subject: "store content", Err: err}
 	}
 
 	if err := store.Validate(); err != nil {
 		slog.Error("Invalid store", "error", err)
-		return nil, fmt.Errorf("invalid store: %w", err)
+		return nil, err
+	}
+
+	if err := store.checkHash(ctx); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+type hashRepairKey struct{}
+
+// WithHashRepair makes LoadStore accept a store whose content doesn't match
+// its hash, instead of refusing it. The hash is corrected by the next save.
+func WithHashRepair(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hashRepairKey{}, true)
+}
+
+func hashRepairFromContext(ctx context.Context) bool {
+	repair, _ := ctx.Value(hashRepairKey{}).(bool)
+	return repair
+}
+
+// checkHash checks that the store's content matches the hash it was saved
+// with, so a store edited or damaged outside zfsbackrest isn't acted on.
+func (s *Store) checkHash(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Hash == nil {
+		slog.Debug("Store has no hash yet. It is recorded by the next save.")
+		return nil
+	}
+
+	// The hash covers the fields as the version that saved the store
+	// marshalled them, which can't be reproduced without knowing them all.
+	if len(s.unknownFields) > 0 {
+		slog.Debug("Store has fields this version doesn't know about. Not checking its hash.")
+		return nil
+	}
+
+	computed, err := s.computeHash()
+	if err != nil {
+		return fmt.Errorf("failed to hash store: %w", err)
+	}
+	if computed == *s.Hash {
+		return nil
+	}
+
+	if hashRepairFromContext(ctx) {
+		slog.Warn("Store content does not match its recorded hash. Continuing because of --repair; the hash is corrected by the next save.",
+			"recorded", *s.Hash, "computed", computed)
+		s.hashMismatch = true
+		return nil
 	}
 
+	slog.Error("Store content does not match its recorded hash. It was changed outside zfsbackrest, or damaged. Check it with `zfsbackrest verify-history`, or pass --repair to use it anyway.",
+		"recorded", *s.Hash, "computed", computed)
+	return &errclass.ValidationError{
+		Subject: "store",
+		Err:     fmt.Errorf("%w: recorded %s, computed %s", ErrStoreHashMismatch, *s.Hash, computed),
+	}
+}
+
+// HashMismatch reports whether the store was loaded with --repair although
+// its content doesn't match its hash.
+func (s *Store) HashMismatch() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hashMismatch
+}
+
+// StoreExists reports whether storage already has a store, e.g. to not
+// overwrite a repository by initializing it again.
+func StoreExists(ctx context.Context, storage storage.StrongStore) (bool, error) {
+	_, err := storage.LoadStoreContent(ctx)
+	if errors.Is(err, errclass.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		slog.Error("Failed to check for an existing store", "error", err)
+		return false, fmt.Errorf("failed to check for an existing store: %w", err)
+	}
+
+	return true, nil
+}
+
+// decodeStore strictly decodes the store. Unknown top-level fields are kept
+// aside and preserved; unknown fields anywhere else, trailing data, and
+// missing required fields are errors.
+func decodeStore(content []byte) (*Store, error) {
+	var fields map[string]json.RawMessage
+	if err := strictUnmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+
+	if fields == nil {
+		return nil, errors.New("store content is null")
+	}
+
+	for _, name := range []string{"version", "created_at", "backups", "orphans", "encryption"} {
+		if raw, ok := fields[name]; !ok || string(raw) == "null" {
+			return nil, fmt.Errorf("%w: %q", ErrStoreMissingField, name)
+		}
+	}
+
+	known := storeFieldNames()
+	var unknown map[string]json.RawMessage
+	for name, raw := range fields {
+		if known[name] {
+			continue
+		}
+
+		slog.Warn("Store has a field this version of zfsbackrest doesn't know about. It will be preserved, but ignored.", "field", name)
+		if unknown == nil {
+			unknown = map[string]json.RawMessage{}
+		}
+		unknown[name] = raw
+		delete(fields, name)
+	}
+
+	knownContent, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var store Store
+	if err := strictUnmarshal(knownContent, &store); err != nil {
+		return nil, err
+	}
+	store.unknownFields = unknown
+
 	return &store, nil
 }
 
+func strictUnmarshal(content []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the store")
+	}
+
+	return nil
+}
+
+// storeFieldNames returns the JSON names of Store's fields.
+func storeFieldNames() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(Store{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// SetLease makes saves fail once lease is lost, so a store loaded under the
+// repository lock can't overwrite changes made after another host took it
+// over.
+func (s *Store) SetLease(lease *Lease) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.lease = lease
+}
+
 func (s *Store) Save(ctx context.Context, storage storage.StrongStore) error {
-	slog.Debug("Saving store", "store", s)
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
 
-	if err := s.Validate(); err != nil {
-		slog.Error("Invalid store", "error", err)
-		return fmt.Errorf("invalid store: %w", err)
+	if s.lease != nil {
+		if err := s.lease.Check(); err != nil {
+			slog.Error("Refusing to save the store without the repository lock", "error", err)
+			return err
+		}
 	}
 
-	storeBytes, err := json.Marshal(s)
+	s.mu.Lock()
+	hash, storeBytes, err := s.encode()
+	recipients := []string{s.Encryption.Age.RecipientPublicKey, s.Encryption.Age.RecoveryRecipientPublicKey}
+	changes := s.auditChanges()
+	baseline := s.newAuditBaseline()
+	s.mu.Unlock()
 	if err != nil {
-		slog.Error("Failed to marshal store", "error", err)
-		return fmt.Errorf("failed to marshal store: %w", err)
+		return err
+	}
+
+	storeBytes, err = sealStore(ctx, storeBytes, recipients)
+	if err != nil {
+		slog.Error("Failed to encrypt store", "error", err)
+		return fmt.Errorf("failed to encrypt store: %w", err)
+	}
+
+	if err := writeJournal(ctx, storage, hash, storeBytes); err != nil {
+		slog.Error("Failed to write store journal", "error", err)
+		return err
 	}
 
 	if err := storage.SaveStoreContent(ctx, storeBytes); err != nil {
 		slog.Error("Failed to save store content", "error", err)
+		discardJournal(ctx, storage)
 		return fmt.Errorf("failed to save store content: %w", err)
 	}
 
+	// The store is saved. If the history entry can't be appended, the
+	// journal is kept, so the next RecoverJournal appends it.
+	if err := appendHistory(ctx, storage, hash); err != nil {
+		slog.Error("Failed to append store history", "error", err)
+		return err
+	}
+
+	if err := storage.DeleteJournalContent(ctx); err != nil {
+		slog.Warn("Failed to delete the store journal. It is cleaned up by the next command that changes the repository.", "error", err)
+	}
+
+	saveStoreVersion(ctx, storage, storeBytes)
+
+	// The audit log is informational, so the save stands if it can't be
+	// appended to.
+	if err := AppendAudit(ctx, storage, changes...); err != nil {
+		slog.Warn("Failed to append to the audit log", "error", err)
+	}
+	s.audited = baseline
+
+	s.mu.Lock()
+	s.hashMismatch = false
+	s.mu.Unlock()
+
+	saveLocalCopy(ctx, storeBytes)
+
 	return nil
 }
 
+// encode validates, hashes and marshals the store. The caller holds s.mu for
+// writing, as it sets the hash.
+func (s *Store) encode() (string, []byte, error) {
+	slog.Debug("Saving store", "store", s)
+
+	if err := s.validate(); err != nil {
+		slog.Error("Invalid store", "error", err)
+		return "", nil, &errclass.ValidationError{Subject: "store", Err: err}
+	}
+
+	hash, err := s.computeHash()
+	if err != nil {
+		slog.Error("Failed to hash store", "error", err)
+		return "", nil, fmt.Errorf("failed to hash store: %w", err)
+	}
+	s.Hash = &hash
+
+	storeBytes, err := s.marshal()
+	if err != nil {
+		slog.Error("Failed to marshal store", "error", err)
+		return "", nil, fmt.Errorf("failed to marshal store: %w", err)
+	}
+
+	return hash, storeBytes, nil
+}
+
+// marshal encodes the store, including unknown fields it was loaded with.
+func (s *Store) marshal() ([]byte, error) {
+	content, err := json.Marshal(s)
+	if err != nil || len(s.unknownFields) == 0 {
+		return content, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, raw := range s.unknownFields {
+		if _, ok := fields[name]; !ok {
+			fields[name] = raw
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
 var (
+	ErrStoreMissingField    = errors.New("store is missing a required field")
 	ErrInvalidStoreVersion  = errors.New("invalid store version")
 	ErrStoreCreatedInFuture = errors.New("store created in the future")
 	ErrBackupInOrphan       = errors.New("backup is in orphan list")
 	ErrBackupValidation     = errors.New("backup validation failed")
+	ErrInvalidEncryption    = errors.New("invalid store encryption")
 )
 
+// Validate validates the store. Failures are returned as an
+// errclass.ValidationError wrapping one of the sentinel errors above.
 func (s *Store) Validate() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.validate(); err != nil {
+		return &errclass.ValidationError{Subject: "store", Err: err}
+	}
+
+	return nil
+}
+
+func (s *Store) validate() error {
 	slog.Debug("Validating store", "store", s)
 
+	if s.Version > 1 {
+		slog.Error("Store was written by a newer version of zfsbackrest", "version", s.Version)
+		return fmt.Errorf("%w: version %d is newer than the supported version 1, upgrade zfsbackrest", ErrInvalidStoreVersion, s.Version)
+	}
+
 	if s.Version != 1 {
 		slog.Error("Invalid store version", "version", s.Version)
 		return ErrInvalidStoreVersion
@@ -120,16 +477,51 @@ func (s *Store) Validate() error {
 		return ErrStoreCreatedInFuture
 	}
 
+	if err := s.validateEncryption(); err != nil {
+		return err
+	}
+
 	// Check if backups and orphans have the same ID.
 	for id := range s.Orphans {
-		if _, ok := s.Backups[id]; ok {
+		if _, ok := s.Backups.Get(id); ok {
 			slog.Error("Backup is in both backups and orphans. Your backup store is not consistent.", "backup", id)
 			return ErrBackupInOrphan
 		}
 	}
 
+	for id, trashed := range s.Trash {
+		if _, ok := s.Backups.Get(id); ok {
+			slog.Error("Backup is in both backups and the trash. Your backup store is not consistent.", "backup", id)
+			return ErrBackupInTrash
+		}
+		if _, ok := s.Orphans[id]; ok {
+			slog.Error("Backup is in both orphans and the trash. Your backup store is not consistent.", "backup", id)
+			return ErrBackupInTrash
+		}
+
+		if trashed == nil {
+			slog.Error("Trashed backup is null", "backup", id)
+			return fmt.Errorf("%w: trashed backup %s is null", ErrBackupValidation, id)
+		}
+
+		if err := trashed.Backup.validateFields(id); err != nil {
+			return errors.Join(ErrBackupValidation, err)
+		}
+	}
+
+	for id, orphan := range s.Orphans {
+		if orphan == nil {
+			slog.Error("Orphan is null", "backup", id)
+			return fmt.Errorf("%w: orphan %s is null", ErrBackupValidation, id)
+		}
+
+		if err := orphan.Backup.validateFields(id); err != nil {
+			return errors.Join(ErrBackupValidation, err)
+		}
+	}
+
 	// Validate backups.
-	for id := range s.Backups {
+	for id := range s.Backups.All() {
 		if err := s.Backups.Validate(id); err != nil {
 			return errors.Join(ErrBackupValidation, err)
 		}
@@ -137,3 +529,35 @@ func (s *Store) Validate() error {
 
 	return nil
 }
+
+// validateEncryption checks the store's encryption mode is consistent with
+// its recipient and its backups, so a repository can't be switched between
+// encrypted and unencrypted by editing the store.
+func (s *Store) validateEncryption() error {
+	enc := &s.Encryption
+	switch {
+	case enc.Mode != "" && !enc.Disabled():
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidEncryption, enc.Mode)
+	case enc.Disabled() && (enc.Age.RecipientPublicKey != "" || enc.Age.RecoveryRecipientPublicKey != "" || len(s.RetiredRecipients) > 0):
+		slog.Error("Store of a repository without encryption has a recipient", "recipient", enc.Age.RecipientPublicKey)
+		return fmt.Errorf("%w: a repository initialized without encryption has no recipient", ErrInvalidEncryption)
+	case enc.Age.RecoveryRecipientPublicKey != "" && enc.Age.RecoveryRecipientPublicKey == enc.Age.RecipientPublicKey:
+		return fmt.Errorf("%w: %w", ErrInvalidEncryption, ErrRecoveryRecipient)
+	}
+
+	for id, backup := range s.Backups.All() {
+		if backup != nil && (backup.EncryptionScheme() == EncryptionSchemeNone) != enc.Disabled() {
+			slog.Error("Backup doesn't match the repository's encryption mode", "backup", id, "encryption", backup.EncryptionScheme())
+			return fmt.Errorf("%w: backup %s is %s, but the repository is not", ErrInvalidEncryption, id, encryptionModeName(backup.EncryptionScheme() == EncryptionSchemeNone))
+		}
+	}
+
+	return nil
+}
+
+func encryptionModeName(unencrypted bool) string {
+	if unencrypted {
+		return "unencrypted"
+	}
+	return "encrypted"
+}
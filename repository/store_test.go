@@ -2,9 +2,11 @@ package repository
 
 import (
 	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gargakshit/zfsbackrest/config"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -34,14 +36,14 @@ func TestStoreValidate(t *testing.T) {
 		{
 			name: "invalid version -> ErrInvalidStoreVersion",
 			build: func() Store {
-				return Store{Version: 2, CreatedAt: now, Backups: Backups{}, Orphans: Orphans{}}
+				return Store{Version: 2, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}}
 			},
 			wantErr: ErrInvalidStoreVersion,
 		},
 		{
 			name: "created in future -> ErrStoreCreatedInFuture",
 			build: func() Store {
-				return Store{Version: 1, CreatedAt: future, Backups: Backups{}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: future, Backups: NewBackups(), Orphans: Orphans{}}
 			},
 			wantErr: ErrStoreCreatedInFuture,
 		},
@@ -53,7 +55,7 @@ func TestStoreValidate(t *testing.T) {
 				return Store{
 					Version:   1,
 					CreatedAt: now,
-					Backups:   Backups{id: b},
+					Backups:   NewBackups(b),
 					Orphans:   Orphans{id: &Orphan{Backup: *b}},
 				}
 			},
@@ -64,7 +66,7 @@ func TestStoreValidate(t *testing.T) {
 			build: func() Store {
 				id := newID()
 				b := diff(id, past, nil)
-				return Store{Version: 1, CreatedAt: now, Backups: Backups{id: b}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}}
 			},
 			wantErr: ErrBackupValidation,
 			alsoIs:  ErrDiffBackupNoParent,
@@ -75,15 +77,71 @@ func TestStoreValidate(t *testing.T) {
 				id := newID()
 				missing := newID()
 				b := diff(id, past, &missing)
-				return Store{Version: 1, CreatedAt: now, Backups: Backups{id: b}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}}
 			},
 			wantErr: ErrBackupValidation,
 			alsoIs:  ErrParentBackupNotFound,
 		},
+		{
+			name: "unknown encryption mode -> ErrInvalidEncryption",
+			build: func() Store {
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}, Encryption: config.Encryption{Mode: "rot13"}}
+			},
+			wantErr: ErrInvalidEncryption,
+		},
+		{
+			name: "unencrypted store with a recipient -> ErrInvalidEncryption",
+			build: func() Store {
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}, Encryption: config.Encryption{
+					Mode: config.EncryptionModeNone,
+					Age:  config.Age{RecipientPublicKey: "age1..."},
+				}}
+			},
+			wantErr: ErrInvalidEncryption,
+		},
+		{
+			name: "recovery recipient is the recipient -> ErrInvalidEncryption + ErrRecoveryRecipient",
+			build: func() Store {
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}, Encryption: config.Encryption{
+					Age: config.Age{RecipientPublicKey: "age1...", RecoveryRecipientPublicKey: "age1..."},
+				}}
+			},
+			wantErr: ErrInvalidEncryption,
+			alsoIs:  ErrRecoveryRecipient,
+		},
+		{
+			name: "encrypted backup in an unencrypted store -> ErrInvalidEncryption",
+			build: func() Store {
+				id := newID()
+				b := full(id, past, nil)
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}, Encryption: config.Encryption{Mode: config.EncryptionModeNone}}
+			},
+			wantErr: ErrInvalidEncryption,
+		},
+		{
+			name: "unencrypted backup in an encrypted store -> ErrInvalidEncryption",
+			build: func() Store {
+				id := newID()
+				b := full(id, past, nil)
+				b.Encryption = EncryptionSchemeNone
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}}
+			},
+			wantErr: ErrInvalidEncryption,
+		},
+		{
+			name: "valid store: unencrypted backup in an unencrypted store",
+			build: func() Store {
+				id := newID()
+				b := full(id, past, nil)
+				b.Encryption = EncryptionSchemeNone
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}, Encryption: config.Encryption{Mode: config.EncryptionModeNone}}
+			},
+			wantErr: nil,
+		},
 		{
 			name: "valid store: empty",
 			build: func() Store {
-				return Store{Version: 1, CreatedAt: now, Backups: Backups{}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(), Orphans: Orphans{}}
 			},
 			wantErr: nil,
 		},
@@ -92,7 +150,7 @@ func TestStoreValidate(t *testing.T) {
 			build: func() Store {
 				id := newID()
 				b := full(id, past, nil)
-				return Store{Version: 1, CreatedAt: now, Backups: Backups{id: b}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(b), Orphans: Orphans{}}
 			},
 			wantErr: nil,
 		},
@@ -105,7 +163,7 @@ func TestStoreValidate(t *testing.T) {
 				fb := full(fid, past, nil)
 				db := diff(did, past, &fid)
 				ib := incr(iid, past, &did)
-				return Store{Version: 1, CreatedAt: now, Backups: Backups{fid: fb, did: db, iid: ib}, Orphans: Orphans{}}
+				return Store{Version: 1, CreatedAt: now, Backups: NewBackups(fb, db, ib), Orphans: Orphans{}}
 			},
 			wantErr: nil,
 		},
@@ -131,3 +189,69 @@ func TestStoreValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeStore(t *testing.T) {
+	id := ulid.Make()
+	created := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	backup := func(extra string) string {
+		return `{"id":"` + id.String() + `","type":"full","created_at":"` + created + `","depends_on":null,"dataset":"tank/data","size":1` + extra + `}`
+	}
+	store := func(backups string, extra string) string {
+		return `{"version":1,"created_at":"` + created + `","backups":{` + backups + `},"orphans":{},"encryption":{"age":{"recipient_public_key":""}},"managed_datasets":[],"hash":null` + extra + `}`
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr error // nil: valid; errAny: any error
+	}{
+		{name: "valid", content: store(`"`+id.String()+`":`+backup(""), "")},
+		{name: "unknown top-level field", content: store("", `,"future":{"a":1}`)},
+		{name: "unknown backup field", content: store(`"`+id.String()+`":`+backup(`,"future":1`), ""), wantErr: errAny},
+		{name: "trailing data", content: store("", "") + `{}`, wantErr: errAny},
+		{name: "missing field", content: `{"version":1,"created_at":"` + created + `","backups":{},"encryption":{}}`, wantErr: ErrStoreMissingField},
+		{name: "null backups", content: `{"version":1,"created_at":"` + created + `","backups":null,"orphans":{},"encryption":{}}`, wantErr: ErrStoreMissingField},
+		{name: "negative size", content: store(`"`+id.String()+`":`+strings.Replace(backup(""), `"size":1`, `"size":-1`, 1), ""), wantErr: ErrNegativeBackupSize},
+		{name: "zero id", content: store(`"`+ulid.ULID{}.String()+`":`+strings.Replace(backup(""), id.String(), ulid.ULID{}.String(), 1), ""), wantErr: ErrZeroBackupID},
+		{name: "null backup", content: store(`"`+id.String()+`":null`, ""), wantErr: ErrNullBackup},
+		{name: "newer version", content: strings.Replace(store("", ""), `"version":1`, `"version":7`, 1), wantErr: ErrInvalidStoreVersion},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := decodeStore([]byte(tc.content))
+			if err == nil {
+				err = s.Validate()
+			}
+
+			switch {
+			case tc.wantErr == nil && err != nil:
+				t.Fatalf("expected no error, got %v", err)
+			case tc.wantErr == errAny && err == nil:
+				t.Fatal("expected an error")
+			case tc.wantErr != nil && tc.wantErr != errAny && !errors.Is(err, tc.wantErr):
+				t.Fatalf("expected %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestStorePreservesUnknownFields(t *testing.T) {
+	content := `{"version":1,"created_at":"2020-01-01T00:00:00Z","backups":{},"orphans":{},"encryption":{"age":{"recipient_public_key":""}},"future":{"a":1}}`
+
+	s, err := decodeStore([]byte(content))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	out, err := s.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	if !strings.Contains(string(out), `"future":{"a":1}`) {
+		t.Fatalf("expected unknown field to be preserved, got %s", out)
+	}
+}
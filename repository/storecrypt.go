@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// The store can be encrypted at rest, as it names the datasets and records
+// when backups were taken and how large they are. It is encrypted to the
+// repository's recipient, so whoever can restore can read it, and to the
+// recipients of the store identities, so the backup host, which only has the
+// repository's recipient, can read it back.
+
+var ErrStoreEncrypted = errors.New("the store is encrypted, but no identity to decrypt it was given")
+
+// StoreEncryption is how stores in a context are encrypted.
+type StoreEncryption struct {
+	// Enabled encrypts the store when it is saved. An encrypted store is
+	// decrypted on load either way.
+	Enabled bool
+	// Identities decrypt the store. The recipients of the X25519 ones are
+	// recipients of the store, besides the repository's.
+	Identities []string
+	Age        encryption.AgeOpts
+	// ReadIdentities only decrypt the store, with ReadAge. They never become
+	// recipients of it.
+	ReadIdentities []string
+	ReadAge        encryption.AgeOpts
+}
+
+type storeEncryptionKey struct{}
+
+// WithStoreEncryption makes stores loaded and saved in ctx encrypted with
+// enc.
+func WithStoreEncryption(ctx context.Context, enc StoreEncryption) context.Context {
+	return context.WithValue(ctx, storeEncryptionKey{}, enc)
+}
+
+// WithStoreIdentities adds identities that can decrypt the store in ctx, like
+// the repository's identity when restoring on a host without the store
+// identity. They don't become recipients of the store.
+func WithStoreIdentities(ctx context.Context, identities []string, opts encryption.AgeOpts) context.Context {
+	enc := storeEncryptionFromContext(ctx)
+	enc.ReadIdentities = append(slices.Clip(enc.ReadIdentities), identities...)
+	enc.ReadAge = opts
+
+	return WithStoreEncryption(ctx, enc)
+}
+
+func storeEncryptionFromContext(ctx context.Context) StoreEncryption {
+	enc, _ := ctx.Value(storeEncryptionKey{}).(StoreEncryption)
+	return enc
+}
+
+// sealStore encrypts the store content, if store encryption is enabled in
+// ctx, to repositoryRecipients, the repository's recipient and recovery
+// recipient, and to the recipients of the store identities. Empty recipients
+// are skipped: repositories initialized without encryption have no
+// recipient, so their store is only encrypted to the store identities.
+func sealStore(ctx context.Context, content []byte, repositoryRecipients []string) ([]byte, error) {
+	enc := storeEncryptionFromContext(ctx)
+	if !enc.Enabled {
+		return content, nil
+	}
+
+	var recipients []string
+	for _, recipient := range repositoryRecipients {
+		if recipient != "" && !slices.Contains(recipients, recipient) {
+			recipients = append(recipients, recipient)
+		}
+	}
+	for _, identity := range enc.Identities {
+		r, err := encryption.RecipientFromIdentity(identity)
+		if err != nil {
+			// Plugin identities can't be recipients.
+			continue
+		}
+		if !slices.Contains(recipients, r) {
+			recipients = append(recipients, r)
+		}
+	}
+
+	slog.Debug("Encrypting store", "recipients", recipients)
+	return encryption.EncryptContent(content, recipients, enc.Age)
+}
+
+// openStore decrypts the store content, if it is encrypted, with the store
+// identities, then with the identities that only read it.
+func openStore(ctx context.Context, content []byte) ([]byte, error) {
+	if !encryption.IsEncrypted(content) {
+		return content, nil
+	}
+
+	enc := storeEncryptionFromContext(ctx)
+	if len(enc.Identities) == 0 && len(enc.ReadIdentities) == 0 {
+		return nil, &errclass.EncryptionError{Op: "decrypt store", Err: ErrStoreEncrypted}
+	}
+
+	if len(enc.Identities) > 0 {
+		slog.Debug("Decrypting store", "identities", len(enc.Identities))
+		decrypted, err := encryption.DecryptContent(content, enc.Identities, enc.Age)
+		if err == nil || len(enc.ReadIdentities) == 0 {
+			return decrypted, err
+		}
+		slog.Debug("The store identities can't decrypt the store", "error", err)
+	}
+
+	slog.Debug("Decrypting store", "read_identities", len(enc.ReadIdentities))
+	return encryption.DecryptContent(content, enc.ReadIdentities, enc.ReadAge)
+}
@@ -0,0 +1,121 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestStoreEncryption(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	repositoryIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := repositorytest.NewStore("tank/data").
+		WithEncryption(config.Encryption{Age: config.Age{RecipientPublicKey: repositoryIdentity.Recipient().String()}}).
+		Build()
+
+	hostCtx := repository.WithStoreEncryption(ctx, repository.StoreEncryption{Enabled: true, Identities: []string{hostIdentity.String()}})
+	if err := store.Save(hostCtx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	content := s.StoreContent()
+	if !encryption.IsEncrypted(content) || bytes.Contains(content, []byte("tank/data")) {
+		t.Fatalf("expected the store to be encrypted, got %q", content)
+	}
+
+	if _, err := repository.LoadStore(hostCtx, s); err != nil {
+		t.Fatalf("load with the store identity: %v", err)
+	}
+
+	// Restoring on a new host, with only the repository's identity.
+	restoreCtx := repository.WithStoreIdentities(ctx, []string{repositoryIdentity.String()}, encryption.AgeOpts{})
+	loaded, err := repository.LoadStore(restoreCtx, s)
+	if err != nil {
+		t.Fatalf("load with the repository identity: %v", err)
+	}
+	if len(loaded.ManagedDatasets) != 1 || loaded.ManagedDatasets[0] != "tank/data" {
+		t.Fatalf("unexpected managed datasets %v", loaded.ManagedDatasets)
+	}
+
+	if _, err := repository.LoadStore(ctx, s); !errors.Is(err, repository.ErrStoreEncrypted) {
+		t.Fatalf("expected ErrStoreEncrypted without identities, got %v", err)
+	}
+
+	otherCtx := repository.WithStoreIdentities(ctx, []string{other.String()}, encryption.AgeOpts{})
+	if _, err := repository.LoadStore(otherCtx, s); !errors.Is(err, encryption.ErrIdentityMismatch) {
+		t.Fatalf("expected ErrIdentityMismatch with another identity, got %v", err)
+	}
+
+	// Saving without store encryption writes the store in plaintext again.
+	if err := loaded.Save(restoreCtx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if encryption.IsEncrypted(s.StoreContent()) {
+		t.Fatal("expected the store to be saved in plaintext")
+	}
+}
+
+func TestStoreReadIdentitiesArentRecipients(t *testing.T) {
+	ctx := context.Background()
+	s := storagetest.NewMemoryStore()
+
+	oldIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := repositorytest.NewStore("tank/data").
+		WithEncryption(config.Encryption{Age: config.Age{RecipientPublicKey: newIdentity.Recipient().String()}}).
+		Build()
+
+	// Re-encrypting after a rotation, with the retired identity given to
+	// decrypt the backups.
+	hostCtx := repository.WithStoreEncryption(ctx, repository.StoreEncryption{Enabled: true, Identities: []string{hostIdentity.String()}})
+	reencryptCtx := repository.WithStoreIdentities(hostCtx, []string{oldIdentity.String()}, encryption.AgeOpts{})
+	if err := store.Save(reencryptCtx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := repository.LoadStore(reencryptCtx, s); err != nil {
+		t.Fatalf("load with the store identity: %v", err)
+	}
+
+	oldCtx := repository.WithStoreIdentities(ctx, []string{oldIdentity.String()}, encryption.AgeOpts{})
+	if _, err := repository.LoadStore(oldCtx, s); !errors.Is(err, encryption.ErrIdentityMismatch) {
+		t.Fatalf("expected the retired identity alone not to open the store, got %v", err)
+	}
+
+	newCtx := repository.WithStoreIdentities(ctx, []string{newIdentity.String()}, encryption.AgeOpts{})
+	if _, err := repository.LoadStore(newCtx, s); err != nil {
+		t.Fatalf("load with the repository identity: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/oklog/ulid/v2"
+)
+
+// Backups carry tags, key=value labels set when they are taken, like
+// reason=pre-upgrade. Tag selectors pick backups by them: key=value matches
+// the tag with that value, and a bare key matches the tag with any value.
+
+var (
+	ErrEmptyTagKey   = errors.New("tag key is empty")
+	ErrInvalidTagKey = errors.New("tag key must not contain '=', ',' or whitespace")
+)
+
+// TagSelector matches backups by a tag.
+type TagSelector struct {
+	Key   string
+	Value string
+	// AnyValue is set for a bare key, which matches any value.
+	AnyValue bool
+}
+
+func (s TagSelector) String() string {
+	if s.AnyValue {
+		return s.Key
+	}
+	return s.Key + "=" + s.Value
+}
+
+// Match reports whether the backup has the selected tag.
+func (s TagSelector) Match(b *Backup) bool {
+	value, ok := b.Tags[s.Key]
+	return ok && (s.AnyValue || value == s.Value)
+}
+
+// ParseTags parses key=value tags, as given on the command line.
+func ParseTags(tags []string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			return nil, &errclass.ValidationError{Subject: "tag", Err: fmt.Errorf("%q is not key=value", tag)}
+		}
+		if err := validateTagKey(key); err != nil {
+			return nil, &errclass.ValidationError{Subject: "tag", Err: fmt.Errorf("%q: %w", tag, err)}
+		}
+		parsed[key] = value
+	}
+
+	return parsed, nil
+}
+
+// ParseTagSelectors parses key=value and bare key tag selectors.
+func ParseTagSelectors(selectors []string) ([]TagSelector, error) {
+	parsed := make([]TagSelector, 0, len(selectors))
+	for _, selector := range selectors {
+		key, value, ok := strings.Cut(selector, "=")
+		if err := validateTagKey(key); err != nil {
+			return nil, fmt.Errorf("tag selector %q: %w", selector, err)
+		}
+		parsed = append(parsed, TagSelector{Key: key, Value: value, AnyValue: !ok})
+	}
+
+	return parsed, nil
+}
+
+func validateTagKey(key string) error {
+	if key == "" {
+		return ErrEmptyTagKey
+	}
+	if strings.ContainsAny(key, "=, \t\n") {
+		return ErrInvalidTagKey
+	}
+
+	return nil
+}
+
+// FormatTags formats the tags of a backup as key=value pairs, sorted by key.
+func FormatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// MatchAllTags reports whether the backup has every selected tag.
+func (b *Backup) MatchAllTags(selectors []TagSelector) bool {
+	for _, s := range selectors {
+		if !s.Match(b) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keptTag returns the first of keep the backup matches.
+func (b *Backup) keptTag(keep []TagSelector) (TagSelector, bool) {
+	for _, s := range keep {
+		if s.Match(b) {
+			return s, true
+		}
+	}
+
+	return TagSelector{}, false
+}
+
+// KeptByTags returns the backups the keep tags keep from expiring, with the
+// tag that keeps each: the backups that have one, and the parents their
+// restores need.
+func (bs Backups) KeptByTags(keep []TagSelector) map[ulid.ULID]TagSelector {
+	kept := map[ulid.ULID]TagSelector{}
+	if len(keep) == 0 {
+		return kept
+	}
+
+	for _, b := range bs.All() {
+		tag, ok := b.keptTag(keep)
+		if !ok {
+			continue
+		}
+
+		for cur := b; cur != nil; {
+			if _, ok := kept[cur.ID]; !ok || cur == b {
+				kept[cur.ID] = tag
+			}
+
+			if cur.DependsOn == nil {
+				break
+			}
+			cur = bs.Find(*cur.DependsOn)
+		}
+	}
+
+	return kept
+}
+
+// KeepTags parses the keep tags of the expiry policy.
+func KeepTags(expiry *config.Expiry) ([]TagSelector, error) {
+	selectors, err := ParseTagSelectors(expiry.KeepTags)
+	if err != nil {
+		return nil, &errclass.ConfigError{Key: "repository.expiry.keep_tags", Err: err}
+	}
+
+	return selectors, nil
+}
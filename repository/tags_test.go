@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"reason=pre-upgrade", "pinned=true", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 3 || tags["reason"] != "pre-upgrade" || tags["pinned"] != "true" || tags["empty"] != "" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	if got := FormatTags(tags); got != "empty=,pinned=true,reason=pre-upgrade" {
+		t.Fatalf("expected the tags sorted by key, got %q", got)
+	}
+
+	for _, invalid := range []string{"pinned", "=true", "a b=c"} {
+		var validationErr *errclass.ValidationError
+		if _, err := ParseTags([]string{invalid}); !errors.As(err, &validationErr) {
+			t.Errorf("expected %q to be rejected, got %v", invalid, err)
+		}
+	}
+
+	selectors, err := ParseTagSelectors([]string{"pinned=true", "reason"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Backup{Tags: tags}
+	if !b.MatchAllTags(selectors) {
+		t.Fatal("expected the backup to match both selectors")
+	}
+	if b.MatchAllTags([]TagSelector{{Key: "pinned", Value: "false"}}) {
+		t.Fatal("expected a different value not to match")
+	}
+}
+
+func TestKeepTags(t *testing.T) {
+	old := time.Now().Add(-72 * time.Hour)
+	full := ulid.MustNew(ulid.Timestamp(old), ulid.DefaultEntropy())
+	diff := ulid.MustNew(ulid.Timestamp(old.Add(time.Hour)), ulid.DefaultEntropy())
+	untagged := ulid.MustNew(ulid.Timestamp(old.Add(2*time.Hour)), ulid.DefaultEntropy())
+
+	bs := NewBackups(
+		&Backup{ID: full, Type: BackupTypeFull, CreatedAt: old, Dataset: "tank/data"},
+		&Backup{ID: diff, Type: BackupTypeDiff, CreatedAt: old.Add(time.Hour), Dataset: "tank/data", DependsOn: &full, Tags: map[string]string{"pinned": "true"}},
+		&Backup{ID: untagged, Type: BackupTypeFull, CreatedAt: old.Add(2 * time.Hour), Dataset: "tank/data"},
+	)
+
+	for name, expiry := range map[string]*config.Expiry{
+		"age": {Full: time.Hour, Diff: time.Hour, KeepTags: []string{"pinned=true"}},
+		"gfs": {GFS: config.GFS{Daily: 1}, KeepTags: []string{"pinned"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			expired, err := bs.ExpiredBackupsForDataset("tank/data", expiry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := expired.Get(diff); ok {
+				t.Fatal("expected the tagged backup to be kept")
+			}
+			if _, ok := expired.Get(full); ok {
+				t.Fatal("expected the parent of the tagged backup to be kept")
+			}
+			if name == "age" {
+				if _, ok := expired.Get(untagged); !ok {
+					t.Fatal("expected the untagged backup to expire")
+				}
+			}
+		})
+	}
+
+	var configErr *errclass.ConfigError
+	if _, err := bs.ExpiredBackupsForDataset("tank/data", &config.Expiry{KeepTags: []string{"=true"}}); !errors.As(err, &configErr) {
+		t.Fatalf("expected an invalid keep tag to be a config error, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Tier is the storage tier a backup's snapshot lives in. New backups land in
+// the hot tier and are moved to the cold tier once they are old enough.
+type Tier string
+
+const (
+	TierHot  Tier = "hot"
+	TierCold Tier = "cold"
+)
+
+// StorageTier returns the tier the backup's snapshot lives in. Backups
+// created before tiering existed are in the hot tier.
+func (b *Backup) StorageTier() Tier {
+	if b.Tier == "" {
+		return TierHot
+	}
+
+	return b.Tier
+}
+
+// DueForCold returns the hot backups older than coldAfter, oldest first.
+// Routed backups stay in the storage of their route.
+func (bs Backups) DueForCold(coldAfter time.Duration) []*Backup {
+	slog.Debug("Getting backups due for the cold tier", "coldAfter", coldAfter)
+
+	var due []*Backup
+	for _, b := range bs.All() {
+		if b.StorageTier() == TierHot && b.Route == "" && b.CreatedAt.Before(time.Now().Add(-coldAfter)) {
+			due = append(due, b)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ID.Compare(due[j].ID) < 0
+	})
+
+	return due
+}
@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestDueForCold(t *testing.T) {
+	now := time.Now()
+
+	oldHot := ulid.Make()
+	olderHot := ulid.Make()
+	oldCold := ulid.Make()
+	recent := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: oldHot, Type: BackupTypeFull, CreatedAt: now.Add(-48 * time.Hour)},
+		&Backup{ID: olderHot, Type: BackupTypeFull, CreatedAt: now.Add(-72 * time.Hour), Tier: TierHot},
+		&Backup{ID: oldCold, Type: BackupTypeFull, CreatedAt: now.Add(-72 * time.Hour), Tier: TierCold},
+		&Backup{ID: recent, Type: BackupTypeFull, CreatedAt: now.Add(-time.Hour)},
+	)
+
+	due := bs.DueForCold(24 * time.Hour)
+	if len(due) != 2 {
+		t.Fatalf("expected 2 backups due, got %d", len(due))
+	}
+	if due[0].ID != oldHot || due[1].ID != olderHot {
+		t.Fatalf("expected backups ordered by ID, got %s, %s", due[0].ID, due[1].ID)
+	}
+}
+
+func TestStorageTierDefaultsToHot(t *testing.T) {
+	b := &Backup{}
+	if b.StorageTier() != TierHot {
+		t.Fatalf("expected %q, got %q", TierHot, b.StorageTier())
+	}
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/oklog/ulid/v2"
+)
+
+// Deleted backups go to the trash instead of being removed, if the trash is
+// enabled. Their snapshots and manifests stay where they are, so a backup can
+// be recovered by moving it back, until cleanup purges it.
+
+type Trash map[ulid.ULID]*TrashedBackup
+
+type TrashedBackup struct {
+	Backup    Backup    `json:"backup"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+var (
+	ErrBackupInTrash     = errors.New("backup is in the trash")
+	ErrNotInTrash        = errors.New("backup is not in the trash")
+	ErrTrashParentPurged = errors.New("backup depends on a backup that no longer exists")
+)
+
+// AddToTrash records a deleted backup in the trash.
+func (s *Store) AddToTrash(ctx context.Context, backup Backup, deletedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.Trash[backup.ID]; ok {
+		if cmp.Equal(existing.Backup, backup) {
+			slog.Debug("Backup already in the trash, skipping addition (idempotency)", "backup", backup.ID)
+			return nil
+		}
+
+		return fmt.Errorf("backup %s is already in the trash", backup.ID)
+	}
+
+	if s.Trash == nil {
+		s.Trash = Trash{}
+	}
+
+	s.Trash[backup.ID] = &TrashedBackup{Backup: backup, DeletedAt: deletedAt}
+	return nil
+}
+
+// RemoveFromTrash forgets a trashed backup, once its snapshot is purged.
+func (s *Store) RemoveFromTrash(ctx context.Context, id ulid.ULID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Trash[id]; !ok {
+		slog.Error("Backup not found in the trash", "backup", id)
+		return fmt.Errorf("%w: %s", ErrNotInTrash, id)
+	}
+
+	delete(s.Trash, id)
+	return nil
+}
+
+// DueForPurge returns the trashed backups deleted more than retention ago,
+// newest first, so children are purged before their parents.
+func (t Trash) DueForPurge(retention time.Duration) []*TrashedBackup {
+	var due []*TrashedBackup
+	for _, trashed := range t {
+		if trashed.DeletedAt.Before(time.Now().Add(-retention)) {
+			due = append(due, trashed)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Backup.ID.Compare(due[j].Backup.ID) > 0
+	})
+
+	return due
+}
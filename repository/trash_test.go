@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestUndeleteFromTrash(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	fid := ulid.Make()
+	did := ulid.Make()
+	iid := ulid.Make()
+
+	full := Backup{ID: fid, Type: BackupTypeFull, Dataset: "tank/data", CreatedAt: now}
+	diff := Backup{ID: did, Type: BackupTypeDiff, Dataset: "tank/data", CreatedAt: now, DependsOn: &fid}
+	incr := Backup{ID: iid, Type: BackupTypeIncr, Dataset: "tank/data", CreatedAt: now, DependsOn: &did}
+
+	s := &Store{Version: 1, CreatedAt: now, Backups: NewBackups(&full), Orphans: Orphans{}}
+	for _, b := range []Backup{diff, incr} {
+		if err := s.AddToTrash(ctx, b, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Adding the same backup again is a no-op.
+	if err := s.AddToTrash(ctx, incr, now.Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	recovered, err := s.Undelete(ctx, iid)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recovered) != 2 || recovered[0].ID != did || recovered[1].ID != iid {
+		t.Fatalf("expected the diff and then the incr to be recovered, got %v", recovered)
+	}
+	if len(s.Trash) != 0 || s.Backups.Len() != 3 {
+		t.Fatalf("expected every backup to be live, got %d backups and %d trashed", s.Backups.Len(), len(s.Trash))
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := s.Undelete(ctx, iid); !errors.Is(err, ErrNotDeleted) {
+		t.Fatalf("expected ErrNotDeleted, got %v", err)
+	}
+
+	// A backup whose parent was purged can't be recovered.
+	s.Backups.remove(iid)
+	s.Backups.remove(did)
+	s.Backups.remove(fid)
+	if err := s.AddToTrash(ctx, incr, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Undelete(ctx, iid); !errors.Is(err, ErrTrashParentPurged) {
+		t.Fatalf("expected ErrTrashParentPurged, got %v", err)
+	}
+}
+
+func TestTrashValidate(t *testing.T) {
+	now := time.Now()
+	id := ulid.Make()
+	b := &Backup{ID: id, Type: BackupTypeFull, CreatedAt: now}
+
+	s := Store{
+		Version:   1,
+		CreatedAt: now,
+		Backups:   NewBackups(b),
+		Orphans:   Orphans{},
+		Trash:     Trash{id: {Backup: *b, DeletedAt: now}},
+	}
+	if err := s.Validate(); !errors.Is(err, ErrBackupInTrash) {
+		t.Fatalf("expected ErrBackupInTrash, got %v", err)
+	}
+}
+
+func TestDueForPurge(t *testing.T) {
+	now := time.Now()
+
+	older := ulid.Make()
+	newer := ulid.Make()
+	recent := ulid.Make()
+
+	trash := Trash{
+		older:  {Backup: Backup{ID: older}, DeletedAt: now.Add(-72 * time.Hour)},
+		newer:  {Backup: Backup{ID: newer}, DeletedAt: now.Add(-48 * time.Hour)},
+		recent: {Backup: Backup{ID: recent}, DeletedAt: now.Add(-time.Hour)},
+	}
+
+	due := trash.DueForPurge(24 * time.Hour)
+	if len(due) != 2 || due[0].Backup.ID != newer || due[1].Backup.ID != older {
+		t.Fatalf("expected the two old backups, newest first, got %v", due)
+	}
+
+	if due := trash.DueForPurge(0); len(due) != 3 {
+		t.Fatalf("expected everything to be due without retention, got %d", len(due))
+	}
+}
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	ErrNotDeleted        = errors.New("backup is neither in the trash nor being deleted")
+	ErrOrphanUncommitted = errors.New("backup was never committed")
+)
+
+// DeletedChain returns the backups Undelete would move back to the backups,
+// parents first, without changing the store.
+func (s *Store) DeletedChain(id ulid.ULID) ([]*Backup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chain, err := s.deletedChain(id)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]*Backup, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		backup := chain[i]
+		backups = append(backups, &backup)
+	}
+
+	return backups, nil
+}
+
+// Undelete moves a backup that is in the trash, or whose deletion started but
+// didn't finish, back to the backups, together with the deleted backups it
+// depends on. It returns the undeleted backups, parents first. Uncommitted
+// orphans can't be undeleted, as their upload may not have finished.
+func (s *Store) Undelete(ctx context.Context, id ulid.ULID) ([]*Backup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chain, err := s.deletedChain(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate against a copy first, so the store is left as it was if the
+	// undeleted chain is inconsistent.
+	backups := s.Backups.Clone()
+	for _, backup := range chain {
+		backups.Add(&backup)
+	}
+	if err := backups.Validate(id); err != nil {
+		slog.Error("Undeleted backup failed validation", "backup", id, "error", err)
+		return nil, errors.Join(ErrBackupValidation, err)
+	}
+
+	return s.restoreChain(chain), nil
+}
+
+// deletedChain walks from id up its parents until it reaches a live backup,
+// and returns the deleted backups on the way, children first: trashed
+// backups, and orphans whose deletion started.
+func (s *Store) deletedChain(id ulid.ULID) ([]Backup, error) {
+	var chain []Backup
+	for next := &id; next != nil; {
+		if _, ok := s.Backups.Get(*next); ok && *next != id {
+			break
+		}
+
+		backup, err := s.deletedBackup(*next)
+		if err != nil {
+			if *next == id {
+				return nil, err
+			}
+			if errors.Is(err, ErrNotDeleted) {
+				return nil, fmt.Errorf("%w: %s", ErrTrashParentPurged, *next)
+			}
+			return nil, err
+		}
+
+		chain = append(chain, *backup)
+		next = backup.DependsOn
+	}
+
+	return chain, nil
+}
+
+func (s *Store) deletedBackup(id ulid.ULID) (*Backup, error) {
+	if trashed, ok := s.Trash[id]; ok {
+		return &trashed.Backup, nil
+	}
+
+	orphan, ok := s.Orphans[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotDeleted, id)
+	}
+
+	if orphan.Reason != OrphanReasonStartedDeletion {
+		return nil, fmt.Errorf("%w: %s", ErrOrphanUncommitted, id)
+	}
+
+	return &orphan.Backup, nil
+}
+
+// restoreChain moves a chain returned by deletedChain to the backups.
+func (s *Store) restoreChain(chain []Backup) []*Backup {
+	restored := make([]*Backup, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		backup := chain[i]
+		slog.Debug("Moving deleted backup back to the backups", "backup", backup.ID)
+
+		delete(s.Trash, backup.ID)
+		delete(s.Orphans, backup.ID)
+		s.Backups.Add(&backup)
+		restored = append(restored, &backup)
+	}
+
+	return restored
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+// Damage records a verification that found a backup's snapshot damaged.
+type Damage struct {
+	DetectedAt time.Time `json:"detected_at"`
+	Reason     string    `json:"reason"`
+}
+
+// MarkVerified records a successful verification of the backup, clearing any
+// earlier damage.
+func (b *Backup) MarkVerified(at time.Time) {
+	b.VerifiedAt = &at
+	b.Damage = nil
+}
+
+// MarkDamaged records a verification that found the backup's snapshot
+// damaged.
+func (b *Backup) MarkDamaged(at time.Time, reason string) {
+	b.Damage = &Damage{DetectedAt: at, Reason: reason}
+}
+
+// Damaged returns the backups whose snapshots were found damaged, oldest
+// first.
+func (bs Backups) Damaged() []*Backup {
+	var damaged []*Backup
+	for _, b := range bs.All() {
+		if b.Damage != nil {
+			damaged = append(damaged, b)
+		}
+	}
+
+	sort.Slice(damaged, func(i, j int) bool {
+		return damaged[i].ID.Compare(damaged[j].ID) < 0
+	})
+
+	return damaged
+}
+
+// LastVerified returns when the backup was last verified. Backups that were
+// never verified count as verified when they were created, so new backups
+// aren't overdue right away.
+func (b *Backup) LastVerified() time.Time {
+	if b.VerifiedAt == nil {
+		return b.CreatedAt
+	}
+
+	return *b.VerifiedAt
+}
+
+// DueForVerification returns the backups a scheduled verification run should
+// verify: every backup not verified within maxAge, least recently verified
+// first, topped up with a random sample of the others until a sample fraction
+// of all backups is picked. maxAge is unlimited when 0.
+func (bs Backups) DueForVerification(sample float64, maxAge time.Duration, rng *rand.Rand) []*Backup {
+	slog.Debug("Getting backups due for verification", "sample", sample, "maxAge", maxAge)
+
+	var overdue, rest []*Backup
+	for _, b := range bs.All() {
+		if maxAge > 0 && b.LastVerified().Before(time.Now().Add(-maxAge)) {
+			overdue = append(overdue, b)
+		} else {
+			rest = append(rest, b)
+		}
+	}
+
+	sort.Slice(overdue, func(i, j int) bool {
+		return overdue[i].LastVerified().Before(overdue[j].LastVerified())
+	})
+
+	// Map iteration order isn't random enough to sample from.
+	sort.Slice(rest, func(i, j int) bool {
+		return rest[i].ID.Compare(rest[j].ID) < 0
+	})
+	rng.Shuffle(len(rest), func(i, j int) {
+		rest[i], rest[j] = rest[j], rest[i]
+	})
+
+	want := int(math.Ceil(sample * float64(bs.Len())))
+	due := overdue
+	for _, b := range rest {
+		if len(due) >= want {
+			break
+		}
+		due = append(due, b)
+	}
+
+	return due
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestDueForVerification(t *testing.T) {
+	now := time.Now()
+	verified := func(age time.Duration) *time.Time {
+		at := now.Add(-age)
+		return &at
+	}
+
+	overdue := ulid.Make()
+	moreOverdue := ulid.Make()
+	neverVerifiedOld := ulid.Make()
+
+	bs := NewBackups(
+		&Backup{ID: overdue, CreatedAt: now.Add(-200 * 24 * time.Hour), VerifiedAt: verified(100 * 24 * time.Hour)},
+		&Backup{ID: moreOverdue, CreatedAt: now.Add(-200 * 24 * time.Hour), VerifiedAt: verified(120 * 24 * time.Hour)},
+		&Backup{ID: neverVerifiedOld, CreatedAt: now.Add(-95 * 24 * time.Hour)},
+	)
+	for range 17 {
+		id := ulid.Make()
+		bs.Add(&Backup{ID: id, CreatedAt: now.Add(-24 * time.Hour)})
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	quarter := 90 * 24 * time.Hour
+
+	due := bs.DueForVerification(0.1, quarter, rng)
+	if len(due) != 3 {
+		t.Fatalf("expected every overdue backup even above the sample, got %d", len(due))
+	}
+	if due[0].ID != moreOverdue || due[1].ID != overdue || due[2].ID != neverVerifiedOld {
+		t.Fatalf("expected overdue backups least recently verified first, got %v %v %v", due[0].ID, due[1].ID, due[2].ID)
+	}
+
+	due = bs.DueForVerification(0.5, quarter, rng)
+	if len(due) != 10 {
+		t.Fatalf("expected half of the backups, got %d", len(due))
+	}
+	seen := map[ulid.ULID]bool{}
+	for _, b := range due {
+		if seen[b.ID] {
+			t.Fatalf("backup %s picked twice", b.ID)
+		}
+		seen[b.ID] = true
+	}
+
+	if due := bs.DueForVerification(0, 0, rng); len(due) != 0 {
+		t.Fatalf("expected nothing without a sample or max age, got %d", len(due))
+	}
+}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/storage"
+	"github.com/oklog/ulid/v2"
+)
+
+// Every store save also writes the store as saved to a version named by a
+// ULID, and deletes the oldest versions beyond the number kept. Unlike the
+// local copy, the versions live in the repository, so any host can roll the
+// store back to one after a destructive change.
+
+type storeVersionsKey struct{}
+
+// WithStoreVersions makes store saves in ctx also keep the last versions of
+// the store in the repository.
+func WithStoreVersions(ctx context.Context, cfg config.StoreVersions) context.Context {
+	return context.WithValue(ctx, storeVersionsKey{}, cfg)
+}
+
+func storeVersionsFromContext(ctx context.Context) (config.StoreVersions, bool) {
+	cfg, ok := ctx.Value(storeVersionsKey{}).(config.StoreVersions)
+	return cfg, ok && cfg.Keep > 0
+}
+
+// StoreVersion is an earlier version of the store kept in the repository.
+type StoreVersion struct {
+	ID ulid.ULID `json:"id"`
+	// Time is when the version was saved.
+	Time time.Time `json:"time"`
+}
+
+// saveStoreVersion writes content as a new version of the store, if versions
+// are kept, and deletes the oldest beyond the number kept. The versions are a
+// fallback, so failing to write them only warns.
+func saveStoreVersion(ctx context.Context, storage storage.StrongStore, content []byte) {
+	cfg, ok := storeVersionsFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	id := ulid.Make()
+	if err := storage.SaveStoreVersionContent(ctx, id.String(), content); err != nil {
+		slog.Warn("Failed to save a version of the store", "id", id, "error", err)
+		return
+	}
+	slog.Debug("Saved a version of the store", "id", id)
+
+	versions, err := ListStoreVersions(ctx, storage)
+	if err != nil {
+		slog.Warn("Failed to prune the versions of the store", "error", err)
+		return
+	}
+
+	for len(versions) > cfg.Keep {
+		slog.Debug("Deleting an old version of the store", "id", versions[0].ID)
+		if err := storage.DeleteStoreVersionContent(ctx, versions[0].ID.String()); err != nil {
+			slog.Warn("Failed to delete an old version of the store", "id", versions[0].ID, "error", err)
+			return
+		}
+		versions = versions[1:]
+	}
+}
+
+// ListStoreVersions lists the versions of the store kept in storage, oldest
+// first. Objects not named by a ULID are skipped.
+func ListStoreVersions(ctx context.Context, storage storage.StrongStore) ([]StoreVersion, error) {
+	ids, err := storage.ListStoreVersions(ctx)
+	if err != nil {
+		slog.Error("Failed to list store versions", "error", err)
+		return nil, fmt.Errorf("failed to list store versions: %w", err)
+	}
+
+	versions := make([]StoreVersion, 0, len(ids))
+	for _, name := range ids {
+		id, err := ulid.ParseStrict(name)
+		if err != nil {
+			slog.Warn("Skipping a store version that isn't named by a ULID", "name", name, "error", err)
+			continue
+		}
+		versions = append(versions, StoreVersion{ID: id, Time: ulid.Time(id.Time())})
+	}
+	slices.SortFunc(versions, func(a, b StoreVersion) int {
+		return a.ID.Compare(b.ID)
+	})
+
+	return versions, nil
+}
+
+// LoadStoreVersion loads a version of the store, checked like LoadStore
+// checks the store.
+func LoadStoreVersion(ctx context.Context, storage storage.StrongStore, id ulid.ULID) (*Store, error) {
+	slog.Debug("Loading store version", "id", id)
+
+	storeBytes, err := storage.LoadStoreVersionContent(ctx, id.String())
+	if err != nil {
+		slog.Error("Failed to load store version", "id", id, "error", err)
+		return nil, fmt.Errorf("failed to load store version %s: %w", id, err)
+	}
+
+	store, err := openStoreContent(ctx, storeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("store version %s: %w", id, err)
+	}
+
+	return store, nil
+}
+
+// RollBackTo replaces the content of the store with version's. The store
+// keeps its lease, and what the audit log compares the next save with, so
+// saving it records the backups and datasets the rollback changed. It also
+// keeps its encryption and retired recipients, so rolling back past a key
+// rotation doesn't make a retired recipient the recipient of new backups, and
+// its maintenance mode, which is only turned on or off on purpose.
+func (s *Store) RollBackTo(version *Store) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version.mu.RLock()
+	defer version.mu.RUnlock()
+
+	// Every persisted field of Store but the encryption and maintenance mode
+	// is copied.
+	s.Version = version.Version
+	s.CreatedAt = version.CreatedAt
+	s.Backups = version.Backups
+	s.Orphans = version.Orphans
+	s.ManagedDatasets = version.ManagedDatasets
+	s.ManagedSince = version.ManagedSince
+	s.Hash = version.Hash
+	s.Trash = version.Trash
+	s.unknownFields = version.unknownFields
+	s.hashMismatch = version.hashMismatch
+}
+
+// PendingChanges returns the audit entries the next save records, e.g. to
+// preview a rollback.
+func (s *Store) PendingChanges() []AuditEntry {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.auditChanges()
+}
@@ -0,0 +1,94 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/repository"
+	"github.com/gargakshit/zfsbackrest/repository/repositorytest"
+	"github.com/gargakshit/zfsbackrest/storage/storagetest"
+)
+
+func TestStoreVersions(t *testing.T) {
+	ctx := repository.WithOperation(context.Background(), "test")
+	s := storagetest.NewMemoryStore()
+
+	b := repositorytest.NewStore("tank/data")
+	kept := b.Full("tank/data", 48*time.Hour)
+	store, err := b.Save(ctx, s)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	listVersions := func(t *testing.T, want int) []repository.StoreVersion {
+		t.Helper()
+		versions, err := repository.ListStoreVersions(ctx, s)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(versions) != want {
+			t.Fatalf("expected %d versions, got %v", want, versions)
+		}
+		return versions
+	}
+
+	// No versions are kept without WithStoreVersions.
+	listVersions(t, 0)
+
+	ctx = repository.WithStoreVersions(ctx, config.StoreVersions{Keep: 2})
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	b.Trash(kept, 0)
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	versions := listVersions(t, 2)
+	if versions[0].ID.Compare(versions[1].ID) >= 0 || versions[0].Time.IsZero() {
+		t.Fatalf("expected the versions oldest first, got %v", versions)
+	}
+
+	version, err := repository.LoadStoreVersion(ctx, s, versions[0].ID)
+	if err != nil {
+		t.Fatalf("load version: %v", err)
+	}
+	if _, ok := version.Backups.Get(kept.ID); !ok {
+		t.Fatal("expected the version before the change to have the backup")
+	}
+
+	maintenance := repository.NewMaintenance("migrating the bucket")
+	store.Maintenance = maintenance
+	store.RollBackTo(version)
+	if store.Maintenance != maintenance {
+		t.Fatalf("expected the rollback to keep the maintenance mode, got %+v", store.Maintenance)
+	}
+	store.Maintenance = nil
+
+	changes := store.PendingChanges()
+	if len(changes) != 1 || changes[0].Action != repository.AuditBackupCreated || *changes[0].Backup != kept.ID {
+		t.Fatalf("expected the rollback to bring the backup back, got %+v", changes)
+	}
+	if err := store.Save(ctx, s); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// The oldest version is pruned by the save.
+	if after := listVersions(t, 2); after[0].ID != versions[1].ID {
+		t.Fatalf("expected the oldest version to be pruned, got %v", after)
+	}
+
+	loaded, err := repository.LoadStore(ctx, s)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := loaded.Backups.Get(kept.ID); !ok {
+		t.Fatal("expected the rolled back store to have the backup")
+	}
+	if _, err := repository.VerifyHistory(ctx, s, loaded); err != nil {
+		t.Fatalf("expected the history to match the rolled back store: %v", err)
+	}
+}
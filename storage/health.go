@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// ProbeDataset is the dataset of the object HealthCheck writes. It isn't a
+// valid dataset name, so it never clashes with a backup.
+const ProbeDataset = "zfsbackrest-probe"
+
+// Health is what HealthCheck found out about a store.
+type Health struct {
+	// Initialized is whether the store object exists. It doesn't in a cold
+	// bucket, or before the repository is initialized.
+	Initialized bool
+	// Snapshots is the number of snapshot objects.
+	Snapshots int
+	// Writable is whether a probe object was written, read back and deleted.
+	Writable bool
+	// Latency is how long the write round-trip took.
+	Latency time.Duration
+}
+
+// HealthCheck checks a store is usable: the bucket or container exists, the
+// credentials can list it and read the store, and, if write is set, a probe
+// object can be written, read back and deleted. It stops at the first
+// failure.
+func HealthCheck(ctx context.Context, s StrongStore, write bool) (*Health, error) {
+	health := &Health{}
+
+	objects, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return health, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	health.Snapshots = len(objects)
+
+	_, err = s.LoadStoreContent(ctx)
+	switch {
+	case errors.Is(err, errclass.ErrNotFound):
+	case err != nil:
+		return health, fmt.Errorf("failed to read the store: %w", err)
+	default:
+		health.Initialized = true
+	}
+
+	if !write {
+		return health, nil
+	}
+
+	start := time.Now()
+	if err := ProbeWrite(ctx, s); err != nil {
+		return health, err
+	}
+	health.Writable = true
+	health.Latency = time.Since(start)
+
+	return health, nil
+}
+
+// ProbeWrite writes a small object, reads it back and deletes it.
+func ProbeWrite(ctx context.Context, s StrongStore) error {
+	snapshot := time.Now().UTC().Format("20060102T150405.000000000Z")
+	content := []byte("zfsbackrest write probe " + snapshot + "\n")
+
+	slog.Debug("Writing probe object", "dataset", ProbeDataset, "snapshot", snapshot)
+
+	w, err := s.OpenSnapshotWriteStream(ctx, ProbeDataset, snapshot, int64(len(content)), encryption.Passthrough{})
+	if err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	r, err := s.OpenSnapshotReadStream(ctx, ProbeDataset, snapshot, encryption.Passthrough{})
+	if err == nil {
+		var read []byte
+		read, err = io.ReadAll(r)
+		_ = r.Close()
+		if err == nil && !bytes.Equal(read, content) {
+			err = fmt.Errorf("read back %d bytes that don't match the %d written", len(read), len(content))
+		}
+	}
+	if err != nil {
+		_ = s.DeleteSnapshot(ctx, ProbeDataset, snapshot)
+		return fmt.Errorf("failed to read back: %w", err)
+	}
+
+	if err := s.DeleteSnapshot(ctx, ProbeDataset, snapshot); err != nil {
+		return fmt.Errorf("failed to delete: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ToolVersion is recorded in the metadata of uploaded snapshots. It's set by
+// the command line.
+var ToolVersion = "unknown"
+
+// ObjectKind tells snapshot streams, backup manifests and checksums apart.
+type ObjectKind string
+
+const (
+	ObjectKindSnapshot ObjectKind = "snapshot"
+	ObjectKindManifest ObjectKind = "manifest"
+	ObjectKindChecksum ObjectKind = "checksum"
+)
+
+// SnapshotMetadata describes an object written through
+// OpenSnapshotWriteStream. Backends that support object metadata attach it
+// to the object, so bucket-side tooling, lifecycle rules and people browsing
+// the bucket can tell objects apart. It's informational only; zfsbackrest
+// never reads it back.
+type SnapshotMetadata struct {
+	Kind       ObjectKind
+	BackupID   string
+	Dataset    string
+	BackupType string
+	CreatedAt  time.Time
+	// Encrypted is set if the object is encrypted, which is true unless the
+	// repository is unencrypted. Streams opened with a passthrough
+	// encryption may still carry data that is already encrypted.
+	Encrypted bool
+}
+
+type snapshotMetadataKey struct{}
+
+// WithSnapshotMetadata attaches the metadata of the object about to be
+// written to ctx.
+func WithSnapshotMetadata(ctx context.Context, metadata SnapshotMetadata) context.Context {
+	return context.WithValue(ctx, snapshotMetadataKey{}, metadata)
+}
+
+// SnapshotMetadataFromContext returns the metadata attached to ctx.
+func SnapshotMetadataFromContext(ctx context.Context) (SnapshotMetadata, bool) {
+	metadata, ok := ctx.Value(snapshotMetadataKey{}).(SnapshotMetadata)
+	return metadata, ok
+}
+
+// ContentType returns the content type of the object.
+func (m SnapshotMetadata) ContentType() string {
+	switch {
+	case m.Encrypted:
+		return "application/x-age-encryption"
+	case m.Kind == ObjectKindManifest:
+		return "application/json"
+	case m.Kind == ObjectKindChecksum:
+		return "text/plain"
+	case m.Kind == ObjectKindSnapshot:
+		return "application/x-zfs-send-stream"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// Fields returns the metadata as key-value pairs, with lowercase keys
+// suitable for S3 user metadata and Swift object metadata. Empty fields are
+// left out.
+func (m SnapshotMetadata) Fields() map[string]string {
+	fields := map[string]string{
+		"zfsbackrest-version": ToolVersion,
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+
+	set("object-kind", string(m.Kind))
+	set("backup-id", m.BackupID)
+	set("dataset", m.Dataset)
+	set("backup-type", m.BackupType)
+	if !m.CreatedAt.IsZero() {
+		set("created-at", m.CreatedAt.UTC().Format(time.RFC3339))
+	}
+
+	return fields
+}
+
+// snapshotMetadata returns the metadata attached to ctx, or only the tool
+// version and a generic content type if there is none.
+func snapshotMetadata(ctx context.Context) SnapshotMetadata {
+	metadata, _ := SnapshotMetadataFromContext(ctx)
+	return metadata
+}
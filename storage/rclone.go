@@ -0,0 +1,621 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// rclone exit codes for a missing directory and a missing file.
+const (
+	rcloneExitDirNotFound  = 3
+	rcloneExitFileNotFound = 4
+)
+
+// RcloneStrongStorage is a storage implementation backed by any rclone remote,
+// by running the rclone binary. rclone adds no consistency guarantees of its
+// own, so the remote must provide read-after-write consistency for new
+// objects and overwrites, which is what the store requires. Most object
+// stores do; eventually consistent remotes can lose store updates.
+type RcloneStrongStorage struct {
+	rcloneConfig *config.RcloneStore
+	binary       string
+}
+
+func NewRcloneStrongStorage(ctx context.Context, rcloneConfig *config.RcloneStore) (*RcloneStrongStorage, error) {
+	slog.Debug("Creating rclone strong storage", "remote", rcloneConfig.Remote)
+
+	if rcloneConfig.Remote == "" {
+		return nil, &errclass.ConfigError{Key: "repository.rclone.remote", Err: errors.New("required")}
+	}
+
+	if !strings.Contains(rcloneConfig.Remote, ":") {
+		return nil, &errclass.ConfigError{
+			Key: "repository.rclone.remote",
+			Err: fmt.Errorf("%q is not an rclone remote, expected e.g. \"b2:zfsbackrest\"", rcloneConfig.Remote),
+		}
+	}
+
+	binary, err := exec.LookPath(rcloneConfig.Binary)
+	if err != nil {
+		return nil, &errclass.ConfigError{Key: "repository.rclone.binary", Err: err}
+	}
+
+	s := &RcloneStrongStorage{
+		rcloneConfig: rcloneConfig,
+		binary:       binary,
+	}
+
+	// List the remote eagerly so misconfiguration fails fast. A remote
+	// without a repository yet is fine.
+	_, err = s.run(ctx, "list", "", nil, "lsjson", "--max-depth", "1", s.remotePath(""))
+	if err != nil && !errors.Is(err, errclass.ErrNotFound) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *RcloneStrongStorage) LoadStoreContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, storePath)
+}
+
+func (s *RcloneStrongStorage) SaveStoreContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, storePath, content)
+}
+
+func (s *RcloneStrongStorage) LoadHistoryContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, historyPath)
+}
+
+func (s *RcloneStrongStorage) SaveHistoryContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, historyPath, content)
+}
+
+func (s *RcloneStrongStorage) LoadKeyEscrowContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, keyEscrowPath)
+}
+
+func (s *RcloneStrongStorage) SaveKeyEscrowContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, keyEscrowPath, content)
+}
+
+func (s *RcloneStrongStorage) LoadAuditContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, auditPath)
+}
+
+func (s *RcloneStrongStorage) SaveAuditContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, auditPath, content)
+}
+
+func (s *RcloneStrongStorage) LoadJournalContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, journalPath)
+}
+
+func (s *RcloneStrongStorage) SaveJournalContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, journalPath, content)
+}
+
+func (s *RcloneStrongStorage) DeleteJournalContent(ctx context.Context) error {
+	return s.deleteObject(ctx, journalPath)
+}
+
+func (s *RcloneStrongStorage) SaveLockContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, lockPath(id), content)
+}
+
+func (s *RcloneStrongStorage) SaveStoreVersionContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, storeVersionPath(id), content)
+}
+
+func (s *RcloneStrongStorage) LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error) {
+	return s.loadObject(ctx, storeVersionPath(id))
+}
+
+func (s *RcloneStrongStorage) ListStoreVersions(ctx context.Context) ([]string, error) {
+	return s.listIDs(ctx, storeVersionPrefix)
+}
+
+func (s *RcloneStrongStorage) DeleteStoreVersionContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, storeVersionPath(id))
+}
+
+func (s *RcloneStrongStorage) LoadLockContents(ctx context.Context) (map[string][]byte, error) {
+	ids, err := s.listIDs(ctx, lockPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	locks := map[string][]byte{}
+	for _, id := range ids {
+		content, err := s.loadObject(ctx, lockPath(id))
+		if errors.Is(err, errclass.ErrNotFound) {
+			// Released since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		locks[id] = content
+	}
+
+	return locks, nil
+}
+
+func (s *RcloneStrongStorage) DeleteLockContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, lockPath(id))
+}
+
+// listIDs lists the IDs of the objects directly under prefix.
+func (s *RcloneStrongStorage) listIDs(ctx context.Context, prefix string) ([]string, error) {
+	slog.Debug("Listing objects", "remote", s.rcloneConfig.Remote, "prefix", prefix)
+
+	entries, err := s.list(ctx, strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := parseObjectID(prefix, prefix+entry.Path); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// deleteObject deletes the object at objectPath. Deleting a missing object
+// succeeds.
+func (s *RcloneStrongStorage) deleteObject(ctx context.Context, objectPath string) error {
+	slog.Debug("Deleting object", "remote", s.rcloneConfig.Remote, "path", objectPath)
+
+	_, err := s.run(ctx, "delete", objectPath, nil, "deletefile", s.remotePath(objectPath))
+	if err != nil && !errors.Is(err, errclass.ErrNotFound) {
+		slog.Error("Failed to delete object", "path", objectPath, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *RcloneStrongStorage) loadObject(ctx context.Context, objectPath string) ([]byte, error) {
+	slog.Debug("Loading object", "remote", s.rcloneConfig.Remote, "path", objectPath)
+
+	content, err := s.run(ctx, "get", objectPath, nil, "cat", s.remotePath(objectPath))
+	if err != nil {
+		slog.Error("Failed to get object", "path", objectPath, "error", err)
+		return nil, err
+	}
+
+	// Depending on the remote, rclone cat of a missing file may succeed with
+	// no output. Tell it apart from an empty object.
+	if len(content) == 0 {
+		if _, err := s.run(ctx, "stat", objectPath, nil, "lsjson", "--stat", s.remotePath(objectPath)); err != nil {
+			return nil, err
+		}
+	}
+
+	return content, nil
+}
+
+func (s *RcloneStrongStorage) saveObject(ctx context.Context, objectPath string, content []byte) error {
+	slog.Debug("Saving object", "remote", s.rcloneConfig.Remote, "path", objectPath)
+
+	_, err := s.run(ctx, "put", objectPath, bytes.NewReader(content), "rcat", s.remotePath(objectPath))
+	if err != nil {
+		slog.Error("Failed to save object", "path", objectPath, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *RcloneStrongStorage) OpenSnapshotWriteStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	size int64,
+	encryption encryption.Encryption,
+) (io.WriteCloser, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Opening snapshot write stream", "remote", s.rcloneConfig.Remote, "path", filePath)
+
+	// rcat commits the object once its stdin is closed. Cancelling the
+	// context kills rclone instead, so a failed upload is never committed.
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := s.command(ctx, "rcat", s.remotePath(filePath))
+
+	w := &rcloneWriteCloser{s: s, path: filePath, cmd: cmd, cancel: cancel}
+	cmd.Stderr = &w.stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, s.storageError("put", filePath, err)
+	}
+	w.stdin = stdin
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		slog.Error("Failed to start rclone", "error", err)
+		return nil, s.storageError("put", filePath, err)
+	}
+
+	w.enc, err = encryption.EncryptedWriter(stdin)
+	if err != nil {
+		w.abort()
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+
+	return w, nil
+}
+
+func (s *RcloneStrongStorage) OpenSnapshotReadStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	encryption encryption.Encryption,
+) (io.ReadCloser, error) {
+	r, err := s.openSnapshotReader(ctx, dataset, snapshot, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedReader, err := encryption.DecryptedReader(r)
+	if err != nil {
+		// The header couldn't be read because rclone failed, e.g. because
+		// the snapshot doesn't exist.
+		rcloneErr := r.err
+		_ = r.Close()
+		if rcloneErr != nil {
+			slog.Error("Failed to get snapshot", "error", rcloneErr)
+			return nil, rcloneErr
+		}
+
+		slog.Error("Failed to decrypt snapshot", "error", err)
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return wrappedReader, nil
+}
+
+var _ RangeReadStore = (*RcloneStrongStorage)(nil)
+
+func (s *RcloneStrongStorage) OpenSnapshotReadStreamAt(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	offset int64,
+) (io.ReadCloser, error) {
+	return s.openSnapshotReader(ctx, dataset, snapshot, offset)
+}
+
+func (s *RcloneStrongStorage) openSnapshotReader(ctx context.Context, dataset string, snapshot string, offset int64) (*rcloneReader, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Opening snapshot read stream", "remote", s.rcloneConfig.Remote, "path", filePath, "offset", offset)
+
+	args := []string{s.remotePath(filePath)}
+	if offset > 0 {
+		args = append(args, "--offset", strconv.FormatInt(offset, 10))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := s.command(ctx, "cat", args...)
+
+	r := &rcloneReader{s: s, path: filePath, cmd: cmd, cancel: cancel}
+	cmd.Stderr = &r.stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, s.storageError("get", filePath, err)
+	}
+	r.stdout = stdout
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		slog.Error("Failed to start rclone", "error", err)
+		return nil, s.storageError("get", filePath, err)
+	}
+
+	return r, nil
+}
+
+func (s *RcloneStrongStorage) DeleteSnapshot(ctx context.Context, dataset string, snapshot string) error {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Deleting snapshot", "remote", s.rcloneConfig.Remote, "path", filePath)
+
+	_, err := s.run(ctx, "delete", filePath, nil, "deletefile", s.remotePath(filePath))
+	if err != nil {
+		if errors.Is(err, errclass.ErrNotFound) {
+			slog.Debug("Snapshot already deleted", "path", filePath)
+			return nil
+		}
+
+		slog.Error("Failed to delete snapshot", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *RcloneStrongStorage) ListSnapshots(ctx context.Context) ([]SnapshotObject, error) {
+	return s.listSnapshots(ctx, snapshotPrefix)
+}
+
+func (s *RcloneStrongStorage) ListSnapshotObjects(ctx context.Context, dataset string) ([]SnapshotObject, error) {
+	objects, err := s.listSnapshots(ctx, snapshotDatasetPrefix(dataset))
+	if err != nil {
+		return nil, err
+	}
+
+	return datasetSnapshots(objects, dataset), nil
+}
+
+func (s *RcloneStrongStorage) StatSnapshot(ctx context.Context, dataset string, snapshot string) (SnapshotObject, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Getting snapshot info", "remote", s.rcloneConfig.Remote, "path", filePath)
+
+	output, err := s.run(ctx, "stat", filePath, nil,
+		"lsjson", "--stat", "--no-mimetype", "--no-modtime", s.remotePath(filePath))
+	if err != nil {
+		return SnapshotObject{}, err
+	}
+
+	var entry struct {
+		Size  int64 `json:"Size"`
+		IsDir bool  `json:"IsDir"`
+	}
+	if err := json.Unmarshal(output, &entry); err != nil {
+		return SnapshotObject{}, s.storageError("stat", filePath, err)
+	}
+	if entry.IsDir {
+		return SnapshotObject{}, &errclass.StorageError{Op: "stat", Backend: "rclone", Path: filePath, NotFound: true, Err: errclass.ErrNotFound}
+	}
+
+	return SnapshotObject{Dataset: dataset, Snapshot: snapshot, Size: entry.Size}, nil
+}
+
+// listSnapshots lists the snapshot objects under prefix, which ends with a
+// slash.
+func (s *RcloneStrongStorage) listSnapshots(ctx context.Context, prefix string) ([]SnapshotObject, error) {
+	slog.Debug("Listing snapshots", "remote", s.rcloneConfig.Remote, "prefix", prefix)
+
+	entries, err := s.list(ctx, strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []SnapshotObject
+	for _, entry := range entries {
+		object, ok := parseSnapshotPath(prefix + entry.Path)
+		if !ok {
+			continue
+		}
+
+		object.Size = entry.Size
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+var _ ObjectLister = (*RcloneStrongStorage)(nil)
+
+func (s *RcloneStrongStorage) ListObjects(ctx context.Context) ([]Object, error) {
+	slog.Debug("Listing objects", "remote", s.rcloneConfig.Remote)
+
+	return s.list(ctx, "")
+}
+
+// list lists the files under dir recursively, with paths relative to dir. A
+// missing dir has no files.
+func (s *RcloneStrongStorage) list(ctx context.Context, dir string) ([]Object, error) {
+	output, err := s.run(ctx, "list", dir, nil,
+		"lsjson", "--recursive", "--files-only", "--no-mimetype", "--no-modtime", s.remotePath(dir))
+	if err != nil {
+		if errors.Is(err, errclass.ErrNotFound) {
+			return nil, nil
+		}
+
+		slog.Error("Failed to list objects", "dir", dir, "error", err)
+		return nil, err
+	}
+
+	var entries []struct {
+		Path string `json:"Path"`
+		Size int64  `json:"Size"`
+	}
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return nil, s.storageError("list", dir, err)
+	}
+
+	objects := make([]Object, 0, len(entries))
+	for _, entry := range entries {
+		objects = append(objects, Object{Path: entry.Path, Size: entry.Size})
+	}
+
+	return objects, nil
+}
+
+// remotePath is the rclone path of an object, or of the remote itself if
+// objectPath is empty.
+func (s *RcloneStrongStorage) remotePath(objectPath string) string {
+	remote := s.rcloneConfig.Remote
+	if objectPath == "" || strings.HasSuffix(remote, ":") || strings.HasSuffix(remote, "/") {
+		return remote + objectPath
+	}
+
+	return remote + "/" + objectPath
+}
+
+// command builds an rclone command. The configured flags go after the
+// subcommand, where rclone accepts both global and subcommand flags.
+func (s *RcloneStrongStorage) command(ctx context.Context, subcommand string, args ...string) *exec.Cmd {
+	fullArgs := []string{subcommand}
+	if s.rcloneConfig.ConfigFile != "" {
+		fullArgs = append(fullArgs, "--config", s.rcloneConfig.ConfigFile)
+	}
+	fullArgs = append(fullArgs, s.rcloneConfig.Flags...)
+	fullArgs = append(fullArgs, args...)
+
+	slog.Debug("Running rclone command", "args", fullArgs)
+	return exec.CommandContext(ctx, s.binary, fullArgs...)
+}
+
+// run runs an rclone command to completion and returns its output.
+func (s *RcloneStrongStorage) run(
+	ctx context.Context,
+	op string,
+	objectPath string,
+	stdin io.Reader,
+	subcommand string,
+	args ...string,
+) ([]byte, error) {
+	cmd := s.command(ctx, subcommand, args...)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, s.commandError(op, objectPath, err, stderr.Bytes())
+	}
+
+	return output, nil
+}
+
+// commandError turns a failed rclone command into a StorageError, with the
+// last line rclone logged, which is usually the reason it failed.
+func (s *RcloneStrongStorage) commandError(op string, objectPath string, err error, stderr []byte) error {
+	msg := strings.TrimSpace(string(stderr))
+	if i := strings.LastIndexByte(msg, '\n'); i >= 0 {
+		msg = msg[i+1:]
+	}
+
+	notFound := strings.Contains(strings.ToLower(msg), "not found")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		notFound = notFound || code == rcloneExitDirNotFound || code == rcloneExitFileNotFound
+	}
+
+	if msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+
+	return &errclass.StorageError{Op: op, Backend: "rclone", Path: objectPath, NotFound: notFound, Err: err}
+}
+
+func (s *RcloneStrongStorage) storageError(op string, objectPath string, err error) error {
+	return &errclass.StorageError{Op: op, Backend: "rclone", Path: objectPath, Err: err}
+}
+
+// rcloneWriteCloser encrypts a snapshot into the stdin of rclone rcat.
+type rcloneWriteCloser struct {
+	s      *RcloneStrongStorage
+	path   string
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	enc    io.WriteCloser
+}
+
+func (w *rcloneWriteCloser) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *rcloneWriteCloser) Close() error {
+	// Close the encryption stream first to flush and finalize. If that fails,
+	// rclone must not see the end of its input, or we'd commit a truncated
+	// object.
+	if err := w.enc.Close(); err != nil {
+		w.abort()
+		return err
+	}
+
+	if err := w.stdin.Close(); err != nil {
+		w.abort()
+		return w.s.storageError("put", w.path, err)
+	}
+
+	err := w.cmd.Wait()
+	w.cancel()
+	if err != nil {
+		slog.Error("Failed to upload snapshot", "path", w.path, "error", err)
+		return w.s.commandError("put", w.path, err, w.stderr.Bytes())
+	}
+
+	return nil
+}
+
+// abort kills rclone before it sees the end of its input.
+func (w *rcloneWriteCloser) abort() {
+	w.cancel()
+	_ = w.stdin.Close()
+	_ = w.cmd.Wait()
+}
+
+// rcloneReader reads the stdout of rclone cat. When the output ends, it waits
+// for rclone, and returns its error instead of io.EOF if it failed.
+type rcloneReader struct {
+	s      *RcloneStrongStorage
+	path   string
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+
+	waited bool
+	err    error
+}
+
+func (r *rcloneReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		if waitErr := r.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+func (r *rcloneReader) wait() error {
+	if r.waited {
+		return r.err
+	}
+	r.waited = true
+
+	if err := r.cmd.Wait(); err != nil {
+		r.err = r.s.commandError("get", r.path, err, r.stderr.Bytes())
+	}
+	r.cancel()
+
+	return r.err
+}
+
+// Close stops rclone if the stream wasn't read to the end.
+func (r *rcloneReader) Close() error {
+	if !r.waited {
+		r.cancel()
+		_ = r.wait()
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+)
+
+// resumingReader reads a snapshot object from a RangeReadStore, and reopens
+// it at the offset it stopped at when a read fails with a transient error, so
+// a dropped connection doesn't restart a download of hundreds of gigabytes.
+type resumingReader struct {
+	ctx      context.Context
+	store    RangeReadStore
+	dataset  string
+	snapshot string
+	config   config.StorageRetry
+
+	reader io.ReadCloser
+	offset int64
+	// retries counts the failures since the last successful read.
+	retries int
+	// err is the error the download gave up with.
+	err error
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		n, err := r.reader.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+
+		if err == nil || err == io.EOF || r.ctx.Err() != nil || !transientError(err) || r.retries >= r.config.MaxRetries {
+			return n, err
+		}
+
+		if err := r.resume(err); err != nil {
+			r.err = err
+			return n, err
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the object at the offset read so far, after the read failed
+// with cause.
+func (r *resumingReader) resume(cause error) error {
+	_ = r.reader.Close()
+	r.reader = nil
+
+	for {
+		wait := r.config.InitialWait
+		for range r.retries {
+			wait *= 2
+			if r.config.MaxWait > 0 && wait >= r.config.MaxWait {
+				wait = r.config.MaxWait
+				break
+			}
+		}
+		r.retries++
+
+		slog.Warn("Snapshot download failed, resuming",
+			"dataset", r.dataset, "snapshot", r.snapshot, "offset", r.offset,
+			"attempt", r.retries, "max_retries", r.config.MaxRetries, "wait", wait, "error", cause)
+
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return cause
+		}
+
+		reader, err := r.store.OpenSnapshotReadStreamAt(r.ctx, r.dataset, r.snapshot, r.offset)
+		if err == nil {
+			r.reader = reader
+			return nil
+		}
+
+		if r.ctx.Err() != nil || !transientError(err) || r.retries >= r.config.MaxRetries {
+			return err
+		}
+		cause = err
+	}
+}
+
+func (r *resumingReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
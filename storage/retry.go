@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7"
+)
+
+// RetryStore retries the calls of a StrongStore that fail with a transient
+// error, with exponential backoff, and bounds each attempt with a timeout.
+// Writes of snapshot streams aren't retried, only opening them, as an upload
+// can't be resumed where it failed. Reads are resumed at the offset they
+// failed at if the store is a RangeReadStore.
+//
+// The optional interfaces of the wrapped store, like ArchiveStore, are found
+// with As.
+type RetryStore struct {
+	store  StrongStore
+	config config.StorageRetry
+}
+
+var _ StrongStore = (*RetryStore)(nil)
+
+// NewRetryStore wraps s with the retry policy. It returns s as is if retries
+// and timeouts are disabled.
+func NewRetryStore(s StrongStore, retryConfig config.StorageRetry) StrongStore {
+	if retryConfig.MaxRetries <= 0 && retryConfig.Timeout <= 0 {
+		return s
+	}
+
+	return &RetryStore{store: s, config: retryConfig}
+}
+
+// Unwrap returns the wrapped store.
+func (r *RetryStore) Unwrap() StrongStore {
+	return r.store
+}
+
+// As finds the first store in the chain of wrapped stores starting at s that
+// implements T, the way errors.As finds an error. Use it instead of a type
+// assertion to check for an optional interface, like ArchiveStore.
+func As[T any](s StrongStore) (T, bool) {
+	for s != nil {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+
+		wrapper, ok := s.(interface{ Unwrap() StrongStore })
+		if !ok {
+			break
+		}
+		s = wrapper.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+func (r *RetryStore) LoadStoreContent(ctx context.Context) ([]byte, error) {
+	return retryValue(ctx, r, "load store", true, r.store.LoadStoreContent)
+}
+
+func (r *RetryStore) SaveStoreContent(ctx context.Context, content []byte) error {
+	return r.retry(ctx, "save store", true, func(ctx context.Context) error {
+		return r.store.SaveStoreContent(ctx, content)
+	})
+}
+
+func (r *RetryStore) LoadHistoryContent(ctx context.Context) ([]byte, error) {
+	return retryValue(ctx, r, "load history", true, r.store.LoadHistoryContent)
+}
+
+func (r *RetryStore) SaveHistoryContent(ctx context.Context, content []byte) error {
+	return r.retry(ctx, "save history", true, func(ctx context.Context) error {
+		return r.store.SaveHistoryContent(ctx, content)
+	})
+}
+
+func (r *RetryStore) LoadKeyEscrowContent(ctx context.Context) ([]byte, error) {
+	return retryValue(ctx, r, "load key escrow", true, r.store.LoadKeyEscrowContent)
+}
+
+func (r *RetryStore) SaveKeyEscrowContent(ctx context.Context, content []byte) error {
+	return r.retry(ctx, "save key escrow", true, func(ctx context.Context) error {
+		return r.store.SaveKeyEscrowContent(ctx, content)
+	})
+}
+
+func (r *RetryStore) LoadAuditContent(ctx context.Context) ([]byte, error) {
+	return retryValue(ctx, r, "load audit log", true, r.store.LoadAuditContent)
+}
+
+func (r *RetryStore) SaveAuditContent(ctx context.Context, content []byte) error {
+	return r.retry(ctx, "save audit log", true, func(ctx context.Context) error {
+		return r.store.SaveAuditContent(ctx, content)
+	})
+}
+
+func (r *RetryStore) LoadJournalContent(ctx context.Context) ([]byte, error) {
+	return retryValue(ctx, r, "load journal", true, r.store.LoadJournalContent)
+}
+
+func (r *RetryStore) SaveJournalContent(ctx context.Context, content []byte) error {
+	return r.retry(ctx, "save journal", true, func(ctx context.Context) error {
+		return r.store.SaveJournalContent(ctx, content)
+	})
+}
+
+func (r *RetryStore) DeleteJournalContent(ctx context.Context) error {
+	return r.retry(ctx, "delete journal", true, r.store.DeleteJournalContent)
+}
+
+func (r *RetryStore) SaveStoreVersionContent(ctx context.Context, id string, content []byte) error {
+	return r.retry(ctx, "save store version", true, func(ctx context.Context) error {
+		return r.store.SaveStoreVersionContent(ctx, id, content)
+	})
+}
+
+func (r *RetryStore) LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error) {
+	return retryValue(ctx, r, "load store version", true, func(ctx context.Context) ([]byte, error) {
+		return r.store.LoadStoreVersionContent(ctx, id)
+	})
+}
+
+func (r *RetryStore) ListStoreVersions(ctx context.Context) ([]string, error) {
+	return retryValue(ctx, r, "list store versions", true, r.store.ListStoreVersions)
+}
+
+func (r *RetryStore) DeleteStoreVersionContent(ctx context.Context, id string) error {
+	return r.retry(ctx, "delete store version", true, func(ctx context.Context) error {
+		return r.store.DeleteStoreVersionContent(ctx, id)
+	})
+}
+
+func (r *RetryStore) SaveLockContent(ctx context.Context, id string, content []byte) error {
+	return r.retry(ctx, "save lock", true, func(ctx context.Context) error {
+		return r.store.SaveLockContent(ctx, id, content)
+	})
+}
+
+func (r *RetryStore) LoadLockContents(ctx context.Context) (map[string][]byte, error) {
+	return retryValue(ctx, r, "load locks", true, r.store.LoadLockContents)
+}
+
+func (r *RetryStore) DeleteLockContent(ctx context.Context, id string) error {
+	return r.retry(ctx, "delete lock", true, func(ctx context.Context) error {
+		return r.store.DeleteLockContent(ctx, id)
+	})
+}
+
+// OpenSnapshotWriteStream retries opening the stream. The stream's context
+// outlives the call, so the attempts aren't bounded by the timeout.
+func (r *RetryStore) OpenSnapshotWriteStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	size int64,
+	encryption encryption.Encryption,
+) (io.WriteCloser, error) {
+	return retryValue(ctx, r, "open snapshot write stream", false, func(ctx context.Context) (io.WriteCloser, error) {
+		return r.store.OpenSnapshotWriteStream(ctx, dataset, snapshot, size, encryption)
+	})
+}
+
+// OpenSnapshotReadStream retries opening the stream. The stream's context
+// outlives the call, so the attempts aren't bounded by the timeout. If the
+// store supports ranged reads, the download also resumes where it stopped
+// when a read fails.
+func (r *RetryStore) OpenSnapshotReadStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	enc encryption.Encryption,
+) (io.ReadCloser, error) {
+	store, ok := As[RangeReadStore](r.store)
+	if !ok {
+		return retryValue(ctx, r, "open snapshot read stream", false, func(ctx context.Context) (io.ReadCloser, error) {
+			return r.store.OpenSnapshotReadStream(ctx, dataset, snapshot, enc)
+		})
+	}
+
+	reader, err := r.openResumingReader(ctx, store, dataset, snapshot, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedReader, err := enc.DecryptedReader(reader)
+	if err != nil {
+		slog.Error("Failed to decrypt snapshot", "error", err)
+		_ = reader.Close()
+		var storageErr *errclass.StorageError
+		if errors.As(err, &storageErr) {
+			return nil, storageErr
+		}
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return wrappedReader, nil
+}
+
+// openResumingReader retries opening the stream at offset, and resumes it
+// where it stopped when a read fails with a transient error.
+func (r *RetryStore) openResumingReader(
+	ctx context.Context,
+	store RangeReadStore,
+	dataset string,
+	snapshot string,
+	offset int64,
+) (io.ReadCloser, error) {
+	reader, err := retryValue(ctx, r, "open snapshot read stream", false, func(ctx context.Context) (io.ReadCloser, error) {
+		return store.OpenSnapshotReadStreamAt(ctx, dataset, snapshot, offset)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumingReader{
+		ctx:      ctx,
+		store:    store,
+		dataset:  dataset,
+		snapshot: snapshot,
+		config:   r.config,
+		reader:   reader,
+		offset:   offset,
+	}, nil
+}
+
+func (r *RetryStore) DeleteSnapshot(ctx context.Context, dataset string, snapshot string) error {
+	return r.retry(ctx, "delete snapshot", true, func(ctx context.Context) error {
+		return r.store.DeleteSnapshot(ctx, dataset, snapshot)
+	})
+}
+
+func (r *RetryStore) ListSnapshots(ctx context.Context) ([]SnapshotObject, error) {
+	return retryValue(ctx, r, "list snapshots", true, r.store.ListSnapshots)
+}
+
+func (r *RetryStore) ListSnapshotObjects(ctx context.Context, dataset string) ([]SnapshotObject, error) {
+	return retryValue(ctx, r, "list snapshot objects", true, func(ctx context.Context) ([]SnapshotObject, error) {
+		return r.store.ListSnapshotObjects(ctx, dataset)
+	})
+}
+
+func (r *RetryStore) StatSnapshot(ctx context.Context, dataset string, snapshot string) (SnapshotObject, error) {
+	return retryValue(ctx, r, "stat snapshot", true, func(ctx context.Context) (SnapshotObject, error) {
+		return r.store.StatSnapshot(ctx, dataset, snapshot)
+	})
+}
+
+func (r *RetryStore) retry(ctx context.Context, op string, timeout bool, fn func(ctx context.Context) error) error {
+	_, err := retryValue(ctx, r, op, timeout, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// retryValue calls fn until it succeeds, fails with an error retrying doesn't
+// fix, or runs out of retries. If timeout is set, each attempt is bounded by
+// the configured timeout.
+func retryValue[T any](ctx context.Context, r *RetryStore, op string, timeout bool, fn func(ctx context.Context) (T, error)) (T, error) {
+	wait := r.config.InitialWait
+
+	for attempt := 0; ; attempt++ {
+		value, err := retryAttempt(ctx, r, timeout, fn)
+		if err == nil {
+			return value, nil
+		}
+
+		if ctx.Err() != nil || !transientError(err) || attempt >= r.config.MaxRetries {
+			return value, err
+		}
+
+		slog.Warn("Storage call failed, retrying", "op", op, "attempt", attempt+1, "max_retries", r.config.MaxRetries, "wait", wait, "error", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return value, err
+		}
+
+		wait *= 2
+		if r.config.MaxWait > 0 {
+			wait = min(wait, r.config.MaxWait)
+		}
+	}
+}
+
+// retryAttempt calls fn once, bounded by the configured timeout if timeout is
+// set.
+func retryAttempt[T any](ctx context.Context, r *RetryStore, timeout bool, fn func(ctx context.Context) (T, error)) (T, error) {
+	if !timeout || r.config.Timeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	return fn(ctx)
+}
+
+// transientError reports whether err may go away on retry. Missing objects,
+// and the errors of a request the backend rejected, like a denied request,
+// don't.
+func transientError(err error) bool {
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, errclass.ErrNotFound) ||
+		errors.Is(err, errclass.ErrConfig) ||
+		errors.Is(err, errclass.ErrValidation) ||
+		errors.Is(err, errclass.ErrEncryption) {
+		return false
+	}
+
+	statusCode := 0
+	var s3Err minio.ErrorResponse
+	var httpErr *httpStatusError
+	switch {
+	case errors.As(err, &s3Err):
+		statusCode = s3Err.StatusCode
+	case errors.As(err, &httpErr):
+		statusCode = httpErr.StatusCode
+	}
+
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+
+	return statusCode < 400 || statusCode >= 500
+}
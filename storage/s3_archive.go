@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrRetrievalTimeout is returned when an archived snapshot did not become
+// readable within the configured retrieval timeout.
+var ErrRetrievalTimeout = errors.New("timed out waiting for archived snapshot retrieval")
+
+// ErrSnapshotArchived is returned when reading a snapshot in an archive tier
+// that wasn't retrieved, or whose retrieved copy expired.
+var ErrSnapshotArchived = errors.New("snapshot is archived and has to be retrieved before it can be read")
+
+// archiveStorageClasses are the S3 storage classes whose objects must be
+// restored before they can be read.
+var archiveStorageClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+func validateS3Retrieval(retrieval *config.S3Retrieval) error {
+	switch minio.TierType(retrieval.Tier) {
+	case "", minio.TierStandard, minio.TierBulk, minio.TierExpedited:
+	default:
+		return &errclass.ConfigError{
+			Key: "repository.s3.retrieval.tier",
+			Err: fmt.Errorf("unknown tier %q. Valid values are: Expedited, Standard, Bulk", retrieval.Tier),
+		}
+	}
+
+	if retrieval.Days < 0 {
+		return &errclass.ConfigError{Key: "repository.s3.retrieval.days", Err: errors.New("must not be negative")}
+	}
+
+	return nil
+}
+
+// RetrieveSnapshot makes a snapshot in an archive storage class readable by
+// issuing an S3 restore request. It does nothing for snapshots that are
+// readable already, and never issues a second request for a retrieval that
+// is in progress.
+func (s *S3StrongStorage) RetrieveSnapshot(ctx context.Context, dataset string, snapshot string, wait bool) error {
+	filePath := s.filePath(dataset, snapshot)
+	retrieval := &s.s3Config.Retrieval
+	deadline := time.Now().Add(retrieval.Timeout)
+
+	for {
+		info, err := s.mc.StatObject(ctx, s.s3Config.Bucket, filePath, minio.StatObjectOptions{})
+		if err != nil {
+			slog.Error("Failed to stat snapshot", "error", err)
+			return s.storageError("stat", filePath, err)
+		}
+
+		archived, readable := s3ArchiveState(&info)
+		if !archived || readable {
+			slog.Debug("Snapshot is readable", "path", filePath, "storageClass", info.StorageClass)
+			return nil
+		}
+
+		if info.Restore == nil {
+			if err := s.requestRetrieval(ctx, filePath, &info); err != nil {
+				return err
+			}
+		}
+
+		if !wait {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return s.storageError("retrieve", filePath, fmt.Errorf("%w after %s", ErrRetrievalTimeout, retrieval.Timeout))
+		}
+
+		slog.Info("Waiting for archived snapshot to be retrieved",
+			"path", filePath,
+			"storageClass", info.StorageClass,
+			"tier", retrieval.Tier,
+			"next_check", retrieval.PollInterval,
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retrieval.PollInterval):
+		}
+	}
+}
+
+func (s *S3StrongStorage) requestRetrieval(ctx context.Context, filePath string, info *minio.ObjectInfo) error {
+	retrieval := &s.s3Config.Retrieval
+	tier := minio.TierType(retrieval.Tier)
+	if tier == "" {
+		tier = minio.TierStandard
+	}
+
+	req := minio.RestoreRequest{}
+	// Intelligent-Tiering archive tiers restore into the frequent access tier,
+	// so they take neither a number of days nor a retrieval tier.
+	if archiveStorageClasses[info.StorageClass] {
+		req.SetDays(max(retrieval.Days, 1))
+		req.SetGlacierJobParameters(minio.GlacierJobParameters{Tier: tier})
+	}
+
+	slog.Info("Requesting retrieval of archived snapshot", "path", filePath, "storageClass", info.StorageClass, "tier", tier)
+
+	err := s.mc.RestoreObject(ctx, s.s3Config.Bucket, filePath, "", req)
+	if err != nil && s3ErrorCode(err) != "RestoreAlreadyInProgress" {
+		slog.Error("Failed to request snapshot retrieval", "error", err)
+		return s.storageError("restore", filePath, err)
+	}
+
+	return nil
+}
+
+// s3ArchiveState reports whether an object is in an archive tier, and if so,
+// whether a retrieved copy of it is readable.
+func s3ArchiveState(info *minio.ObjectInfo) (archived bool, readable bool) {
+	archived = archiveStorageClasses[info.StorageClass] || info.Metadata.Get("X-Amz-Archive-Status") != ""
+	if !archived {
+		return false, true
+	}
+
+	return true, info.Restore != nil && !info.Restore.OngoingRestore
+}
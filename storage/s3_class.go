@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// s3StorageClasses are the storage classes snapshots can be uploaded to.
+var s3StorageClasses = []string{
+	"STANDARD",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER_IR",
+	"GLACIER",
+	"DEEP_ARCHIVE",
+}
+
+// validateS3StorageClasses checks the configured storage classes, so a typo
+// fails at startup rather than on the first upload.
+func validateS3StorageClasses(classes *config.S3StorageClasses) error {
+	for backupType, class := range map[string]string{
+		"full": classes.Full,
+		"diff": classes.Diff,
+		"incr": classes.Incr,
+	} {
+		if class == "" {
+			continue
+		}
+
+		valid := false
+		for _, c := range s3StorageClasses {
+			if class == c {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return &errclass.ConfigError{
+				Key: "repository.s3.storage_class." + backupType,
+				Err: fmt.Errorf("unknown storage class %q. Valid values are: %s", class, strings.Join(s3StorageClasses, ", ")),
+			}
+		}
+	}
+
+	return nil
+}
+
+// snapshotStorageClass returns the storage class for a snapshot upload
+// described by metadata, or "" for the bucket's default. Manifests always use
+// the default, so they stay cheap to read.
+func (s *S3StrongStorage) snapshotStorageClass(metadata SnapshotMetadata) string {
+	if metadata.Kind != ObjectKindSnapshot {
+		return ""
+	}
+
+	switch metadata.BackupType {
+	case "full":
+		return s.s3Config.StorageClass.Full
+	case "diff":
+		return s.s3Config.StorageClass.Diff
+	case "incr":
+		return s.s3Config.StorageClass.Incr
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// The session duration limits of STS AssumeRole.
+const (
+	s3MinRoleDuration = 15 * time.Minute
+	s3MaxRoleDuration = 12 * time.Hour
+)
+
+// newS3Credentials returns the credentials every S3 client of a bucket shares.
+// With an assumed role, the role's temporary credentials are fetched from STS
+// on first use, and fetched again before they expire, so uploads that outlive
+// a session keep working.
+func newS3Credentials(s3Config *config.S3Store, transport http.RoundTripper) (*credentials.Credentials, error) {
+	role := &s3Config.AssumeRole
+	if role.RoleARN == "" {
+		return credentials.NewStaticV4(s3Config.Key, s3Config.Secret, ""), nil
+	}
+
+	if role.Duration < s3MinRoleDuration || role.Duration > s3MaxRoleDuration {
+		return nil, &errclass.ConfigError{
+			Key: "repository.s3.assume_role.duration",
+			Err: fmt.Errorf("must be between %s and %s", s3MinRoleDuration, s3MaxRoleDuration),
+		}
+	}
+
+	endpoint := stsEndpoint(s3Config)
+	slog.Debug("Assuming IAM role for S3", "role_arn", role.RoleARN, "sts_endpoint", endpoint, "duration", role.Duration)
+
+	if s3Config.Key == "" || s3Config.Secret == "" {
+		return nil, &errclass.ConfigError{Key: "repository.s3.assume_role", Err: errors.New("requires key and secret")}
+	}
+
+	creds := credentials.New(&credentials.STSAssumeRole{
+		Client:      &http.Client{Transport: transport},
+		STSEndpoint: endpoint,
+		Options: credentials.STSAssumeRoleOptions{
+			AccessKey:       s3Config.Key,
+			SecretKey:       s3Config.Secret,
+			Location:        s3Config.Region,
+			DurationSeconds: int(role.Duration.Seconds()),
+			RoleARN:         role.RoleARN,
+			RoleSessionName: role.SessionName,
+			ExternalID:      role.ExternalID,
+		},
+	})
+
+	// Assume the role right away, so a misconfigured role fails here instead
+	// of on the first request.
+	if _, err := creds.Get(); err != nil {
+		slog.Error("Failed to assume IAM role", "role_arn", role.RoleARN, "error", err)
+		return nil, &errclass.StorageError{Op: "assume_role", Backend: "s3", Path: role.RoleARN, Err: err}
+	}
+
+	return creds, nil
+}
+
+// stsEndpoint is the configured STS endpoint, or the AWS STS endpoint of the
+// bucket's region.
+func stsEndpoint(s3Config *config.S3Store) string {
+	switch {
+	case s3Config.AssumeRole.STSEndpoint != "":
+		return s3Config.AssumeRole.STSEndpoint
+	case s3Config.Region != "":
+		return "https://sts." + s3Config.Region + ".amazonaws.com"
+	default:
+		return "https://sts.amazonaws.com"
+	}
+}
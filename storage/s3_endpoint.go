@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+const s3AccelerateEndpoint = "s3-accelerate.amazonaws.com"
+
+// newS3UploadClient returns the client for uploads through
+// OpenSnapshotWriteStream, if they go through a different endpoint than
+// everything else, or nil if they don't. Reads, deletes, listings and the
+// store and history objects always use the standard endpoint.
+func newS3UploadClient(s3Config *config.S3Store, creds *credentials.Credentials, transport http.RoundTripper) (*minio.Client, error) {
+	switch {
+	case s3Config.UploadEndpoint != "" && s3Config.TransferAcceleration:
+		return nil, &errclass.ConfigError{
+			Key: "repository.s3.upload_endpoint",
+			Err: errors.New("can't be combined with transfer_acceleration"),
+		}
+	case s3Config.UploadEndpoint != "":
+		slog.Debug("Using a separate endpoint for snapshot uploads", "endpoint", s3Config.UploadEndpoint)
+		return newS3Client(s3Config, s3Config.UploadEndpoint, creds, transport)
+	case s3Config.TransferAcceleration:
+		if !s3utils.IsAmazonEndpoint(url.URL{Host: s3Config.Endpoint}) {
+			return nil, &errclass.ConfigError{
+				Key: "repository.s3.transfer_acceleration",
+				Err: errors.New("is only supported by AWS S3 endpoints"),
+			}
+		}
+		if strings.Contains(s3Config.Bucket, ".") || strings.Contains(s3Config.ColdBucket, ".") {
+			return nil, &errclass.ConfigError{
+				Key: "repository.s3.transfer_acceleration",
+				Err: errors.New("is not supported for bucket names with dots"),
+			}
+		}
+
+		client, err := newS3Client(s3Config, s3Config.Endpoint, creds, transport)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("Using S3 Transfer Acceleration for snapshot uploads")
+		client.SetS3TransferAccelerate(s3AccelerateEndpoint)
+		return client, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newS3Client(s3Config *config.S3Store, endpoint string, creds *credentials.Credentials, transport http.RoundTripper) (*minio.Client, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    !s3Config.Insecure,
+		Transport: transport,
+	})
+	if err != nil {
+		slog.Error("Failed to create minio client", "endpoint", endpoint, "error", err)
+		return nil, &errclass.StorageError{Op: "connect", Backend: "s3", Path: endpoint, Err: err}
+	}
+
+	return client, nil
+}
+
+// uploadClient returns the client for snapshot uploads.
+func (s *S3StrongStorage) uploadClient() *minio.Client {
+	if s.upload != nil {
+		return s.upload
+	}
+
+	return s.mc
+}
+
+// newS3Transport returns the HTTP transport of every S3 client of a bucket,
+// and of STS. It trusts the configured CA bundle on top of the system's, and
+// presents the configured client certificate.
+func newS3Transport(s3Config *config.S3Store) (http.RoundTripper, error) {
+	transport, err := minio.DefaultTransport(!s3Config.Insecure)
+	if err != nil {
+		return nil, &errclass.StorageError{Op: "connect", Backend: "s3", Path: s3Config.Endpoint, Err: err}
+	}
+
+	tlsConfig := &s3Config.TLS
+	if tlsConfig.CAFile == "" && tlsConfig.CertFile == "" && tlsConfig.KeyFile == "" {
+		return transport, nil
+	}
+
+	if s3Config.Insecure {
+		return nil, &errclass.ConfigError{Key: "repository.s3.tls", Err: errors.New("can't be combined with insecure")}
+	}
+
+	if tlsConfig.CAFile != "" {
+		pem, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, &errclass.ConfigError{Key: "repository.s3.tls.ca_file", Err: err}
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			slog.Warn("Failed to load the system CA certificates. Only the configured CA bundle is trusted.", "error", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &errclass.ConfigError{Key: "repository.s3.tls.ca_file", Err: errors.New("contains no PEM certificates")}
+		}
+
+		slog.Debug("Trusting custom CA bundle for S3", "path", tlsConfig.CAFile)
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, &errclass.ConfigError{Key: "repository.s3.tls", Err: errors.New("cert_file and key_file must be set together")}
+		}
+
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, &errclass.ConfigError{Key: "repository.s3.tls.cert_file", Err: err}
+		}
+
+		slog.Debug("Using TLS client certificate for S3", "path", tlsConfig.CertFile)
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return transport, nil
+}
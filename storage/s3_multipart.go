@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7"
+)
+
+// s3MinPartSize and s3MaxParts are the S3 limits on multipart uploads.
+const (
+	s3MinPartSize = 5 * 1024 * 1024
+	s3MaxParts    = 10000
+)
+
+// s3AbortTimeout bounds aborting a failed multipart upload, which runs even
+// if the upload's context was cancelled.
+const s3AbortTimeout = 30 * time.Second
+
+func validateS3Upload(s3Config *config.S3Store) error {
+	if s3Config.PartSize < s3MinPartSize {
+		return &errclass.ConfigError{Key: "repository.s3.part_size", Err: fmt.Errorf("must be at least %d bytes (5 MiB)", s3MinPartSize)}
+	}
+
+	if s3Config.UploadThreads == 0 {
+		return &errclass.ConfigError{Key: "repository.s3.upload_threads", Err: errors.New("must be greater than 0")}
+	}
+
+	return nil
+}
+
+// s3MultipartWriter uploads an object as an S3 multipart upload. Writes fill
+// part_size buffers, and up to upload_threads parts are uploaded in parallel
+// while the next one fills, so at most upload_threads+1 parts are held in
+// memory. Objects that fit in a single part, like manifests, are uploaded with
+// a plain PutObject. The upload is completed on Close, and aborted as soon as
+// a part fails, so it doesn't leave parts behind.
+type s3MultipartWriter struct {
+	s      *S3StrongStorage
+	ctx    context.Context
+	cancel context.CancelFunc
+	core   minio.Core
+	bucket string
+	path   string
+	opts   minio.PutObjectOptions
+
+	partSize int64
+	buf      []byte
+	free     chan []byte
+	sem      chan struct{}
+	wg       sync.WaitGroup
+
+	uploadID   string
+	partNumber int
+
+	mu    sync.Mutex
+	parts []minio.CompletePart
+	err   error
+
+	abortOnce sync.Once
+	closed    bool
+}
+
+func (s *S3StrongStorage) newMultipartWriter(ctx context.Context, path string, opts minio.PutObjectOptions) *s3MultipartWriter {
+	ctx, cancel := context.WithCancel(ctx)
+	threads := max(int(s.s3Config.UploadThreads), 1)
+	partSize := int64(s.s3Config.PartSize)
+	// Keeps PutObject of objects smaller than a part to a single request.
+	opts.PartSize = s.s3Config.PartSize
+
+	return &s3MultipartWriter{
+		s:        s,
+		ctx:      ctx,
+		cancel:   cancel,
+		core:     minio.Core{Client: s.uploadClient()},
+		bucket:   s.s3Config.Bucket,
+		path:     path,
+		opts:     opts,
+		partSize: partSize,
+		buf:      make([]byte, 0, partSize),
+		free:     make(chan []byte, threads),
+		sem:      make(chan struct{}, threads),
+	}
+}
+
+func (w *s3MultipartWriter) Write(p []byte) (int, error) {
+	if err := w.failed(); err != nil {
+		w.abort()
+		return 0, err
+	}
+
+	total := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		total += n
+		p = p[n:]
+
+		if int64(len(w.buf)) == w.partSize {
+			if err := w.flushPart(); err != nil {
+				w.abort()
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// flushPart starts uploading the filled buffer as the next part, once one of
+// the upload_threads workers is free.
+func (w *s3MultipartWriter) flushPart() error {
+	if w.uploadID == "" {
+		uploadID, err := w.core.NewMultipartUpload(w.ctx, w.bucket, w.path, w.opts)
+		if err != nil {
+			slog.Error("Failed to start multipart upload", "path", w.path, "error", err)
+			return w.setErr(err)
+		}
+
+		slog.Debug("Started multipart upload", "path", w.path, "upload_id", uploadID, "part_size", w.partSize, "threads", cap(w.sem))
+		w.uploadID = uploadID
+	}
+
+	if w.partNumber == s3MaxParts {
+		return w.setErr(fmt.Errorf("object exceeds %d parts of %d bytes, increase repository.s3.part_size", s3MaxParts, w.partSize))
+	}
+
+	select {
+	case w.sem <- struct{}{}:
+	case <-w.ctx.Done():
+		return w.setErr(w.ctx.Err())
+	}
+
+	w.partNumber++
+	partNumber := w.partNumber
+	part := w.buf
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.sem }()
+
+		var partOpts minio.PutObjectPartOptions
+		if w.opts.SendContentMd5 {
+			sum := md5.Sum(part)
+			partOpts.Md5Base64 = base64.StdEncoding.EncodeToString(sum[:])
+		}
+
+		info, err := w.core.PutObjectPart(w.ctx, w.bucket, w.path, w.uploadID, partNumber,
+			bytes.NewReader(part), int64(len(part)), partOpts)
+
+		// The buffer is free for the next part either way.
+		select {
+		case w.free <- part[:0]:
+		default:
+		}
+
+		if err != nil {
+			slog.Error("Failed to upload part", "path", w.path, "part", partNumber, "error", err)
+			_ = w.setErr(err)
+			// Stop the other parts.
+			w.cancel()
+			return
+		}
+
+		slog.Debug("Uploaded part", "path", w.path, "part", partNumber, "size", len(part))
+
+		w.mu.Lock()
+		w.parts = append(w.parts, minio.CompletePart{PartNumber: partNumber, ETag: info.ETag})
+		w.mu.Unlock()
+	}()
+
+	select {
+	case w.buf = <-w.free:
+	default:
+		w.buf = make([]byte, 0, w.partSize)
+	}
+
+	return nil
+}
+
+func (w *s3MultipartWriter) Close() error {
+	if w.closed {
+		return w.failed()
+	}
+	w.closed = true
+	defer w.cancel()
+
+	if err := w.failed(); err != nil {
+		w.abort()
+		return err
+	}
+
+	if w.uploadID == "" {
+		// Everything fit in a single part.
+		_, err := w.core.Client.PutObject(w.ctx, w.bucket, w.path, bytes.NewReader(w.buf), int64(len(w.buf)), w.opts)
+		if err != nil {
+			slog.Error("Failed to upload object", "path", w.path, "error", err)
+			return w.setErr(err)
+		}
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.flushPart(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	w.wg.Wait()
+	if err := w.failed(); err != nil {
+		w.abort()
+		return err
+	}
+
+	sort.Slice(w.parts, func(i, j int) bool {
+		return w.parts[i].PartNumber < w.parts[j].PartNumber
+	})
+
+	slog.Debug("Completing multipart upload", "path", w.path, "upload_id", w.uploadID, "parts", len(w.parts))
+	if _, err := w.core.CompleteMultipartUpload(w.ctx, w.bucket, w.path, w.uploadID, w.parts, w.opts); err != nil {
+		slog.Error("Failed to complete multipart upload", "path", w.path, "error", err)
+		err = w.setErr(err)
+		w.abort()
+		return err
+	}
+
+	return nil
+}
+
+// abort stops the upload, and aborts the multipart upload if one was started.
+// It runs even if the upload's context was cancelled, so an interrupted
+// upload doesn't leave parts behind.
+func (w *s3MultipartWriter) abort() {
+	w.abortOnce.Do(func() {
+		w.cancel()
+		w.wg.Wait()
+
+		if w.uploadID == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(w.ctx), s3AbortTimeout)
+		defer cancel()
+
+		slog.Debug("Aborting multipart upload", "path", w.path, "upload_id", w.uploadID)
+		if err := w.core.AbortMultipartUpload(ctx, w.bucket, w.path, w.uploadID); err != nil {
+			slog.Warn("Failed to abort multipart upload. Cleanup removes its parts.", "path", w.path, "upload_id", w.uploadID, "error", err)
+		}
+	})
+}
+
+// setErr records the first error of the upload, and returns it.
+func (w *s3MultipartWriter) setErr(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = w.s.storageError("put", w.path, err)
+	}
+	return w.err
+}
+
+func (w *s3MultipartWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+)
+
+// normalizeS3Prefix returns the configured key prefix without leading or
+// trailing slashes, or "" if every object is stored at the bucket root.
+func normalizeS3Prefix(s3Config *config.S3Store) (string, error) {
+	prefix := strings.Trim(s3Config.Prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+
+	if path.Clean(prefix) != prefix || prefix == ".." || strings.HasPrefix(prefix, "../") {
+		return "", &errclass.ConfigError{
+			Key: "repository.s3.prefix",
+			Err: errors.New("must be a plain path like \"team/zfsbackrest\", without empty, . or .. elements"),
+		}
+	}
+
+	return prefix, nil
+}
+
+// key is the object key of p, a path relative to the repository root.
+func (s *S3StrongStorage) key(p string) string {
+	if s.prefix == "" {
+		return p
+	}
+
+	return s.prefix + "/" + p
+}
+
+// relativePath is the inverse of key. It returns false for keys outside of
+// the repository's prefix.
+func (s *S3StrongStorage) relativePath(key string) (string, bool) {
+	if s.prefix == "" {
+		return key, true
+	}
+
+	return strings.CutPrefix(key, s.prefix+"/")
+}
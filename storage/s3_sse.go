@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// newS3ServerSideEncryption returns the server-side encryption applied to
+// every object written to the bucket, or nil if it is left to the bucket's
+// default encryption.
+func newS3ServerSideEncryption(sse *config.S3SSE) (encrypt.ServerSide, error) {
+	switch sse.Type {
+	case "":
+		if sse.KMSKeyID != "" {
+			return nil, &errclass.ConfigError{Key: "repository.s3.sse.kms_key_id", Err: errors.New(`requires type = "kms"`)}
+		}
+		return nil, nil
+
+	case config.S3SSETypeS3:
+		if sse.KMSKeyID != "" {
+			return nil, &errclass.ConfigError{Key: "repository.s3.sse.kms_key_id", Err: errors.New(`requires type = "kms"`)}
+		}
+		return encrypt.NewSSE(), nil
+
+	case config.S3SSETypeKMS:
+		// An empty key ID uses the AWS managed key of the account.
+		kms, err := encrypt.NewSSEKMS(sse.KMSKeyID, nil)
+		if err != nil {
+			return nil, &errclass.ConfigError{Key: "repository.s3.sse.kms_key_id", Err: err}
+		}
+		return kms, nil
+
+	default:
+		return nil, &errclass.ConfigError{
+			Key: "repository.s3.sse.type",
+			Err: fmt.Errorf("unknown type %q. Valid values are: s3, kms", sse.Type),
+		}
+	}
+}
@@ -3,15 +3,16 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"path"
 
 	"github.com/gargakshit/zfsbackrest/config"
 	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 // S3StrongStorage is a storage implementation that uses S3 as the backend and
@@ -19,57 +20,254 @@ import (
 // data and ensure integrity.
 type S3StrongStorage struct {
 	mc       *minio.Client
+	upload   *minio.Client
 	s3Config *config.S3Store
+	// prefix is prepended to every object key, see config.S3Store.Prefix.
+	prefix string
+	// sse is the server-side encryption of every object written, if any.
+	sse encrypt.ServerSide
 }
 
 func NewS3StrongStorage(ctx context.Context, s3Config *config.S3Store) (*S3StrongStorage, error) {
 	slog.Debug("Creating S3 strong storage", "s3Config", s3Config)
 
-	minioClient, err := minio.New(s3Config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(s3Config.Key, s3Config.Secret, ""),
-		Secure: true,
-	})
+	if err := validateS3Retrieval(&s3Config.Retrieval); err != nil {
+		return nil, err
+	}
+
+	if err := validateS3Tags(&s3Config.Tags); err != nil {
+		return nil, err
+	}
+
+	if err := validateS3StorageClasses(&s3Config.StorageClass); err != nil {
+		return nil, err
+	}
+
+	if err := validateS3Upload(s3Config); err != nil {
+		return nil, err
+	}
+
+	if err := validateS3ObjectLock(&s3Config.ObjectLock); err != nil {
+		return nil, err
+	}
+
+	prefix, err := normalizeS3Prefix(s3Config)
+	if err != nil {
+		return nil, err
+	}
+
+	sse, err := newS3ServerSideEncryption(&s3Config.SSE)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newS3Transport(s3Config)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := newS3Credentials(s3Config, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	minioClient, err := newS3Client(s3Config, s3Config.Endpoint, creds, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadClient, err := newS3UploadClient(s3Config, creds, transport)
 	if err != nil {
-		slog.Error("Failed to create minio client", "error", err)
 		return nil, err
 	}
 
 	return &S3StrongStorage{
 		mc:       minioClient,
+		upload:   uploadClient,
 		s3Config: s3Config,
+		prefix:   prefix,
+		sse:      sse,
 	}, nil
 }
 
-// storePath is the path to the store file in the S3 bucket. It is not encrypted.
+// storePath is the path to the store file in the S3 bucket, under the
+// configured prefix. It is not encrypted.
 var storePath = "zfsbackrest_store_v1.json"
 
+// historyPath is the path to the store history log. It is not encrypted.
+var historyPath = "zfsbackrest_history_v1.jsonl"
+
+// keyEscrowPath is the path to the escrowed age identity. It is encrypted
+// with a passphrase, not with the repository's recipient.
+var keyEscrowPath = "zfsbackrest_key_escrow_v1.age"
+
+// auditPath is the path to the audit log. It is not encrypted.
+var auditPath = "zfsbackrest_audit_v1.jsonl"
+
+// journalPath is the path to the journal of a store save in progress. It is
+// encrypted like the store.
+var journalPath = "zfsbackrest_journal_v1.json"
+
 func (s *S3StrongStorage) LoadStoreContent(ctx context.Context) ([]byte, error) {
-	slog.Debug("Loading store content", "bucket", s.s3Config.Bucket, "path", storePath)
+	return s.loadObject(ctx, storePath)
+}
+
+func (s *S3StrongStorage) SaveStoreContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, storePath, content)
+}
+
+func (s *S3StrongStorage) LoadHistoryContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, historyPath)
+}
+
+func (s *S3StrongStorage) SaveHistoryContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, historyPath, content)
+}
+
+func (s *S3StrongStorage) LoadKeyEscrowContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, keyEscrowPath)
+}
 
-	reader, err := s.mc.GetObject(ctx, s.s3Config.Bucket, storePath, minio.GetObjectOptions{})
+func (s *S3StrongStorage) SaveKeyEscrowContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, keyEscrowPath, content)
+}
+
+func (s *S3StrongStorage) LoadAuditContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, auditPath)
+}
+
+func (s *S3StrongStorage) SaveAuditContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, auditPath, content)
+}
+
+func (s *S3StrongStorage) LoadJournalContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, journalPath)
+}
+
+func (s *S3StrongStorage) SaveJournalContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, journalPath, content)
+}
+
+func (s *S3StrongStorage) DeleteJournalContent(ctx context.Context) error {
+	return s.deleteObject(ctx, journalPath)
+}
+
+func (s *S3StrongStorage) SaveLockContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, lockPath(id), content)
+}
+
+func (s *S3StrongStorage) SaveStoreVersionContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, storeVersionPath(id), content)
+}
+
+func (s *S3StrongStorage) LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error) {
+	return s.loadObject(ctx, storeVersionPath(id))
+}
+
+func (s *S3StrongStorage) ListStoreVersions(ctx context.Context) ([]string, error) {
+	return s.listIDs(ctx, storeVersionPrefix)
+}
+
+func (s *S3StrongStorage) DeleteStoreVersionContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, storeVersionPath(id))
+}
+
+func (s *S3StrongStorage) LoadLockContents(ctx context.Context) (map[string][]byte, error) {
+	ids, err := s.listIDs(ctx, lockPrefix)
 	if err != nil {
-		slog.Error("Failed to get store content", "error", err)
 		return nil, err
 	}
 
+	locks := map[string][]byte{}
+	for _, id := range ids {
+		content, err := s.loadObject(ctx, lockPath(id))
+		if errors.Is(err, errclass.ErrNotFound) {
+			// Released since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		locks[id] = content
+	}
+
+	return locks, nil
+}
+
+func (s *S3StrongStorage) DeleteLockContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, lockPath(id))
+}
+
+// listIDs lists the IDs of the objects directly under prefix.
+func (s *S3StrongStorage) listIDs(ctx context.Context, prefix string) ([]string, error) {
+	key := s.key(prefix)
+	slog.Debug("Listing objects", "bucket", s.s3Config.Bucket, "prefix", key)
+
+	var ids []string
+	for info := range s.mc.ListObjects(ctx, s.s3Config.Bucket, minio.ListObjectsOptions{Prefix: key}) {
+		if info.Err != nil {
+			slog.Error("Failed to list objects", "prefix", key, "error", info.Err)
+			return nil, s.storageError("list", key, info.Err)
+		}
+
+		rel, ok := s.relativePath(info.Key)
+		if !ok {
+			continue
+		}
+		if id, ok := parseObjectID(prefix, rel); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// deleteObject deletes the object at path. Deleting a missing object
+// succeeds.
+func (s *S3StrongStorage) deleteObject(ctx context.Context, path string) error {
+	path = s.key(path)
+	slog.Debug("Deleting object", "bucket", s.s3Config.Bucket, "path", path)
+
+	if err := s.mc.RemoveObject(ctx, s.s3Config.Bucket, path, minio.RemoveObjectOptions{}); err != nil {
+		slog.Error("Failed to delete object", "path", path, "error", err)
+		return s.storageError("delete", path, err)
+	}
+
+	return nil
+}
+
+func (s *S3StrongStorage) loadObject(ctx context.Context, path string) ([]byte, error) {
+	path = s.key(path)
+	slog.Debug("Loading object", "bucket", s.s3Config.Bucket, "path", path)
+
+	reader, err := s.mc.GetObject(ctx, s.s3Config.Bucket, path, minio.GetObjectOptions{})
+	if err != nil {
+		slog.Error("Failed to get object", "path", path, "error", err)
+		return nil, s.storageError("get", path, err)
+	}
+
 	defer reader.Close()
 
 	content, err := io.ReadAll(reader)
 	if err != nil {
-		slog.Error("Failed to read store content", "error", err)
-		return nil, err
+		slog.Error("Failed to read object", "path", path, "error", err)
+		return nil, s.storageError("get", path, err)
 	}
 
 	return content, nil
 }
 
-func (s *S3StrongStorage) SaveStoreContent(ctx context.Context, content []byte) error {
-	slog.Debug("Saving store content", "bucket", s.s3Config.Bucket, "path", storePath)
+func (s *S3StrongStorage) saveObject(ctx context.Context, path string, content []byte) error {
+	path = s.key(path)
+	slog.Debug("Saving object", "bucket", s.s3Config.Bucket, "path", path)
 
-	_, err := s.mc.PutObject(ctx, s.s3Config.Bucket, storePath, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	_, err := s.mc.PutObject(ctx, s.s3Config.Bucket, path, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{
+		ServerSideEncryption: s.sse,
+	})
 	if err != nil {
-		slog.Error("Failed to save store content", "error", err)
-		return err
+		slog.Error("Failed to save object", "path", path, "error", err)
+		return s.storageError("put", path, err)
 	}
 
 	return nil
@@ -85,44 +283,30 @@ func (s *S3StrongStorage) OpenSnapshotWriteStream(
 	filePath := s.filePath(dataset, snapshot)
 	slog.Debug("Opening snapshot write stream", "bucket", s.s3Config.Bucket, "path", filePath)
 
-	pr, pw := io.Pipe()
-
-	// Kick off the upload that consumes from the pipe reader.
-	done := make(chan error)
-	go func() {
-		defer close(done)
-		// Disable concurrent streaming parts to avoid buffering multiple part
-		// buffers in memory at once. Also choose a smaller part size to limit
-		// the single in-memory buffer used by the MinIO client.
-		_, err := s.mc.PutObject(ctx, s.s3Config.Bucket, filePath, pr, size, minio.PutObjectOptions{
-			ContentType: "application/octet-stream",
-			NumThreads:  s.s3Config.UploadThreads,
-			PartSize:    s.s3Config.PartSize,
-		})
-		if err != nil {
-			slog.Error("Failed to upload snapshot", "path", filePath, "error", err)
-			// Ensure the writer side sees an error
-			_ = pr.CloseWithError(err)
-			done <- err
-			return
-		}
-		done <- nil
-	}()
+	metadata := snapshotMetadata(ctx)
+	opts := minio.PutObjectOptions{
+		ContentType:  metadata.ContentType(),
+		UserMetadata: metadata.Fields(),
+		UserTags:     s.snapshotTags(metadata),
+		StorageClass: s.snapshotStorageClass(metadata),
 
-	// Wrap the pipe writer with encryption so callers write plaintext
-	encWriter, err := encryption.EncryptedWriter(pw)
+		ServerSideEncryption: s.sse,
+	}
+	s.applyObjectLock(&opts, metadata)
+	parts := s.newMultipartWriter(ctx, filePath, opts)
+
+	// Wrap the multipart writer with encryption so callers write plaintext
+	encWriter, err := encryption.EncryptedWriter(parts)
 	if err != nil {
-		// If encryption setup fails, close the pipe and return the error
-		_ = pw.Close()
-		return nil, err
+		parts.abort()
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
 	}
 
 	// Return a WriteCloser that forwards writes to the encrypted writer and
-	// waits for the upload to complete on Close.
+	// completes the upload on Close.
 	return &s3EncryptedWriteCloser{
-		enc:  encWriter,
-		pw:   pw,
-		done: done,
+		enc:   encWriter,
+		parts: parts,
 	}, nil
 }
 
@@ -132,49 +316,225 @@ func (s *S3StrongStorage) OpenSnapshotReadStream(
 	snapshot string,
 	encryption encryption.Encryption,
 ) (io.ReadCloser, error) {
-	filePath := s.filePath(dataset, snapshot)
-	slog.Debug("Opening snapshot read stream", "bucket", s.s3Config.Bucket, "path", filePath)
-
-	reader, err := s.mc.GetObject(ctx, s.s3Config.Bucket, filePath, minio.GetObjectOptions{})
+	reader, err := s.OpenSnapshotReadStreamAt(ctx, dataset, snapshot, 0)
 	if err != nil {
-		slog.Error("Failed to get snapshot", "error", err)
-		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+		return nil, err
 	}
 
 	wrappedReader, err := encryption.DecryptedReader(reader)
 	if err != nil {
 		slog.Error("Failed to decrypt snapshot", "error", err)
-		return nil, fmt.Errorf("failed to decrypt snapshot: %w", err)
+		_ = reader.Close()
+		var storageErr *errclass.StorageError
+		if errors.As(err, &storageErr) {
+			return nil, storageErr
+		}
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
 	}
 
 	return wrappedReader, nil
 }
 
+var _ RangeReadStore = (*S3StrongStorage)(nil)
+
+func (s *S3StrongStorage) OpenSnapshotReadStreamAt(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	offset int64,
+) (io.ReadCloser, error) {
+	filePath := s.filePath(dataset, snapshot)
+	slog.Debug("Opening snapshot read stream", "bucket", s.s3Config.Bucket, "path", filePath, "offset", offset)
+
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, s.storageError("get", filePath, err)
+		}
+	}
+
+	reader, err := s.mc.GetObject(ctx, s.s3Config.Bucket, filePath, opts)
+	if err != nil {
+		slog.Error("Failed to get snapshot", "error", err)
+		return nil, s.storageError("get", filePath, err)
+	}
+
+	return &s3ObjectReader{Object: reader, s: s, path: filePath}, nil
+}
+
 func (s *S3StrongStorage) DeleteSnapshot(
 	ctx context.Context,
 	dataset string,
 	snapshot string,
 ) error {
 	filePath := s.filePath(dataset, snapshot)
-	slog.Debug("Deleting snapshot", "bucket", s.s3Config.Bucket, "path", filePath)
+	slog.Debug("Deleting snapshot", "bucket", s.s3Config.Bucket, "path", filePath, "purge_versions", s.s3Config.PurgeVersions)
+
+	if s.s3Config.PurgeVersions {
+		return s.deleteAllVersions(ctx, filePath)
+	}
 
 	err := s.mc.RemoveObject(ctx, s.s3Config.Bucket, filePath, minio.RemoveObjectOptions{})
 	if err != nil {
 		slog.Error("Failed to delete snapshot", "error", err)
-		return err
+		return s.storageError("delete", filePath, err)
 	}
 
 	return nil
 }
 
+func (s *S3StrongStorage) ListSnapshots(ctx context.Context) ([]SnapshotObject, error) {
+	return s.listSnapshots(ctx, snapshotPrefix)
+}
+
+func (s *S3StrongStorage) ListSnapshotObjects(ctx context.Context, dataset string) ([]SnapshotObject, error) {
+	objects, err := s.listSnapshots(ctx, snapshotDatasetPrefix(dataset))
+	if err != nil {
+		return nil, err
+	}
+
+	return datasetSnapshots(objects, dataset), nil
+}
+
+func (s *S3StrongStorage) StatSnapshot(ctx context.Context, dataset string, snapshot string) (SnapshotObject, error) {
+	filePath := s.filePath(dataset, snapshot)
+	slog.Debug("Getting snapshot info", "bucket", s.s3Config.Bucket, "path", filePath)
+
+	info, err := s.mc.StatObject(ctx, s.s3Config.Bucket, filePath, minio.StatObjectOptions{})
+	if err != nil {
+		return SnapshotObject{}, s.storageError("stat", filePath, err)
+	}
+
+	return SnapshotObject{Dataset: dataset, Snapshot: snapshot, Size: info.Size}, nil
+}
+
+// listSnapshots lists the snapshot objects under prefix, relative to the
+// repository's prefix.
+func (s *S3StrongStorage) listSnapshots(ctx context.Context, prefix string) ([]SnapshotObject, error) {
+	prefix = s.key(prefix)
+	slog.Debug("Listing snapshots", "bucket", s.s3Config.Bucket, "prefix", prefix)
+
+	var objects []SnapshotObject
+	for info := range s.mc.ListObjects(ctx, s.s3Config.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			slog.Error("Failed to list snapshots", "error", info.Err)
+			return nil, s.storageError("list", prefix, info.Err)
+		}
+
+		rel, ok := s.relativePath(info.Key)
+		if !ok {
+			continue
+		}
+
+		object, ok := parseSnapshotPath(rel)
+		if !ok {
+			continue
+		}
+
+		object.Size = info.Size
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+var _ ObjectLister = (*S3StrongStorage)(nil)
+
+func (s *S3StrongStorage) ListObjects(ctx context.Context) ([]Object, error) {
+	prefix := s.key("")
+	slog.Debug("Listing objects", "bucket", s.s3Config.Bucket, "prefix", prefix)
+
+	var objects []Object
+	for info := range s.mc.ListObjects(ctx, s.s3Config.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			slog.Error("Failed to list objects", "error", info.Err)
+			return nil, s.storageError("list", prefix, info.Err)
+		}
+
+		rel, ok := s.relativePath(info.Key)
+		if !ok {
+			continue
+		}
+
+		objects = append(objects, Object{Path: rel, Size: info.Size})
+	}
+
+	return objects, nil
+}
+
+var _ PartialUploadStore = (*S3StrongStorage)(nil)
+
+// AtomicSnapshotReplace is always true, as an object is only replaced once
+// its PUT or multipart upload completes.
+func (s *S3StrongStorage) AtomicSnapshotReplace() bool {
+	return true
+}
+
+var _ AtomicReplaceStore = (*S3StrongStorage)(nil)
+
+// AbortPartialUpload aborts the incomplete multipart uploads of a snapshot,
+// which removes their parts.
+func (s *S3StrongStorage) AbortPartialUpload(ctx context.Context, dataset string, snapshot string) error {
+	filePath := s.filePath(dataset, snapshot)
+	slog.Debug("Aborting partial upload", "bucket", s.s3Config.Bucket, "path", filePath)
+
+	err := s.uploadClient().RemoveIncompleteUpload(ctx, s.s3Config.Bucket, filePath)
+	if err != nil {
+		slog.Error("Failed to abort partial upload", "error", err)
+		return s.storageError("abort_upload", filePath, err)
+	}
+
+	return nil
+}
+
+func (s *S3StrongStorage) storageError(op string, path string, err error) error {
+	if s3ErrorCode(err) == "InvalidObjectState" {
+		err = fmt.Errorf("%w: %w", ErrSnapshotArchived, err)
+	}
+
+	return &errclass.StorageError{
+		Op:       op,
+		Backend:  "s3",
+		Path:     path,
+		NotFound: s3ErrorCode(err) == "NoSuchKey",
+		Err:      err,
+	}
+}
+
+// s3ErrorCode returns the S3 error code anywhere in err's chain, or "" if err
+// did not come from S3.
+func s3ErrorCode(err error) string {
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		return resp.Code
+	}
+
+	return ""
+}
+
 func (s *S3StrongStorage) filePath(dataset string, snapshot string) string {
-	return path.Join("snaps", dataset, snapshot)
+	return s.key(snapshotPath(dataset, snapshot))
+}
+
+// s3ObjectReader reads an object, classifying the errors of the request,
+// which GetObject only sends on the first read.
+type s3ObjectReader struct {
+	*minio.Object
+	s    *S3StrongStorage
+	path string
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	if err != nil && err != io.EOF {
+		err = r.s.storageError("get", r.path, err)
+	}
+	return n, err
 }
 
 type s3EncryptedWriteCloser struct {
-	enc  io.WriteCloser
-	pw   *io.PipeWriter
-	done chan error
+	enc   io.WriteCloser
+	parts *s3MultipartWriter
 }
 
 func (w *s3EncryptedWriteCloser) Write(p []byte) (int, error) {
@@ -182,14 +542,12 @@ func (w *s3EncryptedWriteCloser) Write(p []byte) (int, error) {
 }
 
 func (w *s3EncryptedWriteCloser) Close() error {
-	// Close the encryption stream first to flush and finalize
-	encErr := w.enc.Close()
-	// Ensure the pipe writer is closed to signal EOF to the reader
-	_ = w.pw.Close()
-	// Wait for the upload goroutine to finish and capture its error
-	putErr := <-w.done
-	if encErr != nil {
-		return encErr
-	}
-	return putErr
+	// Close the encryption stream first to flush and finalize. If that fails,
+	// the upload must not be completed, or we'd commit a truncated object.
+	if err := w.enc.Close(); err != nil {
+		w.parts.abort()
+		return err
+	}
+
+	return w.parts.Close()
 }
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// validateS3Tags checks the configured tags against the S3 limits on object
+// tags, so a bad tag fails at startup rather than on the first upload.
+func validateS3Tags(s3Tags *config.S3Tags) error {
+	for backupType, t := range map[string]map[string]string{
+		"full": s3Tags.Full,
+		"diff": s3Tags.Diff,
+		"incr": s3Tags.Incr,
+	} {
+		if _, err := tags.NewTags(t, true); err != nil {
+			return &errclass.ConfigError{Key: "repository.s3.tags." + backupType, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// snapshotTags returns the tags for a snapshot upload described by metadata.
+func (s *S3StrongStorage) snapshotTags(metadata SnapshotMetadata) map[string]string {
+	if metadata.Kind != ObjectKindSnapshot {
+		return nil
+	}
+
+	switch metadata.BackupType {
+	case "full":
+		return s.s3Config.Tags.Full
+	case "diff":
+		return s.s3Config.Tags.Diff
+	case "incr":
+		return s.s3Config.Tags.Incr
+	default:
+		return nil
+	}
+}
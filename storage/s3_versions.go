@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var _ VersionedStore = (*S3StrongStorage)(nil)
+
+func (s *S3StrongStorage) VersionUsage(ctx context.Context) (*VersionUsage, error) {
+	return s.walkNoncurrentVersions(ctx, nil)
+}
+
+func (s *S3StrongStorage) PurgeNoncurrentVersions(ctx context.Context, dryRun bool) (*VersionUsage, error) {
+	slog.Debug("Purging noncurrent snapshot versions", "bucket", s.s3Config.Bucket, "dry_run", dryRun)
+
+	return s.walkNoncurrentVersions(ctx, func(info minio.ObjectInfo) error {
+		if dryRun {
+			slog.Info("Dry run. Noncurrent version would be removed.", "path", info.Key, "version", info.VersionID, "delete_marker", info.IsDeleteMarker)
+			return nil
+		}
+
+		if !info.IsDeleteMarker {
+			locked, err := s.versionLocked(ctx, info.Key, info.VersionID)
+			if err != nil {
+				return err
+			}
+			if locked {
+				slog.Info("Noncurrent version is locked by Object Lock. It is removed by a later cleanup.", "path", info.Key, "version", info.VersionID)
+				return nil
+			}
+		}
+
+		slog.Debug("Removing noncurrent version", "path", info.Key, "version", info.VersionID, "delete_marker", info.IsDeleteMarker)
+		if err := s.mc.RemoveObject(ctx, s.s3Config.Bucket, info.Key, minio.RemoveObjectOptions{VersionID: info.VersionID}); err != nil {
+			slog.Error("Failed to remove noncurrent version", "path", info.Key, "version", info.VersionID, "error", err)
+			return s.storageError("delete", info.Key, err)
+		}
+
+		return nil
+	})
+}
+
+// walkNoncurrentVersions sums up the noncurrent versions and delete markers
+// of snapshot objects, calling fn for each of them if it's not nil.
+func (s *S3StrongStorage) walkNoncurrentVersions(ctx context.Context, fn func(minio.ObjectInfo) error) (*VersionUsage, error) {
+	versioning, err := s.mc.GetBucketVersioning(ctx, s.s3Config.Bucket)
+	if err != nil {
+		slog.Error("Failed to get bucket versioning", "error", err)
+		return nil, s.storageError("get versioning", s.s3Config.Bucket, err)
+	}
+
+	usage := &VersionUsage{Status: versioning.Status}
+	if versioning.Status == "" {
+		return usage, nil
+	}
+
+	prefix := s.key(snapshotPrefix)
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true, WithVersions: true}
+	for info := range s.mc.ListObjects(ctx, s.s3Config.Bucket, opts) {
+		if info.Err != nil {
+			slog.Error("Failed to list object versions", "error", info.Err)
+			return nil, s.storageError("list", prefix, info.Err)
+		}
+
+		// The current version of a live object is what the store refers to.
+		if info.IsLatest && !info.IsDeleteMarker {
+			continue
+		}
+
+		if info.IsDeleteMarker {
+			usage.DeleteMarkers++
+		} else {
+			usage.NoncurrentVersions++
+			usage.NoncurrentBytes += info.Size
+		}
+
+		if fn != nil {
+			if err := fn(info); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+// deleteAllVersions permanently deletes every version of the object at
+// filePath, including delete markers. On an unversioned bucket, that's just
+// the object. Versions locked by Object Lock are kept, behind a delete
+// marker, for PurgeNoncurrentVersions to remove once their retention ends.
+func (s *S3StrongStorage) deleteAllVersions(ctx context.Context, filePath string) error {
+	removed := 0
+	locked := 0
+	opts := minio.ListObjectsOptions{Prefix: filePath, WithVersions: true}
+	for info := range s.mc.ListObjects(ctx, s.s3Config.Bucket, opts) {
+		if info.Err != nil {
+			slog.Error("Failed to list snapshot versions", "error", info.Err)
+			return s.storageError("list", filePath, info.Err)
+		}
+
+		// The prefix also matches longer keys, e.g. the manifest next to it.
+		if info.Key != filePath {
+			continue
+		}
+
+		if !info.IsDeleteMarker {
+			isLocked, err := s.versionLocked(ctx, filePath, info.VersionID)
+			if err != nil {
+				return err
+			}
+			if isLocked {
+				locked++
+				continue
+			}
+		}
+
+		err := s.mc.RemoveObject(ctx, s.s3Config.Bucket, filePath, minio.RemoveObjectOptions{VersionID: info.VersionID})
+		if err != nil {
+			slog.Error("Failed to delete snapshot version", "version", info.VersionID, "error", err)
+			return s.storageError("delete", filePath, err)
+		}
+		removed++
+	}
+
+	if locked > 0 {
+		slog.Info("Snapshot versions are locked by Object Lock. They are hidden by a delete marker until a later cleanup can remove them.",
+			"path", filePath, "versions", locked)
+
+		err := s.mc.RemoveObject(ctx, s.s3Config.Bucket, filePath, minio.RemoveObjectOptions{})
+		if err != nil {
+			slog.Error("Failed to add delete marker", "error", err)
+			return s.storageError("delete", filePath, err)
+		}
+	}
+
+	slog.Debug("Deleted snapshot versions", "path", filePath, "versions", removed)
+	return nil
+}
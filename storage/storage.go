@@ -2,9 +2,16 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/gargakshit/zfsbackrest/config"
 	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
 )
 
 type StrongStore interface {
@@ -14,6 +21,51 @@ type StrongStore interface {
 	LoadStoreContent(ctx context.Context) ([]byte, error)
 	// SaveStoreContent saves the store content to the storage.
 	SaveStoreContent(ctx context.Context, content []byte) error
+	// LoadHistoryContent loads the store history log from the storage.
+	LoadHistoryContent(ctx context.Context) ([]byte, error)
+	// SaveHistoryContent replaces the store history log.
+	SaveHistoryContent(ctx context.Context, content []byte) error
+	// LoadKeyEscrowContent loads the passphrase-encrypted age identity kept
+	// in the repository, if key escrow is enabled.
+	LoadKeyEscrowContent(ctx context.Context) ([]byte, error)
+	// SaveKeyEscrowContent replaces the passphrase-encrypted age identity.
+	SaveKeyEscrowContent(ctx context.Context, content []byte) error
+	// LoadAuditContent loads the audit log of the operations that changed
+	// the repository.
+	LoadAuditContent(ctx context.Context) ([]byte, error)
+	// SaveAuditContent replaces the audit log.
+	SaveAuditContent(ctx context.Context, content []byte) error
+	// LoadJournalContent loads the journal of a store save that hasn't
+	// finished.
+	LoadJournalContent(ctx context.Context) ([]byte, error)
+	// SaveJournalContent replaces the journal.
+	SaveJournalContent(ctx context.Context, content []byte) error
+	// DeleteJournalContent deletes the journal. It is not an error if it
+	// doesn't exist.
+	DeleteJournalContent(ctx context.Context) error
+
+	// Store versions.
+
+	// SaveStoreVersionContent writes a version of the store.
+	SaveStoreVersionContent(ctx context.Context, id string, content []byte) error
+	// LoadStoreVersionContent loads a version of the store.
+	LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error)
+	// ListStoreVersions lists the IDs of the versions of the store.
+	ListStoreVersions(ctx context.Context) ([]string, error)
+	// DeleteStoreVersionContent deletes a version of the store. It is not an
+	// error if it doesn't exist.
+	DeleteStoreVersionContent(ctx context.Context, id string) error
+
+	// Repository locks.
+
+	// SaveLockContent writes the lock object of a holder, replacing it if it
+	// exists.
+	SaveLockContent(ctx context.Context, id string, content []byte) error
+	// LoadLockContents loads every lock object, by holder.
+	LoadLockContents(ctx context.Context) (map[string][]byte, error)
+	// DeleteLockContent deletes the lock object of a holder. It is not an
+	// error if it doesn't exist.
+	DeleteLockContent(ctx context.Context, id string) error
 
 	// Snapshots.
 
@@ -37,4 +89,263 @@ type StrongStore interface {
 	) (io.ReadCloser, error)
 	// DeleteSnapshot deletes a snapshot from the storage.
 	DeleteSnapshot(ctx context.Context, dataset string, snapshot string) error
+	// ListSnapshots lists every object stored through OpenSnapshotWriteStream.
+	ListSnapshots(ctx context.Context) ([]SnapshotObject, error)
+	// ListSnapshotObjects is like ListSnapshots, but only lists the objects
+	// of dataset, not those of its children.
+	ListSnapshotObjects(ctx context.Context, dataset string) ([]SnapshotObject, error)
+	// StatSnapshot returns the object of a snapshot without reading it. It
+	// fails with errclass.ErrNotFound if the object doesn't exist.
+	StatSnapshot(ctx context.Context, dataset string, snapshot string) (SnapshotObject, error)
+}
+
+// SnapshotObject is an object listed by ListSnapshots.
+type SnapshotObject struct {
+	Dataset  string
+	Snapshot string
+	Size     int64
+}
+
+// ArchiveStore is implemented by stores whose snapshots may sit in an archive
+// tier, where they have to be retrieved before they can be read.
+type ArchiveStore interface {
+	// RetrieveSnapshot makes an archived snapshot readable, requesting a
+	// retrieval if one isn't in progress already. If wait is set, it blocks
+	// until the snapshot is readable or the retrieval times out.
+	RetrieveSnapshot(ctx context.Context, dataset string, snapshot string, wait bool) error
+}
+
+// PartialUploadStore is implemented by stores where an upload cut short leaves
+// data behind that isn't part of any snapshot object, like the parts of an S3
+// multipart upload or the segments of a Swift static large object.
+type PartialUploadStore interface {
+	// AbortPartialUpload removes what an interrupted upload of a snapshot
+	// left behind. It is not an error if nothing was left behind.
+	AbortPartialUpload(ctx context.Context, dataset string, snapshot string) error
+}
+
+// AtomicReplaceStore is implemented by stores that keep the current snapshot
+// object readable while it is overwritten, and only replace it once the new
+// one is complete, like an S3 PUT does. A snapshot can only be rewritten in
+// place, e.g. to re-encrypt it, on such stores.
+type AtomicReplaceStore interface {
+	// AtomicSnapshotReplace reports whether overwriting a snapshot object
+	// replaces it atomically.
+	AtomicSnapshotReplace() bool
+}
+
+// RangeReadStore is implemented by stores that can read a snapshot object from
+// an offset, so a download cut short resumes where it stopped instead of
+// starting over.
+type RangeReadStore interface {
+	// OpenSnapshotReadStreamAt opens a read stream of the snapshot object as
+	// it is stored, i.e. still encrypted, starting at offset.
+	OpenSnapshotReadStreamAt(ctx context.Context, dataset string, snapshot string, offset int64) (io.ReadCloser, error)
+}
+
+// VersionedStore is implemented by stores whose bucket may keep noncurrent
+// object versions. With versioning enabled, deletes only add a delete marker,
+// and the storage used keeps growing.
+type VersionedStore interface {
+	// VersionUsage reports the bucket's versioning status, and the noncurrent
+	// versions and delete markers of snapshot objects.
+	VersionUsage(ctx context.Context) (*VersionUsage, error)
+	// PurgeNoncurrentVersions permanently removes the noncurrent versions and
+	// delete markers of snapshot objects, and reports what it removed. The
+	// store and history objects are left alone.
+	PurgeNoncurrentVersions(ctx context.Context, dryRun bool) (*VersionUsage, error)
+}
+
+// VersionUsage describes the noncurrent versions of snapshot objects.
+type VersionUsage struct {
+	// Status is the bucket's versioning status: Enabled, Suspended, or empty
+	// if versioning was never enabled.
+	Status             string `json:"status"`
+	NoncurrentVersions int    `json:"noncurrent_versions"`
+	NoncurrentBytes    int64  `json:"noncurrent_bytes"`
+	DeleteMarkers      int    `json:"delete_markers"`
+}
+
+// ObjectLister is implemented by stores that can list every object of the
+// repository, not only snapshots: manifests, the store, its history and
+// anything else under the bucket, container or prefix.
+type ObjectLister interface {
+	// ListObjects lists every object of the repository, with paths relative
+	// to the repository's root.
+	ListObjects(ctx context.Context) ([]Object, error)
+}
+
+// Object is an object of the repository, as listed by ObjectLister.
+type Object struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// LockingStore is implemented by stores that can lock snapshots against
+// deletion, like S3 Object Lock. A locked snapshot can't be deleted, even
+// with the repository's credentials, until its retention ends.
+type LockingStore interface {
+	// SnapshotRetention returns how long new snapshots are locked for, or 0
+	// if they aren't locked.
+	SnapshotRetention() time.Duration
+}
+
+// NewStrongStore creates the StrongStore for the configured repository
+// backend, retrying its calls with the repository's retry policy.
+func NewStrongStore(ctx context.Context, repoConfig *config.Repository) (StrongStore, error) {
+	s, err := newBackendStore(ctx, repoConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRetryStore(s, repoConfig.Retry), nil
+}
+
+func newBackendStore(ctx context.Context, repoConfig *config.Repository) (StrongStore, error) {
+	switch repoConfig.Backend {
+	case config.BackendS3, "":
+		return NewS3StrongStorage(ctx, &repoConfig.S3)
+	case config.BackendSwift:
+		return NewSwiftStrongStorage(ctx, &repoConfig.Swift)
+	case config.BackendRclone:
+		return NewRcloneStrongStorage(ctx, &repoConfig.Rclone)
+	default:
+		return nil, &errclass.ConfigError{
+			Key: "repository.backend",
+			Err: fmt.Errorf("unknown backend %q. Valid values are: s3, swift, rclone", repoConfig.Backend),
+		}
+	}
+}
+
+// NewReplicaStrongStore creates the StrongStore of a replica.
+func NewReplicaStrongStore(ctx context.Context, replica *config.Replica) (StrongStore, error) {
+	return NewStrongStore(ctx, &config.Repository{
+		Backend: replica.Backend,
+		S3:      replica.S3,
+		Swift:   replica.Swift,
+		Rclone:  replica.Rclone,
+		Retry:   replica.Retry,
+	})
+}
+
+// NewColdStrongStore creates the StrongStore backups are moved to by tiering.
+// It returns nil if tiering is disabled.
+func NewColdStrongStore(ctx context.Context, repoConfig *config.Repository) (StrongStore, error) {
+	if repoConfig.Tiering.ColdAfter <= 0 {
+		return nil, nil
+	}
+
+	s, err := newColdBackendStore(ctx, repoConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRetryStore(s, repoConfig.Retry), nil
+}
+
+func newColdBackendStore(ctx context.Context, repoConfig *config.Repository) (StrongStore, error) {
+	switch repoConfig.Backend {
+	case config.BackendS3, "":
+		if repoConfig.S3.ColdBucket == "" {
+			return nil, &errclass.ConfigError{Key: "repository.s3.cold_bucket", Err: errors.New("required when tiering is enabled")}
+		}
+
+		coldConfig := repoConfig.S3
+		coldConfig.Bucket = repoConfig.S3.ColdBucket
+		return NewS3StrongStorage(ctx, &coldConfig)
+
+	case config.BackendSwift:
+		if repoConfig.Swift.ColdContainer == "" {
+			return nil, &errclass.ConfigError{Key: "repository.swift.cold_container", Err: errors.New("required when tiering is enabled")}
+		}
+
+		coldConfig := repoConfig.Swift
+		coldConfig.Container = repoConfig.Swift.ColdContainer
+		return NewSwiftStrongStorage(ctx, &coldConfig)
+
+	case config.BackendRclone:
+		if repoConfig.Rclone.ColdRemote == "" {
+			return nil, &errclass.ConfigError{Key: "repository.rclone.cold_remote", Err: errors.New("required when tiering is enabled")}
+		}
+
+		coldConfig := repoConfig.Rclone
+		coldConfig.Remote = repoConfig.Rclone.ColdRemote
+		return NewRcloneStrongStorage(ctx, &coldConfig)
+
+	default:
+		return nil, &errclass.ConfigError{
+			Key: "repository.backend",
+			Err: fmt.Errorf("unknown backend %q. Valid values are: s3, swift, rclone", repoConfig.Backend),
+		}
+	}
+}
+
+const snapshotPrefix = "snaps/"
+
+// lockPrefix is where the lock objects of the repository live, one per
+// holder, so holders never overwrite each other's.
+const lockPrefix = "locks/"
+
+func lockPath(id string) string {
+	return lockPrefix + id + ".json"
+}
+
+// storeVersionPrefix is where earlier versions of the store are kept.
+const storeVersionPrefix = "store/v1/"
+
+func storeVersionPath(id string) string {
+	return storeVersionPrefix + id + ".json"
+}
+
+// parseObjectID is the inverse of lockPath and storeVersionPath: it returns
+// the ID of the object at p, if it is directly under prefix.
+func parseObjectID(prefix string, p string) (string, bool) {
+	name, ok := strings.CutPrefix(p, prefix)
+	if !ok || strings.Contains(name, "/") {
+		return "", false
+	}
+
+	return strings.CutSuffix(name, ".json")
+}
+
+// snapshotPath is the path of a snapshot object, relative to the bucket or
+// container.
+func snapshotPath(dataset string, snapshot string) string {
+	return path.Join("snaps", dataset, snapshot)
+}
+
+// snapshotDatasetPrefix is the prefix of the snapshot objects of dataset,
+// and of its children.
+func snapshotDatasetPrefix(dataset string) string {
+	return snapshotPath(dataset, "") + "/"
+}
+
+// datasetSnapshots returns the objects of dataset, leaving out those of its
+// children, which are listed under the same prefix.
+func datasetSnapshots(objects []SnapshotObject, dataset string) []SnapshotObject {
+	var filtered []SnapshotObject
+	for _, object := range objects {
+		if object.Dataset == dataset {
+			filtered = append(filtered, object)
+		}
+	}
+
+	return filtered
+}
+
+// parseSnapshotPath is the inverse of snapshotPath. Datasets may contain
+// slashes, so the snapshot is the last path element.
+func parseSnapshotPath(p string) (SnapshotObject, bool) {
+	rest, ok := strings.CutPrefix(p, snapshotPrefix)
+	if !ok {
+		return SnapshotObject{}, false
+	}
+
+	dataset, snapshot := path.Split(rest)
+	dataset = strings.TrimSuffix(dataset, "/")
+	if dataset == "" || snapshot == "" {
+		return SnapshotObject{}, false
+	}
+
+	return SnapshotObject{Dataset: dataset, Snapshot: snapshot}, true
 }
@@ -0,0 +1,664 @@
+// Package storagetest provides an in-memory storage.StrongStore for tests, so
+// backup, delete and restore flows can be exercised without an object store.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+// Op identifies a StrongStore operation for fault injection.
+type Op string
+
+const (
+	OpLoadStore Op = "load_store"
+	OpSaveStore Op = "save_store"
+	OpLoadHist  Op = "load_history"
+	OpSaveHist  Op = "save_history"
+	OpLoadKey   Op = "load_key_escrow"
+	OpSaveKey   Op = "save_key_escrow"
+	OpLoadAudit Op = "load_audit"
+	OpSaveAudit Op = "save_audit"
+	OpLoadJrnl  Op = "load_journal"
+	OpSaveJrnl  Op = "save_journal"
+	OpDelJrnl   Op = "delete_journal"
+	OpSaveVer   Op = "save_store_version"
+	OpSaveLock  Op = "save_lock"
+	OpLoadLocks Op = "load_locks"
+	OpDelLock   Op = "delete_lock"
+	OpWrite     Op = "write"
+	OpRead      Op = "read"
+	OpDelete    Op = "delete"
+	OpList      Op = "list"
+	OpStat      Op = "stat"
+)
+
+// MemoryStore is an in-memory storage.StrongStore. Like the real backends,
+// snapshots only become visible once their write stream is closed, and are
+// stored as written by the encryption, so they can be inspected raw.
+// It is safe for concurrent use.
+type MemoryStore struct {
+	mu        sync.Mutex
+	store     []byte
+	history   []byte
+	keyEscrow []byte
+	audit     []byte
+	journal   []byte
+	versions  map[string][]byte
+	locks     map[string][]byte
+	snapshots map[string][]byte
+	metadata  map[string]storage.SnapshotMetadata
+	faults    map[Op][]error
+	// readFaults fail the next read streams once they read past an
+	// offset.
+	readFaults []readFault
+}
+
+type readFault struct {
+	offset int64
+	err    error
+}
+
+var (
+	_ storage.StrongStore    = (*MemoryStore)(nil)
+	_ storage.RangeReadStore = (*MemoryStore)(nil)
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		versions:  map[string][]byte{},
+		locks:     map[string][]byte{},
+		snapshots: map[string][]byte{},
+		metadata:  map[string]storage.SnapshotMetadata{},
+		faults:    map[Op][]error{},
+	}
+}
+
+// FailNext makes the next call of op fail with err. Calling it several times
+// queues failures for consecutive calls.
+func (m *MemoryStore) FailNext(op Op, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.faults[op] = append(m.faults[op], err)
+}
+
+func (m *MemoryStore) fault(op Op) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queued := m.faults[op]
+	if len(queued) == 0 {
+		return nil
+	}
+
+	m.faults[op] = queued[1:]
+	return queued[0]
+}
+
+// FailReadAt makes the next snapshot read stream fail with err once it has
+// read offset bytes of the object, like a dropped connection. Calling it
+// several times queues failures for consecutive streams.
+func (m *MemoryStore) FailReadAt(offset int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.readFaults = append(m.readFaults, readFault{offset: offset, err: err})
+}
+
+func (m *MemoryStore) readFault() (readFault, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.readFaults) == 0 {
+		return readFault{}, false
+	}
+
+	fault := m.readFaults[0]
+	m.readFaults = m.readFaults[1:]
+	return fault, true
+}
+
+// StoreContent returns the last saved store content, or nil if the store was
+// never saved.
+func (m *MemoryStore) StoreContent() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return bytes.Clone(m.store)
+}
+
+// SetStoreContent replaces the store content, e.g. to load a fixture.
+func (m *MemoryStore) SetStoreContent(content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store = bytes.Clone(content)
+}
+
+// RawSnapshot returns a snapshot as stored, i.e. after encryption.
+func (m *MemoryStore) RawSnapshot(dataset string, snapshot string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, ok := m.snapshots[objectPath(dataset, snapshot)]
+	return bytes.Clone(content), ok
+}
+
+// Metadata returns the metadata the snapshot was written with.
+func (m *MemoryStore) Metadata(dataset string, snapshot string) (storage.SnapshotMetadata, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metadata, ok := m.metadata[objectPath(dataset, snapshot)]
+	return metadata, ok
+}
+
+// Snapshots returns the paths of all stored snapshots, sorted.
+func (m *MemoryStore) Snapshots() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := make([]string, 0, len(m.snapshots))
+	for p := range m.snapshots {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+
+	return paths
+}
+
+func (m *MemoryStore) LoadStoreContent(ctx context.Context) ([]byte, error) {
+	if err := m.fault(OpLoadStore); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.store == nil {
+		return nil, notFound("get", storePath)
+	}
+
+	return bytes.Clone(m.store), nil
+}
+
+func (m *MemoryStore) SaveStoreContent(ctx context.Context, content []byte) error {
+	if err := m.fault(OpSaveStore); err != nil {
+		return err
+	}
+
+	m.SetStoreContent(content)
+	return nil
+}
+
+func (m *MemoryStore) LoadHistoryContent(ctx context.Context) ([]byte, error) {
+	if err := m.fault(OpLoadHist); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.history == nil {
+		return nil, notFound("get", historyPath)
+	}
+
+	return bytes.Clone(m.history), nil
+}
+
+func (m *MemoryStore) SaveHistoryContent(ctx context.Context, content []byte) error {
+	if err := m.fault(OpSaveHist); err != nil {
+		return err
+	}
+
+	m.SetHistoryContent(content)
+	return nil
+}
+
+// HistoryContent returns the store history log, or nil if it was never saved.
+func (m *MemoryStore) HistoryContent() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return bytes.Clone(m.history)
+}
+
+// SetHistoryContent replaces the store history log, e.g. to tamper with it.
+func (m *MemoryStore) SetHistoryContent(content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.history = bytes.Clone(content)
+}
+
+func (m *MemoryStore) LoadKeyEscrowContent(ctx context.Context) ([]byte, error) {
+	if err := m.fault(OpLoadKey); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keyEscrow == nil {
+		return nil, notFound("get", keyEscrowPath)
+	}
+
+	return bytes.Clone(m.keyEscrow), nil
+}
+
+func (m *MemoryStore) SaveKeyEscrowContent(ctx context.Context, content []byte) error {
+	if err := m.fault(OpSaveKey); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keyEscrow = bytes.Clone(content)
+	return nil
+}
+
+func (m *MemoryStore) LoadAuditContent(ctx context.Context) ([]byte, error) {
+	if err := m.fault(OpLoadAudit); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.audit == nil {
+		return nil, notFound("get", auditPath)
+	}
+
+	return bytes.Clone(m.audit), nil
+}
+
+func (m *MemoryStore) SaveAuditContent(ctx context.Context, content []byte) error {
+	if err := m.fault(OpSaveAudit); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audit = bytes.Clone(content)
+	return nil
+}
+
+func (m *MemoryStore) LoadJournalContent(ctx context.Context) ([]byte, error) {
+	if err := m.fault(OpLoadJrnl); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.journal == nil {
+		return nil, notFound("get", journalPath)
+	}
+
+	return bytes.Clone(m.journal), nil
+}
+
+func (m *MemoryStore) SaveJournalContent(ctx context.Context, content []byte) error {
+	if err := m.fault(OpSaveJrnl); err != nil {
+		return err
+	}
+
+	m.SetJournalContent(content)
+	return nil
+}
+
+func (m *MemoryStore) DeleteJournalContent(ctx context.Context) error {
+	if err := m.fault(OpDelJrnl); err != nil {
+		return err
+	}
+
+	m.SetJournalContent(nil)
+	return nil
+}
+
+// JournalContent returns the journal, or nil if there is none.
+func (m *MemoryStore) JournalContent() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return bytes.Clone(m.journal)
+}
+
+// SetJournalContent replaces the journal, e.g. to leave one behind like an
+// interrupted save. nil deletes it.
+func (m *MemoryStore) SetJournalContent(content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.journal = bytes.Clone(content)
+}
+
+func (m *MemoryStore) SaveStoreVersionContent(ctx context.Context, id string, content []byte) error {
+	if err := m.fault(OpSaveVer); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.versions[id] = bytes.Clone(content)
+	return nil
+}
+
+func (m *MemoryStore) LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, ok := m.versions[id]
+	if !ok {
+		return nil, notFound("get", storeVersionPrefix+id+".json")
+	}
+
+	return bytes.Clone(content), nil
+}
+
+func (m *MemoryStore) ListStoreVersions(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.versions))
+	for id := range m.versions {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+func (m *MemoryStore) DeleteStoreVersionContent(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.versions, id)
+	return nil
+}
+
+func (m *MemoryStore) SaveLockContent(ctx context.Context, id string, content []byte) error {
+	if err := m.fault(OpSaveLock); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.locks[id] = bytes.Clone(content)
+	return nil
+}
+
+func (m *MemoryStore) LoadLockContents(ctx context.Context) (map[string][]byte, error) {
+	if err := m.fault(OpLoadLocks); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	locks := make(map[string][]byte, len(m.locks))
+	for id, content := range m.locks {
+		locks[id] = bytes.Clone(content)
+	}
+
+	return locks, nil
+}
+
+func (m *MemoryStore) DeleteLockContent(ctx context.Context, id string) error {
+	if err := m.fault(OpDelLock); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.locks, id)
+	return nil
+}
+
+func (m *MemoryStore) OpenSnapshotWriteStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	size int64,
+	encryption encryption.Encryption,
+) (io.WriteCloser, error) {
+	if err := m.fault(OpWrite); err != nil {
+		return nil, err
+	}
+
+	metadata, _ := storage.SnapshotMetadataFromContext(ctx)
+	w := &memoryWriteCloser{m: m, path: objectPath(dataset, snapshot), metadata: metadata}
+	enc, err := encryption.EncryptedWriter(&w.buf)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+	w.enc = enc
+
+	return w, nil
+}
+
+func (m *MemoryStore) OpenSnapshotReadStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	encryption encryption.Encryption,
+) (io.ReadCloser, error) {
+	if err := m.fault(OpRead); err != nil {
+		return nil, err
+	}
+
+	object, err := m.openSnapshotReader(dataset, snapshot, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := encryption.DecryptedReader(object)
+	if err != nil {
+		if errors.Is(err, errclass.ErrStorage) {
+			return nil, err
+		}
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return reader, nil
+}
+
+func (m *MemoryStore) OpenSnapshotReadStreamAt(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	offset int64,
+) (io.ReadCloser, error) {
+	if err := m.fault(OpRead); err != nil {
+		return nil, err
+	}
+
+	return m.openSnapshotReader(dataset, snapshot, offset)
+}
+
+func (m *MemoryStore) openSnapshotReader(dataset string, snapshot string, offset int64) (io.ReadCloser, error) {
+	p := objectPath(dataset, snapshot)
+	content, ok := m.RawSnapshot(dataset, snapshot)
+	if !ok {
+		return nil, notFound("get", p)
+	}
+
+	var reader io.Reader = bytes.NewReader(content[min(offset, int64(len(content))):])
+	if fault, ok := m.readFault(); ok {
+		reader = io.MultiReader(
+			io.LimitReader(reader, max(fault.offset-offset, 0)),
+			&failingReader{err: &errclass.StorageError{Op: "get", Backend: "memory", Path: p, Err: fault.err}},
+		)
+	}
+
+	return io.NopCloser(reader), nil
+}
+
+func (m *MemoryStore) DeleteSnapshot(ctx context.Context, dataset string, snapshot string) error {
+	if err := m.fault(OpDelete); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.snapshots, objectPath(dataset, snapshot))
+	delete(m.metadata, objectPath(dataset, snapshot))
+	return nil
+}
+
+func (m *MemoryStore) ListSnapshots(ctx context.Context) ([]storage.SnapshotObject, error) {
+	if err := m.fault(OpList); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	objects := make([]storage.SnapshotObject, 0, len(m.snapshots))
+	for p, content := range m.snapshots {
+		dataset, snapshot := path.Split(strings.TrimPrefix(p, "snaps/"))
+		objects = append(objects, storage.SnapshotObject{
+			Dataset:  strings.TrimSuffix(dataset, "/"),
+			Snapshot: snapshot,
+			Size:     int64(len(content)),
+		})
+	}
+
+	return objects, nil
+}
+
+func (m *MemoryStore) ListSnapshotObjects(ctx context.Context, dataset string) ([]storage.SnapshotObject, error) {
+	objects, err := m.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []storage.SnapshotObject
+	for _, object := range objects {
+		if object.Dataset == dataset {
+			filtered = append(filtered, object)
+		}
+	}
+
+	return filtered, nil
+}
+
+func (m *MemoryStore) StatSnapshot(ctx context.Context, dataset string, snapshot string) (storage.SnapshotObject, error) {
+	if err := m.fault(OpStat); err != nil {
+		return storage.SnapshotObject{}, err
+	}
+
+	content, ok := m.RawSnapshot(dataset, snapshot)
+	if !ok {
+		return storage.SnapshotObject{}, notFound("stat", objectPath(dataset, snapshot))
+	}
+
+	return storage.SnapshotObject{Dataset: dataset, Snapshot: snapshot, Size: int64(len(content))}, nil
+}
+
+var _ storage.AtomicReplaceStore = (*MemoryStore)(nil)
+
+// AtomicSnapshotReplace is always true, as a snapshot is only stored once its
+// write stream is closed.
+func (m *MemoryStore) AtomicSnapshotReplace() bool {
+	return true
+}
+
+var _ storage.ObjectLister = (*MemoryStore)(nil)
+
+func (m *MemoryStore) ListObjects(ctx context.Context) ([]storage.Object, error) {
+	if err := m.fault(OpList); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var objects []storage.Object
+	for p, content := range map[string][]byte{storePath: m.store, historyPath: m.history, keyEscrowPath: m.keyEscrow, auditPath: m.audit, journalPath: m.journal} {
+		if content != nil {
+			objects = append(objects, storage.Object{Path: p, Size: int64(len(content))})
+		}
+	}
+	for id, content := range m.versions {
+		objects = append(objects, storage.Object{Path: storeVersionPrefix + id + ".json", Size: int64(len(content))})
+	}
+	for id, content := range m.locks {
+		objects = append(objects, storage.Object{Path: "locks/" + id + ".json", Size: int64(len(content))})
+	}
+	for p, content := range m.snapshots {
+		objects = append(objects, storage.Object{Path: p, Size: int64(len(content))})
+	}
+
+	return objects, nil
+}
+
+type memoryWriteCloser struct {
+	m        *MemoryStore
+	path     string
+	metadata storage.SnapshotMetadata
+	buf      bytes.Buffer
+	enc      io.WriteCloser
+}
+
+func (w *memoryWriteCloser) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *memoryWriteCloser) Close() error {
+	if err := w.enc.Close(); err != nil {
+		return err
+	}
+
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+
+	w.m.snapshots[w.path] = bytes.Clone(w.buf.Bytes())
+	w.m.metadata[w.path] = w.metadata
+	return nil
+}
+
+// storePath, historyPath, keyEscrowPath, auditPath, journalPath,
+// storeVersionPrefix and objectPath mirror the layout of the real backends.
+const (
+	storePath     = "zfsbackrest_store_v1.json"
+	historyPath   = "zfsbackrest_history_v1.jsonl"
+	keyEscrowPath = "zfsbackrest_key_escrow_v1.age"
+	auditPath     = "zfsbackrest_audit_v1.jsonl"
+	journalPath   = "zfsbackrest_journal_v1.json"
+
+	storeVersionPrefix = "store/v1/"
+)
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func objectPath(dataset string, snapshot string) string {
+	return path.Join("snaps", dataset, snapshot)
+}
+
+func notFound(op string, p string) error {
+	return &errclass.StorageError{Op: op, Backend: "memory", Path: p, NotFound: true, Err: errclass.ErrNotFound}
+}
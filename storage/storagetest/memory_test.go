@@ -0,0 +1,171 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/gargakshit/zfsbackrest/storage"
+)
+
+func TestMemoryStoreSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	w, err := m.OpenSnapshotWriteStream(ctx, "tank/data", "snap", -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, ok := m.RawSnapshot("tank/data", "snap"); ok {
+		t.Fatal("snapshot visible before the write stream was closed")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	r, err := m.OpenSnapshotReadStream(ctx, "tank/data", "snap", encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open read stream: %v", err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", content)
+	}
+
+	if err := m.DeleteSnapshot(ctx, "tank/data", "snap"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	_, err = m.OpenSnapshotReadStream(ctx, "tank/data", "snap", encryption.Passthrough{})
+	if !errors.Is(err, errclass.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestMemoryStoreFailNext(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	injected := errors.New("injected")
+
+	m.FailNext(OpSaveStore, injected)
+
+	if err := m.SaveStoreContent(ctx, []byte("{}")); !errors.Is(err, injected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	if err := m.SaveStoreContent(ctx, []byte("{}")); err != nil {
+		t.Fatalf("expected second save to succeed, got %v", err)
+	}
+	if string(m.StoreContent()) != "{}" {
+		t.Fatalf("unexpected store content %q", m.StoreContent())
+	}
+}
+
+func TestRetryStoreResumesSnapshotRead(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	w, err := m.OpenSnapshotWriteStream(ctx, "tank/data", "snap", -1, encryption.Passthrough{})
+	if err != nil {
+		t.Fatalf("open write stream: %v", err)
+	}
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	store := storage.NewRetryStore(m, config.StorageRetry{MaxRetries: 2, InitialWait: time.Millisecond})
+
+	t.Run("resumes", func(t *testing.T) {
+		m.FailReadAt(3, io.ErrUnexpectedEOF)
+		m.FailReadAt(7, io.ErrUnexpectedEOF)
+
+		r, err := store.OpenSnapshotReadStream(ctx, "tank/data", "snap", encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open read stream: %v", err)
+		}
+		defer r.Close()
+
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(content) != "hello world" {
+			t.Fatalf("expected %q, got %q", "hello world", content)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		for range 3 {
+			m.FailReadAt(3, io.ErrUnexpectedEOF)
+		}
+
+		r, err := store.OpenSnapshotReadStream(ctx, "tank/data", "snap", encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open read stream: %v", err)
+		}
+		defer r.Close()
+
+		content, err := io.ReadAll(r)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected the read to fail after the retries, got %v", err)
+		}
+		if string(content) != "hel" {
+			t.Fatalf("expected %q before the failure, got %q", "hel", content)
+		}
+	})
+}
+
+func TestMemoryStoreListAndStatSnapshotObjects(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	for _, dataset := range []string{"tank/data", "tank/data/child"} {
+		w, err := m.OpenSnapshotWriteStream(ctx, dataset, "snap", -1, encryption.Passthrough{})
+		if err != nil {
+			t.Fatalf("open write stream: %v", err)
+		}
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+
+	objects, err := m.ListSnapshotObjects(ctx, "tank/data")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Dataset != "tank/data" || objects[0].Snapshot != "snap" {
+		t.Fatalf("expected only the snapshot of tank/data, got %+v", objects)
+	}
+
+	object, err := m.StatSnapshot(ctx, "tank/data/child", "snap")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if object.Size != 5 {
+		t.Fatalf("expected size 5, got %d", object.Size)
+	}
+
+	if _, err := m.StatSnapshot(ctx, "tank/data", "missing"); !errors.Is(err, errclass.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
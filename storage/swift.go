@@ -0,0 +1,974 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gargakshit/zfsbackrest/config"
+	"github.com/gargakshit/zfsbackrest/encryption"
+	"github.com/gargakshit/zfsbackrest/errclass"
+	"github.com/oklog/ulid/v2"
+)
+
+// SwiftStrongStorage is a storage implementation backed by OpenStack Swift.
+// Swift provides read-after-write consistency for new objects and overwrites
+// within a single region, which is what the store requires. Snapshots are
+// uploaded as static large objects, so their size is not limited by Swift's
+// maximum object size.
+type SwiftStrongStorage struct {
+	client      *http.Client
+	swiftConfig *config.SwiftStore
+
+	authLock    sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	endpoint    string
+}
+
+func NewSwiftStrongStorage(ctx context.Context, swiftConfig *config.SwiftStore) (*SwiftStrongStorage, error) {
+	slog.Debug("Creating Swift strong storage", "authURL", swiftConfig.AuthURL, "container", swiftConfig.Container)
+
+	if swiftConfig.AuthURL == "" || swiftConfig.Container == "" {
+		return nil, &errclass.ConfigError{Key: "repository.swift", Err: errors.New("auth_url and container are required")}
+	}
+
+	if swiftConfig.ApplicationCredentialID == "" && (swiftConfig.Username == "" || swiftConfig.Project == "") {
+		return nil, &errclass.ConfigError{
+			Key: "repository.swift",
+			Err: errors.New("either application_credential_id or username and project are required"),
+		}
+	}
+
+	if swiftConfig.SegmentSize == 0 {
+		return nil, &errclass.ConfigError{Key: "repository.swift.segment_size", Err: errors.New("must be greater than 0")}
+	}
+
+	s := &SwiftStrongStorage{
+		client:      &http.Client{},
+		swiftConfig: swiftConfig,
+	}
+
+	// Authenticate eagerly so misconfiguration fails fast.
+	if _, _, err := s.auth(ctx); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SwiftStrongStorage) LoadStoreContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, storePath)
+}
+
+func (s *SwiftStrongStorage) SaveStoreContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, storePath, content)
+}
+
+func (s *SwiftStrongStorage) LoadHistoryContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, historyPath)
+}
+
+func (s *SwiftStrongStorage) SaveHistoryContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, historyPath, content)
+}
+
+func (s *SwiftStrongStorage) LoadKeyEscrowContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, keyEscrowPath)
+}
+
+func (s *SwiftStrongStorage) SaveKeyEscrowContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, keyEscrowPath, content)
+}
+
+func (s *SwiftStrongStorage) LoadAuditContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, auditPath)
+}
+
+func (s *SwiftStrongStorage) SaveAuditContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, auditPath, content)
+}
+
+func (s *SwiftStrongStorage) LoadJournalContent(ctx context.Context) ([]byte, error) {
+	return s.loadObject(ctx, journalPath)
+}
+
+func (s *SwiftStrongStorage) SaveJournalContent(ctx context.Context, content []byte) error {
+	return s.saveObject(ctx, journalPath, content)
+}
+
+func (s *SwiftStrongStorage) DeleteJournalContent(ctx context.Context) error {
+	return s.deleteObject(ctx, journalPath)
+}
+
+func (s *SwiftStrongStorage) SaveLockContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, lockPath(id), content)
+}
+
+func (s *SwiftStrongStorage) SaveStoreVersionContent(ctx context.Context, id string, content []byte) error {
+	return s.saveObject(ctx, storeVersionPath(id), content)
+}
+
+func (s *SwiftStrongStorage) LoadStoreVersionContent(ctx context.Context, id string) ([]byte, error) {
+	return s.loadObject(ctx, storeVersionPath(id))
+}
+
+func (s *SwiftStrongStorage) ListStoreVersions(ctx context.Context) ([]string, error) {
+	return s.listIDs(ctx, storeVersionPrefix)
+}
+
+func (s *SwiftStrongStorage) DeleteStoreVersionContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, storeVersionPath(id))
+}
+
+func (s *SwiftStrongStorage) LoadLockContents(ctx context.Context) (map[string][]byte, error) {
+	ids, err := s.listIDs(ctx, lockPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	locks := map[string][]byte{}
+	for _, id := range ids {
+		content, err := s.loadObject(ctx, lockPath(id))
+		if errors.Is(err, errclass.ErrNotFound) {
+			// Released since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		locks[id] = content
+	}
+
+	return locks, nil
+}
+
+func (s *SwiftStrongStorage) DeleteLockContent(ctx context.Context, id string) error {
+	return s.deleteObject(ctx, lockPath(id))
+}
+
+// listIDs lists the IDs of the objects directly under prefix.
+func (s *SwiftStrongStorage) listIDs(ctx context.Context, prefix string) ([]string, error) {
+	slog.Debug("Listing objects", "container", s.swiftConfig.Container, "prefix", prefix)
+
+	var ids []string
+	err := s.list(ctx, prefix, func(name string, size int64) {
+		if id, ok := parseObjectID(prefix, name); ok {
+			ids = append(ids, id)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// deleteObject deletes the object at objectPath. Deleting a missing object
+// succeeds.
+func (s *SwiftStrongStorage) deleteObject(ctx context.Context, objectPath string) error {
+	slog.Debug("Deleting object", "container", s.swiftConfig.Container, "path", objectPath)
+
+	resp, err := s.do(ctx, http.MethodDelete, objectPath, "", nil, nil)
+	if err != nil {
+		if errors.Is(err, errclass.ErrNotFound) {
+			return nil
+		}
+
+		slog.Error("Failed to delete object", "path", objectPath, "error", err)
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *SwiftStrongStorage) loadObject(ctx context.Context, objectPath string) ([]byte, error) {
+	slog.Debug("Loading object", "container", s.swiftConfig.Container, "path", objectPath)
+
+	resp, err := s.do(ctx, http.MethodGet, objectPath, "", nil, nil)
+	if err != nil {
+		slog.Error("Failed to get object", "path", objectPath, "error", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Failed to read object", "path", objectPath, "error", err)
+		return nil, s.storageError("get", objectPath, err)
+	}
+
+	return content, nil
+}
+
+func (s *SwiftStrongStorage) saveObject(ctx context.Context, objectPath string, content []byte) error {
+	slog.Debug("Saving object", "container", s.swiftConfig.Container, "path", objectPath)
+
+	resp, err := s.do(ctx, http.MethodPut, objectPath, "", nil, bytes.NewReader(content))
+	if err != nil {
+		slog.Error("Failed to save object", "path", objectPath, "error", err)
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *SwiftStrongStorage) OpenSnapshotWriteStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	size int64,
+	encryption encryption.Encryption,
+) (io.WriteCloser, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Opening snapshot write stream", "container", s.swiftConfig.Container, "path", filePath)
+
+	segments := &swiftSegmentWriter{
+		ctx:         ctx,
+		s:           s,
+		objectPath:  filePath,
+		uploadID:    ulid.Make().String(),
+		segmentSize: int64(s.swiftConfig.SegmentSize),
+		metadata:    snapshotMetadata(ctx),
+	}
+
+	encWriter, err := encryption.EncryptedWriter(segments)
+	if err != nil {
+		return nil, &errclass.EncryptionError{Op: "encrypt", Err: err}
+	}
+
+	return &swiftEncryptedWriteCloser{enc: encWriter, segments: segments}, nil
+}
+
+func (s *SwiftStrongStorage) OpenSnapshotReadStream(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	encryption encryption.Encryption,
+) (io.ReadCloser, error) {
+	reader, err := s.OpenSnapshotReadStreamAt(ctx, dataset, snapshot, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedReader, err := encryption.DecryptedReader(reader)
+	if err != nil {
+		slog.Error("Failed to decrypt snapshot", "error", err)
+		_ = reader.Close()
+		return nil, &errclass.EncryptionError{Op: "decrypt", Err: err}
+	}
+
+	return wrappedReader, nil
+}
+
+var _ RangeReadStore = (*SwiftStrongStorage)(nil)
+
+func (s *SwiftStrongStorage) OpenSnapshotReadStreamAt(
+	ctx context.Context,
+	dataset string,
+	snapshot string,
+	offset int64,
+) (io.ReadCloser, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Opening snapshot read stream", "container", s.swiftConfig.Container, "path", filePath, "offset", offset)
+
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, filePath, "", header, nil)
+	if err != nil {
+		slog.Error("Failed to get snapshot", "error", err)
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *SwiftStrongStorage) DeleteSnapshot(ctx context.Context, dataset string, snapshot string) error {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Deleting snapshot", "container", s.swiftConfig.Container, "path", filePath)
+
+	// Deleting the manifest with multipart-manifest=delete removes the
+	// segments as well.
+	resp, err := s.do(ctx, http.MethodDelete, filePath, "multipart-manifest=delete", nil, nil)
+	if err != nil {
+		if errors.Is(err, errclass.ErrNotFound) {
+			slog.Debug("Snapshot already deleted", "path", filePath)
+			return nil
+		}
+
+		slog.Error("Failed to delete snapshot", "error", err)
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+var _ PartialUploadStore = (*SwiftStrongStorage)(nil)
+
+// AtomicSnapshotReplace is always true, as the manifest of a snapshot is only
+// replaced once the segments of the new upload are complete, and they are
+// named after the upload.
+func (s *SwiftStrongStorage) AtomicSnapshotReplace() bool {
+	return true
+}
+
+var _ AtomicReplaceStore = (*SwiftStrongStorage)(nil)
+
+// AbortPartialUpload removes the segments an interrupted upload of a snapshot
+// uploaded before its static large object manifest.
+func (s *SwiftStrongStorage) AbortPartialUpload(ctx context.Context, dataset string, snapshot string) error {
+	prefix := snapshotPath(dataset, snapshot) + "/segments/"
+	slog.Debug("Aborting partial upload", "container", s.swiftConfig.Container, "prefix", prefix)
+
+	deleted, err := s.deleteSegments(ctx, prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Partial upload aborted", "prefix", prefix, "segments", deleted)
+	return nil
+}
+
+// deleteSegments deletes the segments under prefix, other than the ones keep
+// reports true for, and returns how many it deleted.
+func (s *SwiftStrongStorage) deleteSegments(ctx context.Context, prefix string, keep func(name string) bool) (int, error) {
+	// Deleting segments changes the listing, so list them all first.
+	var segments []string
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("format", "json")
+		query.Set("prefix", prefix)
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query.Encode(), nil, nil)
+		if err != nil {
+			slog.Error("Failed to list segments", "error", err)
+			return 0, err
+		}
+
+		var page []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return 0, s.storageError("list", prefix, err)
+		}
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, entry := range page {
+			if keep == nil || !keep(entry.Name) {
+				segments = append(segments, entry.Name)
+			}
+		}
+		marker = page[len(page)-1].Name
+	}
+
+	for _, segment := range segments {
+		resp, err := s.do(ctx, http.MethodDelete, segment, "", nil, nil)
+		if err != nil {
+			if errors.Is(err, errclass.ErrNotFound) {
+				continue
+			}
+
+			slog.Error("Failed to delete segment", "path", segment, "error", err)
+			return 0, err
+		}
+		_ = resp.Body.Close()
+	}
+
+	return len(segments), nil
+}
+
+func (s *SwiftStrongStorage) ListSnapshots(ctx context.Context) ([]SnapshotObject, error) {
+	return s.listSnapshots(ctx, snapshotPrefix)
+}
+
+func (s *SwiftStrongStorage) ListSnapshotObjects(ctx context.Context, dataset string) ([]SnapshotObject, error) {
+	objects, err := s.listSnapshots(ctx, snapshotDatasetPrefix(dataset))
+	if err != nil {
+		return nil, err
+	}
+
+	return datasetSnapshots(objects, dataset), nil
+}
+
+// StatSnapshot returns the snapshot object. The size of a static large object
+// is the size of all of its segments.
+func (s *SwiftStrongStorage) StatSnapshot(ctx context.Context, dataset string, snapshot string) (SnapshotObject, error) {
+	filePath := snapshotPath(dataset, snapshot)
+	slog.Debug("Getting snapshot info", "container", s.swiftConfig.Container, "path", filePath)
+
+	resp, err := s.do(ctx, http.MethodHead, filePath, "", nil, nil)
+	if err != nil {
+		return SnapshotObject{}, err
+	}
+	_ = resp.Body.Close()
+
+	return SnapshotObject{Dataset: dataset, Snapshot: snapshot, Size: resp.ContentLength}, nil
+}
+
+func (s *SwiftStrongStorage) listSnapshots(ctx context.Context, prefix string) ([]SnapshotObject, error) {
+	slog.Debug("Listing snapshots", "container", s.swiftConfig.Container, "prefix", prefix)
+
+	var objects []SnapshotObject
+	err := s.list(ctx, prefix, func(name string, size int64) {
+		object, ok := parseSnapshotPath(name)
+		if !ok {
+			return
+		}
+
+		object.Size = size
+		objects = append(objects, object)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+var _ ObjectLister = (*SwiftStrongStorage)(nil)
+
+// ListObjects lists every object of the container. Static large objects are
+// listed with their full size, and their segments are left out.
+func (s *SwiftStrongStorage) ListObjects(ctx context.Context) ([]Object, error) {
+	slog.Debug("Listing objects", "container", s.swiftConfig.Container)
+
+	var objects []Object
+	err := s.list(ctx, "", func(name string, size int64) {
+		objects = append(objects, Object{Path: name, Size: size})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// list calls fn for every object of the container under prefix, page by
+// page, skipping the segments of static large objects.
+func (s *SwiftStrongStorage) list(ctx context.Context, prefix string, fn func(name string, size int64)) error {
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("format", "json")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query.Encode(), nil, nil)
+		if err != nil {
+			slog.Error("Failed to list objects", "prefix", prefix, "error", err)
+			return err
+		}
+
+		var page []struct {
+			Name  string `json:"name"`
+			Bytes int64  `json:"bytes"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return s.storageError("list", prefix, err)
+		}
+
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, entry := range page {
+			// Skip the segments of static large objects.
+			if strings.Contains(entry.Name, "/segments/") {
+				continue
+			}
+
+			fn(entry.Name, entry.Bytes)
+		}
+
+		marker = page[len(page)-1].Name
+	}
+}
+
+// do sends a request for an object in the container, or for the container
+// itself if objectPath is empty. Non-2xx responses are
+// returned as errors. On success, the caller must close the response body.
+func (s *SwiftStrongStorage) do(
+	ctx context.Context,
+	method string,
+	objectPath string,
+	query string,
+	header http.Header,
+	body io.Reader,
+) (*http.Response, error) {
+	op := strings.ToLower(method)
+
+	// Only bodies we can rewind are retried after re-authentication.
+	_, rewindable := body.(*bytes.Reader)
+	retryable := body == nil || rewindable
+
+	for attempt := 0; ; attempt++ {
+		token, endpoint, err := s.auth(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		u := endpoint + "/" + url.PathEscape(s.swiftConfig.Container)
+		if objectPath != "" {
+			u += "/" + escapeObjectPath(objectPath)
+		}
+		if query != "" {
+			u += "?" + query
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u, body)
+		if err != nil {
+			return nil, s.storageError(op, objectPath, err)
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Auth-Token", token)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, s.storageError(op, objectPath, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && retryable && attempt == 0 {
+			slog.Debug("Swift token rejected, re-authenticating", "path", objectPath)
+			_ = resp.Body.Close()
+			s.invalidateToken()
+			if r, ok := body.(*bytes.Reader); ok {
+				_, _ = r.Seek(0, io.SeekStart)
+			}
+			continue
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, s.responseError(op, objectPath, resp)
+		}
+
+		return resp, nil
+	}
+}
+
+func (s *SwiftStrongStorage) responseError(op string, objectPath string, resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return &errclass.StorageError{
+		Op:       op,
+		Backend:  "swift",
+		Path:     objectPath,
+		NotFound: resp.StatusCode == http.StatusNotFound,
+		Err:      &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(msg))},
+	}
+}
+
+// httpStatusError is returned when the backend answers a request with an
+// unexpected status.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Body)
+}
+
+func (s *SwiftStrongStorage) storageError(op string, objectPath string, err error) error {
+	return &errclass.StorageError{Op: op, Backend: "swift", Path: objectPath, Err: err}
+}
+
+func escapeObjectPath(objectPath string) string {
+	parts := strings.Split(objectPath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Keystone v3 authentication.
+
+func (s *SwiftStrongStorage) invalidateToken() {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	s.token = ""
+}
+
+// auth returns a valid token and the object-store endpoint, authenticating
+// against Keystone if the cached token is missing or about to expire.
+func (s *SwiftStrongStorage) auth(ctx context.Context) (string, string, error) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	if s.token != "" && time.Until(s.tokenExpiry) > time.Minute {
+		return s.token, s.endpoint, nil
+	}
+
+	slog.Debug("Authenticating with Keystone", "authURL", s.swiftConfig.AuthURL)
+
+	body, err := json.Marshal(s.authRequest())
+	if err != nil {
+		return "", "", s.authError(err)
+	}
+
+	u := strings.TrimSuffix(s.swiftConfig.AuthURL, "/") + "/auth/tokens"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", "", s.authError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", "", s.authError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", "", s.authError(fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+
+	var tokenResp keystoneTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", "", s.authError(fmt.Errorf("failed to decode token: %w", err))
+	}
+
+	endpoint := tokenResp.objectStoreEndpoint(s.swiftConfig.Region)
+	if endpoint == "" {
+		return "", "", s.authError(fmt.Errorf("no public object-store endpoint found in the service catalog for region %q", s.swiftConfig.Region))
+	}
+
+	s.token = resp.Header.Get("X-Subject-Token")
+	s.tokenExpiry = tokenResp.Token.ExpiresAt
+	s.endpoint = strings.TrimSuffix(endpoint, "/")
+
+	slog.Debug("Authenticated with Keystone", "endpoint", s.endpoint, "expires", s.tokenExpiry)
+
+	return s.token, s.endpoint, nil
+}
+
+func (s *SwiftStrongStorage) authError(err error) error {
+	return &errclass.StorageError{Op: "auth", Backend: "swift", Path: s.swiftConfig.AuthURL, Err: err}
+}
+
+func (s *SwiftStrongStorage) authRequest() map[string]any {
+	if s.swiftConfig.ApplicationCredentialID != "" {
+		return map[string]any{
+			"auth": map[string]any{
+				"identity": map[string]any{
+					"methods": []string{"application_credential"},
+					"application_credential": map[string]any{
+						"id":     s.swiftConfig.ApplicationCredentialID,
+						"secret": s.swiftConfig.ApplicationCredentialSecret,
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]any{
+		"auth": map[string]any{
+			"identity": map[string]any{
+				"methods": []string{"password"},
+				"password": map[string]any{
+					"user": map[string]any{
+						"name":     s.swiftConfig.Username,
+						"password": s.swiftConfig.Password,
+						"domain":   map[string]any{"name": s.swiftConfig.UserDomain},
+					},
+				},
+			},
+			"scope": map[string]any{
+				"project": map[string]any{
+					"name":   s.swiftConfig.Project,
+					"domain": map[string]any{"name": s.swiftConfig.ProjectDomain},
+				},
+			},
+		},
+	}
+}
+
+type keystoneTokenResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+func (r *keystoneTokenResponse) objectStoreEndpoint(region string) string {
+	for _, service := range r.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface != "public" {
+				continue
+			}
+			if region != "" && endpoint.Region != region && endpoint.RegionID != region {
+				continue
+			}
+
+			return endpoint.URL
+		}
+	}
+
+	return ""
+}
+
+// Static large object uploads.
+
+type swiftSLOSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// swiftSegmentWriter streams writes into fixed size segments, each uploaded
+// with a chunked PUT as it is written, and ties them together with a static
+// large object manifest on Close. At most one segment is in flight, and
+// segments are never buffered in memory.
+//
+// Segments are named after the upload, so overwriting a snapshot, e.g. to
+// re-encrypt it while it is read, leaves the segments of the current object
+// alone. They are deleted once the manifest of the new object replaced it.
+type swiftSegmentWriter struct {
+	ctx         context.Context
+	s           *SwiftStrongStorage
+	objectPath  string
+	uploadID    string
+	segmentSize int64
+	metadata    SnapshotMetadata
+
+	segments []swiftSLOSegment
+	current  *io.PipeWriter
+	done     chan swiftSegmentResult
+	written  int64
+	err      error
+}
+
+type swiftSegmentResult struct {
+	etag string
+	err  error
+}
+
+func (w *swiftSegmentWriter) segmentPrefix() string {
+	return w.objectPath + "/segments/" + w.uploadID + "/"
+}
+
+func (w *swiftSegmentWriter) segmentPath(i int) string {
+	return fmt.Sprintf("%s%08d", w.segmentPrefix(), i)
+}
+
+func (w *swiftSegmentWriter) startSegment() {
+	pr, pw := io.Pipe()
+	done := make(chan swiftSegmentResult, 1)
+	segmentPath := w.segmentPath(len(w.segments))
+
+	go func() {
+		resp, err := w.s.do(w.ctx, http.MethodPut, segmentPath, "", nil, pr)
+		if err != nil {
+			slog.Error("Failed to upload segment", "path", segmentPath, "error", err)
+			_ = pr.CloseWithError(err)
+			done <- swiftSegmentResult{err: err}
+			return
+		}
+
+		_ = resp.Body.Close()
+		done <- swiftSegmentResult{etag: strings.Trim(resp.Header.Get("Etag"), `"`)}
+	}()
+
+	w.current = pw
+	w.done = done
+	w.written = 0
+}
+
+func (w *swiftSegmentWriter) finishSegment() error {
+	_ = w.current.Close()
+	res := <-w.done
+	if res.err != nil {
+		return res.err
+	}
+
+	slog.Debug("Uploaded segment", "path", w.segmentPath(len(w.segments)), "size", w.written)
+
+	w.segments = append(w.segments, swiftSLOSegment{
+		Path:      "/" + w.s.swiftConfig.Container + "/" + w.segmentPath(len(w.segments)),
+		Etag:      res.etag,
+		SizeBytes: w.written,
+	})
+	w.current = nil
+
+	return nil
+}
+
+func (w *swiftSegmentWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if w.current == nil {
+			w.startSegment()
+		}
+
+		chunk := p[:min(int64(len(p)), w.segmentSize-w.written)]
+		n, err := w.current.Write(chunk)
+		total += n
+		w.written += int64(n)
+		p = p[n:]
+		if err != nil {
+			w.err = err
+			return total, err
+		}
+
+		if w.written == w.segmentSize {
+			if err := w.finishSegment(); err != nil {
+				w.err = err
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+func (w *swiftSegmentWriter) Close() error {
+	if w.err != nil {
+		if w.current != nil {
+			_ = w.current.CloseWithError(w.err)
+			<-w.done
+		}
+		w.abort()
+		return w.err
+	}
+
+	if w.current != nil {
+		if err := w.finishSegment(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	if err := w.putManifest(); err != nil {
+		w.abort()
+		return err
+	}
+
+	// The object was replaced, so the segments of any previous upload are
+	// no longer referenced.
+	deleted, err := w.s.deleteSegments(context.WithoutCancel(w.ctx), w.objectPath+"/segments/", func(name string) bool {
+		return strings.HasPrefix(name, w.segmentPrefix())
+	})
+	if err != nil {
+		slog.Warn("Failed to delete the segments of the replaced snapshot object", "path", w.objectPath, "error", err)
+	} else if deleted > 0 {
+		slog.Debug("Deleted the segments of the replaced snapshot object", "path", w.objectPath, "segments", deleted)
+	}
+
+	return nil
+}
+
+// abort deletes the segments of a failed upload. The object, if it exists,
+// still references its own segments, so it is left intact.
+func (w *swiftSegmentWriter) abort() {
+	if _, err := w.s.deleteSegments(context.WithoutCancel(w.ctx), w.segmentPrefix(), nil); err != nil {
+		slog.Warn("Failed to delete the segments of a failed upload", "prefix", w.segmentPrefix(), "error", err)
+	}
+}
+
+// putManifest ties the segments together. Swift checks the etag and size of
+// every segment against the manifest before it replaces the object, so an
+// incomplete upload never replaces it.
+func (w *swiftSegmentWriter) putManifest() error {
+	header := http.Header{}
+	header.Set("Content-Type", w.metadata.ContentType())
+	for key, value := range w.metadata.Fields() {
+		header.Set("X-Object-Meta-"+key, value)
+	}
+
+	if len(w.segments) == 0 {
+		// Swift rejects manifests without segments; upload an empty object.
+		resp, err := w.s.do(w.ctx, http.MethodPut, w.objectPath, "", header, bytes.NewReader(nil))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	manifest, err := json.Marshal(w.segments)
+	if err != nil {
+		return w.s.storageError("put", w.objectPath, err)
+	}
+
+	slog.Debug("Uploading static large object manifest", "path", w.objectPath, "segments", len(w.segments))
+
+	resp, err := w.s.do(w.ctx, http.MethodPut, w.objectPath, "multipart-manifest=put", header, bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+type swiftEncryptedWriteCloser struct {
+	enc      io.WriteCloser
+	segments *swiftSegmentWriter
+}
+
+func (w *swiftEncryptedWriteCloser) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *swiftEncryptedWriteCloser) Close() error {
+	// Close the encryption stream first to flush and finalize. If that fails,
+	// the manifest must not be written, or we'd commit a truncated object.
+	if err := w.enc.Close(); err != nil {
+		if w.segments.err == nil {
+			w.segments.err = err
+		}
+		_ = w.segments.Close()
+		return err
+	}
+
+	return w.segments.Close()
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// manifestSuffix and checksumSuffix are the suffixes of the manifest and
+// checksum objects of backups, which live next to their snapshots. See
+// repository.ManifestObjectName and repository.ChecksumObjectName.
+const (
+	manifestSuffix = ".manifest"
+	checksumSuffix = ".sha256"
+)
+
+// ErrUsageUnsupported is returned by MeasureUsage for stores that can't list
+// every object.
+var ErrUsageUnsupported = errors.New("store can't list its objects")
+
+// ObjectUsage is the number and total size of a group of objects.
+type ObjectUsage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (u *ObjectUsage) add(size int64) {
+	u.Objects++
+	u.Bytes += size
+}
+
+// Usage is the remote storage a repository actually takes up, as listed by
+// the backend. Unlike the sizes recorded in the store, it includes encryption
+// overhead, manifests, the store and its history, and objects the store
+// doesn't know about.
+type Usage struct {
+	Snapshots ObjectUsage `json:"snapshots"`
+	// Manifests are the manifest and checksum objects of backups.
+	Manifests ObjectUsage `json:"manifests"`
+	// Metadata is the store, its history and the escrowed key.
+	Metadata ObjectUsage `json:"metadata"`
+	Other    ObjectUsage `json:"other"`
+}
+
+// Total is the usage of every object.
+func (u *Usage) Total() ObjectUsage {
+	return ObjectUsage{
+		Objects: u.Snapshots.Objects + u.Manifests.Objects + u.Metadata.Objects + u.Other.Objects,
+		Bytes:   u.Snapshots.Bytes + u.Manifests.Bytes + u.Metadata.Bytes + u.Other.Bytes,
+	}
+}
+
+// MeasureUsage lists every object of s, and sums them up by kind. It returns
+// ErrUsageUnsupported if s isn't an ObjectLister.
+func MeasureUsage(ctx context.Context, s StrongStore) (*Usage, error) {
+	lister, ok := As[ObjectLister](s)
+	if !ok {
+		return nil, ErrUsageUnsupported
+	}
+
+	objects, err := lister.ListObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &Usage{}
+	for _, object := range objects {
+		switch {
+		case object.Path == storePath || object.Path == historyPath || object.Path == keyEscrowPath || object.Path == journalPath || object.Path == auditPath ||
+			strings.HasPrefix(object.Path, lockPrefix) || strings.HasPrefix(object.Path, storeVersionPrefix):
+			usage.Metadata.add(object.Size)
+		case strings.HasPrefix(object.Path, snapshotPrefix) &&
+			(strings.HasSuffix(object.Path, manifestSuffix) || strings.HasSuffix(object.Path, checksumSuffix)):
+			usage.Manifests.add(object.Size)
+		case strings.HasPrefix(object.Path, snapshotPrefix):
+			usage.Snapshots.add(object.Size)
+		default:
+			usage.Other.add(object.Size)
+		}
+	}
+
+	return usage, nil
+}
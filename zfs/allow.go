@@ -0,0 +1,172 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Grant is a set of permissions delegated with `zfs allow` to a user, a group,
+// or everyone. Perms may name permission sets, like @backup.
+type Grant struct {
+	// Kind is "user", "group" or "everyone".
+	Kind  string   `json:"kind"`
+	Name  string   `json:"name,omitempty"`
+	Perms []string `json:"perms"`
+}
+
+// Delegation is the permissions delegated on a dataset, including those
+// inherited from its ancestors.
+type Delegation struct {
+	Dataset string `json:"dataset"`
+	// Grants are the grants that apply to the dataset itself.
+	Grants []Grant `json:"grants"`
+	// Sets are the permission sets visible from the dataset. Sets defined
+	// closer to the dataset take precedence.
+	Sets map[string][]string `json:"sets"`
+}
+
+// Allowed returns the permissions delegated on a dataset.
+func (z *ZFS) Allowed(ctx context.Context, dataset string) (*Delegation, error) {
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "allow", dataset)
+	if err != nil {
+		slog.Error("Failed to get ZFS delegated permissions", "dataset", dataset, "error", err)
+		return nil, fmt.Errorf("failed to get ZFS delegated permissions: %w", err)
+	}
+
+	delegation, err := ParseAllowed(dataset, stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("ZFS delegated permissions", "dataset", dataset, "delegation", delegation)
+	return delegation, nil
+}
+
+// ParseAllowed parses the output of `zfs allow <dataset>`. The output has a
+// section for the dataset and each of its ancestors that has permissions
+// delegated on it, nearest first. Local permissions apply only to the dataset
+// of their section, and descendent permissions only to its descendants.
+func ParseAllowed(dataset string, output []byte) (*Delegation, error) {
+	delegation := &Delegation{Dataset: dataset, Sets: map[string][]string{}}
+
+	var section, kind string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			continue
+
+		case strings.HasPrefix(trimmed, "---- Permissions on "):
+			section = strings.TrimSpace(strings.TrimRight(strings.TrimPrefix(trimmed, "---- Permissions on "), "-"))
+			kind = ""
+
+		case !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " "):
+			// A heading, like "Local+Descendent permissions:".
+			kind = strings.TrimSuffix(trimmed, ":")
+
+		case section == "":
+			return nil, fmt.Errorf("unexpected line in zfs allow output: %q", line)
+
+		case kind == "Permission sets":
+			name, perms, ok := strings.Cut(trimmed, " ")
+			if !ok {
+				return nil, fmt.Errorf("invalid permission set in zfs allow output: %q", line)
+			}
+			// Sections are nearest first, so the nearest definition wins.
+			if _, defined := delegation.Sets[name]; !defined {
+				delegation.Sets[name] = splitPerms(perms)
+			}
+
+		case appliesTo(dataset, section, kind):
+			grant, err := parseGrant(trimmed)
+			if err != nil {
+				return nil, err
+			}
+			delegation.Grants = append(delegation.Grants, grant)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read zfs allow output: %w", err)
+	}
+
+	return delegation, nil
+}
+
+// appliesTo reports whether permissions of a kind, delegated on section, apply
+// to dataset.
+func appliesTo(dataset string, section string, kind string) bool {
+	switch kind {
+	case "Local permissions":
+		return section == dataset
+	case "Descendent permissions":
+		return section != dataset
+	case "Local+Descendent permissions":
+		return true
+	default:
+		// Create time permissions only apply to datasets created later.
+		return false
+	}
+}
+
+func parseGrant(line string) (Grant, error) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "everyone":
+		return Grant{Kind: "everyone", Perms: splitPerms(fields[1])}, nil
+	case len(fields) == 3 && (fields[0] == "user" || fields[0] == "group"):
+		return Grant{Kind: fields[0], Name: fields[1], Perms: splitPerms(fields[2])}, nil
+	default:
+		return Grant{}, fmt.Errorf("invalid grant in zfs allow output: %q", line)
+	}
+}
+
+func splitPerms(perms string) []string {
+	return strings.Split(perms, ",")
+}
+
+// PermissionsOf returns the permissions user, a member of groups, has on the
+// dataset, with permission sets expanded.
+func (d *Delegation) PermissionsOf(user string, groups []string) map[string]bool {
+	inGroup := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		inGroup[group] = true
+	}
+
+	perms := map[string]bool{}
+	var expand func(perm string, seen map[string]bool)
+	expand = func(perm string, seen map[string]bool) {
+		if !strings.HasPrefix(perm, "@") {
+			perms[perm] = true
+			return
+		}
+		// Sets can include other sets. Don't loop on cycles.
+		if seen[perm] {
+			return
+		}
+		seen[perm] = true
+		for _, p := range d.Sets[perm] {
+			expand(p, seen)
+		}
+	}
+
+	for _, grant := range d.Grants {
+		if grant.Kind == "user" && grant.Name != user ||
+			grant.Kind == "group" && !inGroup[grant.Name] {
+			continue
+		}
+
+		for _, perm := range grant.Perms {
+			expand(perm, map[string]bool{})
+		}
+	}
+
+	return perms
+}
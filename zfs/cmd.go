@@ -7,6 +7,8 @@ import (
 	"io"
 	"log/slog"
 	"os/exec"
+
+	"github.com/gargakshit/zfsbackrest/errclass"
 )
 
 // runZFSCmdWithStdoutCapture runs a zfs command and returns the output.
@@ -28,7 +30,7 @@ func runZFSCmdWithStdoutCapture(ctx context.Context, ignoreErrorCode1 bool, args
 			slog.Error("Failed to run zfs command", "error", err)
 		}
 
-		return nil, fmt.Errorf("failed to run zfs command: %w", err)
+		return nil, newZFSError(args, err)
 	}
 
 	slog.Debug("ZFS command output", "zfs", "zfs", "args", args, "output", string(output))
@@ -55,7 +57,7 @@ func runZFSCmdWithStreaming(ctx context.Context, args ...string) (io.ReadCloser,
 
 	if err := cmd.Start(); err != nil {
 		slog.Error("Failed to start zfs command", "error", err)
-		return nil, nil, fmt.Errorf("failed to start zfs command: %w", err)
+		return nil, nil, newZFSError(args, err)
 	}
 
 	return stdout, stderr, nil
@@ -71,10 +73,27 @@ func runZFSCmdWithStdinStreaming(ctx context.Context, stdin io.Reader, args ...s
 	stdout, err := cmd.Output()
 	if err != nil {
 		slog.Error("Failed to run zfs command", "error", err)
-		return nil, fmt.Errorf("failed to run zfs command: %w", err)
+		return nil, newZFSError(args, err)
 	}
 
 	slog.Debug("ZFS command output", "zfs", "zfs", "args", args, "output", string(stdout))
 
 	return stdout, nil
 }
+
+// newZFSError classifies a failed zfs invocation. The exec error stays in the
+// chain so callers can still inspect the exit code with errors.As.
+func newZFSError(args []string, err error) error {
+	zfsErr := &errclass.ZFSError{Args: args, Err: err}
+	if len(args) > 0 {
+		zfsErr.Op = args[0]
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		zfsErr.ExitCode = exitErr.ExitCode()
+		zfsErr.Stderr = string(exitErr.Stderr)
+	}
+
+	return zfsErr
+}
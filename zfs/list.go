@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gobwas/glob"
+	"github.com/oklog/ulid/v2"
 )
 
 func (z *ZFS) ListSnapshots(ctx context.Context, dataset string) ([]string, error) {
@@ -31,6 +34,86 @@ func (z *ZFS) ListSnapshots(ctx context.Context, dataset string) ([]string, erro
 	return snapshots, nil
 }
 
+// ListBackupSnapshots returns the IDs of the snapshots of dataset taken by
+// zfsbackrest.
+func (z *ZFS) ListBackupSnapshots(ctx context.Context, dataset string) ([]ulid.ULID, error) {
+	snapshots, err := z.ListSnapshots(ctx, dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := dataset + "@zfsbackrest-"
+	var ids []ulid.ULID
+	for _, snapshot := range snapshots {
+		name, ok := strings.CutPrefix(snapshot, prefix)
+		if !ok {
+			continue
+		}
+
+		id, err := ulid.ParseStrict(name)
+		if err != nil {
+			slog.Debug("Skipping snapshot not named after a backup", "snapshot", snapshot)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Snapshot is a snapshot of a dataset. Name is the name after the @.
+type Snapshot struct {
+	Name     string    `json:"name"`
+	GUID     string    `json:"guid"`
+	Creation time.Time `json:"creation"`
+}
+
+// ListSnapshotsByCreation returns the snapshots of dataset, oldest first.
+func (z *ZFS) ListSnapshotsByCreation(ctx context.Context, dataset string) ([]Snapshot, error) {
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false,
+		"list", "-H", "-p", "-t", "snapshot", "-d", "1", "-s", "createtxg", "-o", "name,guid,creation", dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := parseSnapshots(dataset, string(stdout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse snapshots of %s: %w", dataset, err)
+	}
+
+	slog.Debug("ZFS snapshot list by creation", "dataset", dataset, "snapshots", snapshots)
+	return snapshots, nil
+}
+
+func parseSnapshots(dataset string, output string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+
+		name, ok := strings.CutPrefix(fields[0], dataset+"@")
+		if !ok {
+			return nil, fmt.Errorf("snapshot %s is not of the dataset", fields[0])
+		}
+
+		creation, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse creation time of %s: %w", fields[0], err)
+		}
+
+		snapshots = append(snapshots, Snapshot{Name: name, GUID: fields[1], Creation: time.Unix(creation, 0)})
+	}
+
+	return snapshots, nil
+}
+
 func (z *ZFS) ListDatasets(ctx context.Context) ([]string, error) {
 	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "list", "-H", "-t", "filesystem", "-o", "name")
 	if err != nil {
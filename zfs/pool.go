@@ -0,0 +1,64 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// Pool is a pool and its health, as `zpool list` reports it, e.g. ONLINE or
+// DEGRADED.
+type Pool struct {
+	Name   string `json:"name"`
+	Health string `json:"health"`
+}
+
+// Pools lists the imported pools and their health.
+func (z *ZFS) Pools(ctx context.Context) ([]Pool, error) {
+	args := []string{"list", "-H", "-o", "name,health"}
+	slog.Debug("Running zpool command", "args", args)
+
+	stdout, err := exec.CommandContext(ctx, "zpool", args...).Output()
+	if err != nil {
+		slog.Error("Failed to run zpool command", "error", err)
+		return nil, newZFSError(append([]string{"zpool"}, args...), err)
+	}
+
+	return parsePools(string(stdout)), nil
+}
+
+func parsePools(output string) []Pool {
+	var pools []Pool
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		name, health, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		pools = append(pools, Pool{Name: name, Health: health})
+	}
+
+	return pools
+}
+
+// PoolGUID returns the GUID of the pool dataset is in. Unlike its name, it
+// tells apart pools of the same name on different machines.
+func (z *ZFS) PoolGUID(ctx context.Context, dataset string) (string, error) {
+	pool, _, _ := strings.Cut(dataset, "/")
+	args := []string{"get", "-H", "-p", "-o", "value", "guid", pool}
+	slog.Debug("Running zpool command", "args", args)
+
+	stdout, err := exec.CommandContext(ctx, "zpool", args...).Output()
+	if err != nil {
+		slog.Error("Failed to run zpool command", "error", err)
+		return "", newZFSError(append([]string{"zpool"}, args...), err)
+	}
+
+	guid := strings.TrimSpace(string(stdout))
+	if guid == "" || guid == "-" {
+		return "", fmt.Errorf("ZFS pool %s has no GUID", pool)
+	}
+
+	return guid, nil
+}
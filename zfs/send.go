@@ -2,18 +2,73 @@ package zfs
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gargakshit/zfsbackrest/internal/util"
 	"github.com/oklog/ulid/v2"
 )
 
+// SendOptions are options for SendSnapshot and EstimateSendSize.
+type SendOptions struct {
+	// Intermediates sends an incremental stream with -I instead of -i, so it
+	// carries every snapshot between from and the snapshot as well.
+	Intermediates bool
+	// Raw sends the blocks as they are on disk, with -w instead of -c, so
+	// encrypted datasets stay encrypted with their own key.
+	Raw bool
+	// Snapshot and From name the snapshots to send by their name after the
+	// @, for snapshots zfsbackrest didn't take. They take the place of the
+	// snapshots named after the backup IDs.
+	Snapshot string
+	From     string
+}
+
+// sendFlags returns the single letter flags of `zfs send`: large blocks,
+// parsable output, properties, and compressed or raw blocks.
+func sendFlags(opts SendOptions) string {
+	if opts.Raw {
+		return "LPpw"
+	}
+
+	return "LPpc"
+}
+
+// sendSnapshotName returns the name of the snapshot to send.
+func sendSnapshotName(dataset string, id ulid.ULID, opts SendOptions) string {
+	if opts.Snapshot != "" {
+		return dataset + "@" + opts.Snapshot
+	}
+
+	return snapshotName(dataset, id)
+}
+
+// incrementalArgs returns the arguments to send a stream from the snapshot
+// from, or none if from is nil and opts don't name one.
+func incrementalArgs(dataset string, from *ulid.ULID, opts SendOptions) []string {
+	var snap string
+	switch {
+	case opts.From != "":
+		snap = dataset + "@" + opts.From
+	case from != nil:
+		snap = snapshotName(dataset, *from)
+	default:
+		return []string{}
+	}
+
+	flag := "-i"
+	if opts.Intermediates {
+		flag = "-I"
+	}
+
+	return []string{flag, snap}
+}
+
 // SendSnapshot sends a snapshot to the write stream. The write stream is
 // expected to be a WriteCloser that will be closed when the snapshot is fully
 // sent.
@@ -23,20 +78,18 @@ func (z *ZFS) SendSnapshot(
 	id ulid.ULID,
 	from *ulid.ULID,
 	writeStream io.WriteCloser,
+	opts SendOptions,
 ) (int64, error) {
-	slog.Debug("Sending snapshot", "dataset", dataset, "id", id, "from", from)
+	slog.Debug("Sending snapshot", "dataset", dataset, "id", id, "from", from, "opts", opts)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	snap := snapshotName(dataset, id)
+	snap := sendSnapshotName(dataset, id, opts)
 
-	extraArgs := []string{}
-	if from != nil {
-		extraArgs = append(extraArgs, "-i", snapshotName(dataset, *from))
-	}
+	extraArgs := incrementalArgs(dataset, from, opts)
 
 	stdout, stderr, err := runZFSCmdWithStreaming(ctx,
-		append([]string{"send", "-LPpc", snap}, extraArgs...)...,
+		append([]string{"send", "-" + sendFlags(opts), snap}, extraArgs...)...,
 	)
 	if err != nil {
 		slog.Error("Failed to send snapshot", "error", err)
@@ -52,7 +105,7 @@ func (z *ZFS) SendSnapshot(
 
 	slog.Debug("Snapshot size", "size", size)
 
-	wrappedWriteStream := util.NewLoggedWriter(snap, writeStream, 5*time.Second, size)
+	wrappedWriteStream := util.NewLoggedWriter(snap, writeStream, size)
 
 	// We could've used io.CopyN and specified the size, but the size `zfs send`
 	// returns is not indicative of the actual size of the stream. It doesn't
@@ -64,7 +117,7 @@ func (z *ZFS) SendSnapshot(
 		return 0, fmt.Errorf("failed to copy snapshot: %w", err)
 	}
 
-	err = writeStream.Close()
+	err = wrappedWriteStream.Close()
 	if err != nil {
 		slog.Error("Failed to close write stream", "error", err)
 		return 0, fmt.Errorf("failed to close write stream: %w", err)
@@ -80,6 +133,29 @@ func (z *ZFS) SendSnapshot(
 	return n, nil
 }
 
+// EstimateSendSize returns the size `zfs send -nP` estimates for the stream
+// SendSnapshot would send, without sending it.
+func (z *ZFS) EstimateSendSize(ctx context.Context, dataset string, id ulid.ULID, from *ulid.ULID, opts SendOptions) (int64, error) {
+	snap := sendSnapshotName(dataset, id, opts)
+
+	extraArgs := incrementalArgs(dataset, from, opts)
+
+	// With -n, the parsable output is written to stdout.
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, append([]string{"send", "-n" + sendFlags(opts), snap}, extraArgs...)...)
+	if err != nil {
+		slog.Error("Failed to estimate snapshot send size", "snapshot", snap, "error", err)
+		return 0, fmt.Errorf("failed to estimate snapshot send size: %w", err)
+	}
+
+	size, err := getSnapshotSizeFromSendStderrReader(bytes.NewReader(stdout))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get estimated snapshot size: %w", err)
+	}
+
+	slog.Debug("Estimated snapshot send size", "snapshot", snap, "size", size)
+	return size, nil
+}
+
 func getSnapshotSizeFromSendStderrReader(stderr io.Reader) (int64, error) {
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
@@ -6,12 +6,19 @@ import (
 	"fmt"
 	"log/slog"
 	"os/exec"
+	"strings"
 
 	"github.com/oklog/ulid/v2"
 )
 
+// SnapshotName returns the name after the @ of the snapshot of the backup
+// with id.
+func SnapshotName(id ulid.ULID) string {
+	return "zfsbackrest-" + id.String()
+}
+
 func snapshotName(dataset string, id ulid.ULID) string {
-	return fmt.Sprintf("%s@zfsbackrest-%s", dataset, id.String())
+	return dataset + "@" + SnapshotName(id)
 }
 
 func (z *ZFS) CreateSnapshot(ctx context.Context, dataset string, id ulid.ULID) error {
@@ -57,6 +64,24 @@ func (z *ZFS) SnapshotExists(ctx context.Context, dataset string, id ulid.ULID)
 	return true, nil
 }
 
+// SnapshotGUID returns the GUID of a snapshot. A snapshot keeps its GUID when
+// it is sent and received, so it identifies the same snapshot on both sides.
+func (z *ZFS) SnapshotGUID(ctx context.Context, dataset string, id ulid.ULID) (string, error) {
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "get", "-H", "-p", "-o", "value", "guid", snapshotName(dataset, id))
+	if err != nil {
+		slog.Error("Failed to get ZFS snapshot GUID", "dataset", dataset, "id", id, "error", err)
+		return "", fmt.Errorf("failed to get ZFS snapshot GUID: %w", err)
+	}
+
+	guid := strings.TrimSpace(string(stdout))
+	if guid == "" || guid == "-" {
+		return "", fmt.Errorf("ZFS snapshot %s has no GUID", snapshotName(dataset, id))
+	}
+
+	slog.Debug("ZFS snapshot GUID", "dataset", dataset, "id", id, "guid", guid)
+	return guid, nil
+}
+
 const holdTag = "zfsbackrest-hold"
 
 func (z *ZFS) HoldSnapshot(ctx context.Context, dataset string, id ulid.ULID) error {
@@ -79,6 +104,25 @@ func (z *ZFS) HoldSnapshot(ctx context.Context, dataset string, id ulid.ULID) er
 	return nil
 }
 
+// SnapshotHeld reports whether zfsbackrest holds the snapshot.
+func (z *ZFS) SnapshotHeld(ctx context.Context, dataset string, id ulid.ULID) (bool, error) {
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "holds", "-H", snapshotName(dataset, id))
+	if err != nil {
+		slog.Error("Failed to list ZFS snapshot holds", "dataset", dataset, "id", id, "error", err)
+		return false, fmt.Errorf("failed to list ZFS snapshot holds: %w", err)
+	}
+
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 && fields[1] == holdTag {
+			return true, nil
+		}
+	}
+
+	slog.Debug("ZFS snapshot not held", "dataset", dataset, "id", id, "stdout", string(stdout))
+	return false, nil
+}
+
 func (z *ZFS) ReleaseSnapshot(ctx context.Context, ignoreErrorCode1 bool, dataset string, id ulid.ULID) error {
 	stdout, err := runZFSCmdWithStdoutCapture(ctx, ignoreErrorCode1, "release", holdTag, snapshotName(dataset, id))
 	if err != nil {
@@ -0,0 +1,66 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Space is the space usage of a dataset when a snapshot of it was taken.
+type Space struct {
+	// Used is the space used by the dataset, its snapshots and descendants.
+	Used int64
+	// Referenced is the data the snapshot refers to.
+	Referenced int64
+	// Written is the data written to the dataset between the since snapshot
+	// and this one, if a since snapshot was given.
+	Written *int64
+}
+
+// SnapshotSpace returns the space usage of a snapshot, and of the data written
+// since an earlier snapshot of the same dataset.
+func (z *ZFS) SnapshotSpace(ctx context.Context, dataset string, id ulid.ULID, since *ulid.ULID) (*Space, error) {
+	snap := snapshotName(dataset, id)
+
+	props := []string{"used", "referenced"}
+	written := ""
+	if since != nil {
+		written = "written@" + strings.TrimPrefix(snapshotName(dataset, *since), dataset+"@")
+		props = append(props, written)
+	}
+
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "get", "-H", "-p", "-o", "name,property,value", strings.Join(props, ","), dataset, snap)
+	if err != nil {
+		slog.Error("Failed to get ZFS snapshot space usage", "snapshot", snap, "error", err)
+		return nil, fmt.Errorf("failed to get ZFS snapshot space usage: %w", err)
+	}
+
+	space := &Space{}
+	for _, line := range strings.Split(strings.TrimSpace(string(stdout)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || fields[2] == "-" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s of %s: %w", fields[1], fields[0], err)
+		}
+
+		switch {
+		case fields[0] == dataset && fields[1] == "used":
+			space.Used = value
+		case fields[0] == snap && fields[1] == "referenced":
+			space.Referenced = value
+		case fields[0] == snap && fields[1] == written:
+			space.Written = &value
+		}
+	}
+
+	slog.Debug("ZFS snapshot space usage", "snapshot", snap, "space", space)
+	return space, nil
+}
@@ -0,0 +1,65 @@
+package zfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// A zfs send stream starts with a BEGIN record, which names the snapshot it
+// carries and the one it is incremental from, by GUID. Only the fields up to
+// the GUIDs are read.
+
+// StreamHeaderSize is the size of the start of a stream ParseStreamHeader
+// needs.
+const StreamHeaderSize = 56
+
+const (
+	drrBegin          = 0
+	drrMagic          = 0x2F5bacbac
+	dmuCompoundStream = 2
+)
+
+var ErrNotSendStream = errors.New("not a zfs send stream")
+
+// StreamHeader is the BEGIN record of a zfs send stream.
+type StreamHeader struct {
+	// ToGUID is the GUID of the snapshot the stream carries. With -I, it is
+	// the first snapshot after FromGUID.
+	ToGUID string
+	// FromGUID is the GUID of the snapshot the stream is incremental from,
+	// or empty for a full stream.
+	FromGUID string
+	// Compound is set for streams of several datasets, like those of
+	// `zfs send -R`. Their GUIDs are those of the outer record.
+	Compound bool
+}
+
+// ParseStreamHeader parses the BEGIN record at the start of a stream. The
+// stream is in the byte order of the host that sent it.
+func ParseStreamHeader(b []byte) (*StreamHeader, error) {
+	if len(b) < StreamHeaderSize {
+		return nil, ErrNotSendStream
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint64(b[8:]) != drrMagic {
+		order = binary.BigEndian
+		if order.Uint64(b[8:]) != drrMagic {
+			return nil, ErrNotSendStream
+		}
+	}
+	if order.Uint32(b[0:]) != drrBegin {
+		return nil, ErrNotSendStream
+	}
+
+	header := &StreamHeader{
+		ToGUID:   strconv.FormatUint(order.Uint64(b[40:]), 10),
+		Compound: order.Uint64(b[16:])&3 == dmuCompoundStream,
+	}
+	if from := order.Uint64(b[48:]); from != 0 {
+		header.FromGUID = strconv.FormatUint(from, 10)
+	}
+
+	return header, nil
+}
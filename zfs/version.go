@@ -0,0 +1,21 @@
+package zfs
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Version returns the versions `zfs version` reports for the userland tools
+// and the kernel module, e.g. "zfs-2.2.2-1, zfs-kmod-2.2.2-1". OpenZFS older
+// than 0.8 has no `zfs version`.
+func (z *ZFS) Version(ctx context.Context) (string, error) {
+	stdout, err := runZFSCmdWithStdoutCapture(ctx, false, "version")
+	if err != nil {
+		return "", err
+	}
+
+	version := strings.Join(strings.Fields(string(stdout)), ", ")
+	slog.Debug("ZFS version", "version", version)
+	return version, nil
+}